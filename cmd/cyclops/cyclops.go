@@ -92,7 +92,8 @@ func main() {
 	privateKey := parser.String("", "privatekey", &argparse.Options{Help: "Change private key of system (e.g. for recreating a system using a prior identity)", Default: ""})
 	disableHailo := parser.Flag("", "nohailo", &argparse.Options{Help: "Disable Hailo neural network accelerator support", Default: false})
 	modelsDir := parser.String("", "models", &argparse.Options{Help: "Neural network models directory", Default: nominalModelsDir})
-	nnModelName := parser.String("", "nn", &argparse.Options{Help: "Specify the neural network for object detection", Default: ""})
+	nnModelName := parser.String("", "nn", &argparse.Options{Help: "Specify the neural network for object detection. Custom models are named dataset/model, eg warehouse/yolov8s", Default: ""})
+	installModel := parser.String("", "install-model", &argparse.Options{Help: "Install the custom neural network (named by --nn) from this local directory, and then use it", Default: ""})
 	elevated := parser.Flag("", "elevated", &argparse.Options{Help: "Maintain elevated permissions, instead of setuid(username)", Default: false})
 	kernelWG := parser.Flag("", "kernelwg", &argparse.Options{Help: "(Internal) Run the kernel-mode wireguard interface", Default: false})
 	resetUser := parser.Flag("", "reset-user", &argparse.Options{Help: "Interactively ensure an admin user exists (to recover a system that you're locked out of)", Default: false})
@@ -209,6 +210,17 @@ func main() {
 		*modelsDir = actualDefaultModelsDir
 	}
 
+	if *installModel != "" {
+		if *nnModelName == "" {
+			logger.Errorf("--install-model requires --nn, eg --nn warehouse/yolov8s")
+			ExitNoRestart()
+		}
+		if err := nnload.InstallModel(logger, *installModel, *modelsDir, *nnModelName); err != nil {
+			logger.Errorf("Failed to install model: %v", err)
+			ExitNoRestart()
+		}
+	}
+
 	var ownIP net.IP
 	if *ownIPStr != "" {
 		ownIP = net.ParseIP(*ownIPStr)
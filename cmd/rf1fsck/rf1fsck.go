@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/fsv"
+	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/logs"
+)
+
+// Check the integrity of an fsv archive of rf1 files, and optionally repair them.
+// The Cyclops server must not be running while you do this.
+// The archive directory is the "fsv" directory inside the recording path, which contains
+// one directory per stream. If you have storage tiers, then pass the fsv directory of each tier.
+// For example:
+// rf1fsck /mnt/videos/fsv
+// rf1fsck -repair /mnt/videos/fsv /mnt/nas/videos/fsv
+// If the video is encrypted, then pass the config database, so that we can read the keys:
+// rf1fsck -config $HOME/cyclops/config.sqlite /mnt/videos/fsv
+
+func main() {
+	repair := false
+	configFile := ""
+	dirs := []string{}
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-repair" || arg == "--repair" {
+			repair = true
+		} else if (arg == "-config" || arg == "--config") && i+1 < len(args) {
+			configFile = args[i+1]
+			i++
+		} else {
+			dirs = append(dirs, arg)
+		}
+	}
+	if len(dirs) == 0 {
+		fmt.Printf("Usage: rf1fsck [-repair] [-config <config.sqlite>] <archive dir> [<archive dir>...]\n")
+		os.Exit(1)
+	}
+
+	format := &fsv.VideoFormatRF1{}
+	if configFile != "" {
+		keys, err := loadKeys(configFile)
+		if err != nil {
+			fmt.Printf("Error loading encryption keys: %v\n", err)
+			os.Exit(1)
+		}
+		format.Keys = keys
+	}
+
+	nFiles := 0
+	nBad := 0
+	nRepaired := 0
+	for _, dir := range dirs {
+		results, err := fsv.CheckArchive(dir, format, repair)
+		if err != nil {
+			fmt.Printf("Error checking %v: %v\n", dir, err)
+			os.Exit(1)
+		}
+		for _, r := range results {
+			nFiles++
+			if len(r.Problems) == 0 {
+				continue
+			}
+			nBad++
+			if r.Repaired {
+				nRepaired++
+			}
+			fmt.Printf("%v (%v)\n", r.Filename, r.StartTime.Format("2006-01-02 15:04:05"))
+			for _, p := range r.Problems {
+				fmt.Printf("  %v\n", p)
+			}
+		}
+	}
+
+	fmt.Printf("Checked %v files, %v with problems, %v repaired\n", nFiles, nBad, nRepaired)
+	if nBad != nRepaired {
+		if !repair {
+			fmt.Printf("Run with -repair to fix the problems\n")
+		}
+		os.Exit(1)
+	}
+}
+
+func loadKeys(configFile string) (*rf1.Keyring, error) {
+	if _, err := os.Stat(configFile); err != nil {
+		return nil, err
+	}
+	logger, err := logs.NewLog()
+	if err != nil {
+		return nil, err
+	}
+	configDB, err := configdb.NewConfigDB(logger, configFile, "")
+	if err != nil {
+		return nil, err
+	}
+	keys, err := configdb.GetVideoKeys(configDB.DB, false)
+	if err != nil {
+		return nil, err
+	}
+	return keys.Keyring()
+}
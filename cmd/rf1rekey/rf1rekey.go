@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/logs"
+)
+
+// Replace the video encryption key, and re-encrypt the data keys of all recordings
+// with the new key. The video itself is not re-encrypted, so this is fast.
+// The Cyclops server must not be running while you do this.
+// If we are interrupted, then run us again, and we'll resume where we left off.
+// Until we have finished, the server can still read all recordings, because it
+// keeps the previous key around.
+// For example:
+// rf1rekey $HOME/cyclops/config.sqlite
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Printf("Usage: rf1rekey <config.sqlite>\n")
+		os.Exit(1)
+	}
+	configFile := os.Args[1]
+	if _, err := os.Stat(configFile); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	logger, err := logs.NewLog()
+	if err != nil {
+		fmt.Printf("Error creating logger: %v\n", err)
+		os.Exit(1)
+	}
+	configDB, err := configdb.NewConfigDB(logger, configFile, "")
+	if err != nil {
+		fmt.Printf("Error opening config database: %v\n", err)
+		os.Exit(1)
+	}
+	keys, err := configdb.BeginVideoRekey(configDB.DB)
+	if err != nil {
+		fmt.Printf("Error creating new key: %v\n", err)
+		os.Exit(1)
+	}
+	keyring, err := keys.Keyring()
+	if err != nil {
+		fmt.Printf("Error loading keys: %v\n", err)
+		os.Exit(1)
+	}
+
+	config := configDB.GetConfig()
+	roots := []string{config.Recording.Path}
+	for _, tier := range config.Recording.Tiers {
+		roots = append(roots, tier.Path)
+	}
+
+	nFiles := 0
+	nTracks := 0
+	done := map[string]bool{}
+	for _, root := range roots {
+		dir := filepath.Join(root, "fsv")
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || !rf1.IsVideoFile(path) {
+				return nil
+			}
+			// Each track has its own index file, but Rekey handles all the tracks of a file
+			name := filepath.Base(path)
+			base := filepath.Join(filepath.Dir(path), name[:strings.Index(name, "_")])
+			if done[base] {
+				return nil
+			}
+			done[base] = true
+			n, err := rf1.Rekey(base, keyring)
+			if err != nil {
+				return fmt.Errorf("%v: %w", base, err)
+			}
+			nFiles++
+			nTracks += n
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Error re-keying %v: %v\n", dir, err)
+			os.Exit(1)
+		}
+	}
+
+	if err := configdb.FinishVideoRekey(configDB.DB); err != nil {
+		fmt.Printf("Error discarding previous key: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Checked %v files, re-keyed %v tracks\n", nFiles, nTracks)
+}
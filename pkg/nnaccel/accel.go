@@ -116,7 +116,7 @@ func (d *Device) LoadModel(filename string, setup *nn.ModelSetup) (*Model, error
 	var info C.NNModelInfo
 	C.NAModelInfo(d.accelerator.handle, model.handle, &info)
 	model.config.Architecture = "YOLOv8"  // ASSUMPTION
-	model.config.Classes = nn.COCOClasses // ASSUMPTION
+	model.config.Classes = nn.COCOClasses // ASSUMPTION, until the caller uses SetClasses()
 	model.config.Width = int(info.Width)
 	model.config.Height = int(info.Height)
 
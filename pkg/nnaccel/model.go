@@ -56,3 +56,9 @@ func (m *Model) DetectObjects(batch nn.ImageBatch, params *nn.DetectionParams) (
 func (m *Model) Config() *nn.ModelConfig {
 	return &m.config
 }
+
+// The accelerator doesn't know the names of the model's classes, so the caller
+// must set them from the model's JSON config.
+func (m *Model) SetClasses(classes []string) {
+	m.config.Classes = classes
+}
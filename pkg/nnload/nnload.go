@@ -10,13 +10,16 @@ package nnload
 import (
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/cyclopcam/cyclops/pkg/ncnn"
 	"github.com/cyclopcam/cyclops/pkg/nn"
 	"github.com/cyclopcam/cyclops/pkg/nnaccel"
+	"github.com/cyclopcam/cyclops/pkg/nnremote"
 	"github.com/cyclopcam/logs"
 )
 
@@ -66,25 +69,41 @@ func downloadFile(srcUrl, targetFile string) error {
 	return os.Rename(tempFile, targetFile)
 }
 
+// The dataset of our own models, which we download from models.cyclopcam.org
+const DefaultDataset = "coco"
+
+// Split a model name such as "warehouse/yolov8s" into its dataset ("warehouse") and
+// model ("yolov8s"). A name without a dataset, such as "yolov8m", is one of our COCO models.
+func SplitModelName(modelName string) (dataset, model string) {
+	if i := strings.LastIndexByte(modelName, '/'); i != -1 {
+		return modelName[:i], modelName[i+1:]
+	}
+	return DefaultDataset, modelName
+}
+
 func ModelFiles(device *nnaccel.Device, modelName string) (subdir string, ext []string) {
+	dataset, _ := SplitModelName(modelName)
 	if device != nil {
 		// subdir is eg "hailo/8L", for the "8L" accelerator.
 		subdir, ext := device.ModelFiles()
-		return "coco/" + subdir, ext
+		return dataset + "/" + subdir, ext
 	} else {
-		return "coco/ncnn", []string{".param", ".bin"}
+		return dataset + "/ncnn", []string{".param", ".bin"}
 	}
 }
 
 func ModelStub(modelName string, width, height int) string {
 	// eg "yolov8m_320_256"
-	return fmt.Sprintf("%v_%v_%v", modelName, width, height)
+	_, model := SplitModelName(modelName)
+	return fmt.Sprintf("%v_%v_%v", model, width, height)
 }
 
 // If the model files are not yet downloaded, then download them now.
 // Returns immediately if the files are already downloaded.
+// Only our own COCO models can be downloaded. Custom models must be installed with InstallModel().
 func DownloadModel(logs logs.Log, device *nnaccel.Device, modelDir, modelName string, width, height int) error {
 	baseUrl := "https://models.cyclopcam.org"
+	dataset, _ := SplitModelName(modelName)
 	subdir, ext := ModelFiles(device, modelName)
 	extensions := append([]string{".json"}, ext...)
 	modelStub := ModelStub(modelName, width, height)
@@ -93,6 +112,9 @@ func DownloadModel(logs logs.Log, device *nnaccel.Device, modelDir, modelName st
 		diskPath := filepath.Join(modelDir, subdir, modelStub+ext)
 		networkUrl := baseUrl + "/" + subdir + "/" + modelStub + ext
 		if _, err := os.Stat(diskPath); os.IsNotExist(err) {
+			if dataset != DefaultDataset {
+				return fmt.Errorf("Custom model file %v is not installed", diskPath)
+			}
 			logs.Infof("Downloading %v to %v", networkUrl, diskPath)
 			if err := downloadFile(networkUrl, diskPath); err != nil {
 				return err
@@ -105,9 +127,84 @@ func DownloadModel(logs logs.Log, device *nnaccel.Device, modelDir, modelName st
 	return nil
 }
 
+// Install a custom model from a local directory, without downloading anything.
+// srcDir must have the same layout as a dataset directory inside modelDir, for example:
+//
+//	srcDir/ncnn/yolov8s_320_256.json
+//	srcDir/ncnn/yolov8s_320_256.param
+//	srcDir/ncnn/yolov8s_320_256.bin
+//	srcDir/hailo/8L/yolov8s_320_256.json
+//	srcDir/hailo/8L/yolov8s_320_256.hef
+//
+// modelName is eg "warehouse/yolov8s", in which case the files above are copied into modelDir/warehouse.
+// Every .json file must be a valid nn.ModelConfig, with a list of classes.
+func InstallModel(logs logs.Log, srcDir, modelDir, modelName string) error {
+	dataset, model := SplitModelName(modelName)
+	if dataset == DefaultDataset {
+		return fmt.Errorf("Custom models need a dataset name that is not '%v', such as 'mydataset/%v'", DefaultDataset, model)
+	}
+	dstDir := filepath.Join(modelDir, dataset)
+	nFiles := 0
+	err := filepath.WalkDir(srcDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasPrefix(d.Name(), model+"_") {
+			return nil
+		}
+		if filepath.Ext(path) == ".json" {
+			config, err := nn.LoadModelConfig(path)
+			if err != nil {
+				return fmt.Errorf("Invalid model config %v: %w", path, err)
+			}
+			if len(config.Classes) == 0 {
+				return fmt.Errorf("Model config %v has no classes", path)
+			}
+		}
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		logs.Infof("Installing %v to %v", path, filepath.Join(dstDir, rel))
+		nFiles++
+		return copyFile(path, filepath.Join(dstDir, rel))
+	})
+	if err != nil {
+		return err
+	}
+	if nFiles == 0 {
+		return fmt.Errorf("No files for model '%v' found in %v", model, srcDir)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tempFile := dst + ".tmp"
+	out, err := os.Create(tempFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile, dst)
+}
+
 // LoadModel loads a neural network from disk.
 // If the model consists of several files, then modelName is the base filename, without the extensions.
-// modelName example is "yolov8m"
+// modelName example is "yolov8m", or "warehouse/yolov8s" for a custom model (see InstallModel).
 func LoadModel(logs logs.Log, device *nnaccel.Device, modelDir, modelName string, width, height int, threadingMode nn.ThreadingMode, modelSetup *nn.ModelSetup) (nn.ObjectDetector, error) {
 	// modelName examples:
 	// yolov8m
@@ -145,6 +242,8 @@ func LoadModel(logs logs.Log, device *nnaccel.Device, modelDir, modelName string
 		}
 		model, err := device.LoadModel(fullModelFilename, modelSetup)
 		if err == nil {
+			// The accelerator doesn't know the model's classes
+			model.SetClasses(config.Classes)
 			return model, nil
 		} else {
 			logs.Warnf("Failed to load accelerated NN model '%v': %v", modelName, err)
@@ -163,6 +262,33 @@ func LoadModel(logs logs.Log, device *nnaccel.Device, modelDir, modelName string
 	}
 }
 
+// LoadDetector is LoadModel, but if remote is not nil, then the model runs on a remote server.
+// In that case, the local model is only loaded if the remote server fails.
+func LoadDetector(logs logs.Log, remote *nnremote.ClientOptions, device *nnaccel.Device, modelDir, modelName string, width, height int, threadingMode nn.ThreadingMode, modelSetup *nn.ModelSetup) (nn.ObjectDetector, error) {
+	if remote == nil {
+		return LoadModel(logs, device, modelDir, modelName, width, height, threadingMode, modelSetup)
+	}
+
+	// We need the local config up front, in case the server is not reachable right now.
+	// We don't load the model itself, because that costs a lot of memory, and we hope to never need it.
+	var localConfig *nn.ModelConfig
+	var loadFallback func() (nn.ObjectDetector, error)
+	if err := DownloadModel(logs, device, modelDir, modelName, width, height); err != nil {
+		logs.Warnf("No local fallback for remote NN model '%v': %v", modelName, err)
+	} else {
+		modelSubDir, _ := ModelFiles(device, modelName)
+		localConfig, err = nn.LoadModelConfig(filepath.Join(modelDir, modelSubDir, ModelStub(modelName, width, height)+".json"))
+		if err != nil {
+			logs.Warnf("No local fallback for remote NN model '%v': %v", modelName, err)
+		} else {
+			loadFallback = func() (nn.ObjectDetector, error) {
+				return LoadModel(logs, device, modelDir, modelName, width, height, threadingMode, modelSetup)
+			}
+		}
+	}
+	return nnremote.NewClient(logs, *remote, modelName, localConfig, loadFallback)
+}
+
 func LoadAccelerators(logs logs.Log, enableHailo bool) {
 	if isLoaded {
 		logs.Warnf("Accelerators already loaded")
@@ -0,0 +1,192 @@
+package nnremote
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/cyclops/pkg/requests"
+	"github.com/cyclopcam/logs"
+)
+
+const (
+	DefaultTimeout       = 2 * time.Second
+	DefaultRetryInterval = 30 * time.Second
+)
+
+// ClientOptions describes the remote server that runs our models
+type ClientOptions struct {
+	URL           string        // Base URL of the server, eg "http://192.168.1.20"
+	Key           string        // Must match the server's key
+	Timeout       time.Duration // Timeout of each request. Zero = DefaultTimeout.
+	RetryInterval time.Duration // After a failure, we use the local fallback for this long, before trying the server again. Zero = DefaultRetryInterval.
+}
+
+// Client is an nn.ObjectDetector that runs a model on a remote Server.
+// If the server is unreachable, then it falls back to running the model locally.
+type Client struct {
+	log       logs.Log
+	options   ClientOptions
+	modelName string
+	config    nn.ModelConfig
+	http      *http.Client
+
+	lock           sync.Mutex
+	loadFallback   func() (nn.ObjectDetector, error) // Nil if there is no fallback
+	fallback       nn.ObjectDetector                 // Loaded the first time the server fails
+	fallbackErr    error                             // Error from loadFallback
+	remoteDownTill time.Time                         // Use the fallback until this time
+}
+
+// Create a client for the model 'modelName' on the remote server.
+// localConfig is the config of the local fallback model, or nil if there is no fallback.
+// loadFallback is called the first time that the remote server fails. It may be nil.
+// If the server is reachable, then we use its model config (the server's model may have a different
+// resolution to our local model, but it must detect the same classes). If the server is not reachable,
+// then we use localConfig. This means that the fallback must accept images of the server's resolution,
+// which is true of NCNN.
+func NewClient(log logs.Log, options ClientOptions, modelName string, localConfig *nn.ModelConfig, loadFallback func() (nn.ObjectDetector, error)) (*Client, error) {
+	if options.Timeout == 0 {
+		options.Timeout = DefaultTimeout
+	}
+	if options.RetryInterval == 0 {
+		options.RetryInterval = DefaultRetryInterval
+	}
+	options.URL = strings.TrimSuffix(options.URL, "/")
+	c := &Client{
+		log:          log,
+		options:      options,
+		modelName:    modelName,
+		http:         &http.Client{Timeout: options.Timeout},
+		loadFallback: loadFallback,
+	}
+
+	remoteConfig, err := c.fetchConfig()
+	if err == nil {
+		if localConfig != nil && !slices.Equal(remoteConfig.Classes, localConfig.Classes) {
+			return nil, fmt.Errorf("Remote model '%v' at %v detects different classes to our local model", modelName, options.URL)
+		}
+		c.config = *remoteConfig
+	} else if localConfig != nil {
+		log.Warnf("NN server %v is not available (%v). Using local model '%v' until it is", options.URL, err, modelName)
+		c.config = *localConfig
+		c.remoteDownTill = time.Now().Add(options.RetryInterval)
+	} else {
+		return nil, err
+	}
+	log.Infof("Running NN model '%v' (%v x %v) on %v", modelName, c.config.Width, c.config.Height, options.URL)
+	return c, nil
+}
+
+func (c *Client) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.fallback != nil {
+		c.fallback.Close()
+		c.fallback = nil
+	}
+}
+
+func (c *Client) Config() *nn.ModelConfig {
+	return &c.config
+}
+
+func (c *Client) DetectObjects(batch nn.ImageBatch, params *nn.DetectionParams) ([][]nn.ObjectDetection, error) {
+	c.lock.Lock()
+	remoteDown := time.Now().Before(c.remoteDownTill)
+	c.lock.Unlock()
+
+	if !remoteDown {
+		result, err := c.detectRemote(batch, params)
+		if err == nil {
+			return result, nil
+		}
+		c.lock.Lock()
+		if time.Now().After(c.remoteDownTill) {
+			c.log.Warnf("NN server %v failed: %v. Using local model for %v", c.options.URL, err, c.options.RetryInterval)
+		}
+		c.remoteDownTill = time.Now().Add(c.options.RetryInterval)
+		c.lock.Unlock()
+	}
+
+	fallback, err := c.getFallback()
+	if err != nil {
+		return nil, err
+	}
+	return fallback.DetectObjects(batch, params)
+}
+
+func (c *Client) getFallback() (nn.ObjectDetector, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.fallback == nil && c.fallbackErr == nil {
+		if c.loadFallback == nil {
+			c.fallbackErr = fmt.Errorf("NN server %v is not available, and there is no local model", c.options.URL)
+		} else {
+			c.log.Infof("Loading local NN model '%v'", c.modelName)
+			c.fallback, c.fallbackErr = c.loadFallback()
+		}
+	}
+	return c.fallback, c.fallbackErr
+}
+
+func (c *Client) fetchConfig() (*nn.ModelConfig, error) {
+	req, err := http.NewRequest("GET", c.options.URL+ModelsPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	models := map[string]*nn.ModelConfig{}
+	if err := c.do(req, &models); err != nil {
+		return nil, err
+	}
+	config := models[c.modelName]
+	if config == nil {
+		return nil, fmt.Errorf("Model '%v' is not available on %v", c.modelName, c.options.URL)
+	}
+	return config, nil
+}
+
+func (c *Client) detectRemote(batch nn.ImageBatch, params *nn.DetectionParams) ([][]nn.ObjectDetection, error) {
+	query := detectRequest{
+		model:     c.modelName,
+		batchSize: batch.BatchSize,
+		width:     batch.Width,
+		height:    batch.Height,
+		nchan:     batch.NChan,
+		params:    *params,
+	}
+	req, err := http.NewRequest("POST", c.options.URL+DetectPath+"?"+query.encode(), bytes.NewReader(packBatch(batch)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	result := [][]nn.ObjectDetection{}
+	if err := c.do(req, &result); err != nil {
+		return nil, err
+	}
+	if len(result) != batch.BatchSize {
+		return nil, fmt.Errorf("Expected %v results from NN server, but got %v", batch.BatchSize, len(result))
+	}
+	return result, nil
+}
+
+func (c *Client) do(req *http.Request, response any) error {
+	setAuthHeader(req, c.options.Key)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return requests.NewError(resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
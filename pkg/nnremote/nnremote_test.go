@@ -0,0 +1,173 @@
+package nnremote
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/logs"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDetector "detects" one object per image, whose class is the value of the image's first pixel
+type fakeDetector struct {
+	config nn.ModelConfig
+	delay  time.Duration
+
+	lock       sync.Mutex
+	batchSizes []int
+}
+
+func (f *fakeDetector) Close() {}
+
+func (f *fakeDetector) Config() *nn.ModelConfig {
+	return &f.config
+}
+
+func (f *fakeDetector) DetectObjects(batch nn.ImageBatch, params *nn.DetectionParams) ([][]nn.ObjectDetection, error) {
+	time.Sleep(f.delay)
+	f.lock.Lock()
+	f.batchSizes = append(f.batchSizes, batch.BatchSize)
+	f.lock.Unlock()
+	result := make([][]nn.ObjectDetection, batch.BatchSize)
+	for i := range result {
+		img := batch.Image(i)
+		// The last pixel checks that the rows were packed correctly
+		last := img.Pixels[(batch.Height-1)*batch.Stride+(batch.Width-1)*batch.NChan]
+		result[i] = []nn.ObjectDetection{{Class: int(img.Pixels[0]), Confidence: params.ProbabilityThreshold, Box: nn.MakeRect(int(last), 0, 1, 1)}}
+	}
+	return result, nil
+}
+
+func newFakeDetector() *fakeDetector {
+	return &fakeDetector{config: nn.ModelConfig{Width: 4, Height: 2, Classes: []string{"person", "car"}}}
+}
+
+func startServer(t *testing.T, options ServerOptions, detector nn.ObjectDetector) (*Server, *httptest.Server) {
+	server, err := NewServer(logs.NewTestingLog(t), options)
+	require.NoError(t, err)
+	server.AddModel("yolov8m", detector)
+	mux := http.NewServeMux()
+	mux.HandleFunc(ModelsPath, server.HandleModels)
+	mux.HandleFunc(DetectPath, server.HandleDetect)
+	httpServer := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		httpServer.Close()
+		server.Close()
+	})
+	return server, httpServer
+}
+
+// Make a batch of images with padding between rows and between images, where the first
+// and last pixel of image i is 'i'.
+func makeTestBatch(n, width, height int) nn.ImageBatch {
+	stride := width*3 + 5
+	batchStride := stride*height + 7
+	pixels := make([]byte, n*batchStride)
+	for i := 0; i < n; i++ {
+		pixels[i*batchStride] = byte(i)
+		pixels[i*batchStride+(height-1)*stride+(width-1)*3] = byte(i)
+	}
+	return nn.MakeImageBatch(n, batchStride, width, height, 3, stride, pixels)
+}
+
+func TestRemoteDetect(t *testing.T) {
+	remote := newFakeDetector()
+	remote.config.Width = 8
+	_, httpServer := startServer(t, ServerOptions{Key: "secret"}, remote)
+
+	local := newFakeDetector()
+	client, err := NewClient(logs.NewTestingLog(t), ClientOptions{URL: httpServer.URL, Key: "secret"}, "yolov8m", &local.config, nil)
+	require.NoError(t, err)
+	defer client.Close()
+	// We adopt the resolution of the remote model
+	require.Equal(t, 8, client.Config().Width)
+
+	params := nn.NewDetectionParams()
+	params.ProbabilityThreshold = 0.25
+	result, err := client.DetectObjects(makeTestBatch(3, 8, 2), params)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(result))
+	for i := 0; i < 3; i++ {
+		require.Equal(t, i, result[i][0].Class)
+		require.Equal(t, int32(i), result[i][0].Box.X)
+		require.Equal(t, float32(0.25), result[i][0].Confidence)
+	}
+
+	// Mismatched image size
+	_, err = client.detectRemote(makeTestBatch(1, 4, 2), params)
+	require.Error(t, err)
+
+	// Unknown model
+	_, err = NewClient(logs.NewTestingLog(t), ClientOptions{URL: httpServer.URL, Key: "secret"}, "yolov8x", nil, nil)
+	require.Error(t, err)
+
+	// Different classes
+	local.config.Classes = []string{"forklift"}
+	_, err = NewClient(logs.NewTestingLog(t), ClientOptions{URL: httpServer.URL, Key: "secret"}, "yolov8m", &local.config, nil)
+	require.Error(t, err)
+}
+
+func TestServerBatching(t *testing.T) {
+	remote := newFakeDetector()
+	_, httpServer := startServer(t, ServerOptions{Key: "secret", MaxBatch: 4, BatchWindow: 500 * time.Millisecond}, remote)
+
+	client, err := NewClient(logs.NewTestingLog(t), ClientOptions{URL: httpServer.URL, Key: "secret"}, "yolov8m", nil, nil)
+	require.NoError(t, err)
+
+	// Four clients (eg four cameras) send a single image each, at the same time
+	var wg sync.WaitGroup
+	var nOK atomic.Int32
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batch := makeTestBatch(1, 4, 2)
+			batch.Pixels[0] = byte(i)
+			result, err := client.DetectObjects(batch, nn.NewDetectionParams())
+			if err == nil && result[0][0].Class == i {
+				nOK.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(4), nOK.Load())
+	// All four images were run through the detector together
+	require.Equal(t, []int{4}, remote.batchSizes)
+}
+
+func TestFallback(t *testing.T) {
+	remote := newFakeDetector()
+	remote.delay = 300 * time.Millisecond
+	_, httpServer := startServer(t, ServerOptions{Key: "secret"}, remote)
+
+	local := newFakeDetector()
+	nLoads := 0
+	loadLocal := func() (nn.ObjectDetector, error) {
+		nLoads++
+		return local, nil
+	}
+
+	// The remote is too slow, so we use the local model, and keep using it until RetryInterval expires
+	client, err := NewClient(logs.NewTestingLog(t), ClientOptions{URL: httpServer.URL, Key: "secret", Timeout: 100 * time.Millisecond, RetryInterval: time.Hour}, "yolov8m", &local.config, loadLocal)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = client.DetectObjects(makeTestBatch(1, 4, 2), nn.NewDetectionParams())
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, nLoads)
+	require.Equal(t, 3, len(local.batchSizes))
+
+	// Wrong key
+	_, err = NewClient(logs.NewTestingLog(t), ClientOptions{URL: httpServer.URL, Key: "wrong"}, "yolov8m", nil, nil)
+	require.ErrorContains(t, err, "401")
+
+	// Unreachable server, with no local model
+	httpServer.Close()
+	_, err = NewClient(logs.NewTestingLog(t), ClientOptions{URL: httpServer.URL, Key: "secret"}, "yolov8m", nil, nil)
+	require.Error(t, err)
+}
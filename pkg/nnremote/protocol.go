@@ -0,0 +1,124 @@
+package nnremote
+
+// Package nnremote runs object detection on another machine, over HTTP.
+// This allows one system with an NN accelerator to run inference for several
+// smaller systems (eg Raspberry Pis), which can't keep up with many cameras on their own.
+//
+// The protocol is simple:
+//
+//	GET  /api/nn/models                      Returns map[string]nn.ModelConfig of the models that the server runs
+//	POST /api/nn/detect?model=yolov8m&...    Body is a batch of tightly packed RGB images. Returns [][]nn.ObjectDetection
+//
+// Both requests must include the header "Authorization: Bearer <key>".
+// Images are sent uncompressed, so this is intended for a LAN.
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cyclopcam/cyclops/pkg/nn"
+)
+
+const (
+	ModelsPath = "/api/nn/models"
+	DetectPath = "/api/nn/detect"
+)
+
+// Parameters of a detect request, which are sent in the query string
+type detectRequest struct {
+	model     string
+	batchSize int
+	width     int
+	height    int
+	nchan     int
+	params    nn.DetectionParams
+}
+
+func (d *detectRequest) imageBytes() int {
+	return d.width * d.height * d.nchan
+}
+
+func (d *detectRequest) encode() string {
+	q := url.Values{}
+	q.Set("model", d.model)
+	q.Set("batch", strconv.Itoa(d.batchSize))
+	q.Set("width", strconv.Itoa(d.width))
+	q.Set("height", strconv.Itoa(d.height))
+	q.Set("nchan", strconv.Itoa(d.nchan))
+	q.Set("prob", strconv.FormatFloat(float64(d.params.ProbabilityThreshold), 'g', -1, 32))
+	q.Set("nms", strconv.FormatFloat(float64(d.params.NmsIouThreshold), 'g', -1, 32))
+	if d.params.Unclipped {
+		q.Set("unclipped", "1")
+	}
+	return q.Encode()
+}
+
+func parseDetectRequest(q url.Values) (*detectRequest, error) {
+	d := &detectRequest{
+		model: q.Get("model"),
+	}
+	ints := []struct {
+		name string
+		dst  *int
+		max  int
+	}{
+		{"batch", &d.batchSize, 64},
+		{"width", &d.width, 4096},
+		{"height", &d.height, 4096},
+		{"nchan", &d.nchan, 3},
+	}
+	for _, v := range ints {
+		n, err := strconv.Atoi(q.Get(v.name))
+		if err != nil || n < 1 || n > v.max {
+			return nil, fmt.Errorf("Invalid %v '%v'", v.name, q.Get(v.name))
+		}
+		*v.dst = n
+	}
+	if d.nchan != 3 {
+		return nil, fmt.Errorf("Only RGB images are supported")
+	}
+	floats := []struct {
+		name string
+		dst  *float32
+	}{
+		{"prob", &d.params.ProbabilityThreshold},
+		{"nms", &d.params.NmsIouThreshold},
+	}
+	for _, v := range floats {
+		f, err := strconv.ParseFloat(q.Get(v.name), 32)
+		if err != nil || f < 0 || f > 1 {
+			return nil, fmt.Errorf("Invalid %v '%v'", v.name, q.Get(v.name))
+		}
+		*v.dst = float32(f)
+	}
+	d.params.Unclipped = q.Get("unclipped") == "1"
+	return d, nil
+}
+
+// Returns the images of the batch, tightly packed, without any padding between rows or images
+func packBatch(batch nn.ImageBatch) []byte {
+	rowBytes := batch.Width * batch.NChan
+	imageBytes := rowBytes * batch.Height
+	if batch.Stride == rowBytes && batch.BatchStride == imageBytes {
+		return batch.Pixels[:batch.BatchSize*imageBytes]
+	}
+	packed := make([]byte, batch.BatchSize*imageBytes)
+	for i := 0; i < batch.BatchSize; i++ {
+		for y := 0; y < batch.Height; y++ {
+			src := batch.Pixels[i*batch.BatchStride+y*batch.Stride:]
+			copy(packed[i*imageBytes+y*rowBytes:i*imageBytes+(y+1)*rowBytes], src[:rowBytes])
+		}
+	}
+	return packed
+}
+
+func setAuthHeader(r *http.Request, key string) {
+	r.Header.Set("Authorization", "Bearer "+key)
+}
+
+func authKey(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
@@ -0,0 +1,229 @@
+package nnremote
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/logs"
+)
+
+// ServerOptions controls how a Server runs its detectors
+type ServerOptions struct {
+	Key         string        // Clients must present this key. Must not be empty.
+	MaxBatch    int           // Maximum number of images that we send to a detector at once. Zero = 1.
+	BatchWindow time.Duration // How long we wait for more images (possibly from other clients) to fill up a batch
+	Workers     int           // Number of threads running each detector. Zero = 1.
+}
+
+// Server runs object detection for remote clients.
+// Images from different requests are combined into batches, which is important for NN accelerators.
+type Server struct {
+	log     logs.Log
+	options ServerOptions
+	stop    chan struct{} // Closed by Close()
+	workers sync.WaitGroup
+
+	modelsLock sync.RWMutex
+	models     map[string]*serverModel
+}
+
+// A detector that we serve. The detector is owned by the caller of AddModel.
+type serverModel struct {
+	detector nn.ObjectDetector
+	queue    chan *detectJob
+}
+
+// A single image that is waiting to be detected
+type detectJob struct {
+	params nn.DetectionParams
+	pixels []byte
+	result chan detectResult
+}
+
+type detectResult struct {
+	objects []nn.ObjectDetection
+	err     error
+}
+
+func NewServer(log logs.Log, options ServerOptions) (*Server, error) {
+	if options.Key == "" {
+		return nil, fmt.Errorf("An NN server needs a key")
+	}
+	options.MaxBatch = max(options.MaxBatch, 1)
+	options.Workers = max(options.Workers, 1)
+	return &Server{
+		log:     log,
+		options: options,
+		stop:    make(chan struct{}),
+		models:  map[string]*serverModel{},
+	}, nil
+}
+
+// Serve the detector under the given model name (eg "yolov8m").
+// The server does not close the detector.
+func (s *Server) AddModel(name string, detector nn.ObjectDetector) {
+	model := &serverModel{
+		detector: detector,
+		queue:    make(chan *detectJob, s.options.MaxBatch*s.options.Workers*2),
+	}
+	s.modelsLock.Lock()
+	s.models[name] = model
+	s.modelsLock.Unlock()
+	for i := 0; i < s.options.Workers; i++ {
+		s.workers.Add(1)
+		go s.runWorker(model)
+	}
+}
+
+// Stop all workers. Requests that arrive after this fail.
+func (s *Server) Close() {
+	close(s.stop)
+	s.workers.Wait()
+}
+
+// GET ModelsPath
+func (s *Server) HandleModels(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r) {
+		return
+	}
+	s.modelsLock.RLock()
+	configs := map[string]*nn.ModelConfig{}
+	for name, model := range s.models {
+		configs[name] = model.detector.Config()
+	}
+	s.modelsLock.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(configs)
+}
+
+// POST DetectPath
+func (s *Server) HandleDetect(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r) {
+		return
+	}
+	req, err := parseDetectRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.modelsLock.RLock()
+	model := s.models[req.model]
+	s.modelsLock.RUnlock()
+	if model == nil {
+		http.Error(w, fmt.Sprintf("Model '%v' is not available", req.model), http.StatusNotFound)
+		return
+	}
+	config := model.detector.Config()
+	if req.width != config.Width || req.height != config.Height {
+		http.Error(w, fmt.Sprintf("Image size %v x %v does not match model size %v x %v", req.width, req.height, config.Width, config.Height), http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(req.batchSize*req.imageBytes())+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) != req.batchSize*req.imageBytes() {
+		http.Error(w, fmt.Sprintf("Expected %v bytes of images, but got %v", req.batchSize*req.imageBytes(), len(body)), http.StatusBadRequest)
+		return
+	}
+
+	jobs := make([]*detectJob, req.batchSize)
+	for i := range jobs {
+		jobs[i] = &detectJob{
+			params: req.params,
+			pixels: body[i*req.imageBytes() : (i+1)*req.imageBytes()],
+			result: make(chan detectResult, 1),
+		}
+		select {
+		case model.queue <- jobs[i]:
+		case <-s.stop:
+			http.Error(w, "Server is closing", http.StatusServiceUnavailable)
+			return
+		}
+	}
+	results := make([][]nn.ObjectDetection, req.batchSize)
+	for i, job := range jobs {
+		res := <-job.result
+		if res.err != nil {
+			http.Error(w, res.err.Error(), http.StatusInternalServerError)
+			return
+		}
+		results[i] = res.objects
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if subtle.ConstantTimeCompare([]byte(authKey(r)), []byte(s.options.Key)) != 1 {
+		http.Error(w, "Invalid key", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (s *Server) runWorker(model *serverModel) {
+	defer s.workers.Done()
+	config := model.detector.Config()
+	imageBytes := config.Width * config.Height * 3
+	pixels := make([]byte, s.options.MaxBatch*imageBytes)
+	var next *detectJob // A job that didn't fit into the previous batch
+	for {
+		batch := []*detectJob{}
+		if next != nil {
+			batch = append(batch, next)
+			next = nil
+		} else {
+			select {
+			case job := <-model.queue:
+				batch = append(batch, job)
+			case <-s.stop:
+				return
+			}
+		}
+
+		// Wait a little while for more images, so that we can run them all at once
+		timeout := time.After(s.options.BatchWindow)
+	fill:
+		for len(batch) < s.options.MaxBatch {
+			select {
+			case job := <-model.queue:
+				if job.params != batch[0].params {
+					// Images in a batch must share the same detection parameters
+					next = job
+					break fill
+				}
+				batch = append(batch, job)
+			case <-timeout:
+				break fill
+			}
+		}
+
+		for i, job := range batch {
+			copy(pixels[i*imageBytes:], job.pixels)
+		}
+		images := nn.MakeImageBatch(len(batch), imageBytes, config.Width, config.Height, 3, config.Width*3, pixels)
+		params := batch[0].params
+		objects, err := model.detector.DetectObjects(images, &params)
+		if err == nil && len(objects) != len(batch) {
+			err = fmt.Errorf("Detector returned %v results for %v images", len(objects), len(batch))
+		}
+		if err != nil {
+			s.log.Errorf("NN server failed to detect objects: %v", err)
+		}
+		for i, job := range batch {
+			if err != nil {
+				job.result <- detectResult{err: err}
+			} else {
+				job.result <- detectResult{objects: objects[i]}
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package tracker
+
+import "math"
+
+// Forbidden is the cost of an assignment that must never be made.
+// It is finite so that the potentials don't overflow, so real costs must be much smaller than this.
+const Forbidden = 1e9
+
+// Assign solves the linear assignment problem on cost, which is indexed as cost[row][col].
+// The matrix may be rectangular. Returns the column assigned to each row, or -1 if the row
+// is unassigned. Assignments that cost Forbidden or more are discarded, so rows can end up
+// unassigned even when there are free columns.
+// This is the O(n^3) Hungarian algorithm (Kuhn-Munkres, with potentials).
+func Assign(cost [][]float64) []int {
+	nRows := len(cost)
+	if nRows == 0 {
+		return nil
+	}
+	nCols := len(cost[0])
+	result := make([]int, nRows)
+	for i := range result {
+		result[i] = -1
+	}
+	if nCols == 0 {
+		return result
+	}
+
+	// The algorithm requires rows <= columns, so transpose if necessary
+	transposed := nRows > nCols
+	n, m := nRows, nCols
+	at := func(i, j int) float64 { return cost[i][j] }
+	if transposed {
+		n, m = nCols, nRows
+		at = func(i, j int) float64 { return cost[j][i] }
+	}
+
+	// 1-based arrays, with index 0 being a virtual row/column
+	u := make([]float64, n+1)
+	v := make([]float64, m+1)
+	p := make([]int, m+1) // p[j] is the row assigned to column j
+	way := make([]int, m+1)
+	minv := make([]float64, m+1)
+	used := make([]bool, m+1)
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		for j := range minv {
+			minv[j] = math.Inf(1)
+			used[j] = false
+		}
+		for {
+			used[j0] = true
+			i0 := p[j0]
+			delta := math.Inf(1)
+			j1 := 0
+			for j := 1; j <= m; j++ {
+				if used[j] {
+					continue
+				}
+				cur := at(i0-1, j-1) - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= m; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	for j := 1; j <= m; j++ {
+		i := p[j]
+		if i == 0 || at(i-1, j-1) >= Forbidden {
+			continue
+		}
+		if transposed {
+			result[j-1] = i - 1
+		} else {
+			result[i-1] = j - 1
+		}
+	}
+	return result
+}
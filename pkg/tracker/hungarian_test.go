@@ -0,0 +1,100 @@
+package tracker
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Exhaustive search, for validating Assign
+func bruteForceAssign(cost [][]float64) float64 {
+	best := Forbidden * 100
+	nCols := len(cost[0])
+	used := make([]bool, nCols)
+	var recurse func(row int, total float64)
+	recurse = func(row int, total float64) {
+		if row == len(cost) {
+			best = min(best, total)
+			return
+		}
+		for j := 0; j < nCols; j++ {
+			if !used[j] {
+				used[j] = true
+				recurse(row+1, total+cost[row][j])
+				used[j] = false
+			}
+		}
+		if len(cost)-row > nCols-countTrue(used) {
+			// More rows than columns, so some rows must be left out
+			recurse(row+1, total)
+		}
+	}
+	recurse(0, 0)
+	return best
+}
+
+func countTrue(b []bool) int {
+	n := 0
+	for _, v := range b {
+		if v {
+			n++
+		}
+	}
+	return n
+}
+
+func totalCost(cost [][]float64, assignment []int) float64 {
+	total := 0.0
+	for i, j := range assignment {
+		if j != -1 {
+			total += cost[i][j]
+		}
+	}
+	return total
+}
+
+func TestAssign(t *testing.T) {
+	// Greedy would pick (0,0), and then be forced into (1,1), for a total of 1 + 10
+	cost := [][]float64{
+		{1, 2},
+		{2, 10},
+	}
+	require.Equal(t, []int{1, 0}, Assign(cost))
+
+	// Rectangular, in both directions
+	require.Equal(t, []int{2, 0}, Assign([][]float64{{5, 5, 1}, {1, 5, 5}}))
+	require.Equal(t, []int{-1, 0, 1}, Assign([][]float64{{5, 5}, {1, 5}, {5, 1}}))
+
+	// Forbidden assignments are never made
+	require.Equal(t, []int{0, -1}, Assign([][]float64{{1, Forbidden}, {1, Forbidden}}))
+
+	require.Nil(t, Assign(nil))
+	require.Equal(t, []int{-1}, Assign([][]float64{{}}))
+
+	// Compare against brute force on random matrices
+	rng := rand.New(rand.NewSource(1))
+	for iter := 0; iter < 200; iter++ {
+		nRows := 1 + rng.Intn(5)
+		nCols := 1 + rng.Intn(5)
+		cost := make([][]float64, nRows)
+		for i := range cost {
+			cost[i] = make([]float64, nCols)
+			for j := range cost[i] {
+				cost[i][j] = float64(rng.Intn(100))
+			}
+		}
+		assignment := Assign(cost)
+		assigned := 0
+		seen := map[int]bool{}
+		for _, j := range assignment {
+			if j != -1 {
+				require.False(t, seen[j])
+				seen[j] = true
+				assigned++
+			}
+		}
+		require.Equal(t, min(nRows, nCols), assigned)
+		require.Equal(t, bruteForceAssign(cost), totalCost(cost, assignment), "%v", cost)
+	}
+}
@@ -0,0 +1,158 @@
+package tracker
+
+import (
+	"math"
+	"time"
+)
+
+// Noise parameters of BoxFilter. These are all relative to the size of the box, so that
+// a small (distant) object is allowed to move fewer pixels than a large (near) object.
+const (
+	measurementNoise     = 0.05 // Standard deviation of an NN box edge, as a fraction of box size
+	accelerationNoise    = 1.0  // Standard deviation of acceleration, in box sizes per second²
+	initialVelocityNoise = 2.0  // Standard deviation of the unknown velocity of a new object, in box sizes per second
+)
+
+// Box is a rectangle in center form
+type Box struct {
+	CX, CY, W, H float64
+}
+
+// Center-form box from a top-left corner and size
+func MakeBox(x, y, width, height float64) Box {
+	return Box{x + width/2, y + height/2, width, height}
+}
+
+// Top-left corner
+func (b Box) Origin() (x, y float64) {
+	return b.CX - b.W/2, b.CY - b.H/2
+}
+
+// Length of the diagonal
+func (b Box) Diagonal() float64 {
+	return math.Hypot(b.W, b.H)
+}
+
+// Intersection over union
+func (b Box) IoU(x Box) float64 {
+	iw := min(b.CX+b.W/2, x.CX+x.W/2) - max(b.CX-b.W/2, x.CX-x.W/2)
+	ih := min(b.CY+b.H/2, x.CY+x.H/2) - max(b.CY-b.H/2, x.CY-x.H/2)
+	if iw <= 0 || ih <= 0 {
+		return 0
+	}
+	intersection := iw * ih
+	return intersection / (b.W*b.H + x.W*x.H - intersection)
+}
+
+// axisFilter is a constant velocity Kalman filter of a single coordinate.
+// The state is [position, velocity], with covariance [[p00, p01], [p01, p11]].
+type axisFilter struct {
+	pos, vel      float64
+	p00, p01, p11 float64
+}
+
+func newAxisFilter(pos, posStd, velStd float64) axisFilter {
+	return axisFilter{
+		pos: pos,
+		p00: posStd * posStd,
+		p11: velStd * velStd,
+	}
+}
+
+// Advance by dt seconds, with the given acceleration standard deviation (white noise acceleration model)
+func (f *axisFilter) predict(dt, accelStd float64) {
+	q := accelStd * accelStd
+	dt2 := dt * dt
+	f.pos += f.vel * dt
+	// P = F P Fᵀ + Q, where F = [[1, dt], [0, 1]]
+	f.p00 += 2*dt*f.p01 + dt2*f.p11 + q*dt2*dt2/4
+	f.p01 += dt*f.p11 + q*dt2*dt/2
+	f.p11 += q * dt2
+}
+
+// Incorporate a measurement of the position
+func (f *axisFilter) update(z, measurementStd float64) {
+	s := f.p00 + measurementStd*measurementStd
+	k0 := f.p00 / s
+	k1 := f.p01 / s
+	residual := z - f.pos
+	f.pos += k0 * residual
+	f.vel += k1 * residual
+	// P = (I - K H) P
+	p00, p01, p11 := f.p00, f.p01, f.p11
+	f.p00 = (1 - k0) * p00
+	f.p01 = (1 - k0) * p01
+	f.p11 = p11 - k1*p01
+}
+
+// BoxFilter tracks a box with a constant velocity Kalman filter.
+// Each of center X, center Y, width and height is filtered independently.
+// Predictions are made at arbitrary times, because the NN doesn't see every frame.
+type BoxFilter struct {
+	axes [4]axisFilter
+	time time.Time // Time of the current state
+}
+
+// Start a new filter at the given measurement
+func NewBoxFilter(box Box, at time.Time) BoxFilter {
+	size := boxSize(box)
+	f := BoxFilter{time: at}
+	for i, v := range box.values() {
+		f.axes[i] = newAxisFilter(v, measurementNoise*size, initialVelocityNoise*size)
+	}
+	return f
+}
+
+// Returns the predicted box at the given time, without modifying the filter
+func (f *BoxFilter) Predict(at time.Time) Box {
+	c := *f
+	c.advance(at)
+	return c.Box()
+}
+
+// Returns the uncertainty (standard deviation) of the predicted center at the given time, in pixels
+func (f *BoxFilter) PredictedCenterStd(at time.Time) float64 {
+	c := *f
+	c.advance(at)
+	return math.Sqrt(c.axes[0].p00 + c.axes[1].p00)
+}
+
+// Advance the filter to the time of the measurement, and incorporate the measurement
+func (f *BoxFilter) Update(box Box, at time.Time) {
+	f.advance(at)
+	noise := measurementNoise * boxSize(box)
+	for i, v := range box.values() {
+		f.axes[i].update(v, noise)
+	}
+}
+
+// Current estimate of the box
+func (f *BoxFilter) Box() Box {
+	return Box{f.axes[0].pos, f.axes[1].pos, max(f.axes[2].pos, 1), max(f.axes[3].pos, 1)}
+}
+
+// Current estimate of the velocity of the center, in pixels per second
+func (f *BoxFilter) Velocity() (vx, vy float64) {
+	return f.axes[0].vel, f.axes[1].vel
+}
+
+func (f *BoxFilter) advance(at time.Time) {
+	dt := at.Sub(f.time).Seconds()
+	if dt <= 0 {
+		return
+	}
+	accel := accelerationNoise * boxSize(f.Box())
+	for i := range f.axes {
+		f.axes[i].predict(dt, accel)
+	}
+	f.time = at
+}
+
+func (b Box) values() [4]float64 {
+	return [4]float64{b.CX, b.CY, b.W, b.H}
+}
+
+// The scale that our noise parameters are relative to
+func boxSize(b Box) float64 {
+	return max((b.W+b.H)/2, 1)
+}
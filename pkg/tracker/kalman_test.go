@@ -0,0 +1,41 @@
+package tracker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoxFilter(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// An object moving right at 100 pixels per second, seen 5 times per second
+	f := NewBoxFilter(MakeBox(0, 100, 50, 50), base)
+	for i := 1; i <= 10; i++ {
+		at := base.Add(time.Duration(i) * 200 * time.Millisecond)
+		f.Update(MakeBox(float64(i)*20, 100, 50, 50), at)
+	}
+	vx, vy := f.Velocity()
+	require.InDelta(t, 100, vx, 5)
+	require.InDelta(t, 0, vy, 5)
+
+	// One second after the last sighting, the object should be about 100 pixels further right
+	at := base.Add(3 * time.Second)
+	p := f.Predict(at)
+	x, y := p.Origin()
+	require.InDelta(t, 300, x, 10)
+	require.InDelta(t, 100, y, 5)
+	require.InDelta(t, 50, p.W, 2)
+
+	// Predict doesn't modify the filter, and uncertainty grows with time
+	require.Equal(t, p, f.Predict(at))
+	require.Greater(t, f.PredictedCenterStd(base.Add(5*time.Second)), f.PredictedCenterStd(at))
+}
+
+func TestBoxIoU(t *testing.T) {
+	a := MakeBox(0, 0, 10, 10)
+	require.Equal(t, 1.0, a.IoU(a))
+	require.Equal(t, 0.0, a.IoU(MakeBox(10, 0, 10, 10)))
+	require.InDelta(t, 25.0/175.0, a.IoU(MakeBox(5, 5, 10, 10)), 1e-9)
+}
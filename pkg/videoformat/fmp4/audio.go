@@ -0,0 +1,84 @@
+package fmp4
+
+import (
+	"fmt"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+)
+
+// Every AAC frame has 1024 samples
+const aacSamplesPerFrame = 1024
+
+// Return the raw access unit inside a single ADTS frame
+func stripADTS(frame []byte) ([]byte, error) {
+	var pkts mpeg4audio.ADTSPackets
+	if err := pkts.Unmarshal(frame); err != nil {
+		return nil, fmt.Errorf("Invalid ADTS frame: %w", err)
+	}
+	if len(pkts) != 1 {
+		return nil, fmt.Errorf("Expected one ADTS frame per packet, but found %v", len(pkts))
+	}
+	return pkts[0].AU, nil
+}
+
+// Wrap a raw AAC-LC access unit in an ADTS frame
+func addADTS(au []byte, sampleRate, channels int) ([]byte, error) {
+	pkts := mpeg4audio.ADTSPackets{
+		{
+			Type:         mpeg4audio.ObjectTypeAACLC,
+			SampleRate:   sampleRate,
+			ChannelCount: channels,
+			AU:           au,
+		},
+	}
+	return pkts.Marshal()
+}
+
+// Write the sample entry of an audio track
+func (t *Track) writeAudioSampleEntry(w *boxWriter) {
+	w.begin(t.Codec) // The codec names are the sample entry types
+	w.zeros(6)
+	w.u16(1) // data_reference_index
+	w.zeros(8)
+	w.u16(uint16(t.Channels))
+	if t.Codec == CodecAAC {
+		w.u16(16) // samplesize
+	} else {
+		w.u16(8)
+	}
+	w.zeros(4)
+	w.u32(uint32(t.SampleRate) << 16)
+	if t.Codec == CodecAAC {
+		// MakeAudioTrack has already validated the config, so Marshal can't fail
+		asc, _ := mpeg4audio.Config{
+			Type:         mpeg4audio.ObjectTypeAACLC,
+			SampleRate:   t.SampleRate,
+			ChannelCount: t.Channels,
+		}.Marshal()
+		w.beginFull("esds", 0, 0)
+		writeDescriptor(w, 0x03, 3+5+13+5+len(asc)+6) // ES_Descriptor
+		w.u16(1)                                      // ES_ID
+		w.u8(0)                                       // flags
+		writeDescriptor(w, 0x04, 13+5+len(asc))       // DecoderConfigDescriptor
+		w.u8(0x40)                                    // Audio ISO/IEC 14496-3
+		w.u8(0x15)                                    // AudioStream
+		w.zeros(3)                                    // bufferSizeDB
+		w.u32(0)                                      // maxBitrate
+		w.u32(0)                                      // avgBitrate
+		writeDescriptor(w, 0x05, len(asc))            // DecoderSpecificInfo
+		w.bytes(asc)
+		writeDescriptor(w, 0x06, 1) // SLConfigDescriptor
+		w.u8(2)
+		w.end()
+	}
+	w.end()
+}
+
+// Write the tag and size of an MPEG-4 descriptor, using the 4 byte size encoding
+func writeDescriptor(w *boxWriter, tag uint8, size int) {
+	w.u8(tag)
+	w.u8(0x80 | uint8(size>>21)&0x7f)
+	w.u8(0x80 | uint8(size>>14)&0x7f)
+	w.u8(0x80 | uint8(size>>7)&0x7f)
+	w.u8(uint8(size) & 0x7f)
+}
@@ -0,0 +1,176 @@
+package fmp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var errIncompleteBox = errors.New("incomplete box")
+
+// boxWriter builds ISO BMFF boxes in memory.
+// Boxes are nested by calling begin() and end(), which patches the size of the box.
+type boxWriter struct {
+	buf   []byte
+	stack []int // Start offsets of the boxes that are open
+}
+
+func (w *boxWriter) begin(boxType string) {
+	w.stack = append(w.stack, len(w.buf))
+	w.u32(0) // size is patched by end()
+	w.buf = append(w.buf, boxType[:4]...)
+}
+
+// Begin a "full box", which has a version and 24 bits of flags
+func (w *boxWriter) beginFull(boxType string, version uint8, flags uint32) {
+	w.begin(boxType)
+	w.u32(uint32(version)<<24 | flags&0xffffff)
+}
+
+func (w *boxWriter) end() {
+	start := w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+	binary.BigEndian.PutUint32(w.buf[start:], uint32(len(w.buf)-start))
+}
+
+func (w *boxWriter) u8(v uint8) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *boxWriter) u16(v uint16) {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, v)
+}
+
+func (w *boxWriter) u32(v uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+}
+
+func (w *boxWriter) u64(v uint64) {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, v)
+}
+
+func (w *boxWriter) bytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+func (w *boxWriter) zeros(n int) {
+	for i := 0; i < n; i++ {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+// Header of a box that has been read from disk
+type boxHeader struct {
+	boxType    string
+	offset     int64 // Position of the start of the header
+	headerSize int64
+	size       int64 // Total size, including the header
+}
+
+func (h *boxHeader) bodyOffset() int64 {
+	return h.offset + h.headerSize
+}
+
+func (h *boxHeader) end() int64 {
+	return h.offset + h.size
+}
+
+// Read the header of the box at 'offset'.
+// Returns errIncompleteBox if the box extends beyond fileSize.
+func readBoxHeader(r io.ReaderAt, offset, fileSize int64) (boxHeader, error) {
+	var b [16]byte
+	if offset+8 > fileSize {
+		return boxHeader{}, errIncompleteBox
+	}
+	if _, err := r.ReadAt(b[:8], offset); err != nil {
+		return boxHeader{}, err
+	}
+	h := boxHeader{
+		boxType:    string(b[4:8]),
+		offset:     offset,
+		headerSize: 8,
+		size:       int64(binary.BigEndian.Uint32(b[:4])),
+	}
+	if h.size == 1 {
+		if offset+16 > fileSize {
+			return boxHeader{}, errIncompleteBox
+		}
+		if _, err := r.ReadAt(b[8:16], offset+8); err != nil {
+			return boxHeader{}, err
+		}
+		h.headerSize = 16
+		h.size = int64(binary.BigEndian.Uint64(b[8:16]))
+	} else if h.size == 0 {
+		// Box extends to the end of the file
+		h.size = fileSize - offset
+	}
+	if h.size < h.headerSize || h.end() > fileSize {
+		return boxHeader{}, errIncompleteBox
+	}
+	return h, nil
+}
+
+// Parse the children of a box that has been read into memory.
+// The callback receives the type and body of each child.
+func walkBoxes(body []byte, callback func(boxType string, body []byte) error) error {
+	for len(body) != 0 {
+		if len(body) < 8 {
+			return errIncompleteBox
+		}
+		size := int(binary.BigEndian.Uint32(body))
+		headerSize := 8
+		if size == 1 {
+			if len(body) < 16 {
+				return errIncompleteBox
+			}
+			size = int(binary.BigEndian.Uint64(body[8:]))
+			headerSize = 16
+		} else if size == 0 {
+			size = len(body)
+		}
+		if size < headerSize || size > len(body) {
+			return errIncompleteBox
+		}
+		if err := callback(string(body[4:8]), body[headerSize:size]); err != nil {
+			return err
+		}
+		body = body[size:]
+	}
+	return nil
+}
+
+// byteReader reads big endian integers from the body of a box
+type byteReader struct {
+	buf []byte
+	err error
+}
+
+func (r *byteReader) next(n int) []byte {
+	if r.err != nil || len(r.buf) < n {
+		r.err = errIncompleteBox
+		return make([]byte, n)
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *byteReader) u8() uint8 {
+	return r.next(1)[0]
+}
+
+func (r *byteReader) u16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *byteReader) u32() uint32 {
+	return binary.BigEndian.Uint32(r.next(4))
+}
+
+func (r *byteReader) u64() uint64 {
+	return binary.BigEndian.Uint64(r.next(8))
+}
+
+func (r *byteReader) skip(n int) {
+	r.next(n)
+}
@@ -0,0 +1,164 @@
+package fmp4
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// File is a group of tracks that share the same base filename.
+// Every track is a self-contained fragmented MP4 file, so that it can be
+// played by standard tools.
+type File struct {
+	BaseFilename string
+	Tracks       []*Track
+}
+
+// Create a new file group. The track files are created by AddTrack.
+func Create(baseFilename string) *File {
+	return &File{
+		BaseFilename: baseFilename,
+	}
+}
+
+// Open an existing file group for reading.
+// filename may be either a base filename such as `/foo/bar/myvideo` or
+// a concrete track filename such as `/foo/bar/myvideo_mytrack.mp4`
+func Open(filename string) (*File, error) {
+	baseFilename := filename
+	if IsVideoFile(filename) {
+		hasTrackSeparator := false
+		baseFilename, _, hasTrackSeparator = strings.Cut(strings.TrimSuffix(filename, "."+Extension), "_")
+		if !hasTrackSeparator {
+			return nil, fmt.Errorf("Invalid filename (no track name specified): %v", filename)
+		}
+	}
+	trackNames, err := TrackNames(baseFilename)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{
+		BaseFilename: baseFilename,
+	}
+	for _, trackName := range trackNames {
+		track, err := openTrack(baseFilename, trackName)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		f.Tracks = append(f.Tracks, track)
+	}
+	if len(f.Tracks) == 0 {
+		return nil, fmt.Errorf("No tracks found in %v", baseFilename)
+	}
+	return f, nil
+}
+
+// Return the names of the tracks of a file group, by looking at the filesystem
+func TrackNames(baseFilename string) ([]string, error) {
+	matches, err := filepath.Glob(TrackFilename(globEscape(baseFilename), "*"))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, m := range matches {
+		name := strings.TrimPrefix(m, baseFilename+"_")
+		names = append(names, strings.TrimSuffix(name, "."+Extension))
+	}
+	return names, nil
+}
+
+func globEscape(s string) string {
+	r := strings.NewReplacer("*", "\\*", "?", "\\?", "[", "\\[", "\\", "\\\\")
+	return r.Replace(s)
+}
+
+// Add a new track, and create its file
+func (f *File) AddTrack(track *Track) error {
+	for _, t := range f.Tracks {
+		if t.Name == track.Name {
+			return fmt.Errorf("Track '%v' already exists", track.Name)
+		}
+	}
+	if err := track.createTrackFile(f.BaseFilename); err != nil {
+		track.Close()
+		return err
+	}
+	f.Tracks = append(f.Tracks, track)
+	return nil
+}
+
+func (f *File) Close() error {
+	var errs []error
+	for _, t := range f.Tracks {
+		errs = append(errs, t.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Returns true if any track has trailing data after its last complete fragment,
+// which is what a crash in the middle of a write leaves behind.
+func IsUnclean(baseFilename string) (bool, error) {
+	f, err := Open(baseFilename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	for _, t := range f.Tracks {
+		st, err := t.file.Stat()
+		if err != nil {
+			return false, err
+		}
+		if st.Size() != t.size {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Result of checking a single track
+type TrackCheck struct {
+	Name     string
+	Problems []string
+	Repaired bool
+	Unclean  bool
+}
+
+// Check the integrity of every track of a file group, and optionally repair them,
+// by truncating each track after its last complete fragment.
+func Check(baseFilename string, repair bool) ([]TrackCheck, error) {
+	trackNames, err := TrackNames(baseFilename)
+	if err != nil {
+		return nil, err
+	}
+	results := []TrackCheck{}
+	for _, trackName := range trackNames {
+		res := TrackCheck{Name: trackName}
+		filename := TrackFilename(baseFilename, trackName)
+		track, err := openTrack(baseFilename, trackName)
+		if err != nil {
+			res.Problems = append(res.Problems, err.Error())
+			results = append(results, res)
+			continue
+		}
+		st, err := track.file.Stat()
+		track.Close()
+		if err != nil {
+			return nil, err
+		}
+		if st.Size() != track.size {
+			res.Unclean = true
+			res.Problems = append(res.Problems, fmt.Sprintf("%v bytes of incomplete fragment data after the last complete fragment", st.Size()-track.size))
+			if repair {
+				if err := os.Truncate(filename, track.size); err != nil {
+					return nil, err
+				}
+				res.Repaired = true
+			}
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
@@ -0,0 +1,137 @@
+package fmp4
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	CodecH264 = "h264" // Same codec names as rf1
+	CodecH265 = "h265"
+	CodecAAC  = "mp4a" // AAC-LC. Written and read as ADTS frames, but stored as raw access units.
+	CodecPCMA = "alaw" // G.711 A-law
+	CodecPCMU = "ulaw" // G.711 mu-law
+)
+
+var ErrInvalidCodec = errors.New("invalid codec")
+var ErrReadOnly = errors.New("track is read-only")
+
+// All tracks use a 90 kHz clock, which is the norm for video
+const TimeScale = 90000
+
+// We use the same limits as rf1, so that fsv can treat the two formats alike
+const MaxFileSize = 1<<30 - 1 // 1 GB
+const MaxDuration = 1024 * time.Second
+
+// File extension of a track file
+const Extension = "mp4"
+
+// Flags of a NALU.
+// These have the same values as the rf1 and fsv flags.
+type NALUFlags uint32
+
+const (
+	NALUFlagKeyFrame      NALUFlags = 1 // Key frame
+	NALUFlagEssentialMeta NALUFlags = 2 // Essential metadata, required to initialize the decoder (eg SPS+PPS NALUs in h264 / VPS+SPS+PPS NALUs h265)
+	NALUFlagAnnexB        NALUFlags = 4 // Packet has Annex-B "emulation prevention bytes" and start codes
+)
+
+type NALU struct {
+	PTS     time.Time
+	Flags   NALUFlags
+	Length  int64 // Only used when reading (logically this is equal to len(Payload), but Payload might be nil)
+	Payload []byte
+}
+
+func (n *NALU) IsKeyFrame() bool {
+	return n.Flags&NALUFlagKeyFrame != 0
+}
+
+func IsValidCodec(codec string) bool {
+	return IsVideoCodec(codec) || IsAudioCodec(codec)
+}
+
+func IsVideoCodec(codec string) bool {
+	return codec == CodecH264 || codec == CodecH265
+}
+
+func IsAudioCodec(codec string) bool {
+	return codec == CodecAAC || codec == CodecPCMA || codec == CodecPCMU
+}
+
+func TrackFilename(baseFilename string, trackName string) string {
+	return fmt.Sprintf("%v_%v.%v", baseFilename, trackName, Extension)
+}
+
+func IsVideoFile(filename string) bool {
+	return strings.HasSuffix(filename, "."+Extension)
+}
+
+// Encode a time offset in units of TimeScale
+func EncodeTimeOffset(t time.Duration) int64 {
+	// Split the computation so that we don't overflow for long durations
+	return int64(t/time.Second)*TimeScale + int64(t%time.Second)*TimeScale/int64(time.Second)
+}
+
+// Decode a time offset in units of TimeScale
+func DecodeTimeOffset(t int64) time.Duration {
+	return time.Duration(t/TimeScale)*time.Second + time.Duration(t%TimeScale)*time.Second/TimeScale
+}
+
+// Returns the flags that describe a raw NALU (without start code)
+func naluTypeFlags(codec string, nalu []byte) NALUFlags {
+	if len(nalu) == 0 {
+		return 0
+	}
+	if codec == CodecH265 {
+		t := (nalu[0] >> 1) & 0x3f
+		switch {
+		case t >= 32 && t <= 34:
+			// VPS, SPS, PPS
+			return NALUFlagEssentialMeta
+		case t >= 16 && t <= 21:
+			// IRAP (BLA, IDR, CRA)
+			return NALUFlagKeyFrame
+		}
+		return 0
+	}
+	switch nalu[0] & 0x1f {
+	case 5:
+		return NALUFlagKeyFrame
+	case 7, 8:
+		return NALUFlagEssentialMeta
+	}
+	return 0
+}
+
+// Remove the Annex-B start code from the front of a NALU
+func stripStartCode(b []byte) []byte {
+	if len(b) >= 4 && b[0] == 0 && b[1] == 0 && b[2] == 0 && b[3] == 1 {
+		return b[4:]
+	} else if len(b) >= 3 && b[0] == 0 && b[1] == 0 && b[2] == 1 {
+		return b[3:]
+	}
+	return b
+}
+
+// Add emulation prevention bytes to a raw NALU, which is required
+// for NALUs inside an MP4 file.
+func addEmulationPrevention(b []byte) []byte {
+	out := make([]byte, 0, len(b)+len(b)/64)
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c <= 3 {
+			out = append(out, 3)
+			zeros = 0
+		}
+		out = append(out, c)
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return out
+}
@@ -0,0 +1,200 @@
+package fmp4
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Create h264 NALUs at 10 FPS, with an SPS+PPS+IDR every 10 frames
+func createTestNALUs(timeBase time.Time, nFrames int, seed int64) []NALU {
+	rng := rand.New(rand.NewSource(seed))
+	nalus := []NALU{}
+	for i := 0; i < nFrames; i++ {
+		pts := timeBase.Add(time.Duration(i) * 100 * time.Millisecond)
+		types := []byte{0x41}
+		if i%10 == 0 {
+			types = []byte{0x67, 0x68, 0x65}
+		}
+		for _, t := range types {
+			payload := make([]byte, 5+rng.Intn(200))
+			rng.Read(payload)
+			copy(payload, []byte{0, 0, 0, 1, t})
+			flags := NALUFlagAnnexB
+			if t == 0x65 {
+				flags |= NALUFlagKeyFrame
+			} else if t != 0x41 {
+				flags |= NALUFlagEssentialMeta
+			}
+			nalus = append(nalus, NALU{PTS: pts, Flags: flags, Payload: payload})
+		}
+	}
+	return nalus
+}
+
+func requireEqualNALUs(t *testing.T, expected, actual []NALU) {
+	require.Equal(t, len(expected), len(actual))
+	for i := range expected {
+		require.InDelta(t, expected[i].PTS.UnixNano(), actual[i].PTS.UnixNano(), float64(20*time.Microsecond))
+		require.Equal(t, expected[i].Flags, actual[i].Flags)
+		require.Equal(t, expected[i].Payload, actual[i].Payload)
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "1712815946731")
+	timeBase := time.Now()
+	nalus := createTestNALUs(timeBase, 50, 3)
+
+	f := Create(base)
+	track, err := MakeVideoTrack("video", timeBase, CodecH264, 320, 240)
+	require.NoError(t, err)
+	require.NoError(t, f.AddTrack(track))
+	require.True(t, track.HasCapacity(10, timeBase.Add(time.Second), 1000))
+	require.False(t, track.HasCapacity(10, timeBase.Add(MaxDuration), 1000))
+	// Write in several fragments, splitting a keyframe across two of them
+	require.NoError(t, track.WriteNALUs(nalus[:31]))
+	require.NoError(t, track.WriteNALUs(nalus[31:]))
+	require.Error(t, track.WriteNALUs(nalus[:1]))
+
+	// Read from the open handle
+	r, err := track.ReadAtTime(0, time.Hour, false, false)
+	require.NoError(t, err)
+	requireEqualNALUs(t, nalus, r)
+	require.NoError(t, f.Close())
+
+	f, err = Open(base)
+	require.NoError(t, err)
+	defer f.Close()
+	require.Equal(t, 1, len(f.Tracks))
+	track = f.Tracks[0]
+	require.Equal(t, "video", track.Name)
+	require.Equal(t, CodecH264, track.Codec)
+	require.Equal(t, 320, track.Width)
+	require.Equal(t, 240, track.Height)
+	require.Equal(t, timeBase.UnixNano(), track.TimeBase.UnixNano())
+	require.InDelta(t, 4900*time.Millisecond, track.Duration(), float64(time.Millisecond))
+	st, err := os.Stat(TrackFilename(base, "video"))
+	require.NoError(t, err)
+	require.Equal(t, st.Size(), track.FileSize())
+
+	r, err = track.ReadAtTime(0, time.Hour, false, false)
+	require.NoError(t, err)
+	requireEqualNALUs(t, nalus, r)
+	require.False(t, track.HasCapacity(1, timeBase, 10))
+	require.ErrorIs(t, track.WriteNALUs(nalus), ErrReadOnly)
+
+	// Frames 12..14 (inclusive). Seeking back lands on the keyframe at frame 10.
+	r, err = track.ReadAtTime(1200*time.Millisecond, 1400*time.Millisecond, false, false)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(r))
+	r, err = track.ReadAtTime(1200*time.Millisecond, 1400*time.Millisecond, true, true)
+	require.NoError(t, err)
+	require.Equal(t, 7, len(r))
+	require.Equal(t, NALUFlagAnnexB|NALUFlagEssentialMeta, r[0].Flags)
+	require.Nil(t, r[0].Payload)
+	require.Equal(t, int64(len(nalus[12].Payload)), r[0].Length)
+}
+
+func TestCrashRecovery(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "1712815946731")
+	timeBase := time.Now()
+	nalus := createTestNALUs(timeBase, 30, 5)
+
+	f := Create(base)
+	track, err := MakeVideoTrack("video", timeBase, CodecH264, 320, 240)
+	require.NoError(t, err)
+	require.NoError(t, f.AddTrack(track))
+	require.NoError(t, track.WriteNALUs(nalus[:20]))
+	goodSize := track.FileSize()
+	require.NoError(t, track.WriteNALUs(nalus[20:]))
+	require.NoError(t, f.Close())
+
+	unclean, err := IsUnclean(base)
+	require.NoError(t, err)
+	require.False(t, unclean)
+
+	// Chop off the end of the last fragment
+	filename := TrackFilename(base, "video")
+	require.NoError(t, os.Truncate(filename, goodSize+100))
+	unclean, err = IsUnclean(base)
+	require.NoError(t, err)
+	require.True(t, unclean)
+
+	// The partial fragment is ignored
+	f, err = Open(base)
+	require.NoError(t, err)
+	r, err := f.Tracks[0].ReadAtTime(0, time.Hour, false, false)
+	require.NoError(t, err)
+	requireEqualNALUs(t, nalus[:20], r)
+	f.Close()
+
+	res, err := Check(base, true)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	require.True(t, res[0].Unclean)
+	require.True(t, res[0].Repaired)
+	st, err := os.Stat(filename)
+	require.NoError(t, err)
+	require.Equal(t, goodSize, st.Size())
+	unclean, err = IsUnclean(base)
+	require.NoError(t, err)
+	require.False(t, unclean)
+}
+
+func TestNALUTypeFlags(t *testing.T) {
+	require.Equal(t, NALUFlagKeyFrame, naluTypeFlags(CodecH264, []byte{0x65}))
+	require.Equal(t, NALUFlagEssentialMeta, naluTypeFlags(CodecH264, []byte{0x67}))
+	require.Equal(t, NALUFlags(0), naluTypeFlags(CodecH264, []byte{0x41}))
+	require.Equal(t, NALUFlagKeyFrame, naluTypeFlags(CodecH265, []byte{19 << 1, 1}))
+	require.Equal(t, NALUFlagEssentialMeta, naluTypeFlags(CodecH265, []byte{32 << 1, 1}))
+	require.Equal(t, NALUFlags(0), naluTypeFlags(CodecH265, []byte{1 << 1, 1}))
+	require.Equal(t, []byte{0, 0, 3, 1, 0, 0, 3, 0}, addEmulationPrevention([]byte{0, 0, 1, 0, 0, 0}))
+}
+
+func TestAudioTrack(t *testing.T) {
+	for _, codec := range []string{CodecAAC, CodecPCMU} {
+		base := filepath.Join(t.TempDir(), "1712815946731")
+		timeBase := time.Now()
+		f := Create(base)
+		track, err := MakeAudioTrack("audio", timeBase, codec, 8000, 1)
+		require.NoError(t, err)
+		require.NoError(t, f.AddTrack(track))
+
+		nalus := []NALU{}
+		for i := 0; i < 20; i++ {
+			payload := make([]byte, 100+i)
+			for j := range payload {
+				payload[j] = byte(i * j)
+			}
+			if codec == CodecAAC {
+				payload, err = addADTS(payload, 8000, 1)
+				require.NoError(t, err)
+			}
+			nalus = append(nalus, NALU{PTS: timeBase.Add(time.Duration(i) * 128 * time.Millisecond), Flags: NALUFlagKeyFrame, Payload: payload})
+		}
+		require.NoError(t, track.WriteNALUs(nalus[:10]))
+		require.NoError(t, track.WriteNALUs(nalus[10:]))
+		require.NoError(t, f.Close())
+
+		f, err = Open(base)
+		require.NoError(t, err)
+		track = f.Tracks[0]
+		require.True(t, track.IsAudio())
+		require.Equal(t, codec, track.Codec)
+		require.Equal(t, 8000, track.SampleRate)
+		require.Equal(t, 1, track.Channels)
+		r, err := track.ReadAtTime(0, time.Hour, false, false)
+		require.NoError(t, err)
+		requireEqualNALUs(t, nalus, r)
+		r, err = track.ReadAtTime(time.Second, 2*time.Second, true, true)
+		require.NoError(t, err)
+		require.Equal(t, 8, len(r))
+		require.Equal(t, int64(len(nalus[8].Payload)), r[0].Length)
+		require.NoError(t, f.Close())
+	}
+}
@@ -0,0 +1,245 @@
+package fmp4
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Read the init segment and the index of every fragment.
+// Parsing stops at the first fragment that is incomplete, which is what a crash
+// in the middle of a write leaves behind. Returns true if there is such trailing data.
+func (t *Track) scan() (unclean bool, err error) {
+	st, err := t.file.Stat()
+	if err != nil {
+		return false, err
+	}
+	fileSize := st.Size()
+	t.samples = nil
+	t.size = 0
+	haveMoov := false
+	pos := int64(0)
+loop:
+	for pos < fileSize {
+		h, err := readBoxHeader(t.file, pos, fileSize)
+		if errors.Is(err, errIncompleteBox) {
+			break
+		} else if err != nil {
+			return false, err
+		}
+		switch h.boxType {
+		case "moov":
+			body, err := t.readBody(h)
+			if err != nil {
+				return false, err
+			}
+			if err := t.parseMoov(body); err != nil {
+				return false, fmt.Errorf("Invalid moov box: %w", err)
+			}
+			haveMoov = true
+		case "moof":
+			if !haveMoov {
+				return false, fmt.Errorf("Fragment found before moov box")
+			}
+			// The fragment is only valid if its mdat follows it in full
+			mdat, err := readBoxHeader(t.file, h.end(), fileSize)
+			if err != nil || mdat.boxType != "mdat" {
+				break loop
+			}
+			body, err := t.readBody(h)
+			if err != nil {
+				return false, err
+			}
+			samples, sequence, err := parseMoof(body, h.offset)
+			if err != nil {
+				return false, fmt.Errorf("Invalid moof box at %v: %w", h.offset, err)
+			}
+			if len(samples) != 0 && (samples[0].offset < mdat.bodyOffset() || samples[len(samples)-1].offset+int64(samples[len(samples)-1].size) > mdat.end()) {
+				return false, fmt.Errorf("Samples of moof box at %v are outside of their mdat box", h.offset)
+			}
+			t.samples = append(t.samples, samples...)
+			t.sequence = sequence
+			h.size += mdat.size
+		}
+		pos = h.end()
+		t.size = pos
+	}
+	if !haveMoov {
+		return false, fmt.Errorf("No moov box found")
+	}
+	return t.size != fileSize, nil
+}
+
+func (t *Track) readBody(h boxHeader) ([]byte, error) {
+	body := make([]byte, h.size-h.headerSize)
+	if _, err := t.file.ReadAt(body, h.bodyOffset()); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// Extract the track metadata from the moov box
+func (t *Track) parseMoov(moov []byte) error {
+	var creation uint64
+	haveTimeBase := false
+	var walk func(boxType string, body []byte) error
+	walk = func(boxType string, body []byte) error {
+		r := byteReader{buf: body}
+		switch boxType {
+		case "trak", "mdia", "minf", "stbl", "udta":
+			return walkBoxes(body, walk)
+		case "mdhd":
+			version := r.u8()
+			r.skip(3)
+			if version == 1 {
+				creation = r.u64()
+				r.skip(8)
+			} else {
+				creation = uint64(r.u32())
+				r.skip(4)
+			}
+			if r.u32() != TimeScale {
+				return fmt.Errorf("Unsupported timescale")
+			}
+		case "tkhd":
+			version := r.u8()
+			r.skip(3)
+			if version == 1 {
+				r.skip(32)
+			} else {
+				r.skip(20)
+			}
+			r.skip(52)
+			t.Width = int(r.u32() >> 16)
+			t.Height = int(r.u32() >> 16)
+		case "stsd":
+			r.skip(8)
+			return walkBoxes(r.buf, walk)
+		case "avc1", "avc3":
+			t.Codec = CodecH264
+		case "hvc1", "hev1":
+			t.Codec = CodecH265
+		case CodecAAC, CodecPCMA, CodecPCMU:
+			t.Codec = boxType
+			r.skip(16)
+			t.Channels = int(r.u16())
+			r.skip(6)
+			t.SampleRate = int(r.u32() >> 16)
+		case timeBaseBoxType:
+			t.TimeBase = time.Unix(0, int64(r.u64()))
+			haveTimeBase = true
+		}
+		return r.err
+	}
+	if err := walkBoxes(moov, walk); err != nil {
+		return err
+	}
+	if t.Codec == "" {
+		return ErrInvalidCodec
+	}
+	if !haveTimeBase {
+		// Not one of our files, so fall back to the 1 second resolution of the creation time
+		t.TimeBase = time.Unix(int64(creation)-2082844800, 0)
+	}
+	return nil
+}
+
+// Return the samples of the moof box that starts at moofOffset
+func parseMoof(moof []byte, moofOffset int64) ([]sample, uint32, error) {
+	samples := []sample{}
+	sequence := uint32(0)
+	err := walkBoxes(moof, func(boxType string, body []byte) error {
+		r := byteReader{buf: body}
+		switch boxType {
+		case "mfhd":
+			r.skip(4)
+			sequence = r.u32()
+		case "traf":
+			trafSamples, err := parseTraf(body, moofOffset)
+			if err != nil {
+				return err
+			}
+			samples = append(samples, trafSamples...)
+		}
+		return r.err
+	})
+	return samples, sequence, err
+}
+
+func parseTraf(traf []byte, moofOffset int64) ([]sample, error) {
+	samples := []sample{}
+	baseOffset := moofOffset
+	baseTime := int64(0)
+	var defaultDuration, defaultSize, defaultFlags uint32
+	err := walkBoxes(traf, func(boxType string, body []byte) error {
+		r := byteReader{buf: body}
+		versionAndFlags := r.u32()
+		version := versionAndFlags >> 24
+		flags := versionAndFlags & 0xffffff
+		switch boxType {
+		case "tfhd":
+			r.skip(4) // track_ID
+			if flags&0x1 != 0 {
+				baseOffset = int64(r.u64())
+			}
+			if flags&0x2 != 0 {
+				r.skip(4)
+			}
+			if flags&0x8 != 0 {
+				defaultDuration = r.u32()
+			}
+			if flags&0x10 != 0 {
+				defaultSize = r.u32()
+			}
+			if flags&0x20 != 0 {
+				defaultFlags = r.u32()
+			}
+		case "tfdt":
+			if version == 1 {
+				baseTime = int64(r.u64())
+			} else {
+				baseTime = int64(r.u32())
+			}
+		case "trun":
+			count := int(r.u32())
+			offset := baseOffset
+			if flags&0x1 != 0 {
+				offset += int64(int32(r.u32()))
+			}
+			firstFlags, haveFirstFlags := uint32(0), flags&0x4 != 0
+			if haveFirstFlags {
+				firstFlags = r.u32()
+			}
+			tm := baseTime
+			for i := 0; i < count && r.err == nil; i++ {
+				duration, size, sampleFlags := defaultDuration, defaultSize, defaultFlags
+				if flags&0x100 != 0 {
+					duration = r.u32()
+				}
+				if flags&0x200 != 0 {
+					size = r.u32()
+				}
+				if flags&0x400 != 0 {
+					sampleFlags = r.u32()
+				}
+				if flags&0x800 != 0 {
+					r.skip(4)
+				}
+				if i == 0 && haveFirstFlags {
+					sampleFlags = firstFlags
+				}
+				samples = append(samples, sample{
+					time:   tm,
+					offset: offset,
+					size:   size,
+					sync:   sampleFlags&0x00010000 == 0,
+				})
+				tm += int64(duration)
+				offset += int64(size)
+			}
+			baseTime = tm
+		}
+		return r.err
+	})
+	return samples, err
+}
@@ -0,0 +1,556 @@
+package fmp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// Track is one audio or video track, stored in its own fragmented MP4 file
+type Track struct {
+	Name       string    // Name of track - becomes part of filename
+	TimeBase   time.Time // All PTS times are relative to this
+	Codec      string    // eg "h264"
+	Width      int       // Only applicable to video
+	Height     int       // Only applicable to video
+	SampleRate int       // Only applicable to audio
+	Channels   int       // Only applicable to audio
+
+	file     *os.File
+	canWrite bool
+	size     int64    // Size of the valid part of the file (ie excluding a partially written fragment)
+	samples  []sample // Every sample in the file
+	sequence uint32   // Sequence number of the last fragment
+}
+
+// One sample (ie one video frame, which can consist of several NALUs, or one audio packet)
+type sample struct {
+	time   int64 // Decode time, relative to TimeBase, in units of TimeScale
+	offset int64 // Position of the sample data in the file
+	size   uint32
+	sync   bool // Keyframe
+}
+
+// Sample flags in the 'trun' box
+const (
+	sampleFlagsSync    = 0x02000000 // Does not depend on other samples
+	sampleFlagsNonSync = 0x01010000 // Depends on other samples, and is not a sync sample
+)
+
+// Box type of our custom box inside 'udta', which holds the precise TimeBase,
+// because the creation time of the standard boxes only has a resolution of 1 second.
+const timeBaseBoxType = "cyTB"
+
+// Create a new video track in memory.
+// The track's file is created when it is added to a File.
+func MakeVideoTrack(name string, timeBase time.Time, codec string, width, height int) (*Track, error) {
+	if !IsVideoCodec(codec) {
+		return nil, ErrInvalidCodec
+	}
+	return &Track{
+		Name:     name,
+		TimeBase: timeBase,
+		Codec:    codec,
+		Width:    width,
+		Height:   height,
+	}, nil
+}
+
+// Create a new audio track in memory.
+// The track's file is created when it is added to a File.
+func MakeAudioTrack(name string, timeBase time.Time, codec string, sampleRate, channels int) (*Track, error) {
+	if !IsAudioCodec(codec) {
+		return nil, ErrInvalidCodec
+	}
+	if sampleRate < 1 || sampleRate > 65535 || channels < 1 || channels > 8 {
+		return nil, fmt.Errorf("Invalid audio sample rate/channels (%v, %v)", sampleRate, channels)
+	}
+	if codec == CodecAAC {
+		if _, err := addADTS(nil, sampleRate, channels); err != nil {
+			return nil, fmt.Errorf("Unsupported AAC configuration: %w", err)
+		}
+	}
+	return &Track{
+		Name:       name,
+		TimeBase:   timeBase,
+		Codec:      codec,
+		SampleRate: sampleRate,
+		Channels:   channels,
+	}, nil
+}
+
+// Returns true if this is an audio track
+func (t *Track) IsAudio() bool {
+	return IsAudioCodec(t.Codec)
+}
+
+// Create the file of the track, and write the init segment
+func (t *Track) createTrackFile(baseFilename string) error {
+	f, err := os.OpenFile(TrackFilename(baseFilename, t.Name), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0660)
+	if err != nil {
+		return err
+	}
+	t.file = f
+	t.canWrite = true
+	init := t.initSegment()
+	if _, err := f.Write(init); err != nil {
+		return err
+	}
+	t.size = int64(len(init))
+	return nil
+}
+
+// Open an existing track file
+func openTrack(baseFilename, trackName string) (*Track, error) {
+	f, err := os.Open(TrackFilename(baseFilename, trackName))
+	if err != nil {
+		return nil, err
+	}
+	t := &Track{
+		Name: trackName,
+		file: f,
+	}
+	if _, err := t.scan(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Error reading %v: %w", f.Name(), err)
+	}
+	return t, nil
+}
+
+func (t *Track) Close() error {
+	if t.file == nil {
+		return nil
+	}
+	err := t.file.Close()
+	t.file = nil
+	return err
+}
+
+// Duration of the track, up to the PTS of the last sample
+func (t *Track) Duration() time.Duration {
+	if len(t.samples) == 0 {
+		return 0
+	}
+	return DecodeTimeOffset(t.samples[len(t.samples)-1].time)
+}
+
+// Size of the valid data in the file
+func (t *Track) FileSize() int64 {
+	return t.size
+}
+
+func (t *Track) HasCapacity(nNALU int, maxPTS time.Time, combinedPayloadBytes int) bool {
+	if !t.canWrite {
+		return false
+	}
+	if nNALU == 0 {
+		return true
+	}
+	// Allow for the moof box, and the 4 byte length prefix of each NALU
+	overhead := int64(200 + nNALU*20)
+	if t.size+int64(combinedPayloadBytes)+overhead > MaxFileSize {
+		return false
+	}
+	return maxPTS.Sub(t.TimeBase) < MaxDuration
+}
+
+// Write NALUs as a single fragment.
+// For video, consecutive NALUs with the same PTS are stored in the same sample.
+// For audio, every NALU is one sample.
+func (t *Track) WriteNALUs(nalus []NALU) error {
+	if !t.canWrite {
+		return ErrReadOnly
+	}
+	if len(nalus) == 0 {
+		return nil
+	}
+
+	// Build the samples
+	type newSample struct {
+		time int64
+		data []byte
+		sync bool
+	}
+	lastTime := int64(-1)
+	if len(t.samples) != 0 {
+		lastTime = t.samples[len(t.samples)-1].time
+	}
+	samples := []newSample{}
+	for i := range nalus {
+		tm := EncodeTimeOffset(nalus[i].PTS.Sub(t.TimeBase))
+		if tm < 0 || tm < lastTime {
+			return fmt.Errorf("NALU PTS %v is before the previous NALU, or before the track time base", nalus[i].PTS)
+		}
+		if t.IsAudio() {
+			data := nalus[i].Payload
+			if t.Codec == CodecAAC {
+				var err error
+				if data, err = stripADTS(data); err != nil {
+					return err
+				}
+			}
+			samples = append(samples, newSample{time: tm, data: data, sync: true})
+			lastTime = tm
+			continue
+		}
+		if i == 0 || nalus[i].PTS != nalus[i-1].PTS {
+			samples = append(samples, newSample{time: tm})
+		}
+		s := &samples[len(samples)-1]
+		var raw []byte
+		if nalus[i].Flags&NALUFlagAnnexB != 0 {
+			raw = stripStartCode(nalus[i].Payload)
+		} else {
+			raw = addEmulationPrevention(nalus[i].Payload)
+		}
+		s.data = binary.BigEndian.AppendUint32(s.data, uint32(len(raw)))
+		s.data = append(s.data, raw...)
+		s.sync = s.sync || nalus[i].IsKeyFrame()
+		lastTime = tm
+	}
+
+	// The duration of the last sample is unknown, so we repeat the previous duration.
+	// This only affects playback of the final frame, because every fragment
+	// carries its own absolute decode time.
+	lastDuration := int64(TimeScale / 10)
+	if t.Codec == CodecAAC {
+		lastDuration = int64(aacSamplesPerFrame) * TimeScale / int64(t.SampleRate)
+	} else if t.IsAudio() {
+		lastDuration = int64(len(samples[len(samples)-1].data)/t.Channels) * TimeScale / int64(t.SampleRate)
+	} else if len(samples) > 1 {
+		lastDuration = samples[len(samples)-1].time - samples[len(samples)-2].time
+	} else if len(t.samples) != 0 {
+		lastDuration = samples[0].time - t.samples[len(t.samples)-1].time
+	}
+
+	w := boxWriter{}
+	w.begin("moof")
+	w.beginFull("mfhd", 0, 0)
+	w.u32(t.sequence + 1)
+	w.end()
+	w.begin("traf")
+	w.beginFull("tfhd", 0, 0x020000) // default-base-is-moof
+	w.u32(1)                         // track_ID
+	w.end()
+	w.beginFull("tfdt", 1, 0)
+	w.u64(uint64(samples[0].time))
+	w.end()
+	w.beginFull("trun", 0, 0x000001|0x000100|0x000200|0x000400) // data offset, duration, size, flags
+	w.u32(uint32(len(samples)))
+	dataOffsetPos := len(w.buf)
+	w.u32(0) // data offset is patched below
+	for i := range samples {
+		duration := lastDuration
+		if i+1 < len(samples) {
+			duration = samples[i+1].time - samples[i].time
+		}
+		w.u32(uint32(duration))
+		w.u32(uint32(len(samples[i].data)))
+		if samples[i].sync {
+			w.u32(sampleFlagsSync)
+		} else {
+			w.u32(sampleFlagsNonSync)
+		}
+	}
+	w.end() // trun
+	w.end() // traf
+	w.end() // moof
+	binary.BigEndian.PutUint32(w.buf[dataOffsetPos:], uint32(len(w.buf)+8))
+	w.begin("mdat")
+	dataStart := t.size + int64(len(w.buf))
+	for i := range samples {
+		w.bytes(samples[i].data)
+	}
+	w.end()
+
+	if _, err := t.file.WriteAt(w.buf, t.size); err != nil {
+		return err
+	}
+
+	pos := dataStart
+	for i := range samples {
+		t.samples = append(t.samples, sample{
+			time:   samples[i].time,
+			offset: pos,
+			size:   uint32(len(samples[i].data)),
+			sync:   samples[i].sync,
+		})
+		pos += int64(len(samples[i].data))
+	}
+	t.size += int64(len(w.buf))
+	t.sequence++
+	return nil
+}
+
+// Read NALUs by time, where startTime and endTime are relative to TimeBase.
+// The range is inclusive of endTime.
+func (t *Track) ReadAtTime(startTime, endTime time.Duration, seekBackToKeyFrame, headersOnly bool) ([]NALU, error) {
+	// Work in encoded time, so that a read at time T is guaranteed to include a write at time T
+	start := EncodeTimeOffset(startTime)
+	end := EncodeTimeOffset(endTime)
+	startIdx := sort.Search(len(t.samples), func(i int) bool {
+		return t.samples[i].time >= start
+	})
+	endIdx := sort.Search(len(t.samples), func(i int) bool {
+		return t.samples[i].time > end
+	})
+	if seekBackToKeyFrame {
+		if startIdx == len(t.samples) {
+			startIdx--
+		}
+		for startIdx > 0 && !t.samples[startIdx].sync {
+			startIdx--
+		}
+	}
+	if startIdx < 0 || endIdx <= startIdx {
+		return nil, nil
+	}
+
+	// Read all of the samples in one go. The fragment headers in between are not needed,
+	// but they're small.
+	first := t.samples[startIdx].offset
+	last := t.samples[endIdx-1].offset + int64(t.samples[endIdx-1].size)
+	buf := make([]byte, last-first)
+	if _, err := t.file.ReadAt(buf, first); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	nalus := []NALU{}
+	for i := startIdx; i < endIdx; i++ {
+		s := &t.samples[i]
+		pts := t.TimeBase.Add(DecodeTimeOffset(s.time))
+		data := buf[s.offset-first : s.offset-first+int64(s.size)]
+		if t.IsAudio() {
+			nalu := NALU{
+				PTS:    pts,
+				Flags:  NALUFlagKeyFrame,
+				Length: int64(len(data)),
+			}
+			if t.Codec == CodecAAC {
+				nalu.Length += 7 // ADTS header
+			}
+			if !headersOnly {
+				if t.Codec == CodecAAC {
+					frame, err := addADTS(data, t.SampleRate, t.Channels)
+					if err != nil {
+						return nil, err
+					}
+					nalu.Payload = frame
+				} else {
+					nalu.Payload = append([]byte(nil), data...)
+				}
+			}
+			nalus = append(nalus, nalu)
+			continue
+		}
+		for len(data) >= 4 {
+			n := int(binary.BigEndian.Uint32(data))
+			if n > len(data)-4 {
+				return nil, fmt.Errorf("Invalid NALU length in sample %v of %v", i, t.file.Name())
+			}
+			raw := data[4 : 4+n]
+			nalu := NALU{
+				PTS:    pts,
+				Flags:  NALUFlagAnnexB | naluTypeFlags(t.Codec, raw),
+				Length: int64(4 + n),
+			}
+			if !headersOnly {
+				nalu.Payload = make([]byte, 4+n)
+				nalu.Payload[3] = 1
+				copy(nalu.Payload[4:], raw)
+			}
+			nalus = append(nalus, nalu)
+			data = data[4+n:]
+		}
+	}
+	return nalus, nil
+}
+
+// Build the ftyp and moov boxes
+func (t *Track) initSegment() []byte {
+	w := boxWriter{}
+	w.begin("ftyp")
+	w.bytes([]byte("iso6"))
+	w.u32(0)
+	w.bytes([]byte("iso6mp41"))
+	w.end()
+
+	creation := uint64(t.TimeBase.Unix() + 2082844800) // Seconds since 1904
+	w.begin("moov")
+	w.beginFull("mvhd", 1, 0)
+	w.u64(creation)
+	w.u64(creation)
+	w.u32(1000) // timescale
+	w.u64(0)    // duration is unknown, because the file is fragmented
+	w.u32(0x00010000)
+	w.u16(0x0100)
+	w.zeros(10)
+	writeMatrix(&w)
+	w.zeros(24)
+	w.u32(2) // next_track_ID
+	w.end()
+
+	w.begin("trak")
+	w.beginFull("tkhd", 1, 3) // enabled, in movie
+	w.u64(creation)
+	w.u64(creation)
+	w.u32(1) // track_ID
+	w.u32(0)
+	w.u64(0) // duration
+	w.zeros(8)
+	w.u16(0) // layer
+	w.u16(0) // alternate group
+	if t.IsAudio() {
+		w.u16(0x0100) // volume
+	} else {
+		w.u16(0)
+	}
+	w.u16(0)
+	writeMatrix(&w)
+	w.u32(uint32(t.Width) << 16)
+	w.u32(uint32(t.Height) << 16)
+	w.end()
+
+	w.begin("mdia")
+	w.beginFull("mdhd", 1, 0)
+	w.u64(creation)
+	w.u64(creation)
+	w.u32(TimeScale)
+	w.u64(0)
+	w.u16(0x55c4) // language "und"
+	w.u16(0)
+	w.end()
+	w.beginFull("hdlr", 0, 0)
+	w.u32(0)
+	if t.IsAudio() {
+		w.bytes([]byte("soun"))
+		w.zeros(12)
+		w.bytes([]byte("SoundHandler\x00"))
+	} else {
+		w.bytes([]byte("vide"))
+		w.zeros(12)
+		w.bytes([]byte("VideoHandler\x00"))
+	}
+	w.end()
+
+	w.begin("minf")
+	if t.IsAudio() {
+		w.beginFull("smhd", 0, 0)
+		w.zeros(4)
+	} else {
+		w.beginFull("vmhd", 0, 1)
+		w.zeros(8)
+	}
+	w.end()
+	w.begin("dinf")
+	w.beginFull("dref", 0, 0)
+	w.u32(1)
+	w.beginFull("url ", 0, 1) // media is in this file
+	w.end()
+	w.end()
+	w.end() // dinf
+
+	w.begin("stbl")
+	w.beginFull("stsd", 0, 0)
+	w.u32(1)
+	if t.IsAudio() {
+		t.writeAudioSampleEntry(&w)
+	} else {
+		t.writeSampleEntry(&w)
+	}
+	w.end()
+	for _, empty := range []string{"stts", "stsc", "stco"} {
+		w.beginFull(empty, 0, 0)
+		w.u32(0)
+		w.end()
+	}
+	w.beginFull("stsz", 0, 0)
+	w.u32(0)
+	w.u32(0)
+	w.end()
+	w.end() // stbl
+	w.end() // minf
+	w.end() // mdia
+	w.end() // trak
+
+	w.begin("mvex")
+	w.beginFull("trex", 0, 0)
+	w.u32(1) // track_ID
+	w.u32(1) // default_sample_description_index
+	w.u32(0)
+	w.u32(0)
+	w.u32(0)
+	w.end()
+	w.end()
+
+	w.begin("udta")
+	w.begin(timeBaseBoxType)
+	w.u64(uint64(t.TimeBase.UnixNano()))
+	w.end()
+	w.end()
+
+	w.end() // moov
+	return w.buf
+}
+
+func writeMatrix(w *boxWriter) {
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		w.u32(v)
+	}
+}
+
+// We use the avc3 and hev1 sample entries, which allow the parameter sets to live
+// inside the samples, instead of in the init segment. This is necessary because
+// we write the init segment before we have seen the first SPS. It also means that
+// every keyframe is self-contained, which is what fsv expects when it reads.
+func (t *Track) writeSampleEntry(w *boxWriter) {
+	if t.Codec == CodecH265 {
+		w.begin("hev1")
+	} else {
+		w.begin("avc3")
+	}
+	w.zeros(6)
+	w.u16(1) // data_reference_index
+	w.zeros(16)
+	w.u16(uint16(t.Width))
+	w.u16(uint16(t.Height))
+	w.u32(0x00480000) // 72 dpi
+	w.u32(0x00480000)
+	w.u32(0)
+	w.u16(1) // frame_count
+	w.zeros(32)
+	w.u16(0x0018)
+	w.u16(0xffff)
+	if t.Codec == CodecH265 {
+		w.begin("hvcC")
+		w.u8(1)           // configurationVersion
+		w.u8(1)           // Main profile
+		w.u32(0x60000000) // compatible with Main and Main10
+		w.zeros(6)        // constraint flags
+		w.u8(153)         // level 5.1
+		w.u16(0xf000)
+		w.u8(0xfc)
+		w.u8(0xfd) // 4:2:0
+		w.u8(0xf8)
+		w.u8(0xf8)
+		w.u16(0)   // avgFrameRate
+		w.u8(0x0f) // 1 temporal layer, nested, 4 byte NALU lengths
+		w.u8(0)    // no parameter set arrays
+		w.end()
+	} else {
+		w.begin("avcC")
+		w.u8(1)    // configurationVersion
+		w.u8(100)  // High profile
+		w.u8(0)    // profile compatibility
+		w.u8(51)   // level 5.1
+		w.u8(0xff) // 4 byte NALU lengths
+		w.u8(0xe0) // no SPS
+		w.u8(0)    // no PPS
+		w.end()
+	}
+	w.end()
+}
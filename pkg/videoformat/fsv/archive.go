@@ -5,6 +5,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -25,6 +26,7 @@ type videoFile struct {
 	endTime   time.Time // End time of the video file
 	file      VideoFile // Interface to the on-disk format. This is an open handle to the video file, and needs to be Closed() when we're done with it.
 	tracks    []string  // Names of all the tracks that we've written in this file
+	volume    int       // Index into Archive.volumes
 }
 
 // A small-memory-footprint record that exists for every file in the archive
@@ -32,6 +34,8 @@ type videoFileIndex struct {
 	filename  string // Only the logical filename, such as "1712815946731"
 	startTime int64  // Milliseconds UTC, should be equal to the filename (we might consider getting rid of "filename")
 	size      int64  // Size of the file in bytes. For rf1 files, this is the sum of all rf1 files (all tracks: index files and packet files)
+	volume    uint8  // Index into Archive.volumes. The mover changes this when it migrates the file to another volume.
+	format    uint8  // Index into Archive.formats. New files are always written with formats[0].
 
 	// Names of the tracks (necessary for rf1, so we can delete all tracks/files of the video without scanning the filesystem).
 	// Note: This array is likely shared with many (or all) other videoFileIndex objects in the same stream.
@@ -79,16 +83,19 @@ type StreamInfo struct {
 // Every write call has enough information to create a new track, if necessary.
 // This allows us to have a stateless Write API.
 type TrackPayload struct {
-	TrackType   rf1.TrackType
-	Codec       string // For audio/video tracks
-	VideoWidth  int    // For video tracks
-	VideoHeight int    // For video tracks
-	NALUs       []NALU
+	TrackType       rf1.TrackType
+	Codec           string // For audio/video tracks
+	VideoWidth      int    // For video tracks
+	VideoHeight     int    // For video tracks
+	AudioSampleRate int    // For audio tracks
+	AudioChannels   int    // For audio tracks
+	NALUs           []NALU
 }
 
 // Returns true if all parameters except the payload is identical (eg same codec,width,height,etc)
 func (t *TrackPayload) EqualStructure(b *TrackPayload) bool {
-	return t.TrackType == b.TrackType && t.Codec == b.Codec && t.VideoWidth == b.VideoWidth && t.VideoHeight == b.VideoHeight
+	return t.TrackType == b.TrackType && t.Codec == b.Codec && t.VideoWidth == b.VideoWidth && t.VideoHeight == b.VideoHeight &&
+		t.AudioSampleRate == b.AudioSampleRate && t.AudioChannels == b.AudioChannels
 }
 
 func MakeVideoPayload(codec string, width, height int, nalus []NALU) TrackPayload {
@@ -100,6 +107,17 @@ func MakeVideoPayload(codec string, width, height int, nalus []NALU) TrackPayloa
 	}
 }
 
+// Every audio packet must have NALUFlagKeyFrame set, so that seeking works
+func MakeAudioPayload(codec string, sampleRate, channels int, nalus []NALU) TrackPayload {
+	return TrackPayload{
+		TrackType:       rf1.TrackTypeAudio,
+		Codec:           codec,
+		AudioSampleRate: sampleRate,
+		AudioChannels:   channels,
+		NALUs:           nalus,
+	}
+}
+
 // NALU flags
 type NALUFlags uint32
 
@@ -129,22 +147,31 @@ func (n *NALU) IsEssentialMeta() bool {
 // Archive is a collection of zero or more video streams,
 // rooted at the same base directory. Every sub-directory from the base holds
 // the videos of one stream. The stream name is the directory name.
+// An archive can span multiple volumes, in which case every volume has the
+// same layout, and the files of a stream are spread across the volumes.
 // Archive is not safe for use from multiple threads.
 type Archive struct {
 	log                  logs.Log
-	baseDir              string
+	volumes              []*archiveVolume // volumes[0] is the primary (hottest) volume
 	formats              []VideoFormat
-	maxVideoFileDuration time.Duration  // We need to know this so that it is fast to find files close to a given time period.
-	shutdown             chan bool      // This is closed at the start of Archive.Close()
-	bufferWriterStopped  chan bool      // Buffer writer thread closes this when it exits
-	sweepStop            chan bool      // Tell the sweeper to stop
-	sweeperStopped       chan bool      // Sweeper closes this once it has stopped
-	kickWriteBufferFlush chan bool      // Used to wake up the write buffer flush thread
-	recentWriteMaxQueue  int            // Max number of NALU headers we'll store in videoStream.recentWrite
-	staticSettings       StaticSettings // Initialization settings (can't be changed while Open)
-
-	dynamicSettingsLock sync.Mutex // Guards access to dynamicSettings
+	maxVideoFileDuration time.Duration   // We need to know this so that it is fast to find files close to a given time period.
+	shutdown             chan bool       // This is closed at the start of Archive.Close()
+	bufferWriterStopped  chan bool       // Buffer writer thread closes this when it exits
+	sweepStop            chan bool       // Tell the sweeper to stop
+	sweeperStopped       chan bool       // Sweeper closes this once it has stopped
+	moverStop            chan bool       // Tell the mover to stop
+	moverStopped         chan bool       // Mover closes this once it has stopped
+	pendingDeletes       []pendingDelete // Source files of completed moves and thinnings. Only accessed by the mover thread.
+	kickWriteBufferFlush chan bool       // Used to wake up the write buffer flush thread
+	recentWriteMaxQueue  int             // Max number of NALU headers we'll store in videoStream.recentWrite
+	staticSettings       StaticSettings  // Initialization settings (can't be changed while Open)
+
+	dynamicSettingsLock sync.Mutex // Guards access to dynamicSettings, retention, retentionByStream, holds, thinning
 	dynamicSettings     DynamicSettings
+	retention           []RetentionPolicy           // Per-stream retention policies. Replaced wholesale by SetRetentionPolicies.
+	retentionByStream   map[string]*RetentionPolicy // Map from stream name to policy (pointers into 'retention')
+	holds               []Hold                      // Time ranges that the sweeper may not delete. Replaced wholesale by SetHolds.
+	thinning            []ThinningPolicy            // Streams whose old files are reduced to keyframes. Replaced wholesale by SetThinningPolicies.
 
 	streamsLock sync.Mutex // Guards access to the streams map. Access inside a stream needs stream.contentLock.
 	streams     map[string]*videoStream
@@ -202,6 +229,15 @@ func DefaultStaticSettings() StaticSettings {
 // When creating new streams, formats[0] is used, so the ordering
 // of formats is important.
 func Open(logger logs.Log, baseDir string, formats []VideoFormat, initSettings StaticSettings, settings DynamicSettings) (*Archive, error) {
+	return OpenVolumes(logger, []Volume{{Path: baseDir}}, formats, initSettings, settings)
+}
+
+// Open an archive that spans one or more volumes.
+// volumes[0] is the primary volume, and its directory must exist. The other volumes must
+// have been initialized with InitVolume. See Volume for details.
+// If some of the volumes are not available, then we open the archive anyway, and
+// record onto the volumes that are available.
+func OpenVolumes(logger logs.Log, volumes []Volume, formats []VideoFormat, initSettings StaticSettings, settings DynamicSettings) (*Archive, error) {
 	if len(formats) == 0 {
 		return nil, fmt.Errorf("No video formats provided")
 	}
@@ -223,15 +259,15 @@ func Open(logger logs.Log, baseDir string, formats []VideoFormat, initSettings S
 	// no longer valid.
 	maxVideoFileDuration := 1000 * time.Second
 
-	baseDir = strings.TrimSuffix(baseDir, "/")
-	// Scan top-level directories.
-	// Each directory is a stream (eg camera-0001).
+	if err := ValidateVolumes(volumes); err != nil {
+		return nil, err
+	}
+
 	archive := &Archive{
 		log:                  logs.NewPrefixLogger(logger, "Archive:"),
 		shutdown:             make(chan bool),
 		bufferWriterStopped:  make(chan bool),
 		kickWriteBufferFlush: make(chan bool, 10),
-		baseDir:              baseDir,
 		formats:              formats,
 		streams:              map[string]*videoStream{},
 		maxVideoFileDuration: maxVideoFileDuration,
@@ -240,23 +276,17 @@ func Open(logger logs.Log, baseDir string, formats []VideoFormat, initSettings S
 		dynamicSettings:      settings,
 		lastStatWriteTime:    time.Now(),
 	}
-	err := filepath.WalkDir(baseDir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() && path != baseDir {
-			streamName := filepath.Base(path)
-			archive.streams[streamName] = &videoStream{
-				name:        streamName,
-				recentWrite: map[string][]NALU{},
-				writeBuffer: map[string][]TrackPayload{},
-			}
-			return filepath.SkipDir
+	for i, v := range volumes {
+		v.Path = strings.TrimSuffix(v.Path, "/")
+		vol := &archiveVolume{
+			Volume: v,
+			index:  i,
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
+		vol.online.Store(archive.isVolumeAvailable(vol))
+		archive.volumes = append(archive.volumes, vol)
+	}
+	if len(volumes) == 1 && !archive.volumes[0].online.Load() {
+		return nil, fmt.Errorf("Archive directory '%v' does not exist", volumes[0].Path)
 	}
 
 	// Scan for all video files, so that we know the start and end time of each stream,
@@ -266,6 +296,7 @@ func Open(logger logs.Log, baseDir string, formats []VideoFormat, initSettings S
 	}
 
 	archive.startSweeper()
+	archive.startMover()
 	go archive.writeBufferThread()
 
 	return archive, nil
@@ -335,8 +366,12 @@ func (a *Archive) scan() error {
 		a.log.Infof("Archive scan took %v", time.Now().Sub(scanStart))
 	}()
 
-	for _, stream := range a.streams {
-		if err := a.scanStream(stream); err != nil {
+	for _, vol := range a.volumes {
+		if !vol.online.Load() {
+			a.log.Warnf("Volume %v is not available. Its videos will be missing until it returns.", vol.Path)
+			continue
+		}
+		if err := a.scanVolume(vol); err != nil {
 			return err
 		}
 	}
@@ -359,12 +394,50 @@ func (a *Archive) scan() error {
 	return nil
 }
 
-func (a *Archive) scanStream(stream *videoStream) error {
+// Scan the stream directories of a single volume, and add the files that we find to the index.
+// This is called during Open(), and by the mover if a volume that was missing at startup appears later.
+func (a *Archive) scanVolume(vol *archiveVolume) error {
+	entries, err := os.ReadDir(vol.Path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		streamName := entry.Name()
+		files, err := a.scanStreamDir(vol, streamName)
+		if err != nil {
+			return err
+		}
+		a.streamsLock.Lock()
+		stream := a.streams[streamName]
+		if stream == nil {
+			stream = &videoStream{
+				name:        streamName,
+				recentWrite: map[string][]NALU{},
+				writeBuffer: map[string][]TrackPayload{},
+			}
+			a.streams[streamName] = stream
+		}
+		stream.contentLock.Lock()
+		err = a.addScannedFilesHaveLock(stream, files)
+		stream.contentLock.Unlock()
+		a.streamsLock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	vol.scanned = true
+	return nil
+}
+
+// Return all of the video files in one stream directory of a volume
+func (a *Archive) scanStreamDir(vol *archiveVolume, streamName string) ([]videoFileIndex, error) {
 	// Scan all files in the stream
-	streamDir := a.streamDir(stream.name)
-	foundTime := map[string]*videoFileIndex{} // Total size of all .rf1i/.rf1p files (can be multiple tracks)
-	foundVideo := map[string]bool{}           // Have we found the .rf1i file?
-	streamFormat := a.formats[0]              // Just assume rf1
+	streamDir := a.streamDir(vol.index, streamName)
+	foundTime := map[string]*videoFileIndex{} // Total size of all physical files of a logical file (can be multiple tracks)
+	foundVideo := map[string]bool{}           // Have we found the index file (eg .rf1i)?
 	err := filepath.WalkDir(streamDir, func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
@@ -380,6 +453,18 @@ func (a *Archive) scanStream(stream *videoStream) error {
 		}
 		// Check if this is a video file
 		onlyFilename := filepath.Base(path)
+		if strings.HasSuffix(onlyFilename, moveTempSuffix) {
+			// Leftover from a move that was interrupted
+			a.log.Infof("Deleting incomplete moved file %v", path)
+			os.Remove(path)
+			return nil
+		}
+		if prefix, _, _ := strings.Cut(onlyFilename, "_"); strings.HasSuffix(prefix, thinTempSuffix) {
+			// Leftover from a thinning that was interrupted
+			a.log.Infof("Deleting incomplete thinned file %v", path)
+			os.Remove(path)
+			return nil
+		}
 		// We need to chop the filename up here, because for rf1, look at this example:
 		// path: /var/lib/cyclops/archive/cam-1-HD/1708584695_video.rf1i
 		// onlyFilename: 1708584695_video.rf1i
@@ -387,18 +472,14 @@ func (a *Archive) scanStream(stream *videoStream) error {
 		// tracks, such as 1708584695_audio.rf1i, and we don't want to count this video twice.
 		// It's also nice to be consistent in writing and reading video files. So that's why
 		// we strip all the rf1-specific filename stuff away here.
-		tMilli := int64(0)
-		startTimeUnixMilli, remainder, splitOK := strings.Cut(onlyFilename, "_")
-		if splitOK {
-			tMilli, _ = strconv.ParseInt(startTimeUnixMilli, 10, 64)
-		}
-		if tMilli == 0 {
-			// Ignore files that don't start with "{unixmilli}_"
+		startTimeUnixMilli, tMilli, trackName, _, ok := splitVideoFilename(onlyFilename)
+		if !ok {
+			// Ignore unrecognized filename
 			return nil
 		}
-		trackName, ext, _ := strings.Cut(remainder, ".")
-		if ext != "rf1i" && ext != "rf1p" {
-			// Ignore unrecognized filename
+		formatIdx := a.formatOfFile(onlyFilename, startTimeUnixMilli, trackName)
+		if formatIdx == -1 {
+			// Not one of our formats
 			return nil
 		}
 		//if err != nil {
@@ -412,34 +493,127 @@ func (a *Archive) scanStream(stream *videoStream) error {
 				filename:  startTimeUnixMilli,
 				startTime: tMilli,
 				size:      0,
+				volume:    uint8(vol.index),
+				format:    uint8(formatIdx),
 			}
 			entry = foundTime[startTimeUnixMilli]
+		} else if entry.format != uint8(formatIdx) {
+			a.log.Warnf("Ignoring %v, because %v has another format", path, startTimeUnixMilli)
+			return nil
 		}
 		// Sum of all files with the same timestamp
 		entry.size += st.Size()
 
-		if ext == "rf1i" {
+		if a.formats[formatIdx].IsVideoFile(onlyFilename) {
 			foundVideo[startTimeUnixMilli] = true
 			entry.tracks = append(entry.tracks, trackName)
 		}
 		return nil
 	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	files := []videoFileIndex{}
+	for filename := range foundVideo {
+		files = append(files, *foundTime[filename])
 	}
-	if len(foundVideo) != 0 {
-		// Stream has at least one video file
-		for filename := range foundVideo {
-			stream.files = append(stream.files, *foundTime[filename])
+
+	// Only the latest file of a stream can be open for writing, so that is the only
+	// file that can be damaged by a crash.
+	latest := -1
+	for i := range files {
+		if latest == -1 || files[i].startTime > files[latest].startTime {
+			latest = i
 		}
-		sort.Slice(stream.files, func(i, j int) bool {
-			return stream.files[i].startTime < stream.files[j].startTime
-		})
-		latestVideoFile := filepath.Join(streamDir, stream.files[len(stream.files)-1].filename)
+	}
+	if latest != -1 {
+		a.repairIfUnclean(streamDir, &files[latest])
+	}
+	return files, nil
+}
+
+// Split a filename such as "1708584695123_video.rf1i" into its parts.
+// A thinned file such as "1708584695123.kf_video.rf1i" has the logical name "1708584695123.kf".
+// Returns false if the filename is not recognized.
+func splitVideoFilename(onlyFilename string) (startTimeUnixMilli string, tMilli int64, trackName, ext string, ok bool) {
+	startTimeUnixMilli, remainder, splitOK := strings.Cut(onlyFilename, "_")
+	if splitOK {
+		tMilli, _ = strconv.ParseInt(strings.TrimSuffix(startTimeUnixMilli, thinnedSuffix), 10, 64)
+	}
+	if tMilli == 0 {
+		// Files must start with "{unixmilli}_"
+		return "", 0, "", "", false
+	}
+	trackName, ext, _ = strings.Cut(remainder, ".")
+	if ext == "" {
+		return "", 0, "", "", false
+	}
+	return startTimeUnixMilli, tMilli, trackName, ext, true
+}
+
+// Return the index into a.formats of the format that owns the physical file
+// onlyFilename, or -1 if none of our formats own the file.
+func (a *Archive) formatOfFile(onlyFilename, logicalName, trackName string) int {
+	for i, format := range a.formats {
+		if isFileOfFormat(format, onlyFilename, logicalName, trackName) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns true if onlyFilename is one of the physical files of the given track of a logical file
+func isFileOfFormat(format VideoFormat, onlyFilename, logicalName, trackName string) bool {
+	return slices.Contains(format.Files(logicalName, []string{trackName}), onlyFilename)
+}
+
+// Merge newly scanned files into the stream's index.
+// You must be holding stream.contentLock.
+func (a *Archive) addScannedFilesHaveLock(stream *videoStream, files []videoFileIndex) error {
+	if len(files) == 0 {
+		return nil
+	}
+	stream.format = a.formats[0]
+
+	all := append(stream.files, files...)
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].startTime != all[j].startTime {
+			return all[i].startTime < all[j].startTime
+		}
+		return all[i].volume < all[j].volume
+	})
 
-		stream.format = streamFormat
+	// Remove duplicates, which are the result of a move that was interrupted.
+	// We also exclude 'current', in case it's already on disk.
+	currentName := ""
+	if stream.current != nil {
+		currentName = filepath.Base(stream.current.filename)
+	}
+	stream.files = make([]videoFileIndex, 0, len(all))
+	for _, f := range all {
+		if f.filename == currentName {
+			continue
+		}
+		if n := len(stream.files); n != 0 && stream.files[n-1].startTime == f.startTime {
+			keep, discard := chooseDuplicate(stream.files[n-1], f)
+			stream.files[n-1] = keep
+			discardName := filepath.Join(a.streamDir(int(discard.volume), stream.name), discard.filename)
+			a.log.Infof("Deleting duplicate video file %v", discardName)
+			if err := a.formats[discard.format].Delete(discardName, discard.tracks); err != nil {
+				a.log.Warnf("Failed to delete duplicate video file %v: %v", discardName, err)
+			}
+			continue
+		}
+		stream.files = append(stream.files, f)
+	}
+
+	if stream.current == nil || stream.files[0].startTime < stream.current.startTime.UnixMilli() {
 		stream.startTime = time.UnixMilli(stream.files[0].startTime)
-		if file, err := streamFormat.Open(latestVideoFile); err != nil {
+	}
+	if stream.current == nil {
+		latest := stream.files[len(stream.files)-1]
+		latestVideoFile := filepath.Join(a.streamDir(int(latest.volume), stream.name), latest.filename)
+		if file, err := a.formats[latest.format].Open(latestVideoFile); err != nil {
 			return fmt.Errorf("Error opening latest video file '%v' in stream %v: %w", latestVideoFile, stream.name, err)
 		} else {
 			// stream.endTime is the end time of the longest track in the latest video file (all tracks will usually have similar durations)
@@ -467,8 +641,14 @@ func (a *Archive) scanStream(stream *videoStream) error {
 	return nil
 }
 
-func (a *Archive) streamDir(streamName string) string {
-	return filepath.Join(a.baseDir, streamName)
+// The directory of the stream on the given volume
+func (a *Archive) streamDir(volume int, streamName string) string {
+	return filepath.Join(a.volumes[volume].Path, streamName)
+}
+
+// The full path of a logical video file in the index
+func (a *Archive) indexedFilename(streamName string, file *videoFileIndex) string {
+	return filepath.Join(a.streamDir(int(file.volume), streamName), file.filename)
 }
 
 // Close the archive.
@@ -481,6 +661,7 @@ func (a *Archive) streamDir(streamName string) string {
 func (a *Archive) Close() {
 	a.log.Infof("Archive closing")
 	a.stopSweeper()
+	a.stopMover()
 	a.flushWriteBuffers(true)
 	a.streamsLock.Lock()
 	defer a.streamsLock.Unlock()
@@ -511,19 +692,20 @@ func (a *Archive) getOrCreateStream(streamName string) (*videoStream, error) {
 			writeBuffer: map[string][]TrackPayload{},
 		}
 		a.streams[streamName] = stream
-
-		// Ensure the stream directory exists
-		if err := os.Mkdir(a.streamDir(streamName), 0770); err != nil && !os.IsExist(err) {
-			return nil, fmt.Errorf("Error creating stream directory '%v': %v", a.streamDir(streamName), err)
-		}
+		// The stream directory is created on demand, when we create the stream's first video file on a volume
 	}
 	return stream, nil
 }
 
 func (a *Archive) deleteEmptyStreamHaveLock(streamName string) {
-	dir := a.streamDir(streamName)
-	if err := os.RemoveAll(dir); err != nil {
-		a.log.Warnf("Failed to remove empty stream directory %v: %v", dir, err)
+	for _, vol := range a.volumes {
+		if !vol.online.Load() {
+			continue
+		}
+		dir := a.streamDir(vol.index, streamName)
+		if err := os.RemoveAll(dir); err != nil {
+			a.log.Warnf("Failed to remove empty stream directory %v: %v", dir, err)
+		}
 	}
 	delete(a.streams, streamName)
 }
@@ -569,6 +751,46 @@ func (a *Archive) StreamSizes() map[string]int64 {
 	return streamSize
 }
 
+// A closed video file in the archive
+type FileInfo struct {
+	Stream    string
+	Name      string    // Logical filename, such as "1712815946731"
+	StartTime time.Time // Start time of the video
+	EndTime   time.Time // Approximate end time of the video (see fileEndTimeHaveLock)
+	Size      int64     // Sum of the sizes of all physical files
+	Files     []string  // Full paths of the physical files, in the order returned by VideoFormat.Files
+}
+
+// Return the closed video files of a stream, from oldest to newest.
+// The file that is currently being written to is excluded.
+// The sweeper may delete a file, or the mover may move it to another volume,
+// at any time after this returns, so the caller must be prepared for
+// the physical files to be missing.
+func (a *Archive) ListFiles(streamName string) []FileInfo {
+	a.streamsLock.Lock()
+	stream := a.streams[streamName]
+	a.streamsLock.Unlock()
+	if stream == nil {
+		return nil
+	}
+
+	stream.contentLock.Lock()
+	defer stream.contentLock.Unlock()
+	files := make([]FileInfo, 0, len(stream.files))
+	for i := range stream.files {
+		f := &stream.files[i]
+		files = append(files, FileInfo{
+			Stream:    streamName,
+			Name:      f.filename,
+			StartTime: time.UnixMilli(f.startTime),
+			EndTime:   fileEndTimeHaveLock(stream, i),
+			Size:      f.size,
+			Files:     a.formats[f.format].Files(a.indexedFilename(streamName, f), f.tracks),
+		})
+	}
+	return files
+}
+
 func DoTimeRangesOverlap(start1, end1, start2, end2 time.Time) bool {
 	return start1.Before(end2) && start2.Before(end1)
 }
@@ -0,0 +1,123 @@
+package fsv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
+)
+
+// Result of checking a single video file with CheckArchive
+type FileCheck struct {
+	Stream    string    // Name of the stream (eg "cam-1-HD")
+	Filename  string    // Full path of the logical video file, eg /var/lib/cyclops/fsv/cam-1-HD/1712815946731
+	StartTime time.Time // Start time of the video, according to the filename
+	CheckResult
+}
+
+// If the file was not closed cleanly, then repair it, and update its size.
+// This is called during Open(), before the file is added to the index.
+func (a *Archive) repairIfUnclean(streamDir string, file *videoFileIndex) {
+	checker, ok := a.formats[file.format].(VideoFormatChecker)
+	if !ok {
+		return
+	}
+	filename := filepath.Join(streamDir, file.filename)
+	unclean, err := checker.IsUnclean(filename)
+	if err != nil {
+		a.log.Warnf("Failed to check video file %v: %v", filename, err)
+		return
+	}
+	if !unclean {
+		return
+	}
+	res, err := checker.Check(filename, CheckOptions{Repair: true, StartTime: time.UnixMilli(file.startTime)})
+	if err != nil {
+		a.log.Errorf("Failed to repair video file %v: %v", filename, err)
+		return
+	}
+	for _, p := range res.Problems {
+		a.log.Infof("Repaired video file %v: %v", filename, p)
+	}
+	if res.Repaired {
+		// Preallocated space has been released, so our size is now smaller
+		file.size = physicalFileSize(a.formats[file.format], filename, file.tracks)
+	}
+}
+
+// Returns the sum of the sizes of all the physical files of a video
+func physicalFileSize(format VideoFormat, filename string, tracks []string) int64 {
+	size := int64(0)
+	for _, f := range format.Files(filename, tracks) {
+		if st, err := os.Stat(f); err == nil {
+			size += st.Size()
+		}
+	}
+	return size
+}
+
+// Check the integrity of every video file in an archive directory, and optionally repair them.
+// This is intended for offline use (eg from a command line tool), so the archive must not be open.
+// If a file's index is missing, then we try to rebuild it from the packets, using the filename
+// for the start time, and the start of the next file for the duration.
+func CheckArchive(baseDir string, format VideoFormat, repair bool) ([]FileCheck, error) {
+	checker, ok := format.(VideoFormatChecker)
+	if !ok {
+		return nil, fmt.Errorf("Video format does not support integrity checks")
+	}
+	streams, err := os.ReadDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	results := []FileCheck{}
+	for _, stream := range streams {
+		if !stream.IsDir() {
+			continue
+		}
+		streamDir := filepath.Join(baseDir, stream.Name())
+		entries, err := os.ReadDir(streamDir)
+		if err != nil {
+			return nil, err
+		}
+		// Find the unique logical files, regardless of whether their index files exist
+		startTimes := map[string]int64{}
+		for _, e := range entries {
+			name, tMilli, trackName, _, ok := splitVideoFilename(e.Name())
+			if ok && isFileOfFormat(format, e.Name(), name, trackName) {
+				startTimes[name] = tMilli
+			}
+		}
+		names := []string{}
+		for name := range startTimes {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return startTimes[names[i]] < startTimes[names[j]]
+		})
+		for i, name := range names {
+			start := time.UnixMilli(startTimes[name])
+			duration := time.Duration(0)
+			if i+1 < len(names) {
+				// Files are contiguous unless there was a gap in recording
+				if next := time.UnixMilli(startTimes[names[i+1]]); next.Sub(start) < rf1.MaxDuration {
+					duration = next.Sub(start)
+				}
+			}
+			filename := filepath.Join(streamDir, name)
+			res, err := checker.Check(filename, CheckOptions{Repair: repair, StartTime: start, Duration: duration})
+			if err != nil {
+				return nil, fmt.Errorf("Error checking %v: %w", filename, err)
+			}
+			results = append(results, FileCheck{
+				Stream:      stream.Name(),
+				Filename:    filename,
+				StartTime:   start,
+				CheckResult: *res,
+			})
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,112 @@
+package fsv
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
+	"github.com/cyclopcam/logs"
+	"github.com/stretchr/testify/require"
+)
+
+// Create test packets with Annex-B start codes, so that they pass the integrity checks
+func createAnnexBTestPackets(start time.Time, seed int) []NALU {
+	packets := copyRf1NALUstoFsv(rf1.CreateTestNALUs(start, 0, 50, 10, 100, 200, seed))
+	for i := range packets {
+		copy(packets[i].Payload, []byte{0, 0, 0, 1})
+	}
+	return packets
+}
+
+// Make a file look like the process crashed while writing it:
+// the index header count is zero, and both files still have their preallocated space.
+func makeUnclean(t *testing.T, filename string) {
+	idx, err := os.OpenFile(rf1.TrackFilename(filename, "video", rf1.FileTypeIndex), os.O_RDWR, 0660)
+	require.NoError(t, err)
+	defer idx.Close()
+	_, err = idx.WriteAt(binary.LittleEndian.AppendUint16(nil, 0), 24)
+	require.NoError(t, err)
+	require.NoError(t, idx.Truncate(64*1024))
+	require.NoError(t, os.Truncate(rf1.TrackFilename(filename, "video", rf1.FileTypePackets), 1024*1024))
+}
+
+func TestRepairOnOpen(t *testing.T) {
+	EraseArchive()
+	now := time.Now()
+	settings := DefaultStaticSettings()
+	settings.MaxWriteBufferSize = 0
+	arc, err := Open(logs.NewTestingLog(t), BaseDir, []VideoFormat{&VideoFormatRF1{}}, settings, DefaultDynamicSettings())
+	require.NoError(t, err)
+	times := contiguousFileTimes(now.Add(-time.Hour), 2)
+	all := [][]NALU{}
+	for i, start := range times {
+		packets := createAnnexBTestPackets(start, 3+i)
+		require.NoError(t, arc.Write("cam", map[string]TrackPayload{"video": makeVideoPayload(packets)}))
+		all = append(all, packets)
+	}
+	arc.Close()
+
+	arc, err = Open(logs.NewTestingLog(t), BaseDir, []VideoFormat{&VideoFormatRF1{}}, settings, DefaultDynamicSettings())
+	require.NoError(t, err)
+	sizeBefore := arc.TotalSize()
+	arc.Close()
+
+	latest := filepath.Join(BaseDir, "cam", strconv.FormatInt(times[1].UnixMilli(), 10))
+	makeUnclean(t, latest)
+	unclean, err := rf1.IsUnclean(latest)
+	require.NoError(t, err)
+	require.True(t, unclean)
+
+	arc, err = Open(logs.NewTestingLog(t), BaseDir, []VideoFormat{&VideoFormatRF1{}}, settings, DefaultDynamicSettings())
+	require.NoError(t, err)
+	defer arc.Close()
+	unclean, err = rf1.IsUnclean(latest)
+	require.NoError(t, err)
+	require.False(t, unclean)
+	require.Equal(t, sizeBefore, arc.TotalSize())
+	verifyRead(t, arc, "cam", "video", all[1][0].PTS, all[1][49].PTS, 49, 1)
+}
+
+func TestCheckArchive(t *testing.T) {
+	EraseArchive()
+	now := time.Now()
+	settings := DefaultStaticSettings()
+	settings.MaxWriteBufferSize = 0
+	arc, err := Open(logs.NewTestingLog(t), BaseDir, []VideoFormat{&VideoFormatRF1{}}, settings, DefaultDynamicSettings())
+	require.NoError(t, err)
+	times := contiguousFileTimes(now.Add(-time.Hour), 3)
+	for i, start := range times {
+		require.NoError(t, arc.Write("cam", map[string]TrackPayload{"video": makeVideoPayload(createAnnexBTestPackets(start, 3+i))}))
+	}
+	arc.Close()
+
+	// Corrupt the start of a packet in the middle file
+	middle := filepath.Join(BaseDir, "cam", strconv.FormatInt(times[1].UnixMilli(), 10))
+	pkt, err := os.OpenFile(rf1.TrackFilename(middle, "video", rf1.FileTypePackets), os.O_RDWR, 0660)
+	require.NoError(t, err)
+	_, err = pkt.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 0)
+	require.NoError(t, err)
+	pkt.Close()
+
+	results, err := CheckArchive(BaseDir, &VideoFormatRF1{}, false)
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	require.Empty(t, results[0].Problems)
+	require.NotEmpty(t, results[1].Problems)
+	require.False(t, results[1].Repaired)
+	require.Empty(t, results[2].Problems)
+
+	results, err = CheckArchive(BaseDir, &VideoFormatRF1{}, true)
+	require.NoError(t, err)
+	require.True(t, results[1].Repaired)
+
+	results, err = CheckArchive(BaseDir, &VideoFormatRF1{}, false)
+	require.NoError(t, err)
+	for _, r := range results {
+		require.Empty(t, r.Problems)
+	}
+}
@@ -0,0 +1,57 @@
+package fsv
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
+	"github.com/cyclopcam/logs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedArchive(t *testing.T) {
+	EraseArchive()
+	key := make([]byte, rf1.KeySize)
+	rand.Read(key)
+	keys, err := rf1.NewKeyring(key)
+	require.NoError(t, err)
+
+	settings := DefaultStaticSettings()
+	settings.MaxWriteBufferSize = 0
+	plain := []VideoFormat{&VideoFormatRF1{}}
+	encrypted := []VideoFormat{&VideoFormatRF1{Keys: keys, Encrypt: true}}
+
+	// One plaintext file, followed by one encrypted file
+	times := contiguousFileTimes(time.Now().Add(-time.Hour), 2)
+	all := [][]NALU{}
+	for i, formats := range [][]VideoFormat{plain, encrypted} {
+		arc, err := Open(logs.NewTestingLog(t), BaseDir, formats, settings, DefaultDynamicSettings())
+		require.NoError(t, err)
+		packets := createAnnexBTestPackets(times[i], 3+i*2)
+		require.NoError(t, arc.Write("cam", map[string]TrackPayload{"video": makeVideoPayload(packets)}))
+		all = append(all, packets)
+		arc.Close()
+	}
+
+	// Both files are readable with the keys
+	arc, err := Open(logs.NewTestingLog(t), BaseDir, encrypted, settings, DefaultDynamicSettings())
+	require.NoError(t, err)
+	for i := range all {
+		tracks, err := arc.Read("cam", []string{"video"}, all[i][0].PTS, all[i][49].PTS, 0)
+		require.NoError(t, err)
+		require.Equal(t, 50, len(tracks["video"].NALS))
+		for j, n := range tracks["video"].NALS {
+			require.Equal(t, all[i][j].Payload, n.Payload)
+		}
+	}
+	arc.Close()
+
+	// Without the keys, only the plaintext file is readable
+	arc, err = Open(logs.NewTestingLog(t), BaseDir, plain, settings, DefaultDynamicSettings())
+	require.NoError(t, err)
+	defer arc.Close()
+	verifyRead(t, arc, "cam", "video", all[0][0].PTS, all[0][49].PTS, 50, 1)
+	_, err = arc.Read("cam", []string{"video"}, all[1][0].PTS, all[1][49].PTS, 0)
+	require.ErrorContains(t, err, rf1.ErrNoKey.Error())
+}
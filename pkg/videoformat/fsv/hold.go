@@ -0,0 +1,151 @@
+package fsv
+
+import (
+	"fmt"
+	"time"
+)
+
+// Hold protects a time range of one or more streams from deletion (eg a legal hold).
+// The sweeper will not delete any file that overlaps an active hold, regardless of
+// retention policies or archive size limits. Held files are excluded from the size
+// budgets of the sweeper, so the caller must enforce its own quota on held bytes.
+// A file that is held is still moved between volumes as it ages.
+type Hold struct {
+	Streams []string  // Names of the streams that this hold applies to (eg "cam-1-LD", "cam-1-HD")
+	Start   time.Time // Start of the protected footage
+	End     time.Time // End of the protected footage
+	Expires time.Time // Hold is no longer active after this time. Zero = never.
+}
+
+// Returns true if the hold protects footage at 'now'
+func (h *Hold) IsActive(now time.Time) bool {
+	return h.Expires.IsZero() || now.Before(h.Expires)
+}
+
+// Returns true if the hold overlaps the given time range of the given stream
+func (h *Hold) overlaps(stream string, start, end time.Time) bool {
+	if !h.Start.Before(end) || !start.Before(h.End) {
+		return false
+	}
+	for _, s := range h.Streams {
+		if s == stream {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an error if the holds are invalid
+func ValidateHolds(holds []Hold) error {
+	for i := range holds {
+		if !holds[i].Start.Before(holds[i].End) {
+			return fmt.Errorf("Hold start time (%v) must be before end time (%v)", holds[i].Start, holds[i].End)
+		}
+	}
+	return nil
+}
+
+// Replace all holds.
+// The new holds take effect on the next sweep.
+func (a *Archive) SetHolds(holds []Hold) error {
+	if err := ValidateHolds(holds); err != nil {
+		return err
+	}
+	copied := make([]Hold, len(holds))
+	for i := range holds {
+		copied[i] = holds[i]
+		copied[i].Streams = append([]string{}, holds[i].Streams...)
+	}
+	a.dynamicSettingsLock.Lock()
+	defer a.dynamicSettingsLock.Unlock()
+	a.holds = copied
+	return nil
+}
+
+// Return a copy of the current holds
+func (a *Archive) Holds() []Hold {
+	a.dynamicSettingsLock.Lock()
+	defer a.dynamicSettingsLock.Unlock()
+	r := make([]Hold, len(a.holds))
+	copy(r, a.holds)
+	return r
+}
+
+// Returns the holds that are active at 'now'.
+// Holds are immutable once set, so the caller may read them without holding any locks.
+func (a *Archive) ActiveHolds(now time.Time) []Hold {
+	a.dynamicSettingsLock.Lock()
+	defer a.dynamicSettingsLock.Unlock()
+	active := []Hold{}
+	for i := range a.holds {
+		if a.holds[i].IsActive(now) {
+			active = append(active, a.holds[i])
+		}
+	}
+	return active
+}
+
+// Returns true if stream.files[i] overlaps any of the holds.
+// You must be holding stream.contentLock.
+func isFileHeldHaveLock(stream *videoStream, i int, holds []Hold) bool {
+	if len(holds) == 0 {
+		return false
+	}
+	start := time.UnixMilli(stream.files[i].startTime)
+	end := fileEndTimeHaveLock(stream, i)
+	for h := range holds {
+		if holds[h].overlaps(stream.name, start, end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the total size of the files of each stream that overlap any of the holds.
+// The file that is currently being written is included.
+// Use this to measure how much space a set of holds would occupy.
+func (a *Archive) HeldSizes(holds []Hold) map[string]int64 {
+	sizes := map[string]int64{}
+	if len(holds) == 0 {
+		return sizes
+	}
+	a.streamsLock.Lock()
+	streams := make([]*videoStream, 0, len(a.streams))
+	for _, stream := range a.streams {
+		streams = append(streams, stream)
+	}
+	a.streamsLock.Unlock()
+
+	for _, stream := range streams {
+		stream.contentLock.Lock()
+		size := int64(0)
+		for i := range stream.files {
+			if isFileHeldHaveLock(stream, i, holds) {
+				size += stream.files[i].size
+			}
+		}
+		if stream.current != nil {
+			for h := range holds {
+				if holds[h].overlaps(stream.name, stream.current.startTime, time.Now()) {
+					currentSize, _ := stream.current.file.Size()
+					size += currentSize
+					break
+				}
+			}
+		}
+		if size != 0 {
+			sizes[stream.name] = size
+		}
+		stream.contentLock.Unlock()
+	}
+	return sizes
+}
+
+// Returns the total size of all files that overlap any of the holds
+func (a *Archive) HeldSize(holds []Hold) int64 {
+	total := int64(0)
+	for _, size := range a.HeldSizes(holds) {
+		total += size
+	}
+	return total
+}
@@ -0,0 +1,59 @@
+package fsv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHolds(t *testing.T) {
+	now := time.Now()
+	times := contiguousFileTimes(now.Add(-240*time.Hour), 4)
+	arc := createRetentionTestArchive(t, map[string][]time.Time{"s1": times, "s2": times}, map[string]int{"s1": 100, "s2": 100})
+	defer arc.Close()
+
+	// Hold a few seconds inside the second file of s1, and an expired hold on the first file
+	holds := []Hold{
+		{Streams: []string{"s1"}, Start: times[1].Add(10 * time.Second), End: times[1].Add(20 * time.Second)},
+		{Streams: []string{"s1"}, Start: times[0], End: times[0].Add(time.Second), Expires: now.Add(-time.Hour)},
+	}
+	require.Error(t, arc.SetHolds([]Hold{{Streams: []string{"s1"}, Start: times[1], End: times[0]}}))
+	require.NoError(t, arc.SetHolds(holds))
+	require.Len(t, arc.Holds(), 2)
+	active := arc.ActiveHolds(now)
+	require.Len(t, active, 1)
+
+	held := arc.HeldSizes(active)
+	require.Len(t, held, 1)
+	require.Equal(t, arc.streams["s1"].files[1].size, held["s1"])
+	require.Equal(t, held["s1"], arc.HeldSize(active))
+
+	// Try to delete everything. Only the held file survives.
+	arc.sweep(nil, nil, active, arc.TotalSize(), 0, now)
+	require.Equal(t, 1, len(arc.streams["s1"].files))
+	require.Equal(t, times[1].UnixMilli(), arc.streams["s1"].files[0].startTime)
+	require.Nil(t, arc.streams["s2"])
+}
+
+func TestHoldsAndRetention(t *testing.T) {
+	now := time.Now()
+	times := contiguousFileTimes(now.Add(-240*time.Hour), 4)
+	arc := createRetentionTestArchive(t, map[string][]time.Time{"s1": times}, map[string]int{"s1": 100})
+	defer arc.Close()
+
+	// Hold the oldest file. Every file has expired, but the sweeper must skip over the held file.
+	require.NoError(t, arc.SetRetentionPolicies([]RetentionPolicy{{Streams: []string{"s1"}, MaxAge: 48 * time.Hour}}))
+	require.NoError(t, arc.SetHolds([]Hold{{Streams: []string{"s1"}, Start: times[0], End: times[0].Add(time.Second)}}))
+	policies, byStream := arc.retentionSnapshot()
+	arc.sweepExpired(policies, arc.ActiveHolds(now), now)
+	require.Equal(t, 1, len(arc.streams["s1"].files))
+	require.Equal(t, times[0].UnixMilli(), arc.streams["s1"].files[0].startTime)
+	require.Equal(t, times[0].UnixMilli(), arc.streams["s1"].startTime.UnixMilli())
+
+	// Once the hold is released, the file goes
+	require.NoError(t, arc.SetHolds(nil))
+	arc.sweepQuotas(policies, byStream, nil, nil, now)
+	arc.sweepExpired(policies, arc.ActiveHolds(now), now)
+	require.Equal(t, 0, len(arc.streams["s1"].files))
+}
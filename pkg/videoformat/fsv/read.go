@@ -2,7 +2,6 @@ package fsv
 
 import (
 	"fmt"
-	"path/filepath"
 	"sort"
 	"time"
 )
@@ -28,13 +27,17 @@ const (
 )
 
 type TrackReadResult struct {
-	Codec string
-	NALS  []NALU
+	Codec      string
+	SampleRate int // Only applicable to audio tracks
+	Channels   int // Only applicable to audio tracks
+	NALS       []NALU
 }
 
 // Read packets from the archive.
 // The map that is returned contains the tracks that were requested.
 // If no packets are found, we return an empty map and a nil error.
+// Files that don't contain a requested track are skipped for that track, so it's fine
+// to ask for a track (eg "audio") that was only recorded some of the time.
 func (a *Archive) Read(streamName string, trackNames []string, startTime, endTime time.Time, flags ReadFlags) (map[string]*TrackReadResult, error) {
 	a.streamsLock.Lock()
 	stream := a.streams[streamName]
@@ -62,14 +65,20 @@ func (a *Archive) Read(streamName string, trackNames []string, startTime, endTim
 	readFromVideoFile := func(filename string, vf VideoFile) error {
 		fileTracks := vf.ListTracks()
 		for _, trackName := range trackNames {
+			fileTrack, ok := fileTracks[trackName]
+			if !ok {
+				continue
+			}
 			packets, err := vf.Read(trackName, startTime, endTime, flags)
 			if err != nil {
 				return fmt.Errorf("Error reading track %v from video file %v: %v", trackName, filename, err)
 			}
-			codec := fileTracks[trackName].Codec
+			codec := fileTrack.Codec
 			if tracks[trackName] == nil {
 				tracks[trackName] = &TrackReadResult{
-					Codec: codec,
+					Codec:      codec,
+					SampleRate: fileTrack.SampleRate,
+					Channels:   fileTrack.Channels,
 				}
 			} else if tracks[trackName].Codec != codec {
 				return &ErrCodecSwitch{FromCodec: tracks[trackName].Codec, ToCodec: codec}
@@ -92,14 +101,6 @@ func (a *Archive) Read(streamName string, trackNames []string, startTime, endTim
 	// from the files, we'll open the video files independently, thereby
 	// relying on OS/filesystem concurrency.
 	stream.contentLock.Lock()
-	startIdx := sort.Search(len(stream.files), func(i int) bool {
-		return stream.files[i].startTime >= startTime.UnixMilli()
-	}) - 1
-	startIdx = max(startIdx, 0)
-	endIdx := sort.Search(len(stream.files), func(i int) bool {
-		return stream.files[i].startTime >= endTime.UnixMilli()
-	})
-	indexFiles := stream.files[startIdx:endIdx]
 
 	// We need to be conservative in our decision of whether to flush our write buffers. If the Read() is requesting
 	// a portion of time that is close to the present, then it's very likely that we have buffered the writes that
@@ -115,6 +116,17 @@ func (a *Archive) Read(streamName string, trackNames []string, startTime, endTim
 		a.flushWriteBufferForStream(stream)
 	}
 
+	// Search the index after flushing, because a flush can retire the current file into the index
+	startIdx := sort.Search(len(stream.files), func(i int) bool {
+		return stream.files[i].startTime >= startTime.UnixMilli()
+	}) - 1
+	startIdx = max(startIdx, 0)
+	endIdx := sort.Search(len(stream.files), func(i int) bool {
+		return stream.files[i].startTime >= endTime.UnixMilli()
+	})
+	// Copy the index entries, because the mover can change them after we release the lock
+	indexFiles := append([]videoFileIndex(nil), stream.files[startIdx:endIdx]...)
+
 	var useCurrent *videoFile
 	if stream.current != nil && DoTimeRangesOverlap(stream.current.startTime, stream.current.endTime, startTime, endTime) {
 		useCurrent = stream.current
@@ -128,8 +140,8 @@ func (a *Archive) Read(streamName string, trackNames []string, startTime, endTim
 		if file.startTime > endTime.UnixMilli() {
 			break
 		}
-		videoFilename := filepath.Join(a.streamDir(streamName), file.filename)
-		videoFile, err := stream.format.Open(videoFilename)
+		videoFilename := a.indexedFilename(streamName, &file)
+		videoFile, err := a.formats[file.format].Open(videoFilename)
 		if err != nil {
 			return nil, fmt.Errorf("Error opening video file %v: %v", videoFilename, err)
 		}
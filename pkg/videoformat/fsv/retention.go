@@ -0,0 +1,129 @@
+package fsv
+
+import (
+	"fmt"
+	"time"
+)
+
+// RetentionPolicy controls how long we keep the video of one or more streams.
+// A typical use is to group the LD and HD streams of a single camera under one policy.
+//
+// MinAge is a guarantee. The sweeper will not delete a file if it contains any footage
+// younger than MinAge, even if that means exceeding MaxBytes or the archive's MaxArchiveSize.
+// It is up to the user to ensure that their minimum guarantees fit on their disk.
+type RetentionPolicy struct {
+	Streams  []string      // Names of the streams that this policy applies to (eg "cam-1-LD", "cam-1-HD")
+	MinAge   time.Duration // Never delete footage younger than this. Zero = no guarantee.
+	MaxAge   time.Duration // Delete footage older than this, even if there is space available. Zero = no limit.
+	MaxBytes int64         // Maximum total size of all the streams in this policy. Zero = no limit.
+}
+
+// Effective retention of a stream, at the time of the query
+type StreamRetention struct {
+	Name      string
+	Policy    *RetentionPolicy // nil if the stream has no retention policy
+	StartTime time.Time        // Start of the oldest footage in the stream
+	EndTime   time.Time        // End of the most recent footage in the stream
+	Size      int64            // Total bytes of all files in the stream
+}
+
+// Returns an error if the policies are inconsistent
+func ValidateRetentionPolicies(policies []RetentionPolicy) error {
+	seen := map[string]bool{}
+	for i := range policies {
+		p := &policies[i]
+		if p.MinAge < 0 || p.MaxAge < 0 || p.MaxBytes < 0 {
+			return fmt.Errorf("Retention policy values may not be negative")
+		}
+		if p.MinAge != 0 && p.MaxAge != 0 && p.MinAge > p.MaxAge {
+			return fmt.Errorf("Retention policy MinAge (%v) is greater than MaxAge (%v)", p.MinAge, p.MaxAge)
+		}
+		for _, s := range p.Streams {
+			if seen[s] {
+				return fmt.Errorf("Stream '%v' appears in more than one retention policy", s)
+			}
+			seen[s] = true
+		}
+	}
+	return nil
+}
+
+// Replace all retention policies.
+// Streams that are not mentioned in any policy are only subject to the archive's MaxArchiveSize.
+// The new policies take effect on the next sweep.
+func (a *Archive) SetRetentionPolicies(policies []RetentionPolicy) error {
+	if err := ValidateRetentionPolicies(policies); err != nil {
+		return err
+	}
+	byStream := map[string]*RetentionPolicy{}
+	copied := make([]RetentionPolicy, len(policies))
+	for i := range policies {
+		copied[i] = policies[i]
+		copied[i].Streams = append([]string{}, policies[i].Streams...)
+		for _, s := range copied[i].Streams {
+			byStream[s] = &copied[i]
+		}
+	}
+	a.dynamicSettingsLock.Lock()
+	defer a.dynamicSettingsLock.Unlock()
+	a.retention = copied
+	a.retentionByStream = byStream
+	return nil
+}
+
+// Return a copy of the current retention policies
+func (a *Archive) RetentionPolicies() []RetentionPolicy {
+	a.dynamicSettingsLock.Lock()
+	defer a.dynamicSettingsLock.Unlock()
+	r := make([]RetentionPolicy, len(a.retention))
+	copy(r, a.retention)
+	return r
+}
+
+// Returns the policies, and a map from stream name to policy.
+// Policies are immutable once set, so the caller may read them without holding any locks.
+func (a *Archive) retentionSnapshot() ([]RetentionPolicy, map[string]*RetentionPolicy) {
+	a.dynamicSettingsLock.Lock()
+	defer a.dynamicSettingsLock.Unlock()
+	return a.retention, a.retentionByStream
+}
+
+// Report the effective retention of every stream in the archive
+func (a *Archive) RetentionReport() []StreamRetention {
+	_, byStream := a.retentionSnapshot()
+	sizes := a.StreamSizes()
+
+	a.streamsLock.Lock()
+	defer a.streamsLock.Unlock()
+	report := make([]StreamRetention, 0, len(a.streams))
+	for _, stream := range a.streams {
+		stream.contentLock.Lock()
+		r := StreamRetention{
+			Name:      stream.name,
+			StartTime: stream.startTime,
+			EndTime:   stream.endTime,
+			Size:      sizes[stream.name],
+		}
+		stream.contentLock.Unlock()
+		if p := byStream[stream.name]; p != nil {
+			pc := *p
+			r.Policy = &pc
+		}
+		report = append(report, r)
+	}
+	return report
+}
+
+// Returns the time when the footage inside stream.files[i] ends.
+// We don't store the end time of each file, but files are contiguous unless
+// there was a gap in recording, so the start of the next file is a good
+// (and conservative) approximation.
+// You must be holding stream.contentLock.
+func fileEndTimeHaveLock(stream *videoStream, i int) time.Time {
+	if i+1 < len(stream.files) {
+		return time.UnixMilli(stream.files[i+1].startTime)
+	} else if stream.current != nil {
+		return stream.current.startTime
+	}
+	return stream.endTime
+}
@@ -0,0 +1,125 @@
+package fsv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
+	"github.com/cyclopcam/logs"
+	"github.com/stretchr/testify/require"
+)
+
+// Write one video file per entry in 'starts', and return the archive re-opened, so that all files are in the index
+func createRetentionTestArchive(t *testing.T, streams map[string][]time.Time, packetSize map[string]int) *Archive {
+	EraseArchive()
+	logger := logs.NewTestingLog(t)
+	settings := DefaultStaticSettings()
+	settings.MaxWriteBufferSize = 0
+	arc, err := Open(logger, BaseDir, []VideoFormat{&VideoFormatRF1{}}, settings, DefaultDynamicSettings())
+	require.NoError(t, err)
+	for name, starts := range streams {
+		for i, start := range starts {
+			size := packetSize[name]
+			packets := copyRf1NALUstoFsv(rf1.CreateTestNALUs(start, 0, 50, 10, size, size, 7+i*2))
+			require.NoError(t, arc.Write(name, map[string]TrackPayload{"video": makeVideoPayload(packets)}))
+		}
+	}
+	arc.Close()
+
+	arc, err = Open(logger, BaseDir, []VideoFormat{&VideoFormatRF1{}}, settings, DefaultDynamicSettings())
+	require.NoError(t, err)
+	for name, starts := range streams {
+		require.Equal(t, len(starts), len(arc.streams[name].files))
+	}
+	return arc
+}
+
+// Return n file start times, spaced maxVideoFileDuration apart, starting at 'base'
+func contiguousFileTimes(base time.Time, n int) []time.Time {
+	r := []time.Time{}
+	for i := 0; i < n; i++ {
+		r = append(r, base.Add(time.Duration(i)*1000*time.Second))
+	}
+	return r
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	now := time.Now()
+	// Three contiguous old files, and then a recent file after a gap
+	times := contiguousFileTimes(now.Add(-72*time.Hour), 3)
+	times = append(times, now.Add(-time.Hour))
+	arc := createRetentionTestArchive(t, map[string][]time.Time{"s1": times, "s2": times}, map[string]int{"s1": 100, "s2": 100})
+	defer arc.Close()
+
+	require.NoError(t, arc.SetRetentionPolicies([]RetentionPolicy{{Streams: []string{"s1"}, MaxAge: 48 * time.Hour}}))
+	policies, _ := arc.retentionSnapshot()
+	arc.sweepExpired(policies, nil, now)
+
+	// The first two files end before the cutoff. The third file runs until the start of the fourth, which is recent.
+	require.Equal(t, 2, len(arc.streams["s1"].files))
+	require.Equal(t, times[2].UnixMilli(), arc.streams["s1"].files[0].startTime)
+	// s2 has no policy, so it is untouched
+	require.Equal(t, 4, len(arc.streams["s2"].files))
+}
+
+func TestRetentionMinAgeAndFairness(t *testing.T) {
+	now := time.Now()
+	times := contiguousFileTimes(now.Add(-240*time.Hour), 4)
+	streams := map[string][]time.Time{"entrance": times, "parking": times}
+	sizes := map[string]int{"entrance": 100, "parking": 1000}
+
+	// Entrance footage is protected, so only parking footage can be deleted, even
+	// though we're asking for the entire archive to be emptied.
+	arc := createRetentionTestArchive(t, streams, sizes)
+	require.NoError(t, arc.SetRetentionPolicies([]RetentionPolicy{{Streams: []string{"entrance"}, MinAge: 30 * 24 * time.Hour}}))
+	_, byStream := arc.retentionSnapshot()
+	arc.sweep(nil, byStream, nil, arc.TotalSize(), 0, now)
+	require.Equal(t, 4, len(arc.streams["entrance"].files))
+	require.Nil(t, arc.streams["parking"])
+	arc.Close()
+
+	// Both streams have files of equal age, but entrance has a minimum guarantee of
+	// 1 day, so it has less slack than parking, and parking gets eaten first.
+	arc = createRetentionTestArchive(t, streams, sizes)
+	defer arc.Close()
+	require.NoError(t, arc.SetRetentionPolicies([]RetentionPolicy{{Streams: []string{"entrance"}, MinAge: 24 * time.Hour}}))
+	_, byStream = arc.retentionSnapshot()
+	total := arc.TotalSize()
+	arc.sweep(nil, byStream, nil, total, total-1, now)
+	require.Equal(t, 4, len(arc.streams["entrance"].files))
+	require.Equal(t, 3, len(arc.streams["parking"].files))
+}
+
+func TestRetentionQuota(t *testing.T) {
+	now := time.Now()
+	times := contiguousFileTimes(now.Add(-240*time.Hour), 4)
+	arc := createRetentionTestArchive(t, map[string][]time.Time{"hd": times, "ld": times, "other": times}, map[string]int{"hd": 1000, "ld": 100, "other": 1000})
+	defer arc.Close()
+
+	sizes := arc.StreamSizes()
+	quota := (sizes["hd"] + sizes["ld"]) / 2
+	require.NoError(t, arc.SetRetentionPolicies([]RetentionPolicy{{Streams: []string{"hd", "ld"}, MaxBytes: quota}}))
+	policies, byStream := arc.retentionSnapshot()
+	arc.sweepQuotas(policies, byStream, nil, nil, now)
+
+	sizes = arc.StreamSizes()
+	require.LessOrEqual(t, sizes["hd"]+sizes["ld"], quota)
+	require.Equal(t, 4, len(arc.streams["other"].files))
+
+	report := arc.RetentionReport()
+	require.Len(t, report, 3)
+	for _, r := range report {
+		if r.Name == "other" {
+			require.Nil(t, r.Policy)
+		} else {
+			require.NotNil(t, r.Policy)
+			require.Equal(t, quota, r.Policy.MaxBytes)
+		}
+	}
+}
+
+func TestRetentionValidation(t *testing.T) {
+	require.Error(t, ValidateRetentionPolicies([]RetentionPolicy{{Streams: []string{"a"}, MinAge: 2 * time.Hour, MaxAge: time.Hour}}))
+	require.Error(t, ValidateRetentionPolicies([]RetentionPolicy{{Streams: []string{"a"}}, {Streams: []string{"a"}}}))
+	require.NoError(t, ValidateRetentionPolicies([]RetentionPolicy{{Streams: []string{"a"}, MinAge: time.Hour, MaxAge: 2 * time.Hour}, {Streams: []string{"b"}}}))
+}
@@ -1,7 +1,10 @@
 package fsv
 
 import (
-	"path/filepath"
+	"cmp"
+	"errors"
+	"io/fs"
+	"sort"
 	"time"
 
 	"github.com/cyclopcam/cyclops/pkg/gen"
@@ -43,27 +46,171 @@ func (a *Archive) sweeperThread() {
 	a.log.Infof("Sweeper thread exiting")
 }
 
-// Check if the archive is too large, and delete old files if necessary
+// Apply retention policies, and check if the archive is too large, deleting old files if necessary.
+// Files that overlap an active hold are never deleted, and they don't count towards any of the size limits.
 func (a *Archive) sweepIfNecessary() {
 	a.dynamicSettingsLock.Lock()
 	maxArchiveSize := a.dynamicSettings.MaxArchiveSize
 	a.dynamicSettingsLock.Unlock()
 
+	policies, byStream := a.retentionSnapshot()
+	now := time.Now()
+	holds := a.ActiveHolds(now)
+	heldSizes := a.HeldSizes(holds)
+
+	a.sweepExpired(policies, holds, now)
+	a.sweepQuotas(policies, byStream, holds, heldSizes, now)
+
 	if maxArchiveSize <= 0 {
 		return
 	}
 	totalSize := a.TotalSize()
+	for _, size := range heldSizes {
+		totalSize -= size
+	}
 	maxSize := (maxArchiveSize * 99) / 100
 	targetSize := (maxArchiveSize * 98) / 100
 	if totalSize > maxSize {
-		a.sweep(totalSize, targetSize)
+		a.sweep(nil, byStream, holds, totalSize, targetSize, now)
+	}
+}
+
+// Delete files that are older than the MaxAge of their retention policy
+func (a *Archive) sweepExpired(policies []RetentionPolicy, holds []Hold, now time.Time) {
+	failed := map[sweepFileKey]bool{}
+	for i := range policies {
+		policy := &policies[i]
+		if policy.MaxAge == 0 {
+			continue
+		}
+		cutoff := now.Add(-policy.MaxAge)
+		for _, streamName := range policy.Streams {
+			a.streamsLock.Lock()
+			stream := a.streams[streamName]
+			a.streamsLock.Unlock()
+			if stream == nil {
+				continue
+			}
+			for {
+				if gen.IsChannelClosed(a.sweepStop) {
+					return
+				}
+				// Find the oldest expired file that we can delete
+				victim := int64(-1)
+				stream.contentLock.Lock()
+				for j := 0; j < len(stream.files) && fileEndTimeHaveLock(stream, j).Before(cutoff); j++ {
+					if a.isFileSweepableHaveLock(stream, j, holds, failed) {
+						victim = stream.files[j].startTime
+						break
+					}
+				}
+				stream.contentLock.Unlock()
+				if victim == -1 {
+					break
+				}
+				if err := a.deleteFile(stream, victim); err != nil {
+					failed[sweepFileKey{stream.name, victim}] = true
+				}
+			}
+		}
+	}
+}
+
+// Delete files from policies that exceed their MaxBytes quota
+func (a *Archive) sweepQuotas(policies []RetentionPolicy, byStream map[string]*RetentionPolicy, holds []Hold, heldSizes map[string]int64, now time.Time) {
+	var sizes map[string]int64
+	for i := range policies {
+		policy := &policies[i]
+		if policy.MaxBytes == 0 {
+			continue
+		}
+		if sizes == nil {
+			sizes = a.StreamSizes()
+		}
+		total := int64(0)
+		for _, streamName := range policy.Streams {
+			total += sizes[streamName] - heldSizes[streamName]
+		}
+		if total > policy.MaxBytes {
+			only := map[string]bool{}
+			for _, streamName := range policy.Streams {
+				only[streamName] = true
+			}
+			// Use the same 1% hysteresis as the global budget, so that we're not deleting a file every sweep
+			a.sweep(only, byStream, holds, total, (policy.MaxBytes*99)/100, now)
+		}
 	}
 }
 
-func (a *Archive) sweep(totalSize, targetSize int64) {
+// A file that we failed to delete. We don't try it again during the same sweep.
+type sweepFileKey struct {
+	stream    string
+	startTime int64
+}
+
+// Returns true if the sweeper may delete the i'th file of the stream.
+// Held files must be kept, and files on an offline volume can't be deleted. If we removed
+// those from the index, then their space would never be reclaimed when the volume returns,
+// because we only scan a volume once.
+// You must be holding stream.contentLock.
+func (a *Archive) isFileSweepableHaveLock(stream *videoStream, i int, holds []Hold, failed map[sweepFileKey]bool) bool {
+	f := &stream.files[i]
+	return a.volumes[f.volume].online.Load() && !failed[sweepFileKey{stream.name, f.startTime}] && !isFileHeldHaveLock(stream, i, holds)
+}
+
+// Find the best file to delete, or return nil if there are no candidates.
+// If onlyStreams is not nil, then only those streams are considered.
+//
+// Victims are chosen fairly: We compute each stream's "slack", which is the age of
+// its oldest footage beyond its guaranteed minimum age, and we eat into the stream with
+// the most slack. For streams without a retention policy, this is identical to deleting
+// the oldest file in the archive. Files containing footage younger than MinAge are never chosen.
+// Files that overlap a hold, files on offline volumes, and files in 'failed' are skipped,
+// so a stream's oldest deletable file may come after them.
+// You must be holding streamsLock.
+func (a *Archive) findSweepVictimHaveLock(onlyStreams map[string]bool, byStream map[string]*RetentionPolicy, holds []Hold, failed map[sweepFileKey]bool, now time.Time) (*videoStream, videoFileIndex, []string) {
+	var victim *videoStream
+	victimFile := videoFileIndex{}
+	// Equivalent to the start time of the victim, minus MinAge. Smaller is a better candidate.
+	victimScore := int64(1 << 62)
+	emptyStreams := []string{}
+
+	for _, stream := range a.streams {
+		if onlyStreams != nil && !onlyStreams[stream.name] {
+			continue
+		}
+		minAge := time.Duration(0)
+		if p := byStream[stream.name]; p != nil {
+			minAge = p.MinAge
+		}
+		stream.contentLock.Lock()
+		if len(stream.files) == 0 {
+			emptyStreams = append(emptyStreams, stream.name)
+		} else {
+			i := 0
+			for i < len(stream.files) && !a.isFileSweepableHaveLock(stream, i, holds, failed) {
+				i++
+			}
+			if i < len(stream.files) && (minAge == 0 || fileEndTimeHaveLock(stream, i).Before(now.Add(-minAge))) {
+				score := stream.files[i].startTime + minAge.Milliseconds()
+				if score < victimScore {
+					victim = stream
+					victimFile = stream.files[i]
+					victimScore = score
+				}
+			}
+		}
+		stream.contentLock.Unlock()
+	}
+	return victim, victimFile, emptyStreams
+}
+
+// Keep deleting files until totalSize is less than or equal to targetSize.
+// If onlyStreams is not nil, then only files from those streams are deleted.
+func (a *Archive) sweep(onlyStreams map[string]bool, byStream map[string]*RetentionPolicy, holds []Hold, totalSize, targetSize int64, now time.Time) {
 	initialSize := totalSize
+	failed := map[sweepFileKey]bool{}
 
-	// Keep deleting the oldest file, until we're within budget
 	for totalSize > targetSize {
 		if gen.IsChannelClosed(a.sweepStop) {
 			a.log.Infof("Sweep aborted because of shutdown request")
@@ -71,56 +218,58 @@ func (a *Archive) sweep(totalSize, targetSize int64) {
 		}
 
 		a.streamsLock.Lock()
-		var oldestStream *videoStream
-		oldestFile := videoFileIndex{
-			startTime: int64(1 << 62),
-		}
-		deleteStream := []string{}
-		for _, stream := range a.streams {
-			stream.contentLock.Lock()
-			if len(stream.files) > 0 {
-				if stream.files[0].startTime < oldestFile.startTime {
-					oldestStream = stream
-					oldestFile = stream.files[0]
-				}
-			} else {
-				deleteStream = append(deleteStream, stream.name)
+		victim, victimFile, emptyStreams := a.findSweepVictimHaveLock(onlyStreams, byStream, holds, failed, now)
+		if onlyStreams == nil {
+			for _, del := range emptyStreams {
+				a.deleteEmptyStreamHaveLock(del)
 			}
-			stream.contentLock.Unlock()
-		}
-		for _, del := range deleteStream {
-			a.deleteEmptyStreamHaveLock(del)
 		}
 		a.streamsLock.Unlock()
 
-		if oldestStream == nil {
-			a.log.Errorf("Sweep failed to find any more files to delete. Total size: %v, target size: %v", totalSize, targetSize)
+		if victim == nil {
+			a.log.Errorf("Sweep failed to find any more files to delete. Remaining files may be protected by minimum retention or holds, or be on offline volumes. Total size: %v, target size: %v", totalSize, targetSize)
 			break
 		}
 
-		totalSize -= oldestFile.size
-		a.deleteOldestFile(oldestStream)
+		if err := a.deleteFile(victim, victimFile.startTime); err != nil {
+			failed[sweepFileKey{victim.name, victimFile.startTime}] = true
+		} else {
+			totalSize -= victimFile.size
+		}
 	}
 
 	a.log.Infof("Sweep finished. Dropped size from %v to %v (%v deleted)", kibi.FormatBytes(initialSize), kibi.FormatBytes(totalSize), kibi.FormatBytes(initialSize-totalSize))
 }
 
-func (a *Archive) deleteOldestFile(stream *videoStream) {
+// Delete the file that starts at startTime (unix milliseconds).
+// This is usually the oldest file of the stream, unless older files are held.
+// If the file can't be deleted, then it stays in the index, so that we can try again later.
+func (a *Archive) deleteFile(stream *videoStream, startTime int64) error {
 	stream.contentLock.Lock()
 	defer stream.contentLock.Unlock()
 
-	if len(stream.files) == 0 {
-		return
+	idx, found := sort.Find(len(stream.files), func(i int) int {
+		return cmp.Compare(startTime, stream.files[i].startTime)
+	})
+	if !found {
+		return nil
 	}
 
-	absFilename := filepath.Join(a.streamDir(stream.name), stream.files[0].filename)
-	a.log.Infof("Deleting oldest file %v from stream %v", absFilename, stream.name)
+	absFilename := a.indexedFilename(stream.name, &stream.files[idx])
+	a.log.Infof("Deleting file %v from stream %v", absFilename, stream.name)
 
-	if err := a.formats[0].Delete(absFilename, stream.files[0].tracks); err != nil {
-		a.log.Errorf("Failed to delete video file %v: %v", absFilename, err)
+	if err := a.formats[stream.files[idx].format].Delete(absFilename, stream.files[idx].tracks); err != nil {
+		// If the file is already gone from a volume that is still mounted, then there's nothing left to delete
+		if !errors.Is(err, fs.ErrNotExist) || !a.isVolumeAvailable(a.volumes[stream.files[idx].volume]) {
+			a.log.Errorf("Failed to delete video file %v: %v", absFilename, err)
+			return err
+		}
+		a.log.Warnf("Video file %v was already deleted", absFilename)
 	}
 
-	if cap(stream.files) > len(stream.files)*2 {
+	if idx != 0 {
+		stream.files = append(stream.files[:idx], stream.files[idx+1:]...)
+	} else if cap(stream.files) > len(stream.files)*2 {
 		// The slice's underlying array is growing large, so make a new array
 		newFiles := make([]videoFileIndex, len(stream.files)-1)
 		copy(newFiles, stream.files[1:])
@@ -139,4 +288,5 @@ func (a *Archive) deleteOldestFile(stream *videoStream) {
 		stream.startTime = time.Time{}
 		stream.endTime = time.Time{}
 	}
+	return nil
 }
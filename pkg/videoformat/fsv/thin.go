@@ -0,0 +1,297 @@
+package fsv
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/gen"
+	"github.com/cyclopcam/cyclops/pkg/kibi"
+)
+
+// Thinning replaces old video with a copy that contains only the keyframes.
+// Old HD footage is rarely watched at full fidelity, but it consumes most of the disk.
+// With a keyframe every second or two, a thinned file is typically 10% to 20% of
+// the original size, so we can keep several times more history of "what happened".
+//
+// A thinned file has the same start time as the original, but its logical filename
+// has thinnedSuffix appended (eg "1712815946731.kf"). This lets us write the thinned
+// copy alongside the original, and then swap the index entry over to it, in the same
+// way that the mover does. Readers that found the original in the index just before
+// the swap can still open it, because we only delete the original after moveDeleteDelay.
+// Consumers of ListFiles that keep their own records (such as replication) must identify
+// files by stream and start time, because the name changes when a file is thinned.
+
+// Logical filename suffix of a thinned video file
+const thinnedSuffix = ".kf"
+
+// We read the original in windows of this duration, so that we never hold more than a
+// few seconds of HD video in memory, instead of the whole file.
+const thinReadWindow = 30 * time.Second
+
+// A thinned file is written under this suffix, and renamed once it is complete
+const thinTempSuffix = ".thinning"
+
+// Maximum number of files that we'll thin in a single pass of the mover, so that
+// we don't starve the other jobs of the mover.
+const maxThinPerPass = 20
+
+// ThinningPolicy controls which streams are thinned, and when.
+// Files that overlap an active hold are never thinned.
+type ThinningPolicy struct {
+	Streams []string      // Names of the streams that this policy applies to (eg "cam-1-HD")
+	MinAge  time.Duration // Thin a file once all of its footage is older than this
+}
+
+type thinCandidate struct {
+	stream *videoStream
+	file   videoFileIndex
+}
+
+// Returns an error if the policies are inconsistent
+func ValidateThinningPolicies(policies []ThinningPolicy) error {
+	seen := map[string]bool{}
+	for i := range policies {
+		p := &policies[i]
+		if p.MinAge <= 0 {
+			return fmt.Errorf("Thinning policy MinAge must be positive")
+		}
+		for _, s := range p.Streams {
+			if seen[s] {
+				return fmt.Errorf("Stream '%v' appears in more than one thinning policy", s)
+			}
+			seen[s] = true
+		}
+	}
+	return nil
+}
+
+// Replace all thinning policies.
+// The new policies take effect on the next pass of the mover.
+func (a *Archive) SetThinningPolicies(policies []ThinningPolicy) error {
+	if err := ValidateThinningPolicies(policies); err != nil {
+		return err
+	}
+	copied := make([]ThinningPolicy, len(policies))
+	for i := range policies {
+		copied[i] = policies[i]
+		copied[i].Streams = append([]string{}, policies[i].Streams...)
+	}
+	a.dynamicSettingsLock.Lock()
+	defer a.dynamicSettingsLock.Unlock()
+	a.thinning = copied
+	return nil
+}
+
+// Return a copy of the current thinning policies
+func (a *Archive) ThinningPolicies() []ThinningPolicy {
+	a.dynamicSettingsLock.Lock()
+	defer a.dynamicSettingsLock.Unlock()
+	r := make([]ThinningPolicy, len(a.thinning))
+	copy(r, a.thinning)
+	return r
+}
+
+// Returns true if the logical filename is that of a thinned file
+func isThinnedFilename(filename string) bool {
+	return strings.HasSuffix(filename, thinnedSuffix)
+}
+
+// Thin files that are older than their policy's MinAge
+func (a *Archive) thinIfNecessary(now time.Time) {
+	a.dynamicSettingsLock.Lock()
+	policies := a.thinning
+	a.dynamicSettingsLock.Unlock()
+	if len(policies) == 0 {
+		return
+	}
+
+	candidates := a.findThinCandidates(policies, a.ActiveHolds(now), now)
+	if len(candidates) > maxThinPerPass {
+		candidates = candidates[:maxThinPerPass]
+	}
+	for _, c := range candidates {
+		if gen.IsChannelClosed(a.moverStop) {
+			return
+		}
+		if err := a.thinFile(c.stream, c.file); err != nil {
+			a.log.Errorf("Failed to thin %v/%v: %v", c.stream.name, c.file.filename, err)
+		}
+	}
+}
+
+// Return the files that should be thinned, oldest first
+func (a *Archive) findThinCandidates(policies []ThinningPolicy, holds []Hold, now time.Time) []thinCandidate {
+	candidates := []thinCandidate{}
+	for i := range policies {
+		cutoff := now.Add(-policies[i].MinAge)
+		for _, streamName := range policies[i].Streams {
+			a.streamsLock.Lock()
+			stream := a.streams[streamName]
+			a.streamsLock.Unlock()
+			if stream == nil {
+				continue
+			}
+			stream.contentLock.Lock()
+			for j := 0; j < len(stream.files) && fileEndTimeHaveLock(stream, j).Before(cutoff); j++ {
+				f := stream.files[j]
+				if isThinnedFilename(f.filename) || !a.volumes[f.volume].online.Load() || isFileHeldHaveLock(stream, j, holds) {
+					continue
+				}
+				candidates = append(candidates, thinCandidate{stream: stream, file: f})
+			}
+			stream.contentLock.Unlock()
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].file.startTime < candidates[j].file.startTime
+	})
+	return candidates
+}
+
+// Write a keyframe-only copy of a video file, and then switch the index over to the copy.
+// The original is deleted later, by deletePendingMoves.
+func (a *Archive) thinFile(stream *videoStream, file videoFileIndex) error {
+	dir := a.streamDir(int(file.volume), stream.name)
+	srcName := filepath.Join(dir, file.filename)
+	dstLogical := file.filename + thinnedSuffix
+	dstName := filepath.Join(dir, dstLogical)
+	tmpName := dstName + thinTempSuffix
+
+	format := a.formats[file.format]
+	tmpFiles := format.Files(tmpName, file.tracks)
+	dstFiles := format.Files(dstName, file.tracks)
+	cleanup := func() {
+		for i := range tmpFiles {
+			os.Remove(tmpFiles[i])
+			os.Remove(dstFiles[i])
+		}
+	}
+
+	size, err := writeThinnedCopy(format, srcName, tmpName)
+	if err != nil {
+		cleanup()
+		return err
+	}
+	// Rename in the order of Files(), so that the index files appear last
+	for i := range tmpFiles {
+		if err := os.Rename(tmpFiles[i], dstFiles[i]); err != nil {
+			cleanup()
+			return err
+		}
+	}
+
+	stream.contentLock.Lock()
+	idx := sort.Search(len(stream.files), func(i int) bool {
+		return stream.files[i].startTime >= file.startTime
+	})
+	found := idx < len(stream.files) && stream.files[idx].startTime == file.startTime && stream.files[idx].filename == file.filename && stream.files[idx].volume == file.volume
+	if found {
+		stream.files[idx].filename = dstLogical
+		stream.files[idx].size = size
+	}
+	stream.contentLock.Unlock()
+
+	if !found {
+		// The sweeper deleted the file, or the mover moved it, while we were thinning it
+		cleanup()
+		return nil
+	}
+
+	a.log.Infof("Thinned %v from %v to %v", srcName, kibi.FormatBytes(file.size), kibi.FormatBytes(size))
+	a.pendingDeletes = append(a.pendingDeletes, pendingDelete{
+		filename: srcName,
+		tracks:   file.tracks,
+		format:   format,
+		movedAt:  time.Now(),
+	})
+	return nil
+}
+
+// Copy the keyframes of srcName into a new file dstName, and return the size of the new file.
+// Tracks that are not video tracks (ie audio) are copied in full.
+func writeThinnedCopy(format VideoFormat, srcName, dstName string) (int64, error) {
+	src, err := format.Open(srcName)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := format.Create(dstName)
+	if err != nil {
+		return 0, err
+	}
+	closed := false
+	defer func() {
+		if !closed {
+			dst.Close()
+		}
+	}()
+
+	for name, track := range src.ListTracks() {
+		if err := writeThinnedTrack(src, dst, name, track); err != nil {
+			return 0, err
+		}
+	}
+
+	size, err := dst.Size()
+	if err != nil {
+		return 0, err
+	}
+	closed = true
+	if err := dst.Close(); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Copy one track of src into dst, one window at a time.
+// The track is only created in dst if there is something to write to it.
+func writeThinnedTrack(src, dst VideoFile, name string, track Track) error {
+	isVideo := track.Width != 0
+	created := false
+	lastPTS := time.Time{}
+	end := track.StartTime.Add(track.Duration + time.Second)
+	for start := track.StartTime; start.Before(end); start = start.Add(thinReadWindow) {
+		packets, err := src.Read(name, start, start.Add(thinReadWindow), 0)
+		if err != nil {
+			return fmt.Errorf("Error reading track %v: %w", name, err)
+		}
+		// Reads are inclusive of the end time, so a packet on the boundary of two windows
+		// is returned by both of them. All the NALUs of a frame share a PTS, so they are
+		// either all in this window, or all in the previous one.
+		prevPTS := lastPTS
+		if len(packets) != 0 {
+			lastPTS = packets[len(packets)-1].PTS
+		}
+		keep := packets[:0]
+		for _, p := range packets {
+			if !prevPTS.IsZero() && !p.PTS.After(prevPTS) {
+				continue
+			}
+			if !isVideo || p.IsKeyFrame() || p.IsEssentialMeta() {
+				keep = append(keep, p)
+			}
+		}
+		if len(keep) == 0 {
+			continue
+		}
+		if !created {
+			if track.IsAudio() {
+				err = dst.CreateAudioTrack(name, track.StartTime, track.Codec, track.SampleRate, track.Channels)
+			} else {
+				err = dst.CreateVideoTrack(name, track.StartTime, track.Codec, track.Width, track.Height)
+			}
+			if err != nil {
+				return err
+			}
+			created = true
+		}
+		if err := dst.Write(name, keep); err != nil {
+			return fmt.Errorf("Error writing track %v: %w", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package fsv
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThinning(t *testing.T) {
+	now := time.Now()
+	EraseArchive()
+	volumes := []Volume{{Path: BaseDir}}
+	times := contiguousFileTimes(now.Add(-72*time.Hour), 3)
+	times = append(times, now.Add(-time.Hour))
+
+	arc := openTestVolumes(t, volumes)
+	packets := writeTestFiles(t, arc, "cam", times)
+	arc.Close()
+
+	arc = openTestVolumes(t, volumes)
+	files := append([]videoFileIndex{}, arc.streams["cam"].files...)
+	require.Error(t, arc.SetThinningPolicies([]ThinningPolicy{{Streams: []string{"cam"}}}))
+	require.Error(t, arc.SetThinningPolicies([]ThinningPolicy{{Streams: []string{"cam"}, MinAge: time.Hour}, {Streams: []string{"cam"}, MinAge: time.Hour}}))
+	require.NoError(t, arc.SetThinningPolicies([]ThinningPolicy{{Streams: []string{"cam"}, MinAge: 24 * time.Hour}}))
+	require.NoError(t, arc.SetHolds([]Hold{{Streams: []string{"cam"}, Start: times[1], End: times[1].Add(time.Second)}}))
+
+	// The first file is thinned. The second is held. The third runs until the start of
+	// the fourth, which is recent.
+	arc.thinIfNecessary(now)
+	thinned := arc.streams["cam"].files
+	require.Equal(t, files[0].filename+thinnedSuffix, thinned[0].filename)
+	require.Less(t, thinned[0].size, files[0].size)
+	for i := 1; i < len(files); i++ {
+		require.Equal(t, files[i], thinned[i])
+	}
+
+	// Only the keyframes, and their SPS and PPS, remain
+	tracksR, err := arc.Read("cam", []string{"video"}, packets[0][0].PTS, packets[1][0].PTS.Add(-time.Millisecond), 0)
+	require.NoError(t, err)
+	nalus := tracksR["video"].NALS
+	require.Equal(t, 6, len(nalus))
+	for _, n := range nalus {
+		require.True(t, n.IsKeyFrame() || n.IsEssentialMeta())
+	}
+
+	// Thinning a second time does nothing
+	arc.thinIfNecessary(now)
+	require.Equal(t, thinned[0].filename, arc.streams["cam"].files[0].filename)
+
+	// Simulate a crash before the original was deleted. The thinned copy wins.
+	arc.pendingDeletes = nil
+	arc.Close()
+	arc = openTestVolumes(t, volumes)
+	defer arc.Close()
+	require.Equal(t, files[0].filename+thinnedSuffix, arc.streams["cam"].files[0].filename)
+	require.NoFileExists(t, rf1.TrackFilename(filepath.Join(BaseDir, "cam", files[0].filename), "video", rf1.FileTypeIndex))
+	verifyRead(t, arc, "cam", "video", packets[1][0].PTS, packets[1][40].PTS, 40, 1)
+}
+
+func TestThinningLongFile(t *testing.T) {
+	// The file spans several read windows, and keyframes fall on the window boundaries
+	now := time.Now()
+	EraseArchive()
+	volumes := []Volume{{Path: BaseDir}}
+	// At 10 FPS, there is a keyframe every 3 seconds, so the 30 second windows start on keyframes
+	nKeyframes := 25
+	start := now.Add(-72 * time.Hour).Truncate(time.Second)
+	packets := copyRf1NALUstoFsv(rf1.CreateTestNALUs(start, 0, nKeyframes*rf1.TestNALUKeyframeInterval, 10, 100, 200, 3))
+
+	arc := openTestVolumes(t, volumes)
+	require.NoError(t, arc.Write("cam", map[string]TrackPayload{"video": makeVideoPayload(packets)}))
+	arc.Close()
+
+	arc = openTestVolumes(t, volumes)
+	defer arc.Close()
+	require.NoError(t, arc.SetThinningPolicies([]ThinningPolicy{{Streams: []string{"cam"}, MinAge: 24 * time.Hour}}))
+	arc.thinIfNecessary(now)
+	require.True(t, isThinnedFilename(arc.streams["cam"].files[0].filename))
+
+	tracksR, err := arc.Read("cam", []string{"video"}, start, packets[len(packets)-1].PTS, 0)
+	require.NoError(t, err)
+	nalus := tracksR["video"].NALS
+	require.Equal(t, nKeyframes*3, len(nalus))
+	for i, n := range nalus {
+		require.True(t, n.IsKeyFrame() || n.IsEssentialMeta())
+		require.Equal(t, i%3 == 2, n.IsKeyFrame())
+	}
+}
@@ -3,6 +3,8 @@ package fsv
 import (
 	"errors"
 	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
 )
 
 var ErrTrackNotFound = errors.New("Track not found")
@@ -14,16 +16,55 @@ type VideoFormat interface {
 	Open(filename string) (VideoFile, error)
 	Create(filename string) (VideoFile, error)
 	Delete(filename string, tracks []string) error
+	// Return the physical files that make up the logical video file.
+	// Index/metadata files must come after the files that they refer to, so that a
+	// partially copied video file is less likely to look valid.
+	Files(filename string, tracks []string) []string
+}
+
+// A VideoFormat can optionally implement VideoFormatChecker, to allow us to
+// detect and repair files that were damaged by a crash or power failure.
+type VideoFormatChecker interface {
+	// Return true if the file was not closed cleanly.
+	// This must be cheap, because we call it on the latest file of every stream during Open().
+	IsUnclean(filename string) (bool, error)
+
+	// Check the integrity of the file, and optionally repair it.
+	Check(filename string, options CheckOptions) (*CheckResult, error)
+}
+
+// Options for VideoFormatChecker.Check
+type CheckOptions struct {
+	Repair bool // Fix the problems that we find, instead of just reporting them
+
+	// Start time and approximate duration of the file. These are used to rebuild
+	// index data from the raw packets, if the index is missing.
+	StartTime time.Time
+	Duration  time.Duration // Zero if unknown
+}
+
+// Result of VideoFormatChecker.Check
+type CheckResult struct {
+	Problems []string // Human readable descriptions of the problems that were found
+	Repaired bool     // True if the file was modified
+	Unclean  bool     // True if the file was not closed cleanly
 }
 
 // Metadata about a track
 type Track struct {
-	Name      string
-	StartTime time.Time
-	Duration  time.Duration
-	Codec     string
-	Width     int // Only applicable to video tracks
-	Height    int // Only applicable to video tracks
+	Name       string
+	StartTime  time.Time
+	Duration   time.Duration
+	Codec      string
+	Width      int // Only applicable to video tracks
+	Height     int // Only applicable to video tracks
+	SampleRate int // Only applicable to audio tracks
+	Channels   int // Only applicable to audio tracks
+}
+
+// Returns true if this is an audio track
+func (t *Track) IsAudio() bool {
+	return t.SampleRate != 0
 }
 
 // VideoFile is the analog of VideoFormat, but this is an embodied handle that can be read from and written to
@@ -44,6 +85,10 @@ type VideoFile interface {
 	// You must do this before writing packets to the track.
 	CreateVideoTrack(trackName string, timeBase time.Time, codec string, width, height int) error
 
+	// Create a new audio track in the file.
+	// You must do this before writing packets to the track.
+	CreateAudioTrack(trackName string, timeBase time.Time, codec string, sampleRate, channels int) error
+
 	Write(trackName string, packets []NALU) error
 	Read(trackName string, startTime, endTime time.Time, flags ReadFlags) ([]NALU, error)
 
@@ -71,3 +116,20 @@ func VideoFileHasVideoTrack(vf VideoFile, trackName string, width, height int) b
 	}
 	return t.Width == width && t.Height == height
 }
+
+// Returns true if the file has an audio track with the given name, sample rate and channel count
+func VideoFileHasAudioTrack(vf VideoFile, trackName string, sampleRate, channels int) bool {
+	t, ok := vf.ListTracks()[trackName]
+	if !ok {
+		return false
+	}
+	return t.SampleRate == sampleRate && t.Channels == channels
+}
+
+// Create a track in the file, of the type described by the payload
+func createTrackForPayload(vf VideoFile, trackName string, timeBase time.Time, payload *TrackPayload) error {
+	if payload.TrackType == rf1.TrackTypeAudio {
+		return vf.CreateAudioTrack(trackName, timeBase, payload.Codec, payload.AudioSampleRate, payload.AudioChannels)
+	}
+	return vf.CreateVideoTrack(trackName, timeBase, payload.Codec, payload.VideoWidth, payload.VideoHeight)
+}
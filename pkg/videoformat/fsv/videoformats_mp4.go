@@ -0,0 +1,186 @@
+package fsv
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/fmp4"
+)
+
+func copyFmp4NALUstoFsv(in []fmp4.NALU) []NALU {
+	out := make([]NALU, len(in))
+	for i := range in {
+		out[i] = NALU{
+			PTS:     in[i].PTS,
+			Flags:   NALUFlags(in[i].Flags),
+			Payload: in[i].Payload,
+			Length:  int32(in[i].Length),
+		}
+	}
+	return out
+}
+
+func copyFsvNALUstoFmp4(in []NALU) []fmp4.NALU {
+	out := make([]fmp4.NALU, len(in))
+	for i := range in {
+		out[i] = fmp4.NALU{
+			PTS:     in[i].PTS,
+			Flags:   fmp4.NALUFlags(in[i].Flags),
+			Payload: in[i].Payload,
+			Length:  int64(in[i].Length),
+		}
+	}
+	return out
+}
+
+/////////////////////////////////////////////////////////////////////////////////
+
+// VideoFormatMP4 stores every track as a fragmented MP4 file, which can be
+// played by standard tools, without any conversion.
+// NALUs are always returned in Annex-B format, and their flags are derived from
+// the NALU type, so flags other than KeyFrame, EssentialMeta and AnnexB are not preserved.
+type VideoFormatMP4 struct {
+}
+
+func (f *VideoFormatMP4) IsVideoFile(filename string) bool {
+	return fmp4.IsVideoFile(filename)
+}
+
+func (f *VideoFormatMP4) Open(filename string) (VideoFile, error) {
+	vf, err := fmp4.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &VideoFileMP4{File: vf}, nil
+}
+
+func (f *VideoFormatMP4) Create(filename string) (VideoFile, error) {
+	return &VideoFileMP4{File: fmp4.Create(filename)}, nil
+}
+
+func (f *VideoFormatMP4) Delete(filename string, tracks []string) error {
+	var firstError error
+	for _, track := range tracks {
+		err := os.Remove(fmp4.TrackFilename(filename, track))
+		if firstError == nil && err != nil {
+			firstError = err
+		}
+	}
+	return firstError
+}
+
+func (f *VideoFormatMP4) Files(filename string, tracks []string) []string {
+	files := []string{}
+	for _, track := range tracks {
+		files = append(files, fmp4.TrackFilename(filename, track))
+	}
+	return files
+}
+
+func (f *VideoFormatMP4) IsUnclean(filename string) (bool, error) {
+	return fmp4.IsUnclean(filename)
+}
+
+func (f *VideoFormatMP4) Check(filename string, options CheckOptions) (*CheckResult, error) {
+	res, err := fmp4.Check(filename, options.Repair)
+	if err != nil {
+		return nil, err
+	}
+	result := &CheckResult{}
+	for _, t := range res {
+		for _, p := range t.Problems {
+			result.Problems = append(result.Problems, fmt.Sprintf("%v: %v", t.Name, p))
+		}
+		result.Repaired = result.Repaired || t.Repaired
+		result.Unclean = result.Unclean || t.Unclean
+	}
+	return result, nil
+}
+
+/////////////////////////////////////////////////////////////////////////////////
+
+type VideoFileMP4 struct {
+	File *fmp4.File
+}
+
+func (v *VideoFileMP4) Close() error {
+	return v.File.Close()
+}
+
+func (v *VideoFileMP4) ListTracks() map[string]Track {
+	tracks := map[string]Track{}
+	for _, t := range v.File.Tracks {
+		tracks[t.Name] = Track{
+			Name:       t.Name,
+			StartTime:  t.TimeBase,
+			Duration:   t.Duration(),
+			Codec:      t.Codec,
+			Width:      t.Width,
+			Height:     t.Height,
+			SampleRate: t.SampleRate,
+			Channels:   t.Channels,
+		}
+	}
+	return tracks
+}
+
+func (v *VideoFileMP4) findTrack(trackName string) *fmp4.Track {
+	for _, track := range v.File.Tracks {
+		if track.Name == trackName {
+			return track
+		}
+	}
+	return nil
+}
+
+func (v *VideoFileMP4) HasCapacity(trackName string, nNALU int, maxPTS time.Time, combinedPayloadBytes int) bool {
+	if track := v.findTrack(trackName); track != nil {
+		return track.HasCapacity(nNALU, maxPTS, combinedPayloadBytes)
+	}
+	// Caller will likely try to create a new file, so it's OK not to return an error, but just return false
+	return false
+}
+
+func (v *VideoFileMP4) CreateVideoTrack(trackName string, timeBase time.Time, codec string, width, height int) error {
+	t, err := fmp4.MakeVideoTrack(trackName, timeBase, codec, width, height)
+	if err != nil {
+		return err
+	}
+	return v.File.AddTrack(t)
+}
+
+func (v *VideoFileMP4) CreateAudioTrack(trackName string, timeBase time.Time, codec string, sampleRate, channels int) error {
+	t, err := fmp4.MakeAudioTrack(trackName, timeBase, codec, sampleRate, channels)
+	if err != nil {
+		return err
+	}
+	return v.File.AddTrack(t)
+}
+
+func (v *VideoFileMP4) Write(trackName string, packets []NALU) error {
+	if track := v.findTrack(trackName); track != nil {
+		return track.WriteNALUs(copyFsvNALUstoFmp4(packets))
+	}
+	return fmt.Errorf("%w: '%v'", ErrTrackNotFound, trackName)
+}
+
+func (v *VideoFileMP4) Read(trackName string, startTime, endTime time.Time, flags ReadFlags) ([]NALU, error) {
+	track := v.findTrack(trackName)
+	if track == nil {
+		return nil, fmt.Errorf("%w: '%v'", ErrTrackNotFound, trackName)
+	}
+	nalus, err := track.ReadAtTime(startTime.Sub(track.TimeBase), endTime.Sub(track.TimeBase), flags&ReadFlagSeekBackToKeyFrame != 0, flags&ReadFlagHeadersOnly != 0)
+	if err != nil {
+		return nil, err
+	}
+	return copyFmp4NALUstoFsv(nalus), nil
+}
+
+func (v *VideoFileMP4) Size() (int64, error) {
+	sum := int64(0)
+	for _, track := range v.File.Tracks {
+		sum += track.FileSize()
+	}
+	return sum, nil
+}
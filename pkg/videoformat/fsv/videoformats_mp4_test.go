@@ -0,0 +1,71 @@
+package fsv
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/fmp4"
+	"github.com/cyclopcam/logs"
+	"github.com/stretchr/testify/require"
+)
+
+// Create test packets with start codes and h264 NALU types that match their flags,
+// because the MP4 format derives the flags from the NALU type.
+func createH264TestPackets(start time.Time, seed int) []NALU {
+	packets := createAnnexBTestPackets(start, seed)
+	for i := range packets {
+		naluType := byte(0x41)
+		if packets[i].IsKeyFrame() {
+			naluType = 0x65
+		} else if packets[i].IsEssentialMeta() {
+			naluType = 0x67
+		}
+		packets[i].Payload[4] = naluType
+	}
+	return packets
+}
+
+func TestMP4Archive(t *testing.T) {
+	EraseArchive()
+	settings := DefaultStaticSettings()
+	settings.MaxWriteBufferSize = 0
+	rf1First := []VideoFormat{&VideoFormatRF1{}, &VideoFormatMP4{}}
+	mp4First := []VideoFormat{&VideoFormatMP4{}, &VideoFormatRF1{}}
+
+	// One rf1 file, followed by one mp4 file
+	times := contiguousFileTimes(time.Now().Add(-time.Hour), 2)
+	all := [][]NALU{}
+	for i, formats := range [][]VideoFormat{rf1First, mp4First} {
+		arc, err := Open(logs.NewTestingLog(t), BaseDir, formats, settings, DefaultDynamicSettings())
+		require.NoError(t, err)
+		packets := createH264TestPackets(times[i], 3+i*2)
+		require.NoError(t, arc.Write("cam", map[string]TrackPayload{"video": makeVideoPayload(packets)}))
+		all = append(all, packets)
+		arc.Close()
+	}
+	require.FileExists(t, fmp4.TrackFilename(filepath.Join(BaseDir, "cam", strconv.FormatInt(times[1].UnixMilli(), 10)), "video"))
+
+	arc, err := Open(logs.NewTestingLog(t), BaseDir, mp4First, settings, DefaultDynamicSettings())
+	require.NoError(t, err)
+	defer arc.Close()
+	require.Equal(t, 2, len(arc.streams["cam"].files))
+	require.Equal(t, uint8(1), arc.streams["cam"].files[0].format)
+	require.Equal(t, uint8(0), arc.streams["cam"].files[1].format)
+
+	// Reads are transparent across formats
+	for i := range all {
+		tracks, err := arc.Read("cam", []string{"video"}, all[i][0].PTS, all[i][49].PTS, 0)
+		require.NoError(t, err)
+		require.Equal(t, 50, len(tracks["video"].NALS))
+		for j, n := range tracks["video"].NALS {
+			require.Equal(t, all[i][j].Payload, n.Payload)
+			require.Equal(t, all[i][j].Flags, n.Flags)
+			require.InDelta(t, all[i][j].PTS.UnixNano(), n.PTS.UnixNano(), float64(time.Millisecond))
+		}
+	}
+	tracks, err := arc.Read("cam", []string{"video"}, all[1][40].PTS, all[1][45].PTS, ReadFlagSeekBackToKeyFrame)
+	require.NoError(t, err)
+	require.True(t, tracks["video"].NALS[0].IsEssentialMeta())
+}
@@ -55,6 +55,11 @@ func copyFsvNALUstoRf1(in []NALU) []rf1.NALU {
 /////////////////////////////////////////////////////////////////////////////////
 
 type VideoFormatRF1 struct {
+	// Keys for reading encrypted files. If nil, then encrypted files can't be read.
+	Keys *rf1.Keyring
+
+	// Encrypt new files with the current key of Keys
+	Encrypt bool
 }
 
 func (f *VideoFormatRF1) IsVideoFile(filename string) bool {
@@ -62,7 +67,7 @@ func (f *VideoFormatRF1) IsVideoFile(filename string) bool {
 }
 
 func (f *VideoFormatRF1) Open(filename string) (VideoFile, error) {
-	vf, err := rf1.Open(filename, rf1.OpenModeReadOnly)
+	vf, err := rf1.OpenWithKeys(filename, rf1.OpenModeReadOnly, f.Keys)
 	if err != nil {
 		return nil, err
 	}
@@ -70,7 +75,14 @@ func (f *VideoFormatRF1) Open(filename string) (VideoFile, error) {
 }
 
 func (f *VideoFormatRF1) Create(filename string) (VideoFile, error) {
-	vf, err := rf1.Create(filename, nil)
+	var keys *rf1.Keyring
+	if f.Encrypt {
+		if f.Keys == nil {
+			return nil, fmt.Errorf("Unable to create encrypted video file, because no key was provided")
+		}
+		keys = f.Keys
+	}
+	vf, err := rf1.CreateEncrypted(filename, nil, keys)
 	if err != nil {
 		return nil, err
 	}
@@ -92,6 +104,42 @@ func (f *VideoFormatRF1) Delete(filename string, tracks []string) error {
 	return firstError
 }
 
+func (f *VideoFormatRF1) Files(filename string, tracks []string) []string {
+	files := []string{}
+	for _, track := range tracks {
+		files = append(files, rf1.TrackFilename(filename, track, rf1.FileTypePackets))
+	}
+	for _, track := range tracks {
+		files = append(files, rf1.TrackFilename(filename, track, rf1.FileTypeIndex))
+	}
+	return files
+}
+
+func (f *VideoFormatRF1) IsUnclean(filename string) (bool, error) {
+	return rf1.IsUnclean(filename)
+}
+
+func (f *VideoFormatRF1) Check(filename string, options CheckOptions) (*CheckResult, error) {
+	res, err := rf1.Check(filename, rf1.CheckOptions{
+		Repair:          options.Repair,
+		RebuildTimeBase: options.StartTime,
+		RebuildDuration: options.Duration,
+		Keys:            f.Keys,
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := &CheckResult{}
+	for _, t := range res.Tracks {
+		for _, p := range t.Problems {
+			result.Problems = append(result.Problems, fmt.Sprintf("%v: %v", t.Name, p))
+		}
+		result.Repaired = result.Repaired || t.Repaired
+		result.Unclean = result.Unclean || t.Unclean
+	}
+	return result, nil
+}
+
 /////////////////////////////////////////////////////////////////////////////////
 
 type VideoFileRF1 struct {
@@ -106,12 +154,14 @@ func (v *VideoFileRF1) ListTracks() map[string]Track {
 	tracks := map[string]Track{}
 	for _, t := range v.File.Tracks {
 		tracks[t.Name] = Track{
-			Name:      t.Name,
-			StartTime: t.TimeBase,
-			Duration:  t.Duration(),
-			Codec:     t.Codec,
-			Width:     t.Width,
-			Height:    t.Height,
+			Name:       t.Name,
+			StartTime:  t.TimeBase,
+			Duration:   t.Duration(),
+			Codec:      t.Codec,
+			Width:      t.Width,
+			Height:     t.Height,
+			SampleRate: t.SampleRate,
+			Channels:   t.Channels,
 		}
 	}
 	return tracks
@@ -135,6 +185,14 @@ func (v *VideoFileRF1) CreateVideoTrack(trackName string, timeBase time.Time, co
 	return v.File.AddTrack(t)
 }
 
+func (v *VideoFileRF1) CreateAudioTrack(trackName string, timeBase time.Time, codec string, sampleRate, channels int) error {
+	t, err := rf1.MakeAudioTrack(trackName, timeBase, codec, sampleRate, channels)
+	if err != nil {
+		return err
+	}
+	return v.File.AddTrack(t)
+}
+
 func (v *VideoFileRF1) Write(trackName string, packets []NALU) error {
 	for _, track := range v.File.Tracks {
 		if track.Name == trackName {
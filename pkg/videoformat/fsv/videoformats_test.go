@@ -2,8 +2,10 @@ package fsv
 
 import (
 	"testing"
+	"time"
 
 	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
+	"github.com/cyclopcam/logs"
 	"github.com/stretchr/testify/require"
 )
 
@@ -23,3 +25,44 @@ func TestRf1Flags(t *testing.T) {
 		require.Equal(t, flagsA[i], copyFsvFlagsToRf1(flagsB[i]))
 	}
 }
+
+func TestAudioTrack(t *testing.T) {
+	for i, format := range []VideoFormat{&VideoFormatRF1{}, &VideoFormatMP4{}, &VideoFormatRF1{}} {
+		EraseArchive()
+		settings := DefaultStaticSettings()
+		if i != 2 {
+			// The write buffer flushes one track at a time, which exercises adding a track to an open file
+			settings.MaxWriteBufferSize = 0
+		}
+		arc, err := Open(logs.NewTestingLog(t), BaseDir, []VideoFormat{format}, settings, DefaultDynamicSettings())
+		require.NoError(t, err)
+
+		start := time.Now().Add(-time.Hour)
+		video := createH264TestPackets(start, 3)
+		audio := []NALU{}
+		for i := 0; i < 20; i++ {
+			audio = append(audio, NALU{PTS: start.Add(time.Duration(i) * 40 * time.Millisecond), Flags: NALUFlagKeyFrame, Payload: make([]byte, 320)})
+		}
+		require.NoError(t, arc.Write("cam", map[string]TrackPayload{
+			"video": makeVideoPayload(video),
+			"audio": MakeAudioPayload(rf1.CodecPCMU, 8000, 1, audio[:10]),
+		}))
+		require.NoError(t, arc.Write("cam", map[string]TrackPayload{"audio": MakeAudioPayload(rf1.CodecPCMU, 8000, 1, audio[10:])}))
+
+		// A change in sample rate forces a new file, which has no video track
+		later := start.Add(time.Minute)
+		audio2 := []NALU{{PTS: later, Flags: NALUFlagKeyFrame, Payload: make([]byte, 640)}}
+		require.NoError(t, arc.Write("cam", map[string]TrackPayload{"audio": MakeAudioPayload(rf1.CodecPCMU, 16000, 1, audio2)}))
+
+		tracks, err := arc.Read("cam", []string{"video", "audio"}, start, later.Add(time.Second), 0)
+		require.NoError(t, err)
+		require.Equal(t, len(video), len(tracks["video"].NALS))
+		require.Equal(t, rf1.CodecPCMU, tracks["audio"].Codec)
+		require.Equal(t, 8000, tracks["audio"].SampleRate)
+		require.Equal(t, 1, tracks["audio"].Channels)
+		require.Equal(t, len(audio)+1, len(tracks["audio"].NALS))
+		require.Equal(t, 640, len(tracks["audio"].NALS[len(audio)].Payload))
+		require.Equal(t, 1, len(arc.streams["cam"].files))
+		arc.Close()
+	}
+}
@@ -0,0 +1,420 @@
+package fsv
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/gen"
+	"github.com/cyclopcam/cyclops/pkg/kibi"
+)
+
+// The presence of this file in the root of a secondary volume tells us that the volume is mounted.
+const volumeMarkerFilename = ".fsv-volume"
+
+// Files are copied to this name, and renamed once the copy is complete.
+const moveTempSuffix = ".moving"
+
+// After moving a file, we wait this long before deleting the source, so that a Read()
+// that found the file in the index just before the move can still open it.
+const moveDeleteDelay = time.Minute
+
+// A Volume is one storage location of an archive.
+// The volumes of an archive are ordered from hottest (eg SSD) to coldest (eg HDD).
+// New video is always written to the hottest volume that is available, and the
+// mover migrates files to the next volume once they are older than MaxAge, or when
+// the volume exceeds MaxSize.
+//
+// The primary volume (volumes[0]) is available if its directory exists.
+// All other volumes must be initialized with InitVolume, and are only considered
+// available if their marker file exists. This protects us from writing into an
+// empty mount point when a removable disk is not mounted.
+type Volume struct {
+	Path    string        // Base directory of the archive on this volume
+	MaxAge  time.Duration // Move files older than this to the next volume. Zero = no age limit.
+	MaxSize int64         // Move the oldest files to the next volume when this volume holds more than this. Zero = no limit.
+}
+
+// Status of a volume, at the time of the query
+type VolumeStatus struct {
+	Path      string
+	Available bool  // False if the volume is missing
+	NumFiles  int   // Number of logical video files on the volume
+	Size      int64 // Total bytes of all the video files on the volume
+}
+
+type archiveVolume struct {
+	Volume
+	index   int
+	online  atomic.Bool // True if we believe the volume is available
+	scanned bool        // True once we've added the volume's files to the index. Only accessed during Open(), and then by the mover thread.
+}
+
+// A source file of a completed move, which we'll delete after moveDeleteDelay
+type pendingDelete struct {
+	filename string
+	tracks   []string
+	format   VideoFormat
+	movedAt  time.Time
+}
+
+type moveCandidate struct {
+	stream  *videoStream
+	file    videoFileIndex
+	endTime time.Time
+}
+
+// Initialize a secondary volume, so that it can be used by OpenVolumes.
+// Do this once, while the volume is mounted.
+func InitVolume(path string) error {
+	if err := os.MkdirAll(path, 0770); err != nil {
+		return err
+	}
+	marker := filepath.Join(path, volumeMarkerFilename)
+	if _, err := os.Stat(marker); err == nil {
+		return nil
+	}
+	return os.WriteFile(marker, []byte("This directory is a volume of a cyclops video archive.\n"), 0660)
+}
+
+// Returns true if InitVolume has been called on the path, and the volume is mounted
+func IsVolumeInitialized(path string) bool {
+	_, err := os.Stat(filepath.Join(path, volumeMarkerFilename))
+	return err == nil
+}
+
+// Returns an error if the volume configuration is invalid
+func ValidateVolumes(volumes []Volume) error {
+	if len(volumes) == 0 {
+		return fmt.Errorf("No volumes provided")
+	}
+	if len(volumes) > 255 {
+		return fmt.Errorf("Too many volumes")
+	}
+	seen := map[string]bool{}
+	for i, v := range volumes {
+		if v.Path == "" {
+			return fmt.Errorf("Volume %v has no path", i)
+		}
+		if v.MaxAge < 0 || v.MaxSize < 0 {
+			return fmt.Errorf("Volume %v may not have a negative MaxAge or MaxSize", v.Path)
+		}
+		if i == len(volumes)-1 && (v.MaxAge != 0 || v.MaxSize != 0) {
+			return fmt.Errorf("The last volume (%v) has nowhere to move files to, so it may not have a MaxAge or MaxSize", v.Path)
+		}
+		clean := filepath.Clean(v.Path)
+		if seen[clean] {
+			return fmt.Errorf("Volume %v appears more than once", v.Path)
+		}
+		seen[clean] = true
+	}
+	return nil
+}
+
+func (a *Archive) isVolumeAvailable(vol *archiveVolume) bool {
+	if vol.index == 0 {
+		st, err := os.Stat(vol.Path)
+		return err == nil && st.IsDir()
+	}
+	return IsVolumeInitialized(vol.Path)
+}
+
+// Record that we failed to write to a volume.
+// We stop writing to the volume until the mover notices that it's available again.
+// If there is only one volume, then there is nowhere else to go, so we keep trying.
+func (a *Archive) markVolumeFailed(vol *archiveVolume, err error) {
+	if len(a.volumes) == 1 {
+		return
+	}
+	if vol.online.Swap(false) {
+		a.log.Warnf("Volume %v is unavailable for writing: %v", vol.Path, err)
+	}
+}
+
+// Report the status of every volume
+func (a *Archive) VolumeStatus() []VolumeStatus {
+	status := make([]VolumeStatus, len(a.volumes))
+	for i, vol := range a.volumes {
+		status[i].Path = vol.Path
+		status[i].Available = vol.online.Load()
+	}
+
+	a.streamsLock.Lock()
+	defer a.streamsLock.Unlock()
+	for _, stream := range a.streams {
+		stream.contentLock.Lock()
+		for _, f := range stream.files {
+			status[f.volume].NumFiles++
+			status[f.volume].Size += f.size
+		}
+		if stream.current != nil {
+			size, _ := stream.current.file.Size()
+			status[stream.current.volume].NumFiles++
+			status[stream.current.volume].Size += size
+		}
+		stream.contentLock.Unlock()
+	}
+	return status
+}
+
+// Choose which of two copies of the same video file to keep.
+// Duplicates are the result of a move that was interrupted. A partially copied
+// or partially deleted copy is smaller than the complete copy, so we keep the
+// larger one. If they're the same size, then the copy completed, so we keep
+// the copy on the colder volume.
+// Duplicates can also be the result of a thinning that was interrupted after the
+// thinned copy was complete, in which case we keep the thinned copy.
+func chooseDuplicate(a, b videoFileIndex) (keep, discard videoFileIndex) {
+	if aThin, bThin := isThinnedFilename(a.filename), isThinnedFilename(b.filename); aThin != bThin {
+		if aThin {
+			return a, b
+		}
+		return b, a
+	}
+	if a.size > b.size || (a.size == b.size && a.volume > b.volume) {
+		return a, b
+	}
+	return b, a
+}
+
+func (a *Archive) startMover() {
+	a.moverStop = make(chan bool)
+	a.moverStopped = make(chan bool)
+	go a.moverThread()
+}
+
+// Stop the mover, and wait for it to exit
+func (a *Archive) stopMover() {
+	if a.moverStop == nil || gen.IsChannelClosed(a.moverStop) {
+		return
+	}
+	a.log.Infof("Stopping mover")
+	close(a.moverStop)
+	<-a.moverStopped
+	a.log.Infof("Mover stopped")
+}
+
+func (a *Archive) moverThread() {
+	a.log.Infof("Mover thread starting")
+
+	keepRunning := true
+	for keepRunning {
+		select {
+		case <-a.moverStop:
+			keepRunning = false
+		case <-time.After(a.staticSettings.SweepInterval):
+			if len(a.volumes) > 1 {
+				a.checkVolumes()
+			}
+			a.deletePendingMoves(time.Now())
+			a.moveIfNecessary(time.Now())
+			a.thinIfNecessary(time.Now())
+		}
+	}
+	// There can't be any readers after Close(), so we don't need to wait before deleting
+	a.deletePendingMoves(time.Now().Add(moveDeleteDelay))
+	close(a.moverStopped)
+
+	a.log.Infof("Mover thread exiting")
+}
+
+// Detect volumes that have gone missing, or that have returned
+func (a *Archive) checkVolumes() {
+	for _, vol := range a.volumes {
+		available := a.isVolumeAvailable(vol)
+		if available == vol.online.Load() {
+			continue
+		}
+		if available {
+			if !vol.scanned {
+				// This volume was missing when we opened the archive
+				if err := a.scanVolume(vol); err != nil {
+					a.log.Errorf("Error scanning volume %v: %v", vol.Path, err)
+					continue
+				}
+			}
+			a.log.Infof("Volume %v is available", vol.Path)
+		} else {
+			a.log.Warnf("Volume %v is no longer available", vol.Path)
+		}
+		vol.online.Store(available)
+	}
+}
+
+// Return the first available volume after 'vol', or nil if there are none
+func (a *Archive) nextAvailableVolume(vol *archiveVolume) *archiveVolume {
+	for _, next := range a.volumes[vol.index+1:] {
+		if next.online.Load() {
+			return next
+		}
+	}
+	return nil
+}
+
+// Move files to colder volumes, if they are too old or if their volume is too full
+func (a *Archive) moveIfNecessary(now time.Time) {
+	for _, src := range a.volumes {
+		if src.MaxAge == 0 && src.MaxSize == 0 || !src.online.Load() {
+			continue
+		}
+		dst := a.nextAvailableVolume(src)
+		if dst == nil {
+			continue
+		}
+		candidates := a.findMoveCandidates(src, now)
+		for _, c := range candidates {
+			if gen.IsChannelClosed(a.moverStop) {
+				return
+			}
+			if err := a.moveFile(c.stream, c.file, src, dst); err != nil {
+				a.log.Errorf("Failed to move %v from %v to %v: %v", c.file.filename, src.Path, dst.Path, err)
+				// The destination is probably full or missing. Try again on the next pass.
+				break
+			}
+		}
+	}
+}
+
+// Return the files on 'vol' that should be moved off it, oldest first
+func (a *Archive) findMoveCandidates(vol *archiveVolume, now time.Time) []moveCandidate {
+	all := []moveCandidate{}
+	totalSize := int64(0)
+	a.streamsLock.Lock()
+	for _, stream := range a.streams {
+		stream.contentLock.Lock()
+		for i, f := range stream.files {
+			if int(f.volume) == vol.index {
+				all = append(all, moveCandidate{stream: stream, file: f, endTime: fileEndTimeHaveLock(stream, i)})
+				totalSize += f.size
+			}
+		}
+		if stream.current != nil && stream.current.volume == vol.index {
+			size, _ := stream.current.file.Size()
+			totalSize += size
+		}
+		stream.contentLock.Unlock()
+	}
+	a.streamsLock.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].file.startTime < all[j].file.startTime
+	})
+
+	// Use the same 1% hysteresis as the sweeper, so that we're not moving a file every pass
+	moveForSize := vol.MaxSize != 0 && totalSize > vol.MaxSize
+	targetSize := (vol.MaxSize * 99) / 100
+	cutoff := now.Add(-vol.MaxAge)
+
+	candidates := []moveCandidate{}
+	for _, c := range all {
+		tooOld := vol.MaxAge != 0 && c.endTime.Before(cutoff)
+		tooBig := moveForSize && totalSize > targetSize
+		if !tooOld && !tooBig {
+			continue
+		}
+		candidates = append(candidates, c)
+		totalSize -= c.file.size
+	}
+	return candidates
+}
+
+// Copy a video file from src to dst, and then switch the index over to the new copy.
+// The source is deleted later, by deletePendingMoves.
+func (a *Archive) moveFile(stream *videoStream, file videoFileIndex, src, dst *archiveVolume) error {
+	srcName := filepath.Join(a.streamDir(src.index, stream.name), file.filename)
+	dstDir := a.streamDir(dst.index, stream.name)
+	dstName := filepath.Join(dstDir, file.filename)
+	if err := os.Mkdir(dstDir, 0770); err != nil && !os.IsExist(err) {
+		return err
+	}
+	format := a.formats[file.format]
+	srcFiles := format.Files(srcName, file.tracks)
+	dstFiles := format.Files(dstName, file.tracks)
+
+	cleanup := func() {
+		for _, f := range dstFiles {
+			os.Remove(f + moveTempSuffix)
+			os.Remove(f)
+		}
+	}
+
+	// Copy everything to temporary names first, so that a crash during the copy
+	// doesn't leave a truncated file that looks like a video file.
+	for i := range srcFiles {
+		if err := copyFileAndSync(srcFiles[i], dstFiles[i]+moveTempSuffix); err != nil {
+			cleanup()
+			return err
+		}
+	}
+	for i := range dstFiles {
+		if err := os.Rename(dstFiles[i]+moveTempSuffix, dstFiles[i]); err != nil {
+			cleanup()
+			return err
+		}
+	}
+
+	stream.contentLock.Lock()
+	idx := sort.Search(len(stream.files), func(i int) bool {
+		return stream.files[i].startTime >= file.startTime
+	})
+	found := idx < len(stream.files) && stream.files[idx].startTime == file.startTime && int(stream.files[idx].volume) == src.index
+	if found {
+		stream.files[idx].volume = uint8(dst.index)
+	}
+	stream.contentLock.Unlock()
+
+	if !found {
+		// The sweeper deleted the file while we were copying it
+		cleanup()
+		return nil
+	}
+
+	a.log.Infof("Moved %v to %v (%v)", srcName, dstName, kibi.FormatBytes(file.size))
+	a.pendingDeletes = append(a.pendingDeletes, pendingDelete{
+		filename: srcName,
+		tracks:   file.tracks,
+		format:   format,
+		movedAt:  time.Now(),
+	})
+	return nil
+}
+
+// Delete the source files of moves that completed at least moveDeleteDelay before 'now'
+func (a *Archive) deletePendingMoves(now time.Time) {
+	remaining := a.pendingDeletes[:0]
+	for _, p := range a.pendingDeletes {
+		if now.Sub(p.movedAt) < moveDeleteDelay {
+			remaining = append(remaining, p)
+			continue
+		}
+		if err := p.format.Delete(p.filename, p.tracks); err != nil {
+			a.log.Warnf("Failed to delete moved video file %v: %v", p.filename, err)
+		}
+	}
+	a.pendingDeletes = remaining
+}
+
+func copyFileAndSync(srcName, dstName string) error {
+	src, err := os.Open(srcName)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(dstName)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
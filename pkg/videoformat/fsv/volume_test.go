@@ -0,0 +1,190 @@
+package fsv
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
+	"github.com/cyclopcam/logs"
+	"github.com/stretchr/testify/require"
+)
+
+// Create a fast volume and a slow volume inside BaseDir
+func makeTestVolumes(t *testing.T, fastMaxAge time.Duration) []Volume {
+	EraseArchive()
+	fast := filepath.Join(BaseDir, "fast")
+	slow := filepath.Join(BaseDir, "slow")
+	require.NoError(t, os.MkdirAll(fast, 0755))
+	require.NoError(t, InitVolume(slow))
+	return []Volume{{Path: fast, MaxAge: fastMaxAge}, {Path: slow}}
+}
+
+func openTestVolumes(t *testing.T, volumes []Volume) *Archive {
+	settings := DefaultStaticSettings()
+	settings.MaxWriteBufferSize = 0
+	arc, err := OpenVolumes(logs.NewTestingLog(t), volumes, []VideoFormat{&VideoFormatRF1{}}, settings, DefaultDynamicSettings())
+	require.NoError(t, err)
+	return arc
+}
+
+func writeTestFiles(t *testing.T, arc *Archive, stream string, starts []time.Time) [][]NALU {
+	all := [][]NALU{}
+	for i, start := range starts {
+		packets := copyRf1NALUstoFsv(rf1.CreateTestNALUs(start, 0, 50, 10, 100, 200, 3+i))
+		require.NoError(t, arc.Write(stream, map[string]TrackPayload{"video": makeVideoPayload(packets)}))
+		all = append(all, packets)
+	}
+	return all
+}
+
+func volumesOfStream(arc *Archive, stream string) []int {
+	r := []int{}
+	for _, f := range arc.streams[stream].files {
+		r = append(r, int(f.volume))
+	}
+	return r
+}
+
+func TestVolumeMover(t *testing.T) {
+	now := time.Now()
+	volumes := makeTestVolumes(t, 24*time.Hour)
+	times := contiguousFileTimes(now.Add(-72*time.Hour), 3)
+	times = append(times, now.Add(-time.Hour), now.Add(-time.Hour+1000*time.Second))
+
+	arc := openTestVolumes(t, volumes)
+	packets := writeTestFiles(t, arc, "cam", times)
+	arc.Close()
+
+	arc = openTestVolumes(t, volumes)
+	require.Equal(t, []int{0, 0, 0, 0, 0}, volumesOfStream(arc, "cam"))
+	sizeBefore := arc.TotalSize()
+
+	// The third file runs until the start of the fourth file, which is recent, so it stays
+	arc.moveIfNecessary(now)
+	require.Equal(t, []int{1, 1, 0, 0, 0}, volumesOfStream(arc, "cam"))
+	require.Equal(t, sizeBefore, arc.TotalSize())
+
+	// The source files stick around until the delete delay has elapsed
+	require.FileExists(t, rf1.TrackFilename(filepath.Join(volumes[0].Path, "cam", arc.streams["cam"].files[0].filename), "video", rf1.FileTypeIndex))
+	arc.deletePendingMoves(time.Now().Add(moveDeleteDelay))
+	require.NoFileExists(t, rf1.TrackFilename(filepath.Join(volumes[0].Path, "cam", arc.streams["cam"].files[0].filename), "video", rf1.FileTypeIndex))
+
+	// Reads are transparent across volumes
+	verifyRead(t, arc, "cam", "video", packets[0][0].PTS, packets[0][40].PTS, 40, 1)
+	verifyRead(t, arc, "cam", "video", packets[1][10].PTS, packets[3][20].PTS, 40+50+20, 2)
+	verifyRead(t, arc, "cam", "video", packets[3][10].PTS, packets[3][20].PTS, 10, 1)
+
+	status := arc.VolumeStatus()
+	require.Equal(t, 3, status[0].NumFiles)
+	require.Equal(t, 2, status[1].NumFiles)
+	require.True(t, status[1].Available)
+	arc.Close()
+
+	// After reopening, the index knows which volume each file is on
+	arc = openTestVolumes(t, volumes)
+	defer arc.Close()
+	require.Equal(t, []int{1, 1, 0, 0, 0}, volumesOfStream(arc, "cam"))
+	require.Equal(t, sizeBefore, arc.TotalSize())
+}
+
+func TestVolumeMoveBySize(t *testing.T) {
+	now := time.Now()
+	volumes := makeTestVolumes(t, 0)
+	arc := openTestVolumes(t, volumes)
+	writeTestFiles(t, arc, "cam", contiguousFileTimes(now.Add(-10*time.Hour), 4))
+	arc.Close()
+
+	arc = openTestVolumes(t, volumes)
+	defer arc.Close()
+	arc.volumes[0].MaxSize = arc.TotalSize() / 2
+	arc.moveIfNecessary(now)
+	status := arc.VolumeStatus()
+	require.LessOrEqual(t, status[0].Size, arc.volumes[0].MaxSize)
+	require.Equal(t, 0, volumesOfStream(arc, "cam")[3])
+	require.Equal(t, 1, volumesOfStream(arc, "cam")[0])
+}
+
+func TestVolumeMissing(t *testing.T) {
+	now := time.Now()
+
+	// The slow volume was never initialized, so we must not write to it, or move files to it
+	volumes := makeTestVolumes(t, time.Hour)
+	require.NoError(t, os.Remove(filepath.Join(volumes[1].Path, volumeMarkerFilename)))
+	arc := openTestVolumes(t, volumes)
+	writeTestFiles(t, arc, "cam", contiguousFileTimes(now.Add(-10*time.Hour), 3))
+	arc.moveIfNecessary(now)
+	require.Equal(t, []int{0, 0}, volumesOfStream(arc, "cam"))
+	require.False(t, arc.VolumeStatus()[1].Available)
+	require.False(t, IsVolumeInitialized(volumes[1].Path))
+
+	// The slow volume gets mounted
+	require.NoError(t, InitVolume(volumes[1].Path))
+	require.True(t, IsVolumeInitialized(volumes[1].Path))
+	arc.checkVolumes()
+	require.True(t, arc.VolumeStatus()[1].Available)
+	arc.moveIfNecessary(now)
+	require.Equal(t, []int{1, 1}, volumesOfStream(arc, "cam"))
+	arc.Close()
+
+	// The fast volume is missing, so we record onto the slow volume.
+	// The third file of "cam" was still on the fast volume, so it's gone.
+	require.NoError(t, os.RemoveAll(volumes[0].Path))
+	arc = openTestVolumes(t, volumes)
+	defer arc.Close()
+	require.Equal(t, []int{1, 1}, volumesOfStream(arc, "cam"))
+	writeTestFiles(t, arc, "cam2", []time.Time{now.Add(-time.Hour), now.Add(-time.Hour + 1000*time.Second)})
+	require.Equal(t, []int{1}, volumesOfStream(arc, "cam2"))
+}
+
+func TestVolumeOfflineSweep(t *testing.T) {
+	now := time.Now()
+	volumes := makeTestVolumes(t, time.Hour)
+	arc := openTestVolumes(t, volumes)
+	defer arc.Close()
+	writeTestFiles(t, arc, "cam", contiguousFileTimes(now.Add(-10*time.Hour), 3))
+	arc.moveIfNecessary(now)
+	require.Equal(t, []int{1, 1}, volumesOfStream(arc, "cam"))
+
+	// The slow volume is unmounted. Its files must stay in the index, so that we can delete them when it returns.
+	require.NoError(t, os.Remove(filepath.Join(volumes[1].Path, volumeMarkerFilename)))
+	arc.checkVolumes()
+	arc.sweep(nil, nil, nil, arc.TotalSize(), 0, now)
+	require.Equal(t, []int{1, 1}, volumesOfStream(arc, "cam"))
+
+	require.NoError(t, InitVolume(volumes[1].Path))
+	arc.checkVolumes()
+	arc.sweep(nil, nil, nil, arc.TotalSize(), 0, now)
+	require.Nil(t, arc.streams["cam"])
+}
+
+func TestVolumeDuplicates(t *testing.T) {
+	now := time.Now()
+	volumes := makeTestVolumes(t, time.Hour)
+	arc := openTestVolumes(t, volumes)
+	writeTestFiles(t, arc, "cam", contiguousFileTimes(now.Add(-10*time.Hour), 3))
+	arc.Close()
+
+	// Simulate a crash after the copy completed, but before the source was deleted,
+	// and another crash in the middle of a copy.
+	arc = openTestVolumes(t, volumes)
+	files := arc.streams["cam"].files
+	arc.moveIfNecessary(now)
+	require.NoError(t, os.WriteFile(filepath.Join(volumes[1].Path, "cam", files[1].filename+"_video.rf1p"+moveTempSuffix), []byte{1, 2, 3}, 0660))
+	arc.pendingDeletes = nil
+	arc.Close()
+
+	arc = openTestVolumes(t, volumes)
+	defer arc.Close()
+	require.Equal(t, []int{1, 1, 1}, volumesOfStream(arc, "cam"))
+	require.NoFileExists(t, rf1.TrackFilename(filepath.Join(volumes[0].Path, "cam", files[0].filename), "video", rf1.FileTypeIndex))
+	require.NoFileExists(t, filepath.Join(volumes[1].Path, "cam", files[1].filename+"_video.rf1p"+moveTempSuffix))
+}
+
+func TestVolumeValidation(t *testing.T) {
+	require.Error(t, ValidateVolumes(nil))
+	require.Error(t, ValidateVolumes([]Volume{{Path: "a", MaxAge: time.Hour}}))
+	require.Error(t, ValidateVolumes([]Volume{{Path: "a"}, {Path: "a/"}}))
+	require.NoError(t, ValidateVolumes([]Volume{{Path: "a", MaxAge: time.Hour}, {Path: "b"}}))
+}
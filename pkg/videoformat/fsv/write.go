@@ -1,7 +1,9 @@
 package fsv
 
 import (
+	"cmp"
 	"fmt"
+	"os"
 	"path/filepath"
 	"slices"
 	"time"
@@ -47,11 +49,10 @@ func (a *Archive) TriggerWriterBufferFlush() {
 
 // Write a payload to the archive.
 // payload keys are track names.
-// The payload must always include the exact same set of tracks, even if some of
-// them have no new content to write. We use the set of tracks and their properties (eg width, height)
-// to figure out when we need to close a file and open a new one. For example, if the user
-// decides to enable HD recording, then the track composition would change. Such a change
-// requires a new video file.
+// Tracks may be written in separate calls (eg "video" and "audio"). A track that is not yet
+// in the current file is added to it. We use the properties of each track (eg width, height,
+// sample rate) to figure out when we need to close a file and open a new one. For example,
+// if the camera's resolution changes, then we need a new video file.
 func (a *Archive) Write(streamName string, payload map[string]TrackPayload) error {
 	var err error
 	if a.isWriteBufferEnabled() {
@@ -134,8 +135,8 @@ func (a *Archive) writeUnbuffered(streamName string, payload map[string]TrackPay
 // At this point, you must be holding stream.contentLock.
 func (a *Archive) writeInner(stream *videoStream, payload map[string]TrackPayload) error {
 	for track, payload := range payload {
-		if payload.TrackType != rf1.TrackTypeVideo {
-			return fmt.Errorf("Only video tracks have been implemented. Track %v has type: %v", track, payload.TrackType)
+		if payload.TrackType != rf1.TrackTypeVideo && payload.TrackType != rf1.TrackTypeAudio {
+			return fmt.Errorf("Track %v has invalid type: %v", track, payload.TrackType)
 		}
 	}
 
@@ -160,18 +161,29 @@ func (a *Archive) writeInner(stream *videoStream, payload map[string]TrackPayloa
 	minPTS := time.UnixMicro(minPTSMicro)
 	maxPTS := time.UnixMicro(maxPTSMicro)
 
-	// Ensure that the tracks in the video file are the same set of tracks that
-	// the caller is trying to write. If the caller has altered the track composition,
-	// then we create a new file.
+	// Ensure that the tracks in the video file have the same structure as the tracks that
+	// the caller is trying to write. If the caller has altered the structure of a track
+	// (eg the resolution changed), then we create a new file.
+	// A track that doesn't exist yet is added to the current file. The write buffer flushes
+	// one track at a time, so this is what keeps audio and video together in one file.
 
+	missingTracks := []string{}
 	if stream.current != nil {
 		mustCloseReason := "" // If not empty, then we close
+		existingTracks := stream.current.file.ListTracks()
 		for trackName, packets := range payload {
-			if !VideoFileHasVideoTrack(stream.current.file, trackName, packets.VideoWidth, packets.VideoHeight) {
-				mustCloseReason = fmt.Sprintf("Track %v does not exist or has different dimensions", trackName)
+			if _, exists := existingTracks[trackName]; !exists {
+				missingTracks = append(missingTracks, trackName)
+			} else if packets.TrackType == rf1.TrackTypeAudio {
+				if !VideoFileHasAudioTrack(stream.current.file, trackName, packets.AudioSampleRate, packets.AudioChannels) {
+					mustCloseReason = fmt.Sprintf("Track %v has a different sample rate", trackName)
+					break
+				}
+			} else if !VideoFileHasVideoTrack(stream.current.file, trackName, packets.VideoWidth, packets.VideoHeight) {
+				mustCloseReason = fmt.Sprintf("Track %v has different dimensions", trackName)
 				break
 			}
-			if !stream.current.file.HasCapacity(trackName, len(packets.NALUs), naluMaxPTS(packets.NALUs), naluPayloadBytes(packets.NALUs)) {
+			if _, exists := existingTracks[trackName]; exists && !stream.current.file.HasCapacity(trackName, len(packets.NALUs), naluMaxPTS(packets.NALUs), naluPayloadBytes(packets.NALUs)) {
 				mustCloseReason = fmt.Sprintf("Insufficient capacity for track %v", trackName)
 				break
 			}
@@ -186,23 +198,18 @@ func (a *Archive) writeInner(stream *videoStream, payload map[string]TrackPayloa
 		}
 
 		if mustCloseReason != "" {
-			a.log.Infof("Closing video file %v: %v", stream.current.filename, mustCloseReason)
-			currentSize, err := stream.current.file.Size()
-			if err != nil {
-				return fmt.Errorf("Error getting size of video file %v: %v", stream.current.filename, err)
+			if err := a.closeCurrentFileHaveLock(stream, mustCloseReason); err != nil {
+				return err
 			}
-			// Add to index
-			stream.files = append(stream.files, videoFileIndex{
-				filename:  filepath.Base(stream.current.filename),
-				startTime: stream.current.startTime.UnixMilli(),
-				size:      currentSize,
-				tracks:    stream.current.tracks,
-			})
-			err = stream.current.file.Close()
-			if err != nil {
-				a.log.Errorf("Error closing video file %v: %v", stream.current.filename, err)
+		}
+	}
+
+	if stream.current != nil {
+		for _, track := range missingTracks {
+			trackPayload := payload[track]
+			if err := createTrackForPayload(stream.current.file, track, minPTS, &trackPayload); err != nil {
+				return fmt.Errorf("Error adding track %v to %v: %v", track, stream.current.filename, err)
 			}
-			stream.current = nil
 		}
 	}
 
@@ -218,16 +225,14 @@ func (a *Archive) writeInner(stream *videoStream, payload map[string]TrackPayloa
 		// lexicographic ordering. Do we need to use 11 digits? Unix time will only roll over
 		// to 11 digits on 2286-11-20 17:46:40. The world is going to look very different 262
 		// years from now. Probably not worth thinking about.
-		videoFilename := filepath.Join(a.streamDir(stream.name), fmt.Sprintf("%v", minPTSMicro/1000))
-		a.log.Infof("Creating new video file %v", videoFilename)
-		file, err := stream.format.Create(videoFilename)
+		file, volume, videoFilename, err := a.createVideoFile(stream, fmt.Sprintf("%v", minPTSMicro/1000))
 		if err != nil {
-			return fmt.Errorf("Error creating video file %v: %v", videoFilename, err)
+			return err
 		}
 		for track, payload := range payload {
-			if err := file.CreateVideoTrack(track, minPTS, payload.Codec, payload.VideoWidth, payload.VideoHeight); err != nil {
+			if err := createTrackForPayload(file, track, minPTS, &payload); err != nil {
 				file.Close()
-				return fmt.Errorf("Error creating video track %v in %v: %v", track, videoFilename, err)
+				return fmt.Errorf("Error creating track %v in %v: %v", track, videoFilename, err)
 			}
 		}
 
@@ -236,6 +241,7 @@ func (a *Archive) writeInner(stream *videoStream, payload map[string]TrackPayloa
 			file:      file,
 			startTime: minPTS,
 			endTime:   minPTS, // We haven't written to the stream yet, so start = end. We'll update endTime further down in this function.
+			volume:    volume,
 		}
 	}
 
@@ -282,6 +288,40 @@ func (a *Archive) writeInner(stream *videoStream, payload map[string]TrackPayloa
 	return nil
 }
 
+// Create a new video file on the hottest volume that is available.
+// If we fail to create the file, then we try the next volume, so that a missing
+// disk doesn't stop us from recording.
+// You must be holding stream.contentLock.
+func (a *Archive) createVideoFile(stream *videoStream, name string) (VideoFile, int, string, error) {
+	var firstErr error
+	for _, vol := range a.volumes {
+		if !vol.online.Load() {
+			continue
+		}
+		streamDir := a.streamDir(vol.index, stream.name)
+		videoFilename := filepath.Join(streamDir, name)
+		if err := os.Mkdir(streamDir, 0770); err != nil && !os.IsExist(err) {
+			err = fmt.Errorf("Error creating stream directory '%v': %v", streamDir, err)
+			firstErr = cmp.Or(firstErr, err)
+			a.markVolumeFailed(vol, err)
+			continue
+		}
+		a.log.Infof("Creating new video file %v", videoFilename)
+		file, err := stream.format.Create(videoFilename)
+		if err != nil {
+			err = fmt.Errorf("Error creating video file %v: %v", videoFilename, err)
+			firstErr = cmp.Or(firstErr, err)
+			a.markVolumeFailed(vol, err)
+			continue
+		}
+		return file, vol.index, videoFilename, nil
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("No archive volumes are available")
+	}
+	return nil, 0, "", firstErr
+}
+
 // You must be holding bufferLock while calling this function
 func (a *Archive) mustFlushWriteBuffer(stream *videoStream) bool {
 	if stream.writeBufferSize > a.staticSettings.MaxWriteBufferSize {
@@ -300,6 +340,13 @@ func (a *Archive) mustFlushWriteBuffer(stream *videoStream) bool {
 	return false
 }
 
+func naluMinPTS(nalu []NALU) time.Time {
+	if len(nalu) == 0 {
+		return time.Time{}
+	}
+	return nalu[0].PTS
+}
+
 func naluMaxPTS(nalu []NALU) time.Time {
 	if len(nalu) == 0 {
 		return time.Time{}
@@ -328,6 +375,51 @@ func canAppendToPayload(merged, addition *TrackPayload) bool {
 	return true
 }
 
+// Close the file that the stream is writing to, and add it to the index.
+// The next write creates a new file.
+// You must be holding stream.contentLock.
+func (a *Archive) closeCurrentFileHaveLock(stream *videoStream, reason string) error {
+	a.log.Infof("Closing video file %v: %v", stream.current.filename, reason)
+	currentSize, err := stream.current.file.Size()
+	if err != nil {
+		return fmt.Errorf("Error getting size of video file %v: %v", stream.current.filename, err)
+	}
+	// Add to index
+	stream.files = append(stream.files, videoFileIndex{
+		filename:  filepath.Base(stream.current.filename),
+		startTime: stream.current.startTime.UnixMilli(),
+		size:      currentSize,
+		tracks:    stream.current.tracks,
+		volume:    uint8(stream.current.volume),
+	})
+	err = stream.current.file.Close()
+	if err != nil {
+		a.log.Errorf("Error closing video file %v: %v", stream.current.filename, err)
+	}
+	stream.current = nil
+	return nil
+}
+
+// Close the file that the stream is busy recording, after flushing the write buffer.
+// The file becomes visible to ListFiles, and the next write starts a new file.
+// This is how the replicator gets recent footage off the box without waiting for
+// the file to reach its maximum duration.
+func (a *Archive) CloseCurrentFile(streamName string) error {
+	a.streamsLock.Lock()
+	stream := a.streams[streamName]
+	a.streamsLock.Unlock()
+	if stream == nil {
+		return nil
+	}
+	stream.contentLock.Lock()
+	defer stream.contentLock.Unlock()
+	a.flushWriteBufferForStream(stream)
+	if stream.current == nil {
+		return nil
+	}
+	return a.closeCurrentFileHaveLock(stream, "Close requested")
+}
+
 // Flush the write buffer for the stream.
 // You must be holding the stream.contentLock before calling this function.
 func (a *Archive) flushWriteBufferForStream(stream *videoStream) {
@@ -352,6 +444,11 @@ func (a *Archive) flushWriteBufferForStream(stream *videoStream) {
 // If necessary, flush the write buffer for the stream.
 // You must be holding the stream.contentLock before calling this function.
 func (a *Archive) persistWriteBufferToStream(stream *videoStream, tracks map[string][]TrackPayload) {
+	type chunk struct {
+		track   string
+		payload TrackPayload
+	}
+	chunks := []chunk{}
 	for track, payloadList := range tracks {
 		// Merge payloads together, so that we can reduce the number of OS write calls,
 		// and also the number of calls to our 'writeInner' function, which is quite bulky.
@@ -360,15 +457,24 @@ func (a *Archive) persistWriteBufferToStream(stream *videoStream, tracks map[str
 			if i < len(payloadList) && canAppendToPayload(&merged, &payloadList[i]) {
 				merged.NALUs = append(merged.NALUs, payloadList[i].NALUs...)
 			} else {
-				if err := a.writeInner(stream, map[string]TrackPayload{track: merged}); err != nil {
-					a.log.Errorf("Error flushing write buffer for stream %v (%v/%v): %v", stream.name, i, len(payloadList), err)
-				}
+				chunks = append(chunks, chunk{track, merged})
 				if i < len(payloadList) {
 					merged = payloadList[i]
 				}
 			}
 		}
 	}
+
+	// Write the chunks of all tracks in time order, so that a track (eg audio) doesn't get
+	// written into a file that was created for a later chunk of another track.
+	slices.SortStableFunc(chunks, func(x, y chunk) int {
+		return naluMinPTS(x.payload.NALUs).Compare(naluMinPTS(y.payload.NALUs))
+	})
+	for i, c := range chunks {
+		if err := a.writeInner(stream, map[string]TrackPayload{c.track: c.payload}); err != nil {
+			a.log.Errorf("Error flushing write buffer for stream %v (%v/%v): %v", stream.name, i+1, len(chunks), err)
+		}
+	}
 }
 
 func (a *Archive) flushWriteBuffers(force bool) {
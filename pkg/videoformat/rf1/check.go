@@ -0,0 +1,679 @@
+package rf1
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
+	"github.com/cyclopcam/cyclops/pkg/cgogo"
+)
+
+// #include "rf1.h"
+import "C"
+
+// When rebuilding an index, and we don't know the duration of the track,
+// we assume this interval between frames.
+const DefaultRebuildFrameInterval = 100 * time.Millisecond
+
+// Options for Check
+type CheckOptions struct {
+	Repair bool // Fix the problems that we find, instead of just reporting them
+
+	// Packet files don't contain timestamps, so in order to rebuild a missing index,
+	// we need to know when the track started. If RebuildTimeBase is zero, then we
+	// don't attempt to rebuild missing indexes.
+	RebuildTimeBase time.Time
+
+	// If not zero, then the frames of a rebuilt index are spread evenly over this duration.
+	// Otherwise, we assume DefaultRebuildFrameInterval between frames.
+	RebuildDuration time.Duration
+
+	// Required to check the packets of encrypted tracks
+	Keys *Keyring
+}
+
+// Result of checking a single track
+type TrackCheck struct {
+	Name     string
+	Problems []string // Human readable description of every problem that we found
+	Repaired bool     // True if we modified the track's files
+	Unclean  bool     // True if the track was not closed cleanly (eg the process or OS crashed while writing)
+	Count    int      // Number of packets in the track (after repair, if Repair was set)
+}
+
+// Result of checking all the tracks of an rf1 file
+type CheckResult struct {
+	Tracks []TrackCheck
+}
+
+// Returns true if any problems were found
+func (r *CheckResult) HasProblems() bool {
+	for _, t := range r.Tracks {
+		if len(t.Problems) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the names of all tracks of the file group, based on the index and packet files that exist
+func findTrackNames(baseFilename string) ([]string, error) {
+	names := map[string]bool{}
+	for _, ft := range []FileType{FileTypeIndex, FileTypePackets} {
+		matches, err := filepath.Glob(TrackFilename(baseFilename, "*", ft))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			name := strings.TrimPrefix(m, baseFilename+"_")
+			name = strings.TrimSuffix(name, "."+Extension(ft))
+			names[name] = true
+		}
+	}
+	r := []string{}
+	for name := range names {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r, nil
+}
+
+// Returns true if any track of the file was not closed cleanly.
+// This only reads the index headers, so it is cheap.
+func IsUnclean(baseFilename string) (bool, error) {
+	tracks, err := findTrackNames(baseFilename)
+	if err != nil {
+		return false, err
+	}
+	for _, track := range tracks {
+		idx, err := os.Open(TrackFilename(baseFilename, track, FileTypeIndex))
+		if err != nil {
+			// A missing index is certainly unclean
+			return true, nil
+		}
+		header, size, err := readIndexHeader(idx)
+		idx.Close()
+		if err != nil || (header.IndexCount == 0 && size > int64(IndexHeaderSize)+8) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Check the consistency of all the tracks of an rf1 file, and optionally repair them.
+//
+// We check that the index entries point inside the packet file, that timestamps
+// are monotonic, that Annex-B packets start with a start code, and that the
+// track starts with a keyframe. Repairs consist of truncating the corrupt tail of
+// a track, dropping packets before the first keyframe, finalizing the index of
+// a track that was not closed cleanly, and rebuilding a missing index from the packets.
+func Check(baseFilename string, options CheckOptions) (*CheckResult, error) {
+	tracks, err := findTrackNames(baseFilename)
+	if err != nil {
+		return nil, err
+	}
+	if len(tracks) == 0 {
+		return nil, os.ErrNotExist
+	}
+	result := &CheckResult{}
+	for _, track := range tracks {
+		tc, err := checkTrack(baseFilename, track, options)
+		if err != nil {
+			return nil, fmt.Errorf("Error checking track %v: %w", track, err)
+		}
+		result.Tracks = append(result.Tracks, *tc)
+	}
+	return result, nil
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
+
+// Returns the header and the size of the index file
+func readIndexHeader(idx *os.File) (C.CommonIndexHeader, int64, error) {
+	header := C.CommonIndexHeader{}
+	size, err := idx.Seek(0, io.SeekEnd)
+	if err != nil {
+		return header, 0, err
+	}
+	if _, err := cgogo.ReadStructAt(idx, &header, 0); err != nil {
+		return header, size, err
+	}
+	magic := [4]byte{}
+	codec := [4]byte{}
+	cgogo.CopySlice(magic[:], header.Magic[:])
+	cgogo.CopySlice(codec[:], header.Codec[:])
+	if !bytes.Equal(magic[:], []byte(MagicVideoTrackBytes)) && !bytes.Equal(magic[:], []byte(MagicAudioTrackBytes)) {
+		return header, size, fmt.Errorf("Unrecognized magic bytes in index: %02x %02x %02x %02x", magic[0], magic[1], magic[2], magic[3])
+	}
+	if !IsValidCodec(string(codec[:])) {
+		return header, size, fmt.Errorf("%w '%v'", ErrInvalidCodec, string(codec[:]))
+	}
+	return header, size, nil
+}
+
+func checkTrack(baseFilename, trackName string, options CheckOptions) (*TrackCheck, error) {
+	tc := &TrackCheck{Name: trackName}
+	idxName := TrackFilename(baseFilename, trackName, FileTypeIndex)
+	pktName := TrackFilename(baseFilename, trackName, FileTypePackets)
+
+	if !fileExists(pktName) {
+		tc.Problems = append(tc.Problems, "Packets file is missing")
+		if options.Repair {
+			// The index is useless without the packets
+			if err := os.Remove(idxName); err != nil {
+				return nil, err
+			}
+			tc.Repaired = true
+		}
+		return tc, nil
+	}
+	if !fileExists(idxName) {
+		tc.Problems = append(tc.Problems, "Index file is missing")
+		return tc, rebuildIndex(baseFilename, trackName, options, tc)
+	}
+
+	flag := os.O_RDONLY
+	if options.Repair {
+		flag = os.O_RDWR
+	}
+	idx, err := os.OpenFile(idxName, flag, 0660)
+	if err != nil {
+		return nil, err
+	}
+	defer idx.Close()
+	pktFile, err := os.OpenFile(pktName, flag, 0660)
+	if err != nil {
+		return nil, err
+	}
+	defer pktFile.Close()
+
+	header, idxSize, err := readIndexHeader(idx)
+	if err != nil {
+		tc.Problems = append(tc.Problems, fmt.Sprintf("Index header is corrupt: %v", err))
+		idx.Close()
+		return tc, rebuildIndex(baseFilename, trackName, options, tc)
+	}
+	encrypted := uint32(header.Flags)&IndexHeaderFlagEncrypted != 0
+	var pkt packetFile = &plainPacketFile{pktFile}
+	if encrypted {
+		if options.Keys == nil {
+			tc.Problems = append(tc.Problems, "Unable to check packets, because the track is encrypted and no key was provided")
+			return tc, nil
+		}
+		if pkt, err = openEncryptedPacketFile(pktFile, options.Keys); err != nil {
+			tc.Problems = append(tc.Problems, fmt.Sprintf("Unable to open encrypted packets: %v", err))
+			return tc, nil
+		}
+	}
+	pktSize, err := pkt.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the index entries, including the sentinel
+	var entries []uint64
+	headerCount := int(header.IndexCount)
+	if headerCount == 0 && idxSize > int64(IndexHeaderSize)+8 {
+		tc.Unclean = true
+		tc.Problems = append(tc.Problems, "Track was not closed cleanly")
+	} else if headerCount != 0 {
+		if idxSize < int64(IndexHeaderSize)+int64(headerCount+1)*8 {
+			tc.Problems = append(tc.Problems, fmt.Sprintf("Index header claims %v packets, but the index file is too short", headerCount))
+		} else {
+			entries = make([]uint64, headerCount+1)
+			if _, err := cgogo.ReadSliceAt(idx, entries, int64(IndexHeaderSize)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if entries == nil {
+		// Scan for the last non-zero entry, just like OpenTrack does
+		entries, err = findAllNonZeroIndexEntries(idx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(entries) == 0 {
+		entries = []uint64{MakeIndexSentinel(0)}
+	}
+
+	// Find the number of valid packets.
+	// Packet i is valid if entries i and i+1 are sane, and its payload looks right.
+	nPackets := len(entries) - 1
+	valid := 0
+	startCode := [4]byte{}
+	for ; valid < nPackets; valid++ {
+		pos := SplitIndexNALULocationOnly(entries[valid])
+		end := SplitIndexNALULocationOnly(entries[valid+1])
+		if end < pos || end > pktSize {
+			break
+		}
+		if valid > 0 && SplitIndexNALUEncodedTimeOnly(entries[valid]) < SplitIndexNALUEncodedTimeOnly(entries[valid-1]) {
+			break
+		}
+		if SplitIndexNALUFlagsOnly(entries[valid])&IndexNALUFlagAnnexB != 0 {
+			n := min(end-pos, 4)
+			if _, err := pkt.ReadAt(startCode[:n], pos); errors.Is(err, ErrCorruptChunk) || errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if !hasAnnexBStartCode(startCode[:n]) {
+				break
+			}
+		}
+		if encrypted && end > pos {
+			// Size() includes preallocated space, so make sure that the whole packet can be decrypted
+			if _, err := pkt.ReadAt(startCode[:1], end-1); errors.Is(err, ErrCorruptChunk) || errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if valid < nPackets {
+		tc.Problems = append(tc.Problems, fmt.Sprintf("Packets %v to %v (of %v) are corrupt", valid, nPackets-1, nPackets))
+	}
+
+	// Find the first keyframe, including the essential metadata packets that precede it.
+	first := 0
+	for first < valid && SplitIndexNALUFlagsOnly(entries[first])&IndexNALUFlagEssentialMeta != 0 {
+		first++
+	}
+	if first < valid && SplitIndexNALUFlagsOnly(entries[first])&IndexNALUFlagKeyFrame != 0 {
+		first = 0
+	} else if valid != 0 {
+		for first < valid && SplitIndexNALUFlagsOnly(entries[first])&IndexNALUFlagKeyFrame == 0 {
+			first++
+		}
+		if first < valid {
+			pts := SplitIndexNALUEncodedTimeOnly(entries[first])
+			for first > 0 && SplitIndexNALUEncodedTimeOnly(entries[first-1]) == pts {
+				first--
+			}
+		}
+		tc.Problems = append(tc.Problems, fmt.Sprintf("Track does not start with a keyframe (%v packets before the first keyframe)", first))
+	}
+
+	sentinelPos := SplitIndexNALULocationOnly(entries[valid])
+	if first == valid {
+		// No packets remain
+		sentinelPos = 0
+	}
+	fixed := append([]uint64{}, entries[first:valid]...)
+	fixed = append(fixed, MakeIndexNALU(0, sentinelPos, 0))
+	tc.Count = len(fixed) - 1
+
+	expectIdxSize := int64(IndexHeaderSize) + int64(len(fixed))*8
+	if !tc.Unclean && len(tc.Problems) == 0 && (idxSize != expectIdxSize || pktSize != sentinelPos) {
+		tc.Problems = append(tc.Problems, "File sizes are inconsistent with the index")
+	}
+
+	if !options.Repair || len(tc.Problems) == 0 {
+		if !options.Repair {
+			tc.Count = nPackets
+		}
+		return tc, nil
+	}
+
+	if _, err := cgogo.WriteSliceAt(idx, fixed, int64(IndexHeaderSize)); err != nil {
+		return nil, err
+	}
+	header.IndexCount = C.uint16_t(tc.Count)
+	if _, err := cgogo.WriteStructAt(idx, &header, 0); err != nil {
+		return nil, err
+	}
+	if err := idx.Truncate(expectIdxSize); err != nil {
+		return nil, err
+	}
+	if err := pkt.Truncate(sentinelPos); err != nil {
+		return nil, err
+	}
+	if err := idx.Sync(); err != nil {
+		return nil, err
+	}
+	if err := pkt.Sync(); err != nil {
+		return nil, err
+	}
+	tc.Repaired = true
+	return tc, nil
+}
+
+func hasAnnexBStartCode(b []byte) bool {
+	return (len(b) >= 3 && b[0] == 0 && b[1] == 0 && b[2] == 1) ||
+		(len(b) >= 4 && b[0] == 0 && b[1] == 0 && b[2] == 0 && b[3] == 1)
+}
+
+// A NALU found by scanning an Annex-B packets file
+type scannedNALU struct {
+	pos    int64  // Position of the start code
+	header []byte // Up to 3 bytes after the start code
+}
+
+// Find all the Annex-B start codes in the packets file.
+// We read the file in chunks, so that we don't need to hold an entire 1 GB file in memory.
+func scanAnnexB(f io.ReaderAt) ([]scannedNALU, error) {
+	const chunkSize = 1024 * 1024
+	startCode := []byte{0, 0, 1}
+	chunk := make([]byte, chunkSize)
+	buf := []byte{}     // Unprocessed window of the file
+	base := int64(0)    // File offset of buf[0]
+	readPos := int64(0) // File offset of the next read
+	nalus := []scannedNALU{}
+	for {
+		n, err := f.ReadAt(chunk, readPos)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		readPos += int64(n)
+		buf = append(buf, chunk[:n]...)
+		eof := n < chunkSize
+
+		next := 0
+		for {
+			j := bytes.Index(buf[next:], startCode)
+			if j < 0 {
+				next = max(next, len(buf)-2)
+				break
+			}
+			p := next + j
+			if !eof && p+6 > len(buf) {
+				// Wait for more data, so that we can see the NALU header
+				next = p
+				break
+			}
+			start := p
+			if p > 0 && buf[p-1] == 0 {
+				start = p - 1
+			}
+			nalus = append(nalus, scannedNALU{
+				pos:    base + int64(start),
+				header: append([]byte{}, buf[p+3:min(p+6, len(buf))]...),
+			})
+			next = p + 3
+		}
+		if eof {
+			return nalus, nil
+		}
+		// Keep one byte before 'next', in case it's the leading zero of a 4 byte start code
+		discard := max(0, next-1)
+		buf = append(buf[:0], buf[discard:]...)
+		base += int64(discard)
+	}
+}
+
+// Classification of a NALU, for the purpose of rebuilding an index
+type naluKind int
+
+const (
+	naluKindOther      naluKind = iota // SEI, AUD, etc
+	naluKindMeta                       // SPS, PPS, VPS
+	naluKindFirstSlice                 // First slice of a frame
+	naluKindSlice                      // Subsequent slice of a frame
+)
+
+// Guess the codec from the first NALU of the stream
+func detectCodec(header []byte) string {
+	if len(header) >= 2 && header[0]&0x80 == 0 && header[1] == 1 {
+		switch h265.NALUType((header[0] >> 1) & 0x3f) {
+		case h265.NALUType_VPS_NUT, h265.NALUType_SPS_NUT, h265.NALUType_PPS_NUT, h265.NALUType_AUD_NUT, h265.NALUType_PREFIX_SEI_NUT:
+			return CodecH265
+		}
+	}
+	if len(header) >= 1 && header[0]&0x80 == 0 {
+		switch h264.NALUType(header[0] & 0x1f) {
+		case h264.NALUTypeSPS, h264.NALUTypePPS, h264.NALUTypeAccessUnitDelimiter, h264.NALUTypeSEI, h264.NALUTypeIDR:
+			return CodecH264
+		}
+	}
+	return ""
+}
+
+// Returns the kind of NALU, and whether it is a keyframe
+func classifyNALU(codec string, header []byte) (naluKind, bool) {
+	if codec == CodecH264 {
+		if len(header) < 1 {
+			return naluKindOther, false
+		}
+		t := h264.NALUType(header[0] & 0x1f)
+		switch {
+		case t == h264.NALUTypeSPS || t == h264.NALUTypePPS:
+			return naluKindMeta, false
+		case t >= h264.NALUTypeNonIDR && t <= h264.NALUTypeIDR:
+			// first_mb_in_slice is an Exp-Golomb number, so a value of zero is encoded as a single 1 bit
+			if len(header) >= 2 && header[1]&0x80 != 0 {
+				return naluKindFirstSlice, t == h264.NALUTypeIDR
+			}
+			return naluKindSlice, t == h264.NALUTypeIDR
+		}
+	} else {
+		if len(header) < 2 {
+			return naluKindOther, false
+		}
+		t := h265.NALUType((header[0] >> 1) & 0x3f)
+		switch {
+		case t == h265.NALUType_VPS_NUT || t == h265.NALUType_SPS_NUT || t == h265.NALUType_PPS_NUT:
+			return naluKindMeta, false
+		case t <= h265.NALUType_CRA_NUT:
+			isKey := t == h265.NALUType_IDR_W_RADL || t == h265.NALUType_IDR_N_LP
+			// first_slice_segment_in_pic_flag
+			if len(header) >= 3 && header[2]&0x80 != 0 {
+				return naluKindFirstSlice, isKey
+			}
+			return naluKindSlice, isKey
+		}
+	}
+	return naluKindOther, false
+}
+
+// Read the SPS at nalus[i] from the packets file, and return the video dimensions
+func readSPSDimensions(pkt io.ReaderAt, codec string, nalus []scannedNALU, i int, end int64) (int, int, error) {
+	if i+1 < len(nalus) {
+		end = nalus[i+1].pos
+	}
+	raw := make([]byte, end-nalus[i].pos)
+	if _, err := pkt.ReadAt(raw, nalus[i].pos); err != nil {
+		return 0, 0, err
+	}
+	// Strip the start code
+	raw = raw[bytes.Index(raw, []byte{0, 0, 1})+3:]
+	if codec == CodecH264 {
+		sps := h264.SPS{}
+		if err := sps.Unmarshal(raw); err != nil {
+			return 0, 0, err
+		}
+		return sps.Width(), sps.Height(), nil
+	}
+	sps := h265.SPS{}
+	if err := sps.Unmarshal(raw); err != nil {
+		return 0, 0, err
+	}
+	return sps.Width(), sps.Height(), nil
+}
+
+// Rebuild a missing or corrupt index from the packets file.
+// This only works for Annex-B video tracks, because we need the start codes to find the packets.
+// The timestamps of the rebuilt index are estimates.
+func rebuildIndex(baseFilename, trackName string, options CheckOptions, tc *TrackCheck) error {
+	if !options.Repair {
+		return nil
+	}
+	if options.RebuildTimeBase.IsZero() {
+		tc.Problems = append(tc.Problems, "Unable to rebuild index, because the start time is unknown")
+		return nil
+	}
+	pktName := TrackFilename(baseFilename, trackName, FileTypePackets)
+	pktFile, err := os.OpenFile(pktName, os.O_RDWR, 0660)
+	if err != nil {
+		return err
+	}
+	defer pktFile.Close()
+
+	var pkt packetFile = &plainPacketFile{pktFile}
+	var pktSize int64
+	encrypted, err := isEncryptedPacketsFile(pktFile)
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		if options.Keys == nil {
+			tc.Problems = append(tc.Problems, "Unable to rebuild index, because the packets are encrypted and no key was provided")
+			return nil
+		}
+		encPkt, err := openEncryptedPacketFile(pktFile, options.Keys)
+		if err != nil {
+			tc.Problems = append(tc.Problems, fmt.Sprintf("Unable to rebuild index: %v", err))
+			return nil
+		}
+		if pktSize, err = encPkt.dataSize(); err != nil {
+			return err
+		}
+		pkt = encPkt
+	} else {
+		// Ignore zeros at the end of the file, which are the result of preallocation
+		if pktSize, err = findEndOfData(pktFile); err != nil {
+			return err
+		}
+	}
+
+	nalus, err := scanAnnexB(io.NewSectionReader(pkt, 0, pktSize))
+	if err != nil {
+		return err
+	}
+	if len(nalus) == 0 {
+		tc.Problems = append(tc.Problems, "Unable to rebuild index, because no Annex-B packets were found")
+		return nil
+	}
+	codec := detectCodec(nalus[0].header)
+	if codec == "" {
+		tc.Problems = append(tc.Problems, "Unable to rebuild index, because the codec is not recognized")
+		return nil
+	}
+
+	// Assign every NALU to a frame. Metadata and SEI NALUs belong to the frame that follows them.
+	frameOf := make([]int, len(nalus))
+	flags := make([]IndexNALUFlags, len(nalus))
+	width, height := 0, 0
+	frame := -1
+	pending := []int{}
+	for i, n := range nalus {
+		kind, isKey := classifyNALU(codec, n.header)
+		flags[i] = IndexNALUFlagAnnexB
+		if isKey {
+			flags[i] |= IndexNALUFlagKeyFrame
+		}
+		switch kind {
+		case naluKindMeta:
+			flags[i] |= IndexNALUFlagEssentialMeta
+			if width == 0 {
+				isSPS := (codec == CodecH264 && h264.NALUType(n.header[0]&0x1f) == h264.NALUTypeSPS) ||
+					(codec == CodecH265 && h265.NALUType((n.header[0]>>1)&0x3f) == h265.NALUType_SPS_NUT)
+				if isSPS {
+					width, height, _ = readSPSDimensions(pkt, codec, nalus, i, pktSize)
+				}
+			}
+			pending = append(pending, i)
+		case naluKindOther:
+			pending = append(pending, i)
+		case naluKindFirstSlice, naluKindSlice:
+			if kind == naluKindFirstSlice || frame == -1 {
+				frame++
+			}
+			for _, p := range pending {
+				frameOf[p] = frame
+			}
+			pending = pending[:0]
+			frameOf[i] = frame
+		}
+	}
+	for _, p := range pending {
+		frameOf[p] = max(frame, 0)
+	}
+	nFrames := max(frame+1, 1)
+	if width == 0 || height == 0 {
+		tc.Problems = append(tc.Problems, "Unable to rebuild index, because no SPS was found")
+		return nil
+	}
+
+	interval := DefaultRebuildFrameInterval
+	if options.RebuildDuration > 0 && nFrames > 1 {
+		interval = options.RebuildDuration / time.Duration(nFrames-1)
+	}
+	if nFrames > 1 && interval*time.Duration(nFrames-1) >= MaxDuration {
+		interval = (MaxDuration - time.Second) / time.Duration(nFrames-1)
+	}
+
+	if len(nalus) > MaxIndexEntries {
+		nalus = nalus[:MaxIndexEntries]
+		pktSize = nalus[len(nalus)-1].pos
+		nalus = nalus[:len(nalus)-1]
+	}
+	entries := make([]uint64, 0, len(nalus)+1)
+	for i, n := range nalus {
+		pts := EncodeTimeOffset(time.Duration(frameOf[i]) * interval)
+		entries = append(entries, MakeIndexNALU(pts, n.pos, flags[i]))
+	}
+	entries = append(entries, MakeIndexNALU(0, pktSize, 0))
+
+	track, err := MakeVideoTrack(trackName, options.RebuildTimeBase, codec, width, height)
+	if err != nil {
+		return err
+	}
+	track.Encrypted = encrypted
+	idx, err := os.Create(TrackFilename(baseFilename, trackName, FileTypeIndex))
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+	track.index = idx
+	track.indexCount = len(entries) - 1
+	if err := track.WriteHeader(); err != nil {
+		return err
+	}
+	if _, err := cgogo.WriteSliceAt(idx, entries, int64(IndexHeaderSize)); err != nil {
+		return err
+	}
+	if err := pkt.Truncate(pktSize); err != nil {
+		return err
+	}
+	if err := errors.Join(idx.Sync(), pkt.Sync()); err != nil {
+		return err
+	}
+	tc.Problems = append(tc.Problems, fmt.Sprintf("Rebuilt index with %v packets in %v frames. Timestamps are estimates.", len(entries)-1, nFrames))
+	tc.Repaired = true
+	tc.Count = len(entries) - 1
+	return nil
+}
+
+// Return the position after the last non-zero byte of the file
+func findEndOfData(f *os.File) (int64, error) {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 64*1024)
+	for size > 0 {
+		n := min(int64(len(buf)), size)
+		if _, err := f.ReadAt(buf[:n], size-n); err != nil {
+			return 0, err
+		}
+		for i := n - 1; i >= 0; i-- {
+			if buf[i] != 0 {
+				return size - n + i + 1, nil
+			}
+		}
+		size -= n
+	}
+	return 0, nil
+}
@@ -0,0 +1,217 @@
+package rf1
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// A real H.264 SPS for a 352x288 stream
+var testSPS = []byte{0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0, 0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00, 0x00, 0x03, 0x00, 0x3d, 0x08}
+
+// Create H.264 Annex-B packets, in the same layout as our camera recorder produces.
+// Every 10th frame is a keyframe, which is preceded by an SPS and PPS.
+func createAnnexBTestNALUs(timeBase time.Time, nFrames int, fps int) []NALU {
+	rng := rand.New(rand.NewSource(123))
+	makePayload := func(header []byte, size int) []byte {
+		p := append([]byte{0, 0, 0, 1}, header...)
+		for len(p) < size {
+			// Avoid zeros, so that we never emulate a start code
+			p = append(p, byte(1+rng.Intn(255)))
+		}
+		return p
+	}
+	nalus := []NALU{}
+	for i := 0; i < nFrames; i++ {
+		pts := timeBase.Add(time.Duration(i) * time.Second / time.Duration(fps))
+		if i%10 == 0 {
+			nalus = append(nalus, NALU{PTS: pts, Flags: IndexNALUFlagAnnexB | IndexNALUFlagEssentialMeta, Payload: append([]byte{0, 0, 0, 1}, testSPS...)})
+			nalus = append(nalus, NALU{PTS: pts, Flags: IndexNALUFlagAnnexB | IndexNALUFlagEssentialMeta, Payload: makePayload([]byte{0x68, 0xee}, 8)})
+			nalus = append(nalus, NALU{PTS: pts, Flags: IndexNALUFlagAnnexB | IndexNALUFlagKeyFrame, Payload: makePayload([]byte{0x65, 0x88}, 500+rng.Intn(500))})
+		} else {
+			nalus = append(nalus, NALU{PTS: pts, Flags: IndexNALUFlagAnnexB, Payload: makePayload([]byte{0x41, 0x9a}, 50+rng.Intn(100))})
+		}
+	}
+	return nalus
+}
+
+func writeCheckTestFile(t *testing.T, baseFilename string, nalus []NALU, clean bool) time.Time {
+	tbase := time.Date(2024, time.March, 4, 5, 6, 7, 0, time.UTC)
+	os.Remove(TrackFilename(baseFilename, "video", FileTypeIndex))
+	os.Remove(TrackFilename(baseFilename, "video", FileTypePackets))
+	track, err := MakeVideoTrack("video", tbase, CodecH264, 352, 288)
+	require.NoError(t, err)
+	f, err := Create(baseFilename, []*Track{track})
+	require.NoError(t, err)
+	require.NoError(t, track.WriteNALUs(nalus))
+	if clean {
+		require.NoError(t, f.Close())
+	} else {
+		dirtyClose(f)
+	}
+	return tbase
+}
+
+func readCheckTestFile(t *testing.T, baseFilename string) []NALU {
+	f, err := Open(baseFilename, OpenModeReadOnly)
+	require.NoError(t, err)
+	defer f.Close()
+	nalus, err := f.Tracks[0].ReadIndex(0, f.Tracks[0].Count())
+	require.NoError(t, err)
+	require.NoError(t, f.Tracks[0].ReadPayload(nalus))
+	return nalus
+}
+
+func TestCheckClean(t *testing.T) {
+	base := BaseDir + "/check-clean"
+	tbase := time.Date(2024, time.March, 4, 5, 6, 7, 0, time.UTC)
+	nalus := createAnnexBTestNALUs(tbase, 50, 10)
+	writeCheckTestFile(t, base, nalus, true)
+
+	unclean, err := IsUnclean(base)
+	require.NoError(t, err)
+	require.False(t, unclean)
+	result, err := Check(base, CheckOptions{Repair: true})
+	require.NoError(t, err)
+	require.False(t, result.HasProblems())
+	require.False(t, result.Tracks[0].Repaired)
+	require.Equal(t, len(nalus), result.Tracks[0].Count)
+}
+
+func TestCheckUnclean(t *testing.T) {
+	base := BaseDir + "/check-unclean"
+	tbase := time.Date(2024, time.March, 4, 5, 6, 7, 0, time.UTC)
+	nalus := createAnnexBTestNALUs(tbase, 50, 10)
+	writeCheckTestFile(t, base, nalus, false)
+
+	unclean, err := IsUnclean(base)
+	require.NoError(t, err)
+	require.True(t, unclean)
+
+	// Without Repair, nothing changes
+	result, err := Check(base, CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, result.Tracks[0].Unclean)
+	unclean, _ = IsUnclean(base)
+	require.True(t, unclean)
+
+	result, err = Check(base, CheckOptions{Repair: true})
+	require.NoError(t, err)
+	require.True(t, result.Tracks[0].Repaired)
+	require.Equal(t, len(nalus), result.Tracks[0].Count)
+	unclean, _ = IsUnclean(base)
+	require.False(t, unclean)
+
+	// Preallocated space has been released
+	total := int64(0)
+	for _, n := range nalus {
+		total += int64(len(n.Payload))
+	}
+	st, err := os.Stat(TrackFilename(base, "video", FileTypePackets))
+	require.NoError(t, err)
+	require.Equal(t, total, st.Size())
+
+	read := readCheckTestFile(t, base)
+	require.Equal(t, len(nalus), len(read))
+	for i := range nalus {
+		require.Equal(t, nalus[i].Payload, read[i].Payload)
+		require.Equal(t, nalus[i].Flags, read[i].Flags)
+	}
+
+	// A second check finds nothing wrong
+	result, err = Check(base, CheckOptions{Repair: true})
+	require.NoError(t, err)
+	require.False(t, result.HasProblems())
+}
+
+func TestCheckCorruptTail(t *testing.T) {
+	base := BaseDir + "/check-tail"
+	tbase := time.Date(2024, time.March, 4, 5, 6, 7, 0, time.UTC)
+	nalus := createAnnexBTestNALUs(tbase, 50, 10)
+	writeCheckTestFile(t, base, nalus, true)
+
+	// Overwrite the start of packet 30
+	pos := int64(0)
+	for _, n := range nalus[:30] {
+		pos += int64(len(n.Payload))
+	}
+	pkt, err := os.OpenFile(TrackFilename(base, "video", FileTypePackets), os.O_RDWR, 0660)
+	require.NoError(t, err)
+	_, err = pkt.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, pos)
+	require.NoError(t, err)
+	pkt.Close()
+
+	result, err := Check(base, CheckOptions{})
+	require.NoError(t, err)
+	require.True(t, result.HasProblems())
+	require.False(t, result.Tracks[0].Repaired)
+
+	result, err = Check(base, CheckOptions{Repair: true})
+	require.NoError(t, err)
+	require.True(t, result.Tracks[0].Repaired)
+	require.Equal(t, 30, result.Tracks[0].Count)
+
+	read := readCheckTestFile(t, base)
+	require.Equal(t, 30, len(read))
+	require.Equal(t, nalus[29].Payload, read[29].Payload)
+	st, err := os.Stat(TrackFilename(base, "video", FileTypePackets))
+	require.NoError(t, err)
+	require.Equal(t, pos, st.Size())
+}
+
+func TestCheckMissingKeyframe(t *testing.T) {
+	base := BaseDir + "/check-keyframe"
+	tbase := time.Date(2024, time.March, 4, 5, 6, 7, 0, time.UTC)
+	nalus := createAnnexBTestNALUs(tbase, 50, 10)
+	// Skip the SPS, PPS and IDR of the first frame, and then 4 more frames
+	nalus = nalus[7:]
+	writeCheckTestFile(t, base, nalus, true)
+
+	result, err := Check(base, CheckOptions{Repair: true})
+	require.NoError(t, err)
+	require.True(t, result.Tracks[0].Repaired)
+	// We drop frames 5..9
+	require.Equal(t, len(nalus)-5, result.Tracks[0].Count)
+
+	read := readCheckTestFile(t, base)
+	require.Equal(t, IndexNALUFlagEssentialMeta, read[0].Flags&IndexNALUFlagEssentialMeta)
+	require.True(t, read[2].IsKeyFrame())
+	require.Equal(t, nalus[5].Payload, read[0].Payload)
+}
+
+func TestCheckRebuildIndex(t *testing.T) {
+	base := BaseDir + "/check-rebuild"
+	tbase := time.Date(2024, time.March, 4, 5, 6, 7, 0, time.UTC)
+	nalus := createAnnexBTestNALUs(tbase, 50, 10)
+	writeCheckTestFile(t, base, nalus, false)
+	require.NoError(t, os.Remove(TrackFilename(base, "video", FileTypeIndex)))
+
+	// Without a time base, we can't rebuild
+	result, err := Check(base, CheckOptions{Repair: true})
+	require.NoError(t, err)
+	require.False(t, result.Tracks[0].Repaired)
+
+	result, err = Check(base, CheckOptions{Repair: true, RebuildTimeBase: tbase, RebuildDuration: 49 * 100 * time.Millisecond})
+	require.NoError(t, err)
+	require.True(t, result.Tracks[0].Repaired)
+	require.Equal(t, len(nalus), result.Tracks[0].Count)
+
+	f, err := Open(base, OpenModeReadOnly)
+	require.NoError(t, err)
+	defer f.Close()
+	track := f.Tracks[0]
+	require.Equal(t, CodecH264, track.Codec)
+	require.Equal(t, 352, track.Width)
+	require.Equal(t, 288, track.Height)
+	read, err := track.ReadIndex(0, track.Count())
+	require.NoError(t, err)
+	require.NoError(t, track.ReadPayload(read))
+	for i := range nalus {
+		require.Equal(t, nalus[i].Payload, read[i].Payload)
+		require.Equal(t, nalus[i].Flags, read[i].Flags)
+		require.LessOrEqual(t, AbsTimeDiff(nalus[i].PTS, read[i].PTS), time.Millisecond)
+	}
+}
@@ -0,0 +1,706 @@
+package rf1
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Encryption at rest
+//
+// The packets file of an encrypted track starts with a header, which is followed by
+// fixed-size chunks. Each chunk holds up to EncryptedChunkSize bytes of packet data,
+// and is encrypted with AES-256-GCM, using a random nonce. Because chunks are a fixed
+// size on disk, we can still seek directly to any packet in the index. The index
+// remains plaintext, and positions in the index refer to the decrypted packet data.
+//
+// Every file has its own random data key, which is stored in the header, encrypted
+// with a master key. The master key lives outside of the video archive (in our case,
+// in the config database). To change the master key, we only need to re-encrypt the
+// header of each file, and not the video itself.
+//
+// Packets file header (128 bytes):
+//
+//	0   magic "rf1e"
+//	4   version (uint16)
+//	6   reserved
+//	8   chunk size (uint32)
+//	12  reserved
+//	16  master key ID (8 bytes)
+//	24  file ID (16 random bytes)
+//	40  nonce for the wrapped data key (12 bytes)
+//	52  wrapped data key (32 bytes + 16 byte GCM tag)
+//	100 reserved
+//
+// Chunk:
+//
+//	0   nonce (12 bytes)
+//	12  length of plaintext (uint32)
+//	16  ciphertext (length bytes)
+//	..  GCM tag (16 bytes)
+//
+// The chunk's authenticated data is the file ID, the chunk number, and the length,
+// so chunks can't be swapped between files, or moved around inside a file.
+// A partial chunk at the end of the file is rewritten with a new nonce each time
+// we append to it.
+
+const (
+	KeySize            = 32        // Size of a master key (AES-256)
+	EncryptedChunkSize = 64 * 1024 // Plaintext bytes per encrypted chunk
+
+	encryptedMagic      = "rf1e"
+	encryptedVersion    = 1
+	encryptedHeaderSize = 128
+	chunkNonceSize      = 12
+	chunkHeaderSize     = chunkNonceSize + 4
+	chunkOverhead       = chunkHeaderSize + 16
+)
+
+var ErrNoKey = errors.New("rf1 track is encrypted, but no key was provided")
+var ErrUnknownKey = errors.New("rf1 track is encrypted with an unknown key")
+var ErrCorruptChunk = errors.New("encrypted rf1 chunk is corrupt")
+
+// KeyID identifies a master key, without revealing it
+type KeyID [8]byte
+
+func (k KeyID) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+func MakeKeyID(key []byte) KeyID {
+	h := sha256.Sum256(append([]byte("rf1 key id:"), key...))
+	id := KeyID{}
+	copy(id[:], h[:])
+	return id
+}
+
+// Keyring holds the master keys that can decrypt tracks.
+// New tracks are encrypted with the current key.
+type Keyring struct {
+	current KeyID
+	keys    map[KeyID]cipher.AEAD
+}
+
+// Create a keyring. Tracks encrypted with any of the other keys can be read,
+// which is necessary while we're busy changing keys.
+func NewKeyring(current []byte, others ...[]byte) (*Keyring, error) {
+	k := &Keyring{
+		current: MakeKeyID(current),
+		keys:    map[KeyID]cipher.AEAD{},
+	}
+	for _, key := range append([][]byte{current}, others...) {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[MakeKeyID(key)] = aead
+	}
+	return k, nil
+}
+
+// ID of the key that new tracks are encrypted with
+func (k *Keyring) CurrentID() KeyID {
+	return k.current
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("Invalid encryption key size %v (must be %v)", len(key), KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// packetFile is the packets file of a track, which may or may not be encrypted.
+// All offsets and sizes are positions in the packet data, which is what the index refers to.
+type packetFile interface {
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+	Preallocate(size int64) error
+	Size() (int64, error) // Upper bound of the amount of packet data (it may include preallocated space)
+	Sync() error
+	Close() error
+}
+
+// Unencrypted packets file
+type plainPacketFile struct {
+	*os.File
+}
+
+func (p *plainPacketFile) Preallocate(size int64) error {
+	return PreallocateFile(p.File, size)
+}
+
+func (p *plainPacketFile) Size() (int64, error) {
+	return p.File.Seek(0, io.SeekEnd)
+}
+
+// Header of an encrypted packets file
+type encryptedHeader struct {
+	chunkSize  int
+	keyID      KeyID
+	fileID     [16]byte
+	wrapNonce  [12]byte
+	wrappedKey [KeySize + 16]byte
+}
+
+func (h *encryptedHeader) marshal() []byte {
+	b := make([]byte, encryptedHeaderSize)
+	copy(b[0:4], encryptedMagic)
+	binary.LittleEndian.PutUint16(b[4:], encryptedVersion)
+	binary.LittleEndian.PutUint32(b[8:], uint32(h.chunkSize))
+	copy(b[16:24], h.keyID[:])
+	copy(b[24:40], h.fileID[:])
+	copy(b[40:52], h.wrapNonce[:])
+	copy(b[52:100], h.wrappedKey[:])
+	return b
+}
+
+// The authenticated data when wrapping the data key
+func (h *encryptedHeader) wrapAAD() []byte {
+	return h.marshal()[:40]
+}
+
+func unmarshalEncryptedHeader(b []byte) (*encryptedHeader, error) {
+	if len(b) < encryptedHeaderSize || !isEncryptedPacketsHeader(b) {
+		return nil, fmt.Errorf("Invalid encrypted packets header")
+	}
+	if v := binary.LittleEndian.Uint16(b[4:]); v != encryptedVersion {
+		return nil, fmt.Errorf("Unsupported encrypted packets version %v", v)
+	}
+	h := &encryptedHeader{
+		chunkSize: int(binary.LittleEndian.Uint32(b[8:])),
+	}
+	if h.chunkSize < 1024 || h.chunkSize > 16*1024*1024 {
+		return nil, fmt.Errorf("Invalid encrypted chunk size %v", h.chunkSize)
+	}
+	copy(h.keyID[:], b[16:24])
+	copy(h.fileID[:], b[24:40])
+	copy(h.wrapNonce[:], b[40:52])
+	copy(h.wrappedKey[:], b[52:100])
+	return h, nil
+}
+
+func isEncryptedPacketsHeader(b []byte) bool {
+	return len(b) >= 4 && string(b[:4]) == encryptedMagic
+}
+
+// Encrypt the data key with the current master key
+func (h *encryptedHeader) wrap(keys *Keyring, dataKey []byte) error {
+	h.keyID = keys.current
+	if _, err := rand.Read(h.wrapNonce[:]); err != nil {
+		return err
+	}
+	kek := keys.keys[keys.current]
+	kek.Seal(h.wrappedKey[:0], h.wrapNonce[:], dataKey, h.wrapAAD())
+	return nil
+}
+
+// Decrypt the data key
+func (h *encryptedHeader) unwrap(keys *Keyring) ([]byte, error) {
+	kek := keys.keys[h.keyID]
+	if kek == nil {
+		return nil, fmt.Errorf("%w (%v)", ErrUnknownKey, h.keyID)
+	}
+	dataKey, err := kek.Open(nil, h.wrapNonce[:], h.wrappedKey[:], h.wrapAAD())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// Encrypted packets file
+type encryptedPacketFile struct {
+	f      *os.File
+	header *encryptedHeader
+	aead   cipher.AEAD // nil if we don't have the key
+
+	// Cache of the most recently used chunk. When recording, this is the
+	// partial chunk at the end of the file, which we're busy appending to.
+	cacheLock  sync.Mutex
+	cacheChunk int64
+	cache      []byte // nil if empty
+}
+
+// Start a new encrypted packets file
+func createEncryptedPacketFile(f *os.File, keys *Keyring) (*encryptedPacketFile, error) {
+	h := &encryptedHeader{
+		chunkSize: EncryptedChunkSize,
+	}
+	dataKey := make([]byte, KeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(h.fileID[:]); err != nil {
+		return nil, err
+	}
+	if err := h.wrap(keys, dataKey); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteAt(h.marshal(), 0); err != nil {
+		return nil, err
+	}
+	return &encryptedPacketFile{f: f, header: h, aead: aead}, nil
+}
+
+// Open an existing encrypted packets file.
+// If keys is nil, then the file can be opened, but not read or written.
+func openEncryptedPacketFile(f *os.File, keys *Keyring) (*encryptedPacketFile, error) {
+	raw := make([]byte, encryptedHeaderSize)
+	if _, err := f.ReadAt(raw, 0); err != nil {
+		return nil, fmt.Errorf("Failed to read encrypted packets header: %w", err)
+	}
+	h, err := unmarshalEncryptedHeader(raw)
+	if err != nil {
+		return nil, err
+	}
+	p := &encryptedPacketFile{f: f, header: h}
+	if keys != nil {
+		dataKey, err := h.unwrap(keys)
+		if err != nil {
+			return nil, err
+		}
+		if p.aead, err = newAEAD(dataKey); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Size of a chunk on disk
+func (p *encryptedPacketFile) slotSize() int64 {
+	return int64(p.header.chunkSize + chunkOverhead)
+}
+
+func (p *encryptedPacketFile) slotPosition(chunk int64) int64 {
+	return encryptedHeaderSize + chunk*p.slotSize()
+}
+
+func (p *encryptedPacketFile) chunkAAD(chunk int64, length int) []byte {
+	aad := make([]byte, 0, 16+8+4)
+	aad = append(aad, p.header.fileID[:]...)
+	aad = binary.LittleEndian.AppendUint64(aad, uint64(chunk))
+	aad = binary.LittleEndian.AppendUint32(aad, uint32(length))
+	return aad
+}
+
+// Decrypt a chunk from its slot on disk. The slot may be truncated after the end of the chunk.
+func (p *encryptedPacketFile) openChunk(chunk int64, slot []byte) ([]byte, error) {
+	if len(slot) < chunkOverhead {
+		return nil, ErrCorruptChunk
+	}
+	length := int(binary.LittleEndian.Uint32(slot[chunkNonceSize:]))
+	if length > p.header.chunkSize || chunkOverhead+length > len(slot) {
+		return nil, ErrCorruptChunk
+	}
+	plain, err := p.aead.Open(nil, slot[:chunkNonceSize], slot[chunkHeaderSize:chunkOverhead+length], p.chunkAAD(chunk, length))
+	if err != nil {
+		return nil, ErrCorruptChunk
+	}
+	return plain, nil
+}
+
+// Encrypt a chunk, and append its slot to dst
+func (p *encryptedPacketFile) sealChunk(dst []byte, chunk int64, plain []byte) ([]byte, error) {
+	nonce := make([]byte, chunkNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce...)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(plain)))
+	return p.aead.Seal(dst, nonce, plain, p.chunkAAD(chunk, len(plain))), nil
+}
+
+// Read and decrypt chunks [first, last]
+func (p *encryptedPacketFile) readChunks(first, last int64) ([][]byte, error) {
+	raw := make([]byte, (last-first+1)*p.slotSize())
+	n, err := p.f.ReadAt(raw, p.slotPosition(first))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	raw = raw[:n]
+	chunks := make([][]byte, 0, last-first+1)
+	for c := first; c <= last; c++ {
+		start := (c - first) * p.slotSize()
+		if start >= int64(len(raw)) {
+			return nil, ErrCorruptChunk
+		}
+		plain, err := p.openChunk(c, raw[start:min(start+p.slotSize(), int64(len(raw)))])
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, plain)
+	}
+	return chunks, nil
+}
+
+// Read one chunk, using the cache. You must be holding cacheLock.
+func (p *encryptedPacketFile) readChunkHaveLock(chunk int64) ([]byte, error) {
+	if p.cache != nil && p.cacheChunk == chunk {
+		return p.cache, nil
+	}
+	chunks, err := p.readChunks(chunk, chunk)
+	if err != nil {
+		return nil, err
+	}
+	p.cacheChunk = chunk
+	p.cache = chunks[0]
+	return p.cache, nil
+}
+
+func (p *encryptedPacketFile) ReadAt(b []byte, off int64) (int, error) {
+	if p.aead == nil {
+		return 0, ErrNoKey
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	cs := int64(p.header.chunkSize)
+	first := off / cs
+	last := (off + int64(len(b)) - 1) / cs
+
+	p.cacheLock.Lock()
+	defer p.cacheLock.Unlock()
+	var chunks [][]byte
+	if first == last {
+		c, err := p.readChunkHaveLock(first)
+		if err != nil {
+			return 0, err
+		}
+		chunks = [][]byte{c}
+	} else {
+		var err error
+		if chunks, err = p.readChunks(first, last); err != nil {
+			return 0, err
+		}
+		p.cacheChunk = last
+		p.cache = chunks[len(chunks)-1]
+	}
+
+	n := 0
+	for i, plain := range chunks {
+		start := int64(0)
+		if i == 0 {
+			start = off - first*cs
+		}
+		if start >= int64(len(plain)) {
+			return n, io.EOF
+		}
+		n += copy(b[n:], plain[start:])
+		if n < len(b) && int64(len(plain)) < cs {
+			// Short chunk before the end of the requested range
+			return n, io.EOF
+		}
+	}
+	return n, nil
+}
+
+func (p *encryptedPacketFile) WriteAt(b []byte, off int64) (int, error) {
+	if p.aead == nil {
+		return 0, ErrNoKey
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	cs := int64(p.header.chunkSize)
+	first := off / cs
+	last := (off + int64(len(b)) - 1) / cs
+
+	p.cacheLock.Lock()
+	defer p.cacheLock.Unlock()
+
+	slots := make([]byte, 0, (last-first+1)*p.slotSize())
+	var lastPlain []byte
+	n := 0
+	for c := first; c <= last; c++ {
+		start := max(off, c*cs) - c*cs
+		end := min(off+int64(len(b)), (c+1)*cs) - c*cs
+		var plain []byte
+		if start != 0 || end != cs {
+			// Partial chunk, so we need to preserve the existing data in the chunk
+			existing, err := p.readChunkHaveLock(c)
+			if err != nil && start != 0 {
+				return n, fmt.Errorf("Unable to append to chunk %v: %w", c, err)
+			}
+			plain = append(plain, existing...)
+		}
+		if int64(len(plain)) < end {
+			plain = append(plain, make([]byte, end-int64(len(plain)))...)
+		}
+		n += copy(plain[start:end], b[n:])
+		var err error
+		// Every chunk except the last is full, so the slots are contiguous
+		if slots, err = p.sealChunk(slots, c, plain); err != nil {
+			return 0, err
+		}
+		lastPlain = plain
+	}
+	if _, err := p.f.WriteAt(slots, p.slotPosition(first)); err != nil {
+		p.cache = nil
+		return 0, err
+	}
+	p.cacheChunk = last
+	p.cache = lastPlain
+	return len(b), nil
+}
+
+// Truncate the packet data to 'size' bytes
+func (p *encryptedPacketFile) Truncate(size int64) error {
+	if p.aead == nil {
+		return ErrNoKey
+	}
+	cs := int64(p.header.chunkSize)
+	chunk := size / cs
+	remain := size % cs
+
+	p.cacheLock.Lock()
+	defer p.cacheLock.Unlock()
+
+	physical := p.slotPosition(chunk)
+	if remain != 0 {
+		plain, err := p.readChunkHaveLock(chunk)
+		if err != nil {
+			return fmt.Errorf("Unable to truncate chunk %v: %w", chunk, err)
+		}
+		if int64(len(plain)) < remain {
+			return fmt.Errorf("Unable to truncate chunk %v to %v bytes, because it is only %v bytes", chunk, remain, len(plain))
+		}
+		if int64(len(plain)) > remain {
+			plain = plain[:remain]
+			slot, err := p.sealChunk(nil, chunk, plain)
+			if err != nil {
+				return err
+			}
+			if _, err := p.f.WriteAt(slot, physical); err != nil {
+				p.cache = nil
+				return err
+			}
+			p.cacheChunk = chunk
+			p.cache = plain
+		}
+		physical += chunkOverhead + remain
+	} else if p.cache != nil && p.cacheChunk >= chunk {
+		p.cache = nil
+	}
+	return p.f.Truncate(physical)
+}
+
+func (p *encryptedPacketFile) Preallocate(size int64) error {
+	cs := int64(p.header.chunkSize)
+	return PreallocateFile(p.f, p.slotPosition((size+cs-1)/cs))
+}
+
+func (p *encryptedPacketFile) Size() (int64, error) {
+	physical, err := p.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	return p.capacity(physical), nil
+}
+
+// Maximum amount of packet data that fits into a file of the given size
+func (p *encryptedPacketFile) capacity(physical int64) int64 {
+	if physical <= encryptedHeaderSize {
+		return 0
+	}
+	full := (physical - encryptedHeaderSize) / p.slotSize()
+	remain := (physical - encryptedHeaderSize) % p.slotSize()
+	return full*int64(p.header.chunkSize) + max(0, remain-chunkOverhead)
+}
+
+// Returns the amount of packet data that can actually be decrypted, by reading
+// chunks until we hit one that is missing or corrupt.
+func (p *encryptedPacketFile) dataSize() (int64, error) {
+	if p.aead == nil {
+		return 0, ErrNoKey
+	}
+	physical, err := p.f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	size := int64(0)
+	nChunks := (physical - encryptedHeaderSize + p.slotSize() - 1) / p.slotSize()
+	for c := int64(0); c < nChunks; c++ {
+		chunks, err := p.readChunks(c, c)
+		if errors.Is(err, ErrCorruptChunk) {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		size += int64(len(chunks[0]))
+		if len(chunks[0]) < p.header.chunkSize {
+			break
+		}
+	}
+	return size, nil
+}
+
+func (p *encryptedPacketFile) Sync() error {
+	return p.f.Sync()
+}
+
+func (p *encryptedPacketFile) Close() error {
+	p.cache = nil
+	return p.f.Close()
+}
+
+// Returns true if the packets file is encrypted
+func isEncryptedPacketsFile(f *os.File) (bool, error) {
+	magic := make([]byte, 4)
+	n, err := f.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return isEncryptedPacketsHeader(magic[:n]), nil
+}
+
+// Re-encrypt the data keys of all the tracks of an rf1 file with the current key of the keyring.
+// The video itself is not re-encrypted. Tracks that are not encrypted, or are already
+// encrypted with the current key, are left alone.
+// Returns the number of tracks that were modified.
+func Rekey(baseFilename string, keys *Keyring) (int, error) {
+	tracks, err := findTrackNames(baseFilename)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, track := range tracks {
+		changed, err := rekeyPacketsFile(TrackFilename(baseFilename, track, FileTypePackets), keys)
+		if err != nil {
+			return n, fmt.Errorf("Error re-keying track %v: %w", track, err)
+		}
+		if changed {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// While we rewrite the header of a packets file, we keep a copy of the original header
+// in a journal next to it. If we crash in the middle of the rewrite, then the header could
+// be torn, which would make the whole file unreadable, so the next Rekey restores the
+// original header from the journal, and starts again.
+const rekeyJournalSuffix = ".rekey"
+
+func rekeyPacketsFile(filename string, keys *Keyring) (bool, error) {
+	if err := recoverRekeyJournal(filename); err != nil {
+		return false, fmt.Errorf("Error recovering from interrupted re-key: %w", err)
+	}
+	f, err := os.OpenFile(filename, os.O_RDWR, 0660)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	raw := make([]byte, encryptedHeaderSize)
+	n, err := f.ReadAt(raw, 0)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	if !isEncryptedPacketsHeader(raw[:n]) {
+		return false, nil
+	}
+	h, err := unmarshalEncryptedHeader(raw[:n])
+	if err != nil {
+		return false, err
+	}
+	if h.keyID == keys.current {
+		return false, nil
+	}
+	dataKey, err := h.unwrap(keys)
+	if err != nil {
+		return false, err
+	}
+	if err := h.wrap(keys, dataKey); err != nil {
+		return false, err
+	}
+	updated := h.marshal()
+	if bytes.Equal(updated, raw) {
+		return false, nil
+	}
+	journal := filename + rekeyJournalSuffix
+	if err := writeFileAndSync(journal, raw); err != nil {
+		return false, err
+	}
+	if _, err := f.WriteAt(updated, 0); err != nil {
+		return false, err
+	}
+	if err := f.Sync(); err != nil {
+		return false, err
+	}
+	return true, os.Remove(journal)
+}
+
+// If a previous Rekey was interrupted while rewriting the header of the packets file,
+// then restore the original header.
+func recoverRekeyJournal(filename string) error {
+	journal := filename + rekeyJournalSuffix
+	original, err := os.ReadFile(journal)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, err := unmarshalEncryptedHeader(original); err != nil {
+		return fmt.Errorf("Re-key journal %v is corrupt: %w", journal, err)
+	}
+	f, err := os.OpenFile(filename, os.O_RDWR, 0660)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(original, 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return os.Remove(journal)
+}
+
+// Write a file via a temporary file, so that it either exists with all of its content, or not at all
+func writeFileAndSync(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return err
+	}
+	// Make the rename durable, otherwise the journal could vanish after a crash
+	dir, err := os.Open(filepath.Dir(filename))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
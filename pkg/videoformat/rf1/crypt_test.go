@@ -0,0 +1,234 @@
+package rf1
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestKey(t *testing.T) []byte {
+	key := make([]byte, KeySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return key
+}
+
+func writeEncryptedTestFile(t *testing.T, baseFilename string, keys *Keyring, nalus []NALU, batch int, clean bool) {
+	os.Remove(TrackFilename(baseFilename, "video", FileTypeIndex))
+	os.Remove(TrackFilename(baseFilename, "video", FileTypePackets))
+	track, err := MakeVideoTrack("video", nalus[0].PTS, CodecH264, 352, 288)
+	require.NoError(t, err)
+	f, err := CreateEncrypted(baseFilename, []*Track{track}, keys)
+	require.NoError(t, err)
+	for i := 0; i < len(nalus); i += batch {
+		require.NoError(t, track.WriteNALUs(nalus[i:min(i+batch, len(nalus))]))
+	}
+	if clean {
+		require.NoError(t, f.Close())
+	} else {
+		dirtyClose(f)
+	}
+}
+
+func readEncryptedTestFile(t *testing.T, baseFilename string, keys *Keyring) ([]NALU, error) {
+	f, err := OpenWithKeys(baseFilename, OpenModeReadOnly, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	nalus, err := f.Tracks[0].ReadIndex(0, f.Tracks[0].Count())
+	require.NoError(t, err)
+	return nalus, f.Tracks[0].ReadPayload(nalus)
+}
+
+func TestEncryptedReadWrite(t *testing.T) {
+	base := BaseDir + "/encrypted"
+	keys, err := NewKeyring(makeTestKey(t))
+	require.NoError(t, err)
+	tbase := time.Date(2024, time.March, 4, 5, 6, 7, 0, time.UTC)
+
+	// Small packets are aggregated into one write, and large packets span multiple chunks
+	small := CreateTestNALUs(tbase, 0, 1000, 10, 50, 150, 7)
+	large := CreateTestNALUs(tbase, 0, 100, 10, 1000, 3*EncryptedChunkSize, 11)
+	for _, nalus := range [][]NALU{small, large} {
+		for _, batch := range []int{1, 13} {
+			writeEncryptedTestFile(t, base, keys, nalus, batch, true)
+			read, err := readEncryptedTestFile(t, base, keys)
+			require.NoError(t, err)
+			require.Equal(t, len(nalus), len(read))
+			for i := range nalus {
+				require.Equal(t, nalus[i].Payload, read[i].Payload)
+			}
+
+			// Random access by time
+			f, err := OpenWithKeys(base, OpenModeReadOnly, keys)
+			require.NoError(t, err)
+			require.True(t, f.Tracks[0].Encrypted)
+			some, err := f.Tracks[0].ReadAtTime(5*time.Second, 6*time.Second, 0)
+			require.NoError(t, err)
+			require.NotEmpty(t, some)
+			first := 0
+			for nalus[first].PTS.Sub(tbase) < 5*time.Second {
+				first++
+			}
+			require.Equal(t, nalus[first].Payload, some[0].Payload)
+			f.Close()
+		}
+	}
+
+	// The packets are not readable on disk
+	raw, err := os.ReadFile(TrackFilename(base, "video", FileTypePackets))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(raw, large[3].Payload[:64]))
+
+	// Without the key, we can read the index, but not the packets
+	read, err := readEncryptedTestFile(t, base, nil)
+	require.ErrorIs(t, err, ErrNoKey)
+	require.Equal(t, len(large), len(read))
+
+	// With the wrong key, we can't open the file
+	wrong, err := NewKeyring(makeTestKey(t))
+	require.NoError(t, err)
+	_, err = readEncryptedTestFile(t, base, wrong)
+	require.ErrorIs(t, err, ErrUnknownKey)
+
+	// Tampering is detected
+	pkt, err := os.OpenFile(TrackFilename(base, "video", FileTypePackets), os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = pkt.WriteAt([]byte{raw[1000] ^ 1}, 1000)
+	require.NoError(t, err)
+	pkt.Close()
+	_, err = readEncryptedTestFile(t, base, keys)
+	require.ErrorIs(t, err, ErrCorruptChunk)
+}
+
+func TestEncryptedCheck(t *testing.T) {
+	base := BaseDir + "/encrypted-check"
+	keys, err := NewKeyring(makeTestKey(t))
+	require.NoError(t, err)
+	tbase := time.Date(2024, time.March, 4, 5, 6, 7, 0, time.UTC)
+	nalus := createAnnexBTestNALUs(tbase, 300, 10)
+
+	writeEncryptedTestFile(t, base, keys, nalus, 10, true)
+	result, err := Check(base, CheckOptions{Repair: true, Keys: keys})
+	require.NoError(t, err)
+	require.False(t, result.HasProblems())
+
+	// Without the key, we can't check the packets
+	result, err = Check(base, CheckOptions{Repair: true})
+	require.NoError(t, err)
+	require.True(t, result.HasProblems())
+	require.False(t, result.Tracks[0].Repaired)
+
+	// Crash while writing
+	writeEncryptedTestFile(t, base, keys, nalus, 10, false)
+	unclean, err := IsUnclean(base)
+	require.NoError(t, err)
+	require.True(t, unclean)
+	result, err = Check(base, CheckOptions{Repair: true, Keys: keys})
+	require.NoError(t, err)
+	require.True(t, result.Tracks[0].Repaired)
+	require.Equal(t, len(nalus), result.Tracks[0].Count)
+	read, err := readEncryptedTestFile(t, base, keys)
+	require.NoError(t, err)
+	require.Equal(t, len(nalus), len(read))
+	for i := range nalus {
+		require.Equal(t, nalus[i].Payload, read[i].Payload)
+	}
+	result, err = Check(base, CheckOptions{Keys: keys})
+	require.NoError(t, err)
+	require.False(t, result.HasProblems())
+
+	// Rebuild a missing index
+	require.NoError(t, os.Remove(TrackFilename(base, "video", FileTypeIndex)))
+	result, err = Check(base, CheckOptions{Repair: true, Keys: keys, RebuildTimeBase: tbase})
+	require.NoError(t, err)
+	require.True(t, result.Tracks[0].Repaired)
+	require.Equal(t, len(nalus), result.Tracks[0].Count)
+	read, err = readEncryptedTestFile(t, base, keys)
+	require.NoError(t, err)
+	for i := range nalus {
+		require.Equal(t, nalus[i].Payload, read[i].Payload)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	base := BaseDir + "/rekey"
+	key1 := makeTestKey(t)
+	key2 := makeTestKey(t)
+	keys1, err := NewKeyring(key1)
+	require.NoError(t, err)
+	tbase := time.Date(2024, time.March, 4, 5, 6, 7, 0, time.UTC)
+	nalus := CreateTestNALUs(tbase, 0, 100, 10, 50, 5000, 13)
+	writeEncryptedTestFile(t, base, keys1, nalus, 10, true)
+	packetsBefore, err := os.ReadFile(TrackFilename(base, "video", FileTypePackets))
+	require.NoError(t, err)
+
+	// During a re-key, the keyring holds both keys
+	both, err := NewKeyring(key2, key1)
+	require.NoError(t, err)
+	n, err := Rekey(base, both)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	n, err = Rekey(base, both)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	// Only the header was changed
+	packetsAfter, err := os.ReadFile(TrackFilename(base, "video", FileTypePackets))
+	require.NoError(t, err)
+	require.Equal(t, packetsBefore[encryptedHeaderSize:], packetsAfter[encryptedHeaderSize:])
+
+	keys2, err := NewKeyring(key2)
+	require.NoError(t, err)
+	read, err := readEncryptedTestFile(t, base, keys2)
+	require.NoError(t, err)
+	for i := range nalus {
+		require.Equal(t, nalus[i].Payload, read[i].Payload)
+	}
+	_, err = readEncryptedTestFile(t, base, keys1)
+	require.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestRekeyInterrupted(t *testing.T) {
+	base := BaseDir + "/rekey-interrupted"
+	key1 := makeTestKey(t)
+	key2 := makeTestKey(t)
+	keys1, err := NewKeyring(key1)
+	require.NoError(t, err)
+	tbase := time.Date(2024, time.March, 4, 5, 6, 7, 0, time.UTC)
+	nalus := CreateTestNALUs(tbase, 0, 100, 10, 50, 5000, 13)
+	writeEncryptedTestFile(t, base, keys1, nalus, 10, true)
+
+	// Crash after writing the journal, and tearing the header of the packets file
+	packetsFile := TrackFilename(base, "video", FileTypePackets)
+	packets, err := os.ReadFile(packetsFile)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(packetsFile+rekeyJournalSuffix, packets[:encryptedHeaderSize], 0660))
+	f, err := os.OpenFile(packetsFile, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(make([]byte, 64), 40)
+	require.NoError(t, err)
+	f.Close()
+	keys2, err := NewKeyring(key2)
+	require.NoError(t, err)
+	_, err = readEncryptedTestFile(t, base, keys1)
+	require.Error(t, err)
+
+	// Running again restores the header, and finishes the job
+	both, err := NewKeyring(key2, key1)
+	require.NoError(t, err)
+	n, err := Rekey(base, both)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.NoFileExists(t, packetsFile+rekeyJournalSuffix)
+	read, err := readEncryptedTestFile(t, base, keys2)
+	require.NoError(t, err)
+	for i := range nalus {
+		require.Equal(t, nalus[i].Payload, read[i].Payload)
+	}
+}
@@ -14,12 +14,20 @@ import "C"
 type File struct {
 	BaseFilename string
 	Tracks       []*Track
+
+	keys *Keyring // If not nil, then new tracks are encrypted
 }
 
 // Create a new rf1 file group writer.
 // baseFilename is the base name of the file, eg "/home/user/recording-2024-01-01".
 // tracks may be empty/nil
 func Create(baseFilename string, tracks []*Track) (*File, error) {
+	return CreateEncrypted(baseFilename, tracks, nil)
+}
+
+// Create a new rf1 file group writer, whose tracks are encrypted with the current key of the keyring.
+// If keys is nil, then the tracks are not encrypted.
+func CreateEncrypted(baseFilename string, tracks []*Track, keys *Keyring) (*File, error) {
 	for _, track := range tracks {
 		if !IsValidCodec(track.Codec) {
 			return nil, ErrInvalidCodec
@@ -27,9 +35,11 @@ func Create(baseFilename string, tracks []*Track) (*File, error) {
 	}
 	f := &File{
 		BaseFilename: baseFilename,
+		keys:         keys,
 	}
 
 	for _, track := range tracks {
+		track.keys = keys
 		if err := track.CreateTrackFiles(baseFilename); err != nil {
 			f.Close()
 			return nil, err
@@ -44,6 +54,12 @@ func Create(baseFilename string, tracks []*Track) (*File, error) {
 // filename may be either a base filename such as `/foo/bar/myvideo` or
 // a concrete track filename such as `/foo/bar/myvideo_mytrack.rf1i`
 func Open(filename string, mode OpenMode) (*File, error) {
+	return OpenWithKeys(filename, mode, nil)
+}
+
+// Open an existing rf1 file group, which may be encrypted.
+// New tracks added to the file are encrypted if keys is not nil.
+func OpenWithKeys(filename string, mode OpenMode, keys *Keyring) (*File, error) {
 	// Scan for tracks
 	baseFilename := filename
 	if strings.HasSuffix(filename, Extension(FileTypeIndex)) {
@@ -60,12 +76,13 @@ func Open(filename string, mode OpenMode) (*File, error) {
 	}
 	f := &File{
 		BaseFilename: baseFilename,
+		keys:         keys,
 	}
 
 	for _, m := range matches {
 		trackName := strings.TrimPrefix(m, baseFilename+"_")
 		trackName = strings.TrimSuffix(trackName, ".rf1i")
-		track, err := OpenTrack(baseFilename, trackName, mode)
+		track, err := OpenTrackWithKeys(baseFilename, trackName, mode, keys)
 		if err != nil {
 			f.Close()
 			return nil, err
@@ -80,6 +97,7 @@ func Open(filename string, mode OpenMode) (*File, error) {
 
 // Create the structure for the new empty track on disk
 func (f *File) AddTrack(track *Track) error {
+	track.keys = f.keys
 	if err := track.CreateTrackFiles(f.BaseFilename); err != nil {
 		return err
 	}
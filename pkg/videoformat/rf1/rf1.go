@@ -12,6 +12,9 @@ const (
 	MagicVideoTrackBytes = "rf1v" // must be 4 bytes long
 	CodecH264            = "h264" // must be 4 bytes long, and present in IsValidCodec()
 	CodecH265            = "h265" // must be 4 bytes long, and present in IsValidCodec()
+	CodecAAC             = "mp4a" // AAC, stored as ADTS frames. Must be 4 bytes long, and present in IsValidCodec()
+	CodecPCMA            = "alaw" // G.711 A-law. Must be 4 bytes long, and present in IsValidCodec()
+	CodecPCMU            = "ulaw" // G.711 mu-law. Must be 4 bytes long, and present in IsValidCodec()
 )
 
 var ErrInvalidCodec = errors.New("invalid codec")
@@ -28,6 +31,11 @@ const (
 	FileTypePackets
 )
 
+// Flags in the index header
+const (
+	IndexHeaderFlagEncrypted = 1 // Packets file is encrypted
+)
+
 // Flags of a NALU in the track index
 type IndexNALUFlags uint32
 
@@ -123,7 +131,15 @@ func SplitIndexNALUFlagsOnly(p uint64) IndexNALUFlags {
 }
 
 func IsValidCodec(c string) bool {
-	return len(c) == 4 && (c == CodecH264 || c == CodecH265)
+	return IsVideoCodec(c) || IsAudioCodec(c)
+}
+
+func IsVideoCodec(c string) bool {
+	return c == CodecH264 || c == CodecH265
+}
+
+func IsAudioCodec(c string) bool {
+	return c == CodecAAC || c == CodecPCMA || c == CodecPCMU
 }
 
 func Extension(fileType FileType) string {
@@ -24,7 +24,9 @@ typedef struct _AudioIndexHeader {
 	uint32_t CodecFlags;
 	uint64_t TimeBase;
 	uint16_t IndexCount;
-	uint8_t  Other[6];
+	uint8_t  Channels;
+	uint8_t  Reserved;
+	uint32_t SampleRate;
 } AudioIndexHeader;
 
 typedef struct _VideoIndexHeader {
@@ -282,6 +282,56 @@ func TestReadBackToKeyframe(t *testing.T) {
 	}
 }
 
+func TestAudioTrack(t *testing.T) {
+	timeBase := time.Now()
+	video, err := MakeVideoTrack("video", timeBase, CodecH264, 320, 240)
+	require.NoError(t, err)
+	audio, err := MakeAudioTrack("audio", timeBase, CodecPCMU, 8000, 1)
+	require.NoError(t, err)
+	_, err = MakeAudioTrack("audio", timeBase, CodecH264, 8000, 1)
+	require.ErrorIs(t, err, ErrInvalidCodec)
+	_, err = MakeVideoTrack("video", timeBase, CodecAAC, 320, 240)
+	require.ErrorIs(t, err, ErrInvalidCodec)
+
+	fw, err := Create(BaseDir+"/audio", []*Track{video, audio})
+	require.NoError(t, err)
+	// 20ms packets of 160 samples each
+	written := []NALU{}
+	for i := 0; i < 50; i++ {
+		payload := make([]byte, 160)
+		for j := range payload {
+			payload[j] = byte(i + j)
+		}
+		written = append(written, NALU{
+			PTS:     timeBase.Add(time.Duration(i) * 20 * time.Millisecond),
+			Flags:   IndexNALUFlagKeyFrame,
+			Payload: payload,
+		})
+	}
+	require.NoError(t, audio.WriteNALUs(written))
+	require.NoError(t, fw.Close())
+
+	fr, err := Open(BaseDir+"/audio", OpenModeReadOnly)
+	require.NoError(t, err)
+	defer fr.Close()
+	require.Equal(t, 2, len(fr.Tracks))
+	var read *Track
+	for _, track := range fr.Tracks {
+		if track.Name == "audio" {
+			read = track
+		}
+	}
+	require.NotNil(t, read)
+	require.Equal(t, TrackTypeAudio, read.Type)
+	require.Equal(t, CodecPCMU, read.Codec)
+	require.Equal(t, 8000, read.SampleRate)
+	require.Equal(t, 1, read.Channels)
+	nalus, err := read.ReadAtTime(200*time.Millisecond, 300*time.Millisecond, PacketReadFlagSeekBackToKeyFrame)
+	require.NoError(t, err)
+	require.Equal(t, 6, len(nalus))
+	require.Equal(t, written[10].Payload, nalus[0].Payload)
+}
+
 // Very useful to get a console dump of the first 70 NALUs when looking at splicing, keyframe seeking, etc.
 func TestFakeNALUFlags(t *testing.T) {
 	// The logic inside CreateTestNALU is a bit trick. This tests that.
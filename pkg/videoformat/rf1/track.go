@@ -43,11 +43,17 @@ type Track struct {
 	Width    int       // Only applicable to video
 	Height   int       // Only applicable to video
 
+	SampleRate int // Only applicable to audio
+	Channels   int // Only applicable to audio
+
+	Encrypted bool // Packets are encrypted (see crypt.go)
+
+	keys        *Keyring      // If not nil, then new track files are encrypted
 	canWrite    bool          // True if opened with write ability
 	index       *os.File      // Index file
 	indexCount  int           // Number of index entries in file, excluding the sentinel
 	dirty       bool          // True if we need to write our index header and truncate files on Close()
-	packets     *os.File      // Packets file
+	packets     packetFile    // Packets file
 	packetsSize int64         // Size of packets file in bytes (real used space, ignoring pre-allocated space)
 	duration    time.Duration // Duration of track
 	indexCache  []uint64      // Cache of all index entries, including sentinel
@@ -61,7 +67,7 @@ type Track struct {
 
 // Create a new track definition, but do not write anything to disk, or associate the track with a file.
 func MakeVideoTrack(name string, timeBase time.Time, codec string, width, height int) (*Track, error) {
-	if !IsValidCodec(codec) {
+	if !IsVideoCodec(codec) {
 		return nil, ErrInvalidCodec
 	}
 	if width < 1 || height < 1 {
@@ -81,6 +87,28 @@ func MakeVideoTrack(name string, timeBase time.Time, codec string, width, height
 	}, nil
 }
 
+// Create a new audio track definition, but do not write anything to disk, or associate the track with a file.
+func MakeAudioTrack(name string, timeBase time.Time, codec string, sampleRate, channels int) (*Track, error) {
+	if !IsAudioCodec(codec) {
+		return nil, ErrInvalidCodec
+	}
+	if sampleRate < 1 || channels < 1 || channels > 255 {
+		return nil, fmt.Errorf("Invalid audio sample rate/channels (%v, %v)", sampleRate, channels)
+	}
+	if !IsValidTrackName(name) {
+		return nil, fmt.Errorf("Invalid track name: %v", name)
+	}
+	return &Track{
+		canWrite:   true,
+		Type:       TrackTypeAudio,
+		Name:       name,
+		TimeBase:   timeBase,
+		Codec:      codec,
+		SampleRate: sampleRate,
+		Channels:   channels,
+	}, nil
+}
+
 // Return true if the given name is a valid track name.
 // Track names become part of filenames, so we impose restrictions on them.
 func IsValidTrackName(name string) bool {
@@ -125,7 +153,17 @@ func (t *Track) CreateTrackFiles(baseFilename string) error {
 	t.canWrite = true
 	t.index = idx
 	t.indexCount = 0
-	t.packets = pkt
+	t.Encrypted = t.keys != nil
+	if t.Encrypted {
+		t.packets, err = createEncryptedPacketFile(pkt, t.keys)
+		if err != nil {
+			idx.Close()
+			pkt.Close()
+			return err
+		}
+	} else {
+		t.packets = &plainPacketFile{pkt}
+	}
 	t.packetsSize = 0
 	t.duration = 0
 	t.indexCache = nil
@@ -147,6 +185,13 @@ func (t *Track) CreateTrackFiles(baseFilename string) error {
 // If OpenMode is OpenModeReadOnly, then we open the files with O_RDONLY.
 // If OpenMode is OpenModeReadWrite is true, and we can't open the file with O_RDWR, then the function fails.
 func OpenTrack(baseFilename string, trackName string, mode OpenMode) (*Track, error) {
+	return OpenTrackWithKeys(baseFilename, trackName, mode, nil)
+}
+
+// Open a track that may be encrypted.
+// If the track is encrypted and keys is nil, then the index can be read, but reading
+// packets fails with ErrNoKey.
+func OpenTrackWithKeys(baseFilename string, trackName string, mode OpenMode, keys *Keyring) (*Track, error) {
 	var idxFile *os.File
 	var pktFile *os.File
 	var err error
@@ -228,7 +273,15 @@ func OpenTrack(baseFilename string, trackName string, mode OpenMode) (*Track, er
 		sentinelPos = SplitIndexNALULocationOnly(sentinel[0])
 	}
 
-	realPacketFileSize, err := pktFile.Seek(0, io.SeekEnd)
+	encrypted := uint32(indexHead.Flags)&IndexHeaderFlagEncrypted != 0
+	var packets packetFile = &plainPacketFile{pktFile}
+	if encrypted {
+		if packets, err = openEncryptedPacketFile(pktFile, keys); err != nil {
+			return nil, err
+		}
+	}
+
+	realPacketFileSize, err := packets.Size()
 	if err != nil {
 		return nil, err
 	}
@@ -265,10 +318,12 @@ func OpenTrack(baseFilename string, trackName string, mode OpenMode) (*Track, er
 		Name:                trackName,
 		Codec:               string(codec[:]),
 		TimeBase:            DecodeTimeBase(uint64(indexHead.TimeBase)),
+		Encrypted:           encrypted,
+		keys:                keys,
 		index:               idxFile,
 		indexCount:          indexCount,
 		indexCache:          indexCache,
-		packets:             pktFile,
+		packets:             packets,
 		packetsSize:         pktBytes,
 		indexPreallocSize:   realIndexFileSize,
 		packetsPreallocSize: realPacketFileSize,
@@ -281,6 +336,13 @@ func OpenTrack(baseFilename string, trackName string, mode OpenMode) (*Track, er
 		copy(videoHeadBytes, commonHeadBytes)
 		track.Width = int(videoHead.Width)
 		track.Height = int(videoHead.Height)
+	} else {
+		audioHead := C.AudioIndexHeader{}
+		commonHeadBytes := unsafe.Slice((*byte)(unsafe.Pointer(&indexHead)), int(unsafe.Sizeof(indexHead)))
+		audioHeadBytes := unsafe.Slice((*byte)(unsafe.Pointer(&audioHead)), int(unsafe.Sizeof(audioHead)))
+		copy(audioHeadBytes, commonHeadBytes)
+		track.SampleRate = int(audioHead.SampleRate)
+		track.Channels = int(audioHead.Channels)
 	}
 
 	track.duration, err = track.readDuration()
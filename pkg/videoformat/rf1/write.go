@@ -21,6 +21,7 @@ func (t *Track) WriteHeader() error {
 		header := C.VideoIndexHeader{}
 		header.TimeBase = C.uint64_t(EncodeTimeBase(t.TimeBase))
 		header.IndexCount = C.uint16_t(t.indexCount)
+		header.Flags = C.uint32_t(t.headerFlags())
 		cgogo.CopySlice(header.Magic[:], []byte(MagicVideoTrackBytes))
 		cgogo.CopySlice(header.Codec[:], []byte(t.Codec))
 		header.Width = C.uint16_t(t.Width)
@@ -32,8 +33,11 @@ func (t *Track) WriteHeader() error {
 		header := C.AudioIndexHeader{}
 		header.TimeBase = C.uint64_t(EncodeTimeBase(t.TimeBase))
 		header.IndexCount = C.uint16_t(t.indexCount)
+		header.Flags = C.uint32_t(t.headerFlags())
 		cgogo.CopySlice(header.Magic[:], []byte(MagicAudioTrackBytes))
 		cgogo.CopySlice(header.Codec[:], []byte(t.Codec))
+		header.Channels = C.uint8_t(t.Channels)
+		header.SampleRate = C.uint32_t(t.SampleRate)
 		if _, err := cgogo.WriteStructAt(t.index, &header, 0); err != nil {
 			return err
 		}
@@ -43,6 +47,14 @@ func (t *Track) WriteHeader() error {
 	return nil
 }
 
+func (t *Track) headerFlags() uint32 {
+	flags := uint32(0)
+	if t.Encrypted {
+		flags |= IndexHeaderFlagEncrypted
+	}
+	return flags
+}
+
 func (t *Track) Close() error {
 	var firstErr error
 
@@ -95,7 +107,7 @@ func (t *Track) WriteNALUs(nalus []NALU) error {
 	if !t.disablePreallocate && t.packetsSize+packetBytes > t.packetsPreallocSize {
 		// Extend the size of the packets file by a large enough increment to achieve our non-fragmentation goal
 		t.packetsPreallocSize = packetFilePreallocationSize(t.packetsSize+packetBytes, t.indexCount+len(nalus))
-		if err := PreallocateFile(t.packets, t.packetsPreallocSize); err != nil {
+		if err := t.packets.Preallocate(t.packetsPreallocSize); err != nil {
 			return err
 		}
 		//if err := t.packets.Truncate(t.packetsPreallocSize); err != nil {
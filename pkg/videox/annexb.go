@@ -145,3 +145,28 @@ func FirstLikelyAnnexBEncodedIndex(encoded []byte) int {
 func AnnexBWorstSize(startCodeLen, rawLen int) int {
 	return startCodeLen + rawLen*3/2
 }
+
+// Split an Annex-B byte stream (eg the output of an encoder) into its NALUs.
+// Each NALU retains its start code, and is marked as Annex-B encoded.
+func SplitAnnexBPacket(packet []byte) []NALU {
+	nalus := []NALU{}
+	start := -1
+	for i := 0; i+2 < len(packet); i++ {
+		if packet[i] == 0 && packet[i+1] == 0 && packet[i+2] == 1 {
+			// A 4 byte start code has an extra leading zero
+			sc := i
+			if i > 0 && packet[i-1] == 0 && i-1 > start {
+				sc = i - 1
+			}
+			if start != -1 {
+				nalus = append(nalus, NALU{PayloadIsAnnexB: true, Payload: packet[start:sc]})
+			}
+			start = sc
+			i += 2
+		}
+	}
+	if start != -1 {
+		nalus = append(nalus, NALU{PayloadIsAnnexB: true, Payload: packet[start:]})
+	}
+	return nalus
+}
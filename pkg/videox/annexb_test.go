@@ -44,3 +44,16 @@ func TestEncodeAnnexB(t *testing.T) {
 	}
 
 }
+
+func TestSplitAnnexBPacket(t *testing.T) {
+	packet := []byte{0, 0, 0, 1, 0x67, 1, 2, 0, 0, 1, 0x68, 3, 0, 0, 0, 1, 0x65, 4, 5, 0, 0, 3, 1}
+	nalus := SplitAnnexBPacket(packet)
+	require.Equal(t, 3, len(nalus))
+	require.Equal(t, []byte{0, 0, 0, 1, 0x67, 1, 2}, nalus[0].Payload)
+	require.Equal(t, []byte{0, 0, 1, 0x68, 3}, nalus[1].Payload)
+	require.Equal(t, []byte{0, 0, 0, 1, 0x65, 4, 5, 0, 0, 3, 1}, nalus[2].Payload)
+	for _, n := range nalus {
+		require.True(t, n.PayloadIsAnnexB)
+	}
+	require.Equal(t, 0, len(SplitAnnexBPacket([]byte{1, 2, 3})))
+}
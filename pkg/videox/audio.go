@@ -0,0 +1,166 @@
+package videox
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+)
+
+// AudioCodec is the codec of an audio stream from a camera's microphone
+type AudioCodec int
+
+const (
+	AudioCodecUnknown AudioCodec = iota
+	AudioCodecAAC                // MPEG-4 AAC. Payloads are single ADTS frames.
+	AudioCodecPCMA               // G.711 A-law
+	AudioCodecPCMU               // G.711 μ-law
+)
+
+func (c AudioCodec) InternalName() string {
+	// SYNC-INTERNAL-AUDIO-CODEC-NAMES
+	switch c {
+	case AudioCodecAAC:
+		return "aac"
+	case AudioCodecPCMA:
+		return "pcma"
+	case AudioCodecPCMU:
+		return "pcmu"
+	default:
+		return "unknown"
+	}
+}
+
+func (c AudioCodec) FourByteName() uint32 {
+	b := [4]byte{}
+	switch c {
+	case AudioCodecAAC:
+		b = [4]byte{'A', 'A', 'C', ' '}
+	case AudioCodecPCMA:
+		b = [4]byte{'P', 'C', 'M', 'A'}
+	case AudioCodecPCMU:
+		b = [4]byte{'P', 'C', 'M', 'U'}
+	default:
+		b = [4]byte{'-', '-', '-', '-'}
+	}
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+func (c AudioCodec) String() string {
+	return c.InternalName()
+}
+
+// Returns true if the codec is one of the G.711 variants
+func (c AudioCodec) IsG711() bool {
+	return c == AudioCodecPCMA || c == AudioCodecPCMU
+}
+
+// AudioPacket is a chunk of audio that was received in a single RTP packet.
+// For AAC, the payload is a single access unit, with an ADTS header, so that
+// every packet is self-describing. For G.711, the payload is the raw 8-bit samples.
+type AudioPacket struct {
+	Codec      AudioCodec
+	SampleRate int
+	Channels   int
+	PTS        time.Duration // Raw packet PTS received from RTSP reader. Same clock as VideoPacket.PTS.
+	WallPTS    time.Time     // Reference wall time combined with the received PTS
+	Payload    []byte
+}
+
+// Deep clone of audio packet
+func (p *AudioPacket) Clone() *AudioPacket {
+	c := *p
+	c.Payload = append([]byte(nil), p.Payload...)
+	return &c
+}
+
+// Returns the number of samples (per channel) in the packet
+func (p *AudioPacket) NumSamples() int {
+	if p.Codec == AudioCodecAAC {
+		return mpeg4audio.SamplesPerAccessUnit
+	}
+	return len(p.Payload) / max(p.Channels, 1)
+}
+
+// Wrap a raw AAC access unit in an ADTS header
+func AACAddADTS(au []byte, config *mpeg4audio.Config) ([]byte, error) {
+	pkts := mpeg4audio.ADTSPackets{
+		{
+			Type:         config.Type,
+			SampleRate:   config.SampleRate,
+			ChannelCount: config.ChannelCount,
+			AU:           au,
+		},
+	}
+	return pkts.Marshal()
+}
+
+// Split a single ADTS frame into its AudioSpecificConfig and the raw access unit
+func AACSplitADTS(payload []byte) (config []byte, au []byte, err error) {
+	var pkts mpeg4audio.ADTSPackets
+	if err := pkts.Unmarshal(payload); err != nil {
+		return nil, nil, err
+	}
+	if len(pkts) != 1 {
+		return nil, nil, fmt.Errorf("Expected 1 ADTS frame, but found %v", len(pkts))
+	}
+	cfg := mpeg4audio.Config{
+		Type:         pkts[0].Type,
+		SampleRate:   pkts[0].SampleRate,
+		ChannelCount: pkts[0].ChannelCount,
+	}
+	config, err = cfg.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, pkts[0].AU, nil
+}
+
+// Decode G.711 samples into 16-bit signed PCM
+func DecodeG711(codec AudioCodec, payload []byte) ([]int16, error) {
+	out := make([]int16, len(payload))
+	switch codec {
+	case AudioCodecPCMA:
+		for i, b := range payload {
+			out[i] = alawToLinear(b)
+		}
+	case AudioCodecPCMU:
+		for i, b := range payload {
+			out[i] = ulawToLinear(b)
+		}
+	default:
+		return nil, fmt.Errorf("Codec %v is not G.711", codec)
+	}
+	return out, nil
+}
+
+// ITU-T G.711 A-law expansion
+func alawToLinear(a byte) int16 {
+	a ^= 0x55
+	t := int32(a&0x0f) << 4
+	seg := (a & 0x70) >> 4
+	switch seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if a&0x80 != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+// ITU-T G.711 μ-law expansion
+func ulawToLinear(u byte) int16 {
+	u = ^u
+	t := (int32(u&0x0f) << 3) + 0x84
+	t <<= (u & 0x70) >> 4
+	if u&0x80 != 0 {
+		return int16(0x84 - t)
+	}
+	return int16(t - 0x84)
+}
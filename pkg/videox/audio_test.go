@@ -0,0 +1,31 @@
+package videox
+
+import (
+	"testing"
+
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeG711(t *testing.T) {
+	pcm, err := DecodeG711(AudioCodecPCMU, []byte{0xff, 0x00, 0x80})
+	require.NoError(t, err)
+	require.Equal(t, []int16{0, -32124, 32124}, pcm)
+	pcm, err = DecodeG711(AudioCodecPCMA, []byte{0xd5, 0x55, 0xaa})
+	require.NoError(t, err)
+	require.Equal(t, []int16{8, -8, 32256}, pcm)
+	_, err = DecodeG711(AudioCodecAAC, []byte{0})
+	require.Error(t, err)
+}
+
+func TestADTS(t *testing.T) {
+	config := mpeg4audio.Config{Type: mpeg4audio.ObjectTypeAACLC, SampleRate: 16000, ChannelCount: 1}
+	au := []byte{1, 2, 3, 4, 5}
+	adts, err := AACAddADTS(au, &config)
+	require.NoError(t, err)
+	rawConfig, au2, err := AACSplitADTS(adts)
+	require.NoError(t, err)
+	require.Equal(t, au, au2)
+	expected, _ := config.Marshal()
+	require.Equal(t, expected, rawConfig)
+}
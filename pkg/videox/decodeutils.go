@@ -62,6 +62,20 @@ func DecodeClosestImageInPacketList(codec Codec, packets []*VideoPacket, targetT
 		}
 	}
 
+	img, imgTime, err := decodeClosestYUVImage(codec, packets, targetTime, cache, videoCacheKey)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return img.ToCImageRGB(), imgTime, nil
+}
+
+// Same as DecodeClosestImageInPacketList, but return the YUV image, and don't use a cache.
+// The image is a copy, so the caller may modify it.
+func DecodeClosestYUVImageInPacketList(codec Codec, packets []*VideoPacket, targetTime time.Time) (*accel.YUVImage, time.Time, error) {
+	return decodeClosestYUVImage(codec, packets, targetTime, nil, "")
+}
+
+func decodeClosestYUVImage(codec Codec, packets []*VideoPacket, targetTime time.Time, cache *FrameCache, videoCacheKey string) (*accel.YUVImage, time.Time, error) {
 	startTime := time.Now()
 	nFramesDecoded := 0
 	decoder, err := NewVideoStreamDecoder(codec)
@@ -106,7 +120,7 @@ func DecodeClosestImageInPacketList(codec Codec, packets []*VideoPacket, targetT
 		fmt.Printf("Decoded %v frames in %.3f seconds (%.1f FPS)\n", nFramesDecoded, time.Since(startTime).Seconds(), float64(nFramesDecoded)/time.Since(startTime).Seconds())
 	}
 	if bestImg != nil {
-		return bestImg.ToCImageRGB(), bestTime, nil
+		return bestImg, bestTime, nil
 	}
 	if firstError == nil {
 		firstError = fmt.Errorf("No image found")
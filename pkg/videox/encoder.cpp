@@ -24,8 +24,27 @@ struct Encoder {
 	AVPacket*        Packet       = nullptr;
 	SwsContext*      SwsCtx       = nullptr;
 
+	// When encoding to memory (MakeMemoryEncoder), the encoded packets are stored here,
+	// until the caller reads them out.
+	struct EncodedPacket {
+		std::string Data;
+		int64_t     PTSNano;
+		bool        IsKeyFrame;
+	};
+	bool                       ToMemory = false;
+	std::vector<EncodedPacket> Encoded;
+
 	bool                     SentHeader = false;
 	std::vector<std::string> PreIDRNALUs; // Queued up NALUs that we need to send with the IDR NALU
+
+	// Optional audio stream
+	AudioEncoderType   AudioType      = AudioEncoderTypeNone;
+	AVStream*          AudioStream    = nullptr;
+	AVCodecContext*    AudioCodecCtx  = nullptr; // Only when transcoding PCM to AAC
+	AVFrame*           AudioFrame     = nullptr; // Only when transcoding PCM to AAC
+	std::vector<float> AudioPending;             // Interleaved samples that don't yet fill a frame
+	int64_t            AudioNextPTS   = 0;       // In samples
+	bool               AudioStarted   = false;
 };
 
 struct EncoderCleanup {
@@ -46,6 +65,10 @@ struct EncoderCleanup {
 			av_frame_free(&E->OutputFrame);
 		if (E->Packet)
 			av_packet_free(&E->Packet);
+		if (E->AudioFrame)
+			av_frame_free(&E->AudioFrame);
+		if (E->AudioCodecCtx)
+			avcodec_free_context(&E->AudioCodecCtx);
 		if (E->CodecCtx) {
 			//printf("avcodec_free_context\n");
 			avcodec_free_context(&E->CodecCtx);
@@ -94,6 +117,87 @@ void AppendNalu(std::string& buf, const void* nalu, size_t size) {
 	buf.append((const char*) nalu, size);
 }
 
+#if LIBAVCODEC_VERSION_INT >= AV_VERSION_INT(59, 37, 100)
+#define SET_DEFAULT_CHANNEL_LAYOUT(obj, n) av_channel_layout_default(&(obj)->ch_layout, n)
+#else
+#define SET_DEFAULT_CHANNEL_LAYOUT(obj, n) ((obj)->channels = n, (obj)->channel_layout = av_get_default_channel_layout(n))
+#endif
+
+// Add an audio stream to the output. This must be done before writing the header.
+static char* AddAudioStream(Encoder* encoder, const EncoderParams* params) {
+	encoder->AudioType   = params->AudioType;
+	encoder->AudioStream = avformat_new_stream(encoder->OutFormatCtx, nullptr);
+	if (encoder->AudioStream == nullptr)
+		RETURN_ERROR_STATIC("Failed to allocate audio stream");
+	encoder->AudioStream->time_base = AVRational{1, params->AudioSampleRate};
+
+	if (params->AudioType == AudioEncoderTypeAACPassthrough) {
+		auto par         = encoder->AudioStream->codecpar;
+		par->codec_type  = AVMEDIA_TYPE_AUDIO;
+		par->codec_id    = AV_CODEC_ID_AAC;
+		par->sample_rate = params->AudioSampleRate;
+		SET_DEFAULT_CHANNEL_LAYOUT(par, params->AudioChannels);
+		par->extradata = (uint8_t*) av_mallocz(params->AudioExtradataLen + AV_INPUT_BUFFER_PADDING_SIZE);
+		if (par->extradata == nullptr)
+			RETURN_ERROR_STATIC("Failed to allocate audio extradata");
+		memcpy(par->extradata, params->AudioExtradata, params->AudioExtradataLen);
+		par->extradata_size = params->AudioExtradataLen;
+		return nullptr;
+	}
+
+	// Transcode PCM to AAC, using ffmpeg's native AAC encoder
+	auto codec = avcodec_find_encoder(AV_CODEC_ID_AAC);
+	if (codec == nullptr)
+		RETURN_ERROR_STATIC("Failed to find AAC encoder");
+	encoder->AudioCodecCtx = avcodec_alloc_context3(codec);
+	if (encoder->AudioCodecCtx == nullptr)
+		RETURN_ERROR_STATIC("Failed to allocate audio codec context");
+	auto ctx         = encoder->AudioCodecCtx;
+	ctx->sample_fmt  = AV_SAMPLE_FMT_FLTP;
+	ctx->sample_rate = params->AudioSampleRate;
+	ctx->bit_rate    = 32000 * params->AudioChannels;
+	ctx->time_base   = AVRational{1, params->AudioSampleRate};
+	SET_DEFAULT_CHANNEL_LAYOUT(ctx, params->AudioChannels);
+	if (encoder->OutFormatCtx->oformat->flags & AVFMT_GLOBALHEADER)
+		ctx->flags |= AV_CODEC_FLAG_GLOBAL_HEADER;
+
+	int e = avcodec_open2(ctx, codec, nullptr);
+	if (e < 0)
+		RETURN_ERROR_STR(tsf::fmt("avcodec_open2 (audio) failed: %v", AvErr(e)));
+	if (avcodec_parameters_from_context(encoder->AudioStream->codecpar, ctx) < 0)
+		RETURN_ERROR_STATIC("avcodec_parameters_from_context (audio) failed");
+
+	encoder->AudioFrame = av_frame_alloc();
+	if (encoder->AudioFrame == nullptr)
+		RETURN_ERROR_STATIC("Failed to allocate audio frame");
+	encoder->AudioFrame->format      = ctx->sample_fmt;
+	encoder->AudioFrame->nb_samples  = ctx->frame_size;
+	encoder->AudioFrame->sample_rate = ctx->sample_rate;
+	SET_DEFAULT_CHANNEL_LAYOUT(encoder->AudioFrame, params->AudioChannels);
+	e = av_frame_get_buffer(encoder->AudioFrame, 0);
+	if (e < 0)
+		RETURN_ERROR_STR(tsf::fmt("av_frame_get_buffer (audio) failed: %v", AvErr(e)));
+	return nullptr;
+}
+
+// Write the packets that the audio encoder has produced
+static char* WriteBufferedAudioPackets(Encoder* encoder) {
+	while (true) {
+		int e = avcodec_receive_packet(encoder->AudioCodecCtx, encoder->Packet);
+		if (e == AVERROR(EAGAIN) || e == AVERROR_EOF)
+			return nullptr;
+		if (e < 0)
+			RETURN_ERROR_STR(tsf::fmt("avcodec_receive_packet (audio) failed: %v", AvErr(e)));
+		av_packet_rescale_ts(encoder->Packet, encoder->AudioCodecCtx->time_base, encoder->AudioStream->time_base);
+		encoder->Packet->stream_index = encoder->AudioStream->index;
+		e                             = av_interleaved_write_frame(encoder->OutFormatCtx, encoder->Packet);
+		av_packet_unref(encoder->Packet);
+		if (e < 0)
+			RETURN_ERROR_STR(tsf::fmt("av_interleaved_write_frame (audio) failed: %v", AvErr(e)));
+	}
+	return nullptr;
+}
+
 extern "C" {
 
 // codec is either a codec name such as "h264", or a specific encoder such as "libx264"
@@ -114,13 +218,22 @@ char* MakeEncoderParams(const char* codec, int width, int height, AVPixelFormat
 	// h264_qsv:     [h264_qsv @ 0x619000004180] Specified pixel format yuv420p is invalid or not supported ---- OK this was on an AMD CPU, so of course. But strange error.
 	// h264_v4l2m2m: [h264_v4l2m2m @ 0x619000004180] Could not find a valid device
 
+	AVCodecID codecID = AV_CODEC_ID_NONE;
 	if (strcmp(codec, "h264") == 0) {
 		encoders = h264_encoders;
-	} else if (strcmp(codec, "h265") == 0) {
+		codecID  = AV_CODEC_ID_H264;
+	} else if (strcmp(codec, "h265") == 0 || strcmp(codec, "hevc") == 0) {
 		encoders = h265_encoders;
+		codecID  = AV_CODEC_ID_HEVC;
 	}
 
-	if (encoders != nullptr) {
+	if (encoderType == EncoderTypePackets && codecID != AV_CODEC_ID_NONE) {
+		// When muxing pre-encoded packets, we only need the codec ID, so we don't require
+		// an encoder to be installed. This matters for HEVC, because libx265 is often absent.
+		encoderParams->Codec = avcodec_find_decoder(codecID);
+		if (encoderParams->Codec == nullptr)
+			RETURN_ERROR_STR(tsf::fmt("Failed to find a codec for '%v'", codec));
+	} else if (encoders != nullptr) {
 		// Try each encoder in turn, until we find one that's available
 		for (int i = 0; encoders[i]; i++) {
 			encoderParams->Codec = avcodec_find_encoder_by_name(encoders[i]);
@@ -157,6 +270,86 @@ char* MakeEncoderParams(const char* codec, int width, int height, AVPixelFormat
 	encoderParams->FPS               = fpsRational;
 	encoderParams->PixelFormatInput  = pixelFormatInput;
 	encoderParams->PixelFormatOutput = pixelFormatOutput;
+	encoderParams->InputWidth        = width;
+	encoderParams->InputHeight       = height;
+	return nullptr;
+}
+
+// Create and open the codec context, for EncoderTypeImageFrames
+static char* OpenImageCodec(Encoder* encoder, EncoderParams* encoderParams, bool globalHeader) {
+	encoder->CodecCtx = avcodec_alloc_context3(encoder->Codec);
+	if (encoder->CodecCtx == nullptr)
+		RETURN_ERROR_STATIC("Failed to allocate codec context");
+	auto ctx       = encoder->CodecCtx;
+	ctx->width     = encoderParams->Width;
+	ctx->height    = encoderParams->Height;
+	ctx->pix_fmt   = encoderParams->PixelFormatOutput;
+	ctx->time_base = encoderParams->Timebase;
+	if (encoderParams->FPS.num != 0)
+		ctx->framerate = encoderParams->FPS;
+	if (encoderParams->Bitrate != 0) {
+		ctx->bit_rate       = encoderParams->Bitrate;
+		ctx->rc_max_rate    = encoderParams->Bitrate;
+		ctx->rc_buffer_size = encoderParams->Bitrate;
+	}
+	if (encoderParams->KeyframeInterval != 0)
+		ctx->gop_size = encoderParams->KeyframeInterval;
+	if (encoderParams->Threads != 0)
+		ctx->thread_count = encoderParams->Threads;
+	if (encoderParams->LowLatency) {
+		ctx->max_b_frames = 0;
+		// These options only exist on libx264 and libx265, so we ignore failure
+		av_opt_set(ctx->priv_data, "preset", "veryfast", 0);
+		av_opt_set(ctx->priv_data, "tune", "zerolatency", 0);
+	}
+	if (globalHeader)
+		ctx->flags |= AV_CODEC_FLAG_GLOBAL_HEADER;
+
+	if (avcodec_open2(ctx, encoder->Codec, nullptr) < 0)
+		RETURN_ERROR_STATIC("avcodec_open2 failed");
+	return nullptr;
+}
+
+// Allocate the frames that are sent to the codec, for EncoderTypeImageFrames
+static char* AllocImageFrames(Encoder* encoder, EncoderParams* encoderParams) {
+	// Allocate output frame buffer (typically YUV420P). This is the frame that is sent to the codec.
+	encoder->OutputFrame = av_frame_alloc();
+	if (encoder->OutputFrame == nullptr)
+		RETURN_ERROR_STATIC("Failed to allocate output frame");
+	encoder->OutputFrame->format = encoder->CodecCtx->pix_fmt;
+	encoder->OutputFrame->width  = encoder->CodecCtx->width;
+	encoder->OutputFrame->height = encoder->CodecCtx->height;
+	//encoder->OutputFrame->format = encoder->OutStream->codecpar->format;
+	//encoder->OutputFrame->width  = encoder->OutStream->codecpar->width;
+	//encoder->OutputFrame->height = encoder->OutStream->codecpar->height;
+	int e = av_frame_get_buffer(encoder->OutputFrame, 0);
+	if (e < 0)
+		RETURN_ERROR_STR(tsf::fmt("av_frame_get_buffer failed: %v", AvErr(e)));
+
+	// If necessary, allocate a 2nd frame buffer for the input (eg RGB24, or a different size)
+	bool scale = encoderParams->InputWidth != encoderParams->Width || encoderParams->InputHeight != encoderParams->Height;
+	if (encoderParams->PixelFormatInput != encoderParams->PixelFormatOutput || scale) {
+		encoder->InputFrame = av_frame_alloc();
+		if (encoder->InputFrame == nullptr)
+			RETURN_ERROR_STATIC("Failed to allocate input frame");
+		// Since we allow RGB24, we should maybe also allow setting
+		// encoder->InputFrame->color_range. For example, it should perhaps be AVCOL_RANGE_JPEG.
+		// We leave it unspecified, and I'm not sure what ffmpeg does in that case.
+		// ChatGPT thinks that RGB24 will by default use full range (aka JPEG range), so this
+		// is probably not a problem for us right now.
+		encoder->InputFrame->format = encoderParams->PixelFormatInput;
+		encoder->InputFrame->width  = encoderParams->InputWidth;
+		encoder->InputFrame->height = encoderParams->InputHeight;
+		e                           = av_frame_get_buffer(encoder->InputFrame, 0);
+		if (e < 0)
+			RETURN_ERROR_STR(tsf::fmt("av_frame_get_buffer failed: %v", AvErr(e)));
+
+		encoder->SwsCtx = sws_getContext(encoderParams->InputWidth, encoderParams->InputHeight, encoderParams->PixelFormatInput,
+		                                 encoderParams->Width, encoderParams->Height, encoderParams->PixelFormatOutput,
+		                                 scale ? SWS_BILINEAR : SWS_POINT, nullptr, nullptr, nullptr);
+		if (encoder->SwsCtx == nullptr)
+			RETURN_ERROR_STATIC("Failed to allocate sws context");
+	}
 	return nullptr;
 }
 
@@ -188,23 +381,22 @@ char* MakeEncoder(const char* format, const char* filename, EncoderParams* encod
 	if (encoder->OutStream == nullptr)
 		RETURN_ERROR_STATIC("Failed to allocate output format stream");
 
+	if (encoderParams->AudioType != AudioEncoderTypeNone) {
+		if (encoderParams->AudioSampleRate <= 0 || encoderParams->AudioChannels <= 0)
+			RETURN_ERROR_STATIC("Invalid audio sample rate or channel count");
+		char* err = AddAudioStream(encoder, encoderParams);
+		if (err != nullptr)
+			return err;
+	}
+
 	if (encoderParams->Type == EncoderTypeImageFrames) {
-		encoder->CodecCtx = avcodec_alloc_context3(encoder->Codec);
-		if (encoder->CodecCtx == nullptr)
-			RETURN_ERROR_STATIC("Failed to allocate codec context");
-		encoder->CodecCtx->width     = encoderParams->Width;
-		encoder->CodecCtx->height    = encoderParams->Height;
-		encoder->CodecCtx->pix_fmt   = encoderParams->PixelFormatOutput;
-		encoder->CodecCtx->time_base = encoderParams->Timebase;
-		if (encoderParams->FPS.num != 0)
-			encoder->CodecCtx->framerate = encoderParams->FPS;
+		char* err = OpenImageCodec(encoder, encoderParams, false);
+		if (err != nullptr)
+			return err;
 
 		//if (avcodec_parameters_from_context(encoder->OutStream->codecpar, encoder->CodecCtx) < 0)
 		//	RETURN_ERROR_STATIC("avcodec_parameters_to_context failed");
 
-		if (avcodec_open2(encoder->CodecCtx, encoder->Codec, nullptr) < 0)
-			RETURN_ERROR_STATIC("avcodec_open2 failed");
-
 		if (avcodec_parameters_from_context(encoder->OutStream->codecpar, encoder->CodecCtx) < 0)
 			RETURN_ERROR_STATIC("avcodec_parameters_from_context failed");
 	} else {
@@ -213,6 +405,11 @@ char* MakeEncoder(const char* format, const char* filename, EncoderParams* encod
 		encoder->OutStream->codecpar->width      = encoderParams->Width;
 		encoder->OutStream->codecpar->height     = encoderParams->Height;
 		encoder->OutStream->codecpar->format     = encoderParams->PixelFormatOutput;
+		if (encoder->Codec->id == AV_CODEC_ID_HEVC && (strcmp(encoder->Format->name, "mp4") == 0 || strcmp(encoder->Format->name, "mov") == 0)) {
+			// The default tag is 'hev1', which Apple players refuse to play. 'hvc1' requires that
+			// the parameter sets are out of band, which the muxer does for us from the first keyframe.
+			encoder->OutStream->codecpar->codec_tag = MKTAG('h', 'v', 'c', '1');
+		}
 		// Setting OutStream->time_base  is just a hint.
 		// When avformat_write_header is called, then OutStream->time_base will likely be changed.
 		// We can also leave it 0/0, and just let the library decide. I'm not sure which method is better.
@@ -232,43 +429,9 @@ char* MakeEncoder(const char* format, const char* filename, EncoderParams* encod
 		RETURN_ERROR_STR(tsf::fmt("avformat_write_header failed: %v", AvErr(e)));
 
 	if (encoderParams->Type == EncoderTypeImageFrames) {
-		// Allocate output frame buffer (typically YUV420P). This is the frame that is sent to the codec.
-		encoder->OutputFrame = av_frame_alloc();
-		if (encoder->OutputFrame == nullptr)
-			RETURN_ERROR_STATIC("Failed to allocate output frame");
-		encoder->OutputFrame->format = encoder->CodecCtx->pix_fmt;
-		encoder->OutputFrame->width  = encoder->CodecCtx->width;
-		encoder->OutputFrame->height = encoder->CodecCtx->height;
-		//encoder->OutputFrame->format = encoder->OutStream->codecpar->format;
-		//encoder->OutputFrame->width  = encoder->OutStream->codecpar->width;
-		//encoder->OutputFrame->height = encoder->OutStream->codecpar->height;
-		e = av_frame_get_buffer(encoder->OutputFrame, 0);
-		if (e < 0)
-			RETURN_ERROR_STR(tsf::fmt("av_frame_get_buffer failed: %v", AvErr(e)));
-
-		// If necessary, allocate a 2nd frame buffer for the input (eg RGB24)
-		if (encoderParams->PixelFormatInput != encoderParams->PixelFormatOutput) {
-			encoder->InputFrame = av_frame_alloc();
-			if (encoder->InputFrame == nullptr)
-				RETURN_ERROR_STATIC("Failed to allocate input frame");
-			// Since we allow RGB24, we should maybe also allow setting
-			// encoder->InputFrame->color_range. For example, it should perhaps be AVCOL_RANGE_JPEG.
-			// We leave it unspecified, and I'm not sure what ffmpeg does in that case.
-			// ChatGPT thinks that RGB24 will by default use full range (aka JPEG range), so this
-			// is probably not a problem for us right now.
-			encoder->InputFrame->format = encoderParams->PixelFormatInput;
-			encoder->InputFrame->width  = encoderParams->Width;
-			encoder->InputFrame->height = encoderParams->Height;
-			e                           = av_frame_get_buffer(encoder->InputFrame, 0);
-			if (e < 0)
-				RETURN_ERROR_STR(tsf::fmt("av_frame_get_buffer failed: %v", AvErr(e)));
-
-			encoder->SwsCtx = sws_getContext(encoderParams->Width, encoderParams->Height, encoderParams->PixelFormatInput,
-			                                 encoderParams->Width, encoderParams->Height, encoderParams->PixelFormatOutput,
-			                                 SWS_POINT, nullptr, nullptr, nullptr);
-			if (encoder->SwsCtx == nullptr)
-				RETURN_ERROR_STATIC("Failed to allocate sws context");
-		}
+		char* err = AllocImageFrames(encoder, encoderParams);
+		if (err != nullptr)
+			return err;
 	}
 
 	encoder->Packet = av_packet_alloc();
@@ -283,6 +446,38 @@ char* MakeEncoder(const char* format, const char* filename, EncoderParams* encod
 	return nullptr;
 }
 
+// Create an encoder that encodes image frames into packets in memory, instead of writing them to a file.
+// Read the packets out with Encoder_NumEncodedPackets and Encoder_GetEncodedPacket.
+// The parameter sets (eg SPS and PPS) are emitted in-band, with every keyframe.
+char* MakeMemoryEncoder(EncoderParams* encoderParams, void** encoderOutput) {
+	if (encoderParams->Type != EncoderTypeImageFrames)
+		RETURN_ERROR_STATIC("A memory encoder can only encode image frames");
+
+	Encoder*       encoder = new Encoder();
+	EncoderCleanup cleanup(encoder);
+	encoder->ToMemory = true;
+
+	encoder->Codec = encoderParams->Codec;
+	if (encoder->Codec == nullptr)
+		RETURN_ERROR_STATIC("Codec is null");
+
+	char* err = OpenImageCodec(encoder, encoderParams, false);
+	if (err != nullptr)
+		return err;
+
+	err = AllocImageFrames(encoder, encoderParams);
+	if (err != nullptr)
+		return err;
+
+	encoder->Packet = av_packet_alloc();
+	if (encoder->Packet == nullptr)
+		RETURN_ERROR_STATIC("Failed to allocate packet");
+
+	cleanup.E      = nullptr; // allow Encoder to survive
+	*encoderOutput = encoder;
+	return nullptr;
+}
+
 void Encoder_Close(void* _encoder) {
 	// when EncoderCleanup goes out of scope, it will clean up
 	EncoderCleanup cleanup((Encoder*) _encoder);
@@ -418,6 +613,73 @@ char* Encoder_WritePacket(void* _encoder, int64_t dtsNano, int64_t ptsNano, int
 	return nullptr;
 }
 
+// For AudioEncoderTypeAACPassthrough, data is a single raw AAC access unit (no ADTS header).
+// For AudioEncoderTypePCM16ToAAC, data is interleaved signed 16-bit samples. In this case we
+// assume that the audio is continuous, so only the PTS of the first call is used.
+// ptsNano is in nanoseconds
+char* Encoder_WriteAudio(void* _encoder, int64_t ptsNano, const void* data, size_t dataLen) {
+	auto encoder = (Encoder*) _encoder;
+	if (encoder->AudioType == AudioEncoderTypeNone)
+		RETURN_ERROR_STATIC("Encoder has no audio stream");
+
+	if (encoder->AudioType == AudioEncoderTypeAACPassthrough) {
+		AVPacket* pkt     = encoder->Packet;
+		pkt->pts          = av_rescale_q(ptsNano, AVRational{1, 1000000000}, encoder->AudioStream->time_base);
+		pkt->dts          = pkt->pts;
+		pkt->stream_index = encoder->AudioStream->index;
+		pkt->flags        = AV_PKT_FLAG_KEY;
+		pkt->data         = (uint8_t*) data;
+		pkt->size         = (int) dataLen;
+		int e             = av_interleaved_write_frame(encoder->OutFormatCtx, pkt);
+		if (e < 0)
+			RETURN_ERROR_STR(tsf::fmt("Failed to write audio packet, len: %v, error: %v", (int) dataLen, AvErr(e)));
+		return nullptr;
+	}
+
+	auto ctx   = encoder->AudioCodecCtx;
+	auto frame = encoder->AudioFrame;
+#if LIBAVCODEC_VERSION_INT >= AV_VERSION_INT(59, 37, 100)
+	int nChannels = ctx->ch_layout.nb_channels;
+#else
+	int nChannels = ctx->channels;
+#endif
+	if (!encoder->AudioStarted) {
+		encoder->AudioNextPTS = av_rescale_q(ptsNano, AVRational{1, 1000000000}, ctx->time_base);
+		encoder->AudioStarted = true;
+	}
+
+	auto samples = (const int16_t*) data;
+	for (size_t i = 0; i < dataLen / 2; i++)
+		encoder->AudioPending.push_back(samples[i] * (1.0f / 32768.0f));
+
+	size_t frameSamples = (size_t) frame->nb_samples * nChannels;
+	size_t consumed     = 0;
+	while (encoder->AudioPending.size() - consumed >= frameSamples) {
+		int e = av_frame_make_writable(frame);
+		if (e < 0)
+			RETURN_ERROR_STR(tsf::fmt("av_frame_make_writable (audio) failed: %v", AvErr(e)));
+		// De-interleave into planar float
+		const float* src = &encoder->AudioPending[consumed];
+		for (int c = 0; c < nChannels; c++) {
+			float* dst = (float*) frame->data[c];
+			for (int i = 0; i < frame->nb_samples; i++)
+				dst[i] = src[i * nChannels + c];
+		}
+		consumed += frameSamples;
+		frame->pts = encoder->AudioNextPTS;
+		encoder->AudioNextPTS += frame->nb_samples;
+
+		e = avcodec_send_frame(ctx, frame);
+		if (e < 0)
+			RETURN_ERROR_STR(tsf::fmt("avcodec_send_frame (audio) failed: %v", AvErr(e)));
+		char* err = WriteBufferedAudioPackets(encoder);
+		if (err != nullptr)
+			return err;
+	}
+	encoder->AudioPending.erase(encoder->AudioPending.begin(), encoder->AudioPending.begin() + consumed);
+	return nullptr;
+}
+
 char* Encoder_MakeFrameWriteable(void* _encoder, AVFrame** _frame) {
 	Encoder* encoder = (Encoder*) _encoder;
 	AVFrame* frame   = encoder->InputFrame != nullptr ? encoder->InputFrame : encoder->OutputFrame;
@@ -443,6 +705,17 @@ char* WriteBufferedPackets(Encoder* encoder) {
 		// further adjustment here.
 		//av_packet_rescale_ts(encoder->Packet, encoder->CodecCtx->time_base, encoder->OutStream->time_base);
 
+		if (encoder->ToMemory) {
+			auto pkt = encoder->Packet;
+			encoder->Encoded.push_back({
+			    std::string((const char*) pkt->data, pkt->size),
+			    av_rescale_q(pkt->pts, encoder->CodecCtx->time_base, AVRational{1, 1000000000}),
+			    !!(pkt->flags & AV_PKT_FLAG_KEY),
+			});
+			av_packet_unref(pkt);
+			continue;
+		}
+
 		encoder->Packet->stream_index = encoder->OutStream->index;
 		e                             = av_interleaved_write_frame(encoder->OutFormatCtx, encoder->Packet);
 		av_packet_unref(encoder->Packet);
@@ -465,7 +738,8 @@ char* Encoder_WriteFrame(void* _encoder, int64_t ptsNano) {
 		          encoder->OutputFrame->data, encoder->OutputFrame->linesize);
 	}
 
-	encoder->OutputFrame->pts = av_rescale_q(ptsNano, AVRational{1, 1000000000}, encoder->OutStream->time_base);
+	AVRational timeBase       = encoder->ToMemory ? encoder->CodecCtx->time_base : encoder->OutStream->time_base;
+	encoder->OutputFrame->pts = av_rescale_q(ptsNano, AVRational{1, 1000000000}, timeBase);
 
 	// Do the actual codec magic
 	int e = avcodec_send_frame(encoder->CodecCtx, encoder->OutputFrame);
@@ -491,12 +765,45 @@ char* Encoder_WriteTrailer(void* _encoder) {
 			return err;
 	}
 
+	if (encoder->AudioCodecCtx != nullptr && encoder->AudioStarted) {
+		// Flush the audio encoder. Samples that don't fill a whole frame are dropped.
+		int e = avcodec_send_frame(encoder->AudioCodecCtx, nullptr);
+		if (e < 0)
+			RETURN_ERROR_STR(tsf::fmt("avcodec_send_frame (audio flush) failed: %v", AvErr(e)));
+		char* err = WriteBufferedAudioPackets(encoder);
+		if (err != nullptr)
+			return err;
+	}
+
+	if (encoder->ToMemory)
+		return nullptr;
+
 	int e = av_write_trailer(encoder->OutFormatCtx);
 	if (e < 0)
 		RETURN_ERROR_STR(tsf::fmt("av_write_trailer failed: %v", AvErr(e)));
 	return nullptr;
 }
 
+int Encoder_NumEncodedPackets(void* _encoder) {
+	Encoder* encoder = (Encoder*) _encoder;
+	return (int) encoder->Encoded.size();
+}
+
+// The returned data pointer is valid until Encoder_ClearEncodedPackets is called
+void Encoder_GetEncodedPacket(void* _encoder, int i, const void** data, size_t* dataLen, int64_t* ptsNano, int* isKeyFrame) {
+	Encoder* encoder = (Encoder*) _encoder;
+	auto&    p       = encoder->Encoded[i];
+	*data            = p.Data.data();
+	*dataLen         = p.Data.size();
+	*ptsNano         = p.PTSNano;
+	*isKeyFrame      = p.IsKeyFrame ? 1 : 0;
+}
+
+void Encoder_ClearEncodedPackets(void* _encoder) {
+	Encoder* encoder = (Encoder*) _encoder;
+	encoder->Encoded.clear();
+}
+
 void SetPacketDataPointer(void* _pkt, const void* buf, size_t bufLen) {
 	tsf::print("SetPacketDataPointer %v %v %v\n", _pkt, buf, bufLen);
 	AVPacket* pkt = (AVPacket*) _pkt;
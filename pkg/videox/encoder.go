@@ -7,8 +7,11 @@ package videox
 // #include <stdint.h>
 import "C"
 import (
+	"fmt"
 	"time"
 	"unsafe"
+
+	"github.com/cyclopcam/cyclops/pkg/accel"
 )
 
 // Export some of the ffmpeg C pixel formats to Go
@@ -36,14 +39,45 @@ const (
 	VideoEncoderTypeImageFrames VideoEncoderType = C.EncoderTypeImageFrames // Sending image frames to the encoder
 )
 
+// EncoderAudioParams describes an optional audio stream that is muxed alongside the video.
+// AAC is muxed as-is. G.711 is transcoded to AAC, because MP4 can't carry G.711.
+type EncoderAudioParams struct {
+	Codec      AudioCodec
+	SampleRate int
+	Channels   int
+	AACConfig  []byte // AudioSpecificConfig. Only needed for AAC.
+}
+
+// MemoryEncoderParams configures an encoder created by NewVideoMemoryEncoder
+type MemoryEncoderParams struct {
+	Codec            Codec
+	InputWidth       int // Size of the images given to WriteImage
+	InputHeight      int //
+	Width            int // Size of the encoded video. If different to the input, then images are scaled.
+	Height           int //
+	PixelFormatIn    AVPixelFormat
+	FPS              int
+	Bitrate          int // Target bits per second. 0 = codec default.
+	KeyframeInterval int // Number of frames between keyframes. 0 = codec default.
+	Threads          int // Number of codec threads. 0 = ffmpeg default.
+}
+
 type VideoEncoder struct {
 	enc              unsafe.Pointer
 	InputPixelFormat AVPixelFormat
+	audioCodec       AudioCodec
+	codec            Codec // Only populated for memory encoders
 }
 
 // NewVideoEncoder creates a new video encoder
 // You must Close() a video encoder when you are done using it, otherwise you will leak ffmpeg objects
 func NewVideoEncoder(codec, format, filename string, width, height int, pixelFormatIn, pixelFormatOut AVPixelFormat, encoderType VideoEncoderType, fps int) (*VideoEncoder, error) {
+	return NewVideoEncoderWithAudio(codec, format, filename, width, height, pixelFormatIn, pixelFormatOut, encoderType, fps, nil)
+}
+
+// NewVideoEncoderWithAudio is NewVideoEncoder, plus an audio stream.
+// If audio is nil, then the file has no audio stream.
+func NewVideoEncoderWithAudio(codec, format, filename string, width, height int, pixelFormatIn, pixelFormatOut AVPixelFormat, encoderType VideoEncoderType, fps int, audio *EncoderAudioParams) (*VideoEncoder, error) {
 	// Populate EncoderParams
 	cCodec := C.CString(codec)
 	var params C.EncoderParams
@@ -53,6 +87,27 @@ func NewVideoEncoder(codec, format, filename string, width, height int, pixelFor
 		return nil, err
 	}
 
+	audioCodec := AudioCodecUnknown
+	if audio != nil {
+		audioCodec = audio.Codec
+		params.AudioSampleRate = C.int(audio.SampleRate)
+		params.AudioChannels = C.int(audio.Channels)
+		switch {
+		case audio.Codec == AudioCodecAAC:
+			if len(audio.AACConfig) == 0 {
+				return nil, fmt.Errorf("AAC audio needs an AudioSpecificConfig")
+			}
+			params.AudioType = C.AudioEncoderTypeAACPassthrough
+			params.AudioExtradata = C.CBytes(audio.AACConfig)
+			params.AudioExtradataLen = C.int(len(audio.AACConfig))
+			defer C.free(params.AudioExtradata)
+		case audio.Codec.IsG711():
+			params.AudioType = C.AudioEncoderTypePCM16ToAAC
+		default:
+			return nil, fmt.Errorf("Unsupported audio codec %v", audio.Codec)
+		}
+	}
+
 	cFormat := C.CString(format)
 	cFilename := C.CString(filename)
 	var encoder unsafe.Pointer
@@ -65,6 +120,37 @@ func NewVideoEncoder(codec, format, filename string, width, height int, pixelFor
 	return &VideoEncoder{
 		enc:              encoder,
 		InputPixelFormat: pixelFormatIn,
+		audioCodec:       audioCodec,
+	}, nil
+}
+
+// NewVideoMemoryEncoder creates an encoder that encodes images into packets in memory,
+// which you read out with ReadPackets. The encoder has no B-frames, and is tuned for
+// live streaming. The parameter sets (eg SPS and PPS) are sent with every keyframe.
+// You must Close() the encoder when you are done using it.
+func NewVideoMemoryEncoder(p MemoryEncoderParams) (*VideoEncoder, error) {
+	cCodec := C.CString(p.Codec.InternalName())
+	var params C.EncoderParams
+	err := takeCError(C.MakeEncoderParams(cCodec, C.int(p.Width), C.int(p.Height), C.enum_AVPixelFormat(p.PixelFormatIn), C.enum_AVPixelFormat(AVPixelFormatYUV420P), C.EncoderTypeImageFrames, C.int(p.FPS), &params))
+	C.free(unsafe.Pointer(cCodec))
+	if err != nil {
+		return nil, err
+	}
+	params.InputWidth = C.int(p.InputWidth)
+	params.InputHeight = C.int(p.InputHeight)
+	params.Bitrate = C.int(p.Bitrate)
+	params.KeyframeInterval = C.int(p.KeyframeInterval)
+	params.Threads = C.int(p.Threads)
+	params.LowLatency = 1
+
+	var encoder unsafe.Pointer
+	if err := takeCError(C.MakeMemoryEncoder(&params, &encoder)); err != nil {
+		return nil, err
+	}
+	return &VideoEncoder{
+		enc:              encoder,
+		InputPixelFormat: p.PixelFormatIn,
+		codec:            p.Codec,
 	}, nil
 }
 
@@ -96,6 +182,32 @@ func (v *VideoEncoder) WritePacket(dts, pts time.Duration, packet *VideoPacket)
 	return takeCError(C.Encoder_WritePacket(v.enc, idts, ipts, isKeyFrame, unsafe.Pointer(&encoded[0]), C.ulong(len(encoded))))
 }
 
+// Write an audio packet to the audio stream.
+// The packet must have the same codec that was given to NewVideoEncoderWithAudio.
+func (v *VideoEncoder) WriteAudio(pts time.Duration, packet *AudioPacket) error {
+	if packet.Codec != v.audioCodec {
+		return fmt.Errorf("Audio packet codec %v does not match encoder (%v)", packet.Codec, v.audioCodec)
+	}
+	var data []byte
+	if packet.Codec == AudioCodecAAC {
+		_, au, err := AACSplitADTS(packet.Payload)
+		if err != nil {
+			return err
+		}
+		data = au
+	} else {
+		pcm, err := DecodeG711(packet.Codec, packet.Payload)
+		if err != nil {
+			return err
+		}
+		data = unsafe.Slice((*byte)(unsafe.Pointer(unsafe.SliceData(pcm))), len(pcm)*2)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	return takeCError(C.Encoder_WriteAudio(v.enc, C.int64_t(pts.Nanoseconds()), unsafe.Pointer(&data[0]), C.ulong(len(data))))
+}
+
 // Write an RGB (single plane) or YUV (3 planes) image to the encoder
 func (v *VideoEncoder) WriteImage(pts time.Duration, data [][]uint8, stride []int) error {
 	var frame *C.AVFrame
@@ -109,6 +221,34 @@ func (v *VideoEncoder) WriteImage(pts time.Duration, data [][]uint8, stride []in
 	return takeCError(C.Encoder_WriteFrame(v.enc, C.int64_t(pts.Nanoseconds())))
 }
 
+// Write a YUV image to the encoder
+func (v *VideoEncoder) WriteYUVImage(pts time.Duration, img *accel.YUVImage) error {
+	return v.WriteImage(pts, [][]uint8{img.Y, img.U, img.V}, []int{img.YStride(), img.UStride(), img.VStride()})
+}
+
+// Return the packets that have been encoded since the last call to ReadPackets.
+// This is only valid for an encoder created with NewVideoMemoryEncoder.
+// The PTS of each packet is the pts that was given to WriteImage, and WallPTS is not populated.
+func (v *VideoEncoder) ReadPackets() []*VideoPacket {
+	n := int(C.Encoder_NumEncodedPackets(v.enc))
+	packets := make([]*VideoPacket, 0, n)
+	for i := 0; i < n; i++ {
+		var data unsafe.Pointer
+		var dataLen C.size_t
+		var ptsNano C.int64_t
+		var isKeyFrame C.int // Our NALU parsing detects keyframes, so we don't need this
+		C.Encoder_GetEncodedPacket(v.enc, C.int(i), &data, &dataLen, &ptsNano, &isKeyFrame)
+		encoded := C.GoBytes(data, C.int(dataLen))
+		packets = append(packets, &VideoPacket{
+			Codec: v.codec,
+			PTS:   time.Duration(ptsNano),
+			NALUs: SplitAnnexBPacket(encoded),
+		})
+	}
+	C.Encoder_ClearEncodedPackets(v.enc)
+	return packets
+}
+
 func (v *VideoEncoder) WriteTrailer() error {
 	return takeCError(C.Encoder_WriteTrailer(v.enc))
 }
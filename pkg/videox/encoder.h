@@ -12,6 +12,12 @@ enum EncoderType {
 	EncoderTypeImageFrames, // Sending image frames to the encoder
 };
 
+enum AudioEncoderType {
+	AudioEncoderTypeNone,           // No audio stream
+	AudioEncoderTypeAACPassthrough, // Sending raw AAC access units, which are muxed as-is
+	AudioEncoderTypePCM16ToAAC,     // Sending interleaved 16-bit PCM, which we encode to AAC
+};
+
 typedef struct EncoderParams {
 #if LIBAVCODEC_VERSION_MAJOR < 59
 	AVCodec* Codec;
@@ -25,16 +31,36 @@ typedef struct EncoderParams {
 	AVRational         FPS;
 	enum AVPixelFormat PixelFormatOutput;
 	enum AVPixelFormat PixelFormatInput;
+
+	// Only used by EncoderTypeImageFrames
+	int InputWidth;       // Size of the images given to Encoder_WriteFrame. If different to Width/Height, we scale.
+	int InputHeight;      //
+	int Bitrate;          // Target bits per second. 0 = codec default.
+	int KeyframeInterval; // Number of frames between keyframes. 0 = codec default.
+	int LowLatency;       // If non-zero, then disable B-frames, and tune the codec for live streaming.
+	int Threads;          // Number of codec threads. 0 = ffmpeg default.
+
+	// Optional audio stream
+	enum AudioEncoderType AudioType;
+	int                   AudioSampleRate;
+	int                   AudioChannels;
+	const void*           AudioExtradata; // AudioSpecificConfig, for AudioEncoderTypeAACPassthrough
+	int                   AudioExtradataLen;
 } EncoderParams;
 
 char* MakeEncoderParams(const char* codec, int width, int height, enum AVPixelFormat pixelFormatInput, enum AVPixelFormat pixelFormatOutput, enum EncoderType encoderType, int fps, EncoderParams* encoderParams);
 char* MakeEncoder(const char* format, const char* filename, EncoderParams* encoderParams, void** encoderOutput);
+char* MakeMemoryEncoder(EncoderParams* encoderParams, void** encoderOutput);
 void  Encoder_Close(void* encoder);
 char* Encoder_WriteNALU(void* encoder, int64_t dtsNano, int64_t ptsNano, int naluPrefixLen, const void* nalu, size_t naluLen);
 char* Encoder_WritePacket(void* encoder, int64_t dtsNano, int64_t ptsNano, int isKeyFrame, const void* packetData, size_t packetLen);
+char* Encoder_WriteAudio(void* encoder, int64_t ptsNano, const void* data, size_t dataLen);
 char* Encoder_MakeFrameWriteable(void* encoder, AVFrame** frame);
 char* Encoder_WriteFrame(void* encoder, int64_t ptsNano);
 char* Encoder_WriteTrailer(void* encoder);
+int   Encoder_NumEncodedPackets(void* encoder);
+void  Encoder_GetEncodedPacket(void* encoder, int i, const void** data, size_t* dataLen, int64_t* ptsNano, int* isKeyFrame);
+void  Encoder_ClearEncodedPackets(void* encoder);
 void  SetPacketDataPointer(void* pkt, const void* buf, size_t bufLen);
 char* GetAvErrorStr(int averr);
 
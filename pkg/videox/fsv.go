@@ -29,6 +29,32 @@ func ParseFsvCodec(codec string) (Codec, error) {
 	}
 }
 
+func AudioCodecToFsv(codec AudioCodec) string {
+	switch codec {
+	case AudioCodecAAC:
+		return rf1.CodecAAC
+	case AudioCodecPCMA:
+		return rf1.CodecPCMA
+	case AudioCodecPCMU:
+		return rf1.CodecPCMU
+	default:
+		panic("Invalid audio codec")
+	}
+}
+
+func ParseFsvAudioCodec(codec string) (AudioCodec, error) {
+	switch codec {
+	case rf1.CodecAAC:
+		return AudioCodecAAC, nil
+	case rf1.CodecPCMA:
+		return AudioCodecPCMA, nil
+	case rf1.CodecPCMU:
+		return AudioCodecPCMU, nil
+	default:
+		return AudioCodecUnknown, fmt.Errorf("Unknown audio codec: %v", codec)
+	}
+}
+
 // Convert FSV packets to our VideoPacket format
 func ExtractFsvPackets(fsvCodec string, input []fsv.NALU) (*PacketBuffer, error) {
 	codec, err := ParseFsvCodec(fsvCodec)
@@ -66,3 +92,24 @@ func ExtractFsvPackets(fsvCodec string, input []fsv.NALU) (*PacketBuffer, error)
 
 	return &pb, nil
 }
+
+// Convert FSV audio packets to our AudioPacket format.
+// PTS is relative to the first packet, the same as ExtractFsvPackets.
+func ExtractFsvAudioPackets(track *fsv.TrackReadResult) ([]*AudioPacket, error) {
+	codec, err := ParseFsvAudioCodec(track.Codec)
+	if err != nil {
+		return nil, err
+	}
+	packets := make([]*AudioPacket, 0, len(track.NALS))
+	for _, p := range track.NALS {
+		packets = append(packets, &AudioPacket{
+			Codec:      codec,
+			SampleRate: track.SampleRate,
+			Channels:   track.Channels,
+			PTS:        p.PTS.Sub(track.NALS[0].PTS),
+			WallPTS:    p.PTS,
+			Payload:    p.Payload,
+		})
+	}
+	return packets, nil
+}
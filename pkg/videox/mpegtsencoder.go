@@ -3,49 +3,80 @@ package videox
 import (
 	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"time"
 
 	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
 	"github.com/cyclopcam/cyclops/pkg/gen"
 	"github.com/cyclopcam/logs"
 
 	"github.com/asticode/go-astits"
 )
 
-// MPGTSEncoder allows to encode H264 NALUs into MPEG-TS.
+// PIDs of our elementary streams
+const (
+	mpegtsVideoPID = 256
+	mpegtsAudioPID = 257
+)
+
+// The H.264 and H.265 DTS extractors have the same interface
+type dtsExtractor interface {
+	Extract(au [][]byte, pts time.Duration) (time.Duration, error)
+}
+
+// MPGTSEncoder allows to encode H264 or H265 NALUs, and optionally AAC audio, into MPEG-TS.
 type MPGTSEncoder struct {
-	sps []byte
-	pps []byte
+	codec Codec
+	vps   []byte // Only used by H265
+	sps   []byte
+	pps   []byte
 
 	log logs.Log
 	//f                *os.File
 	b                *bufio.Writer
 	mux              *astits.Muxer
-	dtsExtractor     *h264.DTSExtractor
+	dtsExtractor     dtsExtractor
 	firstIDRReceived bool
 	startDTS         time.Duration
+	hasAudio         bool
 }
 
 // NewMPEGTSEncoder allocates a mpegtsEncoder.
-func NewMPEGTSEncoder(log logs.Log, output io.Writer, sps []byte, pps []byte) (*MPGTSEncoder, error) {
+// vps is only used by H265, and may be nil for H264.
+// The parameter sets are RBSP payloads (no start codes), and are injected before every keyframe.
+func NewMPEGTSEncoder(log logs.Log, output io.Writer, codec Codec, vps, sps, pps []byte) (*MPGTSEncoder, error) {
 	//f, err := os.Create(filename)
 	//if err != nil {
 	//	return nil, err
 	//}
+	var streamType astits.StreamType
+	switch codec {
+	case CodecH264:
+		streamType = astits.StreamTypeH264Video
+	case CodecH265:
+		streamType = astits.StreamTypeH265Video
+	default:
+		return nil, fmt.Errorf("Unsupported codec %v", codec)
+	}
+
 	b := bufio.NewWriter(output)
 
 	mux := astits.NewMuxer(context.Background(), b)
 	mux.AddElementaryStream(astits.PMTElementaryStream{
-		ElementaryPID: 256,
-		StreamType:    astits.StreamTypeH264Video,
+		ElementaryPID: mpegtsVideoPID,
+		StreamType:    streamType,
 	})
-	mux.SetPCRPID(256)
+	mux.SetPCRPID(mpegtsVideoPID)
 
 	return &MPGTSEncoder{
-		log: log,
-		sps: gen.CopySlice(sps),
-		pps: gen.CopySlice(pps),
+		log:   log,
+		codec: codec,
+		vps:   gen.CopySlice(vps),
+		sps:   gen.CopySlice(sps),
+		pps:   gen.CopySlice(pps),
 		//f:   f,
 		b:   b,
 		mux: mux,
@@ -58,47 +89,29 @@ func (e *MPGTSEncoder) Close() error {
 	//e.f.Close()
 }
 
-// encode encodes H264 NALUs into MPEG-TS.
-func (e *MPGTSEncoder) Encode(nalus []NALU, pts time.Duration) error {
-	// prepend an AUD. This is required by some players
-	filteredNALUs := [][]byte{
-		{byte(h264.NALUTypeAccessUnitDelimiter), 240},
-	}
-
-	nonIDRPresent := false
-	idrPresent := false
-
-	for _, nalu := range nalus {
-		payload := nalu.AsRBSP().Payload
-		typ := h264.NALUType(payload[0] & 0x1F)
-		switch typ {
-		case h264.NALUTypeSPS:
-			e.sps = append([]byte(nil), payload...)
-			continue
-
-		case h264.NALUTypePPS:
-			e.pps = append([]byte(nil), payload...)
-			continue
-
-		case h264.NALUTypeAccessUnitDelimiter:
-			continue
-
-		case h264.NALUTypeIDR:
-			idrPresent = true
-
-			// add SPS and PPS before every IDR
-			if e.sps != nil && e.pps != nil {
-				filteredNALUs = append(filteredNALUs, e.sps, e.pps)
-			}
+// Write any buffered output to the underlying writer
+func (e *MPGTSEncoder) Flush() error {
+	return e.b.Flush()
+}
 
-		case h264.NALUTypeNonIDR:
-			nonIDRPresent = true
-		}
+// Write the PAT and PMT. Every HLS segment must begin with these, so that a player
+// can start decoding at any segment.
+func (e *MPGTSEncoder) WriteTables() error {
+	_, err := e.mux.WriteTables()
+	return err
+}
 
-		filteredNALUs = append(filteredNALUs, payload)
+// encode encodes H264 or H265 NALUs into MPEG-TS.
+func (e *MPGTSEncoder) Encode(nalus []NALU, pts time.Duration) error {
+	var filteredNALUs [][]byte
+	var idrPresent, visualPresent bool
+	if e.codec == CodecH265 {
+		filteredNALUs, idrPresent, visualPresent = e.filterH265(nalus)
+	} else {
+		filteredNALUs, idrPresent, visualPresent = e.filterH264(nalus)
 	}
 
-	if !nonIDRPresent && !idrPresent {
+	if !visualPresent {
 		return nil
 	}
 
@@ -111,7 +124,11 @@ func (e *MPGTSEncoder) Encode(nalus []NALU, pts time.Duration) error {
 		}
 
 		e.firstIDRReceived = true
-		e.dtsExtractor = h264.NewDTSExtractor()
+		if e.codec == CodecH265 {
+			e.dtsExtractor = h265.NewDTSExtractor()
+		} else {
+			e.dtsExtractor = h264.NewDTSExtractor()
+		}
 
 		var err error
 		dts, err = e.dtsExtractor.Extract(filteredNALUs, pts)
@@ -155,7 +172,7 @@ func (e *MPGTSEncoder) Encode(nalus []NALU, pts time.Duration) error {
 
 	// write TS packet
 	_, err = e.mux.WriteData(&astits.MuxerData{
-		PID: 256,
+		PID: mpegtsVideoPID,
 		AdaptationField: &astits.PacketAdaptationField{
 			RandomAccessIndicator: idrPresent,
 		},
@@ -174,3 +191,131 @@ func (e *MPGTSEncoder) Encode(nalus []NALU, pts time.Duration) error {
 	//e.log.Infof("Wrote TS packet (%v data bytes)", len(annexb))
 	return nil
 }
+
+// Strip parameter sets and AUDs from an H264 access unit, and re-insert the
+// parameter sets before every IDR. Returns the NALUs in RBSP format.
+func (e *MPGTSEncoder) filterH264(nalus []NALU) (filtered [][]byte, idrPresent, visualPresent bool) {
+	// prepend an AUD. This is required by some players
+	filtered = [][]byte{
+		{byte(h264.NALUTypeAccessUnitDelimiter), 240},
+	}
+
+	for _, nalu := range nalus {
+		payload := nalu.AsRBSP().Payload
+		typ := h264.NALUType(payload[0] & 0x1F)
+		switch typ {
+		case h264.NALUTypeSPS:
+			e.sps = append([]byte(nil), payload...)
+			continue
+
+		case h264.NALUTypePPS:
+			e.pps = append([]byte(nil), payload...)
+			continue
+
+		case h264.NALUTypeAccessUnitDelimiter:
+			continue
+
+		case h264.NALUTypeIDR:
+			idrPresent = true
+			visualPresent = true
+
+			// add SPS and PPS before every IDR
+			if e.sps != nil && e.pps != nil {
+				filtered = append(filtered, e.sps, e.pps)
+			}
+
+		case h264.NALUTypeNonIDR:
+			visualPresent = true
+		}
+
+		filtered = append(filtered, payload)
+	}
+	return
+}
+
+// Same as filterH264, but for H265, which also has a VPS.
+// CRA frames count as keyframes, because that's what the DTS extractor expects.
+func (e *MPGTSEncoder) filterH265(nalus []NALU) (filtered [][]byte, idrPresent, visualPresent bool) {
+	// prepend an AUD (type 35, layer 0, temporal ID 1, pic_type 2 = any slice type)
+	filtered = [][]byte{
+		{byte(h265.NALUType_AUD_NUT) << 1, 1, 0x50},
+	}
+
+	for _, nalu := range nalus {
+		payload := nalu.AsRBSP().Payload
+		typ := h265.NALUType((payload[0] >> 1) & 0x3f)
+		switch typ {
+		case h265.NALUType_VPS_NUT:
+			e.vps = append([]byte(nil), payload...)
+			continue
+
+		case h265.NALUType_SPS_NUT:
+			e.sps = append([]byte(nil), payload...)
+			continue
+
+		case h265.NALUType_PPS_NUT:
+			e.pps = append([]byte(nil), payload...)
+			continue
+
+		case h265.NALUType_AUD_NUT:
+			continue
+
+		case h265.NALUType_IDR_W_RADL, h265.NALUType_IDR_N_LP, h265.NALUType_CRA_NUT:
+			if !idrPresent && e.vps != nil && e.sps != nil && e.pps != nil {
+				// add VPS, SPS and PPS before every keyframe (but only once per access unit,
+				// because some cameras send multiple slices per frame)
+				filtered = append(filtered, e.vps, e.sps, e.pps)
+			}
+			idrPresent = true
+			visualPresent = true
+
+		default:
+			if H265ToAbstractType(payload[0]) == AbstractNALUTypeNonIDR {
+				visualPresent = true
+			}
+		}
+
+		filtered = append(filtered, payload)
+	}
+	return
+}
+
+// Add an AAC audio stream. This must be called before the first call to Encode.
+func (e *MPGTSEncoder) AddAACStream() {
+	e.mux.AddElementaryStream(astits.PMTElementaryStream{
+		ElementaryPID: mpegtsAudioPID,
+		StreamType:    astits.StreamTypeAACAudio,
+	})
+	e.hasAudio = true
+}
+
+// Encode a single ADTS frame. pts is on the same clock as the pts given to Encode.
+// Audio that arrives before the first IDR is dropped, because we don't know the start time yet.
+func (e *MPGTSEncoder) EncodeAudio(adts []byte, pts time.Duration) error {
+	if !e.hasAudio {
+		return errors.New("No audio stream. Call AddAACStream first")
+	}
+	if !e.firstIDRReceived || pts < e.startDTS {
+		return nil
+	}
+	pts -= e.startDTS
+
+	_, err := e.mux.WriteData(&astits.MuxerData{
+		PID: mpegtsAudioPID,
+		AdaptationField: &astits.PacketAdaptationField{
+			RandomAccessIndicator: true,
+		},
+		PES: &astits.PESData{
+			Header: &astits.PESHeader{
+				OptionalHeader: &astits.PESOptionalHeader{
+					MarkerBits:      2,
+					PTSDTSIndicator: astits.PTSDTSIndicatorOnlyPTS,
+					PTS:             &astits.ClockReference{Base: int64(pts.Seconds() * 90000)},
+				},
+				StreamID: 192, // audio
+			},
+			Data: adts,
+		},
+	})
+	return err
+}
@@ -23,6 +23,13 @@ var ErrNoSPS = errors.New("No SPS NALU found")
 // PacketBuffer is a list of packets, with some helper functions
 type PacketBuffer struct {
 	Packets []*VideoPacket
+	Audio   []*AudioPacket // Optional audio that accompanies the video, in order of PTS
+}
+
+// Returns the time of the audio packet on the same clock as the video packet PTS.
+// Audio and video come from different RTP streams, so we align them using WallPTS.
+func (r *PacketBuffer) audioPTS(a *AudioPacket) time.Duration {
+	return r.Packets[0].PTS + a.WallPTS.Sub(r.Packets[0].WallPTS)
 }
 
 func (r *PacketBuffer) Codec() Codec {
@@ -66,20 +73,24 @@ func (r *PacketBuffer) FindClosestPacketWallPTS(wallPTS time.Time, keyframeOnly
 
 // Extract saved buffer into an MPEGTS stream
 func (r *PacketBuffer) SaveToMPEGTS(log logs.Log, output io.Writer) error {
-	if r.Codec() != CodecH264 {
-		return fmt.Errorf("Cannot save to MPEG-TS: codec is not H264")
-	}
-	sps := r.FirstNALUOfType264(h264.NALUTypeSPS)
-	pps := r.FirstNALUOfType264(h264.NALUTypePPS)
-	if sps == nil || pps == nil {
-		return fmt.Errorf("Stream has no SPS or PPS")
+	vps, sps, pps, err := r.ParameterSets()
+	if err != nil {
+		return err
 	}
-	encoder, err := NewMPEGTSEncoder(log, output, sps.AsRBSP().Payload, pps.AsRBSP().Payload)
+	encoder, err := NewMPEGTSEncoder(log, output, r.Codec(), vps, sps, pps)
 	if err != nil {
 		return fmt.Errorf("Failed to start MPEGTS encoder: %w", err)
 	}
 	defer encoder.Close()
 
+	// MPEG-TS can carry AAC directly. G.711 would need to be transcoded, so we drop it.
+	audio := r.Audio
+	if len(audio) != 0 && audio[0].Codec == AudioCodecAAC {
+		encoder.AddAACStream()
+	} else {
+		audio = nil
+	}
+
 	// We don't actually need to drain the buffer - we could make
 	// ringbuffer.Peek a public function, and use that to suck data
 	// out of the buffer without consuming it. It doesn't really make
@@ -92,7 +103,13 @@ func (r *PacketBuffer) SaveToMPEGTS(log logs.Log, output io.Writer) error {
 	// ensure that incoming packets don't overwrite the old frames that
 	// we haven't yet written out.
 	for _, packet := range r.Packets {
-		// encode H264 NALUs into MPEG-TS
+		for len(audio) != 0 && r.audioPTS(audio[0]) <= packet.PTS {
+			if err := encoder.EncodeAudio(audio[0].Payload, r.audioPTS(audio[0])); err != nil {
+				return err
+			}
+			audio = audio[1:]
+		}
+		// encode H264/H265 NALUs into MPEG-TS
 		log.Infof("MPGTS encode packet PTS:%v", packet.PTS)
 		err := encoder.Encode(packet.NALUs, packet.PTS)
 		if err != nil {
@@ -124,6 +141,29 @@ func (r *PacketBuffer) DecodeHeader() (width, height int, err error) {
 	return 0, 0, fmt.Errorf("Codec not supported")
 }
 
+// Returns the first parameter sets in the buffer, as RBSP payloads.
+// vps is only populated for H265.
+func (r *PacketBuffer) ParameterSets() (vps, sps, pps []byte, err error) {
+	switch r.Codec() {
+	case CodecH264:
+		spsNALU := r.FirstNALUOfType264(h264.NALUTypeSPS)
+		ppsNALU := r.FirstNALUOfType264(h264.NALUTypePPS)
+		if spsNALU == nil || ppsNALU == nil {
+			return nil, nil, nil, fmt.Errorf("Stream has no SPS or PPS")
+		}
+		return nil, spsNALU.AsRBSP().Payload, ppsNALU.AsRBSP().Payload, nil
+	case CodecH265:
+		vpsNALU := r.FirstNALUOfType265(h265.NALUType_VPS_NUT)
+		spsNALU := r.FirstNALUOfType265(h265.NALUType_SPS_NUT)
+		ppsNALU := r.FirstNALUOfType265(h265.NALUType_PPS_NUT)
+		if vpsNALU == nil || spsNALU == nil || ppsNALU == nil {
+			return nil, nil, nil, fmt.Errorf("Stream has no VPS, SPS or PPS")
+		}
+		return vpsNALU.AsRBSP().Payload, spsNALU.AsRBSP().Payload, ppsNALU.AsRBSP().Payload, nil
+	}
+	return nil, nil, nil, fmt.Errorf("Codec %v not supported", r.Codec())
+}
+
 // Returns the first NALU of the given type, or nil if none found
 func (r *PacketBuffer) FirstNALUOfType264(ofType h264.NALUType) *NALU {
 	for _, packet := range r.Packets {
@@ -158,8 +198,8 @@ func (r *PacketBuffer) FindFirstPacketOfType(ofType AbstractNALUType) int {
 }
 
 func (r *PacketBuffer) SaveToMP4(filename string) error {
-	if r.Codec() != CodecH264 {
-		return fmt.Errorf("Cannot save to MP4: codec is not H264")
+	if r.Codec() != CodecH264 && r.Codec() != CodecH265 {
+		return fmt.Errorf("Cannot save to MP4: codec %v is not supported", r.Codec())
 	}
 	width, height, err := r.DecodeHeader()
 	if err != nil {
@@ -168,6 +208,9 @@ func (r *PacketBuffer) SaveToMP4(filename string) error {
 
 	// Assume the first IDR packet also has SPS, PPS, and VPS. This has so far been true on my HikVision cameras.
 	firstPacket := r.FindFirstPacketOfType(AbstractNALUTypeIDR)
+	if firstPacket == -1 {
+		return errors.New("No keyframe found")
+	}
 	/*
 
 		firstSPS := r.FirstNALUOfType264(h264.NALUTypeSPS)
@@ -202,13 +245,45 @@ func (r *PacketBuffer) SaveToMP4(filename string) error {
 
 	baseTime := r.Packets[firstPacket].PTS
 
-	enc, err := NewVideoEncoder(r.Codec().ToFFmpeg(), "mp4", filename, width, height, AVPixelFormatYUV420P, AVPixelFormatYUV420P, VideoEncoderTypePackets, 0)
+	// Audio that precedes the first keyframe is dropped
+	audio := r.Audio
+	for len(audio) != 0 && r.audioPTS(audio[0]) < baseTime {
+		audio = audio[1:]
+	}
+	var audioParams *EncoderAudioParams
+	if len(audio) != 0 {
+		audioParams = &EncoderAudioParams{
+			Codec:      audio[0].Codec,
+			SampleRate: audio[0].SampleRate,
+			Channels:   audio[0].Channels,
+		}
+		if audio[0].Codec == AudioCodecAAC {
+			if audioParams.AACConfig, _, err = AACSplitADTS(audio[0].Payload); err != nil {
+				return err
+			}
+		}
+	}
+
+	enc, err := NewVideoEncoderWithAudio(r.Codec().ToFFmpeg(), "mp4", filename, width, height, AVPixelFormatYUV420P, AVPixelFormatYUV420P, VideoEncoderTypePackets, 0, audioParams)
 	if err != nil {
 		return err
 	}
 	defer enc.Close()
 
+	writeAudioUntil := func(until time.Duration) error {
+		for len(audio) != 0 && r.audioPTS(audio[0]) <= until {
+			if err := enc.WriteAudio(r.audioPTS(audio[0])-baseTime, audio[0]); err != nil {
+				return err
+			}
+			audio = audio[1:]
+		}
+		return nil
+	}
+
 	for _, packet := range r.Packets[firstPacket:] {
+		if err := writeAudioUntil(packet.PTS); err != nil {
+			return err
+		}
 		dts := packet.PTS - baseTime
 		//pts := dts + time.Nanosecond*1000
 		pts := dts
@@ -42,3 +42,62 @@ func TranscodeMediumQualitySeekable(srcFilename, dstFilename string) error {
 	}
 	return nil
 }
+
+// Transcode a video to H264, for browsers that can't decode H265.
+// Audio is copied without re-encoding.
+func TranscodeToH264(srcFilename, dstFilename string) error {
+	args := []string{
+		"-i",
+		srcFilename,
+		"-y", // overwrite output file
+		"-c:v",
+		"libx264",
+		"-preset",
+		"veryfast",
+		"-crf", // constant rate factor
+		"23",   // 0-51, 0 is lossless, 51 is worst quality
+		"-c:a",
+		"copy",
+		dstFilename,
+	}
+	_, err := RunAppCombinedOutput("ffmpeg", args)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Transcode a video to H264, and overlay an image onto every frame.
+// The overlay is stretched to the size of the video, so it only needs the same aspect ratio.
+// This is used to black out privacy masks, so the overlay is scaled without interpolation,
+// which would otherwise leave the edges of the mask semi-transparent.
+// Audio is copied without re-encoding.
+func TranscodeToH264WithOverlay(srcFilename, overlayFilename, dstFilename string) error {
+	args := []string{
+		"-i",
+		srcFilename,
+		"-i",
+		overlayFilename,
+		"-y", // overwrite output file
+		"-filter_complex",
+		"[1:v][0:v]scale2ref=flags=neighbor[overlay][video];[video][overlay]overlay[out]",
+		"-map",
+		"[out]",
+		"-map",
+		"0:a?",
+		"-c:v",
+		"libx264",
+		"-preset",
+		"veryfast",
+		"-crf", // constant rate factor
+		"23",   // 0-51, 0 is lossless, 51 is worst quality
+		"-c:a",
+		"copy",
+		dstFilename,
+	}
+	_, err := RunAppCombinedOutput("ffmpeg", args)
+	if err != nil {
+		return err
+	}
+	return nil
+}
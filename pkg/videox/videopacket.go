@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
 )
 
 // Topic: $ANNEXB-CONFUSION
@@ -97,6 +98,16 @@ func (p *VideoPacket) FirstNALUOfType264(t h264.NALUType) *NALU {
 	return nil
 }
 
+// Returns the first NALU of the given type, or nil if none exists
+func (p *VideoPacket) FirstNALUOfType265(t h265.NALUType) *NALU {
+	for i := 0; i < len(p.NALUs); i++ {
+		if p.NALUs[i].Type265() == t {
+			return &p.NALUs[i]
+		}
+	}
+	return nil
+}
+
 // Returns the number of bytes of NALU data.
 // If the NALUs have annex-b prefixes, then these are included in the size.
 func (p *VideoPacket) PayloadBytes() int {
@@ -11,6 +11,7 @@ import (
 
 	"embed"
 
+	"github.com/cyclopcam/cyclops/pkg/nnremote"
 	"github.com/cyclopcam/cyclops/server/configdb"
 	"github.com/cyclopcam/staticfiles"
 	"github.com/cyclopcam/www"
@@ -92,6 +93,8 @@ func (s *Server) SetupHTTP() error {
 	protected("a", "POST", "/api/system/restart", s.httpSystemRestart)
 	//unprotected("POST", "/api/system/startVPN", s.httpSystemStartVPN) // disabling this because I no longer think it's a good part of user flow
 	unprotected("GET", "/api/system/constants", s.httpSystemConstants)
+	unprotected("GET", nnremote.ModelsPath, s.httpNNModels)
+	unprotected("POST", nnremote.DetectPath, s.httpNNDetect)
 	protected("v", "GET", "/api/system/alarm/status", s.httpSystemAlarmStatus)
 	protected("a", "POST", "/api/system/alarm/arm", s.httpSystemAlarmArm)
 	protected("a", "POST", "/api/system/alarm/disarm", s.httpSystemAlarmDisarm)
@@ -99,12 +102,23 @@ func (s *Server) SetupHTTP() error {
 	protected("v", "GET", "/api/camera/info/:cameraID", s.httpCamGetInfo)
 	protected("v", "GET", "/api/camera/latestImage/:cameraID", s.httpCamGetLatestImage)
 	protected("v", "GET", "/api/camera/recentVideo/:cameraID", s.httpCamGetRecentVideo)
+	protected("v", "GET", "/api/camera/redactedVideo/:cameraID/:resolution/:startTime/:endTime", s.httpCamGetRedactedVideo)
 	protected("v", "GET", "/api/camera/image/:cameraID/:resolution/:time", s.httpCamGetImage)
 	protected("v", "GET", "/api/camera/frames/:cameraID/:resolution/:startTime/:endTime", s.httpCamGetFrames)
 	protected("a", "POST", "/api/camera/debug/saveClip/:cameraID/:startTime/:endTime", s.httpCamDebugSaveClip)
 	protected("v", "GET", "/api/camera/debug/stats", s.httpCamDebugStats)
 	protected("v", "GET", "/api/camera/debug/frameTimes/:cameraID/:resolution", s.httpCamDebugFrameTimes)
+	protected("v", "GET", "/api/camera/clock/:cameraID", s.httpCamGetClock)
+	protected("a", "POST", "/api/camera/measureClock/:cameraID", s.httpCamMeasureClock)
+	protected("a", "POST", "/api/camera/syncClock/:cameraID", s.httpCamSyncClock)
 	protected("v", "GET", "/api/ws/camera/stream/:cameraID/:resolution", s.httpCamStreamVideo)
+	protected("v", "GET", "/api/camera/transcodeProfiles", s.httpCamGetTranscodeProfiles)
+	protected("v", "GET", "/api/mosaic/layouts", s.httpMosaicGetLayouts)
+	protected("v", "POST", "/api/mosaic/save", s.httpMosaicSaveLayout)
+	protected("v", "POST", "/api/mosaic/delete/:id", s.httpMosaicDeleteLayout)
+	protected("v", "GET", "/api/ws/mosaic/stream/:id", s.httpMosaicStreamVideo)
+	protected("v", "GET", "/api/hls/mosaic/:id/:file", s.httpMosaicHLS)
+	protected("v", "GET", "/api/hls/camera/:cameraID/:resolution/:file", s.httpCamHLS)
 	protected("a", "GET", "/api/config/camera/:cameraID", s.httpConfigGetCamera)
 	protected("a", "GET", "/api/config/cameras", s.httpConfigGetCameras)
 	protected("a", "POST", "/api/config/addCamera", s.httpConfigAddCamera)
@@ -115,8 +129,22 @@ func (s *Server) SetupHTTP() error {
 	protected("a", "POST", "/api/config/settings", s.httpConfigSetSettings)
 	protected("a", "POST", "/api/config/scanNetworkForCameras", s.httpConfigScanNetworkForCameras)
 	protected("a", "GET", "/api/config/measureStorageSpace", s.httpConfigMeasureStorageSpace)
+	protected("a", "GET", "/api/config/retention", s.httpConfigGetRetention)
+	protected("a", "GET", "/api/config/replication", s.httpConfigGetReplication)
 	protected("v", "GET", "/api/videoEvents/tiles", s.httpVideoEventsGetTiles)
 	protected("v", "GET", "/api/videoEvents/details", s.httpVideoEventsGetDetails)
+	protected("v", "GET", "/api/holds", s.httpHoldsGet)
+	protected("a", "POST", "/api/holds/create", s.httpHoldsCreate)
+	protected("a", "POST", "/api/holds/release/:id", s.httpHoldsRelease)
+	protected("v", "GET", "/api/reanalysis", s.httpReanalysisGet)
+	protected("a", "POST", "/api/reanalysis/create", s.httpReanalysisCreate)
+	protected("a", "POST", "/api/reanalysis/cancel/:id", s.httpReanalysisCancel)
+	protected("a", "POST", "/api/reanalysis/deleteResults/:id", s.httpReanalysisDeleteResults)
+	protected("v", "GET", "/api/falsePositives", s.httpFalsePositivesGet)
+	protected("v", "GET", "/api/falsePositives/image/:id", s.httpFalsePositivesGetImage)
+	protected("a", "POST", "/api/falsePositives/create", s.httpFalsePositivesCreate)
+	protected("a", "POST", "/api/falsePositives/delete/:id", s.httpFalsePositivesDelete)
+	protected("a", "POST", "/api/falsePositives/exportToArc", s.httpFalsePositivesExportToArc)
 	protected("v", "GET", "/api/events/:id", s.httpEventsGet)
 	protected("v", "GET", "/api/events/:id/image", s.httpEventsGetImage)
 	unprotected("GET", "/api/auth/hasAdmin", s.httpAuthHasAdmin)
@@ -10,10 +10,15 @@ import (
 	"time"
 
 	"github.com/bmharper/cimg/v2"
+	"github.com/cyclopcam/cyclops/pkg/kibi"
 	"github.com/cyclopcam/cyclops/pkg/shell"
+	"github.com/cyclopcam/cyclops/pkg/videoformat/fsv"
 	"github.com/cyclopcam/cyclops/server/camera"
 	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/cyclops/server/defs"
+	"github.com/cyclopcam/cyclops/server/replication"
 	"github.com/cyclopcam/cyclops/server/scanner"
+	"github.com/cyclopcam/cyclops/server/videodb"
 	"github.com/cyclopcam/www"
 	"github.com/gorilla/websocket"
 	"github.com/julienschmidt/httprouter"
@@ -37,8 +42,23 @@ func (s *Server) httpConfigGetCameras(w http.ResponseWriter, r *http.Request, pa
 func (s *Server) httpConfigAddCamera(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
 	cfg := configdb.Camera{}
 	www.ReadJSON(w, r, &cfg, 1024*1024)
+	if err := cfg.ValidateRetention(); err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+
+	if err := cfg.ValidatePrivacyMasks(); err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+	if err := cfg.ValidateAnalyzerSettings(s.monitor.AllClasses()); err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+	if err := cfg.ValidateRegionsOfInterest(); err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+	s.validateCameraClassesOrPanic(&cfg)
 
 	cfg.ID = 0
+	s.validateVirtualCameraOrPanic(&cfg)
 
 	tx := s.configDB.DB.Begin()
 	www.Check(tx.Error)
@@ -60,12 +80,38 @@ func (s *Server) httpConfigAddCamera(w http.ResponseWriter, r *http.Request, par
 	www.SendID(w, cfg.ID)
 }
 
+func (s *Server) validateCameraClassesOrPanic(cfg *configdb.Camera) {
+	classes, err := cfg.ParseClasses()
+	if err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+	if classes != nil {
+		if err := s.monitor.ValidateClasses(classes, true); err != nil {
+			www.PanicBadRequestf("%v", err)
+		}
+	}
+}
+
 func (s *Server) httpConfigChangeCamera(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
 	cfgNew := configdb.Camera{}
 	www.ReadJSON(w, r, &cfgNew, 1024*1024)
+	if err := cfgNew.ValidateRetention(); err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+	if err := cfgNew.ValidatePrivacyMasks(); err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+	if err := cfgNew.ValidateAnalyzerSettings(s.monitor.AllClasses()); err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+	if err := cfgNew.ValidateRegionsOfInterest(); err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+	s.validateCameraClassesOrPanic(&cfgNew)
 
 	cfgOld := configdb.Camera{}
 	www.Check(s.configDB.DB.First(&cfgOld, cfgNew.ID).Error)
+	s.validateVirtualCameraOrPanic(&cfgNew)
 
 	cfgNew.LongLivedName = cfgOld.LongLivedName
 	cfgNew.CreatedAt = cfgOld.CreatedAt
@@ -80,11 +126,44 @@ func (s *Server) httpConfigChangeCamera(w http.ResponseWriter, r *http.Request,
 	www.SendOK(w)
 }
 
+// A virtual camera must have a valid crop rectangle, and its parent must be a physical camera.
+// Virtual cameras can't be nested, so a camera with virtual children can't itself become virtual.
+func (s *Server) validateVirtualCameraOrPanic(cfg *configdb.Camera) {
+	if err := cfg.ValidateVirtual(); err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+	if !cfg.IsVirtual() {
+		return
+	}
+	parent := configdb.Camera{}
+	www.Check(s.configDB.DB.Where("id = ?", cfg.ParentID).Limit(1).Find(&parent).Error)
+	if parent.ID == 0 {
+		www.PanicBadRequestf("Parent camera %v not found", cfg.ParentID)
+	}
+	if parent.IsVirtual() {
+		www.PanicBadRequestf("The parent of a virtual camera must be a physical camera")
+	}
+	if cfg.ID != 0 {
+		nChildren := int64(0)
+		www.Check(s.configDB.DB.Model(&configdb.Camera{}).Where("parent_id = ?", cfg.ID).Count(&nChildren).Error)
+		if nChildren != 0 {
+			www.PanicBadRequestf("A camera with virtual cameras can't itself be virtual")
+		}
+	}
+}
+
 func (s *Server) httpConfigRemoveCamera(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
 	camID := www.ParseID(params.ByName("cameraID"))
 	cam := configdb.Camera{}
 	www.Check(s.configDB.DB.First(&cam, camID).Error)
+	nChildren := int64(0)
+	www.Check(s.configDB.DB.Model(&configdb.Camera{}).Where("parent_id = ?", camID).Count(&nChildren).Error)
+	if nChildren != 0 {
+		www.PanicBadRequestf("Camera %v (%v) has virtual cameras. Remove them first", camID, cam.Name)
+	}
 	www.Check(s.configDB.DB.Delete(&cam).Error)
+	www.Check(s.configDB.DB.Where("camera_id = ?", camID).Delete(&configdb.FalsePositive{}).Error)
+	www.Check(s.loadFalsePositives())
 	s.Log.Infof("Removed camera %v (%v) from DB", camID, cam.Name)
 	s.LiveCameras.CameraRemoved(camID)
 	www.SendOK(w)
@@ -176,7 +255,7 @@ func (s *Server) httpConfigTestCamera(w http.ResponseWriter, r *http.Request, pa
 	success := false
 	start := time.Now()
 	for {
-		img, _ := cam.LowDecoder.LastImageCopy()
+		img, _ := cam.Frames().LastImageCopy()
 		if img != nil {
 			s.Log.Infof("Success connecting to camera %v after %v", cfg.Host, time.Since(start))
 			// Stash this camera, because the next call is extremely likely to be AddCamera(), which will re-use this
@@ -256,6 +335,27 @@ func (s *Server) httpConfigGetSettings(w http.ResponseWriter, r *http.Request, p
 func (s *Server) httpConfigSetSettings(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
 	config := configdb.ConfigJSON{}
 	www.ReadJSON(w, r, &config, 1024*1024)
+	if err := configdb.ValidateConfig(&config); err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+	if err := s.monitor.ValidateClasses(config.Classes, false); err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+	// Only initialize tiers that are new. If an existing tier has no marker, then its disk
+	// is probably not mounted, and initializing it would make us record into the empty mount point.
+	existingTiers := map[string]bool{}
+	for _, tier := range s.configDB.GetConfig().Recording.Tiers {
+		existingTiers[filepath.Clean(tier.Path)] = true
+	}
+	for _, tier := range config.Recording.Tiers {
+		if existingTiers[filepath.Clean(tier.Path)] {
+			if !videodb.IsStorageTierInitialized(tier.Path) {
+				www.PanicBadRequestf("Storage tier '%v' is not available. Is its disk mounted?", tier.Path)
+			}
+		} else if err := videodb.InitStorageTier(tier.Path); err != nil {
+			www.PanicBadRequestf("Failed to initialize storage tier '%v': %v", tier.Path, err)
+		}
+	}
 	needsRestart, err := s.configDB.SetConfig(config)
 	www.Check(err)
 	resp := struct {
@@ -265,3 +365,80 @@ func (s *Server) httpConfigSetSettings(w http.ResponseWriter, r *http.Request, p
 	}
 	www.SendJSON(w, &resp)
 }
+
+// SYNC-REPLICATION-STATUS-RESPONSE-JSON
+type replicationStatusJSON struct {
+	Running bool                `json:"running"` // False if replication is disabled, or failed to start
+	Status  *replication.Status `json:"status"`  // Nil if not running
+}
+
+func (s *Server) httpConfigGetReplication(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	resp := replicationStatusJSON{}
+	if s.replicator != nil {
+		status := s.replicator.Status()
+		resp.Running = true
+		resp.Status = &status
+	}
+	www.SendJSON(w, &resp)
+}
+
+// SYNC-STREAM-RETENTION-JSON
+type streamRetentionJSON struct {
+	StartTime int64   `json:"startTime"` // Unix milliseconds of the oldest footage (0 if there is no footage)
+	Days      float64 `json:"days"`      // Age of the oldest footage, in days
+	Size      int64   `json:"size"`      // Bytes used by this stream
+}
+
+// SYNC-CAMERA-RETENTION-JSON
+type cameraRetentionJSON struct {
+	CameraID         int64               `json:"cameraID"`
+	MinRetentionDays int                 `json:"minRetentionDays"`
+	MaxRetentionDays int                 `json:"maxRetentionDays"`
+	MaxStorageSize   int64               `json:"maxStorageSize"` // Byte quota (0 = no quota)
+	LD               streamRetentionJSON `json:"ld"`
+	HD               streamRetentionJSON `json:"hd"`
+	// True if the camera has a minimum retention guarantee, but we don't yet have that much footage.
+	// This is normal for a new camera, but if it persists, then the guarantee is not being honored.
+	BelowMinRetention bool `json:"belowMinRetention"`
+}
+
+// Report the effective retention of every camera's recordings
+func (s *Server) httpConfigGetRetention(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	if s.videoDB == nil {
+		www.PanicServerErrorf("Video archive is not available")
+	}
+	cams := []*configdb.Camera{}
+	www.Check(s.configDB.DB.Find(&cams).Error)
+
+	streams := map[string]fsv.StreamRetention{}
+	for _, sr := range s.videoDB.Archive.RetentionReport() {
+		streams[sr.Name] = sr
+	}
+	now := time.Now()
+	toJSON := func(sr fsv.StreamRetention) streamRetentionJSON {
+		if sr.StartTime.IsZero() {
+			return streamRetentionJSON{}
+		}
+		return streamRetentionJSON{
+			StartTime: sr.StartTime.UnixMilli(),
+			Days:      now.Sub(sr.StartTime).Hours() / 24,
+			Size:      sr.Size,
+		}
+	}
+
+	result := []*cameraRetentionJSON{}
+	for _, cam := range cams {
+		maxBytes, _ := kibi.ParseBytes(cam.MaxStorageSize)
+		cr := &cameraRetentionJSON{
+			CameraID:         cam.ID,
+			MinRetentionDays: cam.MinRetentionDays,
+			MaxRetentionDays: cam.MaxRetentionDays,
+			MaxStorageSize:   maxBytes,
+			LD:               toJSON(streams[videodb.VideoStreamNameForCamera(cam.LongLivedName, defs.ResLD)]),
+			HD:               toJSON(streams[videodb.VideoStreamNameForCamera(cam.LongLivedName, defs.ResHD)]),
+		}
+		cr.BelowMinRetention = cam.MinRetentionDays != 0 && cr.HD.Days < float64(cam.MinRetentionDays)
+		result = append(result, cr)
+	}
+	www.SendJSON(w, result)
+}
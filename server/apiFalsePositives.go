@@ -0,0 +1,261 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bmharper/cimg/v2"
+	"github.com/cyclopcam/cyclops/pkg/gen"
+	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/cyclops/pkg/videoformat/fsv"
+	"github.com/cyclopcam/cyclops/pkg/videox"
+	"github.com/cyclopcam/cyclops/server/arc"
+	"github.com/cyclopcam/cyclops/server/camera"
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/cyclops/server/monitor"
+	"github.com/cyclopcam/dbh"
+	"github.com/cyclopcam/www"
+	"github.com/julienschmidt/httprouter"
+	"gorm.io/gorm"
+)
+
+// A user can mark a tracked object as a false positive, in the live view, or in recorded footage.
+// The monitor then discards similar detections at the same location, and we keep an image of
+// the object, which can be sent to Arc for retraining.
+
+// Load the false positives of all cameras into the monitor
+func (s *Server) loadFalsePositives() error {
+	falsePositives, err := s.configDB.GetFalsePositives(0)
+	if err != nil {
+		return err
+	}
+	s.monitor.SetFalsePositives(falsePositives)
+	return nil
+}
+
+func (s *Server) getFalsePositiveOrPanic(id int64) *configdb.FalsePositive {
+	fp := configdb.FalsePositive{}
+	if err := s.configDB.DB.First(&fp, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			www.PanicNotFound()
+		}
+		www.Check(err)
+	}
+	return &fp
+}
+
+// If 'camera' is specified, then only the false positives of that camera are returned
+func (s *Server) httpFalsePositivesGet(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	cameraID := int64(0)
+	if camera := www.QueryValue(r, "camera"); camera != "" {
+		cameraID = s.getCameraFromIDOrPanic(camera).ID()
+	}
+	falsePositives, err := s.configDB.GetFalsePositives(cameraID)
+	www.Check(err)
+	www.SendJSON(w, falsePositives)
+}
+
+func (s *Server) httpFalsePositivesGetImage(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	fp := s.getFalsePositiveOrPanic(www.ParseID(params.ByName("id")))
+	www.CacheSeconds(w, 3600)
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(fp.Image)
+}
+
+// Mark a tracked object as a false positive.
+// If time is zero, then the object is one that the monitor is tracking right now.
+// Otherwise, the object is from the recorded events, and time is the frame on which the user
+// marked it, which is the frame that we save.
+func (s *Server) httpFalsePositivesCreate(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	// SYNC-CREATE-FALSE-POSITIVE-JSON
+	req := struct {
+		CameraID int64  `json:"cameraID"`
+		ObjectID uint32 `json:"objectID"`
+		Time     int64  `json:"time"` // Unix milliseconds
+	}{}
+	www.ReadJSON(w, r, &req, 1024*1024)
+	cam := s.LiveCameras.CameraFromID(req.CameraID)
+	if cam == nil {
+		www.PanicBadRequestf("Invalid camera ID '%v'", req.CameraID)
+	}
+
+	var fp *configdb.FalsePositive
+	if req.Time == 0 {
+		fp = s.makeLiveFalsePositive(cam, req.ObjectID)
+	} else {
+		fp = s.makeRecordedFalsePositive(cam, req.ObjectID, time.UnixMilli(req.Time))
+	}
+	fp.CameraID = cam.ID()
+	fp.CreatedBy = user.ID
+	if err := s.configDB.AddFalsePositive(fp); err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+	www.Check(s.loadFalsePositives())
+	s.Log.Infof("Camera %v: '%v' at %v marked as a false positive by user %v", cam.ID(), fp.Class, fp.Box(), user.ID)
+	www.SendJSON(w, fp)
+}
+
+// Undo a false positive, so that its detections are no longer discarded
+func (s *Server) httpFalsePositivesDelete(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	fp := s.getFalsePositiveOrPanic(www.ParseID(params.ByName("id")))
+	www.Check(s.configDB.DB.Delete(fp).Error)
+	www.Check(s.loadFalsePositives())
+	www.SendOK(w)
+}
+
+// Send the samples that have not yet been sent to Arc
+func (s *Server) httpFalsePositivesExportToArc(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	s.arcCredentialsLock.Lock()
+	credentials := s.arcCredentials
+	s.arcCredentialsLock.Unlock()
+	if credentials == nil || !credentials.IsConfigured() {
+		www.PanicBadRequestf("Arc server is not configured")
+	}
+
+	falsePositives := []*configdb.FalsePositive{}
+	www.Check(s.configDB.DB.Where("exported_at IS NULL").Order("id").Find(&falsePositives).Error)
+	byCamera := map[int64][]*configdb.FalsePositive{}
+	for _, fp := range falsePositives {
+		byCamera[fp.CameraID] = append(byCamera[fp.CameraID], fp)
+	}
+
+	nExported := 0
+	for cameraID, list := range byCamera {
+		cameraName := ""
+		if cam := s.LiveCameras.CameraFromID(cameraID); cam != nil {
+			cameraName = cam.Name()
+		}
+		samples := []arc.NegativeSample{}
+		ids := []int64{}
+		for _, fp := range list {
+			sample := arc.NegativeSample{ID: fp.ID, Class: fp.Class, Image: fp.Image}
+			if fp.ImageBox != nil {
+				sample.Box = fp.ImageBox.Data
+			}
+			samples = append(samples, sample)
+			ids = append(ids, fp.ID)
+		}
+		if err := arc.UploadNegativeSamplesToArc(credentials, cameraName, samples); err != nil {
+			www.PanicServerErrorf("Failed to send samples of camera %v to Arc: %v", cameraID, err)
+		}
+		www.Check(s.configDB.DB.Model(&configdb.FalsePositive{}).Where("id IN ?", ids).Update("exported_at", dbh.MakeIntTime(time.Now())).Error)
+		nExported += len(samples)
+	}
+
+	// SYNC-EXPORT-FALSE-POSITIVES-JSON
+	response := struct {
+		NumExported int `json:"numExported"`
+	}{
+		NumExported: nExported,
+	}
+	www.SendJSON(w, &response)
+}
+
+// Create a false positive from an object that the monitor is tracking
+func (s *Server) makeLiveFalsePositive(cam *camera.Camera, objectID uint32) *configdb.FalsePositive {
+	img, _, analysis, err := s.monitor.LatestFrame(cam.ID())
+	if err != nil {
+		www.PanicBadRequestf("No frame available: %v", err)
+	}
+	if analysis != nil {
+		for _, obj := range analysis.Objects {
+			if obj.ID == objectID {
+				last := obj.LastFrame()
+				fp, err := s.makeFalsePositive(img, last.Box, s.monitor.AllClasses()[obj.Class])
+				if err != nil {
+					www.PanicBadRequestf("%v", err)
+				}
+				fp.FrameTime = dbh.MakeIntTime(analysis.Input.FramePTS)
+				return fp
+			}
+		}
+	}
+	www.PanicBadRequestf("Object %v is no longer being tracked", objectID)
+	return nil
+}
+
+// Create a false positive from an object in the recorded events, at the given frame
+func (s *Server) makeRecordedFalsePositive(cam *camera.Camera, objectID uint32, frameTime time.Time) *configdb.FalsePositive {
+	vdb := s.getVideoDBOrPanic()
+	events, err := vdb.ReadEvents(cam.LongLivedName(), frameTime, frameTime.Add(time.Millisecond))
+	www.Check(err)
+	for _, e := range events {
+		if e.Detections == nil {
+			continue
+		}
+		for _, obj := range e.Detections.Data.Objects {
+			if obj.ID != objectID || len(obj.Positions) == 0 {
+				continue
+			}
+			// Use the position closest to the frame
+			best := obj.Positions[0]
+			for _, p := range obj.Positions {
+				if gen.Abs(int64(e.Time)+int64(p.Time)-frameTime.UnixMilli()) < gen.Abs(int64(e.Time)+int64(best.Time)-frameTime.UnixMilli()) {
+					best = p
+				}
+			}
+			img, imgTime, err := s.decodeAnalysisFrame(cam, frameTime)
+			if err != nil {
+				www.PanicBadRequestf("Failed to decode frame: %v", err)
+			}
+			// Scale the box, in case the camera's resolution has changed since the event was recorded
+			resolution := e.Detections.Data.Resolution
+			if resolution[0] == 0 || resolution[1] == 0 {
+				resolution = [2]int{img.Width, img.Height}
+			}
+			sx := float64(img.Width) / float64(resolution[0])
+			sy := float64(img.Height) / float64(resolution[1])
+			box := nn.MakeRect(int(float64(best.Box[0])*sx), int(float64(best.Box[1])*sy), int(float64(best.Box[2]-best.Box[0])*sx), int(float64(best.Box[3]-best.Box[1])*sy))
+			className, err := vdb.IDToString(obj.Class)
+			www.Check(err)
+			fp, err := s.makeFalsePositive(img, box, className)
+			if err != nil {
+				www.PanicBadRequestf("%v", err)
+			}
+			fp.FrameTime = dbh.MakeIntTime(imgTime)
+			fp.EventID = e.ID
+			return fp
+		}
+	}
+	www.PanicBadRequestf("Object %v not found at %v", objectID, frameTime)
+	return nil
+}
+
+func (s *Server) makeFalsePositive(img *cimg.Image, box nn.Rect, class string) (*configdb.FalsePositive, error) {
+	if s.monitor.ClassToIdx(class) == s.monitor.UnrecognizedClassIdx() {
+		return nil, fmt.Errorf("Class '%v' is not recognized by the current model", class)
+	}
+	return monitor.MakeFalsePositive(img, box, class)
+}
+
+// Decode the frame that the NN would have seen at the given time
+func (s *Server) decodeAnalysisFrame(cam *camera.Camera, frameTime time.Time) (*cimg.Image, time.Time, error) {
+	vdb := s.getVideoDBOrPanic()
+	const trackName = "video"
+	readResult, err := vdb.Archive.Read(cam.RecordingStreamName(cam.AnalysisResolution()), []string{trackName}, frameTime, frameTime.Add(200*time.Millisecond), fsv.ReadFlagSeekBackToKeyFrame)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	video := readResult[trackName]
+	if video == nil || len(video.NALS) == 0 {
+		return nil, time.Time{}, errors.New("No video available at that time")
+	}
+	pbuffer, err := videox.ExtractFsvPackets(video.Codec, video.NALS)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !pbuffer.HasIDR() {
+		return nil, time.Time{}, errors.New("No keyframes found")
+	}
+	yuv, imgTime, err := videox.DecodeClosestYUVImageInPacketList(pbuffer.Codec(), pbuffer.Packets[pbuffer.FindFirstIDR():], frameTime)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	yuv, err = cam.PrepareRecordedFrame(yuv)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return yuv.ToCImageRGB(), imgTime, nil
+}
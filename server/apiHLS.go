@@ -0,0 +1,93 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cyclopcam/cyclops/server/camera"
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/cyclops/server/defs"
+	"github.com/cyclopcam/cyclops/server/streamer"
+	"github.com/cyclopcam/cyclops/server/transcoder"
+	"github.com/cyclopcam/www"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Serve the HLS source at path. file is either "index.m3u8" or a segment such as "12.ts".
+// Players that can't send cookies can pass authorizationToken in the query string, and
+// it is passed on to the segment URLs.
+func (s *Server) serveHLS(w http.ResponseWriter, r *http.Request, path string, open streamer.SourceOpener, file string) {
+	www.CacheNever(w)
+
+	if file == "index.m3u8" {
+		segmentQuery := ""
+		if token := r.URL.Query().Get("authorizationToken"); token != "" {
+			segmentQuery = url.Values{"authorizationToken": {token}}.Encode()
+		}
+		playlist, err := s.hls.Playlist(path, open, segmentQuery)
+		if errors.Is(err, transcoder.ErrOverBudget) || errors.Is(err, streamer.ErrHLSNotReady) {
+			www.Panic(http.StatusServiceUnavailable, err.Error())
+		}
+		www.Check(err)
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Write(playlist)
+		return
+	}
+
+	sequence, err := strconv.ParseInt(strings.TrimSuffix(file, ".ts"), 10, 64)
+	if err != nil || !strings.HasSuffix(file, ".ts") {
+		www.PanicNotFound()
+	}
+	segment, err := s.hls.Segment(path, sequence)
+	if errors.Is(err, streamer.ErrHLSSegmentNotFound) {
+		www.PanicNotFound()
+	}
+	www.Check(err)
+	w.Header().Set("Content-Type", "video/mp2t")
+	w.Write(segment)
+}
+
+// Returns a function that opens a camera stream for HLS.
+// The raw stream of a camera with privacy masks never leaves the server, so such a camera
+// is served through the privacy transcoder, which has no audio.
+func (s *Server) cameraSource(cam *camera.Camera, res defs.Resolution) streamer.SourceOpener {
+	return func() (*streamer.Source, error) {
+		name := fmt.Sprintf("%v %v", cam.Name(), res)
+		stream := cam.GetStream(res)
+		if cam.StreamHasPrivacyMasks() {
+			t, err := s.transcoders.Acquire(cam.Name(), stream, transcoder.PrivacyProfileName, cam.StreamPrivacyMask)
+			if err != nil {
+				return nil, err
+			}
+			return &streamer.Source{
+				Name:    name,
+				Stream:  t.Output,
+				Backlog: t.Backlog,
+				Release: func() { s.transcoders.Release(t) },
+			}, nil
+		}
+		var backlog *camera.VideoRingBuffer
+		if res == defs.ResLD {
+			backlog = cam.LowDumper
+		}
+		return &streamer.Source{
+			Name:    name,
+			Stream:  stream,
+			Backlog: backlog,
+			Release: func() {},
+		}, nil
+	}
+}
+
+// Serve a live camera stream over HLS, including its audio, if the camera sends AAC.
+// Example: vlc http://cyclops:8080/api/hls/camera/2/hd/index.m3u8?authorizationToken=...
+func (s *Server) httpCamHLS(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	cam := s.getCameraFromIDOrPanic(params.ByName("cameraID"))
+	res := parseResolutionOrPanic(params.ByName("resolution"))
+	path := fmt.Sprintf("camera/%v/%v", cam.ID(), res)
+	s.serveHLS(w, r, path, s.cameraSource(cam, res), params.ByName("file"))
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/cyclops/server/videodb"
+	"github.com/cyclopcam/www"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Holds protect recordings from deletion, for example while an incident is being investigated.
+
+func (s *Server) getVideoDBOrPanic() *videodb.VideoDB {
+	if s.videoDB == nil {
+		www.PanicServerErrorf("Video archive is not available")
+	}
+	return s.videoDB
+}
+
+// If 'camera' is specified, then only the holds of that camera are returned.
+// If 'all' is 1, then released and expired holds are included.
+func (s *Server) httpHoldsGet(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	vdb := s.getVideoDBOrPanic()
+	camera := ""
+	if cameraID := www.QueryValue(r, "camera"); cameraID != "" {
+		// The holds of a virtual camera are on the footage of its parent
+		camera = s.getCameraFromIDOrPanic(cameraID).RecordingCameraName()
+	}
+	holds, err := vdb.ReadHolds(camera, www.QueryValue(r, "all") == "1")
+	www.Check(err)
+
+	// Resolve the camera names, so that the caller doesn't need to make an additional call
+	idToString := map[uint32]string{}
+	for _, h := range holds {
+		if idToString[h.Camera] == "" {
+			idToString[h.Camera], err = vdb.IDToString(h.Camera)
+			www.Check(err)
+		}
+	}
+	heldSize, maxHeldSize := vdb.HeldSize()
+
+	// SYNC-GET-HOLDS-JSON
+	response := struct {
+		Holds       []*videodb.Hold   `json:"holds"`
+		IDToString  map[uint32]string `json:"idToString"`
+		HeldSize    int64             `json:"heldSize"`    // Bytes of footage protected by active holds
+		MaxHeldSize int64             `json:"maxHeldSize"` // Limit of heldSize (0 = no limit)
+	}{
+		Holds:       holds,
+		IDToString:  idToString,
+		HeldSize:    heldSize,
+		MaxHeldSize: maxHeldSize,
+	}
+	www.SendJSON(w, &response)
+}
+
+func (s *Server) httpHoldsCreate(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	vdb := s.getVideoDBOrPanic()
+	// SYNC-CREATE-HOLD-JSON
+	req := struct {
+		CameraID  int64  `json:"cameraID"`
+		StartTime int64  `json:"startTime"` // Unix milliseconds
+		EndTime   int64  `json:"endTime"`   // Unix milliseconds
+		ExpiresAt int64  `json:"expiresAt"` // Unix milliseconds. Zero = never.
+		Reason    string `json:"reason"`
+	}{}
+	www.ReadJSON(w, r, &req, 1024*1024)
+	cam := s.LiveCameras.CameraFromID(req.CameraID)
+	if cam == nil {
+		www.PanicBadRequestf("Invalid camera ID '%v'", req.CameraID)
+	}
+	if req.EndTime <= req.StartTime {
+		www.PanicBadRequestf("Start time must be before end time")
+	}
+	if req.ExpiresAt != 0 && req.ExpiresAt <= time.Now().UnixMilli() {
+		www.PanicBadRequestf("Expiry time must be in the future")
+	}
+	expires := time.Time{}
+	if req.ExpiresAt != 0 {
+		expires = time.UnixMilli(req.ExpiresAt)
+	}
+	// A virtual camera has no streams of its own, so we hold the footage of its parent
+	hold, err := vdb.CreateHold(cam.RecordingCameraName(), time.UnixMilli(req.StartTime), time.UnixMilli(req.EndTime), expires, req.Reason, user.ID)
+	if errors.Is(err, videodb.ErrHoldQuotaExceeded) {
+		www.PanicBadRequestf("%v", err)
+	}
+	www.Check(err)
+	www.SendJSON(w, hold)
+}
+
+func (s *Server) httpHoldsRelease(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	vdb := s.getVideoDBOrPanic()
+	id := www.ParseID(params.ByName("id"))
+	www.Check(vdb.ReleaseHold(id, user.ID))
+	www.SendOK(w)
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/cyclops/server/mosaic"
+	"github.com/cyclopcam/cyclops/server/streamer"
+	"github.com/cyclopcam/cyclops/server/transcoder"
+	"github.com/cyclopcam/dbh"
+	"github.com/cyclopcam/www"
+	"github.com/julienschmidt/httprouter"
+)
+
+// A mosaic is a grid of cameras that the server composites into a single video stream,
+// for devices that can only play one stream, or can't decode many streams at once.
+// Layouts belong to the user that created them.
+// A mosaic can be watched over our websocket, HLS, or RTSP. RTSP is for devices such as
+// TVs, which can't log in, so it uses BASIC authentication, and is only served on the LAN.
+
+// Users can only see their own layouts.
+// Returns nil if the layout doesn't exist, or belongs to somebody else.
+func (s *Server) getMosaicLayout(id int64, user *configdb.User) (*configdb.MosaicLayout, error) {
+	layout := configdb.MosaicLayout{}
+	if err := s.configDB.DB.Where("id = ? AND user_id = ?", id, user.ID).Limit(1).Find(&layout).Error; err != nil {
+		return nil, err
+	}
+	if layout.ID == 0 {
+		return nil, nil
+	}
+	return &layout, nil
+}
+
+func (s *Server) getMosaicLayoutOrPanic(id int64, user *configdb.User) *configdb.MosaicLayout {
+	layout, err := s.getMosaicLayout(id, user)
+	www.Check(err)
+	if layout == nil {
+		www.PanicNotFound()
+	}
+	return layout
+}
+
+// Returns a function that starts (or shares) the mosaic of the layout
+func (s *Server) mosaicSource(layout *configdb.MosaicLayout) streamer.SourceOpener {
+	return func() (*streamer.Source, error) {
+		m, err := s.mosaics.Acquire(layout)
+		if err != nil {
+			return nil, err
+		}
+		return &streamer.Source{
+			Name:    mosaic.StreamName(layout.ID),
+			Stream:  m.Output,
+			Backlog: m.Backlog,
+			Release: func() { s.mosaics.Release(m) },
+		}, nil
+	}
+}
+
+// Open a mosaic source, or panic with 503 if we're over the CPU budget
+func (s *Server) openMosaicSourceOrPanic(layout *configdb.MosaicLayout) *streamer.Source {
+	source, err := s.mosaicSource(layout)()
+	if errors.Is(err, transcoder.ErrOverBudget) {
+		www.Panic(http.StatusServiceUnavailable, err.Error())
+	}
+	www.Check(err)
+	return source
+}
+
+func (s *Server) httpMosaicGetLayouts(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	layouts, err := s.configDB.GetMosaicLayouts(user.ID)
+	www.Check(err)
+	www.SendJSON(w, layouts)
+}
+
+// Create a new layout (if id is zero), or update an existing one
+func (s *Server) httpMosaicSaveLayout(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	layout := configdb.MosaicLayout{}
+	www.ReadJSON(w, r, &layout, 1024*1024)
+	if err := layout.Validate(); err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+	for _, id := range layout.CameraIDs() {
+		if id != 0 && s.LiveCameras.CameraFromID(id) == nil {
+			www.PanicBadRequestf("Invalid camera ID '%v'", id)
+		}
+	}
+	if layout.Cameras == nil {
+		layout.Cameras = dbh.MakeJSONField([]int64{})
+	}
+	layout.UserID = user.ID
+	if layout.ID != 0 {
+		existing := s.getMosaicLayoutOrPanic(layout.ID, user)
+		layout.CreatedAt = existing.CreatedAt
+	}
+	www.Check(s.configDB.DB.Save(&layout).Error)
+	www.SendJSON(w, &layout)
+}
+
+func (s *Server) httpMosaicDeleteLayout(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	layout := s.getMosaicLayoutOrPanic(www.ParseID(params.ByName("id")), user)
+	www.Check(s.configDB.DB.Delete(layout).Error)
+	www.SendOK(w)
+}
+
+// Stream a mosaic over a websocket, in the same format as a camera stream
+func (s *Server) httpMosaicStreamVideo(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	layout := s.getMosaicLayoutOrPanic(www.ParseID(params.ByName("id")), user)
+	source := s.openMosaicSourceOrPanic(layout)
+	defer source.Release()
+
+	conn, err := s.wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.Log.Errorf("httpMosaicStreamVideo websocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	streamer.RunVideoWebSocketStreamer(layout.Name, s.Log, conn, source.Stream, source.Backlog, nil, false)
+}
+
+// Serve a mosaic over HLS (see serveHLS).
+// Example: vlc http://cyclops:8080/api/hls/mosaic/3/index.m3u8?authorizationToken=...
+func (s *Server) httpMosaicHLS(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	layout := s.getMosaicLayoutOrPanic(www.ParseID(params.ByName("id")), user)
+	path := "mosaic/" + strconv.FormatInt(layout.ID, 10)
+	s.serveHLS(w, r, path, s.mosaicSource(layout), params.ByName("file"))
+}
+
+// Check the credentials of an RTSP request. Paths look like "mosaic/3".
+func (s *Server) authorizeRTSP(path, username, password string, remoteIP net.IP) (streamer.SourceOpener, error) {
+	user := s.configDB.VerifyBasicAuth(username, password, remoteIP)
+	if user == nil || !user.HasPermission(configdb.UserPermissionViewer) {
+		return nil, streamer.ErrUnauthorized
+	}
+	idStr, ok := strings.CutPrefix(path, "mosaic/")
+	if !ok {
+		return nil, streamer.ErrSourceNotFound
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return nil, streamer.ErrSourceNotFound
+	}
+	layout, err := s.getMosaicLayout(id, user)
+	if err != nil {
+		return nil, err
+	} else if layout == nil {
+		return nil, streamer.ErrSourceNotFound
+	}
+	return s.mosaicSource(layout), nil
+}
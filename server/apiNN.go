@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/cyclopcam/www"
+	"github.com/julienschmidt/httprouter"
+)
+
+// These endpoints let other Cyclops systems run their neural networks on us.
+// They are authenticated with the inference key (see nnremote), not with user sessions.
+
+func (s *Server) httpNNModels(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if s.nnServer == nil {
+		www.PanicNotFound()
+	}
+	s.nnServer.HandleModels(w, r)
+}
+
+func (s *Server) httpNNDetect(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
+	if s.nnServer == nil {
+		www.PanicNotFound()
+	}
+	s.nnServer.HandleDetect(w, r)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/cyclops/server/reanalysis"
+	"github.com/cyclopcam/www"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Re-analysis runs recorded footage through the current NN models, as background jobs.
+
+func (s *Server) getReanalysisOrPanic() *reanalysis.Manager {
+	if s.reanalysis == nil {
+		www.PanicServerErrorf("Video archive is not available")
+	}
+	return s.reanalysis
+}
+
+func (s *Server) httpReanalysisGet(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	www.SendJSON(w, s.getReanalysisOrPanic().Jobs())
+}
+
+func (s *Server) httpReanalysisCreate(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	manager := s.getReanalysisOrPanic()
+	req := reanalysis.Request{}
+	www.ReadJSON(w, r, &req, 1024*1024)
+	if s.LiveCameras.CameraFromID(req.CameraID) == nil {
+		www.PanicBadRequestf("Invalid camera ID '%v'", req.CameraID)
+	}
+	job, err := manager.Submit(req)
+	if err != nil {
+		www.PanicBadRequestf("%v", err)
+	}
+	www.SendJSON(w, job)
+}
+
+func (s *Server) httpReanalysisCancel(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	manager := s.getReanalysisOrPanic()
+	err := manager.Cancel(www.ParseID(params.ByName("id")))
+	if errors.Is(err, reanalysis.ErrJobNotFound) {
+		www.PanicNotFound()
+	}
+	www.Check(err)
+	www.SendOK(w)
+}
+
+// Delete the results that a job stored alongside the original results.
+// Results of jobs that ran before the server was restarted can also be deleted.
+func (s *Server) httpReanalysisDeleteResults(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	manager := s.getReanalysisOrPanic()
+	id := www.ParseID(params.ByName("id"))
+	if manager.IsActive(id) {
+		www.PanicBadRequestf("Job %v is still busy. Cancel it before deleting its results.", id)
+	}
+	n, err := s.videoDB.DeleteJobEvents(id)
+	www.Check(err)
+	s.Log.Infof("Deleted %v events of re-analysis job %v", n, id)
+	www.SendOK(w)
+}
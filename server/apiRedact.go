@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/fsv"
+	"github.com/cyclopcam/cyclops/pkg/videox"
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/cyclops/server/redact"
+	"github.com/cyclopcam/www"
+	"github.com/julienschmidt/httprouter"
+)
+
+// Redacting is slow (decode, blur, encode, and optionally a NN pass on every frame), so we limit the length of a clip
+const maxRedactDuration = 10 * time.Minute
+
+// Export an MP4 of recorded footage, with objects of the selected classes blurred.
+// This is for handing footage to third parties, without revealing bystanders.
+// Query parameters:
+//
+//	classes: Comma separated list of classes to blur (default: the camera's alarm classes). Our models don't detect
+//	         licence plates, so to hide plates, blur the vehicles (eg "person,car,motorcycle,truck,bus").
+//	keep:    Comma separated list of object IDs (from the video events) that must not be blurred,
+//	         such as the person that the footage is about.
+//	nn:      If 1, then every frame is also run through the HQ neural network, to catch objects that
+//	         were never recorded as events. This is much slower.
+//
+// Audio is never included, because speech can't be redacted.
+// Example: curl -o redacted.mp4 localhost:8080/api/camera/redactedVideo/1/hd/1700000000000/1700000060000?classes=person&keep=17
+func (s *Server) httpCamGetRedactedVideo(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	cam := s.getCameraFromIDOrPanic(params.ByName("cameraID"))
+	res := parseResolutionOrPanic(params.ByName("resolution"))
+	startTimeMS, _ := strconv.ParseInt(params.ByName("startTime"), 10, 64)
+	endTimeMS, _ := strconv.ParseInt(params.ByName("endTime"), 10, 64)
+	startTime := time.UnixMilli(startTimeMS)
+	endTime := time.UnixMilli(endTimeMS)
+	if !endTime.After(startTime) || endTime.Sub(startTime) > maxRedactDuration {
+		www.PanicBadRequestf("Invalid time range. The maximum duration is %v", maxRedactDuration)
+	}
+	if s.videoDB == nil {
+		www.PanicServerErrorf("VideoDB not initialized")
+	}
+
+	allClasses := s.monitor.AllClasses()
+	classNames := []string{}
+	if q := www.QueryValue(r, "classes"); q != "" {
+		classNames = strings.Split(q, ",")
+		for _, c := range classNames {
+			if !slices.Contains(allClasses, c) {
+				www.PanicBadRequestf("Unknown class '%v'", c)
+			}
+		}
+	} else {
+		// Default to the classes that trigger the camera's alarm, which are the ones that we care about most
+		classConfig := s.monitor.CameraClasses(cam.ID())
+		for _, c := range allClasses {
+			if classConfig.IsAlarm(c) {
+				classNames = append(classNames, c)
+			}
+		}
+		if len(classNames) == 0 {
+			www.PanicBadRequestf("The camera has no alarm classes, so the classes to blur must be specified")
+		}
+	}
+	keep := map[uint32]bool{}
+	if q := www.QueryValue(r, "keep"); q != "" {
+		for _, idStr := range strings.Split(q, ",") {
+			id, err := strconv.ParseUint(idStr, 10, 32)
+			if err != nil {
+				www.PanicBadRequestf("Invalid object ID '%v'", idStr)
+			}
+			keep[uint32(id)] = true
+		}
+	}
+	runNN := www.QueryValue(r, "nn") == "1"
+
+	result, err := s.videoDB.Archive.Read(cam.RecordingStreamName(res), []string{"video"}, startTime, endTime, fsv.ReadFlagSeekBackToKeyFrame)
+	www.Check(err)
+	if result["video"] == nil || len(result["video"].NALS) == 0 {
+		www.PanicBadRequestf("No video available in that time range")
+	}
+	pbuffer, err := videox.ExtractFsvPackets(result["video"].Codec, result["video"].NALS)
+	www.Check(err)
+	if !pbuffer.HasIDR() {
+		www.PanicBadRequestf("No keyframes found")
+	}
+	pbuffer.Packets = pbuffer.Packets[pbuffer.FindFirstIDR():]
+	width, height, err := pbuffer.DecodeHeader()
+	www.Check(err)
+
+	// Events are recorded at the resolution of the NN input. For a virtual camera, that is its crop
+	// of the parent's frame. We only export the crop, because the rest of the parent's frame is
+	// not covered by the virtual camera's events, so bystanders there would not be blurred.
+	cropWidth, cropHeight := width, height
+	if cam.IsVirtual() {
+		crop, err := configdb.ParseCropRect(cam.Config.Load().Crop)
+		www.Check(err)
+		_, _, cropWidth, cropHeight = crop.Pixels(width, height)
+	}
+	classIDs, err := s.videoDB.StringsToID(classNames)
+	www.Check(err)
+	classSet := map[uint32]bool{}
+	for _, id := range classIDs {
+		classSet[id] = true
+	}
+	events, err := s.videoDB.ReadEvents(cam.LongLivedName(), startTime.Add(-redact.HoldDuration), endTime.Add(redact.HoldDuration))
+	www.Check(err)
+	tracks := redact.TracksFromEvents(events, classSet, cropWidth, cropHeight)
+
+	opt := &redact.Options{
+		Prepare: cam.PrepareRecordedFrame,
+	}
+	opt.Tracks, opt.Keep = redact.SplitTracks(tracks, keep)
+	if runNN {
+		detector := s.monitor.HQDetector()
+		opt.Detector = detector
+		opt.DetectClasses = map[int]bool{}
+		for i, c := range detector.Config().Classes {
+			if slices.Contains(classNames, c) {
+				opt.DetectClasses[i] = true
+			}
+		}
+	}
+
+	fn := s.TempFiles.GetOnceOff() + ".mp4"
+	start := time.Now()
+	stats, err := redact.Export(pbuffer.Codec(), pbuffer.Packets, fn, opt)
+	www.Check(err)
+	s.Log.Infof("Redacted %v frames of camera %v (%v) in %.1f seconds. %v tracks, %v boxes blurred", stats.Frames, cam.ID(), cam.Name(), time.Since(start).Seconds(), len(opt.Tracks), stats.BlurredBoxes)
+
+	www.CacheNever(w)
+	www.SendTempFile(w, r, fn, "video/mp4")
+}
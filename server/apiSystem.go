@@ -25,7 +25,9 @@ type systemInfoJSON struct {
 
 // If this gets too bloated, then we can split it up
 type constantsJSON struct {
-	CameraModels []string `json:"cameraModels"`
+	CameraModels []string              `json:"cameraModels"`
+	NNClasses    []string              `json:"nnClasses"` // Classes that our neural network detects. These are not necessarily COCO classes.
+	Classes      *configdb.ClassesJSON `json:"classes"`   // The system's class config, after defaults have been applied
 }
 
 type pingJSON struct {
@@ -103,9 +105,9 @@ func (s *Server) httpSystemGetInfo(w http.ResponseWriter, r *http.Request, param
 	for _, cfg := range cameras {
 		cam := s.LiveCameras.CameraFromID(cfg.ID)
 		if cam != nil {
-			j.Cameras = append(j.Cameras, liveToCamInfoJSON(cam))
+			j.Cameras = append(j.Cameras, liveToCamInfoJSON(cam, s.monitor.CameraClasses(cfg.ID)))
 		} else {
-			j.Cameras = append(j.Cameras, cfgToCamInfoJSON(cfg))
+			j.Cameras = append(j.Cameras, cfgToCamInfoJSON(cfg, s.monitor.CameraClasses(cfg.ID)))
 		}
 	}
 
@@ -130,6 +132,8 @@ func (s *Server) httpSystemConstants(w http.ResponseWriter, r *http.Request, par
 	}
 	c := &constantsJSON{
 		CameraModels: cams,
+		NNClasses:    s.monitor.NNClasses(),
+		Classes:      s.monitor.SystemClasses(),
 	}
 	www.SendJSON(w, c)
 }
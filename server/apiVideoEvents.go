@@ -42,7 +42,8 @@ func (s *Server) httpVideoEventsGetTiles(w http.ResponseWriter, r *http.Request,
 	tiles, err := s.videoDB.ReadEventTiles(cam.LongLivedName(), tileRequest)
 	www.Check(err)
 
-	videoStartTime, err := s.videoDB.VideoStartTimeForCamera(cam.LongLivedName())
+	// A virtual camera has its own events, but its video is in the streams of its parent
+	videoStartTime, err := s.videoDB.VideoStartTimeForCamera(cam.RecordingCameraName())
 	if err != nil {
 		// If there is no video footage, then don't return any tiles.
 		tiles = []*videodb.EventTile{}
@@ -82,7 +83,14 @@ func (s *Server) httpVideoEventsGetDetails(w http.ResponseWriter, r *http.Reques
 	endTime := time.UnixMilli(www.RequiredQueryInt64(r, "endTime"))
 	cam := s.getCameraFromIDOrPanic(cameraID)
 
-	events, err := s.videoDB.ReadEvents(cam.LongLivedName(), startTime, endTime)
+	// If 'job' is specified, then we return the results that a re-analysis job stored alongside the original results
+	var events []*videodb.Event
+	var err error
+	if job := www.QueryInt64(r, "job"); job != 0 {
+		events, err = s.videoDB.ReadJobEvents(cam.LongLivedName(), job, startTime, endTime)
+	} else {
+		events, err = s.videoDB.ReadEvents(cam.LongLivedName(), startTime, endTime)
+	}
 	www.Check(err)
 
 	// Get all the IDs so that the caller doesn't need to make an additional call
@@ -2,10 +2,12 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"math"
 	"net/http"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bmharper/cimg/v2"
@@ -15,6 +17,7 @@ import (
 	"github.com/cyclopcam/cyclops/server/configdb"
 	"github.com/cyclopcam/cyclops/server/defs"
 	"github.com/cyclopcam/cyclops/server/streamer"
+	"github.com/cyclopcam/cyclops/server/transcoder"
 	"github.com/cyclopcam/www"
 	"github.com/julienschmidt/httprouter"
 )
@@ -52,10 +55,40 @@ type streamInfoJSON struct {
 // camInfoJSON holds information about a running camera. This is distinct from
 // it's configuration, which is stored in model.Camera
 type camInfoJSON struct {
-	ID   int64          `json:"id"`
-	Name string         `json:"name"`
-	LD   streamInfoJSON `json:"ld"`
-	HD   streamInfoJSON `json:"hd"`
+	ID    int64            `json:"id"`
+	Name  string           `json:"name"`
+	LD    streamInfoJSON   `json:"ld"`
+	HD    streamInfoJSON   `json:"hd"`
+	Clock *clockStatusJSON `json:"clock,omitempty"` // nil if we have not yet measured the camera's clock
+
+	// Virtual cameras play their parent's streams, so the client must crop them
+	ParentID int64  `json:"parentID,omitempty"`
+	Crop     string `json:"crop,omitempty"`
+
+	// The camera's class config, with its overrides applied to the system config
+	Classes *configdb.ClassesJSON `json:"classes"`
+}
+
+// SYNC-CLOCK-STATUS-JSON
+type clockStatusJSON struct {
+	MeasuredAt   int64   `json:"measuredAt"`   // Unix milliseconds
+	DriftSeconds float64 `json:"driftSeconds"` // Camera time minus server time (positive if the camera is ahead)
+	OutOfSync    bool    `json:"outOfSync"`    // True if the drift exceeds camera.MaxAcceptableClockDrift
+	DateTimeType string  `json:"dateTimeType"` // "Manual" or "NTP"
+	Error        string  `json:"error"`        // If not empty, then we failed to read the camera's clock
+}
+
+func toClockStatusJSON(c *camera.ClockStatus) *clockStatusJSON {
+	if c == nil {
+		return nil
+	}
+	return &clockStatusJSON{
+		MeasuredAt:   c.MeasuredAt.UnixMilli(),
+		DriftSeconds: c.Drift.Seconds(),
+		OutOfSync:    c.IsOutOfSync(),
+		DateTimeType: c.DateTimeType,
+		Error:        c.Error,
+	}
 }
 
 func toStreamInfoJSON(s *camera.Stream) streamInfoJSON {
@@ -76,27 +109,36 @@ func toStreamInfoJSON(s *camera.Stream) streamInfoJSON {
 	return r
 }
 
-func liveToCamInfoJSON(c *camera.Camera) *camInfoJSON {
+func liveToCamInfoJSON(c *camera.Camera, classes *configdb.ClassesJSON) *camInfoJSON {
 	r := &camInfoJSON{
-		ID:   c.ID(),
-		Name: c.Name(),
-		LD:   toStreamInfoJSON(c.LowStream),
-		HD:   toStreamInfoJSON(c.HighStream),
+		ID:      c.ID(),
+		Name:    c.Name(),
+		LD:      toStreamInfoJSON(c.LowStream),
+		HD:      toStreamInfoJSON(c.HighStream),
+		Clock:   toClockStatusJSON(c.ClockStatus()),
+		Classes: classes,
+	}
+	if c.IsVirtual() {
+		r.ParentID = c.Parent.ID()
+		r.Crop = c.Config.Load().Crop
 	}
 	return r
 }
 
-func cfgToCamInfoJSON(c *configdb.Camera) *camInfoJSON {
+func cfgToCamInfoJSON(c *configdb.Camera, classes *configdb.ClassesJSON) *camInfoJSON {
 	r := &camInfoJSON{
-		ID:   c.ID,
-		Name: c.Name,
+		ID:       c.ID,
+		Name:     c.Name,
+		ParentID: c.ParentID,
+		Crop:     c.Crop,
+		Classes:  classes,
 	}
 	return r
 }
 
 func (s *Server) httpCamGetInfo(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
 	cam := s.getCameraFromIDOrPanic(params.ByName("cameraID"))
-	www.SendJSON(w, liveToCamInfoJSON(cam))
+	www.SendJSON(w, liveToCamInfoJSON(cam, s.monitor.CameraClasses(cam.ID())))
 }
 
 // Fetch a low res JPG of the camera's last image.
@@ -143,6 +185,9 @@ func (s *Server) httpCamGetLatestImage(w http.ResponseWriter, r *http.Request, p
 
 // Fetch a high res MP4 of the camera's recent footage
 // default duration is 5 seconds
+// If the camera sends H265, and the client can't decode it, then specify codec=h264
+// to have the server transcode the video. If the camera has privacy masks, then the
+// video is always transcoded to H264, with the masks blacked out.
 // Example: curl -o recent.mp4 localhost:8080/camera/recentVideo/0?duration=15s
 func (s *Server) httpCamGetRecentVideo(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
 	cam := s.getCameraFromIDOrPanic(params.ByName("cameraID"))
@@ -150,6 +195,10 @@ func (s *Server) httpCamGetRecentVideo(w http.ResponseWriter, r *http.Request, p
 	if duration <= 0 {
 		duration = 5 * time.Second
 	}
+	codec := www.QueryValue(r, "codec")
+	if codec != "" && codec != "h264" {
+		www.PanicBadRequestf("Invalid codec. Only 'h264' is supported")
+	}
 
 	www.CacheNever(w)
 
@@ -158,6 +207,24 @@ func (s *Server) httpCamGetRecentVideo(w http.ResponseWriter, r *http.Request, p
 	raw, err := cam.ExtractHighRes(camera.ExtractMethodShallowClone, duration)
 	www.Check(err)
 	www.Check(raw.SaveToMP4(fn))
+	if cam.StreamHasPrivacyMasks() {
+		// Re-encode with the masks burned in. ffmpeg stretches the mask to the size of the video,
+		// so we only need the aspect ratio to be right.
+		width, height := 1920, 1080
+		if inf := cam.HighStream.Info(); inf != nil {
+			width, height = inf.Width, inf.Height
+		}
+		maskFile := s.TempFiles.GetOnceOff() + ".png"
+		www.Check(camera.WritePrivacyMaskPNG(cam.StreamPrivacyMask(width, height), maskFile))
+		masked := s.TempFiles.GetOnceOff() + ".mp4"
+		www.Check(videox.TranscodeToH264WithOverlay(fn, maskFile, masked))
+		fn = masked
+	} else if codec == "h264" && raw.Codec() != videox.CodecH264 {
+		// ffmpeg needs the .mp4 extension to choose the output format
+		transcoded := s.TempFiles.GetOnceOff() + ".mp4"
+		www.Check(videox.TranscodeToH264(fn, transcoded))
+		fn = transcoded
+	}
 
 	www.SendTempFile(w, r, fn, contentType)
 }
@@ -174,6 +241,28 @@ func (s *Server) httpCamStreamVideo(w http.ResponseWriter, r *http.Request, para
 		backlog = cam.LowDumper
 	}
 
+	// A transcoding profile (eg "480p") is for viewers with limited bandwidth, such as a phone on 4G.
+	// The transcoder is shared with anybody else watching the same stream with the same profile.
+	// The raw stream of a camera with privacy masks never leaves the server, so if no profile is
+	// specified, we transcode with the privacy profile. If that would exceed the transcoding
+	// CPU budget, then the viewer gets an error, rather than the raw stream.
+	profile := www.QueryValue(r, "profile")
+	if profile == "" && cam.StreamHasPrivacyMasks() {
+		profile = transcoder.PrivacyProfileName
+	}
+	if profile != "" {
+		t, err := s.transcoders.Acquire(cam.Name(), stream, profile, cam.StreamPrivacyMask)
+		if errors.Is(err, transcoder.ErrUnknownProfile) {
+			www.PanicBadRequestf("%v", err)
+		} else if errors.Is(err, transcoder.ErrOverBudget) {
+			www.Panic(http.StatusServiceUnavailable, err.Error())
+		}
+		www.Check(err)
+		defer s.transcoders.Release(t)
+		stream = t.Output
+		backlog = t.Backlog
+	}
+
 	s.Log.Infof("httpCamStreamVideo websocket upgrading")
 
 	conn, err := s.wsUpgrader.Upgrade(w, r, nil)
@@ -187,13 +276,20 @@ func (s *Server) httpCamStreamVideo(w http.ResponseWriter, r *http.Request, para
 
 	newDetections := s.monitor.AddWatcher(cam.ID())
 
-	streamer.RunVideoWebSocketStreamer(cam.Name(), s.Log, conn, stream, backlog, newDetections)
+	// Audio is opt-in, so that existing clients don't receive binary frames that they don't understand
+	sendAudio := www.QueryValue(r, "audio") == "1"
+
+	streamer.RunVideoWebSocketStreamer(cam.Name(), s.Log, conn, stream, backlog, newDetections, sendAudio)
 
 	s.monitor.RemoveWatcher(cam.ID(), newDetections)
 
 	s.Log.Infof("httpCamStreamVideo done")
 }
 
+func (s *Server) httpCamGetTranscodeProfiles(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	www.SendJSON(w, s.transcoders.Profiles())
+}
+
 func (s *Server) httpCamGetImage(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
 	cam := s.getCameraFromIDOrPanic(params.ByName("cameraID"))
 	res := parseResolutionOrPanic(params.ByName("resolution"))
@@ -277,6 +373,8 @@ func (s *Server) httpGetCameraImage(w http.ResponseWriter, cam *camera.Camera, r
 	if err != nil {
 		www.PanicServerErrorf("Failed to decode video: %v", err)
 	}
+	// The recordings are not masked, so that the masks can be changed after the fact
+	camera.ApplyPrivacyMaskRGB(cam.StreamPrivacyMask(img.Width, img.Height), img)
 
 	// Read events, so that the front-end can show boxes around detected objects.
 	events, err := s.videoDB.ReadEvents(cam.LongLivedName(), imgTime.Add(-time.Second), imgTime.Add(time.Second))
@@ -291,8 +389,9 @@ func (s *Server) httpGetCameraImage(w http.ResponseWriter, cam *camera.Camera, r
 		w.Header().Set("X-Analysis", string(jsAna))
 		if drawDetections {
 			classes := s.monitor.AllClasses()
+			camClasses := s.monitor.CameraClasses(cam.ID())
 			for _, obj := range analysis.Objects {
-				if classes[obj.Class] == "person" {
+				if camClasses.IsAlarm(classes[obj.Class]) {
 					box := obj.Frames[len(obj.Frames)-1].Box
 					img.DrawRectangle(int(box.X), int(box.Y), int(box.X2()), int(box.Y2()), 255, 50, 0)
 					img.DrawRectangle(int(box.X-1), int(box.Y-1), int(box.X2()+1), int(box.Y2()+1), 255, 0, 0)
@@ -414,10 +513,14 @@ func (s *Server) httpCamDebugSaveClip(w http.ResponseWriter, r *http.Request, pa
 	}
 	resolutions := []defs.Resolution{defs.ResLD, defs.ResHD}
 	for _, res := range resolutions {
-		result, err := s.videoDB.Archive.Read(cam.RecordingStreamName(res), []string{"video"}, time.UnixMilli(startTimeMS), time.UnixMilli(endTimeMS), fsv.ReadFlagSeekBackToKeyFrame)
+		result, err := s.videoDB.Archive.Read(cam.RecordingStreamName(res), []string{"video", "audio"}, time.UnixMilli(startTimeMS), time.UnixMilli(endTimeMS), fsv.ReadFlagSeekBackToKeyFrame)
 		www.Check(err)
 		pbuffer, err := videox.ExtractFsvPackets(result["video"].Codec, result["video"].NALS)
 		www.Check(err)
+		if audio := result["audio"]; audio != nil && len(audio.NALS) != 0 {
+			pbuffer.Audio, err = videox.ExtractFsvAudioPackets(audio)
+			www.Check(err)
+		}
 		fn := filepath.Join(s.configDB.GetConfig().Recording.Path, "clip-"+string(res)+".mp4")
 		www.Check(pbuffer.SaveToMP4(fn))
 	}
@@ -426,14 +529,52 @@ func (s *Server) httpCamDebugSaveClip(w http.ResponseWriter, r *http.Request, pa
 
 // Example usage: curl -u USERNAME:PASSWORD localhost:8080/api/camera/debug/stats
 func (s *Server) httpCamDebugStats(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
-	result := map[string]camera.StreamStats{}
+	result := map[string]any{}
+	nnStats := s.monitor.NNStats()
 	for _, cam := range s.LiveCameras.Cameras() {
 		result[cam.Name()+"-HD"] = cam.HighStream.RecentFrameStats()
 		result[cam.Name()+"-LD"] = cam.LowStream.RecentFrameStats()
+		if st, ok := nnStats[cam.ID()]; ok {
+			// Effective NN frame rate, which drops when the NN can't keep up with all cameras
+			result[cam.Name()+"-NN"] = st
+		}
 	}
 	www.SendJSON(w, result)
 }
 
+// Return the most recent measurement of the camera's clock drift, which is refreshed periodically.
+// Returns null if the camera's clock hasn't been measured yet.
+func (s *Server) httpCamGetClock(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	cam := s.getCameraFromIDOrPanic(params.ByName("cameraID"))
+	www.SendJSON(w, toClockStatusJSON(cam.ClockStatus()))
+}
+
+// Measure the camera's clock drift right now, instead of waiting for the periodic check.
+// Example usage: curl -X POST -u USERNAME:PASSWORD localhost:8080/api/camera/measureClock/1
+func (s *Server) httpCamMeasureClock(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	cam := s.getCameraFromIDOrPanic(params.ByName("cameraID"))
+	www.SendJSON(w, toClockStatusJSON(cam.MeasureClockDrift()))
+}
+
+// Fix the camera's clock.
+// If the 'ntpServer' query parameter is specified, then the camera is configured to
+// synchronize with that NTP server. Otherwise, the camera's clock is set manually to
+// the server's time.
+// Example usage: curl -X POST -u USERNAME:PASSWORD localhost:8080/api/camera/syncClock/1?ntpServer=pool.ntp.org
+func (s *Server) httpCamSyncClock(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
+	cam := s.getCameraFromIDOrPanic(params.ByName("cameraID"))
+	cfg := cam.Config.Load()
+	ntpServer := strings.TrimSpace(www.QueryValue(r, "ntpServer"))
+	if ntpServer != "" {
+		s.Log.Infof("Setting NTP server of camera %v (%v) to %v", cam.ID(), cam.Name(), ntpServer)
+		www.Check(camera.OnvifSetNTP(cfg.Host, cfg.Username, cfg.Password, ntpServer))
+	} else {
+		s.Log.Infof("Setting clock of camera %v (%v)", cam.ID(), cam.Name())
+		www.Check(camera.OnvifSetClock(cfg.Host, cfg.Username, cfg.Password))
+	}
+	www.SendJSON(w, toClockStatusJSON(cam.MeasureClockDrift()))
+}
+
 // Example usage: curl -u USERNAME:PASSWORD localhost:8080/api/camera/debug/frameTimes/1/HD
 func (s *Server) httpCamDebugFrameTimes(w http.ResponseWriter, r *http.Request, params httprouter.Params, user *configdb.User) {
 	cam := s.getCameraFromIDOrPanic(params.ByName("cameraID"))
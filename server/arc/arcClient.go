@@ -3,7 +3,9 @@ package arc
 import (
 	"archive/zip"
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os"
@@ -73,8 +75,51 @@ func UploadToArc_FixMe(credentials *ArcServerCredentials, lowRes, highRes string
 		return err
 	}
 	// Upload the zip file
+	return putZip(credentials, "/api/video", cameraName, &zipBuf)
+}
+
+// An image of something that our NN wrongly detected, such as a coat on a hanger that was
+// detected as a person. Arc uses these to retrain the NN.
+// SYNC-ARC-NEGATIVE-SAMPLE
+type NegativeSample struct {
+	ID    int64  `json:"id"`
+	Class string `json:"class"` // Class that was wrongly detected
+	Box   [4]int `json:"box"`   // Box of the detection inside the image, in pixels (x1,y1,x2,y2)
+	Image []byte `json:"-"`     // JPEG
+}
+
+// Share negative samples of a camera with an Arc server.
+// The zip file contains samples.json, which is the list of samples, and the image of each
+// sample, named {id}.jpg.
+func UploadNegativeSamplesToArc(credentials *ArcServerCredentials, cameraName string, samples []NegativeSample) error {
+	zipBuf := bytes.Buffer{}
+	zw := zip.NewWriter(&zipBuf)
+	for _, sample := range samples {
+		// JPEGs don't compress any further
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("%v.jpg", sample.ID), Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(sample.Image); err != nil {
+			return err
+		}
+	}
+	f, err := zw.Create("samples.json")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(samples); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return putZip(credentials, "/api/negativeSamples", cameraName, &zipBuf)
+}
+
+func putZip(credentials *ArcServerCredentials, path, cameraName string, zipBuf *bytes.Buffer) error {
 	query := www.EncodeQuery(map[string]string{"cameraName": cameraName})
-	req, err := http.NewRequest("PUT", credentials.ServerUrl+"/api/video?"+query, &zipBuf)
+	req, err := http.NewRequest("PUT", credentials.ServerUrl+path+"?"+query, zipBuf)
 	if err != nil {
 		return err
 	}
@@ -84,6 +129,7 @@ func UploadToArc_FixMe(credentials *ArcServerCredentials, lowRes, highRes string
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
 		return errors.New("Upload failed: " + www.FailedRequestSummary(resp, err))
 	}
@@ -25,10 +25,22 @@ type Camera struct {
 	LowStream  *Stream
 	HighStream *Stream
 	HighDumper *VideoRingBuffer
-	LowDecoder *VideoDecodeReader
+	LowDecoder *VideoDecodeReader // Nil for a virtual camera. Use Frames() to get the frames that we analyze.
 	LowDumper  *VideoRingBuffer
 	lowResURL  string
 	highResURL string
+
+	// If not nil, then this is a virtual camera, and the streams and ring buffers belong to Parent
+	Parent *Camera
+
+	// Decoder of the HD stream, which is only created when the camera has virtual children
+	highDecoderLock sync.Mutex
+	HighDecoder     *VideoDecodeReader
+
+	frames      FrameReader                       // Source of frames, with privacy masks applied
+	privacyMask atomic.Pointer[cachedPrivacyMask] // See PrivacyMask()
+
+	clock atomic.Pointer[ClockStatus] // Most recent clock drift measurement (nil if not yet measured)
 }
 
 func NewCamera(log logs.Log, cfg configdb.Camera, ringBufferSizeBytes int) (*Camera, error) {
@@ -46,6 +58,8 @@ func NewCamera(log logs.Log, cfg configdb.Camera, ringBufferSizeBytes int) (*Cam
 	lowDecoder := NewVideoDecodeReader()
 	high := NewStream(log, cfg.Name, "high", rtspInfo.PacketsAreAnnexBEncoded)
 	low := NewStream(log, cfg.Name, "low", rtspInfo.PacketsAreAnnexBEncoded)
+	// Audio is recorded alongside the HD video
+	high.EnableAudio = cfg.EnableAudio
 
 	cam := &Camera{
 		Log:        log,
@@ -57,6 +71,7 @@ func NewCamera(log logs.Log, cfg configdb.Camera, ringBufferSizeBytes int) (*Cam
 		lowResURL:  rtspInfo.LowResURL,
 		highResURL: rtspInfo.HighResURL,
 	}
+	cam.frames = &maskedReader{camera: cam, source: lowDecoder}
 	cam.Config.Store(&cfg)
 	return cam, nil
 }
@@ -73,6 +88,17 @@ func (c *Camera) LongLivedName() string {
 	return c.Config.Load().LongLivedName
 }
 
+// Returns true if this is a virtual camera (a cropped region of another camera)
+func (c *Camera) IsVirtual() bool {
+	return c.Parent != nil
+}
+
+// Returns the source of the frames that we show to the neural network.
+// Privacy masks have already been applied to these frames.
+func (c *Camera) Frames() FrameReader {
+	return c.frames
+}
+
 // The name of the low res recording stream in the video archive
 func (c *Camera) LowResRecordingStreamName() string {
 	return c.RecordingStreamName(defs.ResLD)
@@ -83,12 +109,26 @@ func (c *Camera) HighResRecordingStreamName() string {
 	return c.RecordingStreamName(defs.ResHD)
 }
 
-// The name of high/low res recording stream in the video archive
+// The long lived name of the camera whose streams contain our footage.
+// A virtual camera doesn't record anything itself, so this is its parent.
+func (c *Camera) RecordingCameraName() string {
+	if c.Parent != nil {
+		return c.Parent.RecordingCameraName()
+	}
+	return c.Config.Load().LongLivedName
+}
+
+// The name of high/low res recording stream in the video archive.
+// A virtual camera doesn't record anything itself, so these are the streams of its parent.
 func (c *Camera) RecordingStreamName(resolution defs.Resolution) string {
-	return videodb.VideoStreamNameForCamera(c.Config.Load().LongLivedName, resolution)
+	return videodb.VideoStreamNameForCamera(c.RecordingCameraName(), resolution)
 }
 
 func (c *Camera) Start() error {
+	if c.IsVirtual() {
+		// Our streams belong to our parent
+		return nil
+	}
 	if err := c.HighStream.Listen(c.highResURL); err != nil {
 		return err
 	}
@@ -110,6 +150,12 @@ func (c *Camera) Start() error {
 // Close the camera.
 // If wg is not nil, then you must use it to signal when all of your resources are closed.
 func (c *Camera) Close(wg *sync.WaitGroup) {
+	if c.IsVirtual() {
+		// Our streams belong to our parent, so we must not close them
+		c.LowStream = nil
+		c.HighStream = nil
+		return
+	}
 	if c.LowStream != nil {
 		c.LowStream.Close(wg)
 		c.LowStream = nil
@@ -136,7 +182,7 @@ func (c *Camera) LastPacketAt() time.Time {
 }
 
 func (c *Camera) LatestImage(contentType string) []byte {
-	img, _ := c.LowDecoder.LastImageCopy()
+	img, _ := c.frames.LastImageCopy()
 	if img == nil {
 		return nil
 	}
@@ -0,0 +1,44 @@
+package camera
+
+import (
+	"time"
+)
+
+// If a camera's clock differs from ours by more than this, then we consider it out of sync
+const MaxAcceptableClockDrift = 5 * time.Second
+
+// Result of the most recent attempt to measure the camera's clock drift
+type ClockStatus struct {
+	MeasuredAt   time.Time     // When we measured the drift
+	Drift        time.Duration // Camera time minus our time (positive if the camera is ahead of us)
+	DateTimeType string        // "Manual" or "NTP", as reported by the camera
+	Error        string        // If not empty, then the measurement failed, and Drift is meaningless
+}
+
+// Returns true if the measurement succeeded, and the drift is beyond MaxAcceptableClockDrift
+func (c *ClockStatus) IsOutOfSync() bool {
+	return c.Error == "" && c.Drift.Abs() > MaxAcceptableClockDrift
+}
+
+// Return the most recent clock drift measurement, or nil if we haven't measured it yet
+func (c *Camera) ClockStatus() *ClockStatus {
+	return c.clock.Load()
+}
+
+// Measure the camera's clock drift via ONVIF, and store the result.
+// This is a network operation, so it can take several seconds.
+func (c *Camera) MeasureClockDrift() *ClockStatus {
+	cfg := c.Config.Load()
+	status := &ClockStatus{
+		MeasuredAt: time.Now(),
+	}
+	clock, err := OnvifGetClock(cfg.Host, cfg.Username, cfg.Password)
+	if err != nil {
+		status.Error = err.Error()
+	} else {
+		status.Drift = clock.Drift
+		status.DateTimeType = clock.DateTimeType
+	}
+	c.clock.Store(status)
+	return status
+}
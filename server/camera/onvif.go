@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/use-go/onvif"
 	onvifDevice "github.com/use-go/onvif/device"
@@ -35,17 +36,17 @@ func onvifVerbose(format string, v ...any) {
 	}
 }
 
-// Use ONVIF to discover whatever we need to know about the device
-func OnvifGetDeviceInfo(host, username, password string) (*OnvifDeviceInfo, error) {
+// Connect to an ONVIF device
+func onvifConnect(host, username, password string) (*onvif.Device, error) {
 	// Create a special HTTP client that accepts insecure TLS connections.
 	// This is necessary for cameras that use self-signed certificates.
 	client := &http.Client{
 		Transport: &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		},
+		Timeout: 10 * time.Second,
 	}
 
-	// Connect to the camera
 	dev, err := onvif.NewDevice(onvif.DeviceParams{
 		Xaddr:      host,
 		Username:   username,
@@ -56,6 +57,16 @@ func OnvifGetDeviceInfo(host, username, password string) (*OnvifDeviceInfo, erro
 		onvifVerbose("Error connecting to device: %v\n", err)
 		return nil, err
 	}
+	return dev, nil
+}
+
+// Use ONVIF to discover whatever we need to know about the device
+func OnvifGetDeviceInfo(host, username, password string) (*OnvifDeviceInfo, error) {
+	// Connect to the camera
+	dev, err := onvifConnect(host, username, password)
+	if err != nil {
+		return nil, err
+	}
 
 	result := &OnvifDeviceInfo{}
 
@@ -88,3 +88,15 @@ func TestOnvif(t *testing.T) {
 	}
 	testStream(t, rtspInfo.HighResURL, rtspInfo)
 }
+
+// Read the camera's clock, and report how far it has drifted from ours.
+// This does not modify the camera.
+// Example:
+// CAMERA_HOST=192.168.10.10 CAMERA_USERNAME=admin CAMERA_PASSWORD=foo go test -v -run OnvifClock ./server/camera
+func TestOnvifClock(t *testing.T) {
+	d := loadTestCameraDetails(t)
+	clock, err := OnvifGetClock(d.Host, d.Username, d.Password)
+	require.NoError(t, err)
+	t.Logf("Camera time: %v (%v), TZ %v, drift %v", clock.CameraTime, clock.DateTimeType, clock.TimeZone, clock.Drift)
+	require.False(t, clock.CameraTime.IsZero())
+}
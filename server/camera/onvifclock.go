@@ -0,0 +1,198 @@
+package camera
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/use-go/onvif"
+	onvifDevice "github.com/use-go/onvif/device"
+	"github.com/use-go/onvif/xsd"
+	xsdOnvif "github.com/use-go/onvif/xsd/onvif"
+)
+
+// The clock of a camera, as reported by ONVIF GetSystemDateAndTime
+type OnvifClock struct {
+	CameraTime      time.Time     // UTC time reported by the camera
+	Drift           time.Duration // CameraTime minus our own time (positive if the camera is ahead of us)
+	DateTimeType    string        // "Manual" or "NTP"
+	TimeZone        string        // POSIX TZ string, eg "CST-8"
+	DaylightSavings bool          // True if the camera applies daylight savings
+}
+
+// The use-go/onvif library models UTCDateTime as a string, which loses the
+// nested Date and Time elements, so we parse the response ourselves.
+type onvifDateTimeXML struct {
+	Time struct {
+		Hour   int `xml:"Hour"`
+		Minute int `xml:"Minute"`
+		Second int `xml:"Second"`
+	} `xml:"Time"`
+	Date struct {
+		Year  int `xml:"Year"`
+		Month int `xml:"Month"`
+		Day   int `xml:"Day"`
+	} `xml:"Date"`
+}
+
+type onvifSystemDateAndTimeXML struct {
+	DateTimeType    string `xml:"DateTimeType"`
+	DaylightSavings bool   `xml:"DaylightSavings"`
+	TimeZone        struct {
+		TZ string `xml:"TZ"`
+	} `xml:"TimeZone"`
+	UTCDateTime onvifDateTimeXML `xml:"UTCDateTime"`
+}
+
+type onvifGetSystemDateAndTimeEnvelope struct {
+	Body struct {
+		Response struct {
+			SystemDateAndTime onvifSystemDateAndTimeXML `xml:"SystemDateAndTime"`
+		} `xml:"GetSystemDateAndTimeResponse"`
+	} `xml:"Body"`
+}
+
+// Read the camera's clock, and measure how far it has drifted from our own clock.
+// ONVIF only reports time to the nearest second, so the drift is not more precise
+// than that.
+func OnvifGetClock(host, username, password string) (*OnvifClock, error) {
+	dev, err := onvifConnect(host, username, password)
+	if err != nil {
+		return nil, err
+	}
+	return onvifGetClock(dev)
+}
+
+func onvifGetClock(dev *onvif.Device) (*OnvifClock, error) {
+	sent := time.Now()
+	resp, err := dev.CallMethod(onvifDevice.GetSystemDateAndTime{})
+	if err != nil {
+		return nil, err
+	}
+	received := time.Now()
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("GetSystemDateAndTime failed: %v", resp.Status)
+	}
+	envelope := onvifGetSystemDateAndTimeEnvelope{}
+	if err := xml.Unmarshal(body, &envelope); err != nil {
+		return nil, fmt.Errorf("Failed to decode GetSystemDateAndTime response: %w", err)
+	}
+	sdt := &envelope.Body.Response.SystemDateAndTime
+	ut := &sdt.UTCDateTime
+	if ut.Date.Year == 0 {
+		return nil, fmt.Errorf("Camera did not report UTC time")
+	}
+	cameraTime := time.Date(ut.Date.Year, time.Month(ut.Date.Month), ut.Date.Day, ut.Time.Hour, ut.Time.Minute, ut.Time.Second, 0, time.UTC)
+
+	// Assume the camera sampled its clock halfway through the round trip
+	ourTime := sent.Add(received.Sub(sent) / 2)
+
+	clock := &OnvifClock{
+		CameraTime:      cameraTime,
+		Drift:           cameraTime.Sub(ourTime).Round(time.Second),
+		DateTimeType:    sdt.DateTimeType,
+		TimeZone:        sdt.TimeZone.TZ,
+		DaylightSavings: sdt.DaylightSavings,
+	}
+	onvifVerbose("Camera clock: %v (%v), drift %v\n", clock.CameraTime, clock.DateTimeType, clock.Drift)
+	return clock, nil
+}
+
+// Invoke an ONVIF method that has an empty response.
+// We don't use the sdk Call_ functions for these, because they don't report SOAP faults.
+func onvifCallNoReply(dev *onvif.Device, method any) error {
+	resp, err := dev.CallMethod(method)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		onvifVerbose("ONVIF error response: %v\n", string(body))
+		return fmt.Errorf("%v", resp.Status)
+	}
+	return nil
+}
+
+func onvifMakeDateTime(t time.Time) xsdOnvif.DateTime {
+	t = t.UTC()
+	dt := xsdOnvif.DateTime{}
+	dt.Date.Year = xsd.Int(t.Year())
+	dt.Date.Month = xsd.Int(t.Month())
+	dt.Date.Day = xsd.Int(t.Day())
+	dt.Time.Hour = xsd.Int(t.Hour())
+	dt.Time.Minute = xsd.Int(t.Minute())
+	dt.Time.Second = xsd.Int(t.Second())
+	return dt
+}
+
+// Set the camera's clock manually to our own time.
+// The camera's time zone and daylight savings settings are preserved.
+func OnvifSetClock(host, username, password string) error {
+	dev, err := onvifConnect(host, username, password)
+	if err != nil {
+		return err
+	}
+	current, err := onvifGetClock(dev)
+	if err != nil {
+		return err
+	}
+	// Round to the nearest second, because ONVIF has no sub-second precision
+	now := time.Now().Round(time.Second)
+	return onvifCallNoReply(dev, onvifDevice.SetSystemDateAndTime{
+		DateTimeType:    "Manual",
+		DaylightSavings: xsd.Boolean(current.DaylightSavings),
+		TimeZone:        xsdOnvif.TimeZone{TZ: xsd.Token(current.TimeZone)},
+		UTCDateTime:     onvifMakeDateTime(now),
+	})
+}
+
+// Configure the camera to synchronize its clock with the given NTP server.
+// ntpServer can be an IP address or a hostname.
+func OnvifSetNTP(host, username, password, ntpServer string) error {
+	dev, err := onvifConnect(host, username, password)
+	if err != nil {
+		return err
+	}
+	current, err := onvifGetClock(dev)
+	if err != nil {
+		return err
+	}
+
+	ntpHost := xsdOnvif.NetworkHost{}
+	if ip := net.ParseIP(ntpServer); ip == nil {
+		ntpHost.Type = "DNS"
+		ntpHost.DNSname = xsdOnvif.DNSName(ntpServer)
+	} else if ip.To4() != nil {
+		ntpHost.Type = "IPv4"
+		ntpHost.IPv4Address = xsdOnvif.IPv4Address(ntpServer)
+	} else {
+		ntpHost.Type = "IPv6"
+		ntpHost.IPv6Address = xsdOnvif.IPv6Address(ntpServer)
+	}
+	if err := onvifCallNoReply(dev, onvifDevice.SetNTP{
+		FromDHCP:  false,
+		NTPManual: ntpHost,
+	}); err != nil {
+		return fmt.Errorf("SetNTP failed: %w", err)
+	}
+
+	// UTCDateTime is ignored by the camera when DateTimeType is NTP, but some cameras
+	// reject the request if it's not a valid time.
+	if err := onvifCallNoReply(dev, onvifDevice.SetSystemDateAndTime{
+		DateTimeType:    "NTP",
+		DaylightSavings: xsd.Boolean(current.DaylightSavings),
+		TimeZone:        xsdOnvif.TimeZone{TZ: xsd.Token(current.TimeZone)},
+		UTCDateTime:     onvifMakeDateTime(time.Now()),
+	}); err != nil {
+		return fmt.Errorf("SetSystemDateAndTime failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package camera
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"time"
+
+	"github.com/bmharper/cimg/v2"
+	"github.com/cyclopcam/cyclops/pkg/accel"
+	"github.com/cyclopcam/cyclops/server/configdb"
+)
+
+// A rasterized privacy mask, along with the config that produced it.
+// Rasterizing is cheap, but not cheap enough to do on every frame.
+type cachedPrivacyMask struct {
+	key  string
+	mask *configdb.PrivacyMask // nil if there are no masks
+}
+
+// Returns the privacy mask for frames of this camera, at the given resolution, or nil if the camera has no masks.
+// For a virtual camera, this includes the masks of its parent, mapped into the crop.
+// The config may change at any time, so call this for every frame.
+func (c *Camera) PrivacyMask(width, height int) *configdb.PrivacyMask {
+	cfg := c.Config.Load()
+	key := fmt.Sprintf("%v|%v|%v", width, height, cfg.PrivacyMasks)
+	if c.Parent != nil {
+		key += "|" + cfg.Crop + "|" + c.Parent.Config.Load().PrivacyMasks
+	}
+	if cached := c.privacyMask.Load(); cached != nil && cached.key == key {
+		return cached.mask
+	}
+
+	// The masks have been validated by the API, so errors here are unexpected. We fail closed,
+	// by hiding the whole frame, because leaking what's behind a mask is worse than a black image.
+	polygons, err := c.privacyPolygons()
+	if err != nil {
+		c.Log.Errorf("Invalid privacy masks. Hiding the entire frame: %v", err)
+		polygons = []configdb.Polygon{{{X: 0, Y: 0}, {X: 1, Y: 0}, {X: 1, Y: 1}, {X: 0, Y: 1}}}
+	}
+	mask := configdb.RasterizePrivacyMasks(polygons, width, height)
+	c.privacyMask.Store(&cachedPrivacyMask{key: key, mask: mask})
+	return mask
+}
+
+// Returns the privacy mask of the camera's raw streams.
+// A virtual camera shares its parent's streams, so this is the parent's mask.
+func (c *Camera) StreamPrivacyMask(width, height int) *configdb.PrivacyMask {
+	if c.Parent != nil {
+		return c.Parent.PrivacyMask(width, height)
+	}
+	return c.PrivacyMask(width, height)
+}
+
+// Returns true if the camera's raw streams must not leave the server, because they contain areas that must be hidden
+func (c *Camera) StreamHasPrivacyMasks() bool {
+	if c.Parent != nil {
+		return c.Parent.StreamHasPrivacyMasks()
+	}
+	return c.Config.Load().HasPrivacyMasks()
+}
+
+func (c *Camera) privacyPolygons() ([]configdb.Polygon, error) {
+	cfg := c.Config.Load()
+	polygons, err := configdb.ParsePrivacyMasks(cfg.PrivacyMasks)
+	if err != nil {
+		return nil, err
+	}
+	if c.Parent != nil {
+		parentPolygons, err := configdb.ParsePrivacyMasks(c.Parent.Config.Load().PrivacyMasks)
+		if err != nil {
+			return nil, err
+		}
+		crop, err := configdb.ParseCropRect(cfg.Crop)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range parentPolygons {
+			polygons = append(polygons, crop.MapPolygon(p))
+		}
+	}
+	return polygons, nil
+}
+
+// Black out the hidden pixels of a YUV420p image.
+// A chroma sample is blacked out if any of the 4 luma pixels that it covers are hidden.
+func ApplyPrivacyMaskYUV(mask *configdb.PrivacyMask, img *accel.YUVImage) {
+	if mask == nil {
+		return
+	}
+	if mask.Width != img.Width || mask.Height != img.Height {
+		panic("Privacy mask is not the same size as the image")
+	}
+	yStride := img.YStride()
+	uStride := img.UStride()
+	vStride := img.VStride()
+	for y := 0; y < img.Height; y++ {
+		hidden := mask.Hidden[y*mask.Width : (y+1)*mask.Width]
+		row := img.Y[y*yStride:]
+		uRow := img.U[(y/2)*uStride:]
+		vRow := img.V[(y/2)*vStride:]
+		for x, h := range hidden {
+			if h != 0 {
+				row[x] = 16
+				uRow[x/2] = 128
+				vRow[x/2] = 128
+			}
+		}
+	}
+}
+
+// Black out the hidden pixels of an RGB (or any other interleaved format) image
+func ApplyPrivacyMaskRGB(mask *configdb.PrivacyMask, img *cimg.Image) {
+	if mask == nil {
+		return
+	}
+	if mask.Width != img.Width || mask.Height != img.Height {
+		panic("Privacy mask is not the same size as the image")
+	}
+	nchan := img.NChan()
+	for y := 0; y < img.Height; y++ {
+		hidden := mask.Hidden[y*mask.Width : (y+1)*mask.Width]
+		row := img.Pixels[y*img.Stride:]
+		for x, h := range hidden {
+			if h != 0 {
+				clear(row[x*nchan : (x+1)*nchan])
+			}
+		}
+	}
+}
+
+// Write the mask as a PNG that is black where pixels are hidden, and transparent elsewhere.
+// This is for overlaying onto a video with ffmpeg.
+func WritePrivacyMaskPNG(mask *configdb.PrivacyMask, filename string) error {
+	img := image.NewNRGBA(image.Rect(0, 0, mask.Width, mask.Height))
+	for y := 0; y < mask.Height; y++ {
+		for x := 0; x < mask.Width; x++ {
+			if mask.IsHidden(x, y) {
+				img.SetNRGBA(x, y, color.NRGBA{0, 0, 0, 255})
+			}
+		}
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// maskedReader applies the camera's privacy masks to the frames of another reader.
+// Every camera's frames pass through one of these, so that hidden areas never
+// reach the neural network, or the JPEG endpoints.
+type maskedReader struct {
+	camera *Camera
+	source FrameReader
+}
+
+func (r *maskedReader) GetLastImageIfDifferent(ifNotEqualTo int64) (*accel.YUVImage, int64, time.Time) {
+	// The image is a copy, so we're free to modify it
+	img, id, pts := r.source.GetLastImageIfDifferent(ifNotEqualTo)
+	if img != nil {
+		ApplyPrivacyMaskYUV(r.camera.PrivacyMask(img.Width, img.Height), img)
+	}
+	return img, id, pts
+}
+
+func (r *maskedReader) LastImageCopy() (*accel.YUVImage, int64) {
+	img, id := r.source.LastImageCopy()
+	if img != nil {
+		ApplyPrivacyMaskYUV(r.camera.PrivacyMask(img.Width, img.Height), img)
+	}
+	return img, id
+}
@@ -36,11 +36,17 @@ type StandardStreamSink interface {
 	Close()                                 // Called by RunStandardStream(), when it receives a StreamMsgTypeClose
 }
 
+// AudioStreamSink is an optional extension of StandardStreamSink, for sinks that want audio
+type AudioStreamSink interface {
+	OnPacketAudio(packet *videox.AudioPacket) // Called by RunStandardStream(), when it receives a StreamMsgTypeAudio
+}
+
 type StreamMsgType int
 
 const (
 	StreamMsgTypePacket StreamMsgType = iota // New camera packet
 	StreamMsgTypeClose                       // Close yourself. There will be no further packets.
+	StreamMsgTypeAudio                       // New audio packet. Only sent if the stream has audio enabled.
 )
 
 // StreamMsg is sent on a channel from the stream to a sink
@@ -48,6 +54,7 @@ type StreamMsg struct {
 	Type   StreamMsgType
 	Stream *Stream
 	Packet *videox.VideoPacket
+	Audio  *videox.AudioPacket // Only for StreamMsgTypeAudio
 }
 
 // There isn't much rhyme or reason behind this number
@@ -117,6 +124,11 @@ type Stream struct {
 	StreamName string // The stream name, such as "low" and "high"
 	Codec      videox.Codec
 
+	// If EnableAudio is true, then Listen() also subscribes to the camera's audio track, if it has one.
+	// AudioCodec is populated by Listen(), and is AudioCodecUnknown if we're not receiving audio.
+	EnableAudio bool
+	AudioCodec  videox.AudioCodec
+
 	// These are read at the start of Listen(), and will be populated before Listen() returns
 	//H264TrackID int                  // 0-based track index
 	//H264Track   *gortsplib.TrackH264 // track object
@@ -132,7 +144,9 @@ type Stream struct {
 	livenessLock                 sync.Mutex
 	livenessLastPacketReceivedAt time.Time
 
-	// Used to infer real time from packet's relative timestamps
+	// Used to infer real time from packet's relative timestamps.
+	// The audio and video callbacks can run on different threads, so these are guarded by refTimeLock.
+	refTimeLock         sync.Mutex
 	refTimeWall         time.Time
 	refTimeCameraOffset time.Duration
 
@@ -240,6 +254,14 @@ func (s *Stream) Listen(address string) error {
 
 	client.Setup(session.BaseURL, media, 0, 0)
 
+	s.AudioCodec = videox.AudioCodecUnknown
+	if s.EnableAudio {
+		if err := s.setupAudio(client, session); err != nil {
+			// Don't let a broken audio track stop us from recording video
+			s.Log.Warnf("Failed to setup audio: %v", err)
+		}
+	}
+
 	s.Log.Infof("Connected to %v, track media ID %v, codec %v", camHost, media.ID, s.Codec.InternalName())
 
 	//rawRecvID := atomic.Int64{}
@@ -304,6 +326,7 @@ func (s *Stream) Listen(address string) error {
 		// perceived time, then use the camera's time.
 
 		// establish reference time
+		s.refTimeLock.Lock()
 		if s.refTimeWall.IsZero() && len(nalus) != 0 {
 			s.refTimeWall = now
 			s.refTimeCameraOffset = pts
@@ -317,6 +340,7 @@ func (s *Stream) Listen(address string) error {
 			//	fmt.Printf("ntp: %v, refTime: %v\n", ntp, refTime)
 			//}
 		}
+		s.refTimeLock.Unlock()
 
 		// Before we return, we must clone the packet. This is because we send
 		// the packet via channels, to all of our stream sinks. These sinks
@@ -336,40 +360,7 @@ func (s *Stream) Listen(address string) error {
 		cloned := videox.ClonePacket(nalus, s.Codec, pts, now, refTime, s.cameraSendsAnnexBEncoded)
 		cloned.ValidRecvID = myValidPacketID
 
-		// Populate width & height whenever an SPS packet is sent.
-		// Initially, we only did this if s.info was nil. However, I subsequently decided
-		// to support the camera changing resolution while the system is running.
-		// On Rpi5, reading the SPS takes about 300ns, and I believe we only get an SPS
-		// with every keyframe, so this is a tiny price to pay.
-		if inf := s.extractSPSInfo(cloned); inf != nil {
-			s.infoLock.Lock()
-			prev := s.info
-			s.info = inf
-			s.infoLock.Unlock()
-			if prev == nil {
-				s.Log.Infof("Size: %v x %v (after %v packets)", inf.Width, inf.Height, myValidPacketID)
-			} else if prev.Width != inf.Width || prev.Height != inf.Height {
-				s.Log.Infof("Size changed from %v x %v to %v x %v", prev.Width, prev.Height, inf.Width, inf.Height)
-			}
-		}
-
-		s.addFrameToStats(cloned)
-
-		// Obtain the sinks lock, so that we can't send packets after a Close message has been sent.
-		s.sinksLock.Lock()
-		if !s.isClosed {
-			for _, sink := range s.sinks {
-				a := time.Now()
-				s.sendSinkMsg(sink.sink, StreamMsgTypePacket, cloned)
-				elapsed := time.Now().Sub(a)
-				if elapsed > 5*time.Millisecond {
-					// On my Rpi5, 5ms is a normal delay here. I suspect it's the NCNN threads hogging the CPU
-					// On my Ryzen, times are always below 1ms.
-					s.Log.Warnf("Slow stream sink '%v' (%v)", sink.name, elapsed)
-				}
-			}
-		}
-		s.sinksLock.Unlock()
+		s.PublishPacket(cloned)
 	})
 
 	// start playback
@@ -383,6 +374,46 @@ func (s *Stream) Listen(address string) error {
 	return nil
 }
 
+// PublishPacket sends a packet to all of the stream's sinks.
+// Listen() calls this for every packet that it receives from the camera. A stream that is
+// not connected to a camera (eg the output of a transcoder) calls this directly.
+func (s *Stream) PublishPacket(packet *videox.VideoPacket) {
+	// Populate width & height whenever an SPS packet is sent.
+	// Initially, we only did this if s.info was nil. However, I subsequently decided
+	// to support the camera changing resolution while the system is running.
+	// On Rpi5, reading the SPS takes about 300ns, and I believe we only get an SPS
+	// with every keyframe, so this is a tiny price to pay.
+	if inf := s.extractSPSInfo(packet); inf != nil {
+		s.infoLock.Lock()
+		prev := s.info
+		s.info = inf
+		s.infoLock.Unlock()
+		if prev == nil {
+			s.Log.Infof("Size: %v x %v (after %v packets)", inf.Width, inf.Height, packet.ValidRecvID)
+		} else if prev.Width != inf.Width || prev.Height != inf.Height {
+			s.Log.Infof("Size changed from %v x %v to %v x %v", prev.Width, prev.Height, inf.Width, inf.Height)
+		}
+	}
+
+	s.addFrameToStats(packet)
+
+	// Obtain the sinks lock, so that we can't send packets after a Close message has been sent.
+	s.sinksLock.Lock()
+	if !s.isClosed {
+		for _, sink := range s.sinks {
+			a := time.Now()
+			s.sendSinkMsg(sink.sink, StreamMsgTypePacket, packet)
+			elapsed := time.Now().Sub(a)
+			if elapsed > 5*time.Millisecond {
+				// On my Rpi5, 5ms is a normal delay here. I suspect it's the NCNN threads hogging the CPU
+				// On my Ryzen, times are always below 1ms.
+				s.Log.Warnf("Slow stream sink '%v' (%v)", sink.name, elapsed)
+			}
+		}
+	}
+	s.sinksLock.Unlock()
+}
+
 // Close the stream.
 // If wg is not nil, then you must call wg.Done() once all of your sinks have closed themselves.
 func (s *Stream) Close(wg *sync.WaitGroup) {
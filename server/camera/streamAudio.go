@@ -0,0 +1,138 @@
+package camera
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/bluenviron/gortsplib/v4/pkg/format/rtpmpeg4audio"
+	"github.com/bluenviron/mediacommon/pkg/codecs/mpeg4audio"
+	"github.com/cyclopcam/cyclops/pkg/videox"
+	"github.com/pion/rtp"
+)
+
+// Find the camera's audio track, and subscribe to it.
+// We understand AAC and G.711, which covers the microphones of every camera that I've seen.
+// If the camera has no audio track that we understand, then we return nil, and AudioCodec
+// remains AudioCodecUnknown.
+func (s *Stream) setupAudio(client *gortsplib.Client, session *description.Session) error {
+	var formaAAC *format.MPEG4Audio
+	var formaG711 *format.G711
+
+	if media := session.FindFormat(&formaAAC); media != nil {
+		config := formaAAC.GetConfig()
+		if config == nil {
+			return fmt.Errorf("AAC track has no config")
+		}
+		decoder, err := formaAAC.CreateDecoder()
+		if err != nil {
+			return fmt.Errorf("Failed to create AAC decoder: %w", err)
+		}
+		if _, err := client.Setup(session.BaseURL, media, 0, 0); err != nil {
+			return err
+		}
+		s.AudioCodec = videox.AudioCodecAAC
+		s.Log.Infof("Audio: AAC, %v Hz, %v channels", config.SampleRate, config.ChannelCount)
+
+		client.OnPacketRTP(media, formaAAC, func(pkt *rtp.Packet) {
+			pts, ok := client.PacketPTS(media, pkt)
+			if !ok {
+				return
+			}
+			aus, err := decoder.Decode(pkt)
+			if err != nil {
+				if !errors.Is(err, rtpmpeg4audio.ErrMorePacketsNeeded) {
+					s.Log.Errorf("Failed to decode AAC packet: %v", err)
+				}
+				return
+			}
+			// An RTP packet can hold several access units, each of which is 1024 samples long
+			for i, au := range aus {
+				// AACAddADTS makes a copy of 'au', so it's safe to send to our sinks
+				adts, err := videox.AACAddADTS(au, config)
+				if err != nil {
+					s.Log.Errorf("Failed to add ADTS header: %v", err)
+					return
+				}
+				offset := time.Duration(i*mpeg4audio.SamplesPerAccessUnit) * time.Second / time.Duration(config.SampleRate)
+				s.sendAudio(&videox.AudioPacket{
+					Codec:      videox.AudioCodecAAC,
+					SampleRate: config.SampleRate,
+					Channels:   config.ChannelCount,
+					PTS:        pts + offset,
+					Payload:    adts,
+				})
+			}
+		})
+		return nil
+	}
+
+	if media := session.FindFormat(&formaG711); media != nil {
+		decoder, err := formaG711.CreateDecoder()
+		if err != nil {
+			return fmt.Errorf("Failed to create G.711 decoder: %w", err)
+		}
+		if _, err := client.Setup(session.BaseURL, media, 0, 0); err != nil {
+			return err
+		}
+		codec := videox.AudioCodecPCMA
+		if formaG711.MULaw {
+			codec = videox.AudioCodecPCMU
+		}
+		s.AudioCodec = codec
+		s.Log.Infof("Audio: %v, %v Hz, %v channels", codec, formaG711.SampleRate, formaG711.ChannelCount)
+
+		client.OnPacketRTP(media, formaG711, func(pkt *rtp.Packet) {
+			pts, ok := client.PacketPTS(media, pkt)
+			if !ok {
+				return
+			}
+			samples, err := decoder.Decode(pkt)
+			if err != nil {
+				s.Log.Errorf("Failed to decode G.711 packet: %v", err)
+				return
+			}
+			s.sendAudio(&videox.AudioPacket{
+				Codec:      codec,
+				SampleRate: formaG711.SampleRate,
+				Channels:   formaG711.ChannelCount,
+				PTS:        pts,
+				// gortsplib re-uses its buffers, so we must copy
+				Payload: append([]byte(nil), samples...),
+			})
+		})
+		return nil
+	}
+
+	s.Log.Infof("Audio enabled, but camera has no AAC or G.711 audio track")
+	return nil
+}
+
+// Populate WallPTS and send the packet to our sinks.
+// Audio that arrives before the first video packet is dropped, because we don't
+// yet have a reference time.
+func (s *Stream) sendAudio(packet *videox.AudioPacket) {
+	s.refTimeLock.Lock()
+	if s.refTimeWall.IsZero() {
+		s.refTimeLock.Unlock()
+		return
+	}
+	packet.WallPTS = s.refTimeWall.Add(packet.PTS - s.refTimeCameraOffset)
+	s.refTimeLock.Unlock()
+
+	s.sinksLock.Lock()
+	defer s.sinksLock.Unlock()
+	if s.isClosed {
+		return
+	}
+	for _, sink := range s.sinks {
+		sink.sink <- StreamMsg{
+			Type:   StreamMsgTypeAudio,
+			Stream: s,
+			Audio:  packet,
+		}
+	}
+}
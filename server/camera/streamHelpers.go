@@ -17,6 +17,10 @@ func RunStandardStream(stream *Stream, sink StandardStreamSink, ch StreamSinkCha
 			case StreamMsgTypePacket:
 				//fmt.Printf("RunStandardStream StreamMsgTypePacket\n")
 				sink.OnPacketRTP(msg.Packet)
+			case StreamMsgTypeAudio:
+				if audioSink, ok := sink.(AudioStreamSink); ok {
+					audioSink.OnPacketAudio(msg.Audio)
+				}
 			}
 		}
 	}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/cyclopcam/cyclops/pkg/accel"
 	"github.com/cyclopcam/cyclops/pkg/videox"
+	"github.com/cyclopcam/cyclops/server/configdb"
 	"github.com/cyclopcam/logs"
 )
 
@@ -81,6 +82,18 @@ func (r *VideoDecodeReader) GetLastImageIfDifferent(ifNotEqualTo int64) (*accel.
 	return r.lastImg.Clone(), r.lastImgID, r.lastImgPTS
 }
 
+// Return a copy of a crop of the latest image and its ID, if it's different to the given ID.
+// This is cheaper than GetLastImageIfDifferent followed by a crop, because we only copy the pixels inside the crop.
+func (r *VideoDecodeReader) GetLastImageCropIfDifferent(ifNotEqualTo int64, crop configdb.CropRect) (*accel.YUVImage, int64, time.Time) {
+	r.lastImgLock.Lock()
+	defer r.lastImgLock.Unlock()
+	if r.lastImg == nil || r.lastImgID == ifNotEqualTo {
+		return nil, 0, time.Time{}
+	}
+	x, y, width, height := crop.Pixels(r.lastImg.Width, r.lastImg.Height)
+	return cropYUV(r.lastImg, x, y, width, height), r.lastImgID, r.lastImgPTS
+}
+
 // Return the time when the last packet was received
 func (r *VideoDecodeReader) LastPacketAt() time.Time {
 	t := r.lastPacketAt.Load()
@@ -155,6 +168,29 @@ func (r *VideoDecodeReader) OnPacketRTP(packet *videox.VideoPacket) {
 	//r.Log.Infof("[Packet %v] Decoded frame with size %v", r.nPackets, img.Bounds().Max)
 }
 
+// Copy a rectangle out of a YUV420p image, into a new tightly packed image.
+// x, y, width and height must be even.
+func cropYUV(src *accel.YUVImage, x, y, width, height int) *accel.YUVImage {
+	dst := &accel.YUVImage{
+		Width:  width,
+		Height: height,
+		Y:      make([]byte, width*height),
+		U:      make([]byte, width*height/4),
+		V:      make([]byte, width*height/4),
+	}
+	srcYStride := src.YStride()
+	for i := 0; i < height; i++ {
+		copy(dst.Y[i*width:(i+1)*width], src.Y[(y+i)*srcYStride+x:])
+	}
+	srcUStride := src.UStride()
+	srcVStride := src.VStride()
+	for i := 0; i < height/2; i++ {
+		copy(dst.U[i*width/2:(i+1)*width/2], src.U[(y/2+i)*srcUStride+x/2:])
+		copy(dst.V[i*width/2:(i+1)*width/2], src.V[(y/2+i)*srcVStride+x/2:])
+	}
+	return dst
+}
+
 func (r *VideoDecodeReader) cloneIntoLastImg(latest *accel.YUVImage, pts time.Time) {
 	r.lastImgLock.Lock()
 	if r.lastImg == nil ||
@@ -16,6 +16,7 @@ import (
 // For event-triggered recording modes, this is vital because you always
 // want some history that preceded the moment of the event trigger.
 // For continuous recording modes this is not important.
+// If the camera has audio enabled, then the audio is written to the "audio" track.
 type VideoRecorder struct {
 	Log              logs.Log
 	ringBuffer       *VideoRingBuffer
@@ -23,6 +24,7 @@ type VideoRecorder struct {
 	streamName       string
 	stop             chan bool
 	onPacket         chan *videox.VideoPacket
+	onAudio          chan *videox.AudioPacket
 	videoWidth       int
 	videoHeight      int
 	lastWriteWarning time.Time
@@ -46,6 +48,8 @@ func StartVideoRecorder(ringBuffer *VideoRingBuffer, streamName string, archive
 		// will probably work just fine in practice, but I would prefer to have a
 		// bullet-proof solution.
 		onPacket: make(chan *videox.VideoPacket, 10),
+		// Audio packets are much more frequent than video packets (eg 50 per second for G.711)
+		onAudio: make(chan *videox.AudioPacket, 50),
 	}
 	r.start(includeHistory)
 	return r
@@ -104,6 +108,7 @@ func (r *VideoRecorder) recordFunc(includeHistory time.Duration) {
 					// This guarantees that we don't miss any packets.
 					waitingForIDR = false
 					r.ringBuffer.AddPacketListener("VideoRecorder", r.onPacket, FullChannelPolicyDrop)
+					r.ringBuffer.AddAudioListener("VideoRecorder", r.onAudio)
 				}
 			}
 			r.ringBuffer.BufferLock.Unlock()
@@ -115,6 +120,7 @@ func (r *VideoRecorder) recordFunc(includeHistory time.Duration) {
 				// fill up the write buffer of Archive. This is why immediately after writing our backlog,
 				// we trigger a flush of the write buffer.
 				r.writePackets(history.Packets)
+				r.writeAudio(history.Audio)
 				r.archive.TriggerWriterBufferFlush()
 			}
 		}
@@ -127,11 +133,15 @@ func (r *VideoRecorder) recordFunc(includeHistory time.Duration) {
 		case <-r.stop:
 			r.Log.Infof("Recorder stopping")
 			r.ringBuffer.RemovePacketListener(r.onPacket)
+			r.ringBuffer.RemoveAudioListener(r.onAudio)
 			gen.DrainChannel(r.onPacket)
+			gen.DrainChannel(r.onAudio)
 			r.Log.Infof("Recorder stopped after %v", time.Since(startAt))
 			return
 		case packet := <-r.onPacket:
 			r.writePackets([]*videox.VideoPacket{packet})
+		case packet := <-r.onAudio:
+			r.writeAudio([]*videox.AudioPacket{packet})
 		}
 	}
 }
@@ -178,6 +188,29 @@ func (r *VideoRecorder) writePackets(packets []*videox.VideoPacket) {
 	tracks := map[string]fsv.TrackPayload{
 		"video": fsv.MakeVideoPayload(videox.CodecToFsv(packets[0].Codec), r.videoWidth, r.videoHeight, nalus),
 	}
+	r.writeTracks(tracks)
+}
+
+func (r *VideoRecorder) writeAudio(packets []*videox.AudioPacket) {
+	if len(packets) == 0 {
+		return
+	}
+	nalus := make([]fsv.NALU, 0, len(packets))
+	for _, p := range packets {
+		nalus = append(nalus, fsv.NALU{
+			PTS:     p.WallPTS,
+			Flags:   fsv.NALUFlagKeyFrame,
+			Payload: p.Payload,
+		})
+	}
+	first := packets[0]
+	tracks := map[string]fsv.TrackPayload{
+		"audio": fsv.MakeAudioPayload(videox.AudioCodecToFsv(first.Codec), first.SampleRate, first.Channels, nalus),
+	}
+	r.writeTracks(tracks)
+}
+
+func (r *VideoRecorder) writeTracks(tracks map[string]fsv.TrackPayload) {
 	if err := r.archive.Write(r.streamName, tracks); err != nil {
 		now := time.Now()
 		if now.Sub(r.lastWriteWarning) > time.Second*30 {
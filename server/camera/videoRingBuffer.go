@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/bluenviron/mediacommon/pkg/codecs/h264"
+	"github.com/bluenviron/mediacommon/pkg/codecs/h265"
 	"github.com/bmharper/ringbuffer"
 	"github.com/cyclopcam/cyclops/pkg/videox"
 	"github.com/cyclopcam/logs"
@@ -47,6 +48,15 @@ type RingBufferListener struct {
 	nStalled   int
 }
 
+// AudioRingBufferListener receives audio packets from the ring buffer.
+// Audio is small, so if the channel is full, we always drop.
+type AudioRingBufferListener struct {
+	Name       string
+	Chan       chan *videox.AudioPacket
+	lastLogMsg time.Time
+	nDropped   int
+}
+
 /*
 SYNC-MAX-TRAIN-RECORD-TIME
 
@@ -84,11 +94,13 @@ buffer would be only 4800 KB, and that would be an insanely long recording.
 type VideoRingBuffer struct {
 	Log logs.Log
 
-	BufferLock sync.Mutex // Guards all access to Buffer
+	BufferLock sync.Mutex // Guards all access to Buffer and Audio
 	Buffer     ringbuffer.WeightedRingT[videox.VideoPacket]
+	Audio      []*videox.AudioPacket // Audio that overlaps the video in Buffer, oldest first
 
 	packetListenerLock sync.Mutex
 	packetListeners    []*RingBufferListener
+	audioListeners     []*AudioRingBufferListener
 
 	incoming StreamSinkChan
 }
@@ -108,6 +120,7 @@ func (r *VideoRingBuffer) OnConnect(stream *Stream) (StreamSinkChan, error) {
 
 func (r *VideoRingBuffer) initializeBuffer() {
 	r.Buffer = ringbuffer.NewWeightedRingT[videox.VideoPacket](r.Buffer.MaxWeight)
+	r.Audio = nil
 }
 
 func (r *VideoRingBuffer) AddPacketListener(name string, c chan *videox.VideoPacket, policy FullChannelPolicy) {
@@ -131,6 +144,26 @@ func (r *VideoRingBuffer) RemovePacketListener(c chan *videox.VideoPacket) {
 	}
 }
 
+func (r *VideoRingBuffer) AddAudioListener(name string, c chan *videox.AudioPacket) {
+	r.packetListenerLock.Lock()
+	defer r.packetListenerLock.Unlock()
+	r.audioListeners = append(r.audioListeners, &AudioRingBufferListener{
+		Name: name,
+		Chan: c,
+	})
+}
+
+func (r *VideoRingBuffer) RemoveAudioListener(c chan *videox.AudioPacket) {
+	r.packetListenerLock.Lock()
+	defer r.packetListenerLock.Unlock()
+	for i, listener := range r.audioListeners {
+		if listener.Chan == c {
+			r.audioListeners = append(r.audioListeners[:i], r.audioListeners[i+1:]...)
+			return
+		}
+	}
+}
+
 func (r *VideoRingBuffer) Close() {
 	r.Log.Infof("VideoRingBuffer closed")
 }
@@ -172,6 +205,40 @@ func (r *VideoRingBuffer) OnPacketRTP(packet *videox.VideoPacket) {
 	}
 }
 
+func (r *VideoRingBuffer) OnPacketAudio(packet *videox.AudioPacket) {
+	r.BufferLock.Lock()
+	defer r.BufferLock.Unlock()
+
+	r.Audio = append(r.Audio, packet)
+
+	// Discard audio that is older than the oldest video
+	if r.Buffer.Len() != 0 {
+		_, oldest, _ := r.Buffer.Peek(0)
+		n := 0
+		for n < len(r.Audio) && r.Audio[n].WallPTS.Before(oldest.WallPTS) {
+			n++
+		}
+		r.Audio = r.Audio[n:]
+	}
+
+	now := time.Now()
+
+	r.packetListenerLock.Lock()
+	defer r.packetListenerLock.Unlock()
+	for _, listener := range r.audioListeners {
+		if len(listener.Chan) == cap(listener.Chan) {
+			listener.nDropped++
+			if now.Sub(listener.lastLogMsg) > time.Second*3 {
+				r.Log.Warnf("%v audio packets dropped for %v", listener.nDropped, listener.Name)
+				listener.lastLogMsg = now
+				listener.nDropped = 0
+			}
+			continue
+		}
+		listener.Chan <- packet
+	}
+}
+
 // Take BufferLock, then call ExtractRawBufferNoLock
 func (r *VideoRingBuffer) ExtractRawBuffer(method ExtractMethod, duration time.Duration) (*videox.PacketBuffer, error) {
 	r.BufferLock.Lock()
@@ -227,6 +294,14 @@ func (r *VideoRingBuffer) ExtractRawBufferNoLock(method ExtractMethod, duration
 		Packets: make([]*videox.VideoPacket, bufLen-firstPacket),
 	}
 
+	// Audio from the first extracted video packet onwards
+	_, firstVideo, _ := r.Buffer.Peek(firstPacket)
+	firstAudio := 0
+	for firstAudio < len(r.Audio) && r.Audio[firstAudio].WallPTS.Before(firstVideo.WallPTS) {
+		firstAudio++
+	}
+	out.Audio = append([]*videox.AudioPacket(nil), r.Audio[firstAudio:]...)
+
 	switch method {
 	case ExtractMethodShallowClone:
 		for i := firstPacket; i < bufLen; i++ {
@@ -240,6 +315,9 @@ func (r *VideoRingBuffer) ExtractRawBufferNoLock(method ExtractMethod, duration
 			_, packet, _ := r.Buffer.Peek(i)
 			out.Packets[i-firstPacket] = packet.Clone()
 		}
+		for i := range out.Audio {
+			out.Audio[i] = out.Audio[i].Clone()
+		}
 	case ExtractMethodDrain:
 		// Discard earlier history from the ring buffer.
 		// In practice this is OK, because it means we've had a detection event, but the fact that
@@ -261,6 +339,7 @@ func (r *VideoRingBuffer) ExtractRawBufferNoLock(method ExtractMethod, duration
 		if r.Buffer.Len() != 0 {
 			panic("Buffer should be empty")
 		}
+		r.Audio = nil
 	}
 	return out, nil
 }
@@ -294,4 +373,16 @@ func (r *VideoRingBuffer) debugAnalyzePacket(packet *videox.VideoPacket) {
 			}
 		}
 	}
+	if packet.Codec == videox.CodecH265 {
+		if packet.HasIDR() {
+			vps := packet.FirstNALUOfType265(h265.NALUType_VPS_NUT)
+			sps := packet.FirstNALUOfType265(h265.NALUType_SPS_NUT)
+			pps := packet.FirstNALUOfType265(h265.NALUType_PPS_NUT)
+			if vps != nil && sps != nil && pps != nil {
+				r.Log.Debugf("IDR packet. VPS=%v SPS=%v PPS=%v", len(vps.Payload), len(sps.Payload), len(pps.Payload))
+			} else {
+				r.Log.Debugf("IDR packet without VPS, SPS and PPS")
+			}
+		}
+	}
 }
@@ -0,0 +1,117 @@
+package camera
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/accel"
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/cyclops/server/defs"
+	"github.com/cyclopcam/logs"
+)
+
+// FrameReader is the source of decoded frames for a camera.
+// For a physical camera this is the LD decoder. For a virtual camera, it is a crop of the parent's HD decoder.
+type FrameReader interface {
+	// Return a copy of the latest image and its ID, if it's different to the given ID
+	GetLastImageIfDifferent(ifNotEqualTo int64) (*accel.YUVImage, int64, time.Time)
+
+	// Return a copy of the most recently decoded frame (or nil, if there is none available yet), and the frame ID
+	LastImageCopy() (*accel.YUVImage, int64)
+}
+
+// cropReader is the FrameReader of a virtual camera
+type cropReader struct {
+	source *VideoDecodeReader
+	crop   configdb.CropRect
+}
+
+func (r *cropReader) GetLastImageIfDifferent(ifNotEqualTo int64) (*accel.YUVImage, int64, time.Time) {
+	return r.source.GetLastImageCropIfDifferent(ifNotEqualTo, r.crop)
+}
+
+func (r *cropReader) LastImageCopy() (*accel.YUVImage, int64) {
+	// Frame IDs start at 1, so asking for anything other than 0 returns the latest frame
+	img, id, _ := r.source.GetLastImageCropIfDifferent(0, r.crop)
+	return img, id
+}
+
+// Returns the resolution of the recorded stream that holds the frames which we show to the
+// neural network. This is the LD stream, except for a virtual camera, which is a crop of
+// its parent's HD stream.
+func (c *Camera) AnalysisResolution() defs.Resolution {
+	if c.IsVirtual() {
+		return defs.ResHD
+	}
+	return defs.ResLD
+}
+
+// Convert a recorded frame of the AnalysisResolution() stream into the frame that the neural
+// network would have seen live, by applying the virtual camera's crop, and the privacy masks.
+// The frame is modified in place, unless it is cropped.
+func (c *Camera) PrepareRecordedFrame(img *accel.YUVImage) (*accel.YUVImage, error) {
+	if c.IsVirtual() {
+		crop, err := configdb.ParseCropRect(c.Config.Load().Crop)
+		if err != nil {
+			return nil, err
+		}
+		x, y, width, height := crop.Pixels(img.Width, img.Height)
+		img = cropYUV(img, x, y, width, height)
+	}
+	ApplyPrivacyMaskYUV(c.PrivacyMask(img.Width, img.Height), img)
+	return img, nil
+}
+
+// Create a virtual camera, which is a crop of the parent's HD stream.
+// The virtual camera shares the parent's streams and ring buffers, so it doesn't need
+// to be started, and closing it doesn't affect the parent.
+// If the parent is restarted, then the virtual camera must be recreated.
+func NewVirtualCamera(log logs.Log, cfg configdb.Camera, parent *Camera) (*Camera, error) {
+	if parent.IsVirtual() {
+		return nil, fmt.Errorf("The parent of a virtual camera must be a physical camera")
+	}
+	crop, err := configdb.ParseCropRect(cfg.Crop)
+	if err != nil {
+		return nil, err
+	}
+	hd, err := parent.EnableHighDecoder()
+	if err != nil {
+		return nil, err
+	}
+	cam := &Camera{
+		Log:        logs.NewPrefixLogger(log, fmt.Sprintf("Virtual camera %v:", cfg.Name)),
+		Parent:     parent,
+		LowStream:  parent.LowStream,
+		HighStream: parent.HighStream,
+		HighDumper: parent.HighDumper,
+		LowDumper:  parent.LowDumper,
+	}
+	cam.frames = &maskedReader{camera: cam, source: &cropReader{source: hd, crop: crop}}
+	cam.Config.Store(&cfg)
+	return cam, nil
+}
+
+// Start decoding the HD stream, if we're not already doing so.
+// This is only necessary if the camera has virtual children. Decoding HD is expensive, so
+// we don't do it otherwise. Once started, the HD decoder runs until the camera is closed.
+func (c *Camera) EnableHighDecoder() (*VideoDecodeReader, error) {
+	c.highDecoderLock.Lock()
+	defer c.highDecoderLock.Unlock()
+	if c.HighDecoder != nil {
+		return c.HighDecoder, nil
+	}
+	decoder := NewVideoDecodeReader()
+	if err := c.HighStream.ConnectSinkAndRun("HD decode", decoder); err != nil {
+		return nil, err
+	}
+	c.Log.Infof("Decoding HD stream for virtual cameras")
+	c.HighDecoder = decoder
+	return decoder, nil
+}
+
+// Returns the HD decoder, or nil if the camera isn't decoding HD
+func (c *Camera) HighDecoderIfEnabled() *VideoDecodeReader {
+	c.highDecoderLock.Lock()
+	defer c.highDecoderLock.Unlock()
+	return c.HighDecoder
+}
@@ -0,0 +1,98 @@
+package configdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// Limits on the analyzer settings of a camera
+const (
+	MaxMinSightings       = 100
+	MaxMinDistance        = 10000 // pixels
+	MinObjectForgetTime   = 0.5   // seconds
+	MaxObjectForgetTime   = 600   // seconds
+	MinRevalidateInterval = 0.5   // seconds
+	MaxRevalidateInterval = 3600  // seconds
+)
+
+// AnalyzerThresholds are the tunable parts of the monitor's object tracking.
+// A nil value means "not overridden".
+// SYNC-ANALYZER-THRESHOLDS
+type AnalyzerThresholds struct {
+	MinSightings       *int     `json:"minSightings,omitempty"`       // Number of sightings before an object is considered genuine
+	MinDistance        *int     `json:"minDistance,omitempty"`        // Distance (in pixels of the LD stream) that an object must move before it is considered genuine
+	ObjectForgetTime   *float64 `json:"objectForgetTime,omitempty"`   // Seconds without a sighting, before we believe an object has left
+	RevalidateInterval *float64 `json:"revalidateInterval,omitempty"` // Seconds between HQ re-checks of an object that the HQ network rejected
+}
+
+// AnalyzerSettings override the monitor's default object tracking thresholds for a single camera.
+// The camera-wide thresholds replace the built-in defaults for every class, including the classes
+// that have built-in thresholds of their own (eg vehicles, which are allowed to be stationary).
+// Class thresholds take precedence over the camera-wide thresholds.
+// SYNC-ANALYZER-SETTINGS
+type AnalyzerSettings struct {
+	AnalyzerThresholds
+	Classes map[string]AnalyzerThresholds `json:"classes,omitempty"` // Keys are NN class names, such as "person"
+}
+
+// Parse the JSON that is stored in Camera.AnalyzerSettings.
+// An empty string means no overrides.
+func ParseAnalyzerSettings(s string) (*AnalyzerSettings, error) {
+	settings := &AnalyzerSettings{}
+	if s == "" {
+		return settings, nil
+	}
+	if err := json.Unmarshal([]byte(s), settings); err != nil {
+		return nil, fmt.Errorf("Invalid analyzer settings: %w", err)
+	}
+	if err := settings.AnalyzerThresholds.validate(); err != nil {
+		return nil, err
+	}
+	// Sort, so that our error messages are deterministic
+	classes := make([]string, 0, len(settings.Classes))
+	for cls := range settings.Classes {
+		classes = append(classes, cls)
+	}
+	sort.Strings(classes)
+	for _, cls := range classes {
+		t := settings.Classes[cls]
+		if err := t.validate(); err != nil {
+			return nil, fmt.Errorf("%w (class '%v')", err, cls)
+		}
+	}
+	return settings, nil
+}
+
+func (t *AnalyzerThresholds) validate() error {
+	if t.MinSightings != nil && (*t.MinSightings < 1 || *t.MinSightings > MaxMinSightings) {
+		return fmt.Errorf("Minimum sightings must be between 1 and %v", MaxMinSightings)
+	}
+	if t.MinDistance != nil && (*t.MinDistance < 0 || *t.MinDistance > MaxMinDistance) {
+		return fmt.Errorf("Minimum distance must be between 0 and %v pixels", MaxMinDistance)
+	}
+	// The negated comparisons catch NaN
+	if t.ObjectForgetTime != nil && !(*t.ObjectForgetTime >= MinObjectForgetTime && *t.ObjectForgetTime <= MaxObjectForgetTime) {
+		return fmt.Errorf("Object forget time must be between %v and %v seconds", MinObjectForgetTime, MaxObjectForgetTime)
+	}
+	if t.RevalidateInterval != nil && !(*t.RevalidateInterval >= MinRevalidateInterval && *t.RevalidateInterval <= MaxRevalidateInterval) {
+		return fmt.Errorf("Revalidate interval must be between %v and %v seconds", MinRevalidateInterval, MaxRevalidateInterval)
+	}
+	return nil
+}
+
+// Returns an error if the camera's analyzer settings are invalid.
+// allClasses is the list of classes that the monitor knows about (Monitor.AllClasses()).
+func (c *Camera) ValidateAnalyzerSettings(allClasses []string) error {
+	settings, err := ParseAnalyzerSettings(c.AnalyzerSettings)
+	if err != nil {
+		return err
+	}
+	for cls := range settings.Classes {
+		if !slices.Contains(allClasses, cls) {
+			return fmt.Errorf("Unknown class '%v' in analyzer settings", cls)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package configdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzerSettings(t *testing.T) {
+	s, err := ParseAnalyzerSettings("")
+	require.NoError(t, err)
+	require.Nil(t, s.MinDistance)
+
+	s, err = ParseAnalyzerSettings(`{"minDistance": 2, "objectForgetTime": 10, "classes": {"person": {"minSightings": 4, "minDistance": 0}}}`)
+	require.NoError(t, err)
+	require.Equal(t, 2, *s.MinDistance)
+	require.Equal(t, 10.0, *s.ObjectForgetTime)
+	require.Nil(t, s.MinSightings)
+	require.Equal(t, 4, *s.Classes["person"].MinSightings)
+	require.Equal(t, 0, *s.Classes["person"].MinDistance)
+	require.Nil(t, s.Classes["person"].RevalidateInterval)
+
+	invalid := []string{
+		`{"minSightings": 0}`,
+		`{"minDistance": -1}`,
+		`{"objectForgetTime": 0.1}`,
+		`{"revalidateInterval": 100000}`,
+		`{"classes": {"car": {"minSightings": 1000}}}`,
+		`{"minDistance": "far"}`,
+	}
+	for _, js := range invalid {
+		_, err := ParseAnalyzerSettings(js)
+		require.Error(t, err, js)
+	}
+
+	cam := Camera{AnalyzerSettings: `{"classes": {"dog": {"minSightings": 2}}}`}
+	require.NoError(t, cam.ValidateAnalyzerSettings([]string{"person", "dog"}))
+	require.Error(t, cam.ValidateAnalyzerSettings([]string{"person"}))
+}
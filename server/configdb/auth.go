@@ -18,6 +18,8 @@ import (
 const KeyMain = "main"                   // Private X25519 key
 const KeyAccountsToken = "accountsToken" // Token used to authenticate to accounts.cyclopcam.org
 const KeyAccountsNonce = "accountsNonce" // Monotonically increasing nonce used to authenticate ourselves to accounts.cyclopcam.org
+const KeyVideo = "video"                 // Master key for encrypted video (AES-256)
+const KeyVideoPrevious = "videoPrevious" // Previous master key for encrypted video, while a re-key is in progress
 
 // VerifiedIdentity is an identity that accounts.cyclopcam.org has verified
 type VerifiedIdentity struct {
@@ -34,8 +36,15 @@ func (c *ConfigDB) IsCallerOnLAN(r *http.Request) bool {
 		return true
 	}
 	ipStr, _, _ := strings.Cut(r.RemoteAddr, ":")
-	remoteIP := net.ParseIP(ipStr)
-	return !c.VpnAllowedIP.Contains(remoteIP)
+	return c.IsIPOnLAN(net.ParseIP(ipStr))
+}
+
+// Returns true if the IP address is not from our VPN
+func (c *ConfigDB) IsIPOnLAN(ip net.IP) bool {
+	if c.VpnAllowedIP.IP == nil {
+		return true
+	}
+	return !c.VpnAllowedIP.Contains(ip)
 }
 
 // Return the number of users on the system that have an external ID (which is given by accounts.cyclopcam.org).
@@ -0,0 +1,141 @@
+package configdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+)
+
+// Which NN classes we pay attention to, and how we group them.
+// In the system config, a nil field means "use the built-in default".
+// In a camera's config, a nil field means "use the system config".
+// SYNC-CLASSES-JSON
+type ClassesJSON struct {
+	// Classes that we track (eg person, car). Detections of other classes are ignored.
+	// If an abstract class is tracked, then all of the classes that map to it are tracked too.
+	Tracked []string `json:"tracked"`
+
+	// If we get boxes of both of these classes with a very high IoU, then they're the same object,
+	// of the class on the right. For example, {"truck": "car"}.
+	Merge map[string]string `json:"merge"`
+
+	// Group classes under a more abstract class, such as {"car": "vehicle", "dog": "animal"}.
+	// The abstract classes are added to the list of classes that the monitor knows about.
+	Abstract map[string]string `json:"abstract"`
+
+	// Classes that trigger the alarm (eg person). Abstract classes are allowed here too.
+	Alarm []string `json:"alarm"`
+}
+
+// Returns a copy of c, with every non-nil field of o replacing the corresponding field of c.
+// o may be nil.
+func (c *ClassesJSON) WithOverrides(o *ClassesJSON) *ClassesJSON {
+	r := &ClassesJSON{
+		Tracked:  slices.Clone(c.Tracked),
+		Merge:    maps.Clone(c.Merge),
+		Abstract: maps.Clone(c.Abstract),
+		Alarm:    slices.Clone(c.Alarm),
+	}
+	if o == nil {
+		return r
+	}
+	if o.Tracked != nil {
+		r.Tracked = slices.Clone(o.Tracked)
+	}
+	if o.Merge != nil {
+		r.Merge = maps.Clone(o.Merge)
+	}
+	if o.Abstract != nil {
+		r.Abstract = maps.Clone(o.Abstract)
+	}
+	if o.Alarm != nil {
+		r.Alarm = slices.Clone(o.Alarm)
+	}
+	return r
+}
+
+// Returns the sorted, unique list of abstract classes
+func (c *ClassesJSON) AbstractClassList() []string {
+	list := []string{}
+	for _, v := range c.Abstract {
+		if !slices.Contains(list, v) {
+			list = append(list, v)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Returns true if detections of the concrete class 'cls' must be tracked
+func (c *ClassesJSON) IsTracked(cls string) bool {
+	return c.inList(c.Tracked, cls)
+}
+
+// Returns true if genuine objects of the concrete class 'cls' trigger the alarm
+func (c *ClassesJSON) IsAlarm(cls string) bool {
+	return c.inList(c.Alarm, cls)
+}
+
+// Returns true if the concrete class 'cls', or its abstract class, is in 'list'
+func (c *ClassesJSON) inList(list []string, cls string) bool {
+	if slices.Contains(list, cls) {
+		return true
+	}
+	abstract, ok := c.Abstract[cls]
+	return ok && slices.Contains(list, abstract)
+}
+
+// Validate the effective classes config (i.e. after overrides have been applied).
+// nnClasses are the classes that the NN produces (the concrete classes).
+// If allowNewAbstract is false, then the abstract classes must already be in 'knownAbstract'.
+// This is the case for cameras, because the list of classes that the monitor knows about is fixed at startup.
+func (c *ClassesJSON) Validate(nnClasses []string, allowNewAbstract bool, knownAbstract []string) error {
+	// Sort keys, so that our error messages are deterministic
+	for _, from := range slices.Sorted(maps.Keys(c.Abstract)) {
+		to := c.Abstract[from]
+		if !slices.Contains(nnClasses, from) {
+			return fmt.Errorf("Unknown class '%v' in abstract classes", from)
+		}
+		if to == "" || slices.Contains(nnClasses, to) {
+			return fmt.Errorf("Abstract class '%v' must have a name that is not already an NN class", to)
+		}
+		if !allowNewAbstract && !slices.Contains(knownAbstract, to) {
+			return fmt.Errorf("Abstract class '%v' is not defined in the system config", to)
+		}
+	}
+	for _, left := range slices.Sorted(maps.Keys(c.Merge)) {
+		right := c.Merge[left]
+		if !slices.Contains(nnClasses, left) || !slices.Contains(nnClasses, right) {
+			return fmt.Errorf("Unknown class in merge pair '%v' -> '%v'", left, right)
+		}
+		if left == right {
+			return fmt.Errorf("Class '%v' can't be merged with itself", left)
+		}
+	}
+	abstract := c.AbstractClassList()
+	for _, t := range c.Tracked {
+		if !slices.Contains(nnClasses, t) && !slices.Contains(abstract, t) {
+			return fmt.Errorf("Unknown tracked class '%v'", t)
+		}
+	}
+	for _, a := range c.Alarm {
+		if !slices.Contains(nnClasses, a) && !slices.Contains(abstract, a) {
+			return fmt.Errorf("Unknown alarm class '%v'", a)
+		}
+	}
+	return nil
+}
+
+// Parse the camera's class overrides. Returns nil if the camera has no overrides.
+func (c *Camera) ParseClasses() (*ClassesJSON, error) {
+	if c.Classes == "" {
+		return nil, nil
+	}
+	classes := &ClassesJSON{}
+	if err := json.Unmarshal([]byte(c.Classes), classes); err != nil {
+		return nil, fmt.Errorf("Invalid classes config: %w", err)
+	}
+	return classes, nil
+}
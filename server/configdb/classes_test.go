@@ -0,0 +1,62 @@
+package configdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClasses(t *testing.T) {
+	nnClasses := []string{"person", "car", "truck", "dog", "cat"}
+	system := &ClassesJSON{
+		Tracked:  []string{"person", "vehicle"},
+		Merge:    map[string]string{"truck": "car"},
+		Abstract: map[string]string{"car": "vehicle", "truck": "vehicle", "dog": "animal", "cat": "animal"},
+	}
+	require.NoError(t, system.Validate(nnClasses, true, nil))
+	require.Equal(t, []string{"animal", "vehicle"}, system.AbstractClassList())
+	require.True(t, system.IsTracked("truck"))
+	require.False(t, system.IsTracked("dog"))
+	require.False(t, system.IsAlarm("person"))
+
+	// A camera that also tracks animals
+	cam := Camera{Classes: `{"tracked": ["person", "vehicle", "animal"], "alarm": ["animal"]}`}
+	overrides, err := cam.ParseClasses()
+	require.NoError(t, err)
+	eff := system.WithOverrides(overrides)
+	require.NoError(t, eff.Validate(nnClasses, false, []string{"animal", "vehicle"}))
+	require.True(t, eff.IsTracked("dog"))
+	require.True(t, eff.IsAlarm("dog"))
+	require.False(t, eff.IsAlarm("person"))
+	require.Equal(t, "car", eff.Merge["truck"])
+	// The system config is not modified
+	require.False(t, system.IsTracked("dog"))
+
+	// A camera can't introduce new abstract classes
+	cam.Classes = `{"tracked": ["person"], "abstract": {"dog": "pet"}}`
+	overrides, err = cam.ParseClasses()
+	require.NoError(t, err)
+	require.Error(t, system.WithOverrides(overrides).Validate(nnClasses, false, []string{"animal", "vehicle"}))
+	require.NoError(t, system.WithOverrides(overrides).Validate(nnClasses, true, nil))
+
+	invalid := []*ClassesJSON{
+		{Tracked: []string{"unicorn"}},
+		{Alarm: []string{"unicorn"}},
+		{Merge: map[string]string{"truck": "unicorn"}},
+		{Merge: map[string]string{"car": "car"}},
+		{Abstract: map[string]string{"unicorn": "animal"}},
+		{Abstract: map[string]string{"dog": "cat"}},
+	}
+	for _, c := range invalid {
+		require.Error(t, c.Validate(nnClasses, true, nil), "%+v", c)
+	}
+
+	cam.Classes = ""
+	overrides, err = cam.ParseClasses()
+	require.NoError(t, err)
+	require.Nil(t, overrides)
+
+	cam.Classes = `{"tracked": "person"}`
+	_, err = cam.ParseClasses()
+	require.Error(t, err)
+}
@@ -1,9 +1,11 @@
 package configdb
 
 import (
+	"net"
 	"os"
 	"testing"
 
+	"github.com/cyclopcam/cyclops/pkg/pwdhash"
 	"github.com/cyclopcam/logs"
 	"github.com/stretchr/testify/require"
 )
@@ -25,3 +27,80 @@ func TestNextID(t *testing.T) {
 		tx.Commit()
 	}
 }
+
+func TestVideoKeys(t *testing.T) {
+	db := createTestDB(t)
+	keys, err := GetVideoKeys(db.DB, false)
+	require.NoError(t, err)
+	require.Nil(t, keys.Current)
+	_, err = BeginVideoRekey(db.DB)
+	require.Error(t, err)
+
+	keys, err = GetVideoKeys(db.DB, true)
+	require.NoError(t, err)
+	require.Len(t, keys.Current, VideoKeySize)
+	first := keys.Current
+
+	// Re-key, and get interrupted
+	keys, err = BeginVideoRekey(db.DB)
+	require.NoError(t, err)
+	require.Equal(t, first, keys.Previous)
+	require.NotEqual(t, first, keys.Current)
+	second := keys.Current
+
+	// Resume
+	keys, err = BeginVideoRekey(db.DB)
+	require.NoError(t, err)
+	require.Equal(t, first, keys.Previous)
+	require.Equal(t, second, keys.Current)
+
+	require.NoError(t, FinishVideoRekey(db.DB))
+	keys, err = GetVideoKeys(db.DB, true)
+	require.NoError(t, err)
+	require.Nil(t, keys.Previous)
+	require.Equal(t, second, keys.Current)
+}
+
+func TestPinReplicationHostKey(t *testing.T) {
+	db := createTestDB(t)
+	require.NoError(t, db.PinReplicationHostKey("ssh-ed25519 AAAA"))
+	require.Nil(t, db.GetConfig().Replication)
+
+	db.config.Replication = &ReplicationJSON{Enabled: true, Type: ReplicationTargetSFTP, Host: "backup.lan"}
+	require.NoError(t, db.PinReplicationHostKey("ssh-ed25519 AAAA"))
+	require.Equal(t, "ssh-ed25519 AAAA", db.GetConfig().Replication.HostKey)
+
+	// The first key sticks
+	require.NoError(t, db.PinReplicationHostKey("ssh-ed25519 BBBB"))
+	require.Equal(t, "ssh-ed25519 AAAA", db.GetConfig().Replication.HostKey)
+}
+
+func TestVerifyBasicAuth(t *testing.T) {
+	db := createTestDB(t)
+	user := User{
+		Username:           "Alice",
+		UsernameNormalized: NormalizeUsername("Alice"),
+		Permissions:        string(UserPermissionViewer),
+		Password:           pwdhash.HashPasswordBase64("secret"),
+	}
+	require.NoError(t, db.DB.Create(&user).Error)
+	lan := net.ParseIP("192.168.1.20")
+	vpn := net.ParseIP("10.7.0.5")
+
+	require.Nil(t, db.VerifyBasicAuth("alice", "wrong", lan))
+	require.Nil(t, db.VerifyBasicAuth("bob", "secret", lan))
+	require.Nil(t, db.VerifyBasicAuth("alice", "", lan))
+	verified := db.VerifyBasicAuth("alice", "secret", lan)
+	require.NotNil(t, verified)
+	require.Equal(t, user.ID, verified.ID)
+
+	// Without a VPN, every caller is on the LAN
+	require.NotNil(t, db.VerifyBasicAuth("alice", "secret", vpn))
+
+	// BASIC authentication is refused over the VPN, even with the right password
+	_, vpnNet, err := net.ParseCIDR("10.7.0.0/16")
+	require.NoError(t, err)
+	db.VpnAllowedIP = *vpnNet
+	require.Nil(t, db.VerifyBasicAuth("alice", "secret", vpn))
+	require.NotNil(t, db.VerifyBasicAuth("alice", "secret", lan))
+}
@@ -0,0 +1,56 @@
+package configdb
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Smallest allowed width or height of a crop rectangle, as a fraction of the parent frame
+const MinCropSize = 0.05
+
+// CropRect is a rectangle inside a camera's frame, in fractions of the frame size, so that it
+// remains valid if the camera's resolution changes. (0,0) is the top-left corner, and (1,1) is
+// the bottom-right corner.
+type CropRect struct {
+	X1, Y1, X2, Y2 float64
+}
+
+// Parse a crop rectangle of the form "x1,y1,x2,y2", eg "0.5,0,1,0.5" for the top-right quadrant
+func ParseCropRect(s string) (CropRect, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return CropRect{}, fmt.Errorf("Crop rectangle '%v' must be of the form x1,y1,x2,y2", s)
+	}
+	v := [4]float64{}
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return CropRect{}, fmt.Errorf("Invalid crop rectangle '%v': %w", s, err)
+		}
+		if f < 0 || f > 1 {
+			return CropRect{}, fmt.Errorf("Crop rectangle '%v' must be within 0 and 1", s)
+		}
+		v[i] = f
+	}
+	r := CropRect{v[0], v[1], v[2], v[3]}
+	if r.X2-r.X1 < MinCropSize || r.Y2-r.Y1 < MinCropSize {
+		return CropRect{}, fmt.Errorf("Crop rectangle '%v' is too small", s)
+	}
+	return r, nil
+}
+
+func (r CropRect) String() string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	return f(r.X1) + "," + f(r.Y1) + "," + f(r.X2) + "," + f(r.Y2)
+}
+
+// Returns the crop rectangle in pixels, for a frame of the given size.
+// All coordinates are even, so that the rectangle maps exactly onto YUV420 chroma planes.
+func (r CropRect) Pixels(frameWidth, frameHeight int) (x, y, width, height int) {
+	x1 := int(r.X1*float64(frameWidth)) &^ 1
+	y1 := int(r.Y1*float64(frameHeight)) &^ 1
+	x2 := int(r.X2*float64(frameWidth)) &^ 1
+	y2 := int(r.Y2*float64(frameHeight)) &^ 1
+	return x1, y1, max(x2-x1, 2), max(y2-y1, 2)
+}
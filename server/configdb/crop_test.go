@@ -0,0 +1,26 @@
+package configdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCropRect(t *testing.T) {
+	r, err := ParseCropRect("0.5, 0, 1, 0.5")
+	require.NoError(t, err)
+	require.Equal(t, CropRect{0.5, 0, 1, 0.5}, r)
+	require.Equal(t, "0.5,0,1,0.5", r.String())
+
+	x, y, w, h := r.Pixels(3840, 2160)
+	require.Equal(t, []int{1920, 0, 1920, 1080}, []int{x, y, w, h})
+
+	// Odd pixel coordinates are rounded down to even
+	x, y, w, h = CropRect{0.25, 0.25, 0.75, 0.75}.Pixels(1002, 1002)
+	require.Equal(t, []int{250, 250, 500, 500}, []int{x, y, w, h})
+
+	for _, bad := range []string{"", "0,0,1", "0,0,1,x", "0,0,1.5,1", "0.5,0,0.5,1", "0.9,0,0.1,1"} {
+		_, err := ParseCropRect(bad)
+		require.Error(t, err, bad)
+	}
+}
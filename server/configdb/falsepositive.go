@@ -0,0 +1,84 @@
+package configdb
+
+import (
+	"fmt"
+
+	"github.com/cyclopcam/dbh"
+)
+
+// Each false positive is compared against every detection of its camera's class, so we limit them
+const MaxFalsePositivesPerCamera = 100
+
+// A false positive is a detection that a user has marked as wrong, such as a coat on a hanger
+// that was detected as a person. The monitor rejects future detections of the same class, at
+// the same location, with a similar appearance. We also keep an image of the detection, as a
+// negative sample for retraining the NN.
+// SYNC-RECORD-FALSE-POSITIVE
+type FalsePositive struct {
+	BaseModel
+	CameraID int64  `json:"cameraID"`
+	Class    string `json:"class"` // Class of the detection, eg "person"
+
+	// Box of the detection, as fractions of the frame size (see CropRect)
+	X1 float64 `json:"x1"`
+	Y1 float64 `json:"y1"`
+	X2 float64 `json:"x2"`
+	Y2 float64 `json:"y2"`
+
+	FrameTime  dbh.IntTime               `json:"frameTime"`                   // Time of the frame in which the detection was marked
+	EventID    int64                     `json:"eventID" gorm:"default:null"` // videodb event of the detection. Zero if it was marked in the live view, or if the event was not yet written.
+	Appearance *dbh.JSONField[[]float32] `json:"-"`                           // Color histogram of the box. See monitor.AppearanceHistogram().
+	Image      []byte                    `json:"-"`                           // JPEG of the box and its surroundings
+	ImageBox   *dbh.JSONField[[4]int]    `json:"imageBox"`                    // Box of the detection inside Image, in pixels (x1,y1,x2,y2)
+	CreatedBy  int64                     `json:"createdBy"`
+	CreatedAt  dbh.IntTime               `json:"createdAt" gorm:"autoCreateTime:milli"`
+	ExportedAt dbh.IntTime               `json:"exportedAt" gorm:"default:null"` // When the sample was sent to Arc. Zero = not yet.
+}
+
+// Returns the box of the detection
+func (f *FalsePositive) Box() CropRect {
+	return CropRect{f.X1, f.Y1, f.X2, f.Y2}
+}
+
+// Returns an error if the false positive is invalid
+func (f *FalsePositive) Validate() error {
+	if f.Class == "" {
+		return fmt.Errorf("Class is required")
+	}
+	if f.X1 < 0 || f.Y1 < 0 || f.X2 > 1 || f.Y2 > 1 || f.X2 <= f.X1 || f.Y2 <= f.Y1 {
+		return fmt.Errorf("Invalid box %v", f.Box())
+	}
+	if f.Appearance == nil || len(f.Appearance.Data) == 0 {
+		return fmt.Errorf("Appearance is required")
+	}
+	return nil
+}
+
+// Get the false positives of a camera, or of all cameras if cameraID is zero.
+// The images are not loaded.
+func (c *ConfigDB) GetFalsePositives(cameraID int64) ([]*FalsePositive, error) {
+	q := c.DB.Omit("image").Order("id")
+	if cameraID != 0 {
+		q = q.Where("camera_id = ?", cameraID)
+	}
+	falsePositives := []*FalsePositive{}
+	if err := q.Find(&falsePositives).Error; err != nil {
+		return nil, err
+	}
+	return falsePositives, nil
+}
+
+// Add a false positive, unless the camera already has MaxFalsePositivesPerCamera
+func (c *ConfigDB) AddFalsePositive(f *FalsePositive) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	n := int64(0)
+	if err := c.DB.Model(&FalsePositive{}).Where("camera_id = ?", f.CameraID).Count(&n).Error; err != nil {
+		return err
+	}
+	if n >= MaxFalsePositivesPerCamera {
+		return fmt.Errorf("Camera already has %v false positives. Remove some before adding more", n)
+	}
+	return c.DB.Create(f).Error
+}
@@ -0,0 +1,58 @@
+package configdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/dbh"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFalsePositive(t *testing.T) {
+	db := createTestDB(t)
+
+	newFalsePositive := func(cameraID int64) *FalsePositive {
+		return &FalsePositive{
+			CameraID:   cameraID,
+			Class:      "person",
+			X1:         0.1,
+			Y1:         0.2,
+			X2:         0.3,
+			Y2:         0.6,
+			FrameTime:  dbh.MakeIntTime(time.Now()),
+			Appearance: dbh.MakeJSONField([]float32{0.5, 0.5}),
+			Image:      []byte{1, 2, 3},
+			ImageBox:   dbh.MakeJSONField([4]int{10, 10, 30, 50}),
+			CreatedBy:  1,
+		}
+	}
+
+	f := newFalsePositive(1)
+	require.NoError(t, db.AddFalsePositive(f))
+	require.NoError(t, db.AddFalsePositive(newFalsePositive(2)))
+
+	all, err := db.GetFalsePositives(0)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(all))
+	cam1, err := db.GetFalsePositives(1)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(cam1))
+	require.Equal(t, f.ID, cam1[0].ID)
+	require.Equal(t, []float32{0.5, 0.5}, cam1[0].Appearance.Data)
+	require.Equal(t, [4]int{10, 10, 30, 50}, cam1[0].ImageBox.Data)
+	require.Nil(t, cam1[0].Image)
+	require.Equal(t, CropRect{0.1, 0.2, 0.3, 0.6}, cam1[0].Box())
+
+	bad := newFalsePositive(1)
+	bad.X2 = 0.05
+	require.Error(t, db.AddFalsePositive(bad))
+	bad = newFalsePositive(1)
+	bad.Appearance = nil
+	require.Error(t, db.AddFalsePositive(bad))
+
+	for i := 1; i < MaxFalsePositivesPerCamera; i++ {
+		require.NoError(t, db.AddFalsePositive(newFalsePositive(1)))
+	}
+	require.Error(t, db.AddFalsePositive(newFalsePositive(1)))
+	require.NoError(t, db.AddFalsePositive(newFalsePositive(2)))
+}
@@ -0,0 +1,22 @@
+package configdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInferenceConfig(t *testing.T) {
+	require.NoError(t, ValidateInferenceConfig(&InferenceJSON{}))
+	require.NoError(t, ValidateInferenceConfig(&InferenceJSON{RemoteURL: "http://192.168.1.20:8080", RemoteKey: "abc"}))
+	require.NoError(t, ValidateInferenceConfig(&InferenceJSON{Serve: true, ServeKey: "abc"}))
+
+	require.Error(t, ValidateInferenceConfig(&InferenceJSON{RemoteURL: "http://192.168.1.20"}))
+	require.Error(t, ValidateInferenceConfig(&InferenceJSON{RemoteURL: "192.168.1.20", RemoteKey: "abc"}))
+	require.Error(t, ValidateInferenceConfig(&InferenceJSON{RemoteURL: "ftp://server", RemoteKey: "abc"}))
+	require.Error(t, ValidateInferenceConfig(&InferenceJSON{RemoteTimeoutMS: -1}))
+	require.Error(t, ValidateInferenceConfig(&InferenceJSON{Serve: true}))
+	require.Error(t, ValidateInferenceConfig(&InferenceJSON{Serve: true, ServeKey: "abc", RemoteURL: "http://server", RemoteKey: "abc"}))
+
+	require.True(t, RestartNeeded(&ConfigJSON{}, &ConfigJSON{Inference: &InferenceJSON{Serve: true, ServeKey: "abc"}}))
+}
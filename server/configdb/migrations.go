@@ -268,5 +268,88 @@ func Migrations(log logs.Log) []migration.Migrator {
 		return nil
 	}))
 
+	migs = append(migs, dbh.MakeMigrationFromSQL(log, &idx,
+		`
+		ALTER TABLE camera ADD COLUMN min_retention_days INT;
+		ALTER TABLE camera ADD COLUMN max_retention_days INT;
+		ALTER TABLE camera ADD COLUMN max_storage_size TEXT;
+	`))
+
+	migs = append(migs, dbh.MakeMigrationFromSQL(log, &idx,
+		`
+		ALTER TABLE camera ADD COLUMN thin_hd_after_days INT;
+	`))
+
+	migs = append(migs, dbh.MakeMigrationFromSQL(log, &idx,
+		`
+		ALTER TABLE camera ADD COLUMN enable_audio BOOLEAN;
+	`))
+
+	migs = append(migs, dbh.MakeMigrationFromSQL(log, &idx,
+		`
+		CREATE TABLE mosaic_layout(
+			id INTEGER PRIMARY KEY,
+			user_id INT NOT NULL,
+			name TEXT NOT NULL,
+			num_columns INT NOT NULL,
+			num_rows INT NOT NULL,
+			width INT,
+			height INT,
+			fps INT,
+			cameras TEXT,
+			created_at INT,
+			updated_at INT
+		);
+		CREATE INDEX idx_mosaic_layout_user_id ON mosaic_layout (user_id);
+	`))
+
+	migs = append(migs, dbh.MakeMigrationFromSQL(log, &idx,
+		`
+		ALTER TABLE camera ADD COLUMN parent_id INT;
+		ALTER TABLE camera ADD COLUMN crop TEXT;
+	`))
+
+	migs = append(migs, dbh.MakeMigrationFromSQL(log, &idx,
+		`
+		ALTER TABLE camera ADD COLUMN privacy_masks TEXT;
+	`))
+
+	migs = append(migs, dbh.MakeMigrationFromSQL(log, &idx,
+		`
+		ALTER TABLE camera ADD COLUMN analyzer_settings TEXT;
+	`))
+
+	migs = append(migs, dbh.MakeMigrationFromSQL(log, &idx,
+		`
+		ALTER TABLE camera ADD COLUMN classes TEXT;
+	`))
+
+	migs = append(migs, dbh.MakeMigrationFromSQL(log, &idx,
+		`
+		ALTER TABLE camera ADD COLUMN regions_of_interest TEXT;
+	`))
+
+	migs = append(migs, dbh.MakeMigrationFromSQL(log, &idx,
+		`
+		CREATE TABLE false_positive(
+			id INTEGER PRIMARY KEY,
+			camera_id INT NOT NULL,
+			class TEXT NOT NULL,
+			x1 REAL NOT NULL,
+			y1 REAL NOT NULL,
+			x2 REAL NOT NULL,
+			y2 REAL NOT NULL,
+			frame_time INT NOT NULL,
+			event_id INT,
+			appearance TEXT NOT NULL,
+			image BLOB,
+			image_box TEXT,
+			created_by INT NOT NULL,
+			created_at INT NOT NULL,
+			exported_at INT
+		);
+		CREATE INDEX idx_false_positive_camera_id ON false_positive (camera_id);
+	`))
+
 	return migs
 }
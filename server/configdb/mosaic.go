@@ -0,0 +1,98 @@
+package configdb
+
+import (
+	"fmt"
+
+	"github.com/cyclopcam/dbh"
+)
+
+// Limits on the size of a mosaic
+const (
+	MosaicMaxCells  = 64
+	MosaicMaxWidth  = 3840
+	MosaicMaxHeight = 2160
+)
+
+// Defaults for the optional fields of a MosaicLayout
+const (
+	MosaicDefaultWidth  = 1280
+	MosaicDefaultHeight = 720
+	MosaicDefaultFPS    = 5
+)
+
+// MosaicLayout is a grid of cameras that the server composites into a single video stream.
+// Layouts belong to a user.
+// SYNC-RECORD-MOSAIC-LAYOUT
+type MosaicLayout struct {
+	BaseModel
+	UserID     int64                   `json:"userID"`
+	Name       string                  `json:"name"`
+	NumColumns int                     `json:"numColumns"`
+	NumRows    int                     `json:"numRows"`
+	Width      int                     `json:"width" gorm:"default:null"`  // Output width. Zero = MosaicDefaultWidth.
+	Height     int                     `json:"height" gorm:"default:null"` // Output height. Zero = MosaicDefaultHeight.
+	FPS        int                     `json:"fps" gorm:"default:null"`    // Output frame rate. Zero = MosaicDefaultFPS.
+	Cameras    *dbh.JSONField[[]int64] `json:"cameras"`                    // Camera ID of each cell, in row-major order. Zero = empty cell.
+	CreatedAt  dbh.IntTime             `json:"createdAt" gorm:"autoCreateTime:milli"`
+	UpdatedAt  dbh.IntTime             `json:"updatedAt" gorm:"autoUpdateTime:milli"`
+}
+
+// Returns an error if the layout is invalid
+func (m *MosaicLayout) Validate() error {
+	if m.Name == "" {
+		return fmt.Errorf("Mosaic name is required")
+	}
+	if m.NumColumns < 1 || m.NumRows < 1 || m.NumColumns*m.NumRows > MosaicMaxCells {
+		return fmt.Errorf("Mosaic must have between 1 and %v cells", MosaicMaxCells)
+	}
+	if m.Width < 0 || m.Height < 0 || m.Width > MosaicMaxWidth || m.Height > MosaicMaxHeight {
+		return fmt.Errorf("Mosaic size may not exceed %v x %v", MosaicMaxWidth, MosaicMaxHeight)
+	}
+	if (m.Width != 0 && m.Width < 2*m.NumColumns) || (m.Height != 0 && m.Height < 2*m.NumRows) {
+		return fmt.Errorf("Mosaic size is too small for %v x %v cells", m.NumColumns, m.NumRows)
+	}
+	if m.FPS < 0 || m.FPS > 30 {
+		return fmt.Errorf("Mosaic FPS must be between 1 and 30")
+	}
+	if m.Cameras != nil && len(m.Cameras.Data) > m.NumColumns*m.NumRows {
+		return fmt.Errorf("Mosaic has %v cameras, but only %v cells", len(m.Cameras.Data), m.NumColumns*m.NumRows)
+	}
+	return nil
+}
+
+// Returns the camera IDs of the cells. The result may be shorter than the number of cells.
+func (m *MosaicLayout) CameraIDs() []int64 {
+	if m.Cameras == nil {
+		return nil
+	}
+	return m.Cameras.Data
+}
+
+// Returns the output size, with defaults applied. Both dimensions are even.
+func (m *MosaicLayout) OutputSize() (width, height int) {
+	width, height = m.Width, m.Height
+	if width == 0 {
+		width = MosaicDefaultWidth
+	}
+	if height == 0 {
+		height = MosaicDefaultHeight
+	}
+	return width &^ 1, height &^ 1
+}
+
+// Returns the output frame rate, with the default applied
+func (m *MosaicLayout) OutputFPS() int {
+	if m.FPS == 0 {
+		return MosaicDefaultFPS
+	}
+	return m.FPS
+}
+
+// Get the mosaic layouts of a user
+func (c *ConfigDB) GetMosaicLayouts(userID int64) ([]*MosaicLayout, error) {
+	layouts := []*MosaicLayout{}
+	if err := c.DB.Where("user_id = ?", userID).Order("name").Find(&layouts).Error; err != nil {
+		return nil, err
+	}
+	return layouts, nil
+}
@@ -0,0 +1,41 @@
+package configdb
+
+import (
+	"testing"
+
+	"github.com/cyclopcam/dbh"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMosaicLayout(t *testing.T) {
+	db := createTestDB(t)
+
+	m := &MosaicLayout{
+		UserID:     1,
+		Name:       "Booth",
+		NumColumns: 2,
+		NumRows:    2,
+		Cameras:    dbh.MakeJSONField([]int64{3, 0, 5}),
+	}
+	require.NoError(t, m.Validate())
+	require.NoError(t, db.DB.Create(m).Error)
+	require.NoError(t, db.DB.Create(&MosaicLayout{UserID: 2, Name: "Other", NumColumns: 1, NumRows: 1}).Error)
+
+	layouts, err := db.GetMosaicLayouts(1)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(layouts))
+	require.Equal(t, []int64{3, 0, 5}, layouts[0].CameraIDs())
+	w, h := layouts[0].OutputSize()
+	require.Equal(t, MosaicDefaultWidth, w)
+	require.Equal(t, MosaicDefaultHeight, h)
+	require.Equal(t, MosaicDefaultFPS, layouts[0].OutputFPS())
+
+	m.Cameras.Data = []int64{1, 2, 3, 4, 5}
+	require.Error(t, m.Validate())
+	m.Cameras.Data = nil
+	m.NumColumns = 0
+	require.Error(t, m.Validate())
+	m.NumColumns = 9
+	m.NumRows = 8
+	require.Error(t, m.Validate())
+}
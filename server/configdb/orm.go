@@ -1,8 +1,10 @@
 package configdb
 
 import (
+	"fmt"
 	"strings"
 
+	"github.com/cyclopcam/cyclops/pkg/kibi"
 	"github.com/cyclopcam/dbh"
 )
 
@@ -37,6 +39,44 @@ type Camera struct {
 	UpdatedAt        dbh.IntTime `json:"updatedAt" gorm:"autoUpdateTime:milli"`
 	DetectionZone    string      `json:"detectionZone" gorm:"default:null"` // See DetectionZone.EncodeBase64()
 	EnableAlarm      bool        `json:"enableAlarm"`                       // If this camera sees a person when armed, then trigger the alarm
+	EnableAudio      bool        `json:"enableAudio" gorm:"default:null"`   // Record the camera's microphone (AAC or G.711), alongside the HD stream
+
+	// Retention policy for this camera's recordings (LD and HD together).
+	// Zero/empty values mean "no rule", in which case the camera only competes for space with the other
+	// cameras, under the system-wide Recording.MaxStorageSize.
+	MinRetentionDays int    `json:"minRetentionDays" gorm:"default:null"` // Never delete footage younger than this, even if the archive is full
+	MaxRetentionDays int    `json:"maxRetentionDays" gorm:"default:null"` // Delete footage older than this, even if there is space
+	MaxStorageSize   string `json:"maxStorageSize" gorm:"default:null"`   // Byte quota for this camera, eg "200GB"
+
+	// Reduce HD footage older than this to keyframes only, to keep a longer (but choppier)
+	// history in the same space. LD footage is untouched. Zero = never.
+	ThinHDAfterDays int `json:"thinHDAfterDays" gorm:"default:null"`
+
+	// A virtual camera is a cropped region of another (physical) camera's HD stream.
+	// It shares the parent's RTSP connection, HD decoder, and recordings, but it has its
+	// own NN monitoring, detection zone, and event timeline.
+	// The connection fields (Model, Host, etc) of a virtual camera are ignored.
+	ParentID int64  `json:"parentID" gorm:"default:null"` // If non-zero, this is a virtual camera
+	Crop     string `json:"crop" gorm:"default:null"`     // Crop rectangle of a virtual camera. See ParseCropRect().
+
+	// Privacy masks are polygons that are blacked out of everything that leaves the server (images,
+	// transcoded streams, exports), and out of the NN input, so that objects inside them are never tracked.
+	// The recordings themselves are not modified, so masks can be changed after the fact.
+	// The masks of a virtual camera apply to its own crop, in addition to the masks of its parent.
+	PrivacyMasks string `json:"privacyMasks" gorm:"default:null"` // JSON list of polygons. See ParsePrivacyMasks().
+
+	// Overrides of the monitor's object tracking thresholds, per camera and per class.
+	// For example, a camera far from the road needs a smaller minimum distance than a doorbell camera.
+	// These are applied to the running monitor without restarting the camera.
+	AnalyzerSettings string `json:"analyzerSettings" gorm:"default:null"` // JSON. See ParseAnalyzerSettings().
+
+	// Overrides of the system's class config (which classes are tracked, merged, and grouped).
+	// These are applied to the running monitor without restarting the camera.
+	Classes string `json:"classes" gorm:"default:null"` // JSON of ClassesJSON. See ParseClasses().
+
+	// Regions of the frame where we look for small, distant objects in the HD stream.
+	// These are applied to the running monitor without restarting the camera.
+	RegionsOfInterest string `json:"regionsOfInterest" gorm:"default:null"` // JSON list. See ParseRegionsOfInterest().
 
 	// The long lived name is used to identify the camera in the storage archive.
 	// If necessary, we can make this configurable.
@@ -57,7 +97,11 @@ func (c *Camera) EqualsConnection(newCam *Camera) bool {
 		c.Username == newCam.Username &&
 		c.Password == newCam.Password &&
 		c.HighResURLSuffix == newCam.HighResURLSuffix &&
-		c.LowResURLSuffix == newCam.LowResURLSuffix
+		c.LowResURLSuffix == newCam.LowResURLSuffix &&
+		c.EnableAudio == newCam.EnableAudio &&
+		c.ParentID == newCam.ParentID &&
+		c.Crop == newCam.Crop &&
+		c.PrivacyMasks == newCam.PrivacyMasks // Restart, so that viewers of the raw stream are disconnected
 }
 
 func (c *Camera) DeepEquals(x *Camera) bool {
@@ -68,7 +112,60 @@ func (c *Camera) DeepEquals(x *Camera) bool {
 	return c.Name == x.Name &&
 		c.LongLivedName == x.LongLivedName &&
 		c.DetectionZone == x.DetectionZone &&
-		c.EnableAlarm == x.EnableAlarm
+		c.EnableAlarm == x.EnableAlarm &&
+		c.MinRetentionDays == x.MinRetentionDays &&
+		c.MaxRetentionDays == x.MaxRetentionDays &&
+		c.MaxStorageSize == x.MaxStorageSize &&
+		c.ThinHDAfterDays == x.ThinHDAfterDays &&
+		c.AnalyzerSettings == x.AnalyzerSettings &&
+		c.Classes == x.Classes &&
+		c.RegionsOfInterest == x.RegionsOfInterest
+}
+
+// Returns true if the camera has any privacy masks.
+// Invalid masks count as masks, so that we err on the side of hiding things.
+func (c *Camera) HasPrivacyMasks() bool {
+	polygons, err := ParsePrivacyMasks(c.PrivacyMasks)
+	return err != nil || len(polygons) != 0
+}
+
+// Returns an error if the camera's retention policy is invalid
+func (c *Camera) ValidateRetention() error {
+	if c.MinRetentionDays < 0 || c.MaxRetentionDays < 0 || c.ThinHDAfterDays < 0 {
+		return fmt.Errorf("Retention days may not be negative")
+	}
+	if c.MinRetentionDays != 0 && c.MaxRetentionDays != 0 && c.MinRetentionDays > c.MaxRetentionDays {
+		return fmt.Errorf("Minimum retention (%v days) is greater than maximum retention (%v days)", c.MinRetentionDays, c.MaxRetentionDays)
+	}
+	if c.MaxStorageSize != "" {
+		if _, err := kibi.ParseBytes(c.MaxStorageSize); err != nil {
+			return fmt.Errorf("Invalid max storage size '%v': %w", c.MaxStorageSize, err)
+		}
+	}
+	return nil
+}
+
+// Returns true if this is a virtual camera (a cropped region of another camera)
+func (c *Camera) IsVirtual() bool {
+	return c.ParentID != 0
+}
+
+// Returns an error if the virtual camera settings are invalid.
+// This is a no-op for physical cameras.
+func (c *Camera) ValidateVirtual() error {
+	if !c.IsVirtual() {
+		return nil
+	}
+	if c.ParentID == c.ID {
+		return fmt.Errorf("A virtual camera can't be its own parent")
+	}
+	_, err := ParseCropRect(c.Crop)
+	return err
+}
+
+// Returns true if the camera has any retention rules
+func (c *Camera) HasRetentionPolicy() bool {
+	return c.MinRetentionDays != 0 || c.MaxRetentionDays != 0 || c.MaxStorageSize != ""
 }
 
 type Variable struct {
@@ -0,0 +1,125 @@
+package configdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Limits on the privacy masks of a single camera
+const (
+	MaxPrivacyMasks        = 32
+	MaxPrivacyMaskVertices = 100
+	minPrivacyMaskVertices = 3
+)
+
+// A vertex of a privacy mask, in fractions of the frame size, so that masks remain valid if the camera's
+// resolution changes. (0,0) is the top-left corner, and (1,1) is the bottom-right corner.
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// A closed polygon. The last vertex joins up with the first one.
+type Polygon []Point
+
+// Parse the JSON list of polygons that is stored in Camera.PrivacyMasks.
+// An empty string means no masks.
+func ParsePrivacyMasks(s string) ([]Polygon, error) {
+	if s == "" {
+		return nil, nil
+	}
+	polygons := []Polygon{}
+	if err := json.Unmarshal([]byte(s), &polygons); err != nil {
+		return nil, fmt.Errorf("Invalid privacy masks: %w", err)
+	}
+	if len(polygons) > MaxPrivacyMasks {
+		return nil, fmt.Errorf("Too many privacy masks (%v). The maximum is %v", len(polygons), MaxPrivacyMasks)
+	}
+	for i, p := range polygons {
+		if len(p) < minPrivacyMaskVertices || len(p) > MaxPrivacyMaskVertices {
+			return nil, fmt.Errorf("Privacy mask %v must have between %v and %v vertices", i, minPrivacyMaskVertices, MaxPrivacyMaskVertices)
+		}
+		for _, v := range p {
+			if v.X < 0 || v.X > 1 || v.Y < 0 || v.Y > 1 || math.IsNaN(v.X) || math.IsNaN(v.Y) {
+				return nil, fmt.Errorf("Privacy mask %v has a vertex outside of the frame", i)
+			}
+		}
+	}
+	return polygons, nil
+}
+
+// Map a polygon from the coordinates of the parent frame, into the coordinates of the crop.
+// Vertices outside of the crop are not clipped, so the result can extend beyond (0,0)..(1,1),
+// which RasterizePrivacyMasks handles correctly.
+func (r CropRect) MapPolygon(p Polygon) Polygon {
+	out := make(Polygon, len(p))
+	for i, v := range p {
+		out[i] = Point{
+			X: (v.X - r.X1) / (r.X2 - r.X1),
+			Y: (v.Y - r.Y1) / (r.Y2 - r.Y1),
+		}
+	}
+	return out
+}
+
+// PrivacyMask is a set of privacy polygons, rasterized for a particular frame size
+type PrivacyMask struct {
+	Width  int
+	Height int
+	Hidden []byte // One byte per pixel. Non-zero if the pixel must be hidden.
+}
+
+// Returns true if the pixel at (x,y) must be hidden
+func (m *PrivacyMask) IsHidden(x, y int) bool {
+	return m.Hidden[y*m.Width+x] != 0
+}
+
+// Rasterize polygons into a mask of the given size.
+// A pixel is hidden if its center is inside any of the polygons (using the even-odd rule).
+// Returns nil if there are no polygons.
+func RasterizePrivacyMasks(polygons []Polygon, width, height int) *PrivacyMask {
+	if len(polygons) == 0 {
+		return nil
+	}
+	m := &PrivacyMask{
+		Width:  width,
+		Height: height,
+		Hidden: make([]byte, width*height),
+	}
+	xs := []float64{}
+	for y := 0; y < height; y++ {
+		// Sample at the center of the pixel
+		yc := (float64(y) + 0.5) / float64(height)
+		row := m.Hidden[y*width : (y+1)*width]
+		for _, p := range polygons {
+			xs = xs[:0]
+			for i := range p {
+				a := p[i]
+				b := p[(i+1)%len(p)]
+				// Half-open interval, so that a vertex exactly on the scanline is only counted once
+				if (a.Y <= yc) == (b.Y <= yc) {
+					continue
+				}
+				xs = append(xs, a.X+(yc-a.Y)*(b.X-a.X)/(b.Y-a.Y))
+			}
+			sort.Float64s(xs)
+			for i := 0; i+1 < len(xs); i += 2 {
+				// Fill the pixels whose centers lie within [xs[i], xs[i+1])
+				x1 := max(0, int(math.Ceil(xs[i]*float64(width)-0.5)))
+				x2 := min(width, int(math.Ceil(xs[i+1]*float64(width)-0.5)))
+				for x := x1; x < x2; x++ {
+					row[x] = 1
+				}
+			}
+		}
+	}
+	return m
+}
+
+// Returns an error if the privacy masks are invalid
+func (c *Camera) ValidatePrivacyMasks() error {
+	_, err := ParsePrivacyMasks(c.PrivacyMasks)
+	return err
+}
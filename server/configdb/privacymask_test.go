@@ -0,0 +1,70 @@
+package configdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func countHidden(m *PrivacyMask) int {
+	n := 0
+	for _, v := range m.Hidden {
+		if v != 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPrivacyMasks(t *testing.T) {
+	polygons, err := ParsePrivacyMasks(`[[{"x":0,"y":0},{"x":0.5,"y":0},{"x":0.5,"y":0.5},{"x":0,"y":0.5}]]`)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(polygons))
+
+	// Top-left quadrant
+	m := RasterizePrivacyMasks(polygons, 64, 32)
+	require.Equal(t, 32*16, countHidden(m))
+	require.True(t, m.IsHidden(0, 0))
+	require.True(t, m.IsHidden(31, 15))
+	require.False(t, m.IsHidden(32, 15))
+	require.False(t, m.IsHidden(31, 16))
+
+	// Triangle covering the bottom-right half of the frame.
+	// Pixel centers on the diagonal could go either way, so we don't test them.
+	tri := []Polygon{{{1, 0}, {1, 1}, {0, 1}}}
+	m = RasterizePrivacyMasks(tri, 10, 10)
+	require.True(t, m.IsHidden(9, 9))
+	require.True(t, m.IsHidden(9, 1))
+	require.False(t, m.IsHidden(8, 0))
+	require.False(t, m.IsHidden(0, 0))
+
+	// Overlapping polygons are a union
+	both := append(polygons, tri...)
+	m = RasterizePrivacyMasks(both, 10, 10)
+	require.True(t, m.IsHidden(0, 0))
+	require.True(t, m.IsHidden(9, 9))
+	require.False(t, m.IsHidden(0, 9))
+
+	require.Nil(t, RasterizePrivacyMasks(nil, 10, 10))
+
+	// A parent's mask mapped into the crop of a virtual camera, which sees the right half of the parent
+	crop := CropRect{0.5, 0, 1, 1}
+	mapped := crop.MapPolygon(Polygon{{0.25, 0}, {0.75, 0}, {0.75, 1}, {0.25, 1}})
+	m = RasterizePrivacyMasks([]Polygon{mapped}, 10, 10)
+	require.Equal(t, 50, countHidden(m))
+	require.True(t, m.IsHidden(4, 0))
+	require.False(t, m.IsHidden(5, 0))
+
+	require.False(t, (&Camera{}).HasPrivacyMasks())
+	require.False(t, (&Camera{PrivacyMasks: "[]"}).HasPrivacyMasks())
+	require.True(t, (&Camera{PrivacyMasks: "garbage"}).HasPrivacyMasks())
+
+	for _, bad := range []string{
+		`{}`,
+		`[[{"x":0,"y":0},{"x":1,"y":0}]]`,
+		`[[{"x":0,"y":0},{"x":1.5,"y":0},{"x":1,"y":1}]]`,
+	} {
+		_, err := ParsePrivacyMasks(bad)
+		require.Error(t, err, bad)
+	}
+}
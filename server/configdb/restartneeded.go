@@ -1,9 +1,23 @@
 package configdb
 
+import (
+	"reflect"
+	"slices"
+)
+
 func RestartNeeded(c1, c2 *ConfigJSON) bool {
 	if c1.Recording.Path != c2.Recording.Path {
 		return true
 	}
+	if !slices.Equal(c1.Recording.Tiers, c2.Recording.Tiers) {
+		return true
+	}
+	if c1.Recording.Encrypt != c2.Recording.Encrypt {
+		return true
+	}
+	if c1.Recording.Format != c2.Recording.Format {
+		return true
+	}
 	if c1.TempFilePath != c2.TempFilePath {
 		return true
 	}
@@ -13,5 +27,23 @@ func RestartNeeded(c1, c2 *ConfigJSON) bool {
 	if c1.ArcApiKey != c2.ArcApiKey {
 		return true
 	}
+	if !reflect.DeepEqual(c1.Replication, c2.Replication) {
+		return true
+	}
+	if !reflect.DeepEqual(c1.Transcoding, c2.Transcoding) {
+		return true
+	}
+	if !reflect.DeepEqual(c1.Classes, c2.Classes) {
+		return true
+	}
+	if !reflect.DeepEqual(c1.Inference, c2.Inference) {
+		return true
+	}
+	if c1.Tracker != c2.Tracker {
+		return true
+	}
+	if c1.RTSPPort != c2.RTSPPort {
+		return true
+	}
 	return false
 }
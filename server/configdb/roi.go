@@ -0,0 +1,71 @@
+package configdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Limits on the regions of interest of a single camera
+const (
+	MaxRegionsOfInterest = 8
+	MinROIIntervalMS     = 200
+	DefaultROIIntervalMS = 1000
+)
+
+// A region of interest is a part of a camera's frame where objects are too small to be found in the
+// LD stream, such as a gate far from the camera. The monitor periodically decodes an HD frame, and runs
+// the NN on this region of it.
+// SYNC-REGION-OF-INTEREST-JSON
+type RegionOfInterest struct {
+	Rect       string   `json:"rect"`                 // Region of the frame. See ParseCropRect().
+	IntervalMS int      `json:"intervalMS,omitempty"` // Time between scans of the region. Zero = DefaultROIIntervalMS.
+	Tiled      bool     `json:"tiled,omitempty"`      // Scan the region at full HD resolution, in tiles of the NN size. Otherwise the region is scaled to the NN size.
+	Crop       CropRect `json:"-"`                    // Parsed Rect
+}
+
+func (r *RegionOfInterest) Interval() time.Duration {
+	if r.IntervalMS == 0 {
+		return DefaultROIIntervalMS * time.Millisecond
+	}
+	return time.Duration(r.IntervalMS) * time.Millisecond
+}
+
+// Parse the JSON list of regions that is stored in Camera.RegionsOfInterest.
+// An empty string means no regions.
+func ParseRegionsOfInterest(s string) ([]RegionOfInterest, error) {
+	if s == "" {
+		return nil, nil
+	}
+	regions := []RegionOfInterest{}
+	if err := json.Unmarshal([]byte(s), &regions); err != nil {
+		return nil, fmt.Errorf("Invalid regions of interest: %w", err)
+	}
+	if len(regions) > MaxRegionsOfInterest {
+		return nil, fmt.Errorf("Too many regions of interest (%v). The maximum is %v", len(regions), MaxRegionsOfInterest)
+	}
+	for i := range regions {
+		r := &regions[i]
+		crop, err := ParseCropRect(r.Rect)
+		if err != nil {
+			return nil, fmt.Errorf("Region of interest %v: %w", i, err)
+		}
+		r.Crop = crop
+		if r.IntervalMS != 0 && r.IntervalMS < MinROIIntervalMS {
+			return nil, fmt.Errorf("Region of interest %v must be scanned at most every %v ms", i, MinROIIntervalMS)
+		}
+	}
+	return regions, nil
+}
+
+func (c *Camera) ValidateRegionsOfInterest() error {
+	regions, err := ParseRegionsOfInterest(c.RegionsOfInterest)
+	if err != nil {
+		return err
+	}
+	if len(regions) != 0 && c.IsVirtual() {
+		// The NN already sees the HD stream of a virtual camera
+		return fmt.Errorf("A virtual camera can't have regions of interest")
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package configdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegionsOfInterest(t *testing.T) {
+	regions, err := ParseRegionsOfInterest("")
+	require.NoError(t, err)
+	require.Nil(t, regions)
+
+	regions, err = ParseRegionsOfInterest(`[{"rect":"0.6,0.1,0.9,0.3"},{"rect":"0,0,0.5,0.5","intervalMS":500,"tiled":true}]`)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(regions))
+	require.Equal(t, CropRect{0.6, 0.1, 0.9, 0.3}, regions[0].Crop)
+	require.Equal(t, time.Second, regions[0].Interval())
+	require.Equal(t, 500*time.Millisecond, regions[1].Interval())
+	require.True(t, regions[1].Tiled)
+
+	for _, bad := range []string{`{}`, `[{"rect":"0,0,1"}]`, `[{"rect":"0,0,1,1","intervalMS":10}]`} {
+		_, err := ParseRegionsOfInterest(bad)
+		require.Error(t, err, bad)
+	}
+
+	cam := Camera{RegionsOfInterest: `[{"rect":"0.6,0.1,0.9,0.3"}]`}
+	require.NoError(t, cam.ValidateRegionsOfInterest())
+	cam.ParentID = 5
+	require.Error(t, cam.ValidateRegionsOfInterest())
+}
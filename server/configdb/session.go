@@ -2,6 +2,7 @@ package configdb
 
 import (
 	"encoding/base64"
+	"net"
 	"net/http"
 	"strings"
 	"time"
@@ -216,13 +217,9 @@ func (c *ConfigDB) GetUserID(r *http.Request, allowSpecial SpecialAuthMethods) i
 
 	if allowBasic {
 		username, password, haveBasic := r.BasicAuth()
-		if haveBasic && username != "" && password != "" {
-			user := User{}
-			c.DB.Where("username_normalized = ?", NormalizeUsername(username)).Find(&user)
-			if user.ID != 0 {
-				if pwdhash.VerifyHashBase64(password, user.Password) {
-					return user.ID
-				}
+		if haveBasic {
+			if user := c.VerifyUsernamePassword(username, password); user != nil {
+				return user.ID
 			}
 		}
 	} else if len(authorization) > 6 && strings.EqualFold(authorization[:6], "Basic ") {
@@ -232,6 +229,30 @@ func (c *ConfigDB) GetUserID(r *http.Request, allowSpecial SpecialAuthMethods) i
 	return 0
 }
 
+// Returns the user with the given username and password, or nil.
+// This is for BASIC authentication, which the caller must only allow from the LAN.
+func (c *ConfigDB) VerifyUsernamePassword(username, password string) *User {
+	if username == "" || password == "" {
+		return nil
+	}
+	user := User{}
+	c.DB.Where("username_normalized = ?", NormalizeUsername(username)).Find(&user)
+	if user.ID == 0 || !pwdhash.VerifyHashBase64(password, user.Password) {
+		return nil
+	}
+	return &user
+}
+
+// Returns the user with the given username and password, or nil.
+// This is for protocols that only support BASIC authentication, such as RTSP, so like the HTTP API,
+// we refuse callers that are reaching us over the VPN.
+func (c *ConfigDB) VerifyBasicAuth(username, password string, remoteIP net.IP) *User {
+	if !c.IsIPOnLAN(remoteIP) {
+		return nil
+	}
+	return c.VerifyUsernamePassword(username, password)
+}
+
 func (c *ConfigDB) PurgeExpiredSessions() {
 	db, err := c.DB.DB()
 	if err != nil {
@@ -2,7 +2,9 @@ package configdb
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/cyclopcam/cyclops/pkg/kibi"
@@ -17,6 +19,27 @@ type ConfigJSON struct {
 	TempFilePath string        `json:"tempFilePath"` // Temporary file path
 	ArcServer    string        `json:"arcServer"`    // Arc server URL
 	ArcApiKey    string        `json:"arcApiKey"`    // Arc API key
+
+	// Copy recordings to a second location, so that they survive theft or failure of this system
+	Replication *ReplicationJSON `json:"replication,omitempty"`
+
+	// On-demand transcoding of live streams, for remote viewers with little bandwidth
+	Transcoding *TranscodingJSON `json:"transcoding,omitempty"`
+
+	// Which NN classes we track, and how we group them. Nil = built-in defaults.
+	// Cameras can override this. Changing it requires a restart, because the monitor's list of
+	// classes (which includes the abstract classes) is fixed at startup.
+	Classes *ClassesJSON `json:"classes,omitempty"`
+
+	// Run the neural networks on another machine, or let other machines run theirs on us
+	Inference *InferenceJSON `json:"inference,omitempty"`
+
+	// Object tracker. Empty = TrackerGreedy. Changing it requires a restart.
+	Tracker TrackerType `json:"tracker,omitempty"`
+
+	// Serve mosaics over RTSP on this TCP port, for devices such as TVs. Zero = disabled.
+	// Changing it requires a restart.
+	RTSPPort int `json:"rtspPort,omitempty"`
 }
 
 // What causes us to record video
@@ -28,6 +51,24 @@ const (
 	RecordModeOnDetection RecordMode = "detection"
 )
 
+// File format of new recordings
+// SYNC-SYSTEM-VIDEO-FILE-FORMAT
+type VideoFileFormat string
+
+const (
+	VideoFileFormatRF1 VideoFileFormat = "rf1" // Our own format, which is simple and resilient to crashes (default)
+	VideoFileFormatMP4 VideoFileFormat = "mp4" // Fragmented MP4, which can be played by standard tools
+)
+
+// Algorithm that follows objects from one frame to the next
+// SYNC-SYSTEM-TRACKER
+type TrackerType string
+
+const (
+	TrackerGreedy TrackerType = "greedy" // Match each detection to the closest tracked object (default)
+	TrackerKalman TrackerType = "kalman" // Predict motion with a Kalman filter, and find the best assignment. Fewer identity switches in crowded scenes.
+)
+
 // Recording config
 // SYNC-SYSTEM-RECORDING-CONFIG-JSON
 type RecordingJSON struct {
@@ -36,6 +77,84 @@ type RecordingJSON struct {
 	MaxStorageSize    string     `json:"maxStorageSize,omitempty"`    // Maximum storage with optional "gb", "mb", "tb" suffix. If no suffix, then bytes.
 	RecordBeforeEvent int        `json:"recordBeforeEvent,omitempty"` // Record this many seconds before an event
 	RecordAfterEvent  int        `json:"recordAfterEvent,omitempty"`  // Record this many seconds after an event
+
+	// Maximum storage of footage that is protected by holds (eg legal holds). This is in addition
+	// to MaxStorageSize, because held footage does not count towards that limit. Empty = no limit.
+	MaxHeldStorageSize string `json:"maxHeldStorageSize,omitempty"`
+
+	// Slower storage for older recordings, ordered from fastest to slowest.
+	// Path is the fastest tier, and this is where new recordings are written.
+	Tiers []RecordingTierJSON `json:"tiers,omitempty"`
+
+	// Encrypt new recordings. The key is stored in the config database, so a stolen
+	// video disk is useless on its own. Existing recordings are not affected.
+	Encrypt bool `json:"encrypt,omitempty"`
+
+	// File format of new recordings. Existing recordings remain readable if this changes. Empty = rf1.
+	Format VideoFileFormat `json:"format,omitempty"`
+}
+
+// An additional storage volume for older recordings
+// SYNC-SYSTEM-RECORDING-TIER-JSON
+type RecordingTierJSON struct {
+	Path        string `json:"path"`        // Root directory of this tier
+	MinAgeHours int    `json:"minAgeHours"` // Recordings are moved to this tier once they are this many hours old
+}
+
+// Kind of replication target
+type ReplicationTargetType string
+
+const (
+	ReplicationTargetLocal ReplicationTargetType = "local" // Another directory, typically a mounted network share or USB disk
+	ReplicationTargetSFTP  ReplicationTargetType = "sftp"  // SFTP server
+	ReplicationTargetS3    ReplicationTargetType = "s3"    // S3-compatible bucket (AWS, MinIO, Backblaze B2, etc)
+)
+
+// Replication of recordings to a secondary target
+// SYNC-SYSTEM-REPLICATION-JSON
+type ReplicationJSON struct {
+	Enabled    bool                  `json:"enabled"`
+	Type       ReplicationTargetType `json:"type"`
+	Path       string                `json:"path,omitempty"`       // Directory for local and SFTP targets. Key prefix for S3.
+	Host       string                `json:"host,omitempty"`       // SFTP "host:port", or S3 endpoint such as "s3.amazonaws.com" or "minio.local:9000"
+	Username   string                `json:"username,omitempty"`   // SFTP username, or S3 access key ID
+	Password   string                `json:"password,omitempty"`   // SFTP password, or S3 secret access key
+	PrivateKey string                `json:"privateKey,omitempty"` // SFTP private key (PEM). Used instead of Password, if present.
+	HostKey    string                `json:"hostKey,omitempty"`    // SFTP server's public key, in authorized_keys format. If empty, we save the key of the first connection.
+	Bucket     string                `json:"bucket,omitempty"`     // S3 bucket
+	Region     string                `json:"region,omitempty"`     // S3 region
+	DisableTLS bool                  `json:"disableTLS,omitempty"` // Use plain HTTP to talk to the S3 endpoint (only sensible on a LAN)
+	EventsOnly bool                  `json:"eventsOnly,omitempty"` // Only replicate video that overlaps with detected events
+	MaxAgeDays int                   `json:"maxAgeDays,omitempty"` // Delete replicated video that is older than this. Zero = keep forever.
+}
+
+// Live stream transcoding
+// SYNC-SYSTEM-TRANSCODING-JSON
+type TranscodingJSON struct {
+	MaxCPU   float64                `json:"maxCPU,omitempty"`   // Maximum number of CPU cores that all transcoders may use together. Zero = 1.
+	Profiles []TranscodeProfileJSON `json:"profiles,omitempty"` // Additional profiles, on top of the built-in ones. A profile with the same name as a built-in profile replaces it.
+}
+
+// A transcoding profile
+// SYNC-SYSTEM-TRANSCODE-PROFILE-JSON
+type TranscodeProfileJSON struct {
+	Name             string `json:"name"`
+	MaxWidth         int    `json:"maxWidth"`                   // Video is scaled down to fit inside MaxWidth x MaxHeight
+	MaxHeight        int    `json:"maxHeight"`                  //
+	FPS              int    `json:"fps,omitempty"`              // Maximum frames per second. Zero = same as the camera.
+	BitrateKbps      int    `json:"bitrateKbps"`                // Target bitrate, in kilobits per second
+	KeyframeInterval int    `json:"keyframeInterval,omitempty"` // Frames between keyframes. Zero = 2 seconds worth.
+	KeyframesOnly    bool   `json:"keyframesOnly,omitempty"`    // Only decode the camera's keyframes. Much cheaper, but the frame rate is very low.
+}
+
+// Remote inference
+// SYNC-SYSTEM-INFERENCE-JSON
+type InferenceJSON struct {
+	RemoteURL       string `json:"remoteURL,omitempty"`       // If not empty, run our models on this server (eg "http://192.168.1.20"), and fall back to running them locally if it is unreachable
+	RemoteKey       string `json:"remoteKey,omitempty"`       // Must match the remote server's ServeKey
+	RemoteTimeoutMS int    `json:"remoteTimeoutMS,omitempty"` // Timeout of each remote request. Zero = 2000.
+	Serve           bool   `json:"serve,omitempty"`           // Run our models on behalf of other systems
+	ServeKey        string `json:"serveKey,omitempty"`        // Clients must present this key. Required if Serve is true.
 }
 
 func (r *RecordingJSON) RecordBeforeEventDuration() time.Duration {
@@ -52,23 +171,38 @@ func (r *RecordingJSON) RecordAfterEventDuration() time.Duration {
 	return time.Duration(r.RecordAfterEvent) * time.Second
 }
 
-// Holding off on this for now. I'd rather have it in code, until it's obvious that it
-// belongs on config.
-// AI config
-//type AIConfigJSON struct {
-//	// Used to map from an NN class to another class, which could be a more abstract class.
-//	// eg {"car": "vehicle", "truck": "vehicle"}
-//	// We should really be training our own NN that does this kind of mapping, but this
-//	// is a reasonable solution until we get there.
-//	RemapClasses map[string]string `json:"remapClasses,omitempty"`
-//}
-
 // Returns an error if there is anything invalid about the config, or nil if everything is OK
 func ValidateConfig(c *ConfigJSON) error {
 	if err := ValidateRecordingConfig(true, &c.Recording); err != nil {
 		return err
 	}
 
+	if c.Replication != nil {
+		if err := ValidateReplicationConfig(c.Replication); err != nil {
+			return err
+		}
+	}
+
+	if c.Transcoding != nil {
+		if err := ValidateTranscodingConfig(c.Transcoding); err != nil {
+			return err
+		}
+	}
+
+	if c.Inference != nil {
+		if err := ValidateInferenceConfig(c.Inference); err != nil {
+			return err
+		}
+	}
+
+	if err := ValidateTracker(c.Tracker); err != nil {
+		return err
+	}
+
+	if err := ValidateRTSPPort(c.RTSPPort); err != nil {
+		return err
+	}
+
 	if _, err := util.FindAnyTempFileDirectory(c.TempFilePath); err != nil {
 		return fmt.Errorf("Invalid temporary file path '%v': %w", c.TempFilePath, err)
 	}
@@ -99,6 +233,131 @@ func ValidateRecordingConfig(isDefaults bool, c *RecordingJSON) error {
 			return fmt.Errorf("Invalid max storage size '%v': %w", c.MaxStorageSize, err)
 		}
 	}
+	if c.MaxHeldStorageSize != "" {
+		if _, err := kibi.ParseBytes(c.MaxHeldStorageSize); err != nil {
+			return fmt.Errorf("Invalid max held storage size '%v': %w", c.MaxHeldStorageSize, err)
+		}
+	}
+	if c.Format != "" && c.Format != VideoFileFormatRF1 && c.Format != VideoFileFormatMP4 {
+		return fmt.Errorf("Invalid video file format '%v'. Valid formats are 'rf1' and 'mp4'", c.Format)
+	}
+	if c.Format == VideoFileFormatMP4 && c.Encrypt {
+		return fmt.Errorf("Encryption is only supported by the rf1 video file format")
+	}
+	if !isDefaults && len(c.Tiers) != 0 {
+		return fmt.Errorf("Storage tiers can only be configured for the whole system")
+	}
+	prevAge := 0
+	for _, tier := range c.Tiers {
+		if tier.Path == "" {
+			return fmt.Errorf("Storage tier path is required")
+		}
+		if filepath.Clean(tier.Path) == filepath.Clean(c.Path) {
+			return fmt.Errorf("Storage tier '%v' is the same as the Video Location", tier.Path)
+		}
+		if tier.MinAgeHours <= prevAge {
+			return fmt.Errorf("Storage tier '%v' must have a minimum age greater than %v hours", tier.Path, prevAge)
+		}
+		prevAge = tier.MinAgeHours
+	}
+	return nil
+}
+
+func ValidateTranscodingConfig(c *TranscodingJSON) error {
+	if c.MaxCPU < 0 {
+		return fmt.Errorf("Transcoding MaxCPU may not be negative")
+	}
+	seen := map[string]bool{}
+	for _, p := range c.Profiles {
+		if p.Name == "" {
+			return fmt.Errorf("Transcoding profile name is required")
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("Transcoding profile '%v' is defined more than once", p.Name)
+		}
+		seen[p.Name] = true
+		if p.MaxWidth < 16 || p.MaxHeight < 16 {
+			return fmt.Errorf("Transcoding profile '%v' must be at least 16 x 16", p.Name)
+		}
+		if p.BitrateKbps <= 0 {
+			return fmt.Errorf("Transcoding profile '%v' needs a bitrate", p.Name)
+		}
+		if p.FPS < 0 || p.KeyframeInterval < 0 {
+			return fmt.Errorf("Transcoding profile '%v' has a negative FPS or keyframe interval", p.Name)
+		}
+	}
+	return nil
+}
+
+func ValidateReplicationConfig(c *ReplicationJSON) error {
+	if !c.Enabled {
+		return nil
+	}
+	switch c.Type {
+	case ReplicationTargetLocal:
+		if c.Path == "" {
+			return fmt.Errorf("Replication path is required")
+		}
+		if !filepath.IsAbs(c.Path) {
+			return fmt.Errorf("Replication path '%v' must be an absolute path", c.Path)
+		}
+	case ReplicationTargetSFTP:
+		if c.Host == "" || c.Username == "" {
+			return fmt.Errorf("SFTP replication requires a host and username")
+		}
+		if c.Password == "" && c.PrivateKey == "" {
+			return fmt.Errorf("SFTP replication requires a password or private key")
+		}
+	case ReplicationTargetS3:
+		if c.Host == "" || c.Bucket == "" {
+			return fmt.Errorf("S3 replication requires an endpoint and bucket")
+		}
+		if c.Username == "" || c.Password == "" {
+			return fmt.Errorf("S3 replication requires an access key and secret key")
+		}
+	default:
+		return fmt.Errorf("Invalid replication type '%v'. Valid types are 'local', 'sftp', and 's3'", c.Type)
+	}
+	if c.MaxAgeDays < 0 {
+		return fmt.Errorf("Replication max age may not be negative")
+	}
+	return nil
+}
+
+func ValidateTracker(t TrackerType) error {
+	if t != "" && t != TrackerGreedy && t != TrackerKalman {
+		return fmt.Errorf("Invalid tracker '%v'. Valid trackers are 'greedy' and 'kalman'", t)
+	}
+	return nil
+}
+
+func ValidateRTSPPort(port int) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("Invalid RTSP port %v", port)
+	}
+	return nil
+}
+
+func ValidateInferenceConfig(c *InferenceJSON) error {
+	if c.RemoteURL != "" {
+		u, err := url.Parse(c.RemoteURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Remote inference URL '%v' must be an http or https URL", c.RemoteURL)
+		}
+		if c.RemoteKey == "" {
+			return fmt.Errorf("Remote inference requires a key")
+		}
+	}
+	if c.RemoteTimeoutMS < 0 {
+		return fmt.Errorf("Remote inference timeout may not be negative")
+	}
+	if c.Serve && c.ServeKey == "" {
+		return fmt.Errorf("Serving inference requires a key")
+	}
+	if c.Serve && c.RemoteURL != "" {
+		// We would just be relaying requests, possibly back to ourselves
+		return fmt.Errorf("A system that uses remote inference can't also serve it")
+	}
 	return nil
 }
 
@@ -108,6 +367,31 @@ func (c *ConfigDB) GetConfig() ConfigJSON {
 	return c.config
 }
 
+// Save the SFTP host key that the replication target presented on our first connection,
+// so that we refuse any other key from now on (trust on first use).
+// This does nothing if a host key is already configured.
+func (c *ConfigDB) PinReplicationHostKey(hostKey string) error {
+	c.configLock.Lock()
+	defer c.configLock.Unlock()
+	if c.config.Replication == nil || c.config.Replication.HostKey != "" {
+		return nil
+	}
+	cfg := c.config
+	replication := *cfg.Replication
+	replication.HostKey = hostKey
+	cfg.Replication = &replication
+	systemConfig := SystemConfig{
+		Key:   "main",
+		Value: dbh.MakeJSONField(cfg),
+	}
+	if err := c.DB.Save(&systemConfig).Error; err != nil {
+		return err
+	}
+	c.config = cfg
+	c.Log.Infof("Saved SFTP host key of replication target")
+	return nil
+}
+
 // Return true if the system needs to be restarted for the config changes to take effect
 func (c *ConfigDB) SetConfig(cfg ConfigJSON) (bool, error) {
 	if err := ValidateConfig(&cfg); err != nil {
@@ -0,0 +1,17 @@
+package configdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackerConfig(t *testing.T) {
+	require.NoError(t, ValidateTracker(""))
+	require.NoError(t, ValidateTracker(TrackerGreedy))
+	require.NoError(t, ValidateTracker(TrackerKalman))
+	require.Error(t, ValidateTracker("sort"))
+
+	require.False(t, RestartNeeded(&ConfigJSON{}, &ConfigJSON{}))
+	require.True(t, RestartNeeded(&ConfigJSON{}, &ConfigJSON{Tracker: TrackerKalman}))
+}
@@ -0,0 +1,129 @@
+package configdb
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
+	"gorm.io/gorm"
+)
+
+// Size of the master key for encrypted video (AES-256)
+const VideoKeySize = 32
+
+// Master keys for encrypted video.
+// Each video file has its own data key, which is encrypted with the master key.
+type VideoKeys struct {
+	Current  []byte // New video is encrypted with this key. Nil if encryption has never been enabled.
+	Previous []byte // Non-nil while a re-key is in progress. Some video files are still encrypted with this key.
+}
+
+// Build a keyring that can decrypt video encrypted with either key.
+// Returns nil if there are no keys.
+func (k *VideoKeys) Keyring() (*rf1.Keyring, error) {
+	if k.Current == nil {
+		return nil, nil
+	}
+	if k.Previous != nil {
+		return rf1.NewKeyring(k.Current, k.Previous)
+	}
+	return rf1.NewKeyring(k.Current)
+}
+
+// Read the video encryption keys.
+// If create is true, and no key exists yet, then a new key is generated.
+// We never delete keys, because old recordings need them, even if encryption is later disabled.
+func GetVideoKeys(db *gorm.DB, create bool) (*VideoKeys, error) {
+	keys := &VideoKeys{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if keys.Current, err = readBinaryKey(tx, KeyVideo); err != nil {
+			return err
+		}
+		if keys.Previous, err = readBinaryKey(tx, KeyVideoPrevious); err != nil {
+			return err
+		}
+		if keys.Current == nil && create {
+			if keys.Current, err = generateVideoKey(); err != nil {
+				return err
+			}
+			return writeBinaryKey(tx, KeyVideo, keys.Current)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Replace the video encryption key with a new key.
+// The old key is kept as the previous key, until FinishVideoRekey is called,
+// after all video files have been re-encrypted with the new key.
+// If a previous re-key was interrupted, then we resume it, instead of generating another key.
+func BeginVideoRekey(db *gorm.DB) (*VideoKeys, error) {
+	keys := &VideoKeys{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if keys.Current, err = readBinaryKey(tx, KeyVideo); err != nil {
+			return err
+		}
+		if keys.Current == nil {
+			return errors.New("Video encryption has never been enabled")
+		}
+		if keys.Previous, err = readBinaryKey(tx, KeyVideoPrevious); err != nil {
+			return err
+		}
+		if keys.Previous != nil {
+			// Resume an interrupted re-key
+			return nil
+		}
+		keys.Previous = keys.Current
+		if keys.Current, err = generateVideoKey(); err != nil {
+			return err
+		}
+		if err := writeBinaryKey(tx, KeyVideoPrevious, keys.Previous); err != nil {
+			return err
+		}
+		return writeBinaryKey(tx, KeyVideo, keys.Current)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Forget the previous video key, once no video files use it anymore
+func FinishVideoRekey(db *gorm.DB) error {
+	return db.Where("name = ?", KeyVideoPrevious).Delete(&Key{}).Error
+}
+
+func generateVideoKey() ([]byte, error) {
+	key := make([]byte, VideoKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Returns nil if the key does not exist
+func readBinaryKey(tx *gorm.DB, name string) ([]byte, error) {
+	records := []Key{}
+	if err := tx.Where("name = ?", name).Find(&records).Error; err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(records[0].Value)
+	if err != nil {
+		return nil, fmt.Errorf("Key '%v' is corrupt: %w", name, err)
+	}
+	return key, nil
+}
+
+func writeBinaryKey(tx *gorm.DB, name string, key []byte) error {
+	return tx.Save(&Key{Name: name, Value: base64.StdEncoding.EncodeToString(key)}).Error
+}
@@ -3,12 +3,16 @@ package livecameras
 import (
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cyclopcam/cyclops/pkg/kibi"
 	"github.com/cyclopcam/cyclops/pkg/videoformat/fsv"
 	"github.com/cyclopcam/cyclops/server/camera"
 	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/cyclops/server/defs"
 	"github.com/cyclopcam/cyclops/server/monitor"
+	"github.com/cyclopcam/cyclops/server/videodb"
 	"github.com/cyclopcam/logs"
 )
 
@@ -31,7 +35,8 @@ type LiveCameras struct {
 	configDB       *configdb.ConfigDB
 	shutdown       chan bool // The parent system closes this channel when it wants us to shutdown
 	monitor        *monitor.Monitor
-	archive        *fsv.Archive // archive can be nil, in which case we can't record
+	archive        *fsv.Archive     // archive can be nil, in which case we can't record
+	videoDB        *videodb.VideoDB // Can be nil
 	ringBufferSize int
 
 	camerasLock  sync.Mutex
@@ -42,6 +47,8 @@ type LiveCameras struct {
 	periodicWakeInterval   time.Duration // Interval between auto wake up and reconnect cameras that have stopped sending packets
 	timeUntilCameraRestart time.Duration // Wait this long for a camera to be silent, before restarting it
 	closeTestCameraAfter   time.Duration // Close the test camera after this long
+	clockCheckInterval     time.Duration // Interval between measurements of each camera's clock drift
+	clockCheckRunning      atomic.Bool   // True while the clock drift measurement thread is running
 
 	// In order to speed up the UX sequence of Test Camera, Add Camera, we hang onto the most recently
 	// tested camera. This prevents an often multi-second delay that the user would experience
@@ -79,9 +86,9 @@ func (r *cameraRecordState) isRecording() bool {
 }
 
 // Create a new LiveCameras object.
-// archive can be nil, in which case we can't record.
+// archive can be nil, in which case we can't record. videoDB can also be nil.
 // shutdown is a channel that the parent system will close when it wants us to shutdown.
-func NewLiveCameras(logger logs.Log, configDB *configdb.ConfigDB, shutdown chan bool, monitor *monitor.Monitor, archive *fsv.Archive, ringBufferSize int) *LiveCameras {
+func NewLiveCameras(logger logs.Log, configDB *configdb.ConfigDB, shutdown chan bool, monitor *monitor.Monitor, archive *fsv.Archive, videoDB *videodb.VideoDB, ringBufferSize int) *LiveCameras {
 	lc := &LiveCameras{
 		ShutdownComplete:       make(chan bool),
 		log:                    logs.NewPrefixLogger(logger, "LiveCameras:"),
@@ -89,12 +96,14 @@ func NewLiveCameras(logger logs.Log, configDB *configdb.ConfigDB, shutdown chan
 		shutdown:               shutdown,
 		monitor:                monitor,
 		archive:                archive,
+		videoDB:                videoDB,
 		ringBufferSize:         ringBufferSize,
 		cameraFromID:           map[int64]*camera.Camera{},
 		wake:                   make(chan bool, 50),
 		periodicWakeInterval:   10 * time.Second,
 		timeUntilCameraRestart: 5 * time.Second,
 		closeTestCameraAfter:   60 * time.Second,
+		clockCheckInterval:     6 * time.Hour,
 		allCameraMonitorMsg:    monitor.AddWatcherAllCameras(),
 		recordThreadShutdown:   make(chan bool),
 		recordThreadWake:       make(chan bool, 50),
@@ -251,6 +260,10 @@ func (s *LiveCameras) startStopConfiguredCameras() {
 	sort.Slice(configs, func(i, j int) bool {
 		return configs[i].UpdatedAt > configs[j].UpdatedAt
 	})
+	// Virtual cameras are created from their parent, so the physical cameras must be started first
+	sort.SliceStable(configs, func(i, j int) bool {
+		return !configs[i].IsVirtual() && configs[j].IsVirtual()
+	})
 
 	// Close the last tested camera if timeout has expired
 	s.lastTestedCameraLock.Lock()
@@ -278,6 +291,10 @@ func (s *LiveCameras) startStopConfiguredCameras() {
 		s.removeCamera(cam)
 	}
 
+	s.applyRetentionPolicies(configs)
+	s.applyThinningPolicies(configs)
+	s.applyVirtualCameras(configs)
+
 	// If true, then we need a monitor.SetCameras() call
 	needMonitorRefresh := false
 
@@ -295,6 +312,13 @@ func (s *LiveCameras) startStopConfiguredCameras() {
 			break
 		}
 
+		if cfg.IsVirtual() {
+			if s.startStopVirtualCamera(cfg) {
+				needMonitorRefresh = true
+			}
+			continue
+		}
+
 		if existing := s.CameraFromID(cfg.ID); existing != nil {
 			existingConfig := existing.Config.Load()
 			if time.Now().Sub(existing.LastPacketAt()) > s.timeUntilCameraRestart {
@@ -354,6 +378,148 @@ func (s *LiveCameras) startStopConfiguredCameras() {
 	if needMonitorRefresh {
 		s.monitor.SetCameras(s.Cameras())
 	}
+
+	s.checkCameraClocks()
+}
+
+// Start, restart, or update a virtual camera.
+// Virtual cameras have no connection of their own, so they only need to be recreated when their
+// parent is restarted, or when their crop or parent changes.
+// Returns true if the monitor needs to be told about the change.
+func (s *LiveCameras) startStopVirtualCamera(cfg *configdb.Camera) bool {
+	parent := s.CameraFromID(cfg.ParentID)
+	if parent != nil && parent.IsVirtual() {
+		parent = nil
+	}
+	existing := s.CameraFromID(cfg.ID)
+	if existing != nil {
+		existingConfig := existing.Config.Load()
+		if existing.Parent == parent && existingConfig.EqualsConnection(cfg) {
+			if existingConfig.DeepEquals(cfg) {
+				return false
+			}
+			s.log.Infof("Camera %v (%v) configuration changed. Updating", cfg.ID, cfg.Name)
+			existing.Config.Store(cfg)
+			return true
+		}
+		s.log.Infof("Virtual camera %v (%v) crop or parent changed. Restarting", cfg.ID, cfg.Name)
+		existing.Close(nil)
+		s.removeCamera(existing)
+	}
+	if parent == nil {
+		// The parent is not running yet (or is misconfigured). We'll try again next time.
+		return existing != nil
+	}
+	cam, err := camera.NewVirtualCamera(s.log, *cfg, parent)
+	if err != nil {
+		s.log.Errorf("Error creating virtual camera %v (%v): %v", cfg.ID, cfg.Name, err)
+		return existing != nil
+	}
+	s.log.Infof("Started virtual camera %v (%v) from camera %v (%v)", cfg.ID, cfg.Name, parent.ID(), parent.Name())
+	s.addCamera(cam, false)
+	return true
+}
+
+// Convert the per-camera retention rules into archive retention policies.
+// Each camera's LD and HD streams share a single policy, so the byte quota covers both.
+func (s *LiveCameras) applyRetentionPolicies(configs []*configdb.Camera) {
+	if s.archive == nil {
+		return
+	}
+	policies := []fsv.RetentionPolicy{}
+	for _, cfg := range configs {
+		if cfg.IsVirtual() || !cfg.HasRetentionPolicy() {
+			continue
+		}
+		if err := cfg.ValidateRetention(); err != nil {
+			s.log.Errorf("Ignoring invalid retention policy of camera %v (%v): %v", cfg.ID, cfg.Name, err)
+			continue
+		}
+		maxBytes, _ := kibi.ParseBytes(cfg.MaxStorageSize)
+		policies = append(policies, fsv.RetentionPolicy{
+			Streams: []string{
+				videodb.VideoStreamNameForCamera(cfg.LongLivedName, defs.ResLD),
+				videodb.VideoStreamNameForCamera(cfg.LongLivedName, defs.ResHD),
+			},
+			MinAge:   time.Duration(cfg.MinRetentionDays) * 24 * time.Hour,
+			MaxAge:   time.Duration(cfg.MaxRetentionDays) * 24 * time.Hour,
+			MaxBytes: maxBytes,
+		})
+	}
+	if err := s.archive.SetRetentionPolicies(policies); err != nil {
+		s.log.Errorf("Failed to set retention policies: %v", err)
+	}
+}
+
+// Tell the video DB which cameras are virtual, so that it can find the video of their events
+func (s *LiveCameras) applyVirtualCameras(configs []*configdb.Camera) {
+	if s.videoDB == nil {
+		return
+	}
+	idToName := map[int64]string{}
+	for _, cfg := range configs {
+		idToName[cfg.ID] = cfg.LongLivedName
+	}
+	virtualToParent := map[string]string{}
+	for _, cfg := range configs {
+		if parent, ok := idToName[cfg.ParentID]; ok && cfg.IsVirtual() {
+			virtualToParent[cfg.LongLivedName] = parent
+		}
+	}
+	s.videoDB.SetVirtualCameras(virtualToParent)
+}
+
+// Tell the archive which cameras want their old HD footage reduced to keyframes
+func (s *LiveCameras) applyThinningPolicies(configs []*configdb.Camera) {
+	if s.archive == nil {
+		return
+	}
+	policies := []fsv.ThinningPolicy{}
+	for _, cfg := range configs {
+		if cfg.IsVirtual() || cfg.ThinHDAfterDays <= 0 {
+			continue
+		}
+		policies = append(policies, fsv.ThinningPolicy{
+			Streams: []string{videodb.VideoStreamNameForCamera(cfg.LongLivedName, defs.ResHD)},
+			MinAge:  time.Duration(cfg.ThinHDAfterDays) * 24 * time.Hour,
+		})
+	}
+	if err := s.archive.SetThinningPolicies(policies); err != nil {
+		s.log.Errorf("Failed to set thinning policies: %v", err)
+	}
+}
+
+// Measure the clock drift of cameras that haven't been measured recently.
+// The measurements are network calls, so they run on a separate thread, to
+// avoid stalling the auto starter.
+func (s *LiveCameras) checkCameraClocks() {
+	due := []*camera.Camera{}
+	for _, cam := range s.Cameras() {
+		if cam.IsVirtual() {
+			continue
+		}
+		status := cam.ClockStatus()
+		if status == nil || time.Now().Sub(status.MeasuredAt) > s.clockCheckInterval {
+			due = append(due, cam)
+		}
+	}
+	if len(due) == 0 || !s.clockCheckRunning.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer s.clockCheckRunning.Store(false)
+		for _, cam := range due {
+			if s.isShuttingDown() {
+				return
+			}
+			status := cam.MeasureClockDrift()
+			if status.Error != "" {
+				s.log.Infof("Unable to read clock of camera %v (%v) via ONVIF: %v", cam.ID(), cam.Name(), status.Error)
+			} else if status.IsOutOfSync() {
+				s.log.Warnf("Camera %v (%v) clock is off by %v (%v)", cam.ID(), cam.Name(), status.Drift, status.DateTimeType)
+			}
+		}
+	}()
 }
 
 // Returns true if the system wants us to shutdown
@@ -52,10 +52,18 @@ func (s *LiveCameras) getRecordState(cameraID int64) *cameraRecordState {
 
 // Called by recorderThread when it receives a message from the monitor.
 func (s *LiveCameras) processMonitorMessage(msg *monitor.AnalysisState) {
+	// A virtual camera records into its parent's streams, so a detection on
+	// the virtual camera is a reason to record the parent.
+	// Obey the lock hierarchy, and look up the camera before taking recordStateLock.
+	cameraID := msg.CameraID
+	if cam := s.CameraFromID(cameraID); cam != nil && cam.IsVirtual() {
+		cameraID = cam.Parent.ID()
+	}
+
 	s.recordStateLock.Lock()
 	defer s.recordStateLock.Unlock()
 
-	state := s.getRecordState(msg.CameraID)
+	state := s.getRecordState(cameraID)
 
 	// The Monitor doesn't send us messages for uninteresting object detections,
 	// so if we receive this message with a non-zero object count, then we know
@@ -105,6 +113,10 @@ func (s *LiveCameras) startStopRecorderForAllCameras() {
 	//s.log.Warnf("Camera recording mode: %v", systemConfig.Recording.Mode)
 
 	for id, cam := range s.cameraFromID {
+		if cam.IsVirtual() {
+			// Virtual cameras are recorded by their parent
+			continue
+		}
 		// Some day we might allow individual cameras to override the global recording mode,
 		// which is why I introduce this arbitrary variable here.
 		cameraRecordingMode := systemConfig.Recording.Mode
@@ -26,11 +26,14 @@ runloop:
 
 func (m *Monitor) analyzeFrameForAlarmTrigger(event *AnalysisState) {
 	var objectBitmap []byte
+	camera := m.cameraByID(event.CameraID)
+	if camera == nil {
+		return
+	}
 	for _, obj := range event.Objects {
-		if obj.Genuine == 0 || m.nnClassList[obj.Class] != "person" {
+		if obj.Genuine == 0 || !camera.classSettings.alarm[m.nnClassList[obj.Class]] {
 			continue
 		}
-		camera := m.cameraByID(event.CameraID)
 		dz := camera.detectionZone
 		trigger := false
 		if dz != nil {
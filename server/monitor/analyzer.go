@@ -1,12 +1,15 @@
 package monitor
 
 import (
+	"maps"
 	"math"
 	"sort"
 	"time"
 
 	"github.com/bmharper/ringbuffer"
 	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/cyclops/pkg/tracker"
+	"github.com/cyclopcam/cyclops/server/configdb"
 )
 
 // If true, then alert on all classes in the COCO set
@@ -14,18 +17,20 @@ import (
 const includeAllClasses = false
 
 type analyzerSettings struct {
-	positionHistorySize       int            // Keep a ring buffer of the last N positions of each object
-	maxAnalyzeObjectsPerFrame int            // Maximum number of objects to analyze per frame
-	minDistance               map[string]int // Minimum distance that an object must travel to be considered a true detection (in pixels)
-	minDistanceDefault        int            // Default, if no class override
-	minSightings              map[string]int // Minimum number of sightings that an object must have to be considered a true detection
-	minSightingsDefault       int            // Default, if no class override
-	objectForgetTime          time.Duration  // After this amount of time of not seeing an object, we believe it has left the frame, or was a false detection
+	positionHistorySize       int                      // Keep a ring buffer of the last N positions of each object
+	maxAnalyzeObjectsPerFrame int                      // Maximum number of objects to analyze per frame
+	minDistance               map[string]int           // Minimum distance that an object must travel to be considered a true detection (in pixels)
+	minDistanceDefault        int                      // Default, if no class override
+	minSightings              map[string]int           // Minimum number of sightings that an object must have to be considered a true detection
+	minSightingsDefault       int                      // Default, if no class override
+	objectForgetTime          time.Duration            // After this amount of time of not seeing an object, we believe it has left the frame, or was a false detection
+	objectForgetTimes         map[string]time.Duration // Class overrides of objectForgetTime
 
 	// If an object is determined by the HQ network to be a false positive, but we keep
 	// seeing it in the LQ network, then re-run the HQ analysis every X seconds, to make
 	// sure we haven't missed a genuine object.
-	revalidateInterval time.Duration
+	revalidateInterval  time.Duration
+	revalidateIntervals map[string]time.Duration // Class overrides of revalidateInterval
 
 	verbose bool // Print out debug information
 }
@@ -51,12 +56,59 @@ func newAnalyzerSettings(verbose bool) *analyzerSettings {
 		minSightings: map[string]int{
 			"person": 3, // People are almost always alarmable events, so we need a super low false positive rate
 		},
-		objectForgetTime:   5 * time.Second,
-		revalidateInterval: 2 * time.Second,
-		verbose:            verbose,
+		objectForgetTime:    5 * time.Second,
+		objectForgetTimes:   map[string]time.Duration{},
+		revalidateInterval:  2 * time.Second,
+		revalidateIntervals: map[string]time.Duration{},
+		verbose:             verbose,
 	}
 }
 
+// Returns a copy of the settings, with a camera's overrides applied.
+// Camera-wide overrides replace the built-in class values, and class overrides take precedence over those.
+func (a *analyzerSettings) withOverrides(o *configdb.AnalyzerSettings) *analyzerSettings {
+	c := *a
+	c.minDistance = maps.Clone(a.minDistance)
+	c.minSightings = maps.Clone(a.minSightings)
+	c.objectForgetTimes = maps.Clone(a.objectForgetTimes)
+	c.revalidateIntervals = maps.Clone(a.revalidateIntervals)
+	if o.MinDistance != nil {
+		c.minDistanceDefault = *o.MinDistance
+		clear(c.minDistance)
+	}
+	if o.MinSightings != nil {
+		c.minSightingsDefault = *o.MinSightings
+		clear(c.minSightings)
+	}
+	if o.ObjectForgetTime != nil {
+		c.objectForgetTime = secondsToDuration(*o.ObjectForgetTime)
+		clear(c.objectForgetTimes)
+	}
+	if o.RevalidateInterval != nil {
+		c.revalidateInterval = secondsToDuration(*o.RevalidateInterval)
+		clear(c.revalidateIntervals)
+	}
+	for cls, t := range o.Classes {
+		if t.MinDistance != nil {
+			c.minDistance[cls] = *t.MinDistance
+		}
+		if t.MinSightings != nil {
+			c.minSightings[cls] = *t.MinSightings
+		}
+		if t.ObjectForgetTime != nil {
+			c.objectForgetTimes[cls] = secondsToDuration(*t.ObjectForgetTime)
+		}
+		if t.RevalidateInterval != nil {
+			c.revalidateIntervals[cls] = secondsToDuration(*t.RevalidateInterval)
+		}
+	}
+	return &c
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
 func (a *analyzerSettings) minSightingsForClass(cls string) int {
 	if val, ok := a.minSightings[cls]; ok {
 		return val
@@ -71,6 +123,20 @@ func (a *analyzerSettings) minDistanceForClass(cls string) int {
 	return a.minDistanceDefault
 }
 
+func (a *analyzerSettings) objectForgetTimeForClass(cls string) time.Duration {
+	if val, ok := a.objectForgetTimes[cls]; ok {
+		return val
+	}
+	return a.objectForgetTime
+}
+
+func (a *analyzerSettings) revalidateIntervalForClass(cls string) time.Duration {
+	if val, ok := a.revalidateIntervals[cls]; ok {
+		return val
+	}
+	return a.revalidateInterval
+}
+
 // A time and position where we saw an object
 type timeAndPosition struct {
 	time      time.Time
@@ -100,6 +166,8 @@ type trackedObject struct {
 	validation            validationStatus                  // HQ network validation
 	sightingsAtValidation int                               // The value of totalSightings when we last ran validation on this object
 	validationPosition    nn.Rect                           // Position where object was found by the LQ network, and we want to find the object in the same position in the HQ network
+	trackState            trackState                        // Only maintained by kalmanTracker
+	motion                tracker.BoxFilter                 // Only maintained by kalmanTracker
 }
 
 // Internal state of the analyzer for a single camera
@@ -109,6 +177,16 @@ type analyzerCameraState struct {
 	tracked     []*trackedObject
 	lastHQFrame time.Time
 	lastSeen    time.Time
+	offline     *OfflineAnalyzer // Non-nil if this camera's frames are recorded footage, instead of live frames
+}
+
+// Returns the time against which the analyzer measures intervals, such as the time since the last HQ frame.
+// This is the wall clock for live frames, and the time of the frame for recorded footage.
+func (c *analyzerCameraState) now() time.Time {
+	if c.offline != nil {
+		return c.offline.framePTS
+	}
+	return time.Now()
 }
 
 // SYNC-TIME-AND-POSITION
@@ -235,7 +313,7 @@ func (m *Monitor) analyzer() {
 	m.analyzerStopped <- true
 }
 
-// Create abstract objects for each detection, based on nnClassAbstract.
+// Create abstract objects for each detection, based on classSettings.abstract.
 // For example, car -> vehicle, truck -> vehicle, etc.
 func (m *Monitor) createAbstractObjects(objects []nn.ObjectDetection) []nn.ProcessedObject {
 	processed := []nn.ProcessedObject{}
@@ -248,7 +326,7 @@ func (m *Monitor) createAbstractObjects(objects []nn.ObjectDetection) []nn.Proce
 			Class: objects[i].Class,
 		})
 
-		abstractClass := m.nnClassAbstract[m.nnClassList[objects[i].Class]]
+		abstractClass := m.classSettings.abstract[m.nnClassList[objects[i].Class]]
 		if abstractClass != "" {
 			//fmt.Printf("abstractClass %v -> %v\n", m.nnClassList[objects[i].Class], abstractClass)
 			abstractIdx, ok := m.nnClassMap[abstractClass]
@@ -269,6 +347,10 @@ func (m *Monitor) sendFrameForValidation(cam *analyzerCameraState, item analyzer
 	if m.analyzerSettings.verbose {
 		m.Log.Infof("Analyzer (cam %v): Sending frame %v for validation", cam.cameraID, item.imgID)
 	}
+	if cam.offline != nil {
+		cam.offline.validate = append(cam.offline.validate, item)
+		return
+	}
 	m.nnThreadQueue <- monitorQueueItem{
 		isHQ:     true,
 		imgID:    item.imgID,
@@ -282,7 +364,7 @@ func (m *Monitor) sendFrameForValidation(cam *analyzerCameraState, item analyzer
 func (m *Monitor) analyzeFrame(cam *analyzerCameraState, item analyzerQueueItem) {
 	settings := &m.analyzerSettings
 	framePTS := item.detection.FramePTS
-	now := time.Now()
+	now := cam.now()
 
 	// New abstract class strategy:
 	// Delay processing of abstract classes until later
@@ -300,7 +382,8 @@ func (m *Monitor) analyzeFrame(cam *analyzerCameraState, item analyzerQueueItem)
 	//	keepDetections[i] = i
 	//}
 
-	keepDetections := nn.MergeSimilarObjects(processed, m.nnClassBoxMerge, m.nnClassList, 0.9)
+	classes := cam.monCam.classSettings
+	keepDetections := nn.MergeSimilarObjects(processed, classes.boxMerge, m.nnClassList, 0.9)
 
 	/*
 		// Create abstract objects before merging, because this tends to create duplicates.
@@ -317,7 +400,7 @@ func (m *Monitor) analyzeFrame(cam *analyzerCameraState, item analyzerQueueItem)
 		// Merge objects together such as 'car' and 'truck' if they have tight overlap
 		// NOTE: I've removed this after implementing abstract classes.
 		// Abstract classes seem like a more robust approach.
-		//keepDetections := nn.MergeSimilarObjects(objects, m.nnClassBoxMerge, m.nnClassList, 0.9)
+		//keepDetections := nn.MergeSimilarObjects(objects, classes.boxMerge, m.nnClassList, 0.9)
 	*/
 
 	// Discard detections of classes that we're not interested in
@@ -326,12 +409,15 @@ func (m *Monitor) analyzeFrame(cam *analyzerCameraState, item analyzerQueueItem)
 		shortList = keepDetections
 	} else {
 		for _, i := range keepDetections {
-			if m.nnClassFilterSet[m.nnClassList[processed[i].Class]] {
+			if classes.filter[m.nnClassList[processed[i].Class]] {
 				shortList = append(shortList, i)
 			}
 		}
 	}
 
+	// Discard detections that the user has marked as false positives
+	shortList = m.removeSuppressed(cam, item, processed, shortList)
+
 	// Sort from largest to smallest, and retain only the top N
 	if len(shortList) > settings.maxAnalyzeObjectsPerFrame {
 		sort.Slice(shortList, func(i, j int) bool {
@@ -348,7 +434,7 @@ func (m *Monitor) analyzeFrame(cam *analyzerCameraState, item analyzerQueueItem)
 
 	// Map every detected/processed object to an existing tracked object.
 	// If there is no match, then create a new tracked object.
-	m.trackDetectedObjects(cam, processed, item.isHQ, item.imgID, item.detection.ImageWidth, item.detection.ImageHeight, framePTS)
+	m.tracker.track(cam, processed, item.isHQ, item.imgID, item.detection.ImageWidth, item.detection.ImageHeight, framePTS)
 
 	// Upgrade objects from genuine = 0 to genuine = 1, if sufficient criteria is met.
 	// If necessary, schedule this frame for further analysis by the HQ network.
@@ -358,7 +444,7 @@ func (m *Monitor) analyzeFrame(cam *analyzerCameraState, item analyzerQueueItem)
 	remaining := []*trackedObject{}
 	for _, tracked := range cam.tracked {
 		elapsed := framePTS.Sub(tracked.mostRecent().time)
-		if elapsed > settings.objectForgetTime &&
+		if elapsed > m.tracker.forgetTime(cam, tracked) &&
 			(tracked.validation != validationStatusWaiting || elapsed > time.Minute) {
 			m.analyzeDisappearedObject(cam, tracked)
 		} else {
@@ -395,6 +481,10 @@ func (m *Monitor) analyzeFrame(cam *analyzerCameraState, item analyzerQueueItem)
 		}
 		result.Objects = append(result.Objects, obj)
 	}
+	if cam.offline != nil {
+		cam.offline.results = append(cam.offline.results, result)
+		return
+	}
 	cam.monCam.lock.Lock()
 	//fmt.Printf("cam.camera.analyzerState = result (%v). %p = %p\n", cam.cameraID, cam.camera, result)
 	cam.monCam.analyzerState = result
@@ -0,0 +1,32 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnalyzerSettingsOverrides(t *testing.T) {
+	defaults := newAnalyzerSettings(false)
+
+	overrides, err := configdb.ParseAnalyzerSettings(`{"minDistance": 40, "classes": {"car": {"minDistance": 100, "objectForgetTime": 30}}}`)
+	require.NoError(t, err)
+	s := defaults.withOverrides(overrides)
+
+	// The camera-wide value replaces the built-in class values, except where the camera has a class override
+	require.Equal(t, 40, s.minDistanceForClass("person"))
+	require.Equal(t, 40, s.minDistanceForClass("truck"))
+	require.Equal(t, 100, s.minDistanceForClass("car"))
+	require.Equal(t, 30*time.Second, s.objectForgetTimeForClass("car"))
+	require.Equal(t, 5*time.Second, s.objectForgetTimeForClass("person"))
+
+	// Untouched settings keep their built-in values
+	require.Equal(t, 3, s.minSightingsForClass("person"))
+	require.Equal(t, 2, s.minSightingsForClass("car"))
+
+	// The defaults are not modified
+	require.Equal(t, 0, defaults.minDistanceForClass("truck"))
+	require.Equal(t, 5*time.Second, defaults.objectForgetTimeForClass("car"))
+}
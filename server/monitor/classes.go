@@ -0,0 +1,168 @@
+package monitor
+
+import (
+	"slices"
+
+	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/cyclops/server/configdb"
+)
+
+// If not specified in the config, then this is our list of classes that we pay attention to.
+// Other classes (such as potplant, frisbee, etc) are ignored.
+// If an abstract class is in this list, then all of the classes that map to it are tracked too.
+var defaultClassFilterList = []string{
+	nn.COCOClasses[nn.COCOPerson],
+	nn.COCOClasses[nn.COCOBicycle],
+	nn.COCOClasses[nn.COCOCar],
+	nn.COCOClasses[nn.COCOBus],
+	nn.COCOClasses[nn.COCOMotorcycle],
+	nn.COCOClasses[nn.COCOTruck],
+	// abstract classes
+	"vehicle",
+}
+
+// If we get detection boxes of any of these pairs, and the boxes have very high
+// IoU, then we merge them into the same object. The type of the object is the
+// right side of the map. For example, given {"truck": "car"} in the map, and we
+// have a car/truck pair, the resulting object will be a "car".
+var boxMergeClasses = map[string]string{
+	"truck": "car",
+}
+
+// Classes that trigger the alarm, if not specified in the config
+var defaultAlarmClasses = []string{
+	nn.COCOClasses[nn.COCOPerson],
+}
+
+// Class map from concrete to abstract (eg car -> vehicle, truck -> vehicle).
+// Animals are not tracked by default, but because "animal" is always one of our classes,
+// a camera can start tracking animals without restarting the system.
+// SYNC-ABSTRACT-CLASSES
+var abstractClasses = map[string]string{
+	"car":        "vehicle",
+	"motorcycle": "vehicle",
+	"truck":      "vehicle",
+	"bus":        "vehicle",
+	"bird":       "animal",
+	"cat":        "animal",
+	"dog":        "animal",
+	"horse":      "animal",
+	"sheep":      "animal",
+	"cow":        "animal",
+	"bear":       "animal",
+}
+
+// Returns our built-in class config, restricted to the classes that the NN produces.
+// If the NN is a custom model that produces none of our default classes, then we track all of its classes.
+func defaultClasses(nnClasses []string) *configdb.ClassesJSON {
+	c := &configdb.ClassesJSON{
+		Tracked:  []string{},
+		Merge:    map[string]string{},
+		Abstract: map[string]string{},
+		Alarm:    []string{},
+	}
+	for from, to := range abstractClasses {
+		if slices.Contains(nnClasses, from) {
+			c.Abstract[from] = to
+		}
+	}
+	abstract := c.AbstractClassList()
+	for _, cls := range defaultClassFilterList {
+		if slices.Contains(nnClasses, cls) || slices.Contains(abstract, cls) {
+			c.Tracked = append(c.Tracked, cls)
+		}
+	}
+	if len(c.Tracked) == 0 {
+		c.Tracked = slices.Clone(nnClasses)
+	}
+	for _, cls := range defaultAlarmClasses {
+		if slices.Contains(nnClasses, cls) {
+			c.Alarm = append(c.Alarm, cls)
+		}
+	}
+	for left, right := range boxMergeClasses {
+		if slices.Contains(nnClasses, left) && slices.Contains(nnClasses, right) {
+			c.Merge[left] = right
+		}
+	}
+	return c
+}
+
+// The class config of the system, or of a single camera, in the form that the analyzer uses
+type classSettings struct {
+	config     *configdb.ClassesJSON // The config that these settings were built from
+	filter     map[string]bool       // NN classes that we're interested in (eg person, car)
+	boxMerge   map[string]string     // Merge overlapping boxes eg car/truck -> car
+	mergePairs map[uint64]bool       // Pairs of objects that can be merged (eg truck+car). Just another representation of boxMerge
+	abstract   map[string]string     // Remap classes to a more abstract class (eg car -> vehicle, truck -> vehicle)
+	alarm      map[string]bool       // NN classes that trigger the alarm (eg person)
+}
+
+func newClassSettings(config *configdb.ClassesJSON, classMap map[string]int) *classSettings {
+	return &classSettings{
+		config:     config,
+		filter:     makeClassFilter(config),
+		boxMerge:   config.Merge,
+		mergePairs: buildMergePairs(classMap, config.Merge),
+		abstract:   config.Abstract,
+		alarm:      makeAlarmFilter(config),
+	}
+}
+
+// Returns the set of concrete classes that we must track
+func makeClassFilter(config *configdb.ClassesJSON) map[string]bool {
+	r := map[string]bool{}
+	for _, c := range config.Tracked {
+		r[c] = true
+	}
+	for concrete := range config.Abstract {
+		if config.IsTracked(concrete) {
+			r[concrete] = true
+		}
+	}
+	return r
+}
+
+// Returns the set of concrete classes that trigger the alarm
+func makeAlarmFilter(config *configdb.ClassesJSON) map[string]bool {
+	r := map[string]bool{}
+	for _, c := range config.Alarm {
+		r[c] = true
+	}
+	for concrete := range config.Abstract {
+		if config.IsAlarm(concrete) {
+			r[concrete] = true
+		}
+	}
+	return r
+}
+
+// Returns the classes that the NN produces, excluding our abstract classes and "class unrecognized"
+func (m *Monitor) NNClasses() []string {
+	return m.nnClassList[:m.nnNumConcrete]
+}
+
+// Returns the system's class config, after defaults have been applied
+func (m *Monitor) SystemClasses() *configdb.ClassesJSON {
+	return m.classSettings.config
+}
+
+// Validate a class config.
+// If isCamera is true, then 'c' holds a camera's overrides, which can't introduce new abstract classes.
+func (m *Monitor) ValidateClasses(c *configdb.ClassesJSON, isCamera bool) error {
+	if !isCamera {
+		return defaultClasses(m.NNClasses()).WithOverrides(c).Validate(m.NNClasses(), true, nil)
+	}
+	known := m.nnClassList[m.nnNumConcrete:m.nnUnrecognizedClass]
+	return m.SystemClasses().WithOverrides(c).Validate(m.NNClasses(), false, known)
+}
+
+// Returns the class config of the camera, after applying its overrides to the system config.
+// Returns the system config if the camera is not found.
+func (m *Monitor) CameraClasses(cameraID int64) *configdb.ClassesJSON {
+	cam := m.cameraByID(cameraID)
+	if cam == nil {
+		return m.SystemClasses()
+	}
+	return cam.classSettings.config
+}
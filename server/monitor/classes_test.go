@@ -0,0 +1,57 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassSettings(t *testing.T) {
+	defaults := defaultClasses(nn.COCOClasses)
+	require.NoError(t, defaults.Validate(nn.COCOClasses, true, nil))
+
+	classMap := map[string]int{}
+	for i, c := range nn.COCOClasses {
+		classMap[c] = i
+	}
+
+	// Vehicles are tracked via their abstract class, and animals are ignored
+	s := newClassSettings(defaults, classMap)
+	require.True(t, s.filter["person"])
+	require.True(t, s.filter["bus"])
+	require.False(t, s.filter["dog"])
+	require.False(t, s.filter["potted plant"])
+	require.True(t, s.mergePairs[buildMergePairKey(classMap, "car", "truck")])
+
+	// A camera that cares about dogs in the yard
+	s = newClassSettings(defaults.WithOverrides(&configdb.ClassesJSON{Tracked: []string{"person", "animal"}}), classMap)
+	require.True(t, s.filter["dog"])
+	require.True(t, s.filter["cat"])
+	require.False(t, s.filter["car"])
+
+	require.True(t, s.alarm["person"])
+	require.False(t, s.alarm["dog"])
+
+	// Classes that a custom model doesn't produce are dropped from the defaults
+	small := defaultClasses([]string{"person", "car"})
+	require.Equal(t, []string{"person", "car", "vehicle"}, small.Tracked)
+	require.Equal(t, map[string]string{"car": "vehicle"}, small.Abstract)
+	require.Empty(t, small.Merge)
+
+	// A custom model with none of our classes tracks all of its own classes, and has no alarm classes
+	warehouse := []string{"forklift", "hard-hat", "package"}
+	custom := defaultClasses(warehouse)
+	require.NoError(t, custom.Validate(warehouse, true, nil))
+	require.Equal(t, warehouse, custom.Tracked)
+	require.Empty(t, custom.Alarm)
+	custom = custom.WithOverrides(&configdb.ClassesJSON{Alarm: []string{"forklift"}})
+	s = newClassSettings(custom, map[string]int{"forklift": 0, "hard-hat": 1, "package": 2})
+	require.True(t, s.filter["hard-hat"])
+	require.True(t, s.alarm["forklift"])
+}
+
+func buildMergePairKey(classMap map[string]int, a, b string) uint64 {
+	return (&Monitor{}).makeMergePairKey(classMap[a], classMap[b])
+}
@@ -0,0 +1,192 @@
+package monitor
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/bmharper/cimg/v2"
+	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/dbh"
+)
+
+// A user can mark a detection as a false positive, such as a bush that is detected as a person
+// every night. After that, we discard detections of the same class, which overlap the false
+// positive, and look similar to it. The appearance check is a color histogram, which is cheap,
+// and tolerates a bush moving in the wind, but not a real person standing in front of the bush.
+
+const (
+	suppressMinIOU        = 0.6 // A detection must overlap a false positive by this much to be discarded
+	suppressMinSimilarity = 0.8 // A detection must be at least this similar to a false positive to be discarded
+
+	// Size of the surroundings in the image of a false positive, as a fraction of the box size
+	falsePositiveImageMargin = 0.5
+)
+
+// An appearance histogram has 4 bins per RGB channel, for 64 bins in total
+const (
+	appearanceBinShift       = 6 // 8 bits per channel, down to 2 bits
+	appearanceBinsPerChannel = 1 << (8 - appearanceBinShift)
+	appearanceHistogramSize  = appearanceBinsPerChannel * appearanceBinsPerChannel * appearanceBinsPerChannel
+	appearanceMaxSamples     = 64 // Maximum number of pixels that we sample horizontally and vertically
+)
+
+// A false positive, prepared for matching against detections
+type suppression struct {
+	id         int64
+	class      int
+	box        configdb.CropRect
+	appearance []float32
+}
+
+// Replace the false positives of all cameras.
+// False positives of classes that our NN doesn't emit are ignored.
+func (m *Monitor) SetFalsePositives(falsePositives []*configdb.FalsePositive) {
+	byCamera := map[int64][]suppression{}
+	for _, fp := range falsePositives {
+		cls, ok := m.nnClassMap[fp.Class]
+		if !ok || fp.Appearance == nil || len(fp.Appearance.Data) != appearanceHistogramSize {
+			continue
+		}
+		byCamera[fp.CameraID] = append(byCamera[fp.CameraID], suppression{
+			id:         fp.ID,
+			class:      cls,
+			box:        fp.Box(),
+			appearance: fp.Appearance.Data,
+		})
+	}
+	m.suppressionsLock.Lock()
+	m.suppressions = byCamera
+	m.suppressionsLock.Unlock()
+}
+
+func (m *Monitor) cameraSuppressions(cameraID int64) []suppression {
+	m.suppressionsLock.RLock()
+	defer m.suppressionsLock.RUnlock()
+	return m.suppressions[cameraID]
+}
+
+// Remove the detections that match a false positive of the camera, and return the remaining indices of shortList
+func (m *Monitor) removeSuppressed(cam *analyzerCameraState, item analyzerQueueItem, processed []nn.ProcessedObject, shortList []int) []int {
+	suppressions := m.cameraSuppressions(cam.cameraID)
+	if len(suppressions) == 0 || item.rgb == nil {
+		return shortList
+	}
+	width, height := item.detection.ImageWidth, item.detection.ImageHeight
+	keep := make([]int, 0, len(shortList))
+	for _, i := range shortList {
+		det := &processed[i]
+		var appearance []float32 // Only computed if the detection overlaps a false positive
+		suppressedBy := int64(0)
+		for _, s := range suppressions {
+			if s.class != det.Class || det.Raw.Box.IOU(cropRectToBox(s.box, width, height)) < suppressMinIOU {
+				continue
+			}
+			if appearance == nil {
+				appearance = AppearanceHistogram(item.rgb, det.Raw.Box)
+			}
+			if appearanceSimilarity(appearance, s.appearance) >= suppressMinSimilarity {
+				suppressedBy = s.id
+				break
+			}
+		}
+		if suppressedBy != 0 {
+			if m.analyzerSettings.verbose {
+				m.Log.Infof("Analyzer (cam %v): Discarding '%v' at %v, which matches false positive %v", cam.cameraID, m.nnClassList[det.Class], det.Raw.Box.String(), suppressedBy)
+			}
+			continue
+		}
+		keep = append(keep, i)
+	}
+	return keep
+}
+
+func cropRectToBox(r configdb.CropRect, width, height int) nn.Rect {
+	x1 := int(r.X1*float64(width) + 0.5)
+	y1 := int(r.Y1*float64(height) + 0.5)
+	x2 := int(r.X2*float64(width) + 0.5)
+	y2 := int(r.Y2*float64(height) + 0.5)
+	return nn.MakeRect(x1, y1, x2-x1, y2-y1)
+}
+
+// Clamp the box to the image. Returns false if nothing remains.
+func clampBoxToImage(box nn.Rect, width, height int) (nn.Rect, bool) {
+	box = box.Intersection(nn.MakeRect(0, 0, width, height))
+	return box, box.Width > 0 && box.Height > 0
+}
+
+// Compute the color histogram of the box in an RGB image.
+// The histogram is normalized, so that its bins sum to 1. If the box lies outside the
+// image, then all bins are zero.
+func AppearanceHistogram(img *cimg.Image, box nn.Rect) []float32 {
+	hist := make([]float32, appearanceHistogramSize)
+	box, ok := clampBoxToImage(box, img.Width, img.Height)
+	if !ok || img.NChan() < 3 {
+		return hist
+	}
+	// Sample a limited number of pixels, so that the cost doesn't depend on the size of the box
+	stepX := max(1, int(box.Width)/appearanceMaxSamples)
+	stepY := max(1, int(box.Height)/appearanceMaxSamples)
+	nchan := img.NChan()
+	n := 0
+	for y := int(box.Y); y < int(box.Y2()); y += stepY {
+		row := img.Pixels[y*img.Stride:]
+		for x := int(box.X); x < int(box.X2()); x += stepX {
+			p := row[x*nchan:]
+			r := int(p[0]) >> appearanceBinShift
+			g := int(p[1]) >> appearanceBinShift
+			b := int(p[2]) >> appearanceBinShift
+			hist[(r*appearanceBinsPerChannel+g)*appearanceBinsPerChannel+b]++
+			n++
+		}
+	}
+	for i := range hist {
+		hist[i] /= float32(n)
+	}
+	return hist
+}
+
+// Returns the similarity of two appearance histograms, from 0 (nothing in common) to 1 (identical).
+// This is the Bhattacharyya coefficient.
+func appearanceSimilarity(a, b []float32) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+	sum := 0.0
+	for i := range a {
+		sum += math.Sqrt(float64(a[i]) * float64(b[i]))
+	}
+	return float32(sum)
+}
+
+// Create a false positive from a detection, in an RGB frame of the camera.
+// The caller must fill in the CameraID, FrameTime, EventID and CreatedBy.
+func MakeFalsePositive(img *cimg.Image, box nn.Rect, class string) (*configdb.FalsePositive, error) {
+	clamped, ok := clampBoxToImage(box, img.Width, img.Height)
+	if !ok {
+		return nil, fmt.Errorf("Box %v is outside of the %v x %v frame", box.String(), img.Width, img.Height)
+	}
+	box = clamped
+
+	// Include some of the surroundings in the image, so that it can be used for retraining
+	marginX := int(float32(box.Width) * falsePositiveImageMargin)
+	marginY := int(float32(box.Height) * falsePositiveImageMargin)
+	crop, _ := clampBoxToImage(nn.MakeRect(int(box.X)-marginX, int(box.Y)-marginY, int(box.Width)+2*marginX, int(box.Height)+2*marginY), img.Width, img.Height)
+	cropImg := cimg.NewImage(int(crop.Width), int(crop.Height), img.Format)
+	cropImg.CopyImageRect(img, int(crop.X), int(crop.Y), int(crop.X2()), int(crop.Y2()), 0, 0)
+	jpg, err := cimg.Compress(cropImg, cimg.MakeCompressParams(cimg.Sampling420, 90, 0))
+	if err != nil {
+		return nil, err
+	}
+
+	return &configdb.FalsePositive{
+		Class:      class,
+		X1:         float64(box.X) / float64(img.Width),
+		Y1:         float64(box.Y) / float64(img.Height),
+		X2:         float64(box.X2()) / float64(img.Width),
+		Y2:         float64(box.Y2()) / float64(img.Height),
+		Appearance: dbh.MakeJSONField(AppearanceHistogram(img, box)),
+		Image:      jpg,
+		ImageBox:   dbh.MakeJSONField([4]int{int(box.X - crop.X), int(box.Y - crop.Y), int(box.X2() - crop.X), int(box.Y2() - crop.Y)}),
+	}, nil
+}
@@ -0,0 +1,61 @@
+package monitor
+
+import (
+	"testing"
+
+	"github.com/bmharper/cimg/v2"
+	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/stretchr/testify/require"
+)
+
+func fillRect(img *cimg.Image, box nn.Rect, r, g, b uint8) {
+	for y := box.Y; y < box.Y2(); y++ {
+		for x := box.X; x < box.X2(); x++ {
+			p := img.Pixels[int(y)*img.Stride+int(x)*3:]
+			p[0], p[1], p[2] = r, g, b
+		}
+	}
+}
+
+func TestFalsePositiveSuppression(t *testing.T) {
+	m := &Monitor{
+		nnClassList: []string{"person", "car"},
+		nnClassMap:  map[string]int{"person": 0, "car": 1},
+	}
+	img := cimg.NewImage(320, 240, cimg.PixelFormatRGB)
+	bush := nn.MakeRect(100, 80, 40, 60)
+	fillRect(img, bush, 30, 120, 40)
+
+	fp, err := MakeFalsePositive(img, bush, "person")
+	require.NoError(t, err)
+	require.InDelta(t, 100.0/320, fp.X1, 1e-9)
+	require.InDelta(t, 140.0/240, fp.Y2, 1e-9)
+	require.Equal(t, [4]int{20, 30, 60, 90}, fp.ImageBox.Data)
+	require.Equal(t, float32(1), appearanceSimilarity(fp.Appearance.Data, AppearanceHistogram(img, bush)))
+	fp.ID = 1
+	fp.CameraID = 5
+	m.SetFalsePositives([]*configdb.FalsePositive{fp})
+
+	detect := func(cameraID int64, class int, box nn.Rect) []int {
+		cam := &analyzerCameraState{cameraID: cameraID}
+		item := analyzerQueueItem{
+			rgb:       img,
+			detection: &nn.DetectionResult{ImageWidth: img.Width, ImageHeight: img.Height},
+		}
+		processed := []nn.ProcessedObject{{Raw: nn.ObjectDetection{Class: class, Box: box}, Class: class}}
+		return m.removeSuppressed(cam, item, processed, []int{0})
+	}
+
+	// The bush swaying slightly in the wind is discarded
+	require.Equal(t, 0, len(detect(5, 0, nn.MakeRect(102, 81, 40, 60))))
+
+	// Other cameras, classes, and locations are untouched
+	require.Equal(t, 1, len(detect(6, 0, bush)))
+	require.Equal(t, 1, len(detect(5, 1, bush)))
+	require.Equal(t, 1, len(detect(5, 0, nn.MakeRect(200, 80, 40, 60))))
+
+	// A person in a red jacket, standing in front of the bush, is not discarded
+	fillRect(img, nn.MakeRect(105, 80, 30, 55), 200, 20, 20)
+	require.Equal(t, 1, len(detect(5, 0, bush)))
+}
@@ -17,6 +17,7 @@ type frameReaderCameraState struct {
 	lastFrameID        int64 // Last frame we've seen from this camera
 	numFramesTotal     int64 // Number of frames from this camera that we've seen
 	numFramesProcessed int64 // Number of frames from this camera that we've analyzed
+	numFramesAtStats   int64 // numFramesTotal at the previous NN stats update
 }
 
 func frameReaderStats(cameraStates []*frameReaderCameraState) (totalFrames, totalProcessed int64) {
@@ -41,48 +42,52 @@ func (m *Monitor) readFrames() {
 	}
 	m.camerasLock.Unlock()
 
-	// Maintain camera index outside of main loop, so that we're not
-	// biased towards processing the frames of the first camera(s).
-	// I still need to figure out how to boost priority for cameras
-	// that have likely activity in them.
-	icam := uint(0)
+	sched := newNNScheduler(len(looperCameras), time.Now())
+	lastPriorityUpdate := time.Time{}
+
+	// We only queue up enough frames to keep every NN thread busy with one batch. Any more than that,
+	// and the frames are stale by the time the NN gets to them. If the NN can't keep up, then the
+	// scheduler lowers the frame rate of each camera instead.
+	// SYNC-NN-THREAD-QUEUE-MIN-SIZE
+	queueLimit := min(m.nnBatchSizeLQ*m.numNNThreads, cap(m.nnThreadQueue))
 
 	lastStats := time.Now()
+	lastBusyNS := m.nnBusyNS.Load()
+	lastLoadAt := time.Now()
 
 	nStats := 0
 	for !m.mustStopFrameReader.Load() {
-		idle := true
-		// Why do we have this inner loop?
-		// We keep it so that we can detect when to idle.
-		// If we complete a loop over all looperCameras, and we didn't have any work to do,
-		// then we idle for a few milliseconds.
-		for i := 0; i < len(looperCameras); i++ {
-			if m.mustStopFrameReader.Load() {
-				break
-			}
-			// SYNC-NN-THREAD-QUEUE-MIN-SIZE
-			if len(m.nnThreadQueue) >= cap(m.nnThreadQueue) {
-				// Our NN queue is full, so drop frames.
-				break
-			}
-
-			// It's vital that this incrementing happens after the queue check above,
-			// otherwise you don't get round robin behaviour.
-			icam = (icam + 1) % uint(len(looperCameras))
-			camState := looperCameras[icam]
-			mcam := camState.mcam
+		now := time.Now()
+		if now.Sub(lastPriorityUpdate) > 250*time.Millisecond {
+			m.updateSchedulerPriorities(sched, looperCameras)
+			lastPriorityUpdate = now
+		}
+		if sched.updateStats(now) {
+			busyNS := m.nnBusyNS.Load()
+			sched.setLoad(float64(busyNS-lastBusyNS) / (float64(now.Sub(lastLoadAt).Nanoseconds()) * float64(m.numNNThreads)))
+			lastBusyNS = busyNS
+			lastLoadAt = now
+			m.publishNNStats(sched, looperCameras)
+		}
 
-			//m.Log.Infof("%v", icam)
-			img, imgID, imgPTS := mcam.camera.LowDecoder.GetLastImageIfDifferent(camState.lastFrameID)
-			if img != nil {
+		idle := true
+		if len(m.nnThreadQueue) < queueLimit {
+			// Send the frame of the most deserving camera that has a new frame
+			for _, icam := range sched.next(now) {
+				camState := looperCameras[icam]
+				mcam := camState.mcam
+				img, imgID, imgPTS := mcam.camera.Frames().GetLastImageIfDifferent(camState.lastFrameID)
+				if img == nil {
+					continue
+				}
 				if camState.lastFrameID == 0 {
 					camState.numFramesTotal++
 				} else {
 					camState.numFramesTotal += imgID - camState.lastFrameID
 				}
-				//m.Log.Infof("Got image %d from camera %s (%v / %v)", imgID, mcam.camera.Name, camState.numFramesProcessed, camState.numFramesTotal)
 				camState.numFramesProcessed++
 				camState.lastFrameID = imgID
+				sched.sent(icam, now)
 				idle = false
 				m.nnThreadQueue <- monitorQueueItem{
 					isHQ:     false,
@@ -92,12 +97,14 @@ func (m *Monitor) readFrames() {
 					rgb:      nil,
 					framePTS: imgPTS,
 				}
+				break
 			}
 		}
 		if m.mustStopFrameReader.Load() {
 			break
 		}
 		if idle {
+			// Either the NN queue is full, or none of the cameras are due for a frame
 			time.Sleep(5 * time.Millisecond)
 		}
 
@@ -128,3 +135,39 @@ func (m *Monitor) readFrames() {
 	}
 	close(m.frameReaderStopped)
 }
+
+// Alarm cameras get top priority while the system is armed, and then cameras that are tracking objects
+func (m *Monitor) updateSchedulerPriorities(sched *nnScheduler, cameras []*frameReaderCameraState) {
+	armed := m.isArmed != nil && m.isArmed()
+	for i, camState := range cameras {
+		mcam := camState.mcam
+		priority := schedPriorityIdle
+		if armed && mcam.camera.Config.Load().EnableAlarm {
+			priority = schedPriorityAlarm
+		} else {
+			mcam.lock.Lock()
+			if mcam.analyzerState != nil && len(mcam.analyzerState.Objects) != 0 {
+				priority = schedPriorityActive
+			}
+			mcam.lock.Unlock()
+		}
+		sched.setPriority(i, priority)
+	}
+}
+
+func (m *Monitor) publishNNStats(sched *nnScheduler, cameras []*frameReaderCameraState) {
+	stats := map[int64]CameraNNStats{}
+	for i, camState := range cameras {
+		c := &sched.cameras[i]
+		stats[camState.mcam.camera.ID()] = CameraNNStats{
+			Priority:  c.priority.String(),
+			MaxFPS:    sched.maxFPS(c.priority),
+			FPS:       c.fps,
+			CameraFPS: float64(camState.numFramesTotal-camState.numFramesAtStats) / sched.statsElapsed.Seconds(),
+		}
+		camState.numFramesAtStats = camState.numFramesTotal
+	}
+	m.nnSchedStats.lock.Lock()
+	m.nnSchedStats.cameras = stats
+	m.nnSchedStats.lock.Unlock()
+}
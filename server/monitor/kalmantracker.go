@@ -0,0 +1,171 @@
+package monitor
+
+import (
+	"math"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/cyclops/pkg/tracker"
+)
+
+// Lifecycle of an object in kalmanTracker
+type trackState int
+
+const (
+	trackStateTentative trackState = iota // Seen fewer than kalmanConfirmSightings times
+	trackStateConfirmed                   // Seen in the most recent LQ frame
+	trackStateLost                        // Confirmed, but not seen in the most recent LQ frame. Can be re-associated until objectForgetTime.
+)
+
+const (
+	// Number of sightings before a tentative track becomes confirmed
+	kalmanConfirmSightings = 2
+
+	// Tentative tracks that we lose are mostly NN noise, so we forget them sooner than confirmed tracks
+	kalmanTentativeForgetTime = 2 * time.Second
+
+	// A detection can only match a track if it is within this many "gate units" of the predicted position,
+	// or overlaps the prediction. A gate unit is the diagonal of the predicted box, plus the uncertainty
+	// of the prediction. The uncertainty grows while an object is lost, which is what allows us
+	// to re-associate an object after it has been hidden for a while.
+	kalmanMotionGate = 3.0
+
+	// Weight of motion cost, vs IoU cost. Both costs are in the range [0,1].
+	kalmanMotionWeight = 0.5
+
+	// Extra cost of matching two different classes that are allowed to merge (eg car and truck)
+	kalmanClassMergeCost = 0.2
+
+	// Minimum IoU for matching an HQ detection to an LQ detection of the same frame
+	kalmanValidationMinIoU = 0.2
+)
+
+// kalmanTracker predicts the position of each tracked object with a constant velocity
+// Kalman filter, and matches detections to the predictions with the Hungarian algorithm,
+// on a combination of IoU and motion cost.
+// Unlike greedyTracker, an object can't steal the match of another object that is a better fit.
+type kalmanTracker struct {
+	m *Monitor
+}
+
+func (k *kalmanTracker) forgetTime(cam *analyzerCameraState, obj *trackedObject) time.Duration {
+	forget := cam.monCam.analyzerSettings.objectForgetTimeForClass(k.m.nnClassList[obj.firstDetection.Class])
+	if obj.trackState == trackStateTentative {
+		return min(kalmanTentativeForgetTime, forget)
+	}
+	return forget
+}
+
+func (k *kalmanTracker) track(cam *analyzerCameraState, objects []nn.ProcessedObject, isHQ bool, imgID int64, frameWidth, frameHeight int, framePTS time.Time) {
+	if isHQ {
+		k.validate(cam, objects, imgID)
+		return
+	}
+	m := k.m
+
+	// Objects that are closer than this are never gated out, no matter how small their boxes are
+	minGate := 0.05 * float64(frameWidth)
+
+	cost := make([][]float64, len(objects))
+	for i := range objects {
+		cost[i] = make([]float64, len(cam.tracked))
+		for j := range cost[i] {
+			cost[i][j] = tracker.Forbidden
+		}
+	}
+	for j, obj := range cam.tracked {
+		predicted := obj.motion.Predict(framePTS)
+		gate := max(predicted.Diagonal()+obj.motion.PredictedCenterStd(framePTS), minGate) * kalmanMotionGate
+		for i := range objects {
+			classCost, ok := k.classCost(cam, obj, &objects[i])
+			if !ok {
+				continue
+			}
+			box := rectToBox(objects[i].Raw.Box)
+			iou := predicted.IoU(box)
+			motion := math.Hypot(box.CX-predicted.CX, box.CY-predicted.CY) / gate
+			if iou == 0 && motion > 1 {
+				continue
+			}
+			cost[i][j] = (1-kalmanMotionWeight)*(1-iou) + kalmanMotionWeight*min(motion, 1) + classCost
+		}
+	}
+	assignment := tracker.Assign(cost)
+
+	for i, j := range assignment {
+		newObj := &objects[i]
+		var obj *trackedObject
+		if j == -1 {
+			obj = m.newTrackedObject(newObj, frameWidth, frameHeight)
+			obj.motion = tracker.NewBoxFilter(rectToBox(newObj.Raw.Box), framePTS)
+			cam.tracked = append(cam.tracked, obj)
+			if m.analyzerSettings.verbose {
+				m.Log.Infof("Analyzer (cam %v): New '%v' frame %v at %v,%v (CM %.2f)", cam.cameraID, m.nnClassList[newObj.Class], imgID, newObj.Raw.Box.Center().X, newObj.Raw.Box.Center().Y, newObj.Raw.ConfidenceMargin)
+			}
+		} else {
+			obj = cam.tracked[j]
+			if m.analyzerSettings.verbose {
+				if obj.trackState == trackStateLost {
+					m.Log.Infof("Analyzer (cam %v): Re-associated '%v' frame %v at %v,%v after %.1f seconds", cam.cameraID, m.nnClassList[newObj.Class], imgID, newObj.Raw.Box.Center().X, newObj.Raw.Box.Center().Y, framePTS.Sub(obj.mostRecent().time).Seconds())
+				} else {
+					m.Log.Infof("Analyzer (cam %v): Existing '%v' frame %v at %v,%v (cost %.2f, CM %.2f)", cam.cameraID, m.nnClassList[newObj.Class], imgID, newObj.Raw.Box.Center().X, newObj.Raw.Box.Center().Y, cost[i][j], newObj.Raw.ConfidenceMargin)
+				}
+			}
+			obj.motion.Update(rectToBox(newObj.Raw.Box), framePTS)
+		}
+		obj.addSighting(newObj, framePTS)
+	}
+
+	for _, obj := range cam.tracked {
+		if obj.totalSightings < kalmanConfirmSightings {
+			obj.trackState = trackStateTentative
+		} else if obj.mostRecent().time.Equal(framePTS) {
+			obj.trackState = trackStateConfirmed
+		} else {
+			obj.trackState = trackStateLost
+		}
+	}
+}
+
+// Match the HQ detections to the positions that the LQ network found in the same frame
+func (k *kalmanTracker) validate(cam *analyzerCameraState, objects []nn.ProcessedObject, imgID int64) {
+	bestIoU := make([]float32, len(cam.tracked))
+	cost := make([][]float64, len(objects))
+	for i := range objects {
+		cost[i] = make([]float64, len(cam.tracked))
+		for j, obj := range cam.tracked {
+			cost[i][j] = tracker.Forbidden
+			classCost, ok := k.classCost(cam, obj, &objects[i])
+			if !ok {
+				continue
+			}
+			iou := objects[i].Raw.Box.IOU(obj.validationPosition)
+			bestIoU[j] = max(bestIoU[j], iou)
+			if iou >= kalmanValidationMinIoU {
+				cost[i][j] = 1 - float64(iou) + classCost
+			}
+		}
+	}
+	trackedAndFound := make([]bool, len(cam.tracked))
+	for _, j := range tracker.Assign(cost) {
+		if j != -1 {
+			trackedAndFound[j] = true
+		}
+	}
+	k.m.updateValidationStatus(cam, trackedAndFound, bestIoU, imgID)
+}
+
+// Returns the extra cost of matching the detection to the tracked object, or false if the classes can't match
+func (k *kalmanTracker) classCost(cam *analyzerCameraState, obj *trackedObject, detection *nn.ProcessedObject) (float64, bool) {
+	if obj.firstDetection.Class == detection.Class {
+		return 0, true
+	}
+	if cam.monCam.classSettings.mergePairs[k.m.makeMergePairKey(obj.firstDetection.Class, detection.Class)] {
+		return kalmanClassMergeCost, true
+	}
+	return 0, false
+}
+
+func rectToBox(r nn.Rect) tracker.Box {
+	return tracker.MakeBox(float64(r.X), float64(r.Y), float64(r.Width), float64(r.Height))
+}
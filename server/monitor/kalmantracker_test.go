@@ -0,0 +1,91 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/logs"
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestDetection(class int, x, y int) nn.ProcessedObject {
+	return nn.ProcessedObject{
+		Raw: nn.ObjectDetection{
+			Class:      class,
+			Confidence: 0.9,
+			Box:        nn.MakeRect(x, y, 20, 40),
+		},
+		Class: class,
+	}
+}
+
+// Two people walk towards each other and cross paths. At 2 FPS their boxes
+// barely overlap from one frame to the next, and when they cross, each person is
+// closest to the other person's previous position. We rely on motion prediction
+// to keep their identities apart.
+func TestKalmanTrackerCrossingPaths(t *testing.T) {
+	m := &Monitor{
+		Log:              logs.NewTestingLog(t),
+		nnClassList:      []string{"person"},
+		analyzerSettings: *newAnalyzerSettings(false),
+		classSettings:    newClassSettings(defaultClasses([]string{"person"}), map[string]int{"person": 0}),
+	}
+	k := &kalmanTracker{m: m}
+	cam := &analyzerCameraState{
+		monCam: &monitorCamera{
+			analyzerSettings: &m.analyzerSettings,
+			classSettings:    m.classSettings,
+		},
+	}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var idA, idB uint32
+	for i := 0; i < 10; i++ {
+		pts := base.Add(time.Duration(i) * 500 * time.Millisecond)
+		a := makeTestDetection(0, 100+i*40, 100)
+		b := makeTestDetection(0, 460-i*40, 104)
+		k.track(cam, []nn.ProcessedObject{a, b}, false, int64(i), 640, 480, pts)
+		require.Equal(t, 2, len(cam.tracked))
+		if i == 0 {
+			continue
+		}
+		for _, obj := range cam.tracked {
+			// Each object must still be receiving the detections of the person that it started with
+			vx, _ := obj.motion.Velocity()
+			if obj.firstDetection.Raw.Box.X == 100 {
+				idA = obj.id
+				require.Greater(t, vx, 0.0)
+				require.Equal(t, a.Raw.Box, obj.lastPosition)
+			} else {
+				idB = obj.id
+				require.Less(t, vx, 0.0)
+				require.Equal(t, b.Raw.Box, obj.lastPosition)
+			}
+		}
+	}
+	require.NotEqual(t, idA, idB)
+	for _, obj := range cam.tracked {
+		require.Equal(t, trackStateConfirmed, obj.trackState)
+		require.Equal(t, 10, obj.totalSightings)
+	}
+
+	// Person A disappears behind something for 2 seconds, and then reappears further along its path
+	pts := base.Add(5 * time.Second)
+	k.track(cam, []nn.ProcessedObject{makeTestDetection(0, 460-10*40, 104)}, false, 10, 640, 480, pts)
+	require.Equal(t, 2, len(cam.tracked))
+	for _, obj := range cam.tracked {
+		if obj.id == idA {
+			require.Equal(t, trackStateLost, obj.trackState)
+		}
+	}
+	pts = base.Add(6500 * time.Millisecond)
+	k.track(cam, []nn.ProcessedObject{makeTestDetection(0, 100+13*40, 100)}, false, 11, 640, 480, pts)
+	require.Equal(t, 2, len(cam.tracked))
+	for _, obj := range cam.tracked {
+		if obj.id == idA {
+			require.Equal(t, trackStateConfirmed, obj.trackState)
+			require.Equal(t, 11, obj.totalSightings)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package monitor
 import (
 	"fmt"
 	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -14,44 +15,12 @@ import (
 	"github.com/cyclopcam/cyclops/pkg/nn"
 	"github.com/cyclopcam/cyclops/pkg/nnaccel"
 	"github.com/cyclopcam/cyclops/pkg/nnload"
+	"github.com/cyclopcam/cyclops/pkg/nnremote"
 	"github.com/cyclopcam/cyclops/server/camera"
 	"github.com/cyclopcam/cyclops/server/configdb"
 	"github.com/cyclopcam/logs"
 )
 
-// If not specified, then this is our list of classes that we pay attention to.
-// Other classes (such as potplant, frisbee, etc) are ignored.
-// The classes in our abstract list are implicitly also inside this list.
-var defaultClassFilterList = []string{
-	nn.COCOClasses[nn.COCOPerson],
-	nn.COCOClasses[nn.COCOBicycle],
-	nn.COCOClasses[nn.COCOCar],
-	nn.COCOClasses[nn.COCOBus],
-	nn.COCOClasses[nn.COCOMotorcycle],
-	nn.COCOClasses[nn.COCOTruck],
-	// abstract classes
-	// SYNC-ABSTRACT-CLASSES
-	"vehicle",
-}
-
-// If we get detection boxes of any of these pairs, and the boxes have very high
-// IoU, then we merge them into the same object. The type of the object is the
-// right side of the map. For example, given {"truck": "car"} in the map, and we
-// have a car/truck pair, the resulting object will be a "car".
-var boxMergeClasses = map[string]string{
-	"truck": "car",
-}
-
-// Class map from concrete to abstract (eg car -> vehicle, truck -> vehicle)
-// NOTE: If you add new mappings here, also add them to defaultClassFilterList
-// SYNC-ABSTRACT-CLASSES
-var abstractClasses = map[string]string{
-	"car":        "vehicle",
-	"motorcycle": "vehicle",
-	"truck":      "vehicle",
-	"bus":        "vehicle",
-}
-
 /*
 	Monitor runs our neural networks on the camera streams
 
@@ -67,12 +36,16 @@ type Monitor struct {
 	nnDevice                  *nnaccel.Device        // If nil, then we're using NCNN
 	nnDetectorLQ              nn.ObjectDetector      // Low Quality NN object detector
 	nnDetectorHQ              nn.ObjectDetector      // High Quality NN object detector
+	nnModelNameLQ             string                 // Name of the low quality NN model
+	nnModelNameHQ             string                 // Name of the high quality NN model
 	enableFrameReader         bool                   // If false, then we don't run the frame reader
 	mustStopFrameReader       atomic.Bool            // True if stopFrameReader() has been called
 	analyzerQueue             chan analyzerQueueItem // Analyzer work queue. When closed, analyzer must exit.
 	analyzerStopped           chan bool              // Analyzer thread has exited
 	alarmingStop              chan bool              // Used to signal that the alarming thread must exit
 	alarmingStopped           chan bool              // Used to signal that the alarming thread has exited
+	roiScannerStop            chan bool              // Used to signal that the ROI scanner must exit
+	roiScannerStopped         chan bool              // Closed when the ROI scanner has exited
 	numNNThreads              int                    // Number of NN threads
 	nnBatchSizeLQ             int                    // Batch size for low quality NN
 	nnBatchSizeHQ             int                    // Batch size for high quality NN
@@ -84,17 +57,19 @@ type Monitor struct {
 	nnThreadState             []NNThreadState        // State for each NN thread
 	nnPerfStatsLQ             nnPerfStats            // Performance statistics for the low quality NN
 	nnPerfStatsHQ             nnPerfStats            // Performance statistics for the high quality NN
+	nnBusyNS                  atomic.Int64           // Total time (ns) that the NN threads have spent on prep and detection
 	hasShownResolutionWarning atomic.Bool            // True if we've shown a warning about camera resolution vs NN resolution
 	nnClassList               []string               // All the classes that the NN emits (in their native order)
 	nnClassMap                map[string]int         // Map from class name to class index
-	nnClassFilterSet          map[string]bool        // NN classes that we're interested in (eg person, car)
-	nnClassBoxMerge           map[string]string      // Merge overlapping boxes eg car/truck -> car
-	nnClassMergePairs         map[uint64]bool        // Pairs of objects that can be merged (eg truck+car). Just another representation of nnClassBoxMerge
-	nnClassAbstract           map[string]string      // Remap classes to a more abstract class (eg car -> vehicle, truck -> vehicle)
+	nnNumConcrete             int                    // The first nnNumConcrete classes of nnClassList are the classes that the NN emits. The rest are abstract.
 	nnAbstractClassSet        map[int]bool           // Set of abstract class indices
 	nnUnrecognizedClass       int                    // Special index for the "class unrecognized" class
 	analyzerSettings          analyzerSettings       // Analyzer settings
+	classSettings             *classSettings         // System class config. Cameras can override this.
 	nextTrackedObjectID       idgen.Uint32           // Next ID to assign to a tracked object
+	tracker                   objectTracker          // Matches NN detections to tracked objects
+	isArmed                   func() bool            // Returns true if the alarm system is armed. May be nil.
+	nnSchedStats              nnSchedStats           // NN scheduling stats of each camera, updated by the frame reader
 
 	// Dump the first frame of each camera, immediately before it gets sent to the NN for processing.
 	// You get the RGB from the camera, and an RGB that was resized and letterboxed for the NN.
@@ -111,6 +86,9 @@ type Monitor struct {
 
 	alarmWatchersLock sync.RWMutex       // Guards access to alarmWatchers
 	alarmWatchers     []chan *AlarmEvent // Agents watching for alarm events
+
+	suppressionsLock sync.RWMutex            // Guards access to suppressions
+	suppressions     map[int64][]suppression // Keys are CameraID. Values are false positives, whose detections we discard. Immutable.
 }
 
 // monitorCamera is the internal data structure for managing a single camera that we are monitoring
@@ -118,6 +96,16 @@ type monitorCamera struct {
 	camera        *camera.Camera
 	detectionZone *configdb.DetectionZone // If nil, then the entire image is the detection zone
 
+	// Monitor.analyzerSettings, with the camera's overrides applied.
+	// This is immutable, and is replaced along with the monitorCamera when the camera's config changes.
+	analyzerSettings *analyzerSettings
+
+	// Monitor.classSettings, with the camera's overrides applied. Immutable, like analyzerSettings.
+	classSettings *classSettings
+
+	// Regions of interest, which are scanned in the HD stream. Immutable, like analyzerSettings.
+	rois []configdb.RegionOfInterest
+
 	// Guards access to lastImg, lastDetection, analyzerState
 	lock sync.Mutex
 
@@ -136,6 +124,10 @@ type monitorCamera struct {
 	// Can be nil.
 	// Same comment applies here as to lastImg, in the sense that the contents of this object is immutable.
 	analyzerState *AnalysisState
+
+	// Guarded by 'lock' mutex.
+	// The most recent scan of each of the ROIs. Parallel to 'rois'.
+	roiResults []roiResult
 }
 
 type monitorQueueItem struct {
@@ -161,7 +153,8 @@ type MonitorOptions struct {
 	// frames directly, without having the monitor pull frames from the cameras.
 	EnableFrameReader bool
 
-	// ModelNameLQ is the low quality NN model name, such as "yolov8m"
+	// ModelNameLQ is the low quality NN model name, such as "yolov8m".
+	// Custom models are prefixed with their dataset, such as "warehouse/yolov8s".
 	ModelNameLQ string
 
 	// ModelName is the high quality NN model name, such as "yolov8l"
@@ -190,8 +183,26 @@ type MonitorOptions struct {
 
 	// Force batch size to 1 for all neural network models. Used by unit tests to validate frame by frame.
 	ForceBatchSizeOne bool
+
+	// Object tracker (TrackerGreedy or TrackerKalman). Empty means TrackerGreedy.
+	Tracker string
+
+	// Overrides of the built-in class config (tracked classes, merge pairs, abstract classes). May be nil.
+	Classes *configdb.ClassesJSON
+
+	// If not nil, run the NN models on a remote server, and only load them locally if the server fails.
+	Remote *nnremote.ClientOptions
+
+	// Returns true if the alarm system is armed. Armed alarm cameras get priority for NN time. May be nil.
+	IsArmed func() bool
 }
 
+// SYNC-SYSTEM-TRACKER
+const (
+	TrackerGreedy = "greedy" // Match each detection to the closest tracked object
+	TrackerKalman = "kalman" // Kalman filter motion prediction, with optimal (Hungarian) assignment
+)
+
 // DefaultMonitorOptions returns a new MonitorOptions object with default values
 func DefaultMonitorOptions() *MonitorOptions {
 	return &MonitorOptions{
@@ -259,6 +270,11 @@ func NewMonitor(logger logs.Log, options *MonitorOptions) (*Monitor, error) {
 		// Raspberry Pi, or some other SBC (4 cores)
 		nnThreads = 1
 	}
+	if options.Remote != nil {
+		// Most of the time of a remote NN thread is spent waiting for the network, so
+		// we need a few of them to keep the server busy.
+		nnThreads = max(nnThreads, 4)
+	}
 	nnThreadingModel := nn.ThreadingModeSingle
 	if nnThreads == 1 {
 		// If we're only running a single detection thread, then let the NN library use however
@@ -315,11 +331,11 @@ func NewMonitor(logger logs.Log, options *MonitorOptions) (*Monitor, error) {
 		}
 	}
 
-	detectorLQ, err = nnload.LoadModel(logger, device, options.ModelsDir, options.ModelNameLQ, nnWidth, nnHeight, nnThreadingModel, modelSetupLQ)
+	detectorLQ, err = nnload.LoadDetector(logger, options.Remote, device, options.ModelsDir, options.ModelNameLQ, nnWidth, nnHeight, nnThreadingModel, modelSetupLQ)
 	if err != nil {
 		return nil, err
 	}
-	detectorHQ, err = nnload.LoadModel(logger, device, options.ModelsDir, options.ModelNameHQ, nnWidth, nnHeight, nnThreadingModel, modelSetupHQ)
+	detectorHQ, err = nnload.LoadDetector(logger, options.Remote, device, options.ModelsDir, options.ModelNameHQ, nnWidth, nnHeight, nnThreadingModel, modelSetupHQ)
 	if err != nil {
 		return nil, err
 	}
@@ -327,8 +343,16 @@ func NewMonitor(logger logs.Log, options *MonitorOptions) (*Monitor, error) {
 	logger.Infof("LQ NN %v x %v, batch %v, prob threshold %.2f, NMS IoU thresold: %.2f", detectorLQ.Config().Width, detectorLQ.Config().Height, modelSetupLQ.BatchSize, modelSetupLQ.ProbabilityThreshold, modelSetupLQ.NmsIouThreshold)
 	logger.Infof("HQ NN %v x %v, batch %v, prob threshold %.2f, NMS IoU thresold: %.2f", detectorHQ.Config().Width, detectorHQ.Config().Height, modelSetupHQ.BatchSize, modelSetupHQ.ProbabilityThreshold, modelSetupHQ.NmsIouThreshold)
 
-	classFilterList := defaultClassFilterList
-	logger.Infof("Paying attention to the following classes: %v", strings.Join(classFilterList, ","))
+	nnClasses := detectorLQ.Config().Classes
+	if !slices.Equal(nnClasses, detectorHQ.Config().Classes) {
+		return nil, fmt.Errorf("The LQ model '%v' and the HQ model '%v' have different classes", options.ModelNameLQ, options.ModelNameHQ)
+	}
+	classes := defaultClasses(nnClasses).WithOverrides(options.Classes)
+	if err := classes.Validate(nnClasses, true, nil); err != nil {
+		logger.Errorf("Invalid classes config: %v. Using defaults", err)
+		classes = defaultClasses(nnClasses)
+	}
+	logger.Infof("Paying attention to the following classes: %v", strings.Join(classes.Tracked, ","))
 
 	// No idea what a good number is here. I expect analysis to be much
 	// faster to run than NN, so provided this queue is large enough to
@@ -337,14 +361,8 @@ func NewMonitor(logger logs.Log, options *MonitorOptions) (*Monitor, error) {
 	// been emitted by the NN.
 	analysisQueueSize := 20
 
-	classList := detectorLQ.Config().Classes
-	seenAbstract := map[string]bool{}
-	for _, v := range abstractClasses {
-		if !seenAbstract[v] {
-			classList = append(classList, v)
-			seenAbstract[v] = true
-		}
-	}
+	classList := slices.Clone(nnClasses)
+	classList = append(classList, classes.AbstractClassList()...)
 	// Add a special "class unrecognized" class
 	unrecognizedIdx := len(classList)
 	classList = append(classList, "class unrecognized")
@@ -361,12 +379,17 @@ func NewMonitor(logger logs.Log, options *MonitorOptions) (*Monitor, error) {
 		nnDevice:            device,
 		nnDetectorLQ:        detectorLQ,
 		nnDetectorHQ:        detectorHQ,
+		nnModelNameLQ:       options.ModelNameLQ,
+		nnModelNameHQ:       options.ModelNameHQ,
+		isArmed:             options.IsArmed,
 		nnThreadQueue:       make(chan monitorQueueItem, nnQueueSize),
 		nnThreadState:       make([]NNThreadState, nnThreads),
 		analyzerQueue:       make(chan analyzerQueueItem, analysisQueueSize),
 		analyzerStopped:     make(chan bool),
 		alarmingStop:        make(chan bool),
 		alarmingStopped:     make(chan bool),
+		roiScannerStop:      make(chan bool),
+		roiScannerStopped:   make(chan bool),
 		nnModelSetupLQ:      modelSetupLQ,
 		nnModelSetupHQ:      modelSetupHQ,
 		numNNThreads:        nnThreads,
@@ -374,11 +397,9 @@ func NewMonitor(logger logs.Log, options *MonitorOptions) (*Monitor, error) {
 		nnBatchSizeHQ:       nnBatchSizeHQ,
 		nnClassList:         classList,
 		nnClassMap:          classMap,
-		nnClassFilterSet:    makeClassFilter(classFilterList),
-		nnClassAbstract:     abstractClasses,
-		nnClassBoxMerge:     boxMergeClasses,
-		nnClassMergePairs:   buildMergePairs(classMap, boxMergeClasses),
-		nnAbstractClassSet:  makeAbstractClassSet(abstractClasses, classMap),
+		nnNumConcrete:       len(nnClasses),
+		nnAbstractClassSet:  makeAbstractClassSet(classes.Abstract, classMap),
+		classSettings:       newClassSettings(classes, classMap),
 		nnUnrecognizedClass: unrecognizedIdx,
 		analyzerSettings:    *newAnalyzerSettings(options.DebugTracking),
 		watchers:            map[int64][]chan *AnalysisState{},
@@ -387,6 +408,10 @@ func NewMonitor(logger logs.Log, options *MonitorOptions) (*Monitor, error) {
 		debugDumpFrames:     true,
 		hasDumpedFrame:      map[string]bool{},
 	}
+	m.tracker, err = newObjectTracker(m, options.Tracker)
+	if err != nil {
+		return nil, err
+	}
 
 	// Prevent our cleanup defer func from deleting these objects
 	device = nil
@@ -401,6 +426,7 @@ func NewMonitor(logger logs.Log, options *MonitorOptions) (*Monitor, error) {
 	}
 	if m.enableFrameReader {
 		m.startFrameReader()
+		go m.roiScanner()
 	}
 	go m.analyzer()
 	go m.alarmer()
@@ -422,6 +448,12 @@ func (m *Monitor) Close() {
 		m.stopFrameReader()
 	}
 
+	// Stop scanning regions of interest
+	if m.enableFrameReader {
+		m.roiScannerStop <- true
+		<-m.roiScannerStopped
+	}
+
 	// Stop alarming thread
 	m.Log.Infof("Monitor waiting for alarming")
 	m.alarmingStop <- true
@@ -448,14 +480,29 @@ func (m *Monitor) Close() {
 	m.Log.Infof("Monitor is closed")
 }
 
+// Returns the high quality object detector, for offline work such as redacting exported video.
+// The detector is shared with the monitor's own NN threads.
+func (m *Monitor) HQDetector() nn.ObjectDetector {
+	return m.nnDetectorHQ
+}
+
+// Return our NN models, by name, so that they can be served to other systems.
+// If the LQ and HQ models are the same, then the map has just one entry.
+func (m *Monitor) Detectors() map[string]nn.ObjectDetector {
+	return map[string]nn.ObjectDetector{
+		m.nnModelNameHQ: m.nnDetectorHQ,
+		m.nnModelNameLQ: m.nnDetectorLQ,
+	}
+}
+
 // Return the list of all classes that the NN detects
 func (m *Monitor) AllClasses() []string {
 	return m.nnClassList
 }
 
-// Returns the map of concrete -> abstract NN classes
+// Returns the system's map of concrete -> abstract NN classes
 func (m *Monitor) AbstractClasses() map[string]string {
-	return m.nnClassAbstract
+	return m.classSettings.abstract
 }
 
 // Returns the special index of the "class unrecognized" class if 'cls' is not recognized
@@ -514,14 +561,6 @@ func makeAbstractClassSet(abstractClasses map[string]string, classMap map[string
 	return r
 }
 
-func makeClassFilter(classes []string) map[string]bool {
-	r := map[string]bool{}
-	for _, c := range classes {
-		r[c] = true
-	}
-	return r
-}
-
 func (m *Monitor) cameraByID(cameraID int64) *monitorCamera {
 	m.camerasLock.Lock()
 	defer m.camerasLock.Unlock()
@@ -569,9 +608,37 @@ func (m *Monitor) SetCameras(cameras []*camera.Camera) {
 				m.Log.Errorf("Failed to decode detection zone for camera %v: %v", cam.ID(), err)
 			}
 		}
+		settings := &m.analyzerSettings
+		if overrides, err := configdb.ParseAnalyzerSettings(config.AnalyzerSettings); err != nil {
+			// In this case, we use the defaults
+			m.Log.Errorf("Failed to parse analyzer settings for camera %v: %v", cam.ID(), err)
+		} else {
+			settings = m.analyzerSettings.withOverrides(overrides)
+		}
+		classes := m.classSettings
+		if overrides, err := config.ParseClasses(); err != nil {
+			m.Log.Errorf("Failed to parse classes for camera %v: %v", cam.ID(), err)
+		} else if overrides != nil {
+			if err := m.ValidateClasses(overrides, true); err != nil {
+				m.Log.Errorf("Invalid classes for camera %v: %v", cam.ID(), err)
+			} else {
+				classes = newClassSettings(m.classSettings.config.WithOverrides(overrides), m.nnClassMap)
+			}
+		}
+		rois, err := configdb.ParseRegionsOfInterest(config.RegionsOfInterest)
+		if err != nil {
+			m.Log.Errorf("Failed to parse regions of interest for camera %v: %v", cam.ID(), err)
+		} else if len(rois) != 0 && cam.IsVirtual() {
+			m.Log.Errorf("Ignoring regions of interest of virtual camera %v", cam.ID())
+			rois = nil
+		}
 		newCameras = append(newCameras, &monitorCamera{
-			camera:        cam,
-			detectionZone: detectionZone,
+			camera:           cam,
+			detectionZone:    detectionZone,
+			analyzerSettings: settings,
+			classSettings:    classes,
+			rois:             rois,
+			roiResults:       make([]roiResult, len(rois)),
 		})
 	}
 
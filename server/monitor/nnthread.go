@@ -91,7 +91,9 @@ func (t *nnThread) run(m *Monitor, threadIdx int) {
 			start := time.Now()
 			xformRgbToNN, rgbPure, rgbNN := m.prepareImageForNN(item.yuv, item.rgb, d.nnWidth, d.nnHeight, nnBlock, d.resizeQuality)
 			// Note that rgbNN is actually a window into wholeBatchImage, which is why we don't need to store it.
-			perfstats.UpdateMovingAverage(&perf.avgTimeNSPerFrameNNPrep, time.Now().Sub(start).Nanoseconds())
+			prepNS := time.Now().Sub(start).Nanoseconds()
+			perfstats.UpdateMovingAverage(&perf.avgTimeNSPerFrameNNPrep, prepNS)
+			m.nnBusyNS.Add(prepNS)
 			if m.debugDumpFrames {
 				m.dumpFrame(rgbPure, item.monCam.camera, "rgb")
 				m.dumpFrame(rgbNN, item.monCam.camera, "nn")
@@ -111,7 +113,9 @@ func (t *nnThread) run(m *Monitor, threadIdx int) {
 		imageBatch := nn.MakeImageBatch(d.batchSize, d.batchStride, d.nnWidth, d.nnHeight, 3, d.nnWidth*3, d.wholeBatchImage)
 		start := time.Now()
 		batchResult, err := d.detector.DetectObjects(imageBatch, d.detectionParams)
-		perfstats.UpdateMovingAverage(&perf.avgTimeNSPerFrameNNDet, time.Now().Sub(start).Nanoseconds())
+		detNS := time.Now().Sub(start).Nanoseconds()
+		perfstats.UpdateMovingAverage(&perf.avgTimeNSPerFrameNNDet, detNS)
+		m.nnBusyNS.Add(detNS)
 		if err != nil {
 			if time.Now().Sub(t.lastErrAt) > 15*time.Second {
 				m.Log.Errorf("Error detecting objects: %v", err)
@@ -122,6 +126,7 @@ func (t *nnThread) run(m *Monitor, threadIdx int) {
 				input := &d.batch[i]
 				objects := batchResult[i]
 				input.xformRgbToNN.ApplyBackward(objects)
+				objects = m.mergeROIDetections(input.monCam, objects, input.framePTS)
 				//m.Log.Infof("Camera %v detected %v objects", mcam.camera.ID, len(objects))
 				result := &nn.DetectionResult{
 					CameraID:    input.monCam.camera.ID(),
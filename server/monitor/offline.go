@@ -0,0 +1,156 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bmharper/cimg/v2"
+	"github.com/cyclopcam/cyclops/pkg/accel"
+	"github.com/cyclopcam/cyclops/pkg/nn"
+)
+
+// Offline analysis runs recorded footage through the same pipeline as live frames (the LQ NN,
+// HQ validation, tracking, and the genuineness checks), so that re-analyzed footage produces
+// the same results that live analysis would have produced, with the current models and settings.
+//
+// Offline analysis runs synchronously, in the caller's thread. It shares the NN models with
+// live analysis, but before each detection, it waits until the live NN threads have spare
+// capacity, so live analysis always comes first.
+
+// How long we sleep while waiting for the live NN threads to catch up
+const offlineYieldInterval = 10 * time.Millisecond
+
+// OfflineAnalyzer analyzes the recorded frames of a single camera.
+// Frames must be fed in chronological order. An OfflineAnalyzer is not safe for concurrent use.
+type OfflineAnalyzer struct {
+	m            *Monitor
+	cam          *analyzerCameraState
+	lq           nnDetectorState
+	hq           nnDetectorState
+	framePTS     time.Time           // Time of the frame that is being analyzed
+	lastAnalyzed time.Time           // Time of the most recent frame that we analyzed
+	nextImgID    int64               // ID of the next frame
+	validate     []analyzerQueueItem // Frames that the analyzer wants the HQ network to validate
+	results      []*AnalysisState    // Results of the frame that is being analyzed
+}
+
+// Create an analyzer for the recorded frames of the camera.
+// The camera's current class and analyzer settings are used.
+func (m *Monitor) NewOfflineAnalyzer(cameraID int64) (*OfflineAnalyzer, error) {
+	monCam := m.cameraByID(cameraID)
+	if monCam == nil {
+		return nil, fmt.Errorf("Camera %v not found", cameraID)
+	}
+	a := &OfflineAnalyzer{
+		m: m,
+	}
+	a.cam = &analyzerCameraState{
+		cameraID: cameraID,
+		monCam:   monCam,
+		offline:  a,
+	}
+	// We process one frame at a time, so there's no point in waiting to fill a batch
+	setupLQ := *m.nnModelSetupLQ
+	setupLQ.BatchSize = 1
+	a.lq.init(&setupLQ, m.nnDetectorLQ)
+	if m.nnDetectorHQ != nil {
+		setupHQ := *m.nnModelSetupHQ
+		setupHQ.BatchSize = 1
+		a.hq.init(&setupHQ, m.nnDetectorHQ)
+	}
+	return a, nil
+}
+
+// Returns true if the frame at framePTS should be analyzed.
+// We analyze frames at the same rate as the live NN scheduler would, when it has spare capacity:
+// every frame while we're tracking objects, and a limited frame rate otherwise.
+func (a *OfflineAnalyzer) WantFrame(framePTS time.Time) bool {
+	priority := schedPriorityIdle
+	if len(a.cam.tracked) != 0 {
+		priority = schedPriorityActive
+	}
+	maxFPS := schedClasses[priority].maxFPS
+	if maxFPS == 0 || a.lastAnalyzed.IsZero() {
+		return true
+	}
+	return framePTS.Sub(a.lastAnalyzed) >= time.Duration(float64(time.Second)/maxFPS)
+}
+
+// Analyze a frame, and return the analysis results.
+// Privacy masks must already have been applied to the frame.
+// There is usually one result per frame, but there is a second result when the frame is
+// validated by the HQ network. A result is equivalent to one that the monitor sends to
+// its watchers during live analysis, so objects with Genuine = 1 include their history.
+func (a *OfflineAnalyzer) AnalyzeFrame(ctx context.Context, img *accel.YUVImage, framePTS time.Time) ([]*AnalysisState, error) {
+	a.framePTS = framePTS
+	a.lastAnalyzed = framePTS
+	a.results = nil
+	a.nextImgID++
+
+	objects, rgb, err := a.detect(ctx, &a.lq, img, nil)
+	if err != nil {
+		return nil, err
+	}
+	a.m.analyzeFrame(a.cam, analyzerQueueItem{
+		isHQ:      false,
+		imgID:     a.nextImgID,
+		monCam:    a.cam.monCam,
+		yuv:       img,
+		rgb:       rgb,
+		detection: a.detectionResult(img, objects),
+	})
+
+	// The analyzer may have asked for the frame to be validated by the HQ network
+	for len(a.validate) != 0 {
+		item := a.validate[0]
+		a.validate = a.validate[1:]
+		objects, _, err := a.detect(ctx, &a.hq, nil, item.rgb)
+		if err != nil {
+			return nil, err
+		}
+		item.isHQ = true
+		item.detection = a.detectionResult(item.yuv, objects)
+		a.m.analyzeFrame(a.cam, item)
+	}
+
+	return a.results, nil
+}
+
+func (a *OfflineAnalyzer) detectionResult(img *accel.YUVImage, objects []nn.ObjectDetection) *nn.DetectionResult {
+	return &nn.DetectionResult{
+		CameraID:    a.cam.cameraID,
+		ImageWidth:  img.Width,
+		ImageHeight: img.Height,
+		Objects:     objects,
+		FramePTS:    a.framePTS,
+	}
+}
+
+// Run the NN on a frame. Either yuv or rgb must be non-nil.
+// Returns the detections in image coordinates, and the RGB image.
+func (a *OfflineAnalyzer) detect(ctx context.Context, d *nnDetectorState, yuv *accel.YUVImage, rgb *cimg.Image) ([]nn.ObjectDetection, *cimg.Image, error) {
+	if err := a.waitForSpareCapacity(ctx); err != nil {
+		return nil, nil, err
+	}
+	xform, rgb, _ := a.m.prepareImageForNN(yuv, rgb, d.nnWidth, d.nnHeight, d.wholeBatchImage, d.resizeQuality)
+	batch, err := d.detector.DetectObjects(nn.MakeImageBatchSingle(d.nnWidth, d.nnHeight, 3, d.nnWidth*3, d.wholeBatchImage), d.detectionParams)
+	if err != nil {
+		return nil, nil, err
+	}
+	objects := batch[0]
+	xform.ApplyBackward(objects)
+	return objects, rgb, nil
+}
+
+// Wait until no live frames are waiting for the NN, and at least one NN thread is idle
+func (a *OfflineAnalyzer) waitForSpareCapacity(ctx context.Context) error {
+	for a.m.NNQueueLength() != 0 || a.m.NumNNThreadsActive() >= a.m.numNNThreads {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(offlineYieldInterval):
+		}
+	}
+	return nil
+}
@@ -0,0 +1,232 @@
+package monitor
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/bmharper/cimg/v2"
+	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/cyclops/pkg/nnaccel"
+	"github.com/cyclopcam/cyclops/pkg/videox"
+	"github.com/cyclopcam/cyclops/server/camera"
+)
+
+// Regions of interest (ROIs) are parts of a camera's frame where objects are too small for the LQ stream,
+// such as a gate far from the camera. A person there might be just a few pixels tall in the LD stream.
+// We periodically grab a recent HD frame of the camera, run the NN on each of its ROIs,
+// and map the detections back into LD coordinates. Until the next scan, these detections are merged
+// into the NN results of the camera's LD frames, so the tracker treats them like any other detection.
+//
+// Decoding HD is expensive, so we don't decode the HD stream just for ROIs. If the camera is already
+// decoding HD (because it has virtual cameras), then we use its latest frame. Otherwise we decode the
+// most recent HD keyframe on its own, so a scan only happens once a new keyframe has arrived, and
+// an ROI's effective interval is at least the camera's keyframe interval.
+
+const (
+	// How often the ROI scanner wakes up to check if any ROIs are due
+	roiScanTick = 100 * time.Millisecond
+
+	// Maximum age of the HD keyframe that we scan
+	roiMaxKeyframeAge = 10 * time.Second
+
+	// An ROI detection is not merged into an LD frame if the NN found an object of the same class
+	// in the LD frame, with at least this IoU. Small distant objects are often found by both.
+	roiDuplicateIoU = 0.3
+)
+
+// Detections of one scan of an ROI
+type roiResult struct {
+	framePTS time.Time            // Wall time of the HD frame
+	objects  []nn.ObjectDetection // In LD coordinates
+}
+
+// Scan the ROIs of all cameras when they are due.
+// A single thread runs this operation.
+func (m *Monitor) roiScanner() {
+	nextScan := map[*monitorCamera][]time.Time{}
+	lastFrame := map[*monitorCamera]time.Time{} // Time of the HD frame of the most recent scan
+	lastErrAt := time.Time{}
+	ticker := time.NewTicker(roiScanTick)
+	defer ticker.Stop()
+
+runloop:
+	for {
+		select {
+		case <-m.roiScannerStop:
+			break runloop
+		case <-ticker.C:
+		}
+
+		m.camerasLock.Lock()
+		cameras := slices.Clone(m.cameras)
+		m.camerasLock.Unlock()
+
+		now := time.Now()
+		for _, mcam := range cameras {
+			if len(mcam.rois) == 0 {
+				continue
+			}
+			next := nextScan[mcam]
+			if next == nil {
+				next = make([]time.Time, len(mcam.rois))
+				nextScan[mcam] = next
+			}
+			due := []int{}
+			for i := range mcam.rois {
+				if !now.Before(next[i]) {
+					due = append(due, i)
+				}
+			}
+			if len(due) == 0 {
+				continue
+			}
+			framePTS, err := m.scanROIs(mcam, due, lastFrame[mcam])
+			if err != nil && time.Since(lastErrAt) > time.Minute {
+				m.Log.Warnf("Region of interest scan failed on camera %v: %v", mcam.camera.ID(), err)
+				lastErrAt = time.Now()
+			}
+			if err == nil && framePTS.IsZero() {
+				// There is no new HD frame yet, so try again on the next tick
+				continue
+			}
+			lastFrame[mcam] = framePTS
+			for _, i := range due {
+				next[i] = now.Add(mcam.rois[i].Interval())
+			}
+		}
+
+		// Forget cameras that have been replaced by SetCameras
+		for mcam := range nextScan {
+			if !slices.Contains(cameras, mcam) {
+				delete(nextScan, mcam)
+				delete(lastFrame, mcam)
+			}
+		}
+	}
+	close(m.roiScannerStopped)
+}
+
+// Run the NN on the given ROIs of the most recent HD frame of the camera, if that frame is newer than 'after'.
+// Returns the time of the frame that was scanned, or zero if there was no new frame.
+func (m *Monitor) scanROIs(mcam *monitorCamera, due []int, after time.Time) (time.Time, error) {
+	mcam.lock.Lock()
+	lastDetection := mcam.lastDetection
+	mcam.lock.Unlock()
+	if lastDetection == nil {
+		// We need to know the size of the LD frames, to map our detections into them
+		return time.Time{}, nil
+	}
+
+	img, framePTS, err := m.latestHDFrame(mcam.camera, after)
+	if err != nil || img == nil {
+		return time.Time{}, err
+	}
+	camera.ApplyPrivacyMaskRGB(mcam.camera.PrivacyMask(img.Width, img.Height), img)
+
+	for _, i := range due {
+		x, y, width, height := mcam.rois[i].Crop.Pixels(img.Width, img.Height)
+		crop := cimg.NewImage(width, height, cimg.PixelFormatRGB)
+		crop.CopyImageRect(img, x, y, x+width, y+height, 0, 0)
+		objects, err := m.detectROI(crop, mcam.rois[i].Tiled)
+		if err != nil {
+			return time.Time{}, err
+		}
+		// From ROI coordinates to HD frame coordinates, to LD frame coordinates
+		toLD := nn.ResizeTransform{
+			OffsetX: int32(-x),
+			OffsetY: int32(-y),
+			ScaleX:  float32(img.Width) / float32(lastDetection.ImageWidth),
+			ScaleY:  float32(img.Height) / float32(lastDetection.ImageHeight),
+		}
+		toLD.ApplyBackward(objects)
+		mcam.lock.Lock()
+		mcam.roiResults[i] = roiResult{
+			framePTS: framePTS,
+			objects:  objects,
+		}
+		mcam.lock.Unlock()
+	}
+	return framePTS, nil
+}
+
+// Return the most recent HD frame of the camera, if it is newer than 'after', otherwise nil.
+func (m *Monitor) latestHDFrame(cam *camera.Camera, after time.Time) (*cimg.Image, time.Time, error) {
+	if decoder := cam.HighDecoderIfEnabled(); decoder != nil {
+		yuv, _, framePTS := decoder.GetLastImageIfDifferent(0)
+		if yuv == nil || !framePTS.After(after) {
+			return nil, time.Time{}, nil
+		}
+		return yuv.ToCImageRGB(), framePTS, nil
+	}
+
+	buf, err := cam.ExtractHighRes(camera.ExtractMethodShallowClone, roiMaxKeyframeAge)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	for i := len(buf.Packets) - 1; i >= 0; i-- {
+		if !buf.Packets[i].HasIDR() {
+			continue
+		}
+		if !buf.Packets[i].WallPTS.After(after) {
+			return nil, time.Time{}, nil
+		}
+		return videox.DecodeFirstImageInPacketList(buf.Codec(), buf.Packets[i:i+1])
+	}
+	return nil, time.Time{}, fmt.Errorf("No HD keyframe in the last %v", roiMaxKeyframeAge)
+}
+
+// Run the LQ NN on an ROI. The results are in the coordinates of the ROI.
+func (m *Monitor) detectROI(crop *cimg.Image, tiled bool) ([]nn.ObjectDetection, error) {
+	detector := m.nnDetectorLQ
+	params := nn.NewDetectionParams()
+	params.ProbabilityThreshold = m.nnModelSetupLQ.ProbabilityThreshold
+	params.NmsIouThreshold = m.nnModelSetupLQ.NmsIouThreshold
+	if tiled {
+		return nn.TiledInference(detector, nn.WholeImage(3, crop.Pixels, crop.Width, crop.Height), params, 1)
+	}
+	nnWidth := detector.Config().Width
+	nnHeight := detector.Config().Height
+	nnImage := nnaccel.PageAlignedAlloc(nnBatchImageStride(nnWidth, nnHeight))
+	xform, _, _ := m.prepareImageForNN(nil, crop, nnWidth, nnHeight, nnImage, ResizeQualityLow)
+	batch, err := detector.DetectObjects(nn.MakeImageBatchSingle(nnWidth, nnHeight, 3, nnWidth*3, nnImage), params)
+	if err != nil {
+		return nil, err
+	}
+	objects := batch[0]
+	xform.ApplyBackward(objects)
+	return objects, nil
+}
+
+// Add the ROI detections that are recent enough to stand in for the LD frame at framePTS,
+// unless the NN found the same object in the LD frame.
+// We do this for the HQ network's results too, because the HQ network sees the same LD frame,
+// so it would reject an object that only an ROI can see. An ROI scan is itself a high
+// resolution look at the object.
+func (m *Monitor) mergeROIDetections(mcam *monitorCamera, objects []nn.ObjectDetection, framePTS time.Time) []nn.ObjectDetection {
+	if len(mcam.rois) == 0 {
+		return objects
+	}
+	mcam.lock.Lock()
+	defer mcam.lock.Unlock()
+	for i, result := range mcam.roiResults {
+		// Hold detections for a little longer than the scan interval, so that they don't flicker
+		hold := mcam.rois[i].Interval() * 3 / 2
+		if result.objects == nil || framePTS.Sub(result.framePTS).Abs() > hold {
+			continue
+		}
+		for _, obj := range result.objects {
+			isDuplicate := false
+			for j := range objects {
+				if objects[j].Class == obj.Class && objects[j].Box.IOU(obj.Box) >= roiDuplicateIoU {
+					isDuplicate = true
+					break
+				}
+			}
+			if !isDuplicate {
+				objects = append(objects, obj)
+			}
+		}
+	}
+	return objects
+}
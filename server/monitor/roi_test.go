@@ -0,0 +1,39 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergeROIDetections(t *testing.T) {
+	m := &Monitor{}
+	now := time.Now()
+	person := func(x, y, w, h int32) nn.ObjectDetection {
+		return nn.ObjectDetection{Class: 0, Confidence: 0.8, Box: nn.Rect{X: x, Y: y, Width: w, Height: h}}
+	}
+	mcam := &monitorCamera{
+		rois: []configdb.RegionOfInterest{{IntervalMS: 1000}, {IntervalMS: 1000}},
+		roiResults: []roiResult{
+			{framePTS: now, objects: []nn.ObjectDetection{person(300, 50, 2, 6), person(100, 100, 20, 40)}},
+			{framePTS: now.Add(-5 * time.Second), objects: []nn.ObjectDetection{person(10, 10, 4, 8)}},
+		},
+	}
+
+	// The LD frame already has the larger person, so only the tiny distant one is added.
+	// The second ROI's scan is too old to use.
+	objects := m.mergeROIDetections(mcam, []nn.ObjectDetection{person(101, 99, 20, 41)}, now.Add(500*time.Millisecond))
+	require.Equal(t, 2, len(objects))
+	require.Equal(t, person(300, 50, 2, 6), objects[1])
+
+	// Beyond the hold time, nothing is added
+	objects = m.mergeROIDetections(mcam, nil, now.Add(2*time.Second))
+	require.Equal(t, 0, len(objects))
+
+	// A camera without ROIs is untouched
+	objects = m.mergeROIDetections(&monitorCamera{}, []nn.ObjectDetection{person(1, 1, 5, 5)}, now)
+	require.Equal(t, 1, len(objects))
+}
@@ -0,0 +1,204 @@
+package monitor
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// The NN scheduler decides which camera's frame is sent to the NN next.
+//
+// Each camera has a priority, which is recomputed a few times per second. When the NN threads are
+// busy, idle cameras are capped at a low frame rate. When the NN has plenty of spare capacity, there's
+// no reason to throw frames away, so idle cameras get every frame too. Cameras with tracked objects,
+// and alarm cameras while the system is armed, get every frame that the NN can keep up with.
+//
+// When the NN can't keep up, we don't let frames queue up, because that adds latency to every
+// camera. Instead, the NN's capacity is shared between the cameras in proportion to the weight of
+// their priority (weighted fair queueing), so every camera's frame rate drops, but the important
+// cameras keep most of theirs.
+
+type schedPriority int
+
+const (
+	schedPriorityIdle   schedPriority = iota // Nothing going on
+	schedPriorityActive                      // There are tracked objects in the camera's view
+	schedPriorityAlarm                       // The system is armed, and this camera can trigger the alarm
+)
+
+func (p schedPriority) String() string {
+	switch p {
+	case schedPriorityActive:
+		return "active"
+	case schedPriorityAlarm:
+		return "alarm"
+	}
+	return "idle"
+}
+
+type schedClass struct {
+	maxFPS float64 // Zero = no limit (every frame from the camera)
+	weight float64 // Share of the NN when it is overloaded
+}
+
+// SYNC-SCHED-PRIORITY
+var schedClasses = [...]schedClass{
+	schedPriorityIdle:   {maxFPS: 4, weight: 1},
+	schedPriorityActive: {maxFPS: 0, weight: 3},
+	schedPriorityAlarm:  {maxFPS: 0, weight: 6},
+}
+
+// How often we measure the effective NN frame rate of each camera, and the load on the NN threads
+const schedStatsInterval = 2 * time.Second
+
+// Idle cameras are capped once the NN threads are busy for this fraction of the time, and uncapped
+// again when the load drops below schedIdleUncapLoad. The gap stops us from flipping back and forth,
+// because uncapping the idle cameras raises the load.
+const (
+	schedIdleCapLoad   = 0.7
+	schedIdleUncapLoad = 0.4
+)
+
+type schedCamera struct {
+	priority schedPriority
+	vtime    float64   // Virtual finish time of the camera's most recent frame. Lowest is served first.
+	nextDue  time.Time // If the camera's priority has an FPS limit, then we can't send another frame before this time
+	lastSent time.Time // Time when we last sent a frame of this camera to the NN
+	numSent  int       // Frames sent since the last stats update
+	fps      float64   // Effective NN frame rate over the last stats interval
+}
+
+type nnScheduler struct {
+	cameras      []schedCamera
+	capIdle      bool    // True if idle cameras are limited to their maxFPS
+	load         float64 // Fraction of time that the NN threads were busy, over the most recent stats interval
+	vnow         float64 // Virtual time of the most recently sent frame
+	lastStats    time.Time
+	statsElapsed time.Duration // Length of the most recent stats interval
+	order        []int         // Scratch space for next()
+}
+
+func newNNScheduler(numCameras int, now time.Time) *nnScheduler {
+	return &nnScheduler{
+		cameras:   make([]schedCamera, numCameras),
+		capIdle:   true, // Until we know the load, we assume that the NN is busy
+		lastStats: now,
+	}
+}
+
+// Returns the frame rate limit of the priority. Zero = no limit.
+func (s *nnScheduler) maxFPS(p schedPriority) float64 {
+	if p == schedPriorityIdle && !s.capIdle {
+		return 0
+	}
+	return schedClasses[p].maxFPS
+}
+
+// Set the fraction of time that the NN threads were busy, which decides whether idle cameras are capped
+func (s *nnScheduler) setLoad(load float64) {
+	s.load = load
+	if s.capIdle && load < schedIdleUncapLoad {
+		s.capIdle = false
+		for i := range s.cameras {
+			if s.cameras[i].priority == schedPriorityIdle {
+				s.cameras[i].nextDue = time.Time{}
+			}
+		}
+	} else if !s.capIdle && load > schedIdleCapLoad {
+		s.capIdle = true
+	}
+}
+
+func (s *nnScheduler) setPriority(i int, p schedPriority) {
+	c := &s.cameras[i]
+	c.priority = p
+	if s.maxFPS(p) == 0 {
+		// Don't make a camera that has just become active wait out the limit of its idle priority
+		c.nextDue = time.Time{}
+	}
+}
+
+// Returns the indices of the cameras that may send a frame now, with the most deserving camera first.
+// The caller sends the frame of the first camera that has a new frame available, and then calls sent().
+func (s *nnScheduler) next(now time.Time) []int {
+	s.order = s.order[:0]
+	for i := range s.cameras {
+		if !now.Before(s.cameras[i].nextDue) {
+			s.order = append(s.order, i)
+		}
+	}
+	slices.SortFunc(s.order, func(a, b int) int {
+		ca, cb := &s.cameras[a], &s.cameras[b]
+		// A camera that has been quiet doesn't build up credit, otherwise it would get a burst of frames later
+		va, vb := max(ca.vtime, s.vnow), max(cb.vtime, s.vnow)
+		if va != vb {
+			if va < vb {
+				return -1
+			}
+			return 1
+		}
+		if ca.priority != cb.priority {
+			return int(cb.priority) - int(ca.priority)
+		}
+		return ca.lastSent.Compare(cb.lastSent)
+	})
+	return s.order
+}
+
+// Record that we sent a frame of camera i to the NN
+func (s *nnScheduler) sent(i int, now time.Time) {
+	c := &s.cameras[i]
+	class := schedClasses[c.priority]
+	start := max(c.vtime, s.vnow)
+	s.vnow = start
+	c.vtime = start + 1/class.weight
+	c.lastSent = now
+	c.numSent++
+	if maxFPS := s.maxFPS(c.priority); maxFPS != 0 {
+		interval := time.Duration(float64(time.Second) / maxFPS)
+		c.nextDue = c.nextDue.Add(interval)
+		if c.nextDue.Before(now) {
+			// Don't catch up on frames that we missed, because the camera had no new frame, or the NN was busy
+			c.nextDue = now
+		}
+	} else {
+		c.nextDue = time.Time{}
+	}
+}
+
+// Update the effective frame rate of each camera, if it is time to do so.
+// Returns true if the rates were updated.
+func (s *nnScheduler) updateStats(now time.Time) bool {
+	elapsed := now.Sub(s.lastStats)
+	if elapsed < schedStatsInterval {
+		return false
+	}
+	for i := range s.cameras {
+		c := &s.cameras[i]
+		c.fps = float64(c.numSent) / elapsed.Seconds()
+		c.numSent = 0
+	}
+	s.lastStats = now
+	s.statsElapsed = elapsed
+	return true
+}
+
+// NN scheduling stats of a camera
+type CameraNNStats struct {
+	Priority  string  `json:"priority"`  // "idle", "active", or "alarm"
+	MaxFPS    float64 `json:"maxFPS"`    // Current frame rate limit of the camera's priority. Zero = no limit.
+	FPS       float64 `json:"fps"`       // Effective rate at which the camera's frames are being analyzed by the NN
+	CameraFPS float64 `json:"cameraFPS"` // Rate at which the camera produces frames
+}
+
+type nnSchedStats struct {
+	lock    sync.Mutex
+	cameras map[int64]CameraNNStats // Replaced, never modified
+}
+
+// Return the NN scheduling stats of each camera, keyed by camera ID
+func (m *Monitor) NNStats() map[int64]CameraNNStats {
+	m.nnSchedStats.lock.Lock()
+	defer m.nnSchedStats.lock.Unlock()
+	return m.nnSchedStats.cameras
+}
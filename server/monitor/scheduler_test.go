@@ -0,0 +1,108 @@
+package monitor
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Simulate an NN that can process 'capacity' frames per second, from cameras that produce 'cameraFPS' frames
+// per second, and return the number of frames that were sent for each camera.
+func simulateScheduler(s *nnScheduler, cameraFPS float64, capacity float64, duration time.Duration) []int {
+	start := time.Unix(1000, 0)
+	frameInterval := time.Duration(float64(time.Second) / cameraFPS)
+	nnInterval := time.Duration(float64(time.Second) / capacity)
+	lastFrame := make([]int64, len(s.cameras))
+	sent := make([]int, len(s.cameras))
+	nnFreeAt := start
+	for now := start; now.Before(start.Add(duration)); now = now.Add(time.Millisecond) {
+		if now.Before(nnFreeAt) {
+			continue
+		}
+		frameID := int64(now.Sub(start) / frameInterval)
+		for _, i := range s.next(now) {
+			if lastFrame[i] == frameID {
+				continue
+			}
+			lastFrame[i] = frameID
+			sent[i]++
+			s.sent(i, now)
+			nnFreeAt = now.Add(nnInterval)
+			break
+		}
+	}
+	return sent
+}
+
+func TestSchedulerIdleLimit(t *testing.T) {
+	// The NN is fast enough for everything, so only the FPS limit of idle cameras kicks in
+	s := newNNScheduler(2, time.Unix(1000, 0))
+	s.setPriority(1, schedPriorityActive)
+	sent := simulateScheduler(s, 10, 1000, 10*time.Second)
+	require.InDelta(t, 10*schedClasses[schedPriorityIdle].maxFPS, sent[0], 3)
+	require.InDelta(t, 100, sent[1], 2)
+}
+
+func TestSchedulerIdleUncapped(t *testing.T) {
+	// When the NN threads are mostly idle, idle cameras get every frame
+	s := newNNScheduler(2, time.Unix(1000, 0))
+	s.setPriority(1, schedPriorityActive)
+	s.setLoad(0.2)
+	require.Equal(t, 0.0, s.maxFPS(schedPriorityIdle))
+	sent := simulateScheduler(s, 10, 1000, 10*time.Second)
+	require.InDelta(t, 100, sent[0], 2)
+	require.InDelta(t, 100, sent[1], 2)
+
+	// Loads between the two thresholds don't change anything
+	s.setLoad((schedIdleCapLoad + schedIdleUncapLoad) / 2)
+	require.False(t, s.capIdle)
+
+	// Once the NN gets busy, the cap comes back
+	s.setLoad(0.9)
+	require.Equal(t, schedClasses[schedPriorityIdle].maxFPS, s.maxFPS(schedPriorityIdle))
+	s.setLoad((schedIdleCapLoad + schedIdleUncapLoad) / 2)
+	require.True(t, s.capIdle)
+}
+
+func TestSchedulerOverload(t *testing.T) {
+	// 4 cameras at 10 FPS, but the NN can only do 12 FPS.
+	// The alarm camera must get twice the share of the active camera, and the idle cameras get the least.
+	s := newNNScheduler(4, time.Unix(1000, 0))
+	s.setPriority(0, schedPriorityIdle)
+	s.setPriority(1, schedPriorityIdle)
+	s.setPriority(2, schedPriorityActive)
+	s.setPriority(3, schedPriorityAlarm)
+	sent := simulateScheduler(s, 10, 12, 10*time.Second)
+	t.Logf("Frames sent: %v", sent)
+	total := sent[0] + sent[1] + sent[2] + sent[3]
+	require.InDelta(t, 120, total, 3)
+	require.InDelta(t, 2.0, float64(sent[3])/float64(sent[2]), 0.2)
+	require.InDelta(t, 3.0, float64(sent[2])/float64(sent[0]), 0.4)
+	require.InDelta(t, sent[0], sent[1], 2)
+}
+
+func TestSchedulerNoBurst(t *testing.T) {
+	// A camera that has been quiet doesn't get to catch up
+	now := time.Unix(1000, 0)
+	s := newNNScheduler(2, now)
+	s.setPriority(0, schedPriorityActive)
+	s.setPriority(1, schedPriorityActive)
+	for range 100 {
+		s.sent(0, now)
+	}
+	require.Equal(t, []int{1, 0}, s.next(now))
+	s.sent(1, now)
+	require.Equal(t, []int{0, 1}, s.next(now))
+}
+
+func TestSchedulerStats(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := newNNScheduler(1, now)
+	for range 10 {
+		s.sent(0, now)
+	}
+	require.False(t, s.updateStats(now.Add(time.Second)))
+	require.True(t, s.updateStats(now.Add(schedStatsInterval)))
+	require.Equal(t, 10/schedStatsInterval.Seconds(), s.cameras[0].fps)
+}
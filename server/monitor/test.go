@@ -22,7 +22,9 @@ func (m *Monitor) InjectTestCamera() {
 	cfg.ID = int64(id)
 	fakeCamera.Config.Store(cfg)
 	cam := &monitorCamera{
-		camera: fakeCamera,
+		camera:           fakeCamera,
+		analyzerSettings: &m.analyzerSettings,
+		classSettings:    m.classSettings,
 	}
 	m.cameras = append(m.cameras, cam)
 	m.camerasLock.Unlock()
@@ -1,6 +1,7 @@
 package monitor
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/bmharper/flatbush-go"
@@ -32,6 +33,62 @@ func (m *matchNew) hasMatch() bool {
 	return m.existingMatch != -1
 }
 
+// objectTracker matches the objects detected in a frame to the objects in cam.tracked.
+// On the LQ network, it creates new tracked objects for detections that don't match anything.
+// On the HQ network, it updates the validation status of the tracked objects.
+type objectTracker interface {
+	track(cam *analyzerCameraState, objects []nn.ProcessedObject, isHQ bool, imgID int64, frameWidth, frameHeight int, framePTS time.Time)
+
+	// How long we keep tracking an object after we last saw it
+	forgetTime(cam *analyzerCameraState, obj *trackedObject) time.Duration
+}
+
+// greedyTracker is our original tracker, which matches each detection to the closest tracked object
+type greedyTracker struct {
+	m *Monitor
+}
+
+func (g *greedyTracker) track(cam *analyzerCameraState, objects []nn.ProcessedObject, isHQ bool, imgID int64, frameWidth, frameHeight int, framePTS time.Time) {
+	g.m.trackDetectedObjects(cam, objects, isHQ, imgID, frameWidth, frameHeight, framePTS)
+}
+
+func (g *greedyTracker) forgetTime(cam *analyzerCameraState, obj *trackedObject) time.Duration {
+	return cam.monCam.analyzerSettings.objectForgetTimeForClass(g.m.nnClassList[obj.firstDetection.Class])
+}
+
+// Create the tracker named by MonitorOptions.Tracker
+func newObjectTracker(m *Monitor, name string) (objectTracker, error) {
+	switch name {
+	case "", TrackerGreedy:
+		return &greedyTracker{m: m}, nil
+	case TrackerKalman:
+		return &kalmanTracker{m: m}, nil
+	}
+	return nil, fmt.Errorf("Unknown object tracker '%v'", name)
+}
+
+// Start tracking a newly detected object
+func (m *Monitor) newTrackedObject(obj *nn.ProcessedObject, frameWidth, frameHeight int) *trackedObject {
+	return &trackedObject{
+		id:             m.nextTrackedObjectID.Next(),
+		firstDetection: *obj,
+		history:        ringbuffer.NewRingP[timeAndPosition](nextPowerOf2(m.analyzerSettings.positionHistorySize)),
+		cameraWidth:    frameWidth,
+		cameraHeight:   frameHeight,
+		totalSightings: 0,
+	}
+}
+
+// Record an LQ sighting of the object
+func (t *trackedObject) addSighting(obj *nn.ProcessedObject, framePTS time.Time) {
+	t.totalSightings++
+	t.lastPosition = obj.Raw.Box
+	t.history.Add(timeAndPosition{
+		time:      framePTS,
+		detection: *obj,
+	})
+}
+
 // Process incoming objects, and track them spatially.
 // objects is the list of objects detected in the current frame.
 // When performing tracking on the LQ network, we're very lenient. This is because objects
@@ -40,8 +97,6 @@ func (m *matchNew) hasMatch() bool {
 // same frame twice. First on the LQ network, and then on the HQ network. So in this case
 // we impose reasonably strict spatial matching criteria.
 func (m *Monitor) trackDetectedObjects(cam *analyzerCameraState, objects []nn.ProcessedObject, isHQ bool, imgID int64, frameWidth, frameHeight int, framePTS time.Time) {
-	positionHistorySize := nextPowerOf2(m.analyzerSettings.positionHistorySize)
-
 	// Create spatial index on the currently tracked objects (cam.tracked)
 	fb := flatbush.NewFlatbush[int32]()
 	fb.Reserve(len(cam.tracked))
@@ -99,7 +154,7 @@ func (m *Monitor) trackDetectedObjects(cam *analyzerCameraState, objects []nn.Pr
 			oldObj := cam.tracked[j]
 			classMatch := oldObj.firstDetection.Class == newObj.Class
 			if allowMerge && !classMatch {
-				if m.nnClassMergePairs[m.makeMergePairKey(oldObj.firstDetection.Class, newObj.Class)] {
+				if cam.monCam.classSettings.mergePairs[m.makeMergePairKey(oldObj.firstDetection.Class, newObj.Class)] {
 					classMatch = true
 				}
 			}
@@ -202,15 +257,7 @@ func (m *Monitor) trackDetectedObjects(cam *analyzerCameraState, objects []nn.Pr
 		if bestJ == -1 && !isHQ {
 			// Create a new object
 			bestJ = len(cam.tracked)
-			objectID := m.nextTrackedObjectID.Next()
-			cam.tracked = append(cam.tracked, &trackedObject{
-				id:             objectID,
-				firstDetection: *newObj,
-				history:        ringbuffer.NewRingP[timeAndPosition](positionHistorySize),
-				cameraWidth:    frameWidth,
-				cameraHeight:   frameHeight,
-				totalSightings: 0,
-			})
+			cam.tracked = append(cam.tracked, m.newTrackedObject(newObj, frameWidth, frameHeight))
 			if m.analyzerSettings.verbose {
 				m.Log.Infof("Analyzer (cam %v): New '%v' frame %v at %v,%v (bestIoU %.2f, CM %.2f)", cam.cameraID, m.nnClassList[newObj.Class], imgID, newObj.Raw.Box.Center().X, newObj.Raw.Box.Center().Y, newState[i].bestIoU, newObj.Raw.ConfidenceMargin)
 			}
@@ -224,41 +271,42 @@ func (m *Monitor) trackDetectedObjects(cam *analyzerCameraState, objects []nn.Pr
 		}
 
 		if !isHQ {
-			cam.tracked[bestJ].totalSightings++
-			cam.tracked[bestJ].lastPosition = newObj.Raw.Box
-			cam.tracked[bestJ].history.Add(timeAndPosition{
-				time:      framePTS,
-				detection: *newObj,
-			})
+			cam.tracked[bestJ].addSighting(newObj, framePTS)
 		}
 	}
 
 	if isHQ {
-		// Update validation status to either "valid" or "invalid"
-		cam.lastHQFrame = time.Now()
-		for i := range cam.tracked {
-			obj := cam.tracked[i]
-			newState := validationStatusNone
-			if trackedAndFound[i] {
-				newState = validationStatusValid
-			} else if obj.validation == validationStatusWaiting {
-				newState = validationStatusInvalid
-			}
+		bestIoU := make([]float32, len(existingState))
+		for i := range existingState {
+			bestIoU[i] = existingState[i].bestIoU
+		}
+		m.updateValidationStatus(cam, trackedAndFound, bestIoU, imgID)
+	}
+}
+
+// After running the HQ network, update the validation status of cam.tracked to either "valid" or "invalid".
+// trackedAndFound and bestIoU are 1:1 with cam.tracked.
+func (m *Monitor) updateValidationStatus(cam *analyzerCameraState, trackedAndFound []bool, bestIoU []float32, imgID int64) {
+	cam.lastHQFrame = cam.now()
+	for i := range cam.tracked {
+		obj := cam.tracked[i]
+		newState := validationStatusNone
+		if trackedAndFound[i] {
+			newState = validationStatusValid
+		} else if obj.validation == validationStatusWaiting {
+			newState = validationStatusInvalid
+		}
+
+		if obj.validation != newState {
+			obj.validation = newState
 
-			if obj.validation != newState {
-				obj.validation = newState
-
-				if m.analyzerSettings.verbose {
-					iou := float32(-1)
-					if i < len(existingState) {
-						iou = existingState[i].bestIoU
-					}
-					cls := m.nnClassList[obj.firstDetection.Class]
-					if obj.validation == validationStatusInvalid {
-						m.Log.Infof("Analyzer (cam %v): False Positive '%v' frame %v at %v (bestIoU %.2f)", cam.cameraID, cls, imgID, obj.validationPosition, iou)
-					} else {
-						m.Log.Infof("Analyzer (cam %v): True Positive '%v' frame %v at (IoU %.2f, %v -> %v)", cam.cameraID, cls, imgID, iou, obj.validationPosition, obj.lastPosition)
-					}
+			if m.analyzerSettings.verbose {
+				iou := bestIoU[i]
+				cls := m.nnClassList[obj.firstDetection.Class]
+				if obj.validation == validationStatusInvalid {
+					m.Log.Infof("Analyzer (cam %v): False Positive '%v' frame %v at %v (bestIoU %.2f)", cam.cameraID, cls, imgID, obj.validationPosition, iou)
+				} else {
+					m.Log.Infof("Analyzer (cam %v): True Positive '%v' frame %v at (IoU %.2f, %v -> %v)", cam.cameraID, cls, imgID, iou, obj.validationPosition, obj.lastPosition)
 				}
 			}
 		}
@@ -300,7 +348,7 @@ func (m *Monitor) investigateGenuineness(cam *analyzerCameraState, item analyzer
 
 // Investigate if an object should become genuine
 func (m *Monitor) investigateIfObjectIsGenuine(cam *analyzerCameraState, item analyzerQueueItem, tracked *trackedObject, now time.Time) (makeGenuine, sendFrameForValidation bool) {
-	settings := &m.analyzerSettings
+	settings := cam.monCam.analyzerSettings
 	cls := m.nnClassList[tracked.firstDetection.Class]
 
 	// This check happens before any of the other decision tree, because it's an obviously correct
@@ -319,7 +367,7 @@ func (m *Monitor) investigateIfObjectIsGenuine(cam *analyzerCameraState, item an
 			makeGenuine = true
 		} else if !item.isHQ {
 			// LQ observation of object
-			if tracked.validation == validationStatusInvalid && now.Sub(cam.lastHQFrame) > settings.revalidateInterval && tracked.totalSightings > tracked.sightingsAtValidation {
+			if tracked.validation == validationStatusInvalid && now.Sub(cam.lastHQFrame) > settings.revalidateIntervalForClass(cls) && tracked.totalSightings > tracked.sightingsAtValidation {
 				// Reset validation status, because this object seems to be sticky
 				tracked.validation = validationStatusNone
 			}
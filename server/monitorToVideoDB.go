@@ -5,6 +5,7 @@ import (
 
 	"github.com/cyclopcam/cyclops/pkg/gen"
 	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/cyclops/server/defs"
 	"github.com/cyclopcam/cyclops/server/monitor"
 	"github.com/cyclopcam/cyclops/server/videodb"
 )
@@ -28,6 +29,7 @@ func (s *Server) attachMonitorToVideoDB() {
 					s.Log.Warnf("Ignoring monitor message for unknown camera %v", msg.CameraID)
 					continue
 				}
+				haveEvent := false
 				for _, obj := range msg.Objects {
 					if obj.Genuine >= 1 {
 						frames := []videodb.TrackedBox{}
@@ -35,6 +37,13 @@ func (s *Server) attachMonitorToVideoDB() {
 							frames = append(frames, videodb.TrackedBox{Time: frame.Time, Box: frame.Box, Confidence: frame.Confidence})
 						}
 						s.videoDB.ObjectDetected(cam.LongLivedName(), resolution, obj.ID, frames, classes[obj.Class])
+						haveEvent = true
+					}
+				}
+				if haveEvent && s.replicator != nil {
+					// Get the footage off the box soon, instead of when the file is full
+					for _, res := range defs.AllResolutions {
+						s.replicator.OnEvent(cam.RecordingStreamName(res), time.Now())
 					}
 				}
 			}
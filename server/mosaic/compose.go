@@ -0,0 +1,97 @@
+package mosaic
+
+import (
+	"github.com/bmharper/cimg/v2"
+	"github.com/cyclopcam/cyclops/pkg/accel"
+)
+
+// YUV values of black
+const (
+	blackY  = 16
+	blackUV = 128
+)
+
+// A rectangle on the canvas, in luma pixels. All coordinates are even, so that
+// they map exactly onto the chroma planes.
+type rect struct {
+	x, y, width, height int
+}
+
+// Create a black YUV420p canvas
+func newCanvas(width, height int) *accel.YUVImage {
+	img := &accel.YUVImage{
+		Width:  width,
+		Height: height,
+		Y:      make([]byte, width*height),
+		U:      make([]byte, width*height/4),
+		V:      make([]byte, width*height/4),
+	}
+	fillRect(img, rect{0, 0, width, height})
+	return img
+}
+
+// Returns the rectangle of cell i, for a grid of numColumns x numRows
+func cellRect(canvasWidth, canvasHeight, numColumns, numRows, i int) rect {
+	col := i % numColumns
+	row := i / numColumns
+	x1 := (canvasWidth * col / numColumns) &^ 1
+	x2 := (canvasWidth * (col + 1) / numColumns) &^ 1
+	y1 := (canvasHeight * row / numRows) &^ 1
+	y2 := (canvasHeight * (row + 1) / numRows) &^ 1
+	return rect{x1, y1, x2 - x1, y2 - y1}
+}
+
+// Returns the largest rectangle inside 'cell' that has the aspect ratio of a srcWidth x srcHeight image, centered inside the cell
+func fitRect(cell rect, srcWidth, srcHeight int) rect {
+	scale := min(float64(cell.width)/float64(srcWidth), float64(cell.height)/float64(srcHeight))
+	w := max(int(float64(srcWidth)*scale)&^1, 2)
+	h := max(int(float64(srcHeight)*scale)&^1, 2)
+	w = min(w, cell.width)
+	h = min(h, cell.height)
+	x := cell.x + ((cell.width-w)/2)&^1
+	y := cell.y + ((cell.height-h)/2)&^1
+	return rect{x, y, w, h}
+}
+
+// Fill a rectangle of the canvas with black
+func fillRect(canvas *accel.YUVImage, r rect) {
+	fillPlane(canvas.Y, canvas.YStride(), r.x, r.y, r.width, r.height, blackY)
+	fillPlane(canvas.U, canvas.UStride(), r.x/2, r.y/2, r.width/2, r.height/2, blackUV)
+	fillPlane(canvas.V, canvas.VStride(), r.x/2, r.y/2, r.width/2, r.height/2, blackUV)
+}
+
+func fillPlane(plane []byte, stride, x, y, width, height int, value byte) {
+	for row := y; row < y+height; row++ {
+		line := plane[row*stride+x : row*stride+x+width]
+		for i := range line {
+			line[i] = value
+		}
+	}
+}
+
+// Scale src into the rectangle 'dst' of the canvas
+func drawImage(canvas *accel.YUVImage, dst rect, src *accel.YUVImage) error {
+	// Luma and chroma are resized independently, as grayscale images.
+	// CheapSRGBFilter avoids a pointless sRGB -> linear conversion, which isn't meaningful for YUV anyway.
+	params := cimg.ResizeParams{CheapSRGBFilter: true}
+	planes := []struct {
+		src, dst             []byte
+		srcStride, dstStride int
+		div                  int
+	}{
+		{src.Y, canvas.Y, src.YStride(), canvas.YStride(), 1},
+		{src.U, canvas.U, src.UStride(), canvas.UStride(), 2},
+		{src.V, canvas.V, src.VStride(), canvas.VStride(), 2},
+	}
+	for _, p := range planes {
+		srcImg := cimg.WrapImageStrided(src.Width/p.div, src.Height/p.div, cimg.PixelFormatGRAY, p.src, p.srcStride)
+		// We don't use Image.ReferenceCrop, because it slices one row too far, which panics when the crop touches the bottom of the canvas.
+		x1, y1 := dst.x/p.div, dst.y/p.div
+		x2, y2 := (dst.x+dst.width)/p.div, (dst.y+dst.height)/p.div
+		dstImg := cimg.WrapImageStrided(x2-x1, y2-y1, cimg.PixelFormatGRAY, p.dst[y1*p.dstStride+x1:(y2-1)*p.dstStride+x2], p.dstStride)
+		if err := cimg.Resize(srcImg, dstImg, &params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
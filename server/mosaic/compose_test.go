@@ -0,0 +1,48 @@
+package mosaic
+
+import (
+	"testing"
+
+	"github.com/cyclopcam/cyclops/pkg/accel"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCellLayout(t *testing.T) {
+	// Cells must tile the canvas exactly, with even coordinates
+	for _, grid := range [][2]int{{1, 1}, {2, 2}, {3, 3}, {4, 3}} {
+		total := 0
+		for i := 0; i < grid[0]*grid[1]; i++ {
+			c := cellRect(1280, 720, grid[0], grid[1], i)
+			require.Equal(t, 0, c.x%2)
+			require.Equal(t, 0, c.y%2)
+			require.Equal(t, 0, c.width%2)
+			require.Equal(t, 0, c.height%2)
+			total += c.width * c.height
+		}
+		require.Equal(t, 1280*720, total)
+	}
+
+	// 4:3 camera in a 16:9 cell is pillarboxed
+	r := fitRect(rect{0, 0, 640, 360}, 640, 480)
+	require.Equal(t, rect{80, 0, 480, 360}, r)
+}
+
+func TestDrawImage(t *testing.T) {
+	canvas := newCanvas(64, 32)
+	src := &accel.YUVImage{
+		Width:  16,
+		Height: 16,
+		Y:      make([]byte, 16*16),
+		U:      make([]byte, 8*8),
+		V:      make([]byte, 8*8),
+	}
+	for i := range src.Y {
+		src.Y[i] = 200
+	}
+	cell := cellRect(64, 32, 2, 1, 1)
+	dst := fitRect(cell, src.Width, src.Height)
+	require.NoError(t, drawImage(canvas, dst, src))
+	require.Equal(t, byte(blackY), canvas.Y[0])
+	require.Equal(t, byte(200), canvas.Y[(dst.y+dst.height-1)*64+dst.x+dst.width-1])
+	require.Equal(t, byte(0), canvas.U[(dst.y/2)*32+dst.x/2])
+}
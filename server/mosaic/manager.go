@@ -0,0 +1,92 @@
+package mosaic
+
+import (
+	"sync"
+
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/cyclops/server/transcoder"
+	"github.com/cyclopcam/logs"
+)
+
+// Manager creates mosaics on demand, and shares them between viewers of the same layout.
+// A mosaic is stopped when its last viewer leaves.
+// Mosaics share the CPU budget of the transcoders, because encoding a mosaic costs
+// about the same as transcoding a stream.
+type Manager struct {
+	log     logs.Log
+	cameras CameraFinder
+	budget  Budget
+
+	lock    sync.Mutex
+	running map[int64]*Mosaic // Key is the layout ID
+}
+
+func NewManager(log logs.Log, cameras CameraFinder, budget Budget) *Manager {
+	return &Manager{
+		log:     log,
+		cameras: cameras,
+		budget:  budget,
+		running: map[int64]*Mosaic{},
+	}
+}
+
+// Acquire a mosaic for the given layout.
+// If the layout is already running, and hasn't been modified since it was started, then it is shared.
+// Returns transcoder.ErrOverBudget if a new mosaic would exceed the shared CPU budget.
+// You must call Release() when you're done with it.
+func (m *Manager) Acquire(layout *configdb.MosaicLayout) (*Mosaic, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if existing := m.running[layout.ID]; existing != nil && existing.Layout.UpdatedAt == layout.UpdatedAt {
+		existing.refCount++
+		return existing, nil
+	}
+
+	// Like the transcoders, a running mosaic degrades gracefully when we're over budget,
+	// but we don't start a new one.
+	if m.budget.IsOverBudget() {
+		return nil, transcoder.ErrOverBudget
+	}
+
+	// If the layout was modified, then existing viewers keep the old mosaic until they disconnect
+	mosaic, err := newMosaic(m.log, *layout, m.cameras, m.budget)
+	if err != nil {
+		return nil, err
+	}
+	mosaic.refCount = 1
+	m.running[layout.ID] = mosaic
+	return mosaic, nil
+}
+
+// Release a mosaic that was returned by Acquire()
+func (m *Manager) Release(mosaic *Mosaic) {
+	m.lock.Lock()
+	mosaic.refCount--
+	if mosaic.refCount != 0 {
+		m.lock.Unlock()
+		return
+	}
+	// The map entry may already have been removed by Close(), or replaced by a newer version of the layout
+	if m.running[mosaic.Layout.ID] == mosaic {
+		delete(m.running, mosaic.Layout.ID)
+	}
+	m.lock.Unlock()
+
+	mosaic.stopAndWait()
+}
+
+// Stop all mosaics
+func (m *Manager) Close() {
+	m.lock.Lock()
+	all := []*Mosaic{}
+	for _, mosaic := range m.running {
+		all = append(all, mosaic)
+	}
+	m.running = map[int64]*Mosaic{}
+	m.lock.Unlock()
+
+	for _, mosaic := range all {
+		mosaic.stopAndWait()
+	}
+}
@@ -0,0 +1,26 @@
+package mosaic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/cyclops/server/transcoder"
+	"github.com/cyclopcam/logs"
+	"github.com/stretchr/testify/require"
+)
+
+type testBudget struct {
+	over bool
+}
+
+func (b *testBudget) IsOverBudget() bool            { return b.over }
+func (b *testBudget) AddCPUTime(used time.Duration) {}
+
+func TestAcquireOverBudget(t *testing.T) {
+	// A new mosaic must not push the transcoders over their shared budget
+	m := NewManager(logs.NewTestingLog(t), nil, &testBudget{over: true})
+	defer m.Close()
+	_, err := m.Acquire(&configdb.MosaicLayout{ID: 1, Name: "Booth", NumColumns: 2, NumRows: 2})
+	require.ErrorIs(t, err, transcoder.ErrOverBudget)
+}
@@ -0,0 +1,238 @@
+package mosaic
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/accel"
+	"github.com/cyclopcam/cyclops/pkg/videox"
+	"github.com/cyclopcam/cyclops/server/camera"
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/logs"
+)
+
+// Size of the ring buffer on the output stream, which is used to send new viewers the
+// packets since the most recent keyframe, so that they can start playing immediately.
+const backlogBytes = 4 * 1024 * 1024
+
+// CameraFinder returns the live camera with the given ID, or nil.
+// This is satisfied by LiveCameras.
+type CameraFinder interface {
+	CameraFromID(id int64) *camera.Camera
+}
+
+// Budget is the CPU budget that mosaics share with the transcoders.
+// This is satisfied by transcoder.Manager.
+type Budget interface {
+	IsOverBudget() bool
+	AddCPUTime(used time.Duration)
+}
+
+// When we're over the CPU budget, we drop to this frame rate, so that the output keeps moving, even if slowly
+const overBudgetInterval = time.Second
+
+// A single cell of the grid
+type cell struct {
+	cameraID int64
+	area     rect               // The whole cell
+	drawn    rect               // The part of the cell that was last drawn into
+	reader   camera.FrameReader // The reader that we last pulled a frame from
+	imgID    int64              // ID of the last frame that we drew
+}
+
+// Mosaic composites the LD streams of several cameras into a grid, and encodes the grid as a
+// single H.264 stream. We don't decode anything ourselves, because every camera's LD stream is
+// already decoded for the neural network, by the camera's VideoDecodeReader (or in the case of
+// a virtual camera, the crop of its parent's HD stream).
+// The result is published on Output, which behaves like any other camera stream, so anything
+// that can serve a camera stream can serve a mosaic.
+type Mosaic struct {
+	Layout  configdb.MosaicLayout
+	Output  *camera.Stream
+	Backlog *camera.VideoRingBuffer // Recent packets of Output
+
+	log      logs.Log
+	cameras  CameraFinder
+	budget   Budget
+	stop     chan bool // Closed when the last viewer leaves
+	stopOnce sync.Once
+	done     chan bool // Closed when the mosaic has finished cleaning up
+	refCount int       // Protected by Manager.lock
+
+	// These are only accessed by the run thread
+	canvas        *accel.YUVImage
+	cells         []cell
+	encoder       *videox.VideoEncoder
+	nOutput       int64
+	lastEncode    time.Time
+	nOverBudget   int64
+	lastBudgetLog time.Time
+}
+
+// StreamName returns the name of the output stream of a mosaic.
+// Mosaics are named like virtual cameras, so that they're easy to tell apart in the logs.
+func StreamName(layoutID int64) string {
+	return fmt.Sprintf("mosaic-%v", layoutID)
+}
+
+func newMosaic(logger logs.Log, layout configdb.MosaicLayout, cameras CameraFinder, budget Budget) (*Mosaic, error) {
+	width, height := layout.OutputSize()
+	fps := layout.OutputFPS()
+	encoder, err := videox.NewVideoMemoryEncoder(videox.MemoryEncoderParams{
+		Codec:            videox.CodecH264,
+		InputWidth:       width,
+		InputHeight:      height,
+		Width:            width,
+		Height:           height,
+		PixelFormatIn:    videox.AVPixelFormatYUV420P,
+		FPS:              fps,
+		Bitrate:          bitrate(width, height, fps),
+		KeyframeInterval: 2 * fps,
+		Threads:          1,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create encoder: %w", err)
+	}
+
+	name := StreamName(layout.ID)
+	m := &Mosaic{
+		Layout:  layout,
+		Output:  camera.NewStream(logger, layout.Name, name, true),
+		Backlog: camera.NewVideoRingBuffer(backlogBytes),
+		log:     logs.NewPrefixLogger(logger, fmt.Sprintf("Mosaic %v (%v)", layout.ID, layout.Name)),
+		cameras: cameras,
+		budget:  budget,
+		stop:    make(chan bool),
+		done:    make(chan bool),
+		canvas:  newCanvas(width, height),
+		encoder: encoder,
+	}
+	m.Output.Codec = videox.CodecH264
+	ids := layout.CameraIDs()
+	for i := 0; i < layout.NumColumns*layout.NumRows; i++ {
+		c := cell{
+			area: cellRect(width, height, layout.NumColumns, layout.NumRows, i),
+		}
+		if i < len(ids) {
+			c.cameraID = ids[i]
+		}
+		m.cells = append(m.cells, c)
+	}
+	if err := m.Output.ConnectSinkAndRun("Mosaic Ring", m.Backlog); err != nil {
+		encoder.Close()
+		return nil, err
+	}
+	go m.run()
+	return m, nil
+}
+
+// A rough bitrate that gives acceptable quality for a grid of mostly static cameras
+func bitrate(width, height, fps int) int {
+	return max(width*height*fps/10, 250*1000)
+}
+
+// Stop the mosaic, and wait for it to finish cleaning up
+func (m *Mosaic) stopAndWait() {
+	m.stopOnce.Do(func() { close(m.stop) })
+	<-m.done
+}
+
+func (m *Mosaic) run() {
+	defer close(m.done)
+	defer m.Output.Close(nil)
+	defer m.encoder.Close()
+
+	width, height := m.Layout.OutputSize()
+	m.log.Infof("Starting %v x %v, %v x %v cells at %v FPS", width, height, m.Layout.NumColumns, m.Layout.NumRows, m.Layout.OutputFPS())
+
+	start := time.Now()
+	ticker := time.NewTicker(time.Second / time.Duration(m.Layout.OutputFPS()))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			m.log.Infof("Stopped")
+			return
+		case now := <-ticker.C:
+			if m.skipOverBudget(now) {
+				continue
+			}
+			workStart := time.Now()
+			m.compose()
+			if err := m.encode(now, now.Sub(start)); err != nil {
+				m.log.Errorf("%v", err)
+			}
+			m.lastEncode = now
+			m.budget.AddCPUTime(time.Since(workStart))
+		}
+	}
+}
+
+// Returns true if we should skip this frame, because all encoders together are over the CPU budget.
+// Our encoder is single threaded, so the wall time of composing and encoding a frame is a good
+// estimate of the CPU time that it consumed.
+func (m *Mosaic) skipOverBudget(now time.Time) bool {
+	if now.Sub(m.lastEncode) < overBudgetInterval && m.budget.IsOverBudget() {
+		m.nOverBudget++
+		if now.Sub(m.lastBudgetLog) > 10*time.Second {
+			m.log.Infof("Over CPU budget. Skipped %v frames so far", m.nOverBudget)
+			m.lastBudgetLog = now
+		}
+		return true
+	}
+	return false
+}
+
+// Draw the latest frame of every camera onto the canvas.
+// Cells whose camera hasn't produced a new frame are left as they are.
+func (m *Mosaic) compose() {
+	for i := range m.cells {
+		c := &m.cells[i]
+		var reader camera.FrameReader
+		if c.cameraID != 0 {
+			if cam := m.cameras.CameraFromID(c.cameraID); cam != nil {
+				reader = cam.Frames()
+			}
+		}
+		if reader != c.reader {
+			// Camera was added, removed, or restarted. Frame IDs are per reader, so start over.
+			c.reader = reader
+			c.imgID = 0
+			if c.drawn.width != 0 {
+				fillRect(m.canvas, c.drawn)
+				c.drawn = rect{}
+			}
+		}
+		if reader == nil {
+			continue
+		}
+		img, imgID, _ := reader.GetLastImageIfDifferent(c.imgID)
+		if img == nil {
+			continue
+		}
+		c.imgID = imgID
+		dst := fitRect(c.area, img.Width, img.Height)
+		if dst != c.drawn {
+			// Camera resolution changed, so clear the letterbox bars
+			fillRect(m.canvas, c.area)
+			c.drawn = dst
+		}
+		if err := drawImage(m.canvas, dst, img); err != nil {
+			m.log.Errorf("Failed to draw camera %v: %v", c.cameraID, err)
+		}
+	}
+}
+
+func (m *Mosaic) encode(now time.Time, pts time.Duration) error {
+	if err := m.encoder.WriteYUVImage(pts, m.canvas); err != nil {
+		return fmt.Errorf("Failed to encode frame: %w", err)
+	}
+	for _, packet := range m.encoder.ReadPackets() {
+		packet.WallPTS = now.Add(packet.PTS - pts)
+		m.nOutput++
+		packet.ValidRecvID = m.nOutput
+		m.Output.PublishPacket(packet)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package reanalysis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/fsv"
+	"github.com/cyclopcam/cyclops/pkg/videox"
+	"github.com/cyclopcam/cyclops/server/camera"
+	"github.com/cyclopcam/cyclops/server/monitor"
+	"github.com/cyclopcam/cyclops/server/videodb"
+	"github.com/cyclopcam/logs"
+)
+
+// We read this much footage from the archive at a time. This bounds our memory usage,
+// and it's also how often we report progress, and write results to the DB.
+const chunkDuration = 5 * time.Minute
+
+type analyzer struct {
+	log          logs.Log
+	monitor      *monitor.Monitor
+	videoDB      *videodb.VideoDB
+	cameraFromID func(id int64) *camera.Camera
+}
+
+// Create a job manager that re-analyzes footage from the video archive with the monitor's
+// analysis pipeline, and writes the results into videoDB.
+func NewManager(logger logs.Log, mon *monitor.Monitor, videoDB *videodb.VideoDB, cameraFromID func(id int64) *camera.Camera) (*Manager, error) {
+	maxJob, err := videoDB.MaxEventJob()
+	if err != nil {
+		return nil, err
+	}
+	a := &analyzer{
+		log:          logger,
+		monitor:      mon,
+		videoDB:      videoDB,
+		cameraFromID: cameraFromID,
+	}
+	return newManager(logger, a.run, maxJob+1), nil
+}
+
+func (a *analyzer) run(ctx context.Context, id int64, req Request, progress func(Progress)) error {
+	cam := a.cameraFromID(req.CameraID)
+	if cam == nil {
+		return fmt.Errorf("Camera %v not found", req.CameraID)
+	}
+	start := req.StartTime.Get()
+	end := req.EndTime.Get()
+	if now := time.Now(); end.After(now) {
+		end = now
+	}
+
+	offline, err := a.monitor.NewOfflineAnalyzer(req.CameraID)
+	if err != nil {
+		return err
+	}
+	writer, err := a.videoDB.NewReanalysisWriter(cam.LongLivedName(), start, req.Replace, id)
+	if err != nil {
+		return err
+	}
+
+	p := Progress{}
+	for chunkStart := start; chunkStart.Before(end); {
+		chunkEnd := chunkStart.Add(chunkDuration)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+		nFrames, err := a.analyzeChunk(ctx, cam, offline, writer, chunkStart, chunkEnd)
+		p.Frames += nFrames
+		if err != nil {
+			// Write the objects that we've seen so far, so that in replace mode, the footage that
+			// we've analyzed has complete results.
+			if commitErr := writer.Commit(time.Time{}, true); commitErr != nil {
+				a.log.Errorf("Failed to write results of interrupted job: %v", commitErr)
+			}
+			return err
+		}
+		if err := writer.Commit(chunkEnd, false); err != nil {
+			return err
+		}
+		p.Fraction = chunkEnd.Sub(start).Seconds() / end.Sub(start).Seconds()
+		p.Events = writer.NumEvents
+		p.Objects = writer.NumObjects
+		progress(p)
+		chunkStart = chunkEnd
+	}
+
+	if err := writer.Commit(end, true); err != nil {
+		return err
+	}
+	p.Events = writer.NumEvents
+	p.Objects = writer.NumObjects
+	progress(p)
+	return nil
+}
+
+// Analyze the frames from start to end, and return the number of frames analyzed
+func (a *analyzer) analyzeChunk(ctx context.Context, cam *camera.Camera, offline *monitor.OfflineAnalyzer, writer *videodb.ReanalysisWriter, start, end time.Time) (int, error) {
+	stream := cam.RecordingStreamName(cam.AnalysisResolution())
+	result, err := a.videoDB.Archive.Read(stream, []string{"video"}, start, end, fsv.ReadFlagSeekBackToKeyFrame)
+	var codecSwitch *fsv.ErrCodecSwitch
+	if errors.As(err, &codecSwitch) {
+		// The camera's settings were changed. This is rare, so we don't bother splitting the chunk.
+		a.log.Warnf("Skipping %v to %v of camera %v: %v", start, end, cam.ID(), err)
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	video := result["video"]
+	if video == nil || len(video.NALS) == 0 {
+		// There was no recording during this time
+		return 0, nil
+	}
+	pbuffer, err := videox.ExtractFsvPackets(video.Codec, video.NALS)
+	if err != nil {
+		return 0, err
+	}
+	if !pbuffer.HasIDR() {
+		return 0, nil
+	}
+	decoder, err := videox.NewVideoStreamDecoder(pbuffer.Codec())
+	if err != nil {
+		return 0, err
+	}
+	defer decoder.Close()
+
+	classes := a.monitor.AllClasses()
+	nFrames := 0
+	for _, packet := range pbuffer.Packets[pbuffer.FindFirstIDR():] {
+		frame, err := decoder.DecodeDeepRef(packet)
+		if errors.Is(err, videox.ErrNoFrame) {
+			continue
+		} else if err != nil {
+			return nFrames, fmt.Errorf("Failed to decode packet: %w", err)
+		}
+		// We seek back to a keyframe, so the first frames can belong to the previous chunk
+		framePTS := packet.WallPTS
+		if framePTS.Before(start) || !framePTS.Before(end) || !offline.WantFrame(framePTS) {
+			continue
+		}
+		// The decoder needs the frame as a reference for the frames that follow, so we can't modify it
+		img, err := cam.PrepareRecordedFrame(frame.Image.Clone())
+		if err != nil {
+			return nFrames, err
+		}
+		results, err := offline.AnalyzeFrame(ctx, img, framePTS)
+		if err != nil {
+			return nFrames, err
+		}
+		nFrames++
+		for _, r := range results {
+			resolution := [2]int{r.Input.ImageWidth, r.Input.ImageHeight}
+			for _, obj := range r.Objects {
+				if obj.Genuine >= 1 {
+					boxes := []videodb.TrackedBox{}
+					for _, f := range obj.Frames {
+						boxes = append(boxes, videodb.TrackedBox{Time: f.Time, Box: f.Box, Confidence: f.Confidence})
+					}
+					if err := writer.ObjectDetected(resolution, obj.ID, boxes, classes[obj.Class]); err != nil {
+						return nFrames, err
+					}
+				}
+			}
+		}
+	}
+	return nFrames, nil
+}
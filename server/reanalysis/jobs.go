@@ -0,0 +1,258 @@
+// Package reanalysis re-runs the monitor's analysis over recorded footage, so that after we
+// upgrade the NN models, or change class filters, our history becomes searchable with the new results.
+package reanalysis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/cyclopcam/dbh"
+	"github.com/cyclopcam/logs"
+)
+
+var ErrJobNotFound = errors.New("Job not found")
+
+// We keep this many finished jobs, so that the user can see how they turned out
+const maxFinishedJobs = 20
+
+// SYNC-REANALYSIS-JOB-STATE
+type JobState string
+
+const (
+	JobStateQueued    JobState = "queued"
+	JobStateRunning   JobState = "running"
+	JobStateDone      JobState = "done"
+	JobStateFailed    JobState = "failed"
+	JobStateCancelled JobState = "cancelled"
+)
+
+// What to re-analyze
+// SYNC-REANALYSIS-REQUEST-JSON
+type Request struct {
+	CameraID  int64       `json:"cameraID"`
+	StartTime dbh.IntTime `json:"startTime"`
+	EndTime   dbh.IntTime `json:"endTime"`
+	Replace   bool        `json:"replace"` // Replace the original events, instead of storing the new events alongside them
+}
+
+// SYNC-REANALYSIS-PROGRESS-JSON
+type Progress struct {
+	Fraction float64 `json:"fraction"` // Fraction of the time range that has been analyzed (0..1)
+	Frames   int     `json:"frames"`   // Number of frames analyzed
+	Events   int     `json:"events"`   // Number of events written
+	Objects  int     `json:"objects"`  // Number of objects written
+}
+
+// SYNC-REANALYSIS-JOB-JSON
+type Job struct {
+	ID         int64       `json:"id"`
+	Request    Request     `json:"request"`
+	State      JobState    `json:"state"`
+	Progress   Progress    `json:"progress"`
+	Error      string      `json:"error"`
+	CreatedAt  dbh.IntTime `json:"createdAt"`
+	StartedAt  dbh.IntTime `json:"startedAt"`
+	FinishedAt dbh.IntTime `json:"finishedAt"`
+}
+
+func (j *Job) isFinished() bool {
+	return j.State == JobStateDone || j.State == JobStateFailed || j.State == JobStateCancelled
+}
+
+// Re-analyze the footage of a request, and report progress along the way
+type runFunc func(ctx context.Context, id int64, req Request, progress func(Progress)) error
+
+type job struct {
+	Job
+	cancel context.CancelFunc // Non-nil while the job is running
+}
+
+// Manager runs re-analysis jobs one at a time, in the order in which they were submitted.
+// Jobs are not persisted, so queued and running jobs are lost when the server restarts.
+// The results of jobs are marked with the job ID, so IDs continue from 'nextID', which
+// is beyond the IDs of results that are already in the DB.
+type Manager struct {
+	log     logs.Log
+	run     runFunc
+	wake    chan bool
+	cancel  context.CancelFunc
+	stopped chan bool
+
+	lock   sync.Mutex
+	jobs   []*job // In order of submission
+	nextID int64
+}
+
+func newManager(logger logs.Log, run runFunc, nextID int64) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{
+		log:     logs.NewPrefixLogger(logger, "Reanalysis:"),
+		run:     run,
+		wake:    make(chan bool, 1),
+		cancel:  cancel,
+		stopped: make(chan bool),
+		nextID:  nextID,
+	}
+	go m.worker(ctx)
+	return m
+}
+
+// Stop the running job, and wait for it to exit.
+// In replace mode, the footage that was analyzed keeps its new results.
+func (m *Manager) Close() {
+	m.cancel()
+	<-m.stopped
+}
+
+// Queue a new job
+func (m *Manager) Submit(req Request) (Job, error) {
+	if req.EndTime <= req.StartTime {
+		return Job{}, fmt.Errorf("Start time must be before end time")
+	}
+	if req.StartTime.Get().After(time.Now()) {
+		return Job{}, fmt.Errorf("Start time must be in the past")
+	}
+
+	m.lock.Lock()
+	j := &job{
+		Job: Job{
+			ID:        m.nextID,
+			Request:   req,
+			State:     JobStateQueued,
+			CreatedAt: dbh.MakeIntTime(time.Now()),
+		},
+	}
+	m.nextID++
+	m.jobs = append(m.jobs, j)
+	status := j.Job
+	m.lock.Unlock()
+
+	m.log.Infof("Queued job %v: camera %v, %v to %v, replace: %v", j.ID, req.CameraID, req.StartTime.Get(), req.EndTime.Get(), req.Replace)
+	select {
+	case m.wake <- true:
+	default:
+	}
+	return status, nil
+}
+
+// Cancel a queued or running job.
+// Cancelling a job that has already finished is not an error.
+func (m *Manager) Cancel(id int64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, j := range m.jobs {
+		if j.ID != id {
+			continue
+		}
+		if j.State == JobStateQueued {
+			j.State = JobStateCancelled
+			j.FinishedAt = dbh.MakeIntTime(time.Now())
+		} else if j.cancel != nil {
+			j.cancel()
+		}
+		return nil
+	}
+	return ErrJobNotFound
+}
+
+// Returns true if the job is queued or running
+func (m *Manager) IsActive(id int64) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, j := range m.jobs {
+		if j.ID == id {
+			return !j.isFinished()
+		}
+	}
+	return false
+}
+
+// Returns the status of all jobs, in order of submission
+func (m *Manager) Jobs() []Job {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	jobs := make([]Job, 0, len(m.jobs))
+	for _, j := range m.jobs {
+		jobs = append(jobs, j.Job)
+	}
+	return jobs
+}
+
+func (m *Manager) worker(ctx context.Context) {
+	defer close(m.stopped)
+	for {
+		if j, jobCtx := m.startNextJob(ctx); j != nil {
+			err := m.run(jobCtx, j.ID, j.Request, func(p Progress) {
+				m.lock.Lock()
+				j.Progress = p
+				m.lock.Unlock()
+			})
+			m.finishJob(j, err)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.wake:
+		}
+	}
+}
+
+// Mark the oldest queued job as running, and return it
+func (m *Manager) startNextJob(ctx context.Context) (*job, context.Context) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if ctx.Err() != nil {
+		return nil, nil
+	}
+	for _, j := range m.jobs {
+		if j.State == JobStateQueued {
+			jobCtx, cancel := context.WithCancel(ctx)
+			j.cancel = cancel
+			j.State = JobStateRunning
+			j.StartedAt = dbh.MakeIntTime(time.Now())
+			m.log.Infof("Starting job %v", j.ID)
+			return j, jobCtx
+		}
+	}
+	return nil, nil
+}
+
+func (m *Manager) finishJob(j *job, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	j.cancel()
+	j.cancel = nil
+	j.FinishedAt = dbh.MakeIntTime(time.Now())
+	if errors.Is(err, context.Canceled) {
+		j.State = JobStateCancelled
+		m.log.Infof("Job %v cancelled", j.ID)
+	} else if err != nil {
+		j.State = JobStateFailed
+		j.Error = err.Error()
+		m.log.Errorf("Job %v failed: %v", j.ID, err)
+	} else {
+		j.State = JobStateDone
+		j.Progress.Fraction = 1
+		m.log.Infof("Job %v done. %v frames analyzed, %v objects in %v events", j.ID, j.Progress.Frames, j.Progress.Objects, j.Progress.Events)
+	}
+
+	// Forget the oldest finished jobs
+	nFinished := 0
+	for _, other := range m.jobs {
+		if other.isFinished() {
+			nFinished++
+		}
+	}
+	m.jobs = slices.DeleteFunc(m.jobs, func(other *job) bool {
+		if nFinished > maxFinishedJobs && other.isFinished() {
+			nFinished--
+			return true
+		}
+		return false
+	})
+}
@@ -0,0 +1,102 @@
+package reanalysis
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/dbh"
+	"github.com/cyclopcam/logs"
+	"github.com/stretchr/testify/require"
+)
+
+func testRequest(camera int64) Request {
+	now := time.Now()
+	return Request{
+		CameraID:  camera,
+		StartTime: dbh.MakeIntTime(now.Add(-time.Hour)),
+		EndTime:   dbh.MakeIntTime(now),
+	}
+}
+
+func waitForState(t *testing.T, m *Manager, id int64, state JobState) Job {
+	for i := 0; i < 500; i++ {
+		for _, j := range m.Jobs() {
+			if j.ID == id && j.State == state {
+				return j
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Job %v did not reach state %v", id, state)
+	return Job{}
+}
+
+func TestManager(t *testing.T) {
+	// Camera 1 runs until it is cancelled, camera 2 fails, and camera 3 succeeds
+	started := make(chan int64, 10)
+	run := func(ctx context.Context, id int64, req Request, progress func(Progress)) error {
+		started <- req.CameraID
+		progress(Progress{Fraction: 0.5, Frames: 10})
+		switch req.CameraID {
+		case 1:
+			<-ctx.Done()
+			return ctx.Err()
+		case 2:
+			return fmt.Errorf("bad footage")
+		}
+		return nil
+	}
+	m := newManager(logs.NewTestingLog(t), run, 5)
+	defer m.Close()
+
+	_, err := m.Submit(Request{CameraID: 1, StartTime: dbh.MakeIntTime(time.Now()), EndTime: dbh.MakeIntTime(time.Now().Add(-time.Second))})
+	require.Error(t, err)
+
+	j1, err := m.Submit(testRequest(1))
+	require.NoError(t, err)
+	require.Equal(t, JobStateQueued, j1.State)
+	require.Equal(t, int64(5), j1.ID)
+	j2, err := m.Submit(testRequest(2))
+	require.NoError(t, err)
+	j3, err := m.Submit(testRequest(3))
+	require.NoError(t, err)
+	j4, err := m.Submit(testRequest(3))
+	require.NoError(t, err)
+
+	// Jobs run one at a time, in order
+	require.Equal(t, int64(1), <-started)
+	status := waitForState(t, m, j1.ID, JobStateRunning)
+	require.Equal(t, 0.5, status.Progress.Fraction)
+	require.Equal(t, JobStateQueued, waitForState(t, m, j2.ID, JobStateQueued).State)
+	require.True(t, m.IsActive(j1.ID))
+	require.True(t, m.IsActive(j2.ID))
+
+	// A queued job never runs once it has been cancelled
+	require.NoError(t, m.Cancel(j3.ID))
+	waitForState(t, m, j3.ID, JobStateCancelled)
+	require.ErrorIs(t, m.Cancel(12345), ErrJobNotFound)
+
+	require.NoError(t, m.Cancel(j1.ID))
+	waitForState(t, m, j1.ID, JobStateCancelled)
+	require.Equal(t, int64(2), <-started)
+	require.Equal(t, "bad footage", waitForState(t, m, j2.ID, JobStateFailed).Error)
+	require.False(t, m.IsActive(j2.ID))
+	require.Equal(t, int64(3), <-started)
+	status = waitForState(t, m, j4.ID, JobStateDone)
+	require.Equal(t, 1.0, status.Progress.Fraction)
+	require.Equal(t, 10, status.Progress.Frames)
+	require.Len(t, started, 0)
+
+	// Only the most recent finished jobs are kept
+	for i := 0; i < maxFinishedJobs; i++ {
+		j, err := m.Submit(testRequest(3))
+		require.NoError(t, err)
+		<-started
+		waitForState(t, m, j.ID, JobStateDone)
+	}
+	jobs := m.Jobs()
+	require.Len(t, jobs, maxFinishedJobs)
+	require.Equal(t, j4.ID+1, jobs[0].ID)
+}
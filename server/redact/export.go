@@ -0,0 +1,185 @@
+package redact
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/bmharper/cimg/v2"
+	"github.com/cyclopcam/cyclops/pkg/accel"
+	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/cyclops/pkg/videox"
+)
+
+// How long a box that was found by the NN pass stays blurred. The NN misses objects in some
+// frames, and a single unblurred frame is enough to identify somebody.
+const nnHoldDuration = 500 * time.Millisecond
+
+// If an NN detection overlaps a kept object by at least this much (IoU), then it is not blurred
+const keepIoUThreshold = 0.4
+
+// Options controls what is blurred by Export
+type Options struct {
+	Tracks []Track // Objects that must be blurred, typically from TracksFromEvents()
+	Keep   []Track // Objects that must not be blurred. Only needed with Detector, so that the NN pass doesn't blur them.
+
+	// If Detector is not nil, then every frame is run through it, and objects of DetectClasses are
+	// blurred. This catches objects that were never recorded as events, for example because
+	// they didn't move, or because the NN missed them at the time.
+	Detector      nn.ObjectDetector
+	DetectClasses map[int]bool
+
+	// If not nil, every frame is passed through Prepare before it is blurred, and the frame that
+	// it returns is exported. This crops the frame of a virtual camera, and blacks out the
+	// camera's privacy masks. See camera.PrepareRecordedFrame.
+	// Tracks and Keep are in the coordinates of the prepared frame.
+	Prepare func(img *accel.YUVImage) (*accel.YUVImage, error)
+}
+
+// Stats describes the result of an export
+type Stats struct {
+	Frames       int `json:"frames"`       // Number of frames written
+	BlurredBoxes int `json:"blurredBoxes"` // Total number of boxes blurred, over all frames
+}
+
+type recentBox struct {
+	box  Box
+	time time.Time
+}
+
+// Export decodes the packets, blurs the objects described by opt, and re-encodes the
+// result as an H264 MP4 file. Audio is not exported, because speech can't be redacted.
+// The packets must start with a keyframe.
+func Export(codec videox.Codec, packets []*videox.VideoPacket, filename string, opt *Options) (*Stats, error) {
+	if len(packets) == 0 {
+		return nil, errors.New("No video to export")
+	}
+	decoder, err := videox.NewVideoStreamDecoder(codec)
+	if err != nil {
+		return nil, err
+	}
+	defer decoder.Close()
+
+	var encoder *videox.VideoEncoder
+	defer func() {
+		if encoder != nil {
+			encoder.Close()
+		}
+	}()
+
+	stats := &Stats{}
+	var rgb *cimg.Image
+	recent := []recentBox{}
+	for _, packet := range packets {
+		frame, err := decoder.DecodeDeepRef(packet)
+		if errors.Is(err, videox.ErrNoFrame) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to decode packet: %w", err)
+		}
+		// The decoder needs the frame as a reference for the frames that follow, so we can't modify it
+		img := frame.Image.Clone()
+		if opt.Prepare != nil {
+			if img, err = opt.Prepare(img); err != nil {
+				return nil, err
+			}
+		}
+		if encoder == nil {
+			encoder, err = videox.NewVideoEncoder("h264", "mp4", filename, img.Width, img.Height, videox.AVPixelFormatYUV420P, videox.AVPixelFormatYUV420P, videox.VideoEncoderTypeImageFrames, estimateFPS(packets))
+			if err != nil {
+				return nil, fmt.Errorf("Failed to create encoder: %w", err)
+			}
+		}
+
+		boxes := BoxesAt(opt.Tracks, packet.WallPTS)
+		if opt.Detector != nil {
+			if rgb == nil || rgb.Width != img.Width || rgb.Height != img.Height {
+				rgb = cimg.NewImage(img.Width, img.Height, cimg.PixelFormatRGB)
+			}
+			img.CopyToCImageRGB(rgb)
+			detected, err := detectBoxes(opt, rgb, packet.WallPTS)
+			if err != nil {
+				return nil, err
+			}
+			for _, b := range detected {
+				recent = append(recent, recentBox{b, packet.WallPTS})
+			}
+			// Forget boxes that have expired
+			keep := recent[:0]
+			for _, r := range recent {
+				if packet.WallPTS.Sub(r.time) <= nnHoldDuration {
+					keep = append(keep, r)
+					boxes = append(boxes, r.box)
+				}
+			}
+			recent = keep
+		}
+		for _, b := range boxes {
+			Pixelate(img, b)
+		}
+		stats.BlurredBoxes += len(boxes)
+
+		if err := encoder.WriteYUVImage(packet.PTS-packets[0].PTS, img); err != nil {
+			return nil, fmt.Errorf("Failed to encode frame: %w", err)
+		}
+		stats.Frames++
+	}
+	if encoder == nil {
+		return nil, errors.New("No frames could be decoded")
+	}
+	if err := encoder.WriteTrailer(); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Run the NN on the frame, and return the padded boxes of objects that must be blurred
+func detectBoxes(opt *Options, rgb *cimg.Image, at time.Time) ([]Box, error) {
+	objects, err := nn.TiledInference(opt.Detector, nn.WholeImage(3, rgb.Pixels, rgb.Width, rgb.Height), nn.NewDetectionParams(), 1)
+	if err != nil {
+		return nil, fmt.Errorf("Object detection failed: %w", err)
+	}
+	kept := []Box{}
+	for i := range opt.Keep {
+		if b, ok := opt.Keep[i].BoxAt(at); ok {
+			kept = append(kept, b)
+		}
+	}
+	boxes := []Box{}
+	for _, obj := range objects {
+		if !opt.DetectClasses[obj.Class] {
+			continue
+		}
+		b := Box{
+			X1: int(obj.Box.X),
+			Y1: int(obj.Box.Y),
+			X2: int(obj.Box.X + obj.Box.Width),
+			Y2: int(obj.Box.Y + obj.Box.Height),
+		}
+		isKept := false
+		for _, k := range kept {
+			if b.IoU(k) >= keepIoUThreshold {
+				isKept = true
+				break
+			}
+		}
+		if !isKept {
+			boxes = append(boxes, b.Pad(BoxPadding))
+		}
+	}
+	return boxes, nil
+}
+
+// Estimate the frame rate from the packet times
+func estimateFPS(packets []*videox.VideoPacket) int {
+	if len(packets) < 2 {
+		return 10
+	}
+	duration := packets[len(packets)-1].PTS - packets[0].PTS
+	if duration <= 0 {
+		return 10
+	}
+	fps := int(math.Round(float64(len(packets)-1) / duration.Seconds()))
+	return min(max(fps, 1), 60)
+}
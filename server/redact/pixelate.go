@@ -0,0 +1,52 @@
+package redact
+
+import (
+	"github.com/cyclopcam/cyclops/pkg/accel"
+)
+
+// Smallest block size that we pixelate with, in luma pixels
+const minBlockSize = 8
+
+// Number of blocks across the smaller dimension of a box. Faces and plates need
+// to become unrecognizable, so this is coarse on purpose.
+const blocksPerBox = 6
+
+// Pixelate the box, by replacing each block of pixels with its average.
+// Unlike a gaussian blur, this can't be reversed to recover the original.
+func Pixelate(img *accel.YUVImage, box Box) {
+	box = box.Clip(img.Width, img.Height)
+	// Align to even coordinates, so that luma and chroma blocks cover the same area
+	box.X1 &^= 1
+	box.Y1 &^= 1
+	box.X2 = min((box.X2+1)&^1, img.Width&^1)
+	box.Y2 = min((box.Y2+1)&^1, img.Height&^1)
+	if box.X2 <= box.X1 || box.Y2 <= box.Y1 {
+		return
+	}
+	block := max(minBlockSize, min(box.X2-box.X1, box.Y2-box.Y1)/blocksPerBox) &^ 1
+	pixelatePlane(img.Y, img.YStride(), box.X1, box.Y1, box.X2, box.Y2, block)
+	pixelatePlane(img.U, img.UStride(), box.X1/2, box.Y1/2, box.X2/2, box.Y2/2, block/2)
+	pixelatePlane(img.V, img.VStride(), box.X1/2, box.Y1/2, box.X2/2, box.Y2/2, block/2)
+}
+
+func pixelatePlane(plane []byte, stride, x1, y1, x2, y2, block int) {
+	for by := y1; by < y2; by += block {
+		ey := min(by+block, y2)
+		for bx := x1; bx < x2; bx += block {
+			ex := min(bx+block, x2)
+			sum := 0
+			for y := by; y < ey; y++ {
+				for _, v := range plane[y*stride+bx : y*stride+ex] {
+					sum += int(v)
+				}
+			}
+			avg := byte(sum / ((ey - by) * (ex - bx)))
+			for y := by; y < ey; y++ {
+				row := plane[y*stride+bx : y*stride+ex]
+				for i := range row {
+					row[i] = avg
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package redact
+
+import (
+	"sort"
+	"time"
+
+	"github.com/cyclopcam/cyclops/server/videodb"
+)
+
+// How long we keep blurring an object before its first recorded position, and after its last.
+// The NN doesn't see every frame, and objects are usually visible for a moment before they're
+// first detected, and after they're last detected.
+const HoldDuration = 1500 * time.Millisecond
+
+// Fraction of the box width/height that we add to each side of a box, because NN boxes
+// are often a little tight, and the object moves between detections.
+const BoxPadding = 0.15
+
+// Box is a rectangle in the pixels of the exported video
+type Box struct {
+	X1, Y1, X2, Y2 int
+}
+
+// TrackPosition is the position of an object at a point in time
+type TrackPosition struct {
+	Time time.Time
+	Box  Box
+}
+
+// Track is the path of a single object, which must be blurred wherever it appears
+type Track struct {
+	ID        uint32          // Object ID from the video DB. Zero for objects detected during the export.
+	Positions []TrackPosition // Sorted by time
+}
+
+// Build tracks from recorded events.
+// Only objects with a class in 'classes' are included.
+// Boxes are scaled from the resolution that the NN ran on, to width x height.
+func TracksFromEvents(events []*videodb.Event, classes map[uint32]bool, width, height int) []Track {
+	byID := map[uint32]*Track{}
+	for _, ev := range events {
+		if ev.Detections == nil {
+			continue
+		}
+		det := &ev.Detections.Data
+		if det.Resolution[0] == 0 || det.Resolution[1] == 0 {
+			continue
+		}
+		scaleX := float64(width) / float64(det.Resolution[0])
+		scaleY := float64(height) / float64(det.Resolution[1])
+		for _, obj := range det.Objects {
+			if !classes[obj.Class] {
+				continue
+			}
+			track := byID[obj.ID]
+			if track == nil {
+				track = &Track{ID: obj.ID}
+				byID[obj.ID] = track
+			}
+			for _, p := range obj.Positions {
+				track.Positions = append(track.Positions, TrackPosition{
+					Time: ev.Time.Get().Add(time.Duration(p.Time) * time.Millisecond),
+					Box: Box{
+						X1: int(float64(p.Box[0]) * scaleX),
+						Y1: int(float64(p.Box[1]) * scaleY),
+						X2: int(float64(p.Box[2]) * scaleX),
+						Y2: int(float64(p.Box[3]) * scaleY),
+					},
+				})
+			}
+		}
+	}
+	tracks := []Track{}
+	for _, track := range byID {
+		// An object can span several events, so its positions are not necessarily in order
+		sort.Slice(track.Positions, func(i, j int) bool {
+			return track.Positions[i].Time.Before(track.Positions[j].Time)
+		})
+		tracks = append(tracks, *track)
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].ID < tracks[j].ID
+	})
+	return tracks
+}
+
+// Split tracks into those that must be blurred, and those whose IDs are in 'keep'
+func SplitTracks(tracks []Track, keep map[uint32]bool) (blur, kept []Track) {
+	for _, t := range tracks {
+		if keep[t.ID] {
+			kept = append(kept, t)
+		} else {
+			blur = append(blur, t)
+		}
+	}
+	return
+}
+
+// Returns the box of the track at time t, and true if the object is visible at that time.
+// Between two positions, we interpolate linearly.
+func (t *Track) BoxAt(at time.Time) (Box, bool) {
+	n := len(t.Positions)
+	if n == 0 {
+		return Box{}, false
+	}
+	first := t.Positions[0]
+	last := t.Positions[n-1]
+	if at.Before(first.Time) {
+		return first.Box, first.Time.Sub(at) <= HoldDuration
+	}
+	if !at.Before(last.Time) {
+		return last.Box, at.Sub(last.Time) <= HoldDuration
+	}
+	// Find the first position after 'at'
+	i := sort.Search(n, func(i int) bool {
+		return t.Positions[i].Time.After(at)
+	})
+	a := t.Positions[i-1]
+	b := t.Positions[i]
+	f := float64(at.Sub(a.Time)) / float64(b.Time.Sub(a.Time))
+	lerp := func(x, y int) int {
+		return x + int(f*float64(y-x)+0.5)
+	}
+	return Box{
+		X1: lerp(a.Box.X1, b.Box.X1),
+		Y1: lerp(a.Box.Y1, b.Box.Y1),
+		X2: lerp(a.Box.X2, b.Box.X2),
+		Y2: lerp(a.Box.Y2, b.Box.Y2),
+	}, true
+}
+
+// Returns the padded boxes of all tracks that are visible at time t
+func BoxesAt(tracks []Track, at time.Time) []Box {
+	boxes := []Box{}
+	for i := range tracks {
+		if box, ok := tracks[i].BoxAt(at); ok {
+			boxes = append(boxes, box.Pad(BoxPadding))
+		}
+	}
+	return boxes
+}
+
+// Grow the box by the given fraction of its width and height, on each side
+func (b Box) Pad(fraction float64) Box {
+	dx := int(float64(b.X2-b.X1)*fraction + 0.5)
+	dy := int(float64(b.Y2-b.Y1)*fraction + 0.5)
+	return Box{b.X1 - dx, b.Y1 - dy, b.X2 + dx, b.Y2 + dy}
+}
+
+// Clip the box to an image of the given size
+func (b Box) Clip(width, height int) Box {
+	return Box{
+		X1: min(max(b.X1, 0), width),
+		Y1: min(max(b.Y1, 0), height),
+		X2: min(max(b.X2, 0), width),
+		Y2: min(max(b.Y2, 0), height),
+	}
+}
+
+// Intersection over union
+func (b Box) IoU(x Box) float64 {
+	iw := min(b.X2, x.X2) - max(b.X1, x.X1)
+	ih := min(b.Y2, x.Y2) - max(b.Y1, x.Y1)
+	if iw <= 0 || ih <= 0 {
+		return 0
+	}
+	intersection := float64(iw * ih)
+	union := float64((b.X2-b.X1)*(b.Y2-b.Y1)+(x.X2-x.X1)*(x.Y2-x.Y1)) - intersection
+	return intersection / union
+}
@@ -0,0 +1,77 @@
+package redact
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/server/videodb"
+	"github.com/cyclopcam/dbh"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracksFromEvents(t *testing.T) {
+	base := time.UnixMilli(1700000000000)
+	const person = 1
+	const car = 2
+	// Object 7 spans two events, and the second event is listed first
+	events := []*videodb.Event{
+		{
+			Time: dbh.MakeIntTime(base.Add(2 * time.Second)),
+			Detections: dbh.MakeJSONField(videodb.EventDetectionsJSON{
+				Resolution: [2]int{320, 240},
+				Objects: []*videodb.ObjectJSON{
+					{ID: 7, Class: person, Positions: []videodb.ObjectPositionJSON{{Box: [4]int16{20, 20, 40, 40}, Time: 0}}},
+				},
+			}),
+		},
+		{
+			Time: dbh.MakeIntTime(base),
+			Detections: dbh.MakeJSONField(videodb.EventDetectionsJSON{
+				Resolution: [2]int{320, 240},
+				Objects: []*videodb.ObjectJSON{
+					{ID: 7, Class: person, Positions: []videodb.ObjectPositionJSON{{Box: [4]int16{0, 0, 20, 20}, Time: 1000}}},
+					{ID: 8, Class: car, Positions: []videodb.ObjectPositionJSON{{Box: [4]int16{0, 0, 10, 10}, Time: 0}}},
+					{ID: 9, Class: person, Positions: []videodb.ObjectPositionJSON{{Box: [4]int16{100, 100, 110, 110}, Time: 0}}},
+				},
+			}),
+		},
+	}
+
+	// Boxes are scaled from 320x240 to 640x480
+	tracks := TracksFromEvents(events, map[uint32]bool{person: true}, 640, 480)
+	require.Equal(t, 2, len(tracks))
+	require.Equal(t, uint32(7), tracks[0].ID)
+	require.Equal(t, 2, len(tracks[0].Positions))
+	require.Equal(t, Box{0, 0, 40, 40}, tracks[0].Positions[0].Box)
+	require.Equal(t, Box{40, 40, 80, 80}, tracks[0].Positions[1].Box)
+
+	// Interpolate halfway between the two positions
+	box, ok := tracks[0].BoxAt(base.Add(1500 * time.Millisecond))
+	require.True(t, ok)
+	require.Equal(t, Box{20, 20, 60, 60}, box)
+
+	// Hold the box for a while before the first position, and after the last
+	_, ok = tracks[0].BoxAt(base.Add(1000*time.Millisecond - HoldDuration))
+	require.True(t, ok)
+	_, ok = tracks[0].BoxAt(base.Add(900*time.Millisecond - HoldDuration))
+	require.False(t, ok)
+	_, ok = tracks[0].BoxAt(base.Add(2100*time.Millisecond + HoldDuration))
+	require.False(t, ok)
+
+	blur, kept := SplitTracks(tracks, map[uint32]bool{9: true})
+	require.Equal(t, 1, len(blur))
+	require.Equal(t, uint32(7), blur[0].ID)
+	require.Equal(t, 1, len(kept))
+	require.Equal(t, uint32(9), kept[0].ID)
+
+	boxes := BoxesAt(blur, base.Add(1000*time.Millisecond))
+	require.Equal(t, []Box{{-6, -6, 46, 46}}, boxes)
+}
+
+func TestBoxIoU(t *testing.T) {
+	a := Box{0, 0, 10, 10}
+	require.Equal(t, 1.0, a.IoU(a))
+	require.Equal(t, 0.0, a.IoU(Box{10, 0, 20, 10}))
+	require.InDelta(t, 50.0/150.0, a.IoU(Box{5, 0, 15, 10}), 1e-9)
+	require.Equal(t, Box{0, 0, 5, 10}, Box{-5, 0, 5, 20}.Clip(100, 10))
+}
@@ -0,0 +1,52 @@
+package replication
+
+import (
+	"github.com/BurntSushi/migration"
+	"github.com/cyclopcam/dbh"
+	"github.com/cyclopcam/logs"
+)
+
+// State of a video file, from the replicator's point of view
+type FileState string
+
+const (
+	FileStateDone    FileState = "done"    // All physical files have been copied to the target
+	FileStateSkipped FileState = "skipped" // Not replicated, because there were no events during the video (EventsOnly mode)
+)
+
+// Checkpoint for one logical video file (eg all the rf1 files of "cam-1-HD/1712815946731").
+// If a record exists, then we never need to look at that file again.
+type File struct {
+	Stream       string                   `gorm:"primaryKey;autoIncrement:false"`
+	Name         string                   `gorm:"primaryKey;autoIncrement:false"`
+	StartTime    dbh.IntTime              `gorm:"not null"`
+	EndTime      dbh.IntTime              `gorm:"not null"`
+	Size         int64                    `gorm:"not null"`
+	State        FileState                `gorm:"not null"`
+	RemoteFiles  *dbh.JSONField[[]string] // Names of the files on the target, so that we can delete them
+	ReplicatedAt dbh.IntTime              `gorm:"not null"`
+}
+
+func Migrations(log logs.Log) []migration.Migrator {
+	migs := []migration.Migrator{}
+	idx := 0
+
+	migs = append(migs, dbh.MakeMigrationFromSQL(log, &idx,
+		`
+		CREATE TABLE file(
+			stream TEXT NOT NULL,
+			name TEXT NOT NULL,
+			start_time INT NOT NULL,
+			end_time INT NOT NULL,
+			size INT NOT NULL,
+			state TEXT NOT NULL,
+			remote_files TEXT,
+			replicated_at INT NOT NULL,
+			PRIMARY KEY (stream, name)
+		);
+
+		CREATE INDEX idx_file_end_time ON file(end_time);
+	`))
+
+	return migs
+}
@@ -0,0 +1,386 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/fsv"
+	"github.com/cyclopcam/dbh"
+	"github.com/cyclopcam/logs"
+	"gorm.io/gorm"
+)
+
+// Returns true if there were any events on the stream during the given time period
+type EventFilter func(stream string, start, end time.Time) (bool, error)
+
+// Replicator settings
+type Options struct {
+	EventsOnly bool          // Only replicate files that overlap with events
+	HasEvents  EventFilter   // Required if EventsOnly is true
+	MaxAge     time.Duration // Delete replicated files that are older than this. Zero = keep forever.
+	Interval   time.Duration // How often we look for new files
+
+	// In EventsOnly mode, we wait this long after a file is closed before deciding whether
+	// to skip it, so that events near the end of the file have time to reach the DB.
+	SettleTime time.Duration
+
+	// After OnEvent(), we close the stream's current file once it has recorded this much
+	// footage after the event, so that the event is replicated within a few minutes, instead
+	// of when the file reaches its maximum duration. Zero = never close files early.
+	EventCloseDelay time.Duration
+}
+
+func DefaultOptions() Options {
+	return Options{
+		Interval:        30 * time.Second,
+		SettleTime:      2 * time.Minute,
+		EventCloseDelay: time.Minute,
+	}
+}
+
+// SYNC-REPLICATION-STATUS-JSON
+type Status struct {
+	ReplicatedFiles int64       `json:"replicatedFiles"` // Number of files on the target
+	ReplicatedBytes int64       `json:"replicatedBytes"` // Total size of files on the target
+	BacklogFiles    int         `json:"backlogFiles"`    // Number of files waiting to be replicated
+	BacklogBytes    int64       `json:"backlogBytes"`    // Total size of files waiting to be replicated
+	LastReplicated  dbh.IntTime `json:"lastReplicated"`  // Time when we last finished replicating a file
+	LastError       string      `json:"lastError"`       // Most recent error, which is cleared after a successful pass
+	LastErrorTime   dbh.IntTime `json:"lastErrorTime"`
+}
+
+// Replicator copies closed video files from the fsv archive to a secondary target,
+// so that recordings survive if the system is stolen or its disk fails.
+//
+// We replicate the newest files first. If the target was unreachable for a while,
+// the most valuable footage is the most recent (eg the burglar who is busy
+// carrying the system out the door), so that goes to the front of the queue.
+//
+// The file that is currently being recorded is never replicated, because it is
+// still growing. With rf1, files are closed at least every 1000 seconds, which is too
+// late for the footage of a burglary. So when something happens on a camera, we close
+// its current file soon after (see OnEvent).
+type Replicator struct {
+	log     logs.Log
+	db      *gorm.DB
+	archive *fsv.Archive
+	target  Target
+	options Options
+	cancel  context.CancelFunc
+	stopped chan bool
+
+	statusLock sync.Mutex
+	status     Status
+
+	closeLock sync.Mutex
+	closeAt   map[string]time.Time // Streams whose current file must be closed, and when
+}
+
+// Create a replicator and start its background thread.
+// dbFilename is the sqlite database where we store our checkpoints.
+func NewReplicator(logger logs.Log, dbFilename string, archive *fsv.Archive, target Target, options Options) (*Replicator, error) {
+	r, err := newReplicator(logger, dbFilename, archive, target, options)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	go r.run(ctx)
+	return r, nil
+}
+
+func newReplicator(logger logs.Log, dbFilename string, archive *fsv.Archive, target Target, options Options) (*Replicator, error) {
+	if options.EventsOnly && options.HasEvents == nil {
+		return nil, fmt.Errorf("EventsOnly replication requires an event filter")
+	}
+	if options.Interval <= 0 {
+		options.Interval = DefaultOptions().Interval
+	}
+	logger = logs.NewPrefixLogger(logger, "Replication:")
+	db, err := dbh.OpenDB(logger, dbh.MakeSqliteConfig(dbFilename), Migrations(logger), dbh.DBConnectFlagSqliteWAL)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open replication database %v: %w", dbFilename, err)
+	}
+	return &Replicator{
+		log:     logger,
+		db:      db,
+		archive: archive,
+		target:  target,
+		options: options,
+		stopped: make(chan bool),
+		closeAt: map[string]time.Time{},
+	}, nil
+}
+
+// Tell the replicator that an event occurred on a stream at the given time.
+// The stream's current file is closed EventCloseDelay later, and replicated on the next pass.
+// If the stream is busy, we close a file every EventCloseDelay, rather than after every event.
+func (r *Replicator) OnEvent(stream string, at time.Time) {
+	if r.options.EventCloseDelay == 0 {
+		return
+	}
+	r.closeLock.Lock()
+	defer r.closeLock.Unlock()
+	if _, ok := r.closeAt[stream]; !ok {
+		r.closeAt[stream] = at.Add(r.options.EventCloseDelay)
+	}
+}
+
+// Close the current files of streams that had events
+func (r *Replicator) closeEventFiles(now time.Time) {
+	due := []string{}
+	r.closeLock.Lock()
+	for stream, at := range r.closeAt {
+		if !at.After(now) {
+			due = append(due, stream)
+			delete(r.closeAt, stream)
+		}
+	}
+	r.closeLock.Unlock()
+	for _, stream := range due {
+		if err := r.archive.CloseCurrentFile(stream); err != nil {
+			r.log.Errorf("Failed to close current file of %v: %v", stream, err)
+		}
+	}
+}
+
+// Stop replication. An upload that is in progress is aborted, and will be restarted
+// from the beginning of that file when we next start.
+func (r *Replicator) Close() {
+	if r.cancel != nil {
+		r.cancel()
+		<-r.stopped
+	}
+	r.target.Close()
+	if sqlDB, err := r.db.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
+
+func (r *Replicator) Status() Status {
+	r.statusLock.Lock()
+	status := r.status
+	r.statusLock.Unlock()
+
+	totals := struct {
+		Count int64
+		Size  int64
+	}{}
+	r.db.Raw("SELECT COUNT(*) AS count, COALESCE(SUM(size), 0) AS size FROM file WHERE state = ?", FileStateDone).Scan(&totals)
+	status.ReplicatedFiles = totals.Count
+	status.ReplicatedBytes = totals.Size
+	return status
+}
+
+func (r *Replicator) run(ctx context.Context) {
+	defer close(r.stopped)
+	r.log.Infof("Starting")
+	for {
+		err := r.pass(ctx, time.Now())
+		r.setError(err)
+		select {
+		case <-ctx.Done():
+			r.log.Infof("Stopped")
+			return
+		case <-time.After(r.options.Interval):
+		}
+	}
+}
+
+// Record the outcome of a pass. We only log an error when it changes, so that
+// an unreachable target doesn't flood the log.
+func (r *Replicator) setError(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	r.statusLock.Lock()
+	defer r.statusLock.Unlock()
+	if err == nil {
+		if r.status.LastError != "" {
+			r.log.Infof("Replication has recovered")
+		}
+		r.status.LastError = ""
+		return
+	}
+	if err.Error() != r.status.LastError {
+		r.log.Errorf("%v", err)
+	}
+	r.status.LastError = err.Error()
+	r.status.LastErrorTime = dbh.MakeIntTime(time.Now())
+}
+
+// Apply retention, and then replicate all pending files
+func (r *Replicator) pass(ctx context.Context, now time.Time) error {
+	if err := r.applyRetention(ctx, now); err != nil {
+		return err
+	}
+	r.closeEventFiles(now)
+	pending, err := r.findPending(now)
+	if err != nil {
+		return err
+	}
+
+	backlog := int64(0)
+	for _, f := range pending {
+		backlog += f.Size
+	}
+	r.statusLock.Lock()
+	r.status.BacklogFiles = len(pending)
+	r.status.BacklogBytes = backlog
+	r.statusLock.Unlock()
+
+	for _, f := range pending {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		done, err := r.replicateFile(ctx, &f, now)
+		if err != nil {
+			return fmt.Errorf("Failed to replicate %v/%v: %w", f.Stream, f.Name, err)
+		}
+		if done {
+			r.statusLock.Lock()
+			r.status.BacklogFiles--
+			r.status.BacklogBytes -= f.Size
+			r.statusLock.Unlock()
+		}
+	}
+	return nil
+}
+
+// Return the files that have not been replicated yet, newest first
+func (r *Replicator) findPending(now time.Time) ([]fsv.FileInfo, error) {
+	cutoff := time.Time{}
+	if r.options.MaxAge != 0 {
+		cutoff = now.Add(-r.options.MaxAge)
+	}
+	pending := []fsv.FileInfo{}
+	for _, stream := range r.archive.ListStreams() {
+		// We identify files by their start time, and not their name, because thinning
+		// replaces a file with a copy of a different name (see fsv/thin.go). The copy
+		// has less information than the file we've already uploaded, so we ignore it.
+		startTimes := []int64{}
+		if err := r.db.Model(&File{}).Where("stream = ?", stream.Name).Pluck("start_time", &startTimes).Error; err != nil {
+			return nil, err
+		}
+		seen := map[int64]bool{}
+		for _, t := range startTimes {
+			seen[t] = true
+		}
+		for _, f := range r.archive.ListFiles(stream.Name) {
+			// Don't upload files that the target's retention would delete immediately
+			if seen[f.StartTime.UnixMilli()] || f.EndTime.Before(cutoff) {
+				continue
+			}
+			pending = append(pending, f)
+		}
+
+		// Checkpoints of skipped files can be forgotten once the sweeper has deleted the
+		// local file, because we'll never see that file again.
+		// The checkpoints of replicated files are kept until we delete the remote copy.
+		if err := r.db.Where("stream = ? AND state = ? AND start_time < ?", stream.Name, FileStateSkipped, stream.StartTime.UnixMilli()).Delete(&File{}).Error; err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].StartTime.After(pending[j].StartTime)
+	})
+	return pending, nil
+}
+
+// Copy a single logical video file to the target.
+// Returns false if we didn't reach a decision about the file yet.
+func (r *Replicator) replicateFile(ctx context.Context, f *fsv.FileInfo, now time.Time) (bool, error) {
+	record := File{
+		Stream:    f.Stream,
+		Name:      f.Name,
+		StartTime: dbh.MakeIntTime(f.StartTime),
+		EndTime:   dbh.MakeIntTime(f.EndTime),
+		Size:      f.Size,
+		State:     FileStateDone,
+	}
+
+	if r.options.EventsOnly {
+		// If there are events, then we can upload immediately. Otherwise, we wait
+		// in case events near the end of the file haven't reached the DB yet.
+		hasEvents, err := r.options.HasEvents(f.Stream, f.StartTime, f.EndTime)
+		if err != nil {
+			return false, err
+		}
+		if !hasEvents && now.Sub(f.EndTime) < r.options.SettleTime {
+			return false, nil
+		}
+		if !hasEvents {
+			record.State = FileStateSkipped
+			record.ReplicatedAt = dbh.MakeIntTime(time.Now())
+			return true, r.db.Create(&record).Error
+		}
+	}
+
+	remote := []string{}
+	for _, physical := range f.Files {
+		name := f.Stream + "/" + filepath.Base(physical)
+		if err := r.putFile(ctx, physical, name); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				// The sweeper deleted the file, or the mover moved it to another volume.
+				// In the latter case, we'll find it again on the next pass.
+				return false, nil
+			}
+			return false, err
+		}
+		remote = append(remote, name)
+	}
+	record.RemoteFiles = dbh.MakeJSONField(remote)
+	record.ReplicatedAt = dbh.MakeIntTime(time.Now())
+	if err := r.db.Create(&record).Error; err != nil {
+		return false, err
+	}
+	r.statusLock.Lock()
+	r.status.LastReplicated = record.ReplicatedAt
+	r.statusLock.Unlock()
+	return true, nil
+}
+
+func (r *Replicator) putFile(ctx context.Context, physical, name string) error {
+	f, err := os.Open(physical)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return r.target.Put(ctx, name, f, st.Size())
+}
+
+// Delete replicated files whose footage is entirely older than MaxAge
+func (r *Replicator) applyRetention(ctx context.Context, now time.Time) error {
+	if r.options.MaxAge == 0 {
+		return nil
+	}
+	cutoff := now.Add(-r.options.MaxAge)
+	expired := []File{}
+	if err := r.db.Where("end_time < ?", cutoff.UnixMilli()).Order("end_time").Find(&expired).Error; err != nil {
+		return err
+	}
+	for _, f := range expired {
+		if f.RemoteFiles != nil {
+			// Delete in reverse order, so that the index goes before the packets
+			for i := len(f.RemoteFiles.Data) - 1; i >= 0; i-- {
+				if err := r.target.Delete(ctx, f.RemoteFiles.Data[i]); err != nil {
+					return fmt.Errorf("Failed to delete expired file %v: %w", f.RemoteFiles.Data[i], err)
+				}
+			}
+		}
+		if err := r.db.Where("stream = ? AND name = ?", f.Stream, f.Name).Delete(&File{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
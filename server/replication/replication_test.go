@@ -0,0 +1,324 @@
+package replication
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/fsv"
+	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/logs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// Wraps a target, so that we can count uploads, and simulate failures
+type testTarget struct {
+	Target
+	puts    int
+	deletes int
+	failAt  int // Fail on this Put (1-based). Zero = never fail.
+}
+
+func (t *testTarget) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	t.puts++
+	if t.puts == t.failAt {
+		return errors.New("Simulated network failure")
+	}
+	return t.Target.Put(ctx, name, r, size)
+}
+
+func (t *testTarget) Delete(ctx context.Context, name string) error {
+	t.deletes++
+	return t.Target.Delete(ctx, name)
+}
+
+// Create an archive with 'nFiles' closed files in each stream, starting at 'base',
+// and return it re-opened, so that none of the files are busy being written.
+func createTestArchive(t *testing.T, dir string, streams []string, base time.Time, nFiles int) *fsv.Archive {
+	settings := fsv.DefaultStaticSettings()
+	settings.MaxWriteBufferSize = 0
+	formats := []fsv.VideoFormat{&fsv.VideoFormatRF1{}}
+	require.NoError(t, os.MkdirAll(dir, 0770))
+	arc, err := fsv.Open(logs.NewTestingLog(t), dir, formats, settings, fsv.DefaultDynamicSettings())
+	require.NoError(t, err)
+	primes := []int{3, 5, 7, 11, 13, 17}
+	for _, stream := range streams {
+		for i := 0; i < nFiles; i++ {
+			start := base.Add(time.Duration(i) * 1000 * time.Second)
+			nalus := []fsv.NALU{}
+			for _, n := range rf1.CreateTestNALUs(start, 0, 50, 10, 100, 200, primes[i]) {
+				nalus = append(nalus, fsv.NALU{PTS: n.PTS, Flags: fsv.NALUFlags(n.Flags), Payload: n.Payload})
+			}
+			payload := fsv.MakeVideoPayload(rf1.CodecH264, 320, 240, nalus)
+			require.NoError(t, arc.Write(stream, map[string]fsv.TrackPayload{"video": payload}))
+		}
+	}
+	arc.Close()
+	arc, err = fsv.Open(logs.NewTestingLog(t), dir, formats, settings, fsv.DefaultDynamicSettings())
+	require.NoError(t, err)
+	return arc
+}
+
+func newTestReplicator(t *testing.T, dir string, arc *fsv.Archive, target Target, options Options) *Replicator {
+	r, err := newReplicator(logs.NewTestingLog(t), filepath.Join(dir, "replication.sqlite"), arc, target, options)
+	require.NoError(t, err)
+	return r
+}
+
+func TestReplicateLocal(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	streams := []string{"cam-1-LD", "cam-1-HD"}
+	arc := createTestArchive(t, filepath.Join(dir, "fsv"), streams, now.Add(-10*time.Hour), 3)
+	defer arc.Close()
+
+	local, err := NewLocalTarget(filepath.Join(dir, "remote"))
+	require.NoError(t, err)
+
+	// The connection drops during the third upload
+	target := &testTarget{Target: local, failAt: 3}
+	r := newTestReplicator(t, dir, arc, target, DefaultOptions())
+	require.Error(t, r.pass(context.Background(), now))
+	require.Equal(t, int64(1), r.Status().ReplicatedFiles)
+	r.Close()
+
+	// Resume after a restart. Only the remaining files are uploaded.
+	target = &testTarget{Target: local}
+	r = newTestReplicator(t, dir, arc, target, DefaultOptions())
+	require.NoError(t, r.pass(context.Background(), now))
+	require.Equal(t, (6-1)*2, target.puts)
+	status := r.Status()
+	require.Equal(t, int64(6), status.ReplicatedFiles)
+	require.Equal(t, 0, status.BacklogFiles)
+
+	// Nothing more to do
+	require.NoError(t, r.pass(context.Background(), now))
+	require.Equal(t, (6-1)*2, target.puts)
+	r.Close()
+
+	// The replica is a valid archive
+	for _, stream := range streams {
+		for _, f := range arc.ListFiles(stream) {
+			for _, physical := range f.Files {
+				local, err := os.ReadFile(physical)
+				require.NoError(t, err)
+				remote, err := os.ReadFile(filepath.Join(dir, "remote", stream, filepath.Base(physical)))
+				require.NoError(t, err)
+				require.Equal(t, local, remote)
+			}
+		}
+	}
+	replica, err := fsv.Open(logs.NewTestingLog(t), filepath.Join(dir, "remote"), []fsv.VideoFormat{&fsv.VideoFormatRF1{}}, fsv.DefaultStaticSettings(), fsv.DefaultDynamicSettings())
+	require.NoError(t, err)
+	defer replica.Close()
+	require.Len(t, replica.ListStreams(), 2)
+}
+
+func TestReplicateEventsOnly(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	base := now.Add(-10 * time.Hour)
+	arc := createTestArchive(t, filepath.Join(dir, "fsv"), []string{"cam-1-HD"}, base, 3)
+	defer arc.Close()
+
+	local, err := NewLocalTarget(filepath.Join(dir, "remote"))
+	require.NoError(t, err)
+	target := &testTarget{Target: local}
+
+	// There was an event during the second file
+	eventTime := base.Add(1500 * time.Second)
+	options := DefaultOptions()
+	options.EventsOnly = true
+	options.HasEvents = func(stream string, start, end time.Time) (bool, error) {
+		return !eventTime.Before(start) && eventTime.Before(end), nil
+	}
+	r := newTestReplicator(t, dir, arc, target, options)
+	defer r.Close()
+	require.NoError(t, r.pass(context.Background(), now))
+	require.Equal(t, 2, target.puts)
+	require.Equal(t, int64(1), r.Status().ReplicatedFiles)
+
+	skipped := int64(0)
+	r.db.Model(&File{}).Where("state = ?", FileStateSkipped).Count(&skipped)
+	require.Equal(t, int64(2), skipped)
+
+	files := arc.ListFiles("cam-1-HD")
+	require.FileExists(t, filepath.Join(dir, "remote", "cam-1-HD", filepath.Base(files[1].Files[0])))
+	require.NoFileExists(t, filepath.Join(dir, "remote", "cam-1-HD", filepath.Base(files[0].Files[0])))
+
+	// Skipped files are not reconsidered
+	require.NoError(t, r.pass(context.Background(), now))
+	require.Equal(t, 2, target.puts)
+}
+
+func TestReplicateRetention(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	arc := createTestArchive(t, filepath.Join(dir, "fsv"), []string{"cam-1-HD"}, now.Add(-10*time.Hour), 3)
+	defer arc.Close()
+
+	local, err := NewLocalTarget(filepath.Join(dir, "remote"))
+	require.NoError(t, err)
+	target := &testTarget{Target: local}
+	options := DefaultOptions()
+	options.MaxAge = 11 * time.Hour
+	r := newTestReplicator(t, dir, arc, target, options)
+	defer r.Close()
+	require.NoError(t, r.pass(context.Background(), now))
+	require.Equal(t, int64(3), r.Status().ReplicatedFiles)
+
+	// An hour later, the first file has expired on the target (it ends at base + 1000 seconds)
+	require.NoError(t, r.pass(context.Background(), now.Add(time.Hour+1001*time.Second)))
+	require.Equal(t, int64(2), r.Status().ReplicatedFiles)
+	require.Equal(t, 2, target.deletes)
+	first := arc.ListFiles("cam-1-HD")[0]
+	require.NoFileExists(t, filepath.Join(dir, "remote", "cam-1-HD", filepath.Base(first.Files[0])))
+
+	// The local copy still exists, but we must not upload it again
+	require.Equal(t, 6, target.puts)
+}
+
+func TestReplicateAfterEvent(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	arc := createTestArchive(t, filepath.Join(dir, "fsv"), []string{"cam-1-HD"}, now.Add(-10*time.Hour), 1)
+	defer arc.Close()
+
+	// Start recording a new file
+	nalus := []fsv.NALU{}
+	for _, n := range rf1.CreateTestNALUs(now.Add(-time.Minute), 0, 50, 10, 100, 200, 3) {
+		nalus = append(nalus, fsv.NALU{PTS: n.PTS, Flags: fsv.NALUFlags(n.Flags), Payload: n.Payload})
+	}
+	require.NoError(t, arc.Write("cam-1-HD", map[string]fsv.TrackPayload{"video": fsv.MakeVideoPayload(rf1.CodecH264, 320, 240, nalus)}))
+
+	local, err := NewLocalTarget(filepath.Join(dir, "remote"))
+	require.NoError(t, err)
+	target := &testTarget{Target: local}
+	r := newTestReplicator(t, dir, arc, target, DefaultOptions())
+	defer r.Close()
+	require.NoError(t, r.pass(context.Background(), now))
+	require.Equal(t, int64(1), r.Status().ReplicatedFiles)
+
+	// The file being recorded is closed a little while after the event, and then replicated
+	r.OnEvent("cam-1-HD", now)
+	r.OnEvent("cam-1-HD", now.Add(10*time.Second))
+	require.NoError(t, r.pass(context.Background(), now.Add(30*time.Second)))
+	require.Equal(t, int64(1), r.Status().ReplicatedFiles)
+	require.NoError(t, r.pass(context.Background(), now.Add(DefaultOptions().EventCloseDelay)))
+	require.Equal(t, int64(2), r.Status().ReplicatedFiles)
+	require.Len(t, arc.ListFiles("cam-1-HD"), 2)
+}
+
+func TestReplicateThinned(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	arc := createTestArchive(t, filepath.Join(dir, "fsv"), []string{"cam-1-HD"}, now.Add(-10*time.Hour), 3)
+
+	local, err := NewLocalTarget(filepath.Join(dir, "remote"))
+	require.NoError(t, err)
+	target := &testTarget{Target: local}
+	r := newTestReplicator(t, dir, arc, target, DefaultOptions())
+	defer r.Close()
+	require.NoError(t, r.pass(context.Background(), now))
+	require.Equal(t, 6, target.puts)
+
+	// Thinning replaces the first file with a keyframe-only copy, under a new name
+	first := arc.ListFiles("cam-1-HD")[0]
+	arc.Close()
+	for _, physical := range first.Files {
+		base := filepath.Base(physical)
+		require.NoError(t, os.Rename(physical, filepath.Join(filepath.Dir(physical), first.Name+".kf"+base[len(first.Name):])))
+	}
+	arc, err = fsv.Open(logs.NewTestingLog(t), filepath.Join(dir, "fsv"), []fsv.VideoFormat{&fsv.VideoFormatRF1{}}, fsv.DefaultStaticSettings(), fsv.DefaultDynamicSettings())
+	require.NoError(t, err)
+	defer arc.Close()
+	require.Equal(t, first.Name+".kf", arc.ListFiles("cam-1-HD")[0].Name)
+
+	// The thinned copy is not uploaded
+	r.archive = arc
+	require.NoError(t, r.pass(context.Background(), now))
+	require.Equal(t, 6, target.puts)
+}
+
+func TestSFTPHostKeyPinning(t *testing.T) {
+	newKey := func() ssh.PublicKey {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		key, err := ssh.NewPublicKey(pub)
+		require.NoError(t, err)
+		return key
+	}
+	serverKey := newKey()
+	imposterKey := newKey()
+	cfg := &configdb.ReplicationJSON{Enabled: true, Type: configdb.ReplicationTargetSFTP, Host: "backup.lan", Username: "cyclops", Password: "secret"}
+
+	// No key is configured, so we trust and save the first key that we see
+	saved := ""
+	target, err := NewSFTPTarget(logs.NewTestingLog(t), cfg, func(hostKey string) error {
+		saved = hostKey
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, target.checkHostKey("backup.lan:22", nil, serverKey))
+	require.NoError(t, target.checkHostKey("backup.lan:22", nil, serverKey))
+	require.Error(t, target.checkHostKey("backup.lan:22", nil, imposterKey))
+
+	// After a restart, the saved key is enforced
+	cfg.HostKey = saved
+	target, err = NewSFTPTarget(logs.NewTestingLog(t), cfg, func(hostKey string) error {
+		t.Fatal("The host key is already configured")
+		return nil
+	})
+	require.NoError(t, err)
+	require.Error(t, target.checkHostKey("backup.lan:22", nil, imposterKey))
+	require.NoError(t, target.checkHostKey("backup.lan:22", nil, serverKey))
+}
+
+// Run this against a local MinIO server, for example:
+// docker run -p 9000:9000 -e MINIO_ROOT_USER=minio -e MINIO_ROOT_PASSWORD=minio123 minio/minio server /data
+// mc mb local/cyclops
+// CYCLOPS_TEST_S3=localhost:9000 CYCLOPS_TEST_S3_BUCKET=cyclops go test -run TestReplicateS3
+func TestReplicateS3(t *testing.T) {
+	endpoint := os.Getenv("CYCLOPS_TEST_S3")
+	if endpoint == "" {
+		t.Skip("CYCLOPS_TEST_S3 is not set")
+	}
+	cfg := &configdb.ReplicationJSON{
+		Enabled:    true,
+		Type:       configdb.ReplicationTargetS3,
+		Host:       endpoint,
+		Bucket:     os.Getenv("CYCLOPS_TEST_S3_BUCKET"),
+		Username:   os.Getenv("MINIO_ROOT_USER"),
+		Password:   os.Getenv("MINIO_ROOT_PASSWORD"),
+		Path:       "test-replication",
+		DisableTLS: true,
+	}
+	if cfg.Username == "" {
+		cfg.Username = "minio"
+		cfg.Password = "minio123"
+	}
+	require.NoError(t, configdb.ValidateReplicationConfig(cfg))
+
+	dir := t.TempDir()
+	now := time.Now()
+	arc := createTestArchive(t, filepath.Join(dir, "fsv"), []string{"cam-1-HD"}, now.Add(-10*time.Hour), 2)
+	defer arc.Close()
+	target, err := NewTarget(logs.NewTestingLog(t), cfg, nil)
+	require.NoError(t, err)
+	options := DefaultOptions()
+	options.MaxAge = 11 * time.Hour
+	r := newTestReplicator(t, dir, arc, target, options)
+	defer r.Close()
+	require.NoError(t, r.pass(context.Background(), now))
+	require.Equal(t, int64(2), r.Status().ReplicatedFiles)
+	require.NoError(t, r.pass(context.Background(), now.Add(24*time.Hour)))
+	require.Equal(t, int64(0), r.Status().ReplicatedFiles)
+}
@@ -0,0 +1,51 @@
+package replication
+
+import (
+	"context"
+	"io"
+	"path"
+
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Target replicates to an S3-compatible bucket.
+// S3 uploads are atomic, so we don't need temporary names here.
+type S3Target struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Target(cfg *configdb.ReplicationJSON) (*S3Target, error) {
+	client, err := minio.New(cfg.Host, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.Username, cfg.Password, ""),
+		Secure: !cfg.DisableTLS,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3Target{
+		client: client,
+		bucket: cfg.Bucket,
+		prefix: cfg.Path,
+	}, nil
+}
+
+func (t *S3Target) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	_, err := t.client.PutObject(ctx, t.bucket, path.Join(t.prefix, name), r, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+func (t *S3Target) Delete(ctx context.Context, name string) error {
+	// S3 doesn't complain if the object doesn't exist
+	return t.client.RemoveObject(ctx, t.bucket, path.Join(t.prefix, name), minio.RemoveObjectOptions{})
+}
+
+func (t *S3Target) Close() error {
+	return nil
+}
@@ -0,0 +1,198 @@
+package replication
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/logs"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// SFTPTarget replicates to a directory on an SFTP server.
+// We connect lazily, and reconnect after any error, so that a flaky
+// link doesn't require a restart.
+//
+// If the server's host key is not configured, then we trust the key that the server
+// presents on our first connection, and refuse any other key after that (trust on first use).
+type SFTPTarget struct {
+	log        logs.Log
+	root       string
+	host       string
+	sshConfig  *ssh.ClientConfig
+	pinHostKey HostKeyPinner
+
+	lock      sync.Mutex
+	conn      *ssh.Client
+	client    *sftp.Client
+	pinnedKey ssh.PublicKey // The server's host key. Nil until we first connect, if the key was not configured.
+}
+
+// HostKeyPinner saves the host key (in authorized_keys format) that an SFTP server
+// presented on our first connection, so that the key is enforced after a restart.
+type HostKeyPinner func(hostKey string) error
+
+func NewSFTPTarget(log logs.Log, cfg *configdb.ReplicationJSON, pinHostKey HostKeyPinner) (*SFTPTarget, error) {
+	auth := []ssh.AuthMethod{}
+	if cfg.PrivateKey != "" {
+		signer, err := ssh.ParsePrivateKey([]byte(cfg.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SFTP private key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if cfg.Password != "" {
+		auth = append(auth, ssh.Password(cfg.Password))
+	}
+	host := cfg.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host += ":22"
+	}
+	t := &SFTPTarget{
+		log:        log,
+		root:       cfg.Path,
+		host:       host,
+		pinHostKey: pinHostKey,
+	}
+	if cfg.HostKey != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(cfg.HostKey))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid SFTP host key: %w", err)
+		}
+		t.pinnedKey = key
+	} else {
+		log.Warnf("SFTP host key of %v is not configured. We will trust the key that it presents on our first connection.", host)
+	}
+	t.sshConfig = &ssh.ClientConfig{
+		User:            cfg.Username,
+		Auth:            auth,
+		HostKeyCallback: t.checkHostKey,
+		Timeout:         15 * time.Second,
+	}
+	return t, nil
+}
+
+// Verify the server's host key, or pin it if this is our first connection.
+// This is called during ssh.Dial, so we're holding t.lock.
+func (t *SFTPTarget) checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if t.pinnedKey != nil {
+		if !bytes.Equal(key.Marshal(), t.pinnedKey.Marshal()) {
+			t.log.Errorf("SFTP server %v presented host key %v %v, which is not the key that we trust. Somebody may be intercepting the connection. If the server's key really changed, then update the host key in the replication settings.", hostname, key.Type(), ssh.FingerprintSHA256(key))
+			return fmt.Errorf("SFTP host key of %v does not match", hostname)
+		}
+		return nil
+	}
+	authorized := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if t.pinHostKey != nil {
+		if err := t.pinHostKey(authorized); err != nil {
+			return fmt.Errorf("Failed to save SFTP host key: %w", err)
+		}
+	}
+	t.pinnedKey = key
+	t.log.Warnf("Trusting SFTP host key %v %v of %v, because this is our first connection. Check that this is your server's key.", key.Type(), ssh.FingerprintSHA256(key), hostname)
+	return nil
+}
+
+// Returns the SFTP client, connecting if necessary.
+// You must be holding t.lock.
+func (t *SFTPTarget) connectHaveLock() (*sftp.Client, error) {
+	if t.client != nil {
+		return t.client, nil
+	}
+	conn, err := ssh.Dial("tcp", t.host, t.sshConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to SFTP server %v: %w", t.host, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to start SFTP session on %v: %w", t.host, err)
+	}
+	t.conn = conn
+	t.client = client
+	return client, nil
+}
+
+// Drop the connection, so that we reconnect on the next operation.
+// You must be holding t.lock.
+func (t *SFTPTarget) disconnectHaveLock() {
+	if t.client != nil {
+		t.client.Close()
+		t.conn.Close()
+		t.client = nil
+		t.conn = nil
+	}
+}
+
+func (t *SFTPTarget) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	client, err := t.connectHaveLock()
+	if err != nil {
+		return err
+	}
+	err = t.put(ctx, client, name, r)
+	if err != nil {
+		t.disconnectHaveLock()
+	}
+	return err
+}
+
+func (t *SFTPTarget) put(ctx context.Context, client *sftp.Client, name string, r io.Reader) error {
+	final := path.Join(t.root, name)
+	if err := client.MkdirAll(path.Dir(final)); err != nil {
+		return err
+	}
+	temp := final + partialSuffix
+	f, err := client.Create(temp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, &contextReader{ctx: ctx, r: r})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		client.Remove(temp)
+		return err
+	}
+	// PosixRename overwrites the destination, but it's an OpenSSH extension
+	if err := client.PosixRename(temp, final); err != nil {
+		client.Remove(final)
+		return client.Rename(temp, final)
+	}
+	return nil
+}
+
+func (t *SFTPTarget) Delete(ctx context.Context, name string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	client, err := t.connectHaveLock()
+	if err != nil {
+		return err
+	}
+	err = client.Remove(path.Join(t.root, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		t.disconnectHaveLock()
+	}
+	return err
+}
+
+func (t *SFTPTarget) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.disconnectHaveLock()
+	return nil
+}
@@ -0,0 +1,104 @@
+package replication
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/logs"
+)
+
+// Target is a destination for replicated files.
+// Names use forward slashes, for example "cam-1-HD/1712815946731_video.rf1i".
+type Target interface {
+	// Write the contents of r to the named file, replacing it if it already exists.
+	// A partially written file must not be visible under its final name.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+
+	// Delete the named file. Deleting a file that does not exist is not an error.
+	Delete(ctx context.Context, name string) error
+
+	Close() error
+}
+
+// Suffix of files that are being uploaded, for targets that don't support atomic writes
+const partialSuffix = ".partial"
+
+// Create a target from config.
+// pinHostKey saves the host key of an SFTP server on our first connection, if the key is not configured. It may be nil.
+func NewTarget(log logs.Log, cfg *configdb.ReplicationJSON, pinHostKey HostKeyPinner) (Target, error) {
+	switch cfg.Type {
+	case configdb.ReplicationTargetLocal:
+		return NewLocalTarget(cfg.Path)
+	case configdb.ReplicationTargetSFTP:
+		return NewSFTPTarget(log, cfg, pinHostKey)
+	case configdb.ReplicationTargetS3:
+		return NewS3Target(cfg)
+	}
+	return nil, fmt.Errorf("Unknown replication target type '%v'", cfg.Type)
+}
+
+// LocalTarget replicates to another directory, such as a mounted network share or USB disk
+type LocalTarget struct {
+	root string
+}
+
+func NewLocalTarget(root string) (*LocalTarget, error) {
+	if err := os.MkdirAll(root, 0770); err != nil {
+		return nil, err
+	}
+	return &LocalTarget{root: root}, nil
+}
+
+func (t *LocalTarget) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	final := filepath.Join(t.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(final), 0770); err != nil {
+		return err
+	}
+	temp := final + partialSuffix
+	f, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, &contextReader{ctx: ctx, r: r})
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, final)
+}
+
+func (t *LocalTarget) Delete(ctx context.Context, name string) error {
+	err := os.Remove(filepath.Join(t.root, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (t *LocalTarget) Close() error {
+	return nil
+}
+
+// contextReader aborts a long copy when the context is cancelled
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"syscall"
@@ -17,6 +18,8 @@ import (
 
 	"github.com/caddyserver/certmagic"
 	"github.com/cyclopcam/cyclops/pkg/kibi"
+	"github.com/cyclopcam/cyclops/pkg/nnload"
+	"github.com/cyclopcam/cyclops/pkg/nnremote"
 	"github.com/cyclopcam/cyclops/pkg/videoformat/fsv"
 	"github.com/cyclopcam/cyclops/pkg/videox"
 	"github.com/cyclopcam/cyclops/server/arc"
@@ -24,8 +27,13 @@ import (
 	"github.com/cyclopcam/cyclops/server/eventdb"
 	"github.com/cyclopcam/cyclops/server/livecameras"
 	"github.com/cyclopcam/cyclops/server/monitor"
+	"github.com/cyclopcam/cyclops/server/mosaic"
 	"github.com/cyclopcam/cyclops/server/notifications"
 	"github.com/cyclopcam/cyclops/server/perfstats"
+	"github.com/cyclopcam/cyclops/server/reanalysis"
+	"github.com/cyclopcam/cyclops/server/replication"
+	"github.com/cyclopcam/cyclops/server/streamer"
+	"github.com/cyclopcam/cyclops/server/transcoder"
 	"github.com/cyclopcam/cyclops/server/util"
 	"github.com/cyclopcam/cyclops/server/videodb"
 	"github.com/cyclopcam/cyclops/server/vpn"
@@ -60,10 +68,17 @@ type Server struct {
 	httpsServer            *http.Server
 	httpRouter             *httprouter.Router
 	configDB               *configdb.ConfigDB
-	videoDB                *videodb.VideoDB // Can be nil! If the video path is not accessible, then we can fail to create this.
-	eventDB                *eventdb.EventDB // High level events such as alarm activations, and armed state changes.
+	videoDB                *videodb.VideoDB        // Can be nil! If the video path is not accessible, then we can fail to create this.
+	eventDB                *eventdb.EventDB        // High level events such as alarm activations, and armed state changes.
+	replicator             *replication.Replicator // Nil if replication is not enabled
+	transcoders            *transcoder.Manager     // On-demand transcoding of live streams, for viewers with limited bandwidth
+	mosaics                *mosaic.Manager         // Server-composited grids of cameras
+	hls                    *streamer.HLSServer     // Live streams for players that can't use our websocket
+	rtspServer             *streamer.RTSPServer    // Nil unless RTSP is enabled
+	reanalysis             *reanalysis.Manager     // Nil if videoDB is nil
 	wsUpgrader             websocket.Upgrader
 	monitor                *monitor.Monitor
+	nnServer               *nnremote.Server   // Nil unless we run our NN models on behalf of other systems
 	seekFrameCache         *videox.FrameCache // Speeds up seeking
 	arcCredentialsLock     sync.Mutex
 	arcCredentials         *arc.ArcServerCredentials // If Arc server is not configured, then this is nil.
@@ -141,6 +156,14 @@ func NewServer(logger logs.Log, cfg *configdb.ConfigDB, serverFlags int, nnModel
 
 	s.ApplyConfig()
 
+	s.startTranscoders()
+
+	if s.videoDB != nil {
+		if err := s.startReplication(); err != nil {
+			logger.Errorf("Failed to start replication: %v", err)
+		}
+	}
+
 	// Start notification system, which sends realtime events to the cloud/LAN
 	notifier, err := notifications.NewNotifier(s.Log, s.configDB, s.eventDB, s.ShutdownContext)
 	if err != nil {
@@ -155,13 +178,26 @@ func NewServer(logger logs.Log, cfg *configdb.ConfigDB, serverFlags int, nnModel
 	if nnModelName != "" {
 		monitorOptions.ModelNameLQ = nnModelName
 		// Set HQ model automatically
-		if strings.HasPrefix(nnModelName, "yolov8") {
+		if dataset, _ := nnload.SplitModelName(nnModelName); dataset != nnload.DefaultDataset {
+			// A custom model has its own classes, so we can't validate it with one of our COCO models
+			monitorOptions.ModelNameHQ = nnModelName
+		} else if strings.HasPrefix(nnModelName, "yolov8") {
 			plus1 := map[rune]rune{'n': 's', 's': 'm', 'm': 'l', 'l': 'x'}
 			if hq, ok := plus1[rune(nnModelName[len(nnModelName)-1])]; ok {
 				monitorOptions.ModelNameHQ = nnModelName[:len(nnModelName)-1] + string(hq)
 			}
 		}
 	}
+	monitorOptions.Classes = s.configDB.GetConfig().Classes
+	monitorOptions.Tracker = string(s.configDB.GetConfig().Tracker)
+	monitorOptions.IsArmed = s.eventDB.IsArmed
+	if inference := s.configDB.GetConfig().Inference; inference != nil && inference.RemoteURL != "" {
+		monitorOptions.Remote = &nnremote.ClientOptions{
+			URL:     inference.RemoteURL,
+			Key:     inference.RemoteKey,
+			Timeout: time.Duration(inference.RemoteTimeoutMS) * time.Millisecond,
+		}
+	}
 	monitor, err := monitor.NewMonitor(s.Log, monitorOptions)
 	if err != nil {
 		return nil, err
@@ -169,14 +205,35 @@ func NewServer(logger logs.Log, cfg *configdb.ConfigDB, serverFlags int, nnModel
 	s.monitor = monitor
 
 	if s.videoDB != nil {
+		// Make room in the tiles for every class that the monitor can emit
+		s.videoDB.SetMaxClassesPerTile(len(monitor.AllClasses()))
 		s.attachMonitorToVideoDB()
 	} else {
 		close(s.monitorToVideoDBClosed)
 	}
 
+	if err := s.loadFalsePositives(); err != nil {
+		logger.Errorf("Failed to load false positives: %v", err)
+	}
+
+	if err := s.startNNServer(); err != nil {
+		logger.Errorf("Failed to start NN server: %v", err)
+	}
+
 	s.runAlarmHandler()
 
-	s.LiveCameras = livecameras.NewLiveCameras(s.Log, s.configDB, s.ShutdownStarted, s.monitor, fsvArchive, s.RingBufferSize)
+	s.LiveCameras = livecameras.NewLiveCameras(s.Log, s.configDB, s.ShutdownStarted, s.monitor, fsvArchive, s.videoDB, s.RingBufferSize)
+	s.mosaics = mosaic.NewManager(s.Log, s.LiveCameras, s.transcoders)
+	s.hls = streamer.NewHLSServer(s.Log)
+	if err := s.startRTSPServer(); err != nil {
+		logger.Errorf("Failed to start RTSP server: %v", err)
+	}
+	if s.videoDB != nil {
+		s.reanalysis, err = reanalysis.NewManager(s.Log, s.monitor, s.videoDB, s.LiveCameras.CameraFromID)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// Cameras start connecting here
 	s.LiveCameras.Run()
@@ -390,6 +447,13 @@ func (s *Server) Shutdown(restart bool) {
 
 	//s.Log.Infof("SHUTDOWN 3")
 
+	if s.nnServer != nil {
+		s.nnServer.Close()
+	}
+	// Re-analysis uses the monitor, so it must stop first
+	if s.reanalysis != nil {
+		s.reanalysis.Close()
+	}
 	s.monitor.Close()
 
 	//s.Log.Infof("SHUTDOWN 4")
@@ -421,6 +485,21 @@ func (s *Server) Shutdown(restart bool) {
 	s.Log.Infof("Waiting for cameras to close")
 	<-s.LiveCameras.ShutdownComplete
 
+	s.Log.Infof("Stopping HLS and RTSP streams")
+	s.hls.Close()
+	if s.rtspServer != nil {
+		s.rtspServer.Close()
+	}
+
+	s.Log.Infof("Stopping transcoders and mosaics")
+	s.transcoders.Close()
+	s.mosaics.Close()
+
+	if s.replicator != nil {
+		s.Log.Infof("Stopping replication")
+		s.replicator.Close()
+	}
+
 	s.Log.Infof("Shutting down video archive")
 	if s.videoDB != nil {
 		s.videoDB.Close()
@@ -466,6 +545,8 @@ func (s *Server) ApplyConfig() {
 			s.Log.Infof("Max archive storage size is %v bytes (%v)", maxStorage, cfg.Recording.MaxStorageSize)
 		}
 		s.videoDB.SetMaxArchiveSize(maxStorage)
+		maxHeld, _ := kibi.ParseBytes(cfg.Recording.MaxHeldStorageSize)
+		s.videoDB.SetMaxHeldSize(maxHeld)
 	}
 
 	if s.LiveCameras != nil {
@@ -478,7 +559,30 @@ func (s *Server) StartVideoDB() error {
 	if config.Recording.Path == "" {
 		return errors.New("Video archive path is not configured")
 	}
-	v, err := videodb.NewVideoDB(s.Log, config.Recording.Path)
+	tiers := []videodb.StorageTier{}
+	for _, tier := range config.Recording.Tiers {
+		tiers = append(tiers, videodb.StorageTier{
+			Path:   tier.Path,
+			MinAge: time.Duration(tier.MinAgeHours) * time.Hour,
+		})
+	}
+	// We load the keys even if encryption is disabled, so that we can read old recordings
+	keys, err := configdb.GetVideoKeys(s.configDB.DB, config.Recording.Encrypt)
+	if err != nil {
+		return fmt.Errorf("Failed to read video encryption keys: %w", err)
+	}
+	keyring, err := keys.Keyring()
+	if err != nil {
+		return fmt.Errorf("Invalid video encryption key: %w", err)
+	}
+	if keys.Previous != nil {
+		s.Log.Warnf("A video re-key was interrupted. Run rf1rekey to finish it.")
+	}
+	encryption := videodb.Encryption{
+		Keys:    keyring,
+		Encrypt: config.Recording.Encrypt,
+	}
+	v, err := videodb.NewVideoDB(s.Log, config.Recording.Path, tiers, string(config.Recording.Format), encryption)
 	if err != nil {
 		return err
 	}
@@ -486,6 +590,86 @@ func (s *Server) StartVideoDB() error {
 	return nil
 }
 
+// Create the transcoding manager. Transcoders are only started when a viewer asks for one.
+func (s *Server) startTranscoders() {
+	config := s.configDB.GetConfig()
+	maxCPU := 1.0
+	if config.Transcoding != nil && config.Transcoding.MaxCPU != 0 {
+		maxCPU = config.Transcoding.MaxCPU
+	}
+	s.transcoders = transcoder.NewManager(s.Log, maxCPU, transcoder.MergeProfiles(config.Transcoding))
+}
+
+// Serve mosaics over RTSP, if configured
+func (s *Server) startRTSPServer() error {
+	config := s.configDB.GetConfig()
+	if config.RTSPPort == 0 {
+		return nil
+	}
+	rtspServer, err := streamer.StartRTSPServer(s.Log, config.RTSPPort, s.authorizeRTSP)
+	if err != nil {
+		return err
+	}
+	s.rtspServer = rtspServer
+	return nil
+}
+
+// Serve our NN models to other systems, if configured
+func (s *Server) startNNServer() error {
+	config := s.configDB.GetConfig()
+	if config.Inference == nil || !config.Inference.Serve {
+		return nil
+	}
+	options := nnremote.ServerOptions{
+		Key: config.Inference.ServeKey,
+	}
+	if nnload.HaveAccelerator() {
+		// Accelerators are much faster with large batches, so we give requests from
+		// different cameras a moment to accumulate.
+		options.MaxBatch = 8
+		options.BatchWindow = 10 * time.Millisecond
+		options.Workers = 1
+	} else {
+		options.MaxBatch = 1
+		options.Workers = max(runtime.NumCPU()/2, 1)
+	}
+	nnServer, err := nnremote.NewServer(s.Log, options)
+	if err != nil {
+		return err
+	}
+	for name, detector := range s.monitor.Detectors() {
+		nnServer.AddModel(name, detector)
+	}
+	s.nnServer = nnServer
+	return nil
+}
+
+// Start replicating the video archive to a secondary target, if configured
+func (s *Server) startReplication() error {
+	config := s.configDB.GetConfig()
+	if config.Replication == nil || !config.Replication.Enabled {
+		return nil
+	}
+	target, err := replication.NewTarget(s.Log, config.Replication, s.configDB.PinReplicationHostKey)
+	if err != nil {
+		return err
+	}
+	options := replication.DefaultOptions()
+	options.MaxAge = time.Duration(config.Replication.MaxAgeDays) * 24 * time.Hour
+	if config.Replication.EventsOnly {
+		options.EventsOnly = true
+		options.HasEvents = s.videoDB.StreamHasEvents
+	}
+	dbFilename := filepath.Join(config.Recording.Path, "replication.sqlite")
+	r, err := replication.NewReplicator(s.Log, dbFilename, s.videoDB.Archive, target, options)
+	if err != nil {
+		target.Close()
+		return err
+	}
+	s.replicator = r
+	return nil
+}
+
 func (s *Server) loadLANIPs() {
 	// Query the OS for our LAN IP addresses.
 	addrs, err := net.InterfaceAddrs()
@@ -0,0 +1,363 @@
+package streamer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videox"
+	"github.com/cyclopcam/cyclops/server/camera"
+	"github.com/cyclopcam/logs"
+)
+
+// HLS serves live streams to players that can't speak our websocket protocol, such as
+// smart TVs and VLC. A source is only segmented while somebody is fetching its playlist,
+// and the segmenter is shared by everybody watching the same source.
+// Segments are kept in memory, and they are cut at keyframes, so a segment is at least
+// hlsTargetSegmentDuration long, or one keyframe interval, whichever is longer.
+// If the source stream carries AAC audio, then it is muxed into the segments. MPEG-TS can't
+// carry G.711, so G.711 audio is dropped.
+
+const (
+	hlsTargetSegmentDuration = 2 * time.Second
+	hlsMaxSegments           = 6                // Number of segments in the playlist
+	hlsIdleTimeout           = 30 * time.Second // Stop segmenting a source if nobody has fetched anything for this long
+	hlsFirstSegmentTimeout   = 15 * time.Second // How long a playlist request waits for the first segment
+)
+
+var ErrHLSNotReady = errors.New("HLS stream is not ready yet")
+var ErrHLSSegmentNotFound = errors.New("HLS segment not found")
+
+// HLSServer owns the HLS segmenters of all sources
+type HLSServer struct {
+	log logs.Log
+
+	lock     sync.Mutex
+	muxers   map[string]*hlsMuxer // Key is the source path (eg "mosaic/3")
+	stop     chan bool
+	stopOnce sync.Once
+}
+
+type hlsSegment struct {
+	sequence int64
+	duration time.Duration
+	data     []byte
+}
+
+type hlsMuxer struct {
+	log      logs.Log
+	source   *Source
+	incoming camera.StreamSinkChan
+	stop     chan bool
+	stopOnce sync.Once
+	done     chan bool // Closed when the muxer has finished cleaning up
+	ready    chan bool // Closed when the first segment is complete
+
+	lock       sync.Mutex
+	segments   []hlsSegment
+	lastAccess time.Time
+
+	// These are only accessed by the run thread
+	encoder      *videox.MPGTSEncoder
+	hasAudio     bool         // True if the encoder has an AAC stream
+	current      bytes.Buffer // The segment that we're busy writing
+	segmentStart time.Duration
+	nextSequence int64
+	lastRecvID   int64
+	refPTS       time.Duration // PTS of the most recent video packet
+	refWallPTS   time.Time     // Wall time of the most recent video packet. Audio is placed relative to this.
+}
+
+func NewHLSServer(log logs.Log) *HLSServer {
+	h := &HLSServer{
+		log:    log,
+		muxers: map[string]*hlsMuxer{},
+		stop:   make(chan bool),
+	}
+	go h.janitor()
+	return h
+}
+
+// Return the playlist of the source at path, starting the segmenter if necessary.
+// If the segmenter is new, then this waits for the first segment.
+// segmentQuery is appended to the segment URLs (eg "authorizationToken=..."), so that players
+// which can't send headers or cookies can still fetch the segments.
+func (h *HLSServer) Playlist(path string, open SourceOpener, segmentQuery string) ([]byte, error) {
+	m, err := h.getOrStart(path, open)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-m.ready:
+	case <-m.done:
+		return nil, ErrHLSNotReady
+	case <-time.After(hlsFirstSegmentTimeout):
+		return nil, ErrHLSNotReady
+	}
+	return m.playlist(segmentQuery), nil
+}
+
+// Return a segment of the source at path. The segmenter must already be running.
+func (h *HLSServer) Segment(path string, sequence int64) ([]byte, error) {
+	h.lock.Lock()
+	m := h.muxers[path]
+	h.lock.Unlock()
+	if m == nil {
+		return nil, ErrHLSSegmentNotFound
+	}
+	return m.segment(sequence)
+}
+
+// Stop all segmenters
+func (h *HLSServer) Close() {
+	h.stopOnce.Do(func() { close(h.stop) })
+	h.lock.Lock()
+	all := []*hlsMuxer{}
+	for _, m := range h.muxers {
+		all = append(all, m)
+	}
+	h.muxers = map[string]*hlsMuxer{}
+	h.lock.Unlock()
+
+	for _, m := range all {
+		m.stopAndWait()
+	}
+}
+
+func (h *HLSServer) getOrStart(path string, open SourceOpener) (*hlsMuxer, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if m := h.muxers[path]; m != nil && !m.isStopped() {
+		m.touch()
+		return m, nil
+	}
+	source, err := open()
+	if err != nil {
+		return nil, err
+	}
+	m := newHLSMuxer(h.log, source)
+	h.muxers[path] = m
+	return m, nil
+}
+
+// Stop segmenters that nobody is watching
+func (h *HLSServer) janitor() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case now := <-ticker.C:
+			h.lock.Lock()
+			idle := []*hlsMuxer{}
+			for path, m := range h.muxers {
+				if m.isStopped() || now.Sub(m.lastAccessTime()) > hlsIdleTimeout {
+					idle = append(idle, m)
+					delete(h.muxers, path)
+				}
+			}
+			h.lock.Unlock()
+			for _, m := range idle {
+				m.stopAndWait()
+			}
+		}
+	}
+}
+
+func newHLSMuxer(logger logs.Log, source *Source) *hlsMuxer {
+	m := &hlsMuxer{
+		log:        logs.NewPrefixLogger(logger, fmt.Sprintf("HLS %v", source.Name)),
+		source:     source,
+		incoming:   make(camera.StreamSinkChan, camera.StreamSinkChanDefaultBufferSize),
+		stop:       make(chan bool),
+		done:       make(chan bool),
+		ready:      make(chan bool),
+		lastAccess: time.Now(),
+	}
+	source.Stream.ConnectSink("HLS", m.incoming)
+	go m.run()
+	return m
+}
+
+func (m *hlsMuxer) touch() {
+	m.lock.Lock()
+	m.lastAccess = time.Now()
+	m.lock.Unlock()
+}
+
+func (m *hlsMuxer) lastAccessTime() time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.lastAccess
+}
+
+// Returns true if the muxer has stopped, either because it was idle, or because the source stream closed
+func (m *hlsMuxer) isStopped() bool {
+	select {
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop the muxer, and wait for it to finish cleaning up
+func (m *hlsMuxer) stopAndWait() {
+	m.stopOnce.Do(func() { close(m.stop) })
+	<-m.done
+}
+
+func (m *hlsMuxer) run() {
+	defer close(m.done)
+	defer m.source.Release()
+	defer removeSink(m.source.Stream, m.incoming)
+
+	m.log.Infof("Starting")
+	// Start at the most recent keyframe, so that the first segment is ready sooner
+	for _, packet := range backlogSinceKeyframe(m.source.Backlog) {
+		m.onPacket(packet)
+	}
+	for {
+		select {
+		case <-m.stop:
+			m.log.Infof("Stopped")
+			return
+		case msg := <-m.incoming:
+			switch msg.Type {
+			case camera.StreamMsgTypeClose:
+				m.log.Infof("Source closed")
+				return
+			case camera.StreamMsgTypePacket:
+				m.onPacket(msg.Packet)
+			case camera.StreamMsgTypeAudio:
+				m.onAudio(msg.Audio)
+			}
+		}
+	}
+}
+
+func (m *hlsMuxer) onPacket(packet *videox.VideoPacket) {
+	// Packets that were in the backlog can also arrive on our sink
+	if packet.ValidRecvID != 0 && packet.ValidRecvID <= m.lastRecvID {
+		return
+	}
+	m.lastRecvID = packet.ValidRecvID
+
+	isKey := packet.HasIDR()
+	if m.encoder == nil {
+		// Every segment must start with a keyframe
+		if !isKey {
+			return
+		}
+		encoder, err := videox.NewMPEGTSEncoder(m.log, &m.current, packet.Codec, nil, nil, nil)
+		if err != nil {
+			m.log.Errorf("Failed to create MPEG-TS encoder: %v", err)
+			return
+		}
+		// The audio stream must be added before the first video packet is encoded
+		if m.source.Stream.AudioCodec == videox.AudioCodecAAC {
+			encoder.AddAACStream()
+			m.hasAudio = true
+		}
+		m.encoder = encoder
+		m.segmentStart = packet.PTS
+	} else if isKey && packet.PTS-m.segmentStart >= hlsTargetSegmentDuration {
+		if err := m.finishSegment(packet.PTS); err != nil {
+			m.log.Errorf("Failed to finish segment: %v", err)
+		}
+	}
+	if err := m.encoder.Encode(packet.NALUs, packet.PTS); err != nil {
+		m.log.Errorf("Failed to encode packet: %v", err)
+	}
+	if !packet.WallPTS.IsZero() {
+		m.refPTS = packet.PTS
+		m.refWallPTS = packet.WallPTS
+	}
+}
+
+func (m *hlsMuxer) onAudio(audio *videox.AudioPacket) {
+	if !m.hasAudio || audio.Codec != videox.AudioCodecAAC || m.refWallPTS.IsZero() {
+		return
+	}
+	if err := m.encoder.EncodeAudio(audio.Payload, m.audioPTS(audio)); err != nil {
+		m.log.Errorf("Failed to encode audio: %v", err)
+	}
+}
+
+// Return the PTS of an audio packet, on the clock of the video packets.
+// Like exports, we place audio by its wall time, relative to the most recent video packet.
+func (m *hlsMuxer) audioPTS(audio *videox.AudioPacket) time.Duration {
+	return m.refPTS + audio.WallPTS.Sub(m.refWallPTS)
+}
+
+// Publish the current segment, and start a new one at 'end'
+func (m *hlsMuxer) finishSegment(end time.Duration) error {
+	if err := m.encoder.Flush(); err != nil {
+		return err
+	}
+	seg := hlsSegment{
+		sequence: m.nextSequence,
+		duration: end - m.segmentStart,
+		data:     bytes.Clone(m.current.Bytes()),
+	}
+	m.current.Reset()
+	m.segmentStart = end
+	m.nextSequence++
+
+	m.lock.Lock()
+	m.segments = append(m.segments, seg)
+	if len(m.segments) > hlsMaxSegments {
+		m.segments = m.segments[len(m.segments)-hlsMaxSegments:]
+	}
+	m.lock.Unlock()
+
+	if seg.sequence == 0 {
+		close(m.ready)
+	}
+	return m.encoder.WriteTables()
+}
+
+func (m *hlsMuxer) playlist(segmentQuery string) []byte {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lastAccess = time.Now()
+
+	// The target duration must be at least as long as every segment, rounded to the nearest second
+	target := 1
+	for _, seg := range m.segments {
+		target = max(target, int(math.Round(seg.duration.Seconds())))
+	}
+	if segmentQuery != "" {
+		segmentQuery = "?" + segmentQuery
+	}
+
+	b := strings.Builder{}
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%v\n", target)
+	if len(m.segments) != 0 {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%v\n", m.segments[0].sequence)
+	}
+	for _, seg := range m.segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", seg.duration.Seconds())
+		fmt.Fprintf(&b, "%v.ts%v\n", seg.sequence, segmentQuery)
+	}
+	return []byte(b.String())
+}
+
+func (m *hlsMuxer) segment(sequence int64) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lastAccess = time.Now()
+	for _, seg := range m.segments {
+		if seg.sequence == sequence {
+			return seg.data, nil
+		}
+	}
+	return nil, ErrHLSSegmentNotFound
+}
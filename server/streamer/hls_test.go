@@ -0,0 +1,39 @@
+package streamer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videox"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHLSPlaylist(t *testing.T) {
+	// Segments 2..7 are in the window, and the longest is 2.7 seconds
+	m := &hlsMuxer{}
+	for i := 2; i < hlsMaxSegments+2; i++ {
+		m.segments = append(m.segments, hlsSegment{sequence: int64(i), duration: 2*time.Second + time.Duration(i)*100*time.Millisecond})
+	}
+
+	expect := "#EXTM3U\n" +
+		"#EXT-X-VERSION:3\n" +
+		"#EXT-X-TARGETDURATION:3\n" +
+		"#EXT-X-MEDIA-SEQUENCE:2\n"
+	for i := 2; i < hlsMaxSegments+2; i++ {
+		expect += fmt.Sprintf("#EXTINF:2.%v00,\n%v.ts?authorizationToken=abc\n", i, i)
+	}
+	require.Equal(t, expect, string(m.playlist("authorizationToken=abc")))
+
+	_, err := m.segment(1)
+	require.ErrorIs(t, err, ErrHLSSegmentNotFound)
+	_, err = m.segment(7)
+	require.NoError(t, err)
+}
+
+func TestHLSAudioPTS(t *testing.T) {
+	wall := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := &hlsMuxer{refPTS: 10 * time.Second, refWallPTS: wall}
+	require.Equal(t, 10*time.Second+40*time.Millisecond, m.audioPTS(&videox.AudioPacket{WallPTS: wall.Add(40 * time.Millisecond)}))
+	require.Equal(t, 10*time.Second-20*time.Millisecond, m.audioPTS(&videox.AudioPacket{WallPTS: wall.Add(-20 * time.Millisecond)}))
+}
@@ -0,0 +1,364 @@
+package streamer
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bluenviron/gortsplib/v4"
+	"github.com/bluenviron/gortsplib/v4/pkg/auth"
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/description"
+	"github.com/bluenviron/gortsplib/v4/pkg/format"
+	"github.com/bluenviron/gortsplib/v4/pkg/headers"
+	"github.com/cyclopcam/cyclops/pkg/videox"
+	"github.com/cyclopcam/cyclops/server/camera"
+	"github.com/cyclopcam/logs"
+	"github.com/pion/rtp"
+)
+
+// RTSP serves live streams to devices that only speak RTSP, such as the TV in a guard booth,
+// or another NVR. Clients authenticate with BASIC authentication. We don't open any UDP
+// ports, so clients fall back to the TCP transport.
+// Like HLS, a source is only opened while somebody is watching it, and it is shared by
+// everybody watching the same path.
+
+// Stop serving a path if nobody has been playing it for this long
+const rtspIdleTimeout = 10 * time.Second
+
+// RTSPAuthorizer checks that the user may watch the source at path (eg "mosaic/3"), and
+// returns a function that opens the source.
+// It returns ErrUnauthorized if the credentials are wrong, or ErrSourceNotFound.
+type RTSPAuthorizer func(path, username, password string, remoteIP net.IP) (SourceOpener, error)
+
+// RTSPServer owns the RTSP listener, and the paths that are being served
+type RTSPServer struct {
+	log       logs.Log
+	authorize RTSPAuthorizer
+	server    *gortsplib.Server
+
+	lock     sync.Mutex
+	paths    map[string]*rtspPath                   // Key is the path, without a leading slash
+	sessions map[*gortsplib.ServerSession]*rtspPath // Sessions that are playing a path
+	stop     chan bool
+}
+
+// rtspPath sends the packets of a single source to all of its RTSP readers
+type rtspPath struct {
+	log      logs.Log
+	source   *Source
+	stream   *gortsplib.ServerStream
+	media    *description.Media
+	encoder  rtpEncoder
+	incoming camera.StreamSinkChan
+	stop     chan bool
+	stopOnce sync.Once
+	done     chan bool // Closed when the path has finished cleaning up
+
+	readers   int       // Protected by RTSPServer.lock
+	idleSince time.Time // Protected by RTSPServer.lock
+
+	// These are only accessed by the run thread
+	sentKeyframe bool
+	lastRecvID   int64
+}
+
+// The H.264 and H.265 RTP encoders have the same interface
+type rtpEncoder interface {
+	Encode(au [][]byte) ([]*rtp.Packet, error)
+}
+
+// Start an RTSP server on the given TCP port
+func StartRTSPServer(log logs.Log, port int, authorize RTSPAuthorizer) (*RTSPServer, error) {
+	r := &RTSPServer{
+		log:       logs.NewPrefixLogger(log, "RTSP"),
+		authorize: authorize,
+		paths:     map[string]*rtspPath{},
+		sessions:  map[*gortsplib.ServerSession]*rtspPath{},
+		stop:      make(chan bool),
+	}
+	r.server = &gortsplib.Server{
+		Handler:     r,
+		RTSPAddress: fmt.Sprintf(":%v", port),
+	}
+	if err := r.server.Start(); err != nil {
+		return nil, fmt.Errorf("Failed to start RTSP server on port %v: %w", port, err)
+	}
+	r.log.Infof("Listening on port %v", port)
+	go r.janitor()
+	return r, nil
+}
+
+// Stop the server, and all of its paths
+func (r *RTSPServer) Close() {
+	close(r.stop)
+	r.server.Close()
+
+	r.lock.Lock()
+	all := []*rtspPath{}
+	for _, p := range r.paths {
+		all = append(all, p)
+	}
+	r.paths = map[string]*rtspPath{}
+	r.sessions = map[*gortsplib.ServerSession]*rtspPath{}
+	r.lock.Unlock()
+
+	for _, p := range all {
+		p.stopAndWait()
+	}
+}
+
+// Called when receiving a DESCRIBE request
+func (r *RTSPServer) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	return r.openPath(ctx.Conn, ctx.Request, ctx.Path)
+}
+
+// Called when receiving a SETUP request
+func (r *RTSPServer) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	return r.openPath(ctx.Conn, ctx.Request, ctx.Path)
+}
+
+// Called when receiving a PLAY request
+func (r *RTSPServer) OnPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Response, error) {
+	name := strings.TrimPrefix(ctx.Path, "/")
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	p := r.paths[name]
+	if p == nil {
+		return &base.Response{StatusCode: base.StatusNotFound}, nil
+	}
+	if r.sessions[ctx.Session] == nil {
+		r.sessions[ctx.Session] = p
+		p.readers++
+	}
+	return &base.Response{StatusCode: base.StatusOK}, nil
+}
+
+// Called when a session is closed
+func (r *RTSPServer) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionCloseCtx) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if p := r.sessions[ctx.Session]; p != nil {
+		delete(r.sessions, ctx.Session)
+		p.readers--
+		if p.readers == 0 {
+			p.idleSince = time.Now()
+		}
+	}
+}
+
+// Authorize the request, and return the stream of the path, starting it if necessary
+func (r *RTSPServer) openPath(conn *gortsplib.ServerConn, req *base.Request, path string) (*base.Response, *gortsplib.ServerStream, error) {
+	name := strings.TrimPrefix(path, "/")
+	remoteIP := net.IP(nil)
+	if addr, ok := conn.NetConn().RemoteAddr().(*net.TCPAddr); ok {
+		remoteIP = addr.IP
+	}
+
+	open, refusal, err := r.authorizeRequest(req, name, remoteIP)
+	if refusal != nil {
+		return refusal, nil, err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if p := r.paths[name]; p != nil && !p.isStopped() {
+		return &base.Response{StatusCode: base.StatusOK}, p.stream, nil
+	}
+	source, err := open()
+	if err != nil {
+		r.log.Warnf("Failed to open %v: %v", name, err)
+		return &base.Response{StatusCode: base.StatusServiceUnavailable}, nil, nil
+	}
+	p, err := newRTSPPath(r.log, r.server, source)
+	if err != nil {
+		source.Release()
+		return &base.Response{StatusCode: base.StatusInternalServerError}, nil, err
+	}
+	r.paths[name] = p
+	return &base.Response{StatusCode: base.StatusOK}, p.stream, nil
+}
+
+// Check the credentials of a request for the path 'name'.
+// If the request is refused, then we return the response to send instead.
+func (r *RTSPServer) authorizeRequest(req *base.Request, name string, remoteIP net.IP) (SourceOpener, *base.Response, error) {
+	username, password := basicCredentials(req)
+	open, err := r.authorize(name, username, password, remoteIP)
+	if errors.Is(err, ErrUnauthorized) {
+		return nil, &base.Response{
+			StatusCode: base.StatusUnauthorized,
+			Header: base.Header{
+				"WWW-Authenticate": auth.GenerateWWWAuthenticate([]auth.ValidateMethod{auth.ValidateMethodBasic}, "Cyclops", ""),
+			},
+		}, nil
+	} else if errors.Is(err, ErrSourceNotFound) {
+		return nil, &base.Response{StatusCode: base.StatusNotFound}, nil
+	} else if err != nil {
+		return nil, &base.Response{StatusCode: base.StatusInternalServerError}, err
+	}
+	return open, nil, nil
+}
+
+// Return the username and password of a BASIC Authorization header, or empty strings
+func basicCredentials(req *base.Request) (username, password string) {
+	header, ok := req.Header["Authorization"]
+	if !ok {
+		return "", ""
+	}
+	var authorization headers.Authorization
+	if err := authorization.Unmarshal(header); err != nil || authorization.Method != headers.AuthMethodBasic {
+		return "", ""
+	}
+	return authorization.BasicUser, authorization.BasicPass
+}
+
+// Stop serving paths that nobody is playing
+func (r *RTSPServer) janitor() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case now := <-ticker.C:
+			r.lock.Lock()
+			idle := []*rtspPath{}
+			for name, p := range r.paths {
+				if p.isStopped() || (p.readers == 0 && now.Sub(p.idleSince) > rtspIdleTimeout) {
+					idle = append(idle, p)
+					delete(r.paths, name)
+				}
+			}
+			for session, p := range r.sessions {
+				if p.isStopped() {
+					delete(r.sessions, session)
+				}
+			}
+			r.lock.Unlock()
+			for _, p := range idle {
+				p.stopAndWait()
+			}
+		}
+	}
+}
+
+func newRTSPPath(logger logs.Log, server *gortsplib.Server, source *Source) (*rtspPath, error) {
+	var forma format.Format
+	var encoder rtpEncoder
+	switch source.Stream.Codec {
+	case videox.CodecH264:
+		f := &format.H264{PayloadTyp: 96, PacketizationMode: 1}
+		e, err := f.CreateEncoder()
+		if err != nil {
+			return nil, err
+		}
+		forma, encoder = f, e
+	case videox.CodecH265:
+		f := &format.H265{PayloadTyp: 96}
+		e, err := f.CreateEncoder()
+		if err != nil {
+			return nil, err
+		}
+		forma, encoder = f, e
+	default:
+		return nil, fmt.Errorf("Unsupported codec %v", source.Stream.Codec)
+	}
+	media := &description.Media{
+		Type:    description.MediaTypeVideo,
+		Formats: []format.Format{forma},
+	}
+	p := &rtspPath{
+		log:       logs.NewPrefixLogger(logger, source.Name),
+		source:    source,
+		stream:    gortsplib.NewServerStream(server, &description.Session{Medias: []*description.Media{media}}),
+		media:     media,
+		encoder:   encoder,
+		incoming:  make(camera.StreamSinkChan, camera.StreamSinkChanDefaultBufferSize),
+		stop:      make(chan bool),
+		done:      make(chan bool),
+		idleSince: time.Now(),
+	}
+	source.Stream.ConnectSink("RTSP", p.incoming)
+	go p.run()
+	return p, nil
+}
+
+// Returns true if the path has stopped, either because it was idle, or because the source stream closed
+func (p *rtspPath) isStopped() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop the path, and wait for it to finish cleaning up
+func (p *rtspPath) stopAndWait() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.done
+}
+
+func (p *rtspPath) run() {
+	defer close(p.done)
+	defer p.source.Release()
+	defer p.stream.Close() // Disconnects all readers
+	defer removeSink(p.source.Stream, p.incoming)
+
+	p.log.Infof("Starting")
+	for _, packet := range backlogSinceKeyframe(p.source.Backlog) {
+		p.onPacket(packet)
+	}
+	for {
+		select {
+		case <-p.stop:
+			p.log.Infof("Stopped")
+			return
+		case msg := <-p.incoming:
+			switch msg.Type {
+			case camera.StreamMsgTypeClose:
+				p.log.Infof("Source closed")
+				return
+			case camera.StreamMsgTypePacket:
+				p.onPacket(msg.Packet)
+			}
+		}
+	}
+}
+
+func (p *rtspPath) onPacket(packet *videox.VideoPacket) {
+	// Packets that were in the backlog can also arrive on our sink
+	if packet.ValidRecvID != 0 && packet.ValidRecvID <= p.lastRecvID {
+		return
+	}
+	p.lastRecvID = packet.ValidRecvID
+
+	// Readers can't decode anything until they've seen a keyframe
+	if !p.sentKeyframe {
+		if !packet.HasIDR() {
+			return
+		}
+		p.sentKeyframe = true
+	}
+
+	au := make([][]byte, 0, len(packet.NALUs))
+	for _, nalu := range packet.NALUs {
+		au = append(au, nalu.AsRBSP().Payload)
+	}
+	packets, err := p.encoder.Encode(au)
+	if err != nil {
+		p.log.Errorf("Failed to encode RTP: %v", err)
+		return
+	}
+	timestamp := uint32(int64(packet.PTS.Seconds() * 90000))
+	for _, pkt := range packets {
+		pkt.Timestamp = timestamp
+		if err := p.stream.WritePacketRTPWithNTP(p.media, pkt, packet.WallPTS); err != nil {
+			p.log.Errorf("Failed to write RTP: %v", err)
+			return
+		}
+	}
+}
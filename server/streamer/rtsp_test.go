@@ -0,0 +1,64 @@
+package streamer
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/bluenviron/gortsplib/v4/pkg/base"
+	"github.com/bluenviron/gortsplib/v4/pkg/headers"
+	"github.com/stretchr/testify/require"
+)
+
+func rtspTestRequest(username, password string) *base.Request {
+	req := &base.Request{Method: base.Describe, Header: base.Header{}}
+	if username != "" {
+		req.Header["Authorization"] = headers.Authorization{Method: headers.AuthMethodBasic, BasicUser: username, BasicPass: password}.Marshal()
+	}
+	return req
+}
+
+func TestRTSPAuthorize(t *testing.T) {
+	// Only "alice" may watch "mosaic/1", and only from the LAN
+	lan := net.ParseIP("192.168.1.20")
+	vpn := net.ParseIP("10.7.0.5")
+	opener := SourceOpener(func() (*Source, error) { return nil, nil })
+	r := &RTSPServer{
+		authorize: func(path, username, password string, remoteIP net.IP) (SourceOpener, error) {
+			if username != "alice" || password != "secret" || !remoteIP.Equal(lan) {
+				return nil, ErrUnauthorized
+			}
+			switch path {
+			case "mosaic/1":
+				return opener, nil
+			case "mosaic/2":
+				return nil, errors.New("database is locked")
+			}
+			return nil, ErrSourceNotFound
+		},
+	}
+
+	requireUnauthorized := func(req *base.Request, remoteIP net.IP) {
+		open, res, err := r.authorizeRequest(req, "mosaic/1", remoteIP)
+		require.NoError(t, err)
+		require.Nil(t, open)
+		require.Equal(t, base.StatusUnauthorized, res.StatusCode)
+		require.Contains(t, res.Header["WWW-Authenticate"][0], "Basic")
+	}
+	requireUnauthorized(rtspTestRequest("", ""), lan)
+	requireUnauthorized(rtspTestRequest("alice", "wrong"), lan)
+	requireUnauthorized(rtspTestRequest("alice", "secret"), vpn)
+
+	open, res, err := r.authorizeRequest(rtspTestRequest("alice", "secret"), "mosaic/1", lan)
+	require.NoError(t, err)
+	require.Nil(t, res)
+	require.NotNil(t, open)
+
+	_, res, err = r.authorizeRequest(rtspTestRequest("alice", "secret"), "mosaic/3", lan)
+	require.NoError(t, err)
+	require.Equal(t, base.StatusNotFound, res.StatusCode)
+
+	_, res, err = r.authorizeRequest(rtspTestRequest("alice", "secret"), "mosaic/2", lan)
+	require.Error(t, err)
+	require.Equal(t, base.StatusInternalServerError, res.StatusCode)
+}
@@ -0,0 +1,63 @@
+package streamer
+
+import (
+	"errors"
+
+	"github.com/cyclopcam/cyclops/pkg/videox"
+	"github.com/cyclopcam/cyclops/server/camera"
+)
+
+var ErrUnauthorized = errors.New("Unauthorized")
+var ErrSourceNotFound = errors.New("Source not found")
+
+// Source is a live stream that can be served over the websocket, HLS, or RTSP.
+// This is either a camera stream, a transcoder's output, or a mosaic.
+type Source struct {
+	Name    string                  // For logging
+	Stream  *camera.Stream          //
+	Backlog *camera.VideoRingBuffer // Recent packets of Stream. May be nil.
+	Release func()                  // Must be called when we're done with the source
+}
+
+// SourceOpener opens a source on demand.
+// HLS and RTSP only open a source while somebody is watching it.
+type SourceOpener func() (*Source, error)
+
+// Return copies of the packets in the backlog, starting at the most recent keyframe
+func backlogSinceKeyframe(backlog *camera.VideoRingBuffer) []*videox.VideoPacket {
+	if backlog == nil {
+		return nil
+	}
+	backlog.BufferLock.Lock()
+	defer backlog.BufferLock.Unlock()
+	packetIdx := backlog.FindLatestIDRPacketNoLock()
+	if packetIdx == -1 {
+		return nil
+	}
+	packets := []*videox.VideoPacket{}
+	for i := packetIdx; i < backlog.Buffer.Len(); i++ {
+		_, packet, _ := backlog.Buffer.Peek(i)
+		cloned := packet.Clone()
+		cloned.IsBacklog = true
+		packets = append(packets, cloned)
+	}
+	return packets
+}
+
+// Remove our sink from a stream.
+// The stream may be blocked trying to send us a packet while it holds its sinks lock,
+// so we keep draining our channel until RemoveSink has returned.
+func removeSink(stream *camera.Stream, incoming camera.StreamSinkChan) {
+	removed := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-incoming:
+			case <-removed:
+				return
+			}
+		}
+	}()
+	stream.RemoveSink(incoming)
+	close(removed)
+}
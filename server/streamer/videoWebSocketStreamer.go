@@ -29,14 +29,15 @@ type webSocketJSON struct {
 }
 
 // Queued data that must be sent over the websocket
-// Either videoFrame or detectionResult will be non-nil
+// Exactly one of videoFrame, audioFrame or detection will be non-nil
 type webSocketSendPacket struct {
 	videoFrame *videox.VideoPacket
+	audioFrame *videox.AudioPacket
 	detection  *monitor.AnalysisState
 }
 
 // When we send a message on the websocket, it's either a BINARY frame, in which case
-// it's a video packet. Or it's a TEXT frame, in which case it's this.
+// it's a video (or audio) packet. Or it's a TEXT frame, in which case it's this.
 // SYNC-CAMERA-WEBSOCKET-STRING-MESSAGE
 type webSocketSendStringMessage struct {
 	Type      string                 `json:"type"` // Only type of message of "detection"
@@ -63,6 +64,7 @@ type VideoWebSocketStreamer struct {
 	fromWebSocket     chan webSocketMsg
 	sendQueue         chan webSocketSendPacket
 	detections        chan *monitor.AnalysisState
+	sendAudio         bool // Only send audio if the client asked for it
 	lastDropMsg       time.Time
 	lastPacketRecvID  int64
 	lastPacketMissMsg time.Time
@@ -73,7 +75,7 @@ type VideoWebSocketStreamer struct {
 	logPacketCount    bool
 }
 
-func RunVideoWebSocketStreamer(cameraName string, logger logs.Log, conn *websocket.Conn, stream *camera.Stream, backlog *camera.VideoRingBuffer, detections chan *monitor.AnalysisState) {
+func RunVideoWebSocketStreamer(cameraName string, logger logs.Log, conn *websocket.Conn, stream *camera.Stream, backlog *camera.VideoRingBuffer, detections chan *monitor.AnalysisState, sendAudio bool) {
 	streamerID := atomic.AddInt64(&nextWebSocketStreamerID, 1)
 
 	streamer := &VideoWebSocketStreamer{
@@ -82,6 +84,7 @@ func RunVideoWebSocketStreamer(cameraName string, logger logs.Log, conn *websock
 		log:            logs.NewPrefixLogger(logger, fmt.Sprintf("Camera %v WebSocket %v", cameraName, streamerID)),
 		sendQueue:      make(chan webSocketSendPacket, WebSocketSendBufferSize),
 		detections:     detections,
+		sendAudio:      sendAudio,
 		debug:          false,
 		logPacketCount: false, // SYNC-LOG-PACKET-COUNT
 	}
@@ -146,6 +149,17 @@ func (s *VideoWebSocketStreamer) onDetection(detection *monitor.AnalysisState) {
 	}
 }
 
+func (s *VideoWebSocketStreamer) onAudio(packet *videox.AudioPacket) {
+	// Audio packets are small and frequent (especially G.711), so we drop them before
+	// they can crowd out video frames.
+	if len(s.sendQueue) >= WebSocketSendBufferSize*3/4 {
+		return
+	}
+	s.sendQueue <- webSocketSendPacket{
+		audioFrame: packet,
+	}
+}
+
 func (s *VideoWebSocketStreamer) run(conn *websocket.Conn, stream *camera.Stream, backlog *camera.VideoRingBuffer) {
 	//s.trackID = stream.H264TrackID
 
@@ -185,6 +199,10 @@ func (s *VideoWebSocketStreamer) run(conn *websocket.Conn, stream *camera.Stream
 				if !s.paused.Load() {
 					s.onPacketRTP(msg.Packet)
 				}
+			case camera.StreamMsgTypeAudio:
+				if s.sendAudio && !s.paused.Load() {
+					s.onAudio(msg.Audio)
+				}
 			}
 		case wsMsg, ok := <-s.fromWebSocket:
 			if !ok {
@@ -336,6 +354,26 @@ func (s *VideoWebSocketStreamer) webSocketWriter(conn *websocket.Conn) {
 			if err := conn.WriteMessage(websocket.BinaryMessage, final); err != nil {
 				s.log.Infof("Error writing to websocket %v: %v", s.streamerID, err)
 			}
+		} else if pkt.audioFrame != nil {
+			if !sentIDR {
+				// Don't send audio until the client is able to play video
+				continue
+			}
+			audio := pkt.audioFrame
+			// SYNC-CAMERA-WEBSOCKET-AUDIO-FRAME
+			// Same layout as a video frame, but with flag bit 4 set, and the sample rate
+			// and channel count in place of the receive ID.
+			buf := bytes.Buffer{}
+			headerSize := uint32(20)
+			binary.Write(&buf, binary.LittleEndian, headerSize)
+			binary.Write(&buf, binary.BigEndian, audio.Codec.FourByteName()) // "AAC ", "PCMA" or "PCMU"
+			binary.Write(&buf, binary.LittleEndian, uint32(4))
+			binary.Write(&buf, binary.LittleEndian, uint32(audio.SampleRate))
+			binary.Write(&buf, binary.LittleEndian, uint32(audio.Channels))
+			buf.Write(audio.Payload)
+			if err := conn.WriteMessage(websocket.BinaryMessage, buf.Bytes()); err != nil {
+				s.log.Infof("Error writing to websocket %v: %v", s.streamerID, err)
+			}
 		} else {
 			out := webSocketSendStringMessage{
 				Type:      "detection",
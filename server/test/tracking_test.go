@@ -42,6 +42,7 @@ type EventTrackingParams struct {
 	ModelNameHQ string  // eg "yolov8l"
 	NNCoverage  float64 // eg 75%, if we're able to run NN analysis on 75% of video frames (i.e. because we're resource constrained)
 	NNThreads   int     // 0 = default
+	Tracker     string  // monitor.TrackerGreedy or monitor.TrackerKalman
 }
 
 type Range struct {
@@ -50,6 +51,7 @@ type Range struct {
 }
 
 type TestCaseResult struct {
+	Tracker                 string
 	Expected                EventTrackingTestCase
 	ActualPeople            int
 	ActualPeopleUnconfirmed int
@@ -146,6 +148,7 @@ func testEventTrackingCase(t *testing.T, params *EventTrackingParams, tcase *Eve
 	monitorOptions.ModelsDir = FromTestPathToRepoRoot("models")
 	monitorOptions.ModelWidth = nnWidth
 	monitorOptions.ModelHeight = nnHeight
+	monitorOptions.Tracker = params.Tracker
 	if params.NNThreads != 0 {
 		monitorOptions.NNThreads = params.NNThreads
 	}
@@ -334,6 +337,7 @@ func testEventTrackingCase(t *testing.T, params *EventTrackingParams, tcase *Eve
 		}
 	}
 	return TestCaseResult{
+		Tracker:                 params.Tracker,
 		Expected:                *tcase,
 		ActualPeople:            nPerson,
 		ActualPeopleUnconfirmed: nPersonUnconfirmed,
@@ -372,6 +376,14 @@ func TestEventTracking(t *testing.T) {
 			//NNWidth:     defaultNNWidth,
 			//NNHeight:    defaultNNHeight,
 			NNThreads: 1, // Setting this to 1 can aid debugging
+			Tracker:   monitor.TrackerGreedy,
+		},
+		{
+			ModelNameLQ: "yolov8m",
+			ModelNameHQ: "yolov8l",
+			NNCoverage:  1,
+			NNThreads:   1,
+			Tracker:     monitor.TrackerKalman,
 		},
 	}
 	cases := []*EventTrackingTestCase{
@@ -513,7 +525,7 @@ func TestEventTracking(t *testing.T) {
 		resultFile, err = os.Create("tracking-results.csv")
 		require.NoError(t, err)
 		defer resultFile.Close()
-		_, err = fmt.Fprintf(resultFile, "Video,Pass,Min People,Max People,Actual People,Actual People Unconfirmed,Min Vehicles,Max Vehicles,Actual Vehicles,Has False Positives,Has False Negatives,Weak False Positives\n")
+		_, err = fmt.Fprintf(resultFile, "Tracker,Video,Pass,Min People,Max People,Actual People,Actual People Unconfirmed,Min Vehicles,Max Vehicles,Actual Vehicles,Has False Positives,Has False Negatives,Weak False Positives\n")
 		require.NoError(t, err)
 	}
 	writeResult := func(r TestCaseResult) {
@@ -523,15 +535,17 @@ func TestEventTracking(t *testing.T) {
 		weakFalsePositives := max(0, r.ActualPeopleUnconfirmed-r.Expected.NumPeople.Max)
 		pass := !hasFalsePositives && !hasFalseNegatives
 		fmt.Fprintf(resultFile,
-			"%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v\n",
-			e.VideoFilename, pass, e.NumPeople.Max, e.NumPeople.Max, r.ActualPeople, r.ActualPeopleUnconfirmed, e.NumVehicles.Min, e.NumVehicles.Max, r.ActualVehicles, hasFalsePositives, hasFalseNegatives, weakFalsePositives)
+			"%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v\n",
+			r.Tracker, e.VideoFilename, pass, e.NumPeople.Max, e.NumPeople.Max, r.ActualPeople, r.ActualPeopleUnconfirmed, e.NumVehicles.Min, e.NumVehicles.Max, r.ActualVehicles, hasFalsePositives, hasFalseNegatives, weakFalsePositives)
 	}
 
 	numPass := 0
 	numFail := 0
 
 	for iparams, params := range paramPurmutations {
-		t.Logf("Testing parameter permutation %v/%v (%v, %v, %v)", iparams, len(paramPurmutations), params.ModelNameLQ, params.ModelNameHQ, params.NNCoverage)
+		t.Logf("Testing parameter permutation %v/%v (%v, %v, %v, %v tracker)", iparams, len(paramPurmutations), params.ModelNameLQ, params.ModelNameHQ, params.NNCoverage, params.Tracker)
+		permutationPass := 0
+		permutationTotal := 0
 		for _, tcase := range cases {
 			if tcase.LowRes && nnload.HaveAccelerator() {
 				// For Hailo we only publish 640x640
@@ -549,12 +563,15 @@ func TestEventTracking(t *testing.T) {
 			if writeToResultFile {
 				writeResult(result)
 			}
+			permutationTotal++
 			if result.IsPass() {
 				numPass++
+				permutationPass++
 			} else {
 				numFail++
 			}
 		}
+		t.Logf("Permutation %v (%v tracker) passed %v/%v", iparams, params.Tracker, permutationPass, permutationTotal)
 	}
 
 	t.Logf("Passed %v/%v", numPass, numPass+numFail)
@@ -0,0 +1,63 @@
+package transcoder
+
+import (
+	"sync"
+	"time"
+)
+
+// Window over which we measure CPU usage
+const budgetWindow = 5 * time.Second
+
+type cpuSample struct {
+	at   time.Time
+	used time.Duration
+}
+
+// cpuBudget measures the CPU time consumed by all transcoders together, over a sliding window.
+// Our codecs are single threaded, so the wall time spent decoding and encoding a frame
+// is a good estimate of the CPU time that it consumed.
+type cpuBudget struct {
+	maxCores float64
+
+	lock    sync.Mutex
+	samples []cpuSample
+	total   time.Duration // Sum of samples
+}
+
+func newCPUBudget(maxCores float64) *cpuBudget {
+	return &cpuBudget{
+		maxCores: maxCores,
+	}
+}
+
+// Record CPU time that was used at 'now'
+func (b *cpuBudget) add(now time.Time, used time.Duration) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.samples = append(b.samples, cpuSample{at: now, used: used})
+	b.total += used
+	b.expireNoLock(now)
+}
+
+func (b *cpuBudget) expireNoLock(now time.Time) {
+	i := 0
+	for ; i < len(b.samples) && now.Sub(b.samples[i].at) > budgetWindow; i++ {
+		b.total -= b.samples[i].used
+	}
+	if i != 0 {
+		b.samples = append(b.samples[:0], b.samples[i:]...)
+	}
+}
+
+// Returns the average number of CPU cores in use over the window
+func (b *cpuBudget) usage(now time.Time) float64 {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.expireNoLock(now)
+	return b.total.Seconds() / budgetWindow.Seconds()
+}
+
+// Returns true if we're using more than our budget
+func (b *cpuBudget) isOver(now time.Time) bool {
+	return b.usage(now) >= b.maxCores
+}
@@ -0,0 +1,150 @@
+package transcoder
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cyclopcam/cyclops/server/camera"
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/logs"
+)
+
+var ErrOverBudget = errors.New("Transcoding CPU budget exceeded")
+var ErrUnknownProfile = errors.New("Unknown transcoding profile")
+
+// Manager creates transcoders on demand, and shares them between viewers.
+// If two people are watching the same camera with the same profile, then they
+// receive the output of a single transcoder.
+// All transcoders share a single CPU budget, so that transcoding can't starve
+// the neural network threads. Other encoders, such as mosaics, also draw from this
+// budget, via IsOverBudget and AddCPUTime.
+type Manager struct {
+	log      logs.Log
+	budget   *cpuBudget
+	profiles []Profile
+
+	lock    sync.Mutex
+	running map[transcoderKey]*Transcoder
+}
+
+// MaskFunc returns the privacy mask for frames of the given size, or nil if nothing must be hidden.
+// It is called for every frame, so that changes to the camera's masks take effect immediately.
+type MaskFunc func(width, height int) *configdb.PrivacyMask
+
+type transcoderKey struct {
+	source  *camera.Stream
+	profile string
+}
+
+// Create a new transcoding manager.
+// maxCores is the average number of CPU cores that all transcoders together may consume.
+func NewManager(log logs.Log, maxCores float64, profiles []Profile) *Manager {
+	return &Manager{
+		log:      log,
+		budget:   newCPUBudget(maxCores),
+		profiles: profiles,
+		running:  map[transcoderKey]*Transcoder{},
+	}
+}
+
+// Returns the list of available profiles
+func (m *Manager) Profiles() []Profile {
+	return m.profiles
+}
+
+// Returns the average number of CPU cores consumed by transcoding, over the last few seconds
+func (m *Manager) CPUUsage() float64 {
+	return m.budget.usage(time.Now())
+}
+
+// Returns true if all encoders together are using more than the CPU budget
+func (m *Manager) IsOverBudget() bool {
+	return m.budget.isOver(time.Now())
+}
+
+// Record CPU time that was consumed by an encoder other than a transcoder (eg a mosaic),
+// so that it counts against the same budget as the transcoders.
+func (m *Manager) AddCPUTime(used time.Duration) {
+	m.budget.add(time.Now(), used)
+}
+
+// Returns the profile with the given name, or nil
+func (m *Manager) FindProfile(name string) *Profile {
+	for i := range m.profiles {
+		if m.profiles[i].Name == name {
+			return &m.profiles[i]
+		}
+	}
+	return nil
+}
+
+// Acquire a transcoder for the given stream and profile.
+// If such a transcoder is already running, then it is shared.
+// mask may be nil. Because transcoders are shared per stream, mask must belong to the owner
+// of the stream, and not to a virtual camera that is viewing the stream.
+// You must call Release() when you're done with it.
+func (m *Manager) Acquire(cameraName string, source *camera.Stream, profileName string, mask MaskFunc) (*Transcoder, error) {
+	profile := m.FindProfile(profileName)
+	if profile == nil {
+		return nil, fmt.Errorf("%w '%v'", ErrUnknownProfile, profileName)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := transcoderKey{source, profileName}
+	if t := m.running[key]; t != nil && !t.isStopped() {
+		t.refCount++
+		return t, nil
+	}
+
+	// Existing transcoders degrade gracefully when we're over budget, but there's no
+	// sense in making things worse by adding another one.
+	if m.budget.isOver(time.Now()) {
+		return nil, ErrOverBudget
+	}
+
+	t, err := newTranscoder(m.log, cameraName, source, *profile, mask, m.budget)
+	if err != nil {
+		return nil, err
+	}
+	t.refCount = 1
+	m.running[key] = t
+	return t, nil
+}
+
+// Release a transcoder that was returned by Acquire().
+// When the last viewer releases a transcoder, it is stopped.
+func (m *Manager) Release(t *Transcoder) {
+	m.lock.Lock()
+	t.refCount--
+	if t.refCount != 0 {
+		m.lock.Unlock()
+		return
+	}
+	// The map entry may already have been removed by Close(), or replaced after the source stream closed
+	key := transcoderKey{t.source, t.Profile.Name}
+	if m.running[key] == t {
+		delete(m.running, key)
+	}
+	m.lock.Unlock()
+
+	t.stopAndWait()
+}
+
+// Stop all transcoders
+func (m *Manager) Close() {
+	m.lock.Lock()
+	all := []*Transcoder{}
+	for _, t := range m.running {
+		all = append(all, t)
+	}
+	m.running = map[transcoderKey]*Transcoder{}
+	m.lock.Unlock()
+
+	for _, t := range all {
+		t.stopAndWait()
+	}
+}
@@ -0,0 +1,97 @@
+package transcoder
+
+import (
+	"math"
+
+	"github.com/cyclopcam/cyclops/server/configdb"
+)
+
+// Profile describes the output of a transcoder
+type Profile struct {
+	Name             string `json:"name"`
+	MaxWidth         int    `json:"maxWidth"`         // Video is scaled down (never up) to fit inside MaxWidth x MaxHeight
+	MaxHeight        int    `json:"maxHeight"`        //
+	FPS              int    `json:"fps"`              // Maximum frames per second. Zero = same as the source.
+	Bitrate          int    `json:"bitrate"`          // Target bits per second
+	KeyframeInterval int    `json:"keyframeInterval"` // Frames between keyframes. Zero = 2 seconds worth.
+	KeyframesOnly    bool   `json:"keyframesOnly"`    // Only decode the source's keyframes
+}
+
+// When a camera has privacy masks, its raw stream never leaves the server. If a viewer doesn't
+// choose a profile, then they get this one, which preserves the resolution of most cameras.
+const PrivacyProfileName = "privacy"
+
+// Profiles that are always available, unless they are overridden by config
+var BuiltinProfiles = []Profile{
+	{
+		Name:      "480p",
+		MaxWidth:  854,
+		MaxHeight: 480,
+		FPS:       10,
+		Bitrate:   300 * 1000,
+	},
+	{
+		// One frame every second or two. Decoding only keyframes makes this very cheap,
+		// even from an HD source.
+		Name:             "thumbnail",
+		MaxWidth:         320,
+		MaxHeight:        240,
+		FPS:              1,
+		Bitrate:          30 * 1000,
+		KeyframeInterval: 1,
+		KeyframesOnly:    true,
+	},
+	{
+		Name:      PrivacyProfileName,
+		MaxWidth:  1920,
+		MaxHeight: 1080,
+		Bitrate:   2000 * 1000,
+	},
+}
+
+// Merge the built-in profiles with those from the config
+func MergeProfiles(cfg *configdb.TranscodingJSON) []Profile {
+	profiles := append([]Profile{}, BuiltinProfiles...)
+	if cfg == nil {
+		return profiles
+	}
+	for _, c := range cfg.Profiles {
+		p := Profile{
+			Name:             c.Name,
+			MaxWidth:         c.MaxWidth,
+			MaxHeight:        c.MaxHeight,
+			FPS:              c.FPS,
+			Bitrate:          c.BitrateKbps * 1000,
+			KeyframeInterval: c.KeyframeInterval,
+			KeyframesOnly:    c.KeyframesOnly,
+		}
+		replaced := false
+		for i := range profiles {
+			if profiles[i].Name == p.Name {
+				profiles[i] = p
+				replaced = true
+			}
+		}
+		if !replaced {
+			profiles = append(profiles, p)
+		}
+	}
+	return profiles
+}
+
+// Returns the size of the encoded video, for a source of the given size.
+// The aspect ratio is preserved, and the dimensions are even, because YUV420 requires it.
+func (p *Profile) OutputSize(srcWidth, srcHeight int) (width, height int) {
+	scale := min(1.0, float64(p.MaxWidth)/float64(srcWidth), float64(p.MaxHeight)/float64(srcHeight))
+	width = int(math.Round(float64(srcWidth)*scale)) &^ 1
+	height = int(math.Round(float64(srcHeight)*scale)) &^ 1
+	return max(width, 2), max(height, 2)
+}
+
+// Returns the keyframe interval, given the output frame rate
+func (p *Profile) keyframeInterval(fps int) int {
+	if p.KeyframeInterval != 0 {
+		return p.KeyframeInterval
+	}
+	return max(2*fps, 1)
+}
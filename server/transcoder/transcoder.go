@@ -0,0 +1,296 @@
+package transcoder
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videox"
+	"github.com/cyclopcam/cyclops/server/camera"
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/cyclopcam/logs"
+)
+
+// Size of the ring buffer on the output stream, which is used to send new viewers the
+// packets since the most recent keyframe, so that they can start playing immediately.
+const backlogBytes = 4 * 1024 * 1024
+
+// Number of source packets that we queue up for decoding, before we start dropping packets
+const workQueueSize = 30
+
+// Transcoder decodes a camera stream, and re-encodes it according to a Profile.
+// The result is published on Output, which behaves like any other camera stream,
+// so it can be served by the websocket streamer.
+type Transcoder struct {
+	Profile Profile
+	Output  *camera.Stream
+	Backlog *camera.VideoRingBuffer // Recent packets of Output
+
+	log      logs.Log
+	source   *camera.Stream
+	mask     MaskFunc
+	budget   *cpuBudget
+	incoming camera.StreamSinkChan
+	work     chan *videox.VideoPacket
+	stop     chan bool // Closed when the last viewer leaves
+	stopOnce sync.Once
+	done     chan bool // Closed when the transcoder has finished cleaning up
+	refCount int       // Protected by Manager.lock
+
+	// These are only accessed by the worker thread
+	decoder           *videox.VideoDecoder
+	encoder           *videox.VideoEncoder
+	inputWidth        int
+	inputHeight       int
+	skipUntilKeyframe bool
+	lastOutputPTS     time.Duration
+	hasOutput         bool
+	nOutput           int64 // Number of packets published on Output. The streamer uses ValidRecvID to detect gaps, so it must be sequential.
+	nOverBudget       int64
+	lastBudgetLog     time.Time
+
+	// These are only accessed by the receive thread
+	dropping    bool // A packet was dropped, so skip until the next keyframe
+	nDropped    int64
+	lastDropLog time.Time
+}
+
+func newTranscoder(logger logs.Log, cameraName string, source *camera.Stream, profile Profile, mask MaskFunc, budget *cpuBudget) (*Transcoder, error) {
+	decoder, err := videox.NewVideoStreamDecoder(source.Codec)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create %v decoder: %w", source.Codec, err)
+	}
+	streamName := source.StreamName + "-" + profile.Name
+	t := &Transcoder{
+		Profile:           profile,
+		Output:            camera.NewStream(logger, cameraName, streamName, true),
+		Backlog:           camera.NewVideoRingBuffer(backlogBytes),
+		log:               logs.NewPrefixLogger(logger, fmt.Sprintf("Transcoder %v.%v", cameraName, streamName)),
+		source:            source,
+		mask:              mask,
+		budget:            budget,
+		incoming:          make(camera.StreamSinkChan, camera.StreamSinkChanDefaultBufferSize),
+		work:              make(chan *videox.VideoPacket, workQueueSize),
+		stop:              make(chan bool),
+		done:              make(chan bool),
+		decoder:           decoder,
+		skipUntilKeyframe: true,
+	}
+	t.Output.Codec = videox.CodecH264
+	if err := t.Output.ConnectSinkAndRun("Transcode Ring", t.Backlog); err != nil {
+		decoder.Close()
+		return nil, err
+	}
+	source.ConnectSink("Transcode "+profile.Name, t.incoming)
+	go t.receive()
+	go t.process()
+	return t, nil
+}
+
+// Receive packets from the source stream, and queue them for the worker thread.
+// We never block the source stream, because that would stall every other sink of
+// the camera, including the recorder.
+func (t *Transcoder) receive() {
+	defer t.disconnectSource()
+	defer close(t.work)
+	for {
+		select {
+		case <-t.stop:
+			return
+		case msg := <-t.incoming:
+			switch msg.Type {
+			case camera.StreamMsgTypeClose:
+				return
+			case camera.StreamMsgTypePacket:
+				isKey := msg.Packet.HasIDR()
+				if (t.Profile.KeyframesOnly || t.dropping) && !isKey {
+					continue
+				}
+				if len(t.work) >= workQueueSize {
+					// The decoder can't resume until it sees another keyframe
+					t.drop()
+					continue
+				}
+				t.dropping = false
+				t.work <- msg.Packet
+			}
+		}
+	}
+}
+
+// Remove our sink from the source stream.
+// The source may be blocked trying to send us a packet while it holds its sinks lock,
+// so we keep draining our channel until RemoveSink has returned.
+func (t *Transcoder) disconnectSource() {
+	removed := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-t.incoming:
+			case <-removed:
+				return
+			}
+		}
+	}()
+	t.source.RemoveSink(t.incoming)
+	close(removed)
+}
+
+// Returns true if the transcoder has stopped, either because it was released, or because the source stream closed
+func (t *Transcoder) isStopped() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop the transcoder, and wait for it to finish cleaning up
+func (t *Transcoder) stopAndWait() {
+	t.stopOnce.Do(func() { close(t.stop) })
+	<-t.done
+}
+
+// Decode and re-encode packets, on a dedicated thread
+func (t *Transcoder) process() {
+	defer close(t.done)
+	defer t.Output.Close(nil)
+	defer t.decoder.Close()
+	defer func() {
+		if t.encoder != nil {
+			t.encoder.Close()
+		}
+	}()
+
+	t.log.Infof("Starting")
+	for packet := range t.work {
+		if err := t.transcodePacket(packet); err != nil {
+			t.log.Errorf("%v", err)
+			t.skipUntilKeyframe = true
+		}
+	}
+	t.log.Infof("Stopped")
+}
+
+func (t *Transcoder) drop() {
+	t.dropping = true
+	t.nDropped++
+	now := time.Now()
+	if now.Sub(t.lastDropLog) > 10*time.Second {
+		t.log.Infof("Decoder can't keep up. %v packets dropped so far", t.nDropped)
+		t.lastDropLog = now
+	}
+}
+
+func (t *Transcoder) transcodePacket(packet *videox.VideoPacket) error {
+	isKey := packet.HasIDR()
+	if t.skipUntilKeyframe {
+		if !isKey {
+			return nil
+		}
+		t.skipUntilKeyframe = false
+	}
+
+	now := time.Now()
+	if !isKey && t.budget.isOver(now) {
+		// Fall back to decoding only keyframes, until there is CPU time available again.
+		// We only check this on inter frames, so that the output keeps moving, even if slowly.
+		t.skipUntilKeyframe = true
+		t.nOverBudget++
+		if now.Sub(t.lastBudgetLog) > 10*time.Second {
+			t.log.Infof("Over CPU budget (%.2f cores). Skipped %v frames so far", t.budget.usage(now), t.nOverBudget)
+			t.lastBudgetLog = now
+		}
+		return nil
+	}
+
+	start := time.Now()
+	defer func() {
+		t.budget.add(time.Now(), time.Since(start))
+	}()
+
+	frame, err := t.decoder.DecodeDeepRef(packet)
+	if errors.Is(err, videox.ErrNoFrame) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to decode packet: %w", err)
+	}
+
+	// Limit the frame rate, but never drop a keyframe that we've decided to decode
+	if t.Profile.FPS != 0 && t.hasOutput && packet.PTS-t.lastOutputPTS < time.Second/time.Duration(t.Profile.FPS)-5*time.Millisecond {
+		return nil
+	}
+
+	img := frame.Image
+	if mask := t.privacyMask(img.Width, img.Height); mask != nil {
+		// The decoder still needs the frame as a reference for the frames that follow, so we can't modify it
+		img = img.Clone()
+		camera.ApplyPrivacyMaskYUV(mask, img)
+	}
+	if t.encoder == nil || img.Width != t.inputWidth || img.Height != t.inputHeight {
+		if err := t.createEncoder(img.Width, img.Height); err != nil {
+			return err
+		}
+	}
+
+	if err := t.encoder.WriteYUVImage(packet.PTS, img); err != nil {
+		return fmt.Errorf("Failed to encode frame: %w", err)
+	}
+	t.lastOutputPTS = packet.PTS
+	t.hasOutput = true
+
+	for _, out := range t.encoder.ReadPackets() {
+		// Map the output PTS back onto wall time, via the source packet
+		out.WallPTS = packet.WallPTS.Add(out.PTS - packet.PTS)
+		t.nOutput++
+		out.ValidRecvID = t.nOutput
+		t.Output.PublishPacket(out)
+	}
+	return nil
+}
+
+func (t *Transcoder) privacyMask(width, height int) *configdb.PrivacyMask {
+	if t.mask == nil {
+		return nil
+	}
+	return t.mask(width, height)
+}
+
+// Create (or re-create, if the camera's resolution changed) the encoder
+func (t *Transcoder) createEncoder(inputWidth, inputHeight int) error {
+	if t.encoder != nil {
+		t.encoder.Close()
+		t.encoder = nil
+	}
+	width, height := t.Profile.OutputSize(inputWidth, inputHeight)
+	fps := t.Profile.FPS
+	if fps == 0 {
+		stats := t.source.RecentFrameStats()
+		fps = stats.FPSRounded()
+	}
+	if fps == 0 {
+		fps = 10
+	}
+	encoder, err := videox.NewVideoMemoryEncoder(videox.MemoryEncoderParams{
+		Codec:            videox.CodecH264,
+		InputWidth:       inputWidth,
+		InputHeight:      inputHeight,
+		Width:            width,
+		Height:           height,
+		PixelFormatIn:    videox.AVPixelFormatYUV420P,
+		FPS:              fps,
+		Bitrate:          t.Profile.Bitrate,
+		KeyframeInterval: t.Profile.keyframeInterval(fps),
+		Threads:          1, // So that our CPU budget is accurate
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to create encoder: %w", err)
+	}
+	t.log.Infof("Encoding %v x %v -> %v x %v at %v FPS, %v kbps", inputWidth, inputHeight, width, height, fps, t.Profile.Bitrate/1000)
+	t.encoder = encoder
+	t.inputWidth = inputWidth
+	t.inputHeight = inputHeight
+	return nil
+}
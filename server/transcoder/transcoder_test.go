@@ -0,0 +1,53 @@
+package transcoder
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/server/configdb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutputSize(t *testing.T) {
+	p := Profile{MaxWidth: 854, MaxHeight: 480}
+	w, h := p.OutputSize(1920, 1080)
+	require.Equal(t, 852, w)
+	require.Equal(t, 480, h)
+
+	// Never upscale
+	w, h = p.OutputSize(640, 360)
+	require.Equal(t, 640, w)
+	require.Equal(t, 360, h)
+
+	// Portrait
+	w, h = p.OutputSize(1080, 1920)
+	require.Equal(t, 270, w)
+	require.Equal(t, 480, h)
+}
+
+func TestMergeProfiles(t *testing.T) {
+	profiles := MergeProfiles(&configdb.TranscodingJSON{
+		Profiles: []configdb.TranscodeProfileJSON{
+			{Name: "480p", MaxWidth: 640, MaxHeight: 480, BitrateKbps: 200},
+			{Name: "tiny", MaxWidth: 160, MaxHeight: 120, BitrateKbps: 20},
+		},
+	})
+	require.Equal(t, len(BuiltinProfiles)+1, len(profiles))
+	require.Equal(t, "480p", profiles[0].Name)
+	require.Equal(t, 200*1000, profiles[0].Bitrate)
+	require.Equal(t, "tiny", profiles[len(profiles)-1].Name)
+}
+
+func TestCPUBudget(t *testing.T) {
+	b := newCPUBudget(0.5)
+	now := time.Now()
+	b.add(now, time.Second)
+	require.False(t, b.isOver(now))
+	b.add(now.Add(time.Second), 2*time.Second)
+	require.InDelta(t, 0.6, b.usage(now.Add(time.Second)), 0.001)
+	require.True(t, b.isOver(now.Add(time.Second)))
+
+	// The first sample falls out of the window
+	require.InDelta(t, 0.4, b.usage(now.Add(budgetWindow+500*time.Millisecond)), 0.001)
+	require.False(t, b.isOver(now.Add(budgetWindow+500*time.Millisecond)))
+}
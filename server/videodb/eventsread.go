@@ -112,6 +112,28 @@ func (v *VideoDB) VideoStartTimeForCamera(camera string) (time.Time, error) {
 	return time.Time{}, ErrNoVideoFound
 }
 
+// Returns true if there were any events on the video stream's camera during the given time period.
+// This is the event filter for EventsOnly replication.
+func (v *VideoDB) StreamHasEvents(streamName string, startTime, endTime time.Time) (bool, error) {
+	camera, _, ok := CameraForVideoStreamName(streamName)
+	if !ok {
+		return false, fmt.Errorf("Invalid video stream name '%v'", streamName)
+	}
+	events, err := v.ReadEvents(camera, startTime, endTime)
+	if err != nil {
+		return false, err
+	}
+	for _, ev := range events {
+		// ReadEvents includes the event that is busy being built, regardless of its time
+		if ev.Time.Get().Before(endTime) && ev.EndTime().After(startTime) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Read the events of the camera that overlap the time range.
+// Events that a re-analysis job stored alongside the original results are excluded (see ReadJobEvents).
 func (v *VideoDB) ReadEvents(camera string, startTime, endTime time.Time) ([]*Event, error) {
 	cameraID, err := v.StringToID(camera)
 	if err != nil {
@@ -121,7 +143,7 @@ func (v *VideoDB) ReadEvents(camera string, startTime, endTime time.Time) ([]*Ev
 	// In the DB, events have 'time' and 'duration', and we want to find all event records that overlap the
 	// requested startTime-to-endTime interval.
 	events := []*Event{}
-	if err := v.db.Where("camera = ? AND time < ? AND time + duration > ?", cameraID, endTime.UnixMilli(), startTime.UnixMilli()).Find(&events).Error; err != nil {
+	if err := v.db.Where("camera = ? AND time < ? AND time + duration > ? AND job IS NULL", cameraID, endTime.UnixMilli(), startTime.UnixMilli()).Find(&events).Error; err != nil {
 		return nil, err
 	}
 
@@ -136,3 +158,17 @@ func (v *VideoDB) ReadEvents(camera string, startTime, endTime time.Time) ([]*Ev
 
 	return events, nil
 }
+
+// Read the events of the camera that overlap the time range, which were produced by a re-analysis
+// job that stored its results alongside the original results.
+func (v *VideoDB) ReadJobEvents(camera string, job int64, startTime, endTime time.Time) ([]*Event, error) {
+	cameraID, err := v.StringToID(camera)
+	if err != nil {
+		return nil, err
+	}
+	events := []*Event{}
+	if err := v.db.Where("camera = ? AND time < ? AND time + duration > ? AND job = ?", cameraID, endTime.UnixMilli(), startTime.UnixMilli(), job).Find(&events).Error; err != nil {
+		return nil, err
+	}
+	return events, nil
+}
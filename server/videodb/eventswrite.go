@@ -97,6 +97,20 @@ func (v *VideoDB) addBoxToTrackedObject(camera string, cameraResolution [2]int,
 		v.current[id] = obj
 	}
 
+	obj.addDetections(detections)
+
+	// Once we return this object, the caller is no longer inside currentLock,
+	// so either we make a deep clone including Boxes, or we set Boxes to nil.
+	clone := *obj
+	clone.Boxes = nil
+	return clone, nil
+}
+
+// Add new detections of the object.
+// Detections are only stored if the object has moved, but they're always counted.
+func (obj *TrackedObject) addDetections(detections []TrackedBox) {
+	latestFrame := &detections[len(detections)-1]
+
 	// Decide whether to add the frames or ignore them
 	var addFrames bool
 	if len(obj.Boxes) == 0 {
@@ -122,12 +136,6 @@ func (v *VideoDB) addBoxToTrackedObject(camera string, cameraResolution [2]int,
 
 	obj.LastSeen = latestFrame.Time
 	obj.NumDetections++
-
-	// Once we return this object, the caller is no longer inside currentLock,
-	// so either we make a deep clone including Boxes, or we set Boxes to nil.
-	clone := *obj
-	clone.Boxes = nil
-	return clone, nil
 }
 
 func (v *VideoDB) eventWriteThread() {
@@ -151,6 +159,26 @@ func (v *VideoDB) eventWriteThread() {
 	close(v.writeThreadClosed)
 }
 
+// Limits on the objects that we hold in memory, before writing them to an Event record
+const (
+	// Stale = object has not been seen for X seconds
+	eventStaleTimeout = 30 * time.Second
+
+	// Old = object was first seen X seconds ago
+	// eventOldTimeout defines the upper limit on how long Event objects will be in our database.
+	// One reason we have this limit, is that in the event of a power outage, we would
+	// have a decent chance of having written a long-running detection to disk. Imagine a
+	// car parked in a driveway for hours or days. Such a detection would just sit there
+	// forever, so having some kind of time limit seems like a good idea.
+	eventOldTimeout = 5 * time.Minute
+
+	// We want to limit the size of each Event record in the DB. I'm not sure if it's best
+	// to limit the size of the records, or the max time, so I'm doing both.
+	// See TestJSONSize. From that test, each frame is 40 bytes. So 300 * 40 = 12KB,
+	// which seems like a reasonable upper limit on record size.
+	eventMaxFrames = 300
+)
+
 // Determine if now is a good time to write our current state to the DB.
 // If force is true, then write all objects to the DB.
 func (v *VideoDB) writeAgingEventsToDB(force bool) {
@@ -170,23 +198,6 @@ func (v *VideoDB) writeAgingEventsToDB(force bool) {
 
 	now := time.Now()
 
-	// Stale = object has not been seen for X seconds
-	staleTimeout := 30 * time.Second
-
-	// Old = object was first seen X seconds ago
-	// oldTimeout defines the upper limit on how long Event objects will be in our database.
-	// One reason we have this limit, is that in the event of a power outage, we would
-	// have a decent chance of having written a long-running detection to disk. Imagine a
-	// car parked in a driveway for hours or days. Such a detection would just sit there
-	// forever, so having some kind of time limit seems like a good idea.
-	oldTimeout := 5 * time.Minute
-
-	// We want to limit the size of each Event record in the DB. I'm not sure if it's best
-	// to limit the size of the records, or the max time, so I'm doing both.
-	// See TestJSONSize. From that test, each frame is 40 bytes. So 300 * 40 = 12KB,
-	// which seems like a reasonable upper limit on record size.
-	maxFrames := 300
-
 	// We flush a camera if any of these are true:
 	// 1. All objects are stale
 	// 2. Any object is old
@@ -211,10 +222,10 @@ func (v *VideoDB) writeAgingEventsToDB(force bool) {
 		}
 		firstSeen := c.Boxes[0].Time
 		lastSeen := c.Boxes[len(c.Boxes)-1].Time
-		if now.Sub(lastSeen) > staleTimeout {
+		if now.Sub(lastSeen) > eventStaleTimeout {
 			cam.nStaleObjects++
 		}
-		if now.Sub(firstSeen) > oldTimeout {
+		if now.Sub(firstSeen) > eventOldTimeout {
 			cam.nOldObjects++
 		}
 		cam.nObjects++
@@ -222,7 +233,7 @@ func (v *VideoDB) writeAgingEventsToDB(force bool) {
 	}
 
 	for cam, inf := range cameras {
-		if inf.nStaleObjects == inf.nObjects || inf.nOldObjects > 0 || inf.nBoxes > maxFrames {
+		if inf.nStaleObjects == inf.nObjects || inf.nOldObjects > 0 || inf.nBoxes > eventMaxFrames {
 			v.log.Infof("Flushing camera %v events to DB (total=%v stale=%v old=%v frames=%v)", cam, inf.nObjects, inf.nStaleObjects, inf.nOldObjects, inf.nBoxes)
 			v.flushCameraToDB(cam)
 		}
@@ -263,13 +274,20 @@ func copyTrackedBoxToObjectPositionJSON(b TrackedBox, basetime time.Time) Object
 // If there are no tracked objects for this camera, then return (nil, nil).
 // You must already be holding currentLock before calling this function
 func (v *VideoDB) buildEventRecord(camera uint32) (*Event, map[uint32]*TrackedObject) {
+	return buildEventRecordFromObjects(camera, v.current)
+}
+
+// Package up the objects of the given camera as a DB Event record, and return
+// the remaining objects (i.e. those of other cameras).
+// If there are no objects for this camera, then return (nil, nil).
+func buildEventRecordFromObjects(camera uint32, objects map[uint32]*TrackedObject) (*Event, map[uint32]*TrackedObject) {
 	// Find the earliest time. This will be our reference time.
 	// Everything in the JSON blob is specified as milliseconds relative to base.
 	basetime := time.Now()
 	maxtime := time.Time{}
 	resolution := [2]int{}
 	otherCameraObjects := map[uint32]*TrackedObject{}
-	for _, c := range v.current {
+	for _, c := range objects {
 		if c.Camera == camera {
 			if c.Boxes[0].Time.Before(basetime) {
 				basetime = c.Boxes[0].Time
@@ -291,7 +309,7 @@ func (v *VideoDB) buildEventRecord(camera uint32) (*Event, map[uint32]*TrackedOb
 	var detectionsJSON dbh.JSONField[EventDetectionsJSON]
 	detectionsJSON.Data.Resolution = resolution
 
-	for _, c := range v.current {
+	for _, c := range objects {
 		if c.Camera == camera {
 			obj := &ObjectJSON{
 				ID:            c.ID,
@@ -325,6 +343,18 @@ func (v *VideoDB) buildEventRecord(camera uint32) (*Event, map[uint32]*TrackedOb
 	return ev, otherCameraObjects
 }
 
+// Tell us which cameras are virtual, and the long lived name of each one's parent.
+// A virtual camera's events are kept for as long as its parent has video.
+func (v *VideoDB) SetVirtualCameras(virtualToParent map[string]string) {
+	copied := make(map[string]string, len(virtualToParent))
+	for k, p := range virtualToParent {
+		copied[k] = p
+	}
+	v.virtualCamerasLock.Lock()
+	v.virtualCameras = copied
+	v.virtualCamerasLock.Unlock()
+}
+
 // For each camera, get the oldest recording available, and then delete
 // any events that we have which aren't covered by recording.
 // There's no point keeping information around about events, if we don't
@@ -332,6 +362,14 @@ func (v *VideoDB) buildEventRecord(camera uint32) (*Event, map[uint32]*TrackedOb
 func (v *VideoDB) deleteOldEventsFromDB() error {
 	resolutions := []defs.Resolution{defs.ResLD, defs.ResHD}
 
+	v.virtualCamerasLock.Lock()
+	virtualCameras := v.virtualCameras
+	v.virtualCamerasLock.Unlock()
+	if virtualCameras == nil {
+		// Until we know which cameras are virtual, we can't find the video of their events
+		return nil
+	}
+
 	tx := v.db.Begin()
 	if tx.Error != nil {
 		return tx.Error
@@ -360,9 +398,13 @@ func (v *VideoDB) deleteOldEventsFromDB() error {
 			v.log.Warnf("deleteOldEventsFromDB failed to convert camera ID %v to string: %v", cameraID, err)
 			continue
 		}
+		recordingCamera := cameraLongLivedName
+		if parent, ok := virtualCameras[cameraLongLivedName]; ok {
+			recordingCamera = parent
+		}
 		oldestVideoTime := time.Date(9000, 1, 1, 0, 0, 0, 0, time.UTC)
 		for _, res := range resolutions {
-			streamName := VideoStreamNameForCamera(cameraLongLivedName, res)
+			streamName := VideoStreamNameForCamera(recordingCamera, res)
 			stream := nameToStream[streamName]
 			if stream == nil {
 				continue
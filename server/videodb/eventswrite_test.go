@@ -0,0 +1,60 @@
+package videodb
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/fsv"
+	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
+	"github.com/cyclopcam/cyclops/server/defs"
+	"github.com/cyclopcam/logs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteOldEventsOfVirtualCamera(t *testing.T) {
+	root := "temptest-virtual"
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+	vdb, err := NewVideoDB(logs.NewTestingLog(t), root, nil, "", Encryption{})
+	require.NoError(t, err)
+
+	// Footage is recorded by "cam1". The virtual camera "virt1" is a crop of it.
+	base := time.Now().Add(-10 * time.Hour).Truncate(time.Second)
+	nalus := []fsv.NALU{}
+	for _, n := range rf1.CreateTestNALUs(base, 0, 50, 10, 100, 200, 3) {
+		nalus = append(nalus, fsv.NALU{PTS: n.PTS, Flags: fsv.NALUFlags(n.Flags), Payload: n.Payload})
+	}
+	stream := VideoStreamNameForCamera("cam1", defs.ResHD)
+	require.NoError(t, vdb.Archive.Write(stream, map[string]fsv.TrackPayload{"video": fsv.MakeVideoPayload(rf1.CodecH264, 320, 240, nalus)}))
+	vdb.Close()
+	vdb, err = NewVideoDB(logs.NewTestingLog(t), root, nil, "", Encryption{})
+	require.NoError(t, err)
+	defer vdb.Close()
+
+	// One event of virt1 is before the footage, and one is during it.
+	// "virt2" has no parent, so none of its events have video.
+	for _, camera := range []string{"virt1", "virt2"} {
+		w, err := vdb.NewReanalysisWriter(camera, base.Add(-2*time.Hour), true, 0)
+		require.NoError(t, err)
+		reanalysisTestObject(t, w, 1, "person", base.Add(-time.Hour), 2)
+		require.NoError(t, w.Commit(base.Add(-time.Hour+time.Minute), false))
+		reanalysisTestObject(t, w, 2, "person", base.Add(time.Second), 2)
+		require.NoError(t, w.Commit(base.Add(time.Minute), true))
+	}
+	numEvents := func(camera string) int {
+		events, err := vdb.ReadEvents(camera, base.Add(-2*time.Hour), base.Add(time.Hour))
+		require.NoError(t, err)
+		return len(events)
+	}
+
+	// Nothing is deleted until we know which cameras are virtual
+	require.NoError(t, vdb.deleteOldEventsFromDB())
+	require.Equal(t, 2, numEvents("virt1"))
+	require.Equal(t, 2, numEvents("virt2"))
+
+	vdb.SetVirtualCameras(map[string]string{"virt1": "cam1"})
+	require.NoError(t, vdb.deleteOldEventsFromDB())
+	require.Equal(t, 1, numEvents("virt1"))
+	require.Equal(t, 0, numEvents("virt2"))
+}
@@ -0,0 +1,153 @@
+package videodb
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/kibi"
+	"github.com/cyclopcam/cyclops/pkg/videoformat/fsv"
+	"github.com/cyclopcam/cyclops/server/defs"
+	"github.com/cyclopcam/dbh"
+)
+
+var ErrHoldQuotaExceeded = errors.New("Held footage would exceed the storage limit for holds")
+
+// Set the maximum total size of footage that may be protected by holds.
+// This limit is separate from the archive's size limit, because held footage
+// does not count towards that. Zero = no limit.
+func (v *VideoDB) SetMaxHeldSize(maxSize int64) {
+	v.holdLock.Lock()
+	defer v.holdLock.Unlock()
+	v.maxHeldSize = maxSize
+}
+
+// Returns the total size of the footage that is protected by active holds, and the limit
+func (v *VideoDB) HeldSize() (size, limit int64) {
+	v.holdLock.Lock()
+	defer v.holdLock.Unlock()
+	return v.Archive.HeldSize(v.Archive.ActiveHolds(time.Now())), v.maxHeldSize
+}
+
+// Protect a time range of a camera's recordings from deletion.
+// If 'expires' is zero, then the hold lasts until it is released.
+// Returns ErrHoldQuotaExceeded if the held footage would exceed the limit set by SetMaxHeldSize.
+func (v *VideoDB) CreateHold(camera string, start, end, expires time.Time, reason string, userID int64) (*Hold, error) {
+	if !start.Before(end) {
+		return nil, fmt.Errorf("Hold start time must be before end time")
+	}
+	now := time.Now()
+	if !expires.IsZero() && !expires.After(now) {
+		return nil, fmt.Errorf("Hold expiry time must be in the future")
+	}
+	cameraID, err := v.StringToID(camera)
+	if err != nil {
+		return nil, err
+	}
+
+	v.holdLock.Lock()
+	defer v.holdLock.Unlock()
+
+	if v.maxHeldSize != 0 {
+		holds := append(v.Archive.ActiveHolds(now), holdToFsv(camera, start, end, expires))
+		if size := v.Archive.HeldSize(holds); size > v.maxHeldSize {
+			return nil, fmt.Errorf("%w (%v > %v)", ErrHoldQuotaExceeded, kibi.FormatBytes(size), kibi.FormatBytes(v.maxHeldSize))
+		}
+	}
+
+	hold := &Hold{
+		Camera:    cameraID,
+		StartTime: dbh.MakeIntTime(start),
+		EndTime:   dbh.MakeIntTime(end),
+		ExpiresAt: dbh.MakeIntTime(expires),
+		Reason:    reason,
+		CreatedBy: userID,
+		CreatedAt: dbh.MakeIntTime(now),
+	}
+	if err := v.db.Create(hold).Error; err != nil {
+		return nil, err
+	}
+	v.log.Infof("User %v placed hold %v on camera %v from %v to %v (%v)", userID, hold.ID, camera, start, end, reason)
+	if err := v.applyHoldsHaveLock(); err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// Release a hold, so that the footage can be deleted by the normal retention rules.
+// The hold record remains in the DB, for auditing.
+func (v *VideoDB) ReleaseHold(id, userID int64) error {
+	v.holdLock.Lock()
+	defer v.holdLock.Unlock()
+
+	hold := Hold{}
+	if err := v.db.First(&hold, id).Error; err != nil {
+		return err
+	}
+	if !hold.ReleasedAt.IsZero() {
+		return fmt.Errorf("Hold %v was already released", id)
+	}
+	hold.ReleasedBy = userID
+	hold.ReleasedAt = dbh.MakeIntTime(time.Now())
+	if err := v.db.Save(&hold).Error; err != nil {
+		return err
+	}
+	v.log.Infof("User %v released hold %v", userID, id)
+	return v.applyHoldsHaveLock()
+}
+
+// Read the holds of a camera, or of all cameras if camera is empty.
+// If includeInactive is false, then released and expired holds are omitted.
+func (v *VideoDB) ReadHolds(camera string, includeInactive bool) ([]*Hold, error) {
+	q := v.db.Order("start_time")
+	if camera != "" {
+		cameraID, err := v.StringToID(camera)
+		if err != nil {
+			return nil, err
+		}
+		q = q.Where("camera = ?", cameraID)
+	}
+	if !includeInactive {
+		q = q.Where("released_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", time.Now().UnixMilli())
+	}
+	holds := []*Hold{}
+	if err := q.Find(&holds).Error; err != nil {
+		return nil, err
+	}
+	return holds, nil
+}
+
+// Load the active holds from the DB into the archive
+func (v *VideoDB) applyHolds() error {
+	v.holdLock.Lock()
+	defer v.holdLock.Unlock()
+	return v.applyHoldsHaveLock()
+}
+
+func (v *VideoDB) applyHoldsHaveLock() error {
+	holds, err := v.ReadHolds("", false)
+	if err != nil {
+		return err
+	}
+	fsvHolds := []fsv.Hold{}
+	for _, h := range holds {
+		camera, err := v.IDToString(h.Camera)
+		if err != nil {
+			return err
+		}
+		fsvHolds = append(fsvHolds, holdToFsv(camera, h.StartTime.Get(), h.EndTime.Get(), h.ExpiresAt.Get()))
+	}
+	return v.Archive.SetHolds(fsvHolds)
+}
+
+func holdToFsv(camera string, start, end, expires time.Time) fsv.Hold {
+	return fsv.Hold{
+		Streams: []string{
+			VideoStreamNameForCamera(camera, defs.ResLD),
+			VideoStreamNameForCamera(camera, defs.ResHD),
+		},
+		Start:   start,
+		End:     end,
+		Expires: expires,
+	}
+}
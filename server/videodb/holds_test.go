@@ -0,0 +1,71 @@
+package videodb
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/videoformat/fsv"
+	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
+	"github.com/cyclopcam/cyclops/server/defs"
+	"github.com/cyclopcam/logs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHolds(t *testing.T) {
+	root := "temptest-holds"
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+	vdb, err := NewVideoDB(logs.NewTestingLog(t), root, nil, "", Encryption{})
+	require.NoError(t, err)
+
+	// Write two files of footage for the HD stream of camera "cam1"
+	base := time.Now().Add(-10 * time.Hour)
+	stream := VideoStreamNameForCamera("cam1", defs.ResHD)
+	for i, seed := range []int{3, 5} {
+		nalus := []fsv.NALU{}
+		for _, n := range rf1.CreateTestNALUs(base.Add(time.Duration(i)*1000*time.Second), 0, 50, 10, 100, 200, seed) {
+			nalus = append(nalus, fsv.NALU{PTS: n.PTS, Flags: fsv.NALUFlags(n.Flags), Payload: n.Payload})
+		}
+		require.NoError(t, vdb.Archive.Write(stream, map[string]fsv.TrackPayload{"video": fsv.MakeVideoPayload(rf1.CodecH264, 320, 240, nalus)}))
+	}
+
+	// Re-open, so that the footage is flushed to disk
+	vdb.Close()
+	vdb, err = NewVideoDB(logs.NewTestingLog(t), root, nil, "", Encryption{})
+	require.NoError(t, err)
+	defer vdb.Close()
+
+	_, err = vdb.CreateHold("cam1", base.Add(time.Second), base, time.Time{}, "backwards", 1)
+	require.Error(t, err)
+
+	// A tiny quota is exceeded by any held footage
+	vdb.SetMaxHeldSize(1)
+	_, err = vdb.CreateHold("cam1", base, base.Add(time.Second), time.Time{}, "incident 42", 1)
+	require.ErrorIs(t, err, ErrHoldQuotaExceeded)
+
+	vdb.SetMaxHeldSize(0)
+	hold, err := vdb.CreateHold("cam1", base, base.Add(time.Second), time.Time{}, "incident 42", 1)
+	require.NoError(t, err)
+	require.Len(t, vdb.Archive.Holds(), 1)
+	size, _ := vdb.HeldSize()
+	require.NotZero(t, size)
+
+	holds, err := vdb.ReadHolds("cam1", false)
+	require.NoError(t, err)
+	require.Len(t, holds, 1)
+	require.Equal(t, "incident 42", holds[0].Reason)
+
+	// Release the hold. It remains in the DB for auditing.
+	require.NoError(t, vdb.ReleaseHold(hold.ID, 2))
+	require.Error(t, vdb.ReleaseHold(hold.ID, 2))
+	require.Len(t, vdb.Archive.Holds(), 0)
+	holds, err = vdb.ReadHolds("cam1", false)
+	require.NoError(t, err)
+	require.Len(t, holds, 0)
+	holds, err = vdb.ReadHolds("", true)
+	require.NoError(t, err)
+	require.Len(t, holds, 1)
+	require.Equal(t, int64(2), holds[0].ReleasedBy)
+	require.False(t, holds[0].IsActive(time.Now()))
+}
@@ -43,5 +43,29 @@ func Migrations(log logs.Log) []migration.Migrator {
 		CREATE TABLE kv(key TEXT PRIMARY KEY, value TEXT);
 	`))
 
+	migs = append(migs, dbh.MakeMigrationFromSQL(log, &idx,
+		`
+		CREATE TABLE hold(
+			id INTEGER PRIMARY KEY,
+			camera INT NOT NULL,
+			start_time INT NOT NULL,
+			end_time INT NOT NULL,
+			expires_at INT,
+			reason TEXT NOT NULL,
+			created_by INT NOT NULL,
+			created_at INT NOT NULL,
+			released_by INT,
+			released_at INT
+		);
+
+		CREATE INDEX idx_hold_camera ON hold (camera);
+	`))
+
+	migs = append(migs, dbh.MakeMigrationFromSQL(log, &idx,
+		`
+		ALTER TABLE event ADD COLUMN job INT;
+		CREATE INDEX idx_event_job ON event (job);
+	`))
+
 	return migs
 }
@@ -21,6 +21,7 @@ type Event struct {
 	Duration   int32                               `json:"duration"`   // Duration of event in milliseconds
 	Camera     uint32                              `json:"camera"`     // LongLived camera name (via lookup in 'strings' table)
 	Detections *dbh.JSONField[EventDetectionsJSON] `json:"detections"` // Objects detected in the event
+	Job        *int64                              `json:"job"`        // Re-analysis job that produced this event, alongside the original results. Nil for live events.
 }
 
 // Return the end time of the event.
@@ -51,6 +52,28 @@ type ObjectPositionJSON struct {
 	Confidence float32  `json:"confidence"` // NN confidence of detection (0..1)
 }
 
+// A hold protects a time range of a camera's recordings from deletion (eg a legal hold).
+// Holds are never deleted from the DB. When a hold is released, we record who released
+// it, so that there is an audit trail.
+// SYNC-VIDEODB-HOLD
+type Hold struct {
+	BaseModel
+	Camera     uint32      `json:"camera"`     // LongLived camera name (via lookup in 'strings' table)
+	StartTime  dbh.IntTime `json:"startTime"`  // Start of protected footage
+	EndTime    dbh.IntTime `json:"endTime"`    // End of protected footage
+	ExpiresAt  dbh.IntTime `json:"expiresAt"`  // Hold ends automatically at this time. Zero = never.
+	Reason     string      `json:"reason"`     // Why the footage is being preserved (eg incident number)
+	CreatedBy  int64       `json:"createdBy"`  // ID of user who created the hold
+	CreatedAt  dbh.IntTime `json:"createdAt"`  // Time when the hold was created
+	ReleasedBy int64       `json:"releasedBy"` // ID of user who released the hold
+	ReleasedAt dbh.IntTime `json:"releasedAt"` // Time when the hold was released. Zero = not released.
+}
+
+// Returns true if the hold protects footage at 'now'
+func (h *Hold) IsActive(now time.Time) bool {
+	return h.ReleasedAt.IsZero() && (h.ExpiresAt.IsZero() || now.Before(h.ExpiresAt.Get()))
+}
+
 // SYNC-EVENT-TILE-JSON
 type EventTile struct {
 	Camera uint32 `gorm:"primaryKey;autoIncrement:false" json:"camera"` // LongLived camera name (via lookup in 'strings' table)
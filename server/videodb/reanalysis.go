@@ -0,0 +1,326 @@
+package videodb
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ReanalysisWriter writes the results of re-analyzing a camera's recorded footage (eg after
+// upgrading the NN model) into the event and event_tile tables.
+//
+// ObjectDetected() receives detections in real time, and decides when to write them
+// by the wall clock. Re-analysis runs through the footage much faster (or slower) than
+// real time, so the writer keeps its own set of objects, and its decisions are driven
+// by the time of the footage.
+//
+// In replace mode, the original events and tile bits of the footage are removed as the
+// writer progresses through the footage, so if re-analysis is stopped early, then the
+// footage before that point has the new results, and the footage after it has the
+// original results. Otherwise, the new results are stored alongside the original results.
+// Those events are marked with the job ID, so that ReadEvents excludes them, and they
+// don't set tile bits, so that the timeline only shows the original results. They can be
+// read with ReadJobEvents, and removed with DeleteJobEvents.
+type ReanalysisWriter struct {
+	v            *VideoDB
+	camera       uint32
+	replace      bool
+	job          int64
+	start        time.Time                 // Start of the footage
+	replacedUpTo time.Time                 // In replace mode, the original results before this time have been removed
+	objects      map[uint32]*TrackedObject // Objects that have not been written to an Event yet
+	written      []reanalyzedSpan          // Objects that have been written to an Event
+	latest       time.Time                 // Time of the most recent detection
+
+	NumEvents  int // Number of Event records written
+	NumObjects int // Number of objects written
+}
+
+// Time span of an object that has been written to an Event
+type reanalyzedSpan struct {
+	class     uint32
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+// Create a writer for the results of re-analyzing the footage of a camera, from 'start' onwards.
+// If replace is true, then the original results are removed as the writer progresses through the footage.
+// Otherwise, the new events are marked with 'job', which must be unique to this re-analysis.
+func (v *VideoDB) NewReanalysisWriter(camera string, start time.Time, replace bool, job int64) (*ReanalysisWriter, error) {
+	if !replace && job <= 0 {
+		return nil, fmt.Errorf("Re-analysis results that are stored alongside the original results need a job ID")
+	}
+	cameraID, err := v.StringToID(camera)
+	if err != nil {
+		return nil, err
+	}
+	return &ReanalysisWriter{
+		v:            v,
+		camera:       cameraID,
+		replace:      replace,
+		job:          job,
+		start:        start,
+		replacedUpTo: start,
+		objects:      map[uint32]*TrackedObject{},
+	}, nil
+}
+
+// Add detections of an object. The parameters are the same as for VideoDB.ObjectDetected.
+func (w *ReanalysisWriter) ObjectDetected(cameraResolution [2]int, id uint32, detections []TrackedBox, class string) error {
+	obj := w.objects[id]
+	if obj == nil {
+		classID, err := w.v.StringToID(class)
+		if err != nil {
+			return err
+		}
+		obj = &TrackedObject{
+			ID:               id,
+			Camera:           w.camera,
+			CameraResolution: cameraResolution,
+			Class:            classID,
+		}
+		w.objects[id] = obj
+	}
+	obj.addDetections(detections)
+	if obj.LastSeen.After(w.latest) {
+		w.latest = obj.LastSeen
+	}
+	return nil
+}
+
+// Write the objects that are complete, and in replace mode, remove the original results up to 'upTo'.
+// upTo is the time up to which the footage has been analyzed.
+// If final is true, then all objects are written, because no more detections will follow.
+func (w *ReanalysisWriter) Commit(upTo time.Time, final bool) error {
+	// New events must not start at or after replacedUpTo, otherwise the next Commit would remove them
+	if !upTo.After(w.latest) {
+		upTo = w.latest.Add(time.Millisecond)
+	}
+
+	tx := w.v.db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	defer tx.Rollback()
+
+	if w.replace && upTo.After(w.replacedUpTo) {
+		if err := w.removeOriginals(tx, upTo); err != nil {
+			return err
+		}
+	}
+
+	var event *Event
+	if len(w.objects) != 0 && (final || w.mustFlush(upTo)) {
+		event, _ = buildEventRecordFromObjects(w.camera, w.objects)
+		if !w.replace {
+			event.Job = &w.job
+		}
+		if err := tx.Create(event).Error; err != nil {
+			return err
+		}
+		if w.replace {
+			for _, obj := range w.objects {
+				span := reanalyzedSpan{class: obj.Class}
+				span.firstSeen, span.lastSeen = obj.TimeBounds()
+				if err := w.setSpanBits(tx, span); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	if upTo.After(w.replacedUpTo) {
+		w.replacedUpTo = upTo
+		w.forgetOldSpans()
+	}
+	if event != nil {
+		if w.replace {
+			for _, obj := range w.objects {
+				span := reanalyzedSpan{class: obj.Class}
+				span.firstSeen, span.lastSeen = obj.TimeBounds()
+				w.written = append(w.written, span)
+			}
+		}
+		w.NumEvents++
+		w.NumObjects += len(w.objects)
+		w.objects = map[uint32]*TrackedObject{}
+	}
+	return nil
+}
+
+// Forget the written spans that can no longer touch the bits that removeOriginals clears.
+// Those bits all start at or after replacedUpTo, and the widest bit covers 2^maxTileLevel seconds,
+// so a span that ends at least that long before replacedUpTo is never needed again.
+// Without this, a long job would have to walk over every object that it had ever written, on every commit.
+func (w *ReanalysisWriter) forgetOldSpans() {
+	cutoff := w.replacedUpTo.Unix() - (1 << w.v.maxTileLevel)
+	w.written = slices.DeleteFunc(w.written, func(span reanalyzedSpan) bool {
+		return span.lastSeen.Unix() < cutoff
+	})
+}
+
+// Returns true if our objects must be written to an Event record.
+// These are the same rules as writeAgingEventsToDB, but with the time of the footage instead of the wall clock.
+func (w *ReanalysisWriter) mustFlush(now time.Time) bool {
+	nStale := 0
+	nBoxes := 0
+	for _, obj := range w.objects {
+		firstSeen, lastSeen := obj.TimeBounds()
+		if now.Sub(lastSeen) > eventStaleTimeout {
+			nStale++
+		}
+		if now.Sub(firstSeen) > eventOldTimeout {
+			return true
+		}
+		nBoxes += len(obj.Boxes)
+	}
+	return nStale == len(w.objects) || nBoxes > eventMaxFrames
+}
+
+// Remove the original events and tile bits from replacedUpTo to upTo.
+//
+// A tile bit covers 2^level seconds, so at the higher levels, a bit often straddles the boundary of
+// the footage that has been analyzed. We only clear the bits that lie entirely inside the footage
+// that has been analyzed (from the very start), because the other parts of a straddling bit are still
+// described by the original results. After clearing the bits, we set them again for the objects that
+// we've already written, because those objects may have set them.
+func (w *ReanalysisWriter) removeOriginals(tx *gorm.DB, upTo time.Time) error {
+	if err := tx.Exec("DELETE FROM event WHERE camera = ? AND time >= ? AND time < ? AND job IS NULL", w.camera, w.replacedUpTo.UnixMilli(), upTo.UnixMilli()).Error; err != nil {
+		return err
+	}
+
+	firstWholeSecond := uint32(w.start.Unix())
+	if w.start.Nanosecond() != 0 {
+		firstWholeSecond++
+	}
+	for level := uint32(0); level <= uint32(w.v.maxTileLevel); level++ {
+		// All bits in [start, end) lie entirely inside the footage that has been analyzed,
+		// and the bits before end lie entirely inside the footage of previous commits.
+		start := max((firstWholeSecond+(1<<level)-1)>>level, uint32(w.replacedUpTo.Unix())>>level)
+		end := uint32(upTo.Unix()) >> level
+		if start >= end {
+			continue
+		}
+		err := w.v.modifyTileBits(tx, w.camera, level, start, end, func(tb *tileBuilder, start, end uint32) error {
+			for _, line := range tb.classes {
+				line.clearBitRange(start, end)
+			}
+			tb.removeEmptyLines()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, span := range w.written {
+			if err := w.setSpanBitsAtLevel(tx, span, level, start, end); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Delete the events that a re-analysis job stored alongside the original results.
+// Returns the number of events deleted.
+func (v *VideoDB) DeleteJobEvents(job int64) (int64, error) {
+	res := v.db.Exec("DELETE FROM event WHERE job = ?", job)
+	return res.RowsAffected, res.Error
+}
+
+// Returns the highest job ID of the events that re-analysis jobs have stored alongside the original results,
+// or zero if there are none. Job IDs must be higher than this, so that their results aren't mixed up.
+func (v *VideoDB) MaxEventJob() (int64, error) {
+	maxJob := int64(0)
+	err := v.db.Raw("SELECT COALESCE(MAX(job), 0) FROM event").Scan(&maxJob).Error
+	return maxJob, err
+}
+
+// Set the tile bits of the object's span, at every level
+func (w *ReanalysisWriter) setSpanBits(tx *gorm.DB, span reanalyzedSpan) error {
+	for level := uint32(0); level <= uint32(w.v.maxTileLevel); level++ {
+		if err := w.setSpanBitsAtLevel(tx, span, level, 0, 0xffffffff); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Set the tile bits of the object's span at one level, limited to the bits [minBit, maxBit)
+func (w *ReanalysisWriter) setSpanBitsAtLevel(tx *gorm.DB, span reanalyzedSpan, level, minBit, maxBit uint32) error {
+	start := max(uint32(span.firstSeen.Unix())>>level, minBit)
+	end := min(uint32(span.lastSeen.Unix())>>level+1, maxBit)
+	if start >= end {
+		return nil
+	}
+	return w.v.modifyTileBits(tx, w.camera, level, start, end, func(tb *tileBuilder, start, end uint32) error {
+		line, err := tb.getBitmapForClass(span.class)
+		if err != nil {
+			w.v.log.Warnf("Failed to update event tile: %v", err)
+			return nil
+		}
+		line.setBitRange(start, end, nil)
+		return nil
+	})
+}
+
+// Run 'modify' on the camera's tiles at the given level, which overlap the bits [start, end).
+// A bit index here is seconds >> level, so tile N holds the bits [N * TileWidth, (N+1) * TileWidth).
+// 'modify' receives the range of bits inside the tile.
+// Tiles that the tile writer is holding in memory are modified there, otherwise the tile
+// writer would overwrite our changes the next time that it writes the tile.
+func (v *VideoDB) modifyTileBits(tx *gorm.DB, camera, level, start, end uint32, modify func(tb *tileBuilder, start, end uint32) error) error {
+	for tileIdx := start / TileWidth; tileIdx <= (end-1)/TileWidth; tileIdx++ {
+		base := tileIdx * TileWidth
+		tileStart := max(start, base) - base
+		tileEnd := min(end, base+TileWidth) - base
+		if err := v.modifyTile(tx, camera, level, tileIdx, func(tb *tileBuilder) error {
+			return modify(tb, tileStart, tileEnd)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *VideoDB) modifyTile(tx *gorm.DB, camera, level, tileIdx uint32, modify func(tb *tileBuilder) error) error {
+	// We hold the lock while we modify the DB, so that the tile writer can't create the tile in the meantime
+	v.currentTilesLock.Lock()
+	defer v.currentTilesLock.Unlock()
+
+	if levels := v.currentTiles[camera]; int(level) < len(levels) {
+		for _, tb := range levels[level] {
+			if tb.tileIdx == tileIdx {
+				if err := modify(tb); err != nil {
+					return err
+				}
+				tb.updateTick++
+				return nil
+			}
+		}
+	}
+
+	tb, err := v.loadAndDecodeTile(tx, camera, level, tileIdx)
+	exists := err == nil
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		tb = newTileBuilder(level, tileIdxToTime(tileIdx, level), int(v.maxClassesPerTile.Load()))
+	} else if err != nil {
+		return err
+	}
+	if err := modify(tb); err != nil {
+		return err
+	}
+	if tb.isEmpty() {
+		if exists {
+			return tx.Exec("DELETE FROM event_tile WHERE camera = ? AND level = ? AND start = ?", camera, level, tileIdx).Error
+		}
+		return nil
+	}
+	return v.upsertTile(tx, camera, tb)
+}
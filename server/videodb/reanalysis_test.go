@@ -0,0 +1,127 @@
+package videodb
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cyclopcam/cyclops/pkg/nn"
+	"github.com/cyclopcam/logs"
+	"github.com/stretchr/testify/require"
+)
+
+func reanalysisTestObject(t *testing.T, w *ReanalysisWriter, id uint32, class string, start time.Time, seconds int) {
+	for i := 0; i <= seconds; i++ {
+		box := TrackedBox{Time: start.Add(time.Duration(i) * time.Second), Box: nn.MakeRect(10*i, 10, 20, 20), Confidence: 0.9}
+		require.NoError(t, w.ObjectDetected([2]int{320, 240}, id, []TrackedBox{box}, class))
+	}
+}
+
+func TestReanalysisWriter(t *testing.T) {
+	root := "temptest-reanalysis"
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+	vdb, err := NewVideoDB(logs.NewTestingLog(t), root, nil, "", Encryption{})
+	require.NoError(t, err)
+	defer vdb.Close()
+
+	// Start at the beginning of a level 1 tile, two days ago
+	base := time.Unix(time.Now().Add(-48*time.Hour).Unix()/(2*TileWidth)*(2*TileWidth), 0)
+	tileIdx := timeToTileIdx(base, 0)
+	ids, err := vdb.StringsToID([]string{"cam1", "car", "person"})
+	require.NoError(t, err)
+	camera, car, person := ids[0], ids[1], ids[2]
+
+	_, err = vdb.NewReanalysisWriter("cam1", base, false, 0)
+	require.Error(t, err)
+
+	// The original results: two cars
+	w, err := vdb.NewReanalysisWriter("cam1", base, true, 0)
+	require.NoError(t, err)
+	reanalysisTestObject(t, w, 1, "car", base.Add(100*time.Second), 10)
+	require.NoError(t, w.Commit(base.Add(150*time.Second), false))
+	require.Equal(t, 1, w.NumEvents)
+	reanalysisTestObject(t, w, 2, "car", base.Add(700*time.Second), 5)
+	require.NoError(t, w.Commit(base.Add(800*time.Second), true))
+	require.Equal(t, 2, w.NumEvents)
+	require.Equal(t, 2, w.NumObjects)
+	verifyTileBitsInDB(t, vdb, camera, 0, tileIdx, map[uint32]string{car: "100-111,700-706"})
+	verifyTileBitsInDB(t, vdb, camera, 1, tileIdx/2, map[uint32]string{car: "50-56,350-353"})
+
+	// Re-analysis of the first 600 seconds finds a person instead of the first car
+	w, err = vdb.NewReanalysisWriter("cam1", base, true, 0)
+	require.NoError(t, err)
+	reanalysisTestObject(t, w, 3, "person", base.Add(200*time.Second), 10)
+	require.NoError(t, w.Commit(base.Add(300*time.Second), false))
+	require.Equal(t, 1, w.NumEvents)
+	require.NoError(t, w.Commit(base.Add(600*time.Second), true))
+
+	events, err := vdb.ReadEvents("cam1", base, base.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	classes := []uint32{}
+	for _, e := range events {
+		for _, obj := range e.Detections.Data.Objects {
+			classes = append(classes, obj.Class)
+		}
+	}
+	require.ElementsMatch(t, []uint32{person, car}, classes)
+
+	// The bits of the first car are gone, but the second car is beyond the re-analyzed footage
+	verifyTileBitsInDB(t, vdb, camera, 0, tileIdx, map[uint32]string{person: "200-211", car: "700-706"})
+	verifyTileBitsInDB(t, vdb, camera, 1, tileIdx/2, map[uint32]string{person: "100-106", car: "350-353"})
+
+	// Re-analysis alongside the original results finds a car where the person was.
+	// Its events are only visible when asking for the job, and they don't touch the tile bits.
+	maxJob, err := vdb.MaxEventJob()
+	require.NoError(t, err)
+	require.Equal(t, int64(0), maxJob)
+	w, err = vdb.NewReanalysisWriter("cam1", base, false, 7)
+	require.NoError(t, err)
+	reanalysisTestObject(t, w, 4, "car", base.Add(200*time.Second), 10)
+	require.NoError(t, w.Commit(base.Add(600*time.Second), true))
+	require.Equal(t, 1, w.NumEvents)
+
+	events, err = vdb.ReadEvents("cam1", base, base.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	jobEvents, err := vdb.ReadJobEvents("cam1", 7, base, base.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, jobEvents, 1)
+	require.Equal(t, int64(7), *jobEvents[0].Job)
+	require.Equal(t, car, jobEvents[0].Detections.Data.Objects[0].Class)
+	maxJob, err = vdb.MaxEventJob()
+	require.NoError(t, err)
+	require.Equal(t, int64(7), maxJob)
+	verifyTileBitsInDB(t, vdb, camera, 0, tileIdx, map[uint32]string{person: "200-211", car: "700-706"})
+
+	// Replacing the original results leaves the job's results alone
+	w, err = vdb.NewReanalysisWriter("cam1", base, true, 0)
+	require.NoError(t, err)
+	require.NoError(t, w.Commit(base.Add(300*time.Second), true))
+	events, err = vdb.ReadEvents("cam1", base, base.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	jobEvents, err = vdb.ReadJobEvents("cam1", 7, base, base.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, jobEvents, 1)
+
+	n, err := vdb.DeleteJobEvents(7)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), n)
+	jobEvents, err = vdb.ReadJobEvents("cam1", 7, base, base.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, jobEvents, 0)
+
+	// Spans that are too old to touch the bits of later commits are forgotten
+	topBit := time.Duration(1<<vdb.maxTileLevel) * time.Second
+	w, err = vdb.NewReanalysisWriter("cam1", base, true, 0)
+	require.NoError(t, err)
+	reanalysisTestObject(t, w, 5, "person", base.Add(200*time.Second), 10)
+	require.NoError(t, w.Commit(base.Add(300*time.Second), false))
+	require.Len(t, w.written, 1)
+	require.NoError(t, w.Commit(base.Add(210*time.Second+topBit), false))
+	require.Len(t, w.written, 1)
+	require.NoError(t, w.Commit(base.Add(212*time.Second+topBit), false))
+	require.Len(t, w.written, 0)
+}
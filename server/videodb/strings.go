@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/cyclopcam/cyclops/server/defs"
 	"gorm.io/gorm"
@@ -15,6 +16,17 @@ func VideoStreamNameForCamera(cameraLongLivedName string, resolution defs.Resolu
 	return filepath.Clean(cameraLongLivedName + "-" + string(resolution))
 }
 
+// Inverse of VideoStreamNameForCamera.
+// Returns false if the stream name does not end with a known resolution.
+func CameraForVideoStreamName(streamName string) (string, defs.Resolution, bool) {
+	for _, res := range defs.AllResolutions {
+		if camera, ok := strings.CutSuffix(streamName, "-"+string(res)); ok {
+			return camera, res, true
+		}
+	}
+	return "", "", false
+}
+
 // Get a database-wide unique ID for the given string.
 // At some point we should implement a cleanup method that gets rid of strings that are no longer used.
 // It is beneficial to keep the IDs small, because smaller numbers produce smaller DB records due to
@@ -83,6 +83,25 @@ func (b *bitmapLine) setBitRange(start, end uint32, nBitsChanged *int) {
 	}
 }
 
+// Sets all bits in the range [start, end) to 0.
+func (b *bitmapLine) clearBitRange(start, end uint32) {
+	if start > end || end > uint32(len(b))*8 {
+		panic(fmt.Sprintf("clearBitRange: out of bounds: start=%v, end=%v", start, end))
+	}
+	for i := start; i < end; i++ {
+		b[i/8] &^= 1 << (i % 8)
+	}
+}
+
+func (b *bitmapLine) isEmpty() bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 func (b *bitmapLine) formatRange(start, end int) string {
 	s := make([]byte, 0, end-start)
 	for i := uint32(start); i < uint32(end); i++ {
@@ -202,6 +221,15 @@ func (b *tileBuilder) updateObject(obj *TrackedObject) error {
 	return nil
 }
 
+// Remove the lines of classes that have no bits set
+func (b *tileBuilder) removeEmptyLines() {
+	for cls, line := range b.classes {
+		if line.isEmpty() {
+			delete(b.classes, cls)
+		}
+	}
+}
+
 // The only error that this function can return is ErrTooManyClasses
 func (b *tileBuilder) getBitmapForClass(cls uint32) (*bitmapLine, error) {
 	bmp := b.classes[cls]
@@ -116,7 +116,7 @@ func (v *VideoDB) buildHigherTilesForCamera(tx *gorm.DB, camera, startTileIdx ui
 			if v.debugTileLevelBuild {
 				v.log.Infof("Merging tiles %v,%v,%v and %v,%v,%v into %v,%v", camera, level-1, tileIdx*2, camera, level-1, tileIdx*2+1, level, tileIdx)
 			}
-			mergedBuiler, err := mergeTileBuilders(tileIdx, level, children[0], children[1], v.maxClassesPerTile)
+			mergedBuiler, err := mergeTileBuilders(tileIdx, level, children[0], children[1], int(v.maxClassesPerTile.Load()))
 			if err != nil {
 				v.log.Errorf("Failed to merge tile blobs: %v", err)
 				continue
@@ -144,7 +144,7 @@ func (v *VideoDB) loadAndDecodeTile(tx *gorm.DB, camera, level, tileIdx uint32)
 		}
 		return nil, err
 	}
-	return readBlobIntoTileBuilder(tile.Start, tile.Level, tile.Tile, v.maxClassesPerTile, 0)
+	return readBlobIntoTileBuilder(tile.Start, tile.Level, tile.Tile, int(v.maxClassesPerTile.Load()), 0)
 }
 
 // This is run once at startup, in case we've been offline for a long time.
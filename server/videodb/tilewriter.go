@@ -60,6 +60,22 @@ func maxTileIdxAtLevel0(oldTiles map[uint32][]*tileBuilder) uint32 {
 	return maxIdx
 }
 
+// Raise the number of classes that we'll store in a tile, so that a tile can hold every class
+// that the monitor is able to emit. The limit never drops below the default.
+func (v *VideoDB) SetMaxClassesPerTile(n int) {
+	n = max(n, defaultMaxClassesPerTile)
+	v.currentTilesLock.Lock()
+	defer v.currentTilesLock.Unlock()
+	v.maxClassesPerTile.Store(int32(n))
+	for _, levels := range v.currentTiles {
+		for _, level := range levels {
+			for _, tile := range level {
+				tile.maxClasses = n
+			}
+		}
+	}
+}
+
 // Write all in-memory tiles to the database.
 // This is called periodically (eg once a minute).
 func (v *VideoDB) writeAllCurrentTiles() {
@@ -256,7 +272,7 @@ func (v *VideoDB) resumeLatestTiles() {
 			return
 		}
 		for _, tile := range tiles {
-			tb, err := readBlobIntoTileBuilder(tile.Start, tile.Level, tile.Tile, v.maxClassesPerTile, 0)
+			tb, err := readBlobIntoTileBuilder(tile.Start, tile.Level, tile.Tile, int(v.maxClassesPerTile.Load()), 0)
 			if err != nil {
 				v.log.Errorf("Failed to read tile blob camera:%v level:%v start:%v for resume: %v", tile.Camera, tile.Level, tile.Start, err)
 				continue
@@ -337,7 +353,7 @@ func (v *VideoDB) updateTileWithNewDetection(level, tileIdx uint32, obj *Tracked
 		}
 	}
 	if builder == nil {
-		builder = newTileBuilder(level, tileIdxToTime(tileIdx, level), v.maxClassesPerTile)
+		builder = newTileBuilder(level, tileIdxToTime(tileIdx, level), int(v.maxClassesPerTile.Load()))
 		levelsForCamera[level] = append(levelsForCamera[level], builder)
 	}
 	if err := builder.updateObject(obj); err != nil {
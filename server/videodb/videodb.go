@@ -6,13 +6,20 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/cyclopcam/cyclops/pkg/videoformat/fsv"
+	"github.com/cyclopcam/cyclops/pkg/videoformat/rf1"
 	"github.com/cyclopcam/dbh"
 	"github.com/cyclopcam/logs"
 	"gorm.io/gorm"
 )
 
+// Arbitrary constant to prevent terrible performance in pathological cases.
+// The monitor only emits the classes that it tracks, so this is normally plenty.
+const defaultMaxClassesPerTile = 30
+
 // VideoDB manages recordings
 type VideoDB struct {
 	// Root directory
@@ -24,11 +31,11 @@ type VideoDB struct {
 
 	log                   logs.Log
 	db                    *gorm.DB
-	shutdown              chan bool // This channel is closed when its time to shutdown
-	writeThreadClosed     chan bool // The write thread closes this channel when it exits
-	tileWriteThreadClosed chan bool // The tile write thread closes this channel when it exits
-	maxClassesPerTile     int       // Max number of classes that we'll store in a tile
-	debugTileLevelBuild   bool      // Emit extra logs
+	shutdown              chan bool    // This channel is closed when its time to shutdown
+	writeThreadClosed     chan bool    // The write thread closes this channel when it exits
+	tileWriteThreadClosed chan bool    // The tile write thread closes this channel when it exits
+	maxClassesPerTile     atomic.Int32 // Max number of classes that we'll store in a tile. See SetMaxClassesPerTile()
+	debugTileLevelBuild   bool         // Emit extra logs
 	debugTileWriter       bool
 
 	// At level 13, each pixel is 8192 seconds. So a 2000 pixel screen is
@@ -48,10 +55,58 @@ type VideoDB struct {
 	// Tiles that we are building in real-time
 	currentTilesLock sync.Mutex
 	currentTiles     map[uint32][][]*tileBuilder // Key of the map is CameraID. Conceptually: currentTiles[CameraID][Level][TileIdx], although TileIdx is not a literal index into the slice.
+
+	// Guards the 'hold' table, and the holds of the archive, so that the quota check and the insert are atomic
+	holdLock    sync.Mutex
+	maxHeldSize int64 // Maximum bytes of footage protected by holds. Zero = no limit.
+
+	// A virtual camera has its own events, but no video streams. Its footage is in the streams of its parent.
+	virtualCamerasLock sync.Mutex
+	virtualCameras     map[string]string // Long lived name of a virtual camera -> long lived name of its parent. Nil until SetVirtualCameras() is called.
+}
+
+// A slower storage volume for older video
+type StorageTier struct {
+	Path   string        // Root directory of the tier
+	MinAge time.Duration // Video is moved to this tier once it is this old
 }
 
-// Open or create a video DB
-func NewVideoDB(logger logs.Log, root string) (*VideoDB, error) {
+// The fsv archive lives inside this directory of the root, and of every storage tier
+func archiveDir(root string) string {
+	return filepath.Join(root, "fsv")
+}
+
+// Prepare a storage tier for use.
+// This must be done while the tier's disk is mounted, because we refuse to write
+// to a tier that has not been initialized. Otherwise we'd fill up the empty mount
+// point of a disk that is missing.
+func InitStorageTier(path string) error {
+	return fsv.InitVolume(archiveDir(path))
+}
+
+// Returns true if the storage tier has been initialized, and its disk is mounted
+func IsStorageTierInitialized(path string) bool {
+	return fsv.IsVolumeInitialized(archiveDir(path))
+}
+
+// Encryption at rest of the video files.
+// Keys must be populated whenever any keys exist, even if Encrypt is false,
+// so that we can still read files that were recorded while encryption was enabled.
+type Encryption struct {
+	Keys    *rf1.Keyring // May be nil
+	Encrypt bool         // Encrypt new files with the current key
+}
+
+// File formats of new recordings
+const (
+	VideoFormatRF1 = "rf1"
+	VideoFormatMP4 = "mp4"
+)
+
+// Open or create a video DB.
+// If tiers is not empty, then older video is moved from root to the tiers, in order.
+// New recordings are written in the given format ("" = rf1), but recordings of either format can be read.
+func NewVideoDB(logger logs.Log, root string, tiers []StorageTier, format string, encryption Encryption) (*VideoDB, error) {
 	logsRaw := logger
 	logger = logs.NewPrefixLogger(logsRaw, "VideoDB")
 
@@ -60,7 +115,7 @@ func NewVideoDB(logger logs.Log, root string) (*VideoDB, error) {
 		return nil, fmt.Errorf("Failed to create Video DB storage path '%v': %w", root, err)
 	}
 
-	videoDir := filepath.Join(root, "fsv")
+	videoDir := archiveDir(root)
 	if err := os.Mkdir(videoDir, 0770); err != nil && !errors.Is(err, os.ErrExist) {
 		return nil, fmt.Errorf("Failed to create Video storage path '%v': %w", videoDir, err)
 	}
@@ -79,12 +134,30 @@ func NewVideoDB(logger logs.Log, root string) (*VideoDB, error) {
 	// later, and we don't remember to update that kind of thing here.
 
 	logger.Infof("Scanning Video Archive at '%v'", videoDir)
-	formats := []fsv.VideoFormat{&fsv.VideoFormatRF1{}}
+	rf1Format := &fsv.VideoFormatRF1{Keys: encryption.Keys, Encrypt: encryption.Encrypt}
+	var formats []fsv.VideoFormat
+	switch format {
+	case "", VideoFormatRF1:
+		formats = []fsv.VideoFormat{rf1Format, &fsv.VideoFormatMP4{}}
+	case VideoFormatMP4:
+		if encryption.Encrypt {
+			return nil, fmt.Errorf("Encryption is not supported by the mp4 video format")
+		}
+		formats = []fsv.VideoFormat{&fsv.VideoFormatMP4{}, rf1Format}
+	default:
+		return nil, fmt.Errorf("Unknown video format '%v'", format)
+	}
 	archiveInitSettings := fsv.DefaultStaticSettings()
 	// The following line disables the write buffer
 	//archiveInitSettings.MaxWriteBufferSize = 0
 	fsvSettings := fsv.DefaultDynamicSettings()
-	archive, err := fsv.Open(logsRaw, videoDir, formats, archiveInitSettings, fsvSettings)
+	volumes := []fsv.Volume{{Path: videoDir}}
+	for _, tier := range tiers {
+		volumes[len(volumes)-1].MaxAge = tier.MinAge
+		volumes = append(volumes, fsv.Volume{Path: archiveDir(tier.Path)})
+		logger.Infof("Storage tier at '%v' for video older than %v", tier.Path, tier.MinAge)
+	}
+	archive, err := fsv.OpenVolumes(logsRaw, volumes, formats, archiveInitSettings, fsvSettings)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to open video archive at %v: %w", videoDir, err)
 	}
@@ -102,7 +175,6 @@ func NewVideoDB(logger logs.Log, root string) (*VideoDB, error) {
 		shutdown:              make(chan bool),
 		writeThreadClosed:     make(chan bool),
 		tileWriteThreadClosed: make(chan bool),
-		maxClassesPerTile:     30, // Arbitrary constant to prevent terrible performance in pathological cases
 		maxTileLevel:          maxTileLevel,
 		current:               map[uint32]*TrackedObject{},
 		stringToID:            map[string]uint32{},
@@ -111,6 +183,11 @@ func NewVideoDB(logger logs.Log, root string) (*VideoDB, error) {
 		debugTileWriter:       false,
 		debugTileLevelBuild:   true,
 	}
+	self.maxClassesPerTile.Store(defaultMaxClassesPerTile)
+
+	if err := self.applyHolds(); err != nil {
+		logger.Errorf("Failed to load holds: %v", err)
+	}
 
 	// Now that we write tiles of all levels at a regular interval, fillMissingTiles() is no longer needed.
 	//self.fillMissingTiles(time.Now())
@@ -1,3 +1,5 @@
+import type { ClassesJSON } from "@/db/config/configdb";
+
 export type Resolution = "ld" | "hd";
 
 // SYNC-INTERNAL-CODEC-NAMES
@@ -28,6 +30,26 @@ export class StreamInfo {
 	}
 }
 
+// Result of measuring the camera's clock drift via ONVIF
+export class ClockStatus {
+	measuredAt = new Date();
+	driftSeconds = 0; // camera time minus server time
+	outOfSync = false;
+	dateTimeType = ""; // "Manual" or "NTP"
+	error = ""; // if not empty, then we failed to read the camera's clock
+
+	static fromJSON(j: any): ClockStatus {
+		let c = new ClockStatus();
+		// SYNC-CLOCK-STATUS-JSON
+		c.measuredAt = new Date(j.measuredAt);
+		c.driftSeconds = j.driftSeconds;
+		c.outOfSync = j.outOfSync;
+		c.dateTimeType = j.dateTimeType;
+		c.error = j.error;
+		return c;
+	}
+}
+
 // CameraInfo is data for a live running camera (which is separate from it's configuration data in CameraRecord)
 // See camInfoJSON in Go
 export class CameraInfo {
@@ -35,6 +57,10 @@ export class CameraInfo {
 	name = "";
 	ld!: StreamInfo;
 	hd!: StreamInfo;
+	clock: ClockStatus | null = null; // null if the server has not yet measured the camera's clock
+	parentID = 0; // Non-zero for a virtual camera, which plays its parent's streams
+	crop = ""; // Crop rectangle of a virtual camera, as normalized "x1,y1,x2,y2"
+	classes: ClassesJSON | null = null; // The camera's class config, with its overrides applied to the system config
 
 	static fromJSON(j: any): CameraInfo {
 		let c = new CameraInfo();
@@ -42,6 +68,12 @@ export class CameraInfo {
 		c.name = j.name;
 		c.ld = StreamInfo.fromJSON("ld", j.ld);
 		c.hd = StreamInfo.fromJSON("hd", j.hd);
+		if (j.clock) {
+			c.clock = ClockStatus.fromJSON(j.clock);
+		}
+		c.parentID = j.parentID ?? 0;
+		c.crop = j.crop ?? "";
+		c.classes = j.classes ?? null;
 		return c;
 	}
 }
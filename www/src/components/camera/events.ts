@@ -14,6 +14,7 @@ interface EventJSON {
 	//camera: number; // camera ID in VideoDB - DIFFERENT to regular camera ID. Which is why we comment it out, so we ignore it.
 	resolution: [number, number]; // [width, height] of camera stream on which detection was run
 	detections: EventDetectionsJSON;
+	job: number | null; // Re-analysis job that stored this event alongside the original results
 }
 
 // SYNC-VIDEODB-EVENTDETECTIONS
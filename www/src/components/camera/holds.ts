@@ -0,0 +1,75 @@
+// A hold protects a time range of a camera's recordings from deletion (eg a legal hold).
+
+// SYNC-VIDEODB-HOLD
+export interface HoldJSON {
+	id: number;
+	camera: number;
+	startTime: number; // Unix milliseconds
+	endTime: number; // Unix milliseconds
+	expiresAt: number; // Unix milliseconds (0 = never)
+	reason: string;
+	createdBy: number;
+	createdAt: number;
+	releasedBy: number;
+	releasedAt: number;
+}
+
+// SYNC-GET-HOLDS-JSON
+export interface GetHoldsJSON {
+	holds: HoldJSON[];
+	idToString: { [key: number]: string };
+	heldSize: number;
+	maxHeldSize: number;
+}
+
+class CachedHolds {
+	holds: HoldJSON[] = [];
+	fetchedAtMS = 0;
+}
+
+// Holds change rarely, so we cache the active holds of each camera, and refresh them periodically.
+export class HoldCache {
+	cameras: { [cameraID: number]: CachedHolds } = {};
+	fetching = new Set<number>();
+	maxStaleSeconds = 60;
+
+	// Return the active holds of the camera that we have in the cache.
+	// If the cache is stale, then start a fetch, and call afterFetch once it completes.
+	getHolds(cameraID: number, afterFetch?: () => void): HoldJSON[] {
+		let c = this.cameras[cameraID];
+		let nowMS = new Date().getTime();
+		if (afterFetch && (!c || nowMS - c.fetchedAtMS > this.maxStaleSeconds * 1000)) {
+			this.fetchHolds(cameraID, afterFetch);
+		}
+		return c ? c.holds : [];
+	}
+
+	// Forget the cached holds of a camera, eg after creating or releasing a hold
+	invalidate(cameraID: number) {
+		delete this.cameras[cameraID];
+	}
+
+	async fetchHolds(cameraID: number, afterFetch: () => void) {
+		if (this.fetching.has(cameraID)) {
+			return;
+		}
+		this.fetching.add(cameraID);
+		let c = new CachedHolds();
+		try {
+			let r = await fetch(`/api/holds?camera=${cameraID}`);
+			if (r.ok) {
+				let j = await r.json() as GetHoldsJSON;
+				c.holds = j.holds;
+			}
+		} catch (e) {
+			console.error("Failed to fetch holds", e);
+		}
+		// Even on failure, we record the fetch time, so that we don't hammer the server
+		c.fetchedAtMS = new Date().getTime();
+		this.cameras[cameraID] = c;
+		this.fetching.delete(cameraID);
+		afterFetch();
+	}
+}
+
+export let globalHoldCache = new HoldCache();
@@ -6,6 +6,21 @@ import { clamp, monthNamesShort, zeroPad } from "@/util/util";
 
 import { BitsPerTile, BaseSecondsPerTile, MaxTileLevel } from "./eventTile";
 import { SnapSeekState } from "./snapSeek";
+import { globalHoldCache } from "./holds";
+import type { ClassesJSON } from "@/db/config/configdb";
+import { constants } from "@/constants";
+
+// Colors of the rows of the seek bar
+const rowColors = [
+	"rgba(255, 40, 0, 1)",
+	"rgba(0, 255, 0, 1)",
+	"rgba(150, 100, 255, 1)",
+	"rgba(255, 200, 0, 1)",
+	"rgba(0, 200, 255, 1)",
+	"rgba(255, 100, 200, 1)",
+	"rgba(200, 255, 150, 1)",
+	"rgba(255, 150, 80, 1)",
+];
 
 // SeekBar draws the lines at the bottom of a video which show the moments
 // of interest when particular things were detected. For example, the bar might
@@ -29,14 +44,48 @@ export class SeekBarContext {
 
 	needsRender = false;
 	snap = new SnapSeekState();
-	classes = ["person", "car", "truck"];
-	colors = ["rgba(255, 40, 0, 1)", "rgba(0, 255, 0, 1)", "rgba(150, 100, 255, 1)"];
+	classes: string[] = []; // One row per class (which may be an abstract class, such as vehicle)
+	colors: string[] = [];
+	classRow: { [className: string]: number } = {}; // Map from NN class to index in 'classes'
 
-	constructor(cameraID = 0) {
+	// If the camera's class config is not known, then we use the system's, and failing that,
+	// one row for every class of the NN.
+	constructor(cameraID = 0, classes: ClassesJSON | null = null) {
 		this.cameraID = cameraID;
+		if (classes?.tracked) {
+			this.setClasses(classes);
+		} else if (constants.classes?.tracked) {
+			this.setClasses(constants.classes);
+		} else {
+			this.setClasses({ tracked: constants.nnClasses, merge: null, abstract: null, alarm: null });
+		}
 		this.reset();
 	}
 
+	// Create one row for each tracked class. Concrete classes are drawn in the row of their abstract
+	// class, so that tiles which were recorded with a different class config still render.
+	setClasses(classes: ClassesJSON) {
+		let abstract = classes.abstract ?? {};
+		this.classes = [];
+		this.classRow = {};
+		for (let cls of classes.tracked ?? []) {
+			let row = abstract[cls] ?? cls;
+			if (!this.classes.includes(row)) {
+				this.classes.push(row);
+			}
+		}
+		for (let i = 0; i < this.classes.length; i++) {
+			this.classRow[this.classes[i]] = i;
+		}
+		for (let cls in abstract) {
+			let row = this.classRow[abstract[cls]];
+			if (row !== undefined) {
+				this.classRow[cls] = row;
+			}
+		}
+		this.colors = this.classes.map((_, i) => rowColors[i % rowColors.length]);
+	}
+
 	// Set the end time to now
 	panToNow() {
 		this.panTimeEndMS = new Date().getTime();
@@ -133,6 +182,12 @@ export class SeekBarContext {
 		let futureX = this.timeMSToPixel(new Date().getTime(), canvasWidth, pixelsPerSecond);
 		cx.fillRect(futureX, 0, canvasWidth - futureX + 1, canvasHeight);
 
+		// Render held (protected) footage underneath everything else
+		this.renderHolds(cx, canvasHeight, canvasWidth, pixelsPerSecond, () => {
+			this.needsRender = true;
+			requestAnimationFrame(reRender);
+		});
+
 		//if (this.zoomLevel >= 10) console.log(`StartTime = ${new Date(startTimeMS).toISOString()}, EndTime = ${new Date(this.endTimeMS).toISOString()}`);
 
 		this.renderTimeMarkers(cx, canvasWidth, canvasHeight, startTimeMS, pixelsPerSecond);
@@ -194,7 +249,7 @@ export class SeekBarContext {
 		}
 		//console.log(`Render ${endTileIdx - startTileIdx} tiles at level ${bestLevel}`);
 
-		let snapClassIdx = this.classes.indexOf(this.snap.detectedClass);
+		let snapClassIdx = this.classRow[this.snap.detectedClass] ?? -1;
 		let haveSnap = snapClassIdx !== -1 && this.snap.posMS !== 0;
 
 		// Render seek bar
@@ -386,13 +441,35 @@ export class SeekBarContext {
 		}
 	}
 
+	// Held footage is protected from deletion. We shade it, and draw a line along the top.
+	renderHolds(cx: CanvasRenderingContext2D, canvasHeight: number, canvasWidth: number, pixelsPerSecond: number, onFetched: () => void) {
+		let dpr = window.devicePixelRatio;
+		let nowMS = new Date().getTime();
+		for (let hold of globalHoldCache.getHolds(this.cameraID, onFetched)) {
+			if (hold.expiresAt !== 0 && hold.expiresAt < nowMS) {
+				continue;
+			}
+			let x1 = this.timeMSToPixel(hold.startTime, canvasWidth, pixelsPerSecond);
+			let x2 = this.timeMSToPixel(hold.endTime, canvasWidth, pixelsPerSecond);
+			if (x2 < 0 || x1 > canvasWidth) {
+				continue;
+			}
+			// Keep very short holds visible when zoomed out
+			let w = Math.max(x2 - x1, 2 * dpr);
+			cx.fillStyle = "rgba(255, 190, 0, 0.18)";
+			cx.fillRect(x1, 0, w, canvasHeight);
+			cx.fillStyle = "rgba(255, 190, 0, 0.9)";
+			cx.fillRect(x1, 0, w, 1.5 * dpr);
+		}
+	}
+
 	// Return the Y coordinate span of the timeline representing the given class of object (eg person, vehicle).
 	// If the object class is not drawn, returns null
 	tileTimelineSpan(detectedClass: string): { lineHeight: number, y: number } | null {
 		let topY = 4.5;
 		let lineHeight = 3 * window.devicePixelRatio;
-		let idx = this.classes.indexOf(detectedClass);
-		if (idx === -1) {
+		let idx = this.classRow[detectedClass];
+		if (idx === undefined) {
 			return null
 		} else {
 			return { lineHeight, y: topY + idx * (lineHeight + 1) };
@@ -420,7 +497,7 @@ export class SeekBarContext {
 		}
 		for (let icls = 0; icls < this.classes.length; icls++) {
 			cx.fillStyle = this.colors[icls];
-			let bitmap = tile.classes[this.classes[icls]];
+			let bitmap = this.rowBitmap(tile, icls);
 			if (bitmap) {
 				SeekBarContext.countBitsInSlidingWindow(bitmap, bitWindowCount, 3);
 				//console.log(this.cameraID, "window", bitWindowCount);
@@ -462,7 +539,31 @@ export class SeekBarContext {
 	// Count the number of bits in a sliding window of windowSize size, and write that number
 	// into bitWindowCount.
 	// NOTE: The filter is not symmetrical. Should fix it.
-	static countBitsInSlidingWindow(bitmap: Uint8Array, bitWindowCount: Uint8Array, windowSize: number) {
+	// Returns the union of the bitmaps of all classes that are drawn in the given row, or null if there are none
+	rowBitmap(tile: EventTile, row: number): Uint8Array | null {
+		let result: Uint8Array | null = null;
+		let isCopy = false; // Don't modify the tile's own bitmaps, because they're cached
+		for (let cls in tile.classes) {
+			if (this.classRow[cls] !== row) {
+				continue;
+			}
+			let bitmap = tile.classes[cls];
+			if (result === null) {
+				result = bitmap;
+				continue;
+			}
+			if (!isCopy) {
+				result = new Uint8Array(result);
+				isCopy = true;
+			}
+			for (let i = 0; i < bitmap.length; i++) {
+				result[i] |= bitmap[i];
+			}
+		}
+		return result;
+	}
+
+		static countBitsInSlidingWindow(bitmap: Uint8Array, bitWindowCount: Uint8Array, windowSize: number) {
 		let n = bitmap.length * 8;
 		let count = 0;
 		for (let i = 0; i < n; i++) {
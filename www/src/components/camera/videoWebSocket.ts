@@ -67,6 +67,11 @@ export class VideoStreamerIO {
 		let codec32 = dv.getUint32(4, false); // "H264" or "H265", in big endian byte order so that it looks pretty on the wire, and left-to-right in hex as 0x48323634 or 0x48323635
 		let flags = dv.getUint32(8, true);
 		let recvID = dv.getUint32(12, true);
+		if ((flags & 4) !== 0) {
+			// Audio frame (only sent when requested with audio=1). SYNC-CAMERA-WEBSOCKET-AUDIO-FRAME
+			// We don't play live audio yet.
+			return null;
+		}
 		let keyframe = (flags & 1) !== 0;
 		let backlog = (flags & 2) !== 0; // Is this packet part of the backlog of packets, from the most recent keyframe up to the present?
 		//console.log("pts", pts);
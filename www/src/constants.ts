@@ -1,14 +1,19 @@
 import { reactive } from "vue";
 import { fetchOrErr } from "./util/util";
+import type { ClassesJSON } from "./db/config/configdb";
 
 // Random bag of constants from the server
 export interface Constants {
 	cameraModels: string[];
+	nnClasses: string[]; // Classes that our neural network detects (not necessarily COCO classes)
+	classes: ClassesJSON | null; // The system's class config, after defaults have been applied
 }
 
 // constants is initialized before the Vue application is loaded, so it's always available
 export let constants: Constants = reactive({
 	cameraModels: [],
+	nnClasses: [],
+	classes: null,
 });
 
 function setConstantsFromJSON(j: Constants) {
@@ -16,6 +21,8 @@ function setConstantsFromJSON(j: Constants) {
 	// If we just do constants = reactive(j), then Vue will not notice that the object has changed.
 	// I find this surprising.
 	constants.cameraModels = j.cameraModels;
+	constants.nnClasses = j.nnClasses ?? [];
+	constants.classes = j.classes ?? null;
 }
 
 // load constants from server, and if server is unreachable, then load from localStorage
@@ -41,6 +41,43 @@ export class UserRecord {
 	}
 }
 
+// A vertex of a privacy mask, in normalized coordinates (0..1)
+export interface Point {
+	x: number;
+	y: number;
+}
+
+// Overrides of the monitor's object tracking thresholds. Undefined means "use the default".
+// SYNC-ANALYZER-THRESHOLDS
+export interface AnalyzerThresholds {
+	minSightings?: number; // Number of sightings before an object is considered genuine
+	minDistance?: number; // Distance (in pixels of the LD stream) that an object must move before it is considered genuine
+	objectForgetTime?: number; // Seconds without a sighting, before we believe an object has left
+	revalidateInterval?: number; // Seconds between HQ re-checks of an object that the HQ network rejected
+}
+
+// SYNC-ANALYZER-SETTINGS
+export interface AnalyzerSettings extends AnalyzerThresholds {
+	classes?: { [className: string]: AnalyzerThresholds }; // Class overrides, which take precedence over the camera-wide values
+}
+
+// Which NN classes we track, and how we group them. Null means "inherit".
+// SYNC-CLASSES-JSON
+export interface ClassesJSON {
+	tracked: string[] | null; // Classes that we track. Tracking an abstract class tracks all the classes that map to it.
+	merge: { [className: string]: string } | null; // Boxes of these pairs with a high IoU are merged into the class on the right, eg {"truck": "car"}
+	abstract: { [className: string]: string } | null; // Concrete to abstract class, eg {"dog": "animal"}
+	alarm: string[] | null; // Classes that trigger the alarm, eg ["person"]
+}
+
+// A region of the frame where the monitor looks for small, distant objects in the HD stream
+// SYNC-REGION-OF-INTEREST-JSON
+export interface RegionOfInterest {
+	rect: string; // Normalized "x1,y1,x2,y2"
+	intervalMS?: number; // Time between scans of the region (default 1000)
+	tiled?: boolean; // Scan at full HD resolution, in tiles of the NN size
+}
+
 // SYNC-RECORD-CAMERA
 export class CameraRecord {
 	id = 0;
@@ -56,6 +93,17 @@ export class CameraRecord {
 	updatedAt = new Date();
 	detectionZone: DetectionZone | null = null;
 	enableAlarm = true;
+	enableAudio = false; // Record the camera's microphone, alongside the HD stream
+	minRetentionDays = 0; // Never delete footage younger than this (0 = no guarantee)
+	maxRetentionDays = 0; // Delete footage older than this (0 = no limit)
+	maxStorageSize = ""; // Byte quota for this camera, eg "200GB" (empty = no quota)
+	thinHDAfterDays = 0; // Reduce HD footage older than this to keyframes only (0 = never)
+	parentID = 0; // If non-zero, this is a virtual camera, which is a crop of the parent's HD stream
+	crop = ""; // Crop rectangle of a virtual camera, as normalized "x1,y1,x2,y2"
+	privacyMasks: Point[][] = []; // Polygons that are blacked out, in normalized coordinates
+	analyzerSettings: AnalyzerSettings = {}; // Per camera and per class object tracking thresholds
+	classes: ClassesJSON | null = null; // Overrides of the system's class config
+	regionsOfInterest: RegionOfInterest[] = []; // Regions that are scanned for small objects in the HD stream
 
 	static fromJSON(j: any): CameraRecord {
 		let x = new CameraRecord();
@@ -71,6 +119,25 @@ export class CameraRecord {
 		x.createdAt = new Date(j.createdAt);
 		x.updatedAt = new Date(j.updatedAt);
 		x.enableAlarm = j.enableAlarm;
+		x.enableAudio = j.enableAudio ?? false;
+		x.minRetentionDays = j.minRetentionDays ?? 0;
+		x.maxRetentionDays = j.maxRetentionDays ?? 0;
+		x.maxStorageSize = j.maxStorageSize ?? "";
+		x.thinHDAfterDays = j.thinHDAfterDays ?? 0;
+		x.parentID = j.parentID ?? 0;
+		x.crop = j.crop ?? "";
+		if (j.privacyMasks) {
+			x.privacyMasks = JSON.parse(j.privacyMasks);
+		}
+		if (j.analyzerSettings) {
+			x.analyzerSettings = JSON.parse(j.analyzerSettings);
+		}
+		if (j.classes) {
+			x.classes = JSON.parse(j.classes);
+		}
+		if (j.regionsOfInterest) {
+			x.regionsOfInterest = JSON.parse(j.regionsOfInterest);
+		}
 		if (j.detectionZone && j.detectionZone !== "") {
 			x.detectionZone = DetectionZone.decodeBase64(j.detectionZone);
 		}
@@ -99,6 +166,17 @@ export class CameraRecord {
 			createdAt: this.createdAt.getTime(),
 			updatedAt: this.updatedAt.getTime(),
 			enableAlarm: this.enableAlarm,
+			enableAudio: this.enableAudio,
+			minRetentionDays: this.minRetentionDays,
+			maxRetentionDays: this.maxRetentionDays,
+			maxStorageSize: this.maxStorageSize,
+			thinHDAfterDays: this.thinHDAfterDays,
+			parentID: this.parentID,
+			crop: this.crop,
+			privacyMasks: this.privacyMasks.length === 0 ? "" : JSON.stringify(this.privacyMasks),
+			analyzerSettings: Object.keys(this.analyzerSettings).length === 0 ? "" : JSON.stringify(this.analyzerSettings),
+			classes: this.classes ? JSON.stringify(this.classes) : "",
+			regionsOfInterest: this.regionsOfInterest.length === 0 ? "" : JSON.stringify(this.regionsOfInterest),
 		};
 		if (this.detectionZone) {
 			j.detectionZone = this.detectionZone.toBase64();
@@ -120,6 +198,17 @@ export class CameraRecord {
 		c.createdAt = this.createdAt;
 		c.updatedAt = this.updatedAt;
 		c.enableAlarm = this.enableAlarm;
+		c.enableAudio = this.enableAudio;
+		c.minRetentionDays = this.minRetentionDays;
+		c.maxRetentionDays = this.maxRetentionDays;
+		c.maxStorageSize = this.maxStorageSize;
+		c.thinHDAfterDays = this.thinHDAfterDays;
+		c.parentID = this.parentID;
+		c.crop = this.crop;
+		c.privacyMasks = this.privacyMasks.map((p) => p.map((v) => ({ ...v })));
+		c.analyzerSettings = JSON.parse(JSON.stringify(this.analyzerSettings));
+		c.classes = this.classes ? JSON.parse(JSON.stringify(this.classes)) : null;
+		c.regionsOfInterest = this.regionsOfInterest.map((r) => ({ ...r }));
 		if (this.detectionZone) {
 			c.detectionZone = this.detectionZone.clone();
 		}
@@ -138,3 +227,47 @@ export class CameraRecord {
 		return fetchOrErr('/api/config/changeCamera', { method: "POST", body: JSON.stringify(this.toJSON()) });
 	}
 }
+
+// SYNC-RECORD-MOSAIC-LAYOUT
+export class MosaicLayoutRecord {
+	id = 0;
+	userID = 0;
+	name = "";
+	numColumns = 2;
+	numRows = 2;
+	width = 0; // Zero = server default (1280)
+	height = 0; // Zero = server default (720)
+	fps = 0; // Zero = server default (5)
+	cameras: number[] = []; // Camera ID of each cell, in row-major order. Zero = empty cell.
+	createdAt = new Date();
+	updatedAt = new Date();
+
+	static fromJSON(j: any): MosaicLayoutRecord {
+		let x = new MosaicLayoutRecord();
+		x.id = j.id;
+		x.userID = j.userID;
+		x.name = j.name;
+		x.numColumns = j.numColumns;
+		x.numRows = j.numRows;
+		x.width = j.width ?? 0;
+		x.height = j.height ?? 0;
+		x.fps = j.fps ?? 0;
+		x.cameras = j.cameras ?? [];
+		x.createdAt = new Date(j.createdAt);
+		x.updatedAt = new Date(j.updatedAt);
+		return x;
+	}
+
+	toJSON(): any {
+		return {
+			id: this.id,
+			name: this.name,
+			numColumns: this.numColumns,
+			numRows: this.numRows,
+			width: this.width,
+			height: this.height,
+			fps: this.fps,
+			cameras: this.cameras,
+		};
+	}
+}